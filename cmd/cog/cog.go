@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/replicate/cog/pkg/cli"
 	"github.com/replicate/cog/pkg/util/console"
 )
@@ -10,6 +12,7 @@ func main() {
 	if err != nil {
 		console.Fatalf("%f", err)
 	}
+	cli.RunAsDockerCredentialHelper(cmd, os.Args[0])
 
 	if err = cmd.Execute(); err != nil {
 		console.Fatalf("%s", err)
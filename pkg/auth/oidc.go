@@ -0,0 +1,250 @@
+// Package auth logs in to private registries and build services with
+// OpenID Connect, so people log in with their organization's identity
+// provider, like Okta, or Dex or Keycloak in front of LDAP, and get
+// short-lived tokens instead of long-lived passwords.
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Token is what the provider issued on logging in, or refreshing.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	IDToken      string    `json:"id_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// Expired returns whether the token has expired, or is about to.
+func (t *Token) Expired() bool {
+	return !t.Expiry.IsZero() && time.Now().Add(time.Minute).After(t.Expiry)
+}
+
+// DeviceCode is what the person logging in needs to approve the login.
+type DeviceCode struct {
+	UserCode string
+	// VerificationURI is where to enter UserCode, and
+	// VerificationURIComplete is the same with UserCode already filled in,
+	// if the provider supports it
+	VerificationURI         string
+	VerificationURIComplete string
+}
+
+// Client gets tokens from an OpenID Connect provider.
+type Client struct {
+	Provider   config.OIDCProvider
+	HTTPClient *http.Client
+	// Sleep waits between polls for the login to be approved
+	Sleep func(time.Duration)
+}
+
+// NewClient returns a client of provider.
+func NewClient(provider config.OIDCProvider) *Client {
+	return &Client{Provider: provider, HTTPClient: http.DefaultClient, Sleep: time.Sleep}
+}
+
+type discovery struct {
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+}
+
+func (c *Client) discover() (*discovery, error) {
+	discoveryURL := strings.TrimSuffix(c.Provider.Issuer, "/") + "/.well-known/openid-configuration"
+	d := &discovery{}
+	if err := c.do(http.MethodGet, discoveryURL, nil, d); err != nil {
+		return nil, fmt.Errorf("Failed to get the OpenID configuration of %s: %w", c.Provider.Issuer, err)
+	}
+	if d.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("%s doesn't support logging in with a device code", c.Provider.Issuer)
+	}
+	return d, nil
+}
+
+// DeviceLogin logs in with the device authorization flow (RFC 8628).
+// prompt is called with the code the person logging in needs to approve,
+// then it waits until they have.
+func (c *Client) DeviceLogin(prompt func(DeviceCode)) (*Token, error) {
+	d, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+	authorization := &struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{}
+	form := url.Values{"client_id": {c.Provider.ClientID}, "scope": {c.scope()}}
+	if err := c.do(http.MethodPost, d.DeviceAuthorizationEndpoint, form, authorization); err != nil {
+		return nil, fmt.Errorf("Failed to start logging in: %w", err)
+	}
+	prompt(DeviceCode{
+		UserCode:                authorization.UserCode,
+		VerificationURI:         authorization.VerificationURI,
+		VerificationURIComplete: authorization.VerificationURIComplete,
+	})
+
+	interval := time.Duration(authorization.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	form = url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {authorization.DeviceCode},
+		"client_id":   {c.Provider.ClientID},
+	}
+	for {
+		c.Sleep(interval)
+		token, err := c.token(d.TokenEndpoint, form)
+		if err == nil {
+			return token, nil
+		}
+		oauthErr, ok := err.(*oauthError)
+		if !ok {
+			return nil, err
+		}
+		switch oauthErr.Code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return nil, fmt.Errorf("The login was denied")
+		case "expired_token":
+			return nil, fmt.Errorf("The login code expired before it was approved. Run cog login again")
+		default:
+			return nil, err
+		}
+		if authorization.ExpiresIn > 0 && time.Now().After(deadline) {
+			return nil, fmt.Errorf("The login code expired before it was approved. Run cog login again")
+		}
+	}
+}
+
+// Refresh gets a new token with refreshToken.
+func (c *Client) Refresh(refreshToken string) (*Token, error) {
+	d, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.token(d.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {c.Provider.ClientID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Providers may keep the same refresh token, and not send it again
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+func (c *Client) token(endpoint string, form url.Values) (*Token, error) {
+	response := &struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}{}
+	if err := c.do(http.MethodPost, endpoint, form, response); err != nil {
+		return nil, err
+	}
+	token := &Token{AccessToken: response.AccessToken, RefreshToken: response.RefreshToken, IDToken: response.IDToken}
+	if response.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+func (c *Client) scope() string {
+	scopes := []string{"openid"}
+	for _, scope := range c.Provider.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// oauthError is an error response from an OAuth 2.0 endpoint
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// do sends form to endpoint, or gets it if form is nil, and decodes the
+// JSON response into v.
+func (c *Client) do(method string, endpoint string, form url.Values, v interface{}) error {
+	body := strings.NewReader("")
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		oauthErr := &oauthError{}
+		if err := json.NewDecoder(resp.Body).Decode(oauthErr); err == nil && oauthErr.Code != "" {
+			return oauthErr
+		}
+		return fmt.Errorf("%s returned HTTP status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Username returns who the ID token says logged in. The token isn't
+// verified, as it came straight from the provider's token endpoint over
+// TLS, and it's only used to name the login.
+func Username(idToken string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("The ID token isn't a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode the ID token: %w", err)
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("Failed to decode the ID token: %w", err)
+	}
+	for _, claim := range []string{"preferred_username", "email", "sub"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("The ID token doesn't say who logged in")
+}
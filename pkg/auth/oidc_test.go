@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// fakeProvider is an OpenID Connect provider that approves a login after
+// pending polls, and asks to slow down once.
+func fakeProvider(t *testing.T, pending int) *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		require.NoError(t, json.NewEncoder(w).Encode(v))
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"device_authorization_endpoint": server.URL + "/device",
+			"token_endpoint":                server.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "cog", r.PostForm.Get("client_id"))
+		require.Equal(t, "openid offline_access", r.PostForm.Get("scope"))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"device_code":      "device-123",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": server.URL + "/activate",
+			"expires_in":       600,
+			"interval":         1,
+		})
+	})
+	polls := 0
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		switch r.PostForm.Get("grant_type") {
+		case deviceCodeGrantType:
+			require.Equal(t, "device-123", r.PostForm.Get("device_code"))
+			polls++
+			if polls == 1 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "slow_down"})
+				return
+			}
+			if polls <= pending {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "authorization_pending"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"access_token":  "access-1",
+				"refresh_token": "refresh-1",
+				"id_token":      jwt(t, map[string]string{"sub": "123", "email": "ada@example.com"}),
+				"expires_in":    300,
+			})
+		case "refresh_token":
+			require.Equal(t, "refresh-1", r.PostForm.Get("refresh_token"))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "access-2", "expires_in": 300})
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		}
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func jwt(t *testing.T, claims map[string]string) string {
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".c2ln"
+}
+
+func testClient(issuer string, sleeps *[]time.Duration) *Client {
+	client := NewClient(config.OIDCProvider{Issuer: issuer, ClientID: "cog", Scopes: []string{"offline_access"}})
+	client.Sleep = func(d time.Duration) { *sleeps = append(*sleeps, d) }
+	return client
+}
+
+func TestDeviceLogin(t *testing.T) {
+	server := fakeProvider(t, 3)
+	sleeps := []time.Duration{}
+	client := testClient(server.URL, &sleeps)
+
+	var prompted DeviceCode
+	token, err := client.DeviceLogin(func(code DeviceCode) { prompted = code })
+	require.NoError(t, err)
+	require.Equal(t, DeviceCode{UserCode: "ABCD-EFGH", VerificationURI: server.URL + "/activate"}, prompted)
+	require.Equal(t, "access-1", token.AccessToken)
+	require.Equal(t, "refresh-1", token.RefreshToken)
+	require.False(t, token.Expired())
+	// slow_down adds 5 seconds to the interval
+	require.Equal(t, []time.Duration{time.Second, 6 * time.Second, 6 * time.Second, 6 * time.Second}, sleeps)
+
+	username, err := Username(token.IDToken)
+	require.NoError(t, err)
+	require.Equal(t, "ada@example.com", username)
+}
+
+func TestRefresh(t *testing.T) {
+	server := fakeProvider(t, 0)
+	sleeps := []time.Duration{}
+	token, err := testClient(server.URL, &sleeps).Refresh("refresh-1")
+	require.NoError(t, err)
+	require.Equal(t, "access-2", token.AccessToken)
+	// The provider didn't send a new refresh token, so the old one is kept
+	require.Equal(t, "refresh-1", token.RefreshToken)
+}
+
+func TestDeviceLoginWithoutDeviceFlow(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"token_endpoint": "https://example.com/token"}`))
+	}))
+	defer server.Close()
+	sleeps := []time.Duration{}
+	_, err := testClient(server.URL, &sleeps).DeviceLogin(func(DeviceCode) {})
+	require.ErrorContains(t, err, "doesn't support logging in with a device code")
+}
+
+func TestTokenExpired(t *testing.T) {
+	require.False(t, (&Token{}).Expired())
+	require.False(t, (&Token{Expiry: time.Now().Add(time.Hour)}).Expired())
+	require.True(t, (&Token{Expiry: time.Now().Add(30 * time.Second)}).Expired())
+}
+
+func TestUsername(t *testing.T) {
+	username, err := Username(jwt(t, map[string]string{"sub": "123", "preferred_username": "ada"}))
+	require.NoError(t, err)
+	require.Equal(t, "ada", username)
+	username, err = Username(jwt(t, map[string]string{"sub": "123"}))
+	require.NoError(t, err)
+	require.Equal(t, "123", username)
+	_, err = Username("not-a-jwt")
+	require.ErrorContains(t, err, "isn't a JWT")
+}
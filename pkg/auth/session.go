@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/credentials"
+)
+
+// session is what's kept in the credential store for a host: who logged in, and
+// their tokens
+type session struct {
+	Username string `json:"username"`
+	Token    Token  `json:"token"`
+}
+
+// sessionName is what the session for host is kept as in the credential
+// store, apart from the registry credentials Docker reads
+func sessionName(host string) string {
+	return "oidc/" + strings.ToLower(host)
+}
+
+// Login logs in to host with provider, and keeps the tokens in the OS
+// keychain, or the encrypted file if there isn't one. The access token is
+// saved as the Docker credentials for host, so Docker can push to it if
+// it's a registry.
+func Login(host string, provider config.OIDCProvider, prompt func(DeviceCode)) (username string, err error) {
+	// Fail before logging in if the tokens can't be kept
+	store, err := credentials.Open(true)
+	if err != nil {
+		return "", err
+	}
+	token, err := NewClient(provider).DeviceLogin(prompt)
+	if err != nil {
+		return "", err
+	}
+	username = provider.Username
+	if username == "" {
+		if username, err = Username(token.IDToken); err != nil {
+			return "", err
+		}
+	}
+	if err := save(store, host, session{Username: username, Token: *token}); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// AccessToken returns an access token for host that hasn't expired, and
+// refreshes it first if it has.
+func AccessToken(host string, provider config.OIDCProvider) (string, error) {
+	store, err := credentials.Open(true)
+	if err != nil {
+		return "", err
+	}
+	secret, ok, err := store.Get(sessionName(host))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("You're not logged in to %s. Run 'cog login --registry %s'", host, host)
+	}
+	s := session{}
+	if err := json.Unmarshal([]byte(secret), &s); err != nil {
+		return "", fmt.Errorf("Failed to read the login to %s from %s: %w", host, store.Location(), err)
+	}
+	if !s.Token.Expired() {
+		return s.Token.AccessToken, nil
+	}
+	if s.Token.RefreshToken == "" {
+		return "", fmt.Errorf("The login to %s has expired. Run 'cog login --registry %s'", host, host)
+	}
+	token, err := NewClient(provider).Refresh(s.Token.RefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("Failed to refresh the login to %s, so it may have expired. Run 'cog login --registry %s': %w", host, host, err)
+	}
+	s.Token = *token
+	if err := save(store, host, s); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+func save(store credentials.Store, host string, s session) error {
+	secret, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := store.Set(sessionName(host), string(secret)); err != nil {
+		return err
+	}
+	_, err = credentials.SaveRegistryLogin(host, s.Username, s.Token.AccessToken)
+	return err
+}
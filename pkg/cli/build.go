@@ -1,11 +1,20 @@
 package cli
 
 import (
+	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/docker/go-units"
 
 	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/dockerfile"
 	"github.com/replicate/cog/pkg/image"
 	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/slices"
 	"github.com/spf13/cobra"
 )
 
@@ -13,23 +22,86 @@ var (
 	buildTag            string
 	buildProgressOutput string
 	groupFile           bool
+	layerGroups         int
+	largeFileThreshold  string
+	buildMatrix         bool
+	buildPush           bool
+	buildBuilder        string
+	buildCacheScope     string
+	buildCPUs           float64
+	buildMemory         string
+	buildStrict         bool
+	buildNoCache        bool
+	buildNoCacheFilter  []string
+	buildStage          string
+	buildSSH            string
+	buildPlatforms      []string
+	buildVariants       []string
+	buildOffline        bool
+	buildPythonTarball  string
+	buildWheelhouse     string
+	buildBackend        string
+	configFile          string
 )
 
+// buildPlatformsSupported are the platforms models can be built for
+var buildPlatformsSupported = []string{"linux/amd64", "linux/arm64"}
+
 func newBuildCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "build",
+		Use:   "build [GIT_URL]",
 		Short: "Build an image from cog.yaml",
-		Args:  cobra.NoArgs,
-		RunE:  buildCommand,
+		Long: `Build an image from cog.yaml.
+
+With a git URL, the repository is cloned and the model in it is built,
+without a local checkout. It's in the same format as docker build's git
+contexts: the URL, optionally followed by #ref, or #ref:dir for a model in a
+directory of the repository. The ref can be a branch, tag, or commit.
+
+Private repositories are cloned with git's credential helpers or SSH agent,
+or over HTTPS with a token in the ` + image.GitTokenEnv + ` environment variable.`,
+		Example: `  cog build https://github.com/org/model.git#v1.2 --push -t registry.example.com/org/model:v1.2`,
+		Args:    cobra.MaximumNArgs(1),
+		RunE:    buildCommand,
 	}
 	addBuildProgressOutputFlag(cmd)
 	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
+	addBuildIsolationFlags(cmd)
+	addBuildVerifyFlag(cmd)
+	addBuildStrictFlag(cmd)
+	addBuildSSHFlag(cmd)
+	addBuildOfflineFlags(cmd)
+	cmd.Flags().StringVar(&buildBackend, "backend", "dockerfile", "How to build the image: 'dockerfile' builds the generated Dockerfile with docker build, and 'llb' converts its stages to BuildKit's LLB in Cog and builds that with BuildKit directly. 'cog debug dockerfile' shows the Dockerfile either way")
 	cmd.Flags().StringVarP(&buildTag, "tag", "t", "", "A name for the built image in the form 'repository:tag'")
+	cmd.Flags().BoolVar(&buildMatrix, "matrix", false, "Build every combination of options in the 'matrix' in cog.yaml, in parallel")
+	cmd.Flags().BoolVar(&buildPush, "push", false, "Push the image after it's built. With several --platform, push all the images and an image index (manifest list) referencing them. With --matrix or --variant, push each image as an image index with its own tag")
+	cmd.Flags().StringSliceVar(&buildVariants, "variant", nil, "Build these variants of the model, cpu and/or gpu, from the same cog.yaml, tagged :cpu and :gpu")
+	cmd.Flags().StringSliceVar(&buildPlatforms, "platform", nil, "Build for these platforms, like linux/arm64,linux/amd64. Several platforms are built as an image each, tagged with the platform")
+	cmd.Flags().BoolVar(&buildNoCache, "no-cache", false, "Build every step without the cache")
+	cmd.Flags().StringSliceVar(&buildNoCacheFilter, "no-cache-filter", nil, "Build these steps without the cache, and the steps after them: "+strings.Join(dockerfile.CacheStages, ", "))
+	cmd.Flags().StringVar(&buildStage, "target", "", "Only build the image up to this step, to work on it without building the rest: "+strings.Join(dockerfile.CacheStages, ", "))
 	return cmd
 }
 
 func buildCommand(cmd *cobra.Command, args []string) error {
-	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	dir := projectDirFlag
+	if len(args) > 0 {
+		source, err := image.ParseGitSource(args[0])
+		if err != nil {
+			return err
+		}
+		cloneDir, err := os.MkdirTemp("", "cog-build-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(cloneDir)
+		if dir, err = source.Clone(cloneDir); err != nil {
+			return err
+		}
+	}
+
+	cfg, projectDir, err := getBuildConfigIn(dir)
 	if err != nil {
 		return err
 	}
@@ -42,12 +114,247 @@ func buildCommand(cmd *cobra.Command, args []string) error {
 		imageName = config.DockerImageName(projectDir)
 	}
 
-	if err := image.Build(cfg, projectDir, imageName, buildProgressOutput, groupFile); err != nil {
+	if err := validateBuildIsolationFlags(); err != nil {
+		return err
+	}
+
+	if err := validateBuildPlatforms(); err != nil {
 		return err
 	}
 
+	if !slices.ContainsString(docker.Backends, buildBackend) {
+		return fmt.Errorf("--backend must be one of %s, not '%s'", strings.Join(docker.Backends, ", "), buildBackend)
+	}
+
+	if buildStage != "" {
+		if !slices.ContainsString(dockerfile.CacheStages, buildStage) {
+			return fmt.Errorf("--target must be one of %s, not '%s'", strings.Join(dockerfile.CacheStages, ", "), buildStage)
+		}
+		if buildPush {
+			return fmt.Errorf("--target can't be used with --push, because the image isn't complete")
+		}
+		if buildVerify != "" {
+			return fmt.Errorf("--target can't be used with --verify, because the image isn't complete")
+		}
+	}
+
+	if buildMatrix {
+		if buildVerify != "" {
+			return fmt.Errorf("--verify can't be used with --matrix")
+		}
+		if len(buildPlatforms) > 1 {
+			return fmt.Errorf("--matrix can't be used with more than one --platform")
+		}
+		if len(buildVariants) > 0 {
+			return fmt.Errorf("--matrix can't be used with --variant")
+		}
+		return buildMatrixImages(cfg, projectDir, imageName)
+	}
+	if len(buildVariants) > 0 {
+		if buildVerify != "" {
+			return fmt.Errorf("--verify can't be used with --variant")
+		}
+		if len(buildPlatforms) > 1 {
+			return fmt.Errorf("--variant can't be used with more than one --platform")
+		}
+		return buildVariantImages(cfg, projectDir, imageName)
+	}
+	if len(buildPlatforms) > 1 {
+		if buildVerify != "" {
+			return fmt.Errorf("--verify can't be used with more than one --platform")
+		}
+		return buildPlatformImages(cfg, projectDir, imageName)
+	}
+	if buildPush {
+		if err := image.CheckPushPolicy(imageName); err != nil {
+			return err
+		}
+	}
+
+	if err := buildImage(cfg, projectDir, imageName); err != nil {
+		return err
+	}
+
+	if buildStage != "" {
+		console.Infof("\nImage built as %s, up to the %s step", imageName, buildStage)
+		return nil
+	}
 	console.Infof("\nImage built as %s", imageName)
 
+	if !buildPush {
+		return nil
+	}
+	if err := image.CheckPushSize(imageName); err != nil {
+		return err
+	}
+	console.Infof("\nPushing image '%s'...", imageName)
+	if err := image.Push(cfg, imageName); err != nil {
+		return err
+	}
+	console.Infof("Image '%s' pushed", imageName)
+	return nil
+}
+
+// buildTarget is one of several images built from one cog.yaml
+type buildTarget struct {
+	imageName string
+	config    *config.Config
+	options   docker.BuildOptions
+	// description is shown next to the image name, if it isn't in the tag
+	description string
+}
+
+func buildMatrixImages(cfg *config.Config, projectDir string, imageName string) error {
+	variants, err := cfg.MatrixVariants()
+	if err != nil {
+		return err
+	}
+	return buildImages(projectDir, imageName, variantTargets(imageName, variants), false)
+}
+
+// buildVariantImages builds the CPU and GPU variants of the model in
+// buildVariants, tagged :cpu and :gpu.
+func buildVariantImages(cfg *config.Config, projectDir string, imageName string) error {
+	variants, err := cfg.HardwareVariants(buildVariants)
+	if err != nil {
+		return err
+	}
+	return buildImages(projectDir, imageName, variantTargets(imageName, variants), false)
+}
+
+func variantTargets(imageName string, variants []config.MatrixVariant) []buildTarget {
+	targets := []buildTarget{}
+	for _, variant := range variants {
+		targets = append(targets, buildTarget{
+			imageName: config.MatrixImageName(imageName, variant.Name),
+			config:    variant.Config,
+			options:   buildOptions(),
+		})
+	}
+	return targets
+}
+
+// buildPlatformImages builds an image for each of buildPlatforms, tagged
+// with the platform.
+func buildPlatformImages(cfg *config.Config, projectDir string, imageName string) error {
+	targets := []buildTarget{}
+	for _, platform := range buildPlatforms {
+		opts := buildOptions()
+		opts.Platform = platform
+		targets = append(targets, buildTarget{
+			imageName:   config.MatrixImageName(imageName, strings.ReplaceAll(platform, "/", "-")),
+			config:      cfg,
+			options:     opts,
+			description: platform,
+		})
+	}
+	return buildImages(projectDir, imageName, targets, true)
+}
+
+// buildImages builds targets in parallel. With --push, they're pushed with
+// image indexes (manifest lists), which annotate them with the hardware
+// they're for. If they're for different platforms, one index references
+// them all as imageName, so clients pull the one for their platform.
+// Otherwise, each is pushed as an index of its own, with its own tag,
+// because an index can only have one image for each platform.
+func buildImages(projectDir string, imageName string, targets []buildTarget, platformIndex bool) error {
+	if buildPush {
+		if err := image.CheckPushPolicy(imageName); err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if err := image.CheckPushPolicy(target.imageName); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Interleaved TTY output from parallel builds is unreadable
+	progressOutput := buildProgressOutput
+	if progressOutput == "auto" || progressOutput == "tty" {
+		progressOutput = "plain"
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target buildTarget) {
+			defer wg.Done()
+			errs[i] = image.Build(target.config, projectDir, target.imageName, progressOutput, groupFile, target.options)
+		}(i, target)
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for i, err := range errs {
+		if err != nil {
+			console.Errorf("Failed to build %s: %s", targets[i].imageName, err)
+			failed = append(failed, targets[i].imageName)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to build %s", strings.Join(failed, ", "))
+	}
+
+	console.Infof("\nImages built as:")
+	for _, target := range targets {
+		if target.description != "" {
+			console.Infof("  %s (%s)", target.imageName, target.description)
+		} else {
+			console.Infof("  %s", target.imageName)
+		}
+	}
+
+	if !buildPush {
+		return nil
+	}
+	for _, target := range targets {
+		if err := image.CheckPushSize(target.imageName); err != nil {
+			return err
+		}
+	}
+	entries := []image.IndexEntry{}
+	for _, target := range targets {
+		console.Infof("\nPushing image '%s'...", target.imageName)
+		if err := image.Push(target.config, target.imageName); err != nil {
+			return fmt.Errorf("Failed to push %s: %w", target.imageName, err)
+		}
+		entries = append(entries, image.IndexEntry{Image: target.imageName, Config: target.config})
+	}
+	if !platformIndex {
+		for _, entry := range entries {
+			console.Infof("\nPushing image index '%s'...", entry.Image)
+			if err := image.PushImageIndex(entry.Image, []image.IndexEntry{entry}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	console.Infof("\nPushing image index '%s'...", imageName)
+	return image.PushImageIndex(imageName, entries)
+}
+
+// addBuildPlatformFlag adds --platform to commands that build one image
+func addBuildPlatformFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&buildPlatforms, "platform", nil, "Build for this platform, like linux/arm64, instead of the one Docker builds for")
+}
+
+// validateBuildPlatform checks --platform is one platform Cog can build
+// for, for commands that build one image.
+func validateBuildPlatform() error {
+	if len(buildPlatforms) > 1 {
+		return fmt.Errorf("--platform can only have one platform. Use 'cog build --platform' to build for several")
+	}
+	return validateBuildPlatforms()
+}
+
+func validateBuildPlatforms() error {
+	for _, platform := range buildPlatforms {
+		if !slices.ContainsString(buildPlatformsSupported, platform) {
+			return fmt.Errorf("Cog can't build for %s. It can build for %s", platform, strings.Join(buildPlatformsSupported, ", "))
+		}
+	}
 	return nil
 }
 
@@ -56,9 +363,121 @@ func addBuildProgressOutputFlag(cmd *cobra.Command) {
 	if os.Getenv("TERM") == "dumb" {
 		defaultOutput = "plain"
 	}
-	cmd.Flags().StringVar(&buildProgressOutput, "progress", defaultOutput, "Set type of build progress output, 'auto' (default), 'tty' or 'plain'")
+	cmd.Flags().StringVar(&buildProgressOutput, "progress", defaultOutput, "Set type of build progress output, 'auto' (default), 'tty', 'plain', or 'json' (a JSON object for each update, on stderr)")
+}
+
+func addBuildIsolationFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&buildBuilder, "builder", "", "The buildx builder to build with, e.g. a dedicated builder for each team on a shared build server")
+	cmd.Flags().StringVar(&buildCacheScope, "cache-scope", "", "Keep package caches separate from builds with a different cache scope")
+	cmd.Flags().Float64Var(&buildCPUs, "build-cpus", 0, "Limit the number of CPUs the build can use")
+	cmd.Flags().StringVar(&buildMemory, "build-memory", "", "Limit the memory the build can use, e.g. 8g")
+}
+
+func addBuildStrictFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&buildStrict, "strict", false, "Fail the build on problems that are otherwise warnings, like large files copied into the same layer as code")
+}
+
+func addBuildSSHFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&buildSSH, "ssh", "", "SSH agent socket or keys to forward to the build, like 'default' or 'default=~/.ssh/id_ed25519'. Defaults to the SSH agent if build.ssh is set in cog.yaml")
+	cmd.Flags().Lookup("ssh").NoOptDefVal = "default"
+}
+
+func addBuildOfflineFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&buildOffline, "offline", false, "Build without the internet, with a base image that's pulled already, and packages from --wheelhouse or mirrors on your network")
+	cmd.Flags().StringVar(&buildPythonTarball, "python-tarball", "", "A python-build-standalone install_only tarball to install Python from, instead of with pyenv")
+	cmd.Flags().StringVar(&buildWheelhouse, "wheelhouse", "", "A directory of wheels in the project to install Python packages from, instead of a package index. Overrides build.wheelhouse in cog.yaml")
+}
+
+var cacheScopeRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func validateBuildIsolationFlags() error {
+	if buildCacheScope != "" && !cacheScopeRegexp.MatchString(buildCacheScope) {
+		return fmt.Errorf("--cache-scope can only contain letters, numbers, '_', '.', and '-'")
+	}
+	if buildCPUs < 0 {
+		return fmt.Errorf("--build-cpus must be positive")
+	}
+	if buildNoCache && len(buildNoCacheFilter) > 0 {
+		return fmt.Errorf("--no-cache already builds every step without the cache, so it can't be used with --no-cache-filter")
+	}
+	for _, stage := range buildNoCacheFilter {
+		if !slices.ContainsString(dockerfile.CacheStages, stage) {
+			return fmt.Errorf("--no-cache-filter can only have %s, not '%s'", strings.Join(dockerfile.CacheStages, ", "), stage)
+		}
+	}
+	return nil
+}
+
+func buildOptions() docker.BuildOptions {
+	return docker.BuildOptions{
+		Builder:       buildBuilder,
+		CacheScope:    buildCacheScope,
+		CPUs:          buildCPUs,
+		Memory:        buildMemory,
+		Strict:        buildStrict,
+		NoCache:       buildNoCache,
+		NoCacheFilter: buildNoCacheFilter,
+		Target:        buildStage,
+		SSH:           buildSSH,
+		Platform:      buildPlatform(),
+		Offline:       buildOffline,
+		PythonTarball: buildPythonTarball,
+		Wheelhouse:    buildWheelhouse,
+		Backend:       buildBackend,
+	}
+}
+
+// buildPlatform returns the platform to build for, if a single one was
+// passed with --platform.
+func buildPlatform() string {
+	if len(buildPlatforms) == 1 {
+		return buildPlatforms[0]
+	}
+	return ""
 }
 
 func addGroupFileFlag(cmd *cobra.Command) {
 	cmd.Flags().BoolVarP(&groupFile, "groupfile", "g", false, "If set, cog will group small files into independent docker layer")
+	cmd.Flags().IntVar(&layerGroups, "layer-groups", 0, "Number of layers to split small files in the workspace into. Overrides build.layer_groups in cog.yaml")
+	cmd.Flags().StringVar(&largeFileThreshold, "large-file-threshold", "", "Size over which files in the workspace get a layer of their own, like 200MB. Overrides build.large_file_threshold in cog.yaml")
+}
+
+func addConfigFileFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&configFile, "file", "f", "", "Read the config from this file instead of cog.yaml, or from stdin with '-'. It can be YAML, JSON, or TOML. The project is the current directory")
+}
+
+// getBuildConfig loads cog.yaml, or the config from addConfigFileFlag, with
+// how the workspace is split into layers overridden by the flags from
+// addGroupFileFlag.
+func getBuildConfig() (*config.Config, string, error) {
+	return getBuildConfigIn(projectDirFlag)
+}
+
+// getBuildConfigIn is getBuildConfig for the project in dir, or the current
+// one if dir is "".
+func getBuildConfigIn(dir string) (*config.Config, string, error) {
+	var cfg *config.Config
+	var projectDir string
+	var err error
+	if configFile != "" {
+		cfg, projectDir, err = config.GetConfigFromFile(dir, configFile, os.Stdin)
+	} else {
+		cfg, projectDir, err = config.GetConfig(dir)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if layerGroups < 0 {
+		return nil, "", fmt.Errorf("--layer-groups can't be negative")
+	}
+	if layerGroups > 0 {
+		cfg.Build.LayerGroups = layerGroups
+	}
+	if largeFileThreshold != "" {
+		if _, err := units.FromHumanSize(largeFileThreshold); err != nil {
+			return nil, "", fmt.Errorf("--large-file-threshold must be a size like 200MB")
+		}
+		cfg.Build.LargeFileThreshold = largeFileThreshold
+	}
+	return cfg, projectDir, nil
 }
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/codegen"
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/slices"
+)
+
+var (
+	codegenLang      string
+	codegenOutput    string
+	codegenGoPackage string
+)
+
+func newCodegenCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "codegen [image]",
+		Short: "Generate a typed client for a model's HTTP API",
+		Long: `Generate a typed client for a model's HTTP API.
+
+The client is generated from the model's OpenAPI schema, with types for its
+inputs and output. It can run predictions and wait for their output, or start
+them asynchronously with a webhook.
+
+If 'image' is passed, the client is generated for that image. Otherwise, the
+model in the current directory is built first.`,
+		Example: `  cog codegen --lang python -o client.py
+  cog codegen --lang typescript r8.im/you/your-model`,
+		RunE: cmdCodegen,
+		Args: cobra.MaximumNArgs(1),
+	}
+	addBuildProgressOutputFlag(cmd)
+	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
+	cmd.Flags().StringVar(&codegenLang, "lang", "python", "Language of the client: "+strings.Join(codegen.Languages, ", "))
+	cmd.Flags().StringVarP(&codegenOutput, "output", "o", "", "Path to write the client to. Defaults to stdout")
+	cmd.Flags().StringVar(&codegenGoPackage, "package", "client", "Package of the client, for --lang go")
+	return cmd
+}
+
+func cmdCodegen(cmd *cobra.Command, args []string) error {
+	if !slices.ContainsString(codegen.Languages, codegenLang) {
+		return fmt.Errorf("Can't generate a client in %s. Languages are: %s", codegenLang, strings.Join(codegen.Languages, ", "))
+	}
+
+	var schema *openapi3.T
+	var err error
+	if len(args) == 1 {
+		schema, err = image.GetOpenAPISchema(args[0])
+	} else {
+		schema, err = buildOpenAPISchema()
+	}
+	if err != nil {
+		return err
+	}
+
+	source, err := codegen.Generate(schema, codegenLang, codegen.Options{GoPackage: codegenGoPackage})
+	if err != nil {
+		return err
+	}
+
+	if codegenOutput == "" {
+		console.Output(source)
+		return nil
+	}
+	if err := os.WriteFile(codegenOutput, []byte(source), 0o644); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", codegenOutput, err)
+	}
+	console.Infof("Written %s client to %s", codegenLang, codegenOutput)
+	return nil
+}
+
+// buildOpenAPISchema builds the model in the current directory and returns
+// its schema.
+func buildOpenAPISchema() (*openapi3.T, error) {
+	cfg, projectDir, err := getBuildConfig()
+	if err != nil {
+		return nil, err
+	}
+	imageName := cfg.Image
+	if imageName == "" {
+		imageName = config.DockerImageName(projectDir)
+	}
+	if err := image.Build(cfg, projectDir, imageName, buildProgressOutput, groupFile, buildOptions()); err != nil {
+		return nil, err
+	}
+	return image.GetOpenAPISchema(imageName)
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/global"
+)
+
+func newConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Read and edit " + global.ConfigFilename,
+	}
+
+	get := &cobra.Command{
+		Use:   "get KEY",
+		Short: "Print a value from " + global.ConfigFilename,
+		Long: `Print a value from ` + global.ConfigFilename + `.
+
+KEY is a dot-separated path, like build.python_version. Lists and mappings
+are printed as YAML.`,
+		Example: `cog config get image`,
+		RunE:    cmdConfigGet,
+		Args:    cobra.ExactArgs(1),
+	}
+
+	set := &cobra.Command{
+		Use:   "set KEY VALUE",
+		Short: "Set a value in " + global.ConfigFilename,
+		Long: `Set a value in ` + global.ConfigFilename + `.
+
+KEY is a dot-separated path, like build.python_version. VALUE is parsed as
+YAML, so it can be a list like '["ffmpeg", "git"]'. Comments and the order
+of keys in the file are kept, and the file is only written if the result is
+a valid config.`,
+		Example: `cog config set build.python_version 3.11`,
+		RunE:    cmdConfigSet,
+		Args:    cobra.ExactArgs(2),
+	}
+
+	cmd.AddCommand(get, set)
+	return cmd
+}
+
+func projectConfigPath() (string, error) {
+	projectDir, err := config.GetProjectDir(projectDirFlag)
+	if err != nil {
+		return "", err
+	}
+	configPath := path.Join(projectDir, global.ConfigFilename)
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return "", fmt.Errorf("%s not found in %s. Only %s can be edited by Cog, not cog.json or cog.toml", global.ConfigFilename, projectDir, global.ConfigFilename)
+	}
+	return configPath, nil
+}
+
+func cmdConfigGet(cmd *cobra.Command, args []string) error {
+	configPath, err := projectConfigPath()
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	value, err := config.GetValue(contents, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func cmdConfigSet(cmd *cobra.Command, args []string) error {
+	configPath, err := projectConfigPath()
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	contents, err = config.SetValue(contents, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if _, err := config.FromYAML(contents); err != nil {
+		return fmt.Errorf("Not writing %s, because setting %s would make it invalid: %w", global.ConfigFilename, args[0], err)
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, contents, info.Mode())
+}
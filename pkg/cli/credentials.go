@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/credentials"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+func newCredentialsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "credentials",
+		Short: "Keep secrets in the OS keychain",
+		Long: `Keep secrets in the OS keychain.
+
+Secrets are kept in the OS keychain (macOS Keychain, Windows Credential
+Manager, or Secret Service on Linux, with Docker's credential helpers). On
+machines without one, they're kept in ~/.config/cog/credentials.enc,
+encrypted with a passphrase that's typed in, or set with
+COG_CREDENTIALS_PASSPHRASE.
+
+Registry tokens from 'cog login' are kept the same way. For Docker to read
+them from the encrypted file, link cog as docker-credential-cog:
+
+    ln -s "$(which cog)" /usr/local/bin/docker-credential-cog`,
+	}
+
+	set := &cobra.Command{
+		Use:   "set NAME",
+		Short: "Set a secret, read from stdin",
+		Long: `Set a secret, read from stdin, or typed in without echoing it.
+
+NAME is one of:
+
+` + credentialNames(),
+		Example: `cog credentials set webhook_auth_token < token.txt`,
+		RunE:    cmdCredentialsSet,
+		Args:    cobra.ExactArgs(1),
+	}
+
+	del := &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a secret",
+		RunE:  cmdCredentialsDelete,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	cmd.AddCommand(set, del)
+	return cmd
+}
+
+const dockerCredentialHelperCommand = "docker-credential-helper"
+
+// newDockerCredentialHelperCommand is what Cog runs when it's run as
+// docker-credential-cog, so Docker can read registry tokens from the
+// encrypted file
+func newDockerCredentialHelperCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:    dockerCredentialHelperCommand + " ACTION",
+		Short:  "Run as Docker's credential helper for the encrypted credentials file",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return credentials.ServeDockerHelper(args[0], os.Stdin, os.Stdout)
+		},
+		Args: cobra.ExactArgs(1),
+	}
+}
+
+func credentialNames() string {
+	names := make([]string, 0, len(credentials.Names))
+	for name := range credentials.Names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %s: %s", name, credentials.Names[name]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func validateCredentialName(name string) error {
+	if _, ok := credentials.Names[name]; !ok {
+		return fmt.Errorf("Unknown credential %q. It must be one of:\n\n%s", name, credentialNames())
+	}
+	return nil
+}
+
+func cmdCredentialsSet(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if err := validateCredentialName(name); err != nil {
+		return err
+	}
+	store, err := credentials.Open(true)
+	if err != nil {
+		return err
+	}
+
+	var secret string
+	if console.IsTerminal() {
+		secret, err = console.ReadPassword(name + ": ")
+	} else {
+		secret, err = readTokenFromStdin()
+	}
+	if err != nil {
+		return err
+	}
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return fmt.Errorf("%s can't be empty. Use 'cog credentials delete %s' to delete it", name, name)
+	}
+
+	if err := store.Set(name, secret); err != nil {
+		return err
+	}
+	console.Infof("Saved %s in %s", name, store.Location())
+	return nil
+}
+
+func cmdCredentialsDelete(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if err := validateCredentialName(name); err != nil {
+		return err
+	}
+	store, err := credentials.Open(true)
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(name); err != nil {
+		return err
+	}
+	console.Infof("Deleted %s from %s", name, store.Location())
+	return nil
+}
+
+// webhookAuthEnv passes the webhook auth token from the credential store
+// to the model's container, unless WEBHOOK_AUTH_TOKEN is set already or
+// there's no store to get it from. It's set in Cog's environment and passed
+// through by name, so it isn't in docker run's arguments where anyone on
+// the machine could see it.
+func webhookAuthEnv() []string {
+	if os.Getenv("WEBHOOK_AUTH_TOKEN") != "" {
+		return nil
+	}
+	store, err := credentials.Open(false)
+	if err != nil {
+		console.Debugf("Not getting %s from the credential store: %s", credentials.WebhookAuthToken, err)
+		return nil
+	}
+	token, ok, err := store.Get(credentials.WebhookAuthToken)
+	if err != nil {
+		console.Warnf("Failed to get %s from %s: %s", credentials.WebhookAuthToken, store.Location(), err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	if err := os.Setenv("WEBHOOK_AUTH_TOKEN", token); err != nil {
+		return nil
+	}
+	return []string{"WEBHOOK_AUTH_TOKEN"}
+}
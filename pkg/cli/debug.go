@@ -5,9 +5,8 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/replicate/cog/pkg/config"
-	"github.com/replicate/cog/pkg/dockerfile"
 	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/image"
 	"github.com/replicate/cog/pkg/util/console"
 )
 
@@ -26,17 +25,23 @@ func newDebugCommand() *cobra.Command {
 
 	cmd.AddCommand(debug)
 	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
+	addBuildPlatformFlag(cmd)
 
 	return cmd
 }
 
 func cmdDockerfile(cmd *cobra.Command, args []string) error {
-	config, projectDir, err := config.GetConfig(projectDirFlag)
+	cfg, projectDir, err := getBuildConfig()
 	if err != nil {
 		return err
 	}
 
-	generator, err := dockerfile.NewGenerator(config, projectDir, groupFile)
+	if err := validateBuildPlatform(); err != nil {
+		return err
+	}
+
+	generator, err := image.NewGenerator(cfg, projectDir, groupFile)
 	if err != nil {
 		return fmt.Errorf("Error creating Dockerfile generator: %w", err)
 	}
@@ -45,6 +50,9 @@ func cmdDockerfile(cmd *cobra.Command, args []string) error {
 			console.Warnf("Error cleaning up after build: %v", err)
 		}
 	}()
+	if err := image.SetPlatform(generator, buildPlatform()); err != nil {
+		return err
+	}
 	out, err := generator.Generate()
 	if err != nil {
 		return err
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+func newDedupeReportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dedupe-report <image> <image>...",
+		Short: "Report how much storage related images share in their registry",
+		Long: `Report how much storage related images share in their registry.
+
+A registry stores each layer once, however many images it's in. This shows
+how much of each image's layers are shared with the other images, how much
+the images take up in the registry altogether, and suggests how to build
+them so they share more, like building them on the same base image, or
+copying in weights after the steps they have in common.
+
+The images must already be pushed.`,
+		Example: `  cog dedupe-report r8.im/acme/sdxl r8.im/acme/sdxl-turbo r8.im/acme/sdxl-lightning`,
+		RunE:    cmdDedupeReport,
+		Args:    cobra.MinimumNArgs(2),
+	}
+	return cmd
+}
+
+func cmdDedupeReport(cmd *cobra.Command, args []string) error {
+	images := []image.ImageLayers{}
+	for _, name := range args {
+		layers, err := docker.ManifestLayers(name)
+		if err != nil {
+			return err
+		}
+		images = append(images, image.ImageLayers{Image: name, Layers: layers})
+	}
+
+	report := image.NewDedupeReport(images)
+	for _, storage := range report.Images {
+		console.Infof("%s: %s, %s shared, %s only in this image", storage.Image, humanSize(storage.Size), humanSize(storage.SharedSize), humanSize(storage.UniqueSize))
+	}
+	console.Info("")
+	console.Infof("The images are %s altogether, and the registry stores %s of layers for them.", humanSize(report.TotalSize), humanSize(report.StoredSize))
+
+	if len(report.Suggestions) == 0 {
+		return nil
+	}
+	console.Info("")
+	console.Info("To store less:")
+	for _, suggestion := range report.Suggestions {
+		console.Infof("  - %s", suggestion)
+	}
+	return nil
+}
+
+func humanSize(size int64) string {
+	return units.HumanSize(float64(size))
+}
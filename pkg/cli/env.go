@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/env"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var envPython string
+
+func newEnvCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "env",
+		Short: "Inspect the environment the model runs in",
+	}
+
+	diff := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare the local Python environment with the model's image",
+		Long: `Compare the local Python environment with the model's image.
+
+This compares the Python version, CUDA version, and the packages in
+cog.yaml that are installed locally with what the image would have, without
+building it. Differences here are a common reason a model works locally but
+not once it is built.`,
+		RunE: cmdEnvDiff,
+		Args: cobra.NoArgs,
+	}
+	diff.Flags().StringVar(&envPython, "python", "python3", "Python interpreter of the local environment")
+
+	cmd.AddCommand(diff)
+
+	return cmd
+}
+
+func cmdEnvDiff(cmd *cobra.Command, args []string) error {
+	cfg, _, err := config.GetConfig(projectDirFlag)
+	if err != nil {
+		return err
+	}
+
+	imageEnv, err := env.Image(cfg)
+	if err != nil {
+		return err
+	}
+	localEnv, err := env.Local(envPython)
+	if err != nil {
+		return err
+	}
+
+	diffs := env.Diff(localEnv, imageEnv)
+	if len(diffs) == 0 {
+		console.Infof("The local environment matches the image")
+		return nil
+	}
+	for _, diff := range diffs {
+		console.Output(diff.String())
+	}
+	return nil
+}
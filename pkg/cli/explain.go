@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// explainMaxSources is how many files in a layer cog explain lists
+const explainMaxSources = 8
+
+func newExplainCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "explain",
+		Short: "Explain what building the model will do",
+		Long: `Explain what building the model will do, without building it.
+
+It explains the base image and why it's the one the model is built on, the
+versions of Python, CUDA, and cuDNN and where they came from, the layers
+the project directory is copied into, and what the build connects to. Use
+it to review a change to ` + global.ConfigFilename + `, or to see what Cog does with it.`,
+		RunE: cmdExplain,
+		Args: cobra.NoArgs,
+	}
+	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
+	addBuildStrictFlag(cmd)
+	addBuildOfflineFlags(cmd)
+	addBuildPlatformFlag(cmd)
+	return cmd
+}
+
+func cmdExplain(cmd *cobra.Command, args []string) error {
+	cfg, projectDir, err := getBuildConfig()
+	if err != nil {
+		return err
+	}
+	if err := validateBuildPlatform(); err != nil {
+		return err
+	}
+	plan, err := image.Explain(cfg, projectDir, groupFile, buildOptions())
+	if err != nil {
+		return err
+	}
+	console.Output(explainPlan(plan))
+	return nil
+}
+
+// explainPlan returns plan as plain language.
+func explainPlan(plan *dockerfile.Plan) string {
+	lines := []string{
+		fmt.Sprintf("Base image: %s", plan.BaseImage),
+		fmt.Sprintf("  Because %s.", plan.BaseImageReason),
+	}
+	if plan.CUDA != "" {
+		lines = append(lines,
+			fmt.Sprintf("CUDA: %s", plan.CUDA),
+			fmt.Sprintf("  Because %s.", plan.CUDAReason),
+			fmt.Sprintf("cuDNN: %s", plan.CuDNN),
+			fmt.Sprintf("  Because %s.", plan.CuDNNReason),
+		)
+	}
+	lines = append(lines,
+		fmt.Sprintf("Python: %s", plan.PythonVersion),
+		fmt.Sprintf("  Because %s. %s.", plan.PythonVersionReason, capitalize(plan.PythonInstall)),
+	)
+
+	lines = append(lines, "", "Steps:")
+	if len(plan.Steps) == 0 {
+		lines = append(lines, "  None. Only Cog is installed.")
+	}
+	for _, step := range plan.Steps {
+		lines = append(lines, "  "+step)
+	}
+
+	layers := "layers"
+	if len(plan.Copies) == 1 {
+		layers = "layer"
+	}
+	lines = append(lines, "", fmt.Sprintf("The project directory is copied into %d %s:", len(plan.Copies), layers))
+	for i, copy := range plan.Copies {
+		sources := copy.Sources
+		more := ""
+		if len(sources) > explainMaxSources {
+			more = fmt.Sprintf(", and %d more", len(sources)-explainMaxSources)
+			sources = sources[:explainMaxSources]
+		}
+		if len(sources) == 1 && sources[0] == "." {
+			sources = []string{"everything"}
+		}
+		lines = append(lines, fmt.Sprintf("  %d. %s%s, to %s", i+1, strings.Join(sources, ", "), more, copy.Dest))
+	}
+
+	lines = append(lines, "", "The build connects to:")
+	for _, access := range plan.Network {
+		lines = append(lines, fmt.Sprintf("  %s: %s", access.Host, strings.Join(access.Reasons, ", and ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
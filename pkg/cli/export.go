@@ -0,0 +1,238 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/kubernetes"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var (
+	exportOutput             string
+	exportKubernetesOutput   string
+	exportReplicas           int
+	exportRequirementsOutput string
+	exportWheelhouseOutput   string
+)
+
+func newExportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export artifacts built from the model in the current directory",
+	}
+
+	onnx := &cobra.Command{
+		Use:   "onnx",
+		Short: "Export the model to ONNX",
+		Long: `Export the model to ONNX.
+
+This builds the model in the current directory, runs setup(), and then calls
+the export_onnx(self, path) method on your Predictor to write the ONNX model.
+The result is validated with onnx and onnxruntime, which must be installed
+in the image, and its metadata is written alongside it as <output>.json.`,
+		Example: `cog export onnx --output model.onnx`,
+		RunE:    cmdExportONNX,
+		Args:    cobra.NoArgs,
+	}
+	addBuildProgressOutputFlag(onnx)
+	addGroupFileFlag(onnx)
+	onnx.Flags().StringVarP(&exportOutput, "output", "o", "model.onnx", "Output path")
+
+	kube := &cobra.Command{
+		Use:   "kubernetes [image]",
+		Short: "Generate Kubernetes manifests to deploy the model",
+		Long: `Generate Kubernetes manifests to deploy the model.
+
+This writes a Deployment and a Service for the image, which defaults to
+'image' in cog.yaml. It's a starting point: edit it to suit your cluster.
+If the model has weights.shared in cog.yaml, the weights are mounted from
+the shared volume on each node, and the first pod on a node copies them
+there from the image.`,
+		Example: `cog export kubernetes r8.im/your-username/your-model --replicas 4 | kubectl apply -f -`,
+		RunE:    cmdExportKubernetes,
+		Args:    cobra.MaximumNArgs(1),
+	}
+	kube.Flags().StringVarP(&exportKubernetesOutput, "output", "o", "-", "Output path, or - for stdout")
+	kube.Flags().IntVar(&exportReplicas, "replicas", 1, "Number of replicas")
+
+	requirements := &cobra.Command{
+		Use:   "requirements",
+		Short: "Export the Python packages the model installs as a requirements file",
+		Long: `Export the Python packages the model installs as a requirements file.
+
+Every package, and every package they depend on, is pinned to the version
+the image installs, with its hashes, along with the package indexes they're
+installed from, so the same packages can be installed somewhere else, like
+on a machine that runs the model without Docker. They're from
+` + config.PythonLockFilename + ` if 'cog lock' has pinned them, or they're resolved the
+same way otherwise.`,
+		Example: `cog export requirements -o requirements.txt`,
+		RunE:    cmdExportRequirements,
+		Args:    cobra.NoArgs,
+	}
+	requirements.Flags().StringVarP(&exportRequirementsOutput, "output", "o", "-", "Output path, or - for stdout")
+
+	wheelhouse := &cobra.Command{
+		Use:   "wheelhouse",
+		Short: "Download wheels of the Python packages the model installs",
+		Long: `Download wheels of the Python packages the model installs.
+
+The packages in 'cog export requirements', and Cog's own dependencies, are
+downloaded to a directory, and built if they don't have wheels, for Linux on
+the architecture Docker runs. It can be used as 'build.wheelhouse' in
+cog.yaml, to build the model without the internet, or to install the same
+packages somewhere else with:
+
+  pip install --no-index --find-links wheels --require-hashes -r requirements.txt`,
+		Example: `cog export wheelhouse -o wheels`,
+		RunE:    cmdExportWheelhouse,
+		Args:    cobra.NoArgs,
+	}
+	wheelhouse.Flags().StringVarP(&exportWheelhouseOutput, "output", "o", "wheels", "Output directory")
+
+	cmd.AddCommand(onnx, kube, requirements, wheelhouse)
+
+	return cmd
+}
+
+func cmdExportONNX(cmd *cobra.Command, args []string) error {
+	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	if err != nil {
+		return err
+	}
+	if cfg.Predict == "" {
+		return fmt.Errorf("'predict' must be set in cog.yaml to export a model")
+	}
+
+	imageName, err := image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile, docker.BuildOptions{})
+	if err != nil {
+		return err
+	}
+
+	console.Info("")
+	console.Info("Exporting model to ONNX...")
+	metadata, err := image.ExportONNX(imageName, projectDir, cfg.Build.GPU, weightsRunEnv(cfg), exportOutput)
+	if err != nil {
+		return err
+	}
+
+	opsets := []string{}
+	for domain, version := range metadata.Opsets {
+		opsets = append(opsets, fmt.Sprintf("%s=%d", domain, version))
+	}
+	sort.Strings(opsets)
+
+	console.Infof("Written ONNX model to %s", exportOutput)
+	console.Infof("IR version: %d, opsets: %s", metadata.IRVersion, strings.Join(opsets, ", "))
+	console.Infof("Validated with onnx %s and onnxruntime %s", metadata.ONNXVersion, metadata.ONNXRuntimeVersion)
+	return nil
+}
+
+func cmdExportKubernetes(cmd *cobra.Command, args []string) error {
+	cfg, _, err := config.GetConfig(projectDirFlag)
+	if err != nil {
+		return err
+	}
+	imageName := cfg.Image
+	if len(args) > 0 {
+		imageName = args[0]
+	}
+	if imageName == "" {
+		return fmt.Errorf("Pass the image to deploy, or set 'image' in cog.yaml")
+	}
+
+	manifest, err := kubernetes.Manifest(kubernetes.Options{
+		Name:     imageName,
+		Image:    imageName,
+		Replicas: exportReplicas,
+		Config:   cfg,
+	})
+	if err != nil {
+		return err
+	}
+	if exportKubernetesOutput == "-" {
+		_, err = os.Stdout.Write(manifest)
+		return err
+	}
+	if err := os.WriteFile(exportKubernetesOutput, manifest, 0o644); err != nil {
+		return err
+	}
+	console.Infof("Written Kubernetes manifests to %s", exportKubernetesOutput)
+	return nil
+}
+
+// exportPythonGenerator returns the generator and lock the Python packages
+// are exported with
+func exportPythonGenerator() (*dockerfile.Generator, *config.Lock, string, error) {
+	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	lock, err := config.LoadLock(projectDir)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	generator, err := dockerfile.NewGenerator(cfg, projectDir, false)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("Error creating Dockerfile generator: %w", err)
+	}
+	generator.RegistryMirrors = userConfig.RegistryMirrors
+	return generator, lock, projectDir, nil
+}
+
+func cmdExportRequirements(cmd *cobra.Command, args []string) error {
+	generator, lock, projectDir, err := exportPythonGenerator()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := generator.Cleanup(); err != nil {
+			console.Warnf("Error cleaning up Dockerfile generator: %s", err)
+		}
+	}()
+
+	requirements, err := image.ExportPythonRequirements(generator, lock, projectDir)
+	if err != nil {
+		return err
+	}
+	if exportRequirementsOutput == "-" {
+		_, err = os.Stdout.Write(requirements)
+		return err
+	}
+	if err := os.WriteFile(exportRequirementsOutput, requirements, 0o644); err != nil {
+		return err
+	}
+	console.Infof("Written Python requirements to %s", exportRequirementsOutput)
+	return nil
+}
+
+func cmdExportWheelhouse(cmd *cobra.Command, args []string) error {
+	generator, lock, projectDir, err := exportPythonGenerator()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := generator.Cleanup(); err != nil {
+			console.Warnf("Error cleaning up Dockerfile generator: %s", err)
+		}
+	}()
+
+	if err := image.ExportWheelhouse(generator, lock, projectDir, exportWheelhouseOutput); err != nil {
+		return err
+	}
+	console.Infof("Written wheels to %s", exportWheelhouseOutput)
+	return nil
+}
@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/history"
+	"github.com/replicate/cog/pkg/predict"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var (
+	historyStatus     string
+	historyImage      string
+	historyModel      string
+	historyInputsHash string
+	historySince      string
+	historyLimit      int
+	historyJSON       bool
+)
+
+func newHistoryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the predictions run with cog predict and cog train",
+		Long: `List the predictions run with cog predict and cog train, oldest first.
+
+Each prediction is recorded in .cog/history.jsonl in the project directory,
+with the image it ran on, a hash of its inputs, how long it took, its status,
+and where its output was written.`,
+		RunE: cmdHistory,
+		Args: cobra.NoArgs,
+	}
+	cmd.AddCommand(newHistoryExportCommand())
+	cmd.Flags().StringVar(&historyStatus, "status", "", "Only list predictions with this status, like succeeded, failed, or error")
+	cmd.Flags().StringVar(&historyImage, "image", "", "Only list predictions on images whose name contains this, or whose digest starts with it")
+	cmd.Flags().StringVar(&historyModel, "model", "", "Only list predictions with this model from 'models' in cog.yaml")
+	cmd.Flags().StringVar(&historyInputsHash, "inputs-hash", "", "Only list predictions whose inputs hash starts with this")
+	cmd.Flags().StringVar(&historySince, "since", "", "Only list predictions from this long ago, like 24h")
+	cmd.Flags().IntVarP(&historyLimit, "limit", "n", 0, "Only list this many of the most recent predictions")
+	cmd.Flags().BoolVar(&historyJSON, "json", false, "Print the predictions as JSON")
+	return cmd
+}
+
+func cmdHistory(cmd *cobra.Command, args []string) error {
+	filter := history.Filter{
+		Status:     historyStatus,
+		Image:      historyImage,
+		Model:      historyModel,
+		InputsHash: historyInputsHash,
+		Limit:      historyLimit,
+	}
+	if historySince != "" {
+		since, err := time.ParseDuration(historySince)
+		if err != nil {
+			return fmt.Errorf("--since must be a duration, like 24h: %w", err)
+		}
+		filter.Since = time.Now().Add(-since)
+	}
+
+	entries, err := history.Read(historyDir(""))
+	if err != nil {
+		return err
+	}
+	entries = filter.Apply(entries)
+
+	if historyJSON {
+		out, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		console.Output(string(out))
+		return nil
+	}
+	if len(entries) == 0 {
+		console.Info("No predictions have been recorded")
+		return nil
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tSTATUS\tDURATION\tIMAGE\tINPUTS\tOUTPUT")
+	for _, entry := range entries {
+		inputsHash := entry.InputsHash
+		if len(inputsHash) > 12 {
+			inputsHash = inputsHash[:12]
+		}
+		image := entry.Image
+		if entry.Model != "" {
+			image += " (" + entry.Model + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1fs\t%s\t%s\t%s\n", entry.ID, console.FormatTime(entry.Time), entry.Status, entry.Duration, image, inputsHash, entry.Output)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	console.Output(strings.TrimSuffix(b.String(), "\n"))
+	return nil
+}
+
+// historyDir returns the directory predictions are recorded in: the project
+// directory, or the current directory when predicting on an image outside
+// of one.
+func historyDir(projectDir string) string {
+	if projectDir != "" {
+		return projectDir
+	}
+	if projectDir, err := config.GetProjectDir(projectDirFlag); err == nil {
+		return projectDir
+	}
+	return "."
+}
+
+// recordPrediction adds a prediction to the history. Failing to record it
+// doesn't fail the prediction.
+//
+// The inputs, output and cog.yaml of predictions that got a response are
+// kept too, so they can be exported with cog history export.
+func recordPrediction(predictor *predict.Predictor, projectDir string, model string, outputPath string, start time.Time, prediction *predict.Response, predictErr error) {
+	id, err := newPredictionID()
+	if err != nil {
+		console.Warnf("Failed to record the prediction in the history: %s", err)
+		return
+	}
+	dir := historyDir(projectDir)
+	entry := history.Entry{
+		ID:       id,
+		Time:     start.UTC(),
+		Image:    predictor.Image(),
+		Model:    model,
+		Duration: time.Since(start).Seconds(),
+		Output:   outputPath,
+	}
+	var configJSON []byte
+	if inspect, err := docker.ImageInspect(entry.Image); err == nil {
+		entry.ImageDigest = inspect.ID
+		if len(inspect.RepoDigests) > 0 {
+			entry.RepoDigest = inspect.RepoDigests[0]
+		}
+		if inspect.Config != nil {
+			if label, ok := inspect.Config.Labels[global.LabelNamespace+"config"]; ok {
+				configJSON = []byte(label)
+			}
+		}
+	}
+	if predictErr != nil {
+		entry.Status = history.StatusError
+		entry.Error = predictErr.Error()
+	} else {
+		entry.Status = string(prediction.Status)
+		entry.Error = prediction.Error
+		entry.InputsHash = prediction.InputsHash
+		if err := history.SaveArtifacts(dir, id, predictionArtifacts(projectDir, configJSON, prediction)); err != nil {
+			console.Warnf("Failed to keep the inputs and output of the prediction: %s", err)
+		}
+		if err := history.PruneArtifacts(dir, history.MaxArtifacts); err != nil {
+			console.Warnf("Failed to remove the inputs and outputs of old predictions: %s", err)
+		}
+	}
+	if err := history.Append(dir, entry); err != nil {
+		console.Warnf("Failed to record the prediction in the history: %s", err)
+	}
+}
+
+// predictionArtifacts returns what's kept of a prediction. cog.yaml is
+// copied from the project directory, or, for predictions on an image, is
+// the config in the image's labels, which is JSON, and so also YAML.
+func predictionArtifacts(projectDir string, configJSON []byte, prediction *predict.Response) history.Artifacts {
+	artifacts := history.Artifacts{
+		Config:      configJSON,
+		Inputs:      prediction.Inputs,
+		OutputFiles: map[string]history.OutputFile{},
+	}
+	if projectDir != "" {
+		if content, err := os.ReadFile(filepath.Join(projectDir, global.ConfigFilename)); err == nil {
+			artifacts.Config = content
+		}
+	}
+	if prediction.Output != nil {
+		artifacts.Output = *prediction.Output
+	}
+	for contentID, file := range prediction.Files {
+		artifacts.OutputFiles["cid:"+contentID] = history.OutputFile{Path: file.Path, ContentType: file.ContentType}
+	}
+	return artifacts
+}
+
+var (
+	historyExportBundle bool
+	historyExportOutput string
+)
+
+func newHistoryExportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export <id>",
+		Short: "Export a prediction from the history",
+		Long: `Export a prediction from the history.
+
+It prints the prediction's entry in the history as JSON. With --bundle, it
+writes a tarball with the prediction's input files, cog.yaml, a reference to
+the image it ran on by its digest, and its output, with a reproduce.sh
+script that runs it again, so someone else can reproduce it.`,
+		RunE: cmdHistoryExport,
+		Args: cobra.ExactArgs(1),
+	}
+	cmd.Flags().BoolVar(&historyExportBundle, "bundle", false, "Write a tarball of everything needed to reproduce the prediction")
+	cmd.Flags().StringVarP(&historyExportOutput, "output", "o", "", "Where to write the bundle. Defaults to cog-prediction-<id>.tar.gz")
+	return cmd
+}
+
+func cmdHistoryExport(cmd *cobra.Command, args []string) error {
+	dir := historyDir("")
+	entries, err := history.Read(dir)
+	if err != nil {
+		return err
+	}
+	entry, err := history.Find(entries, args[0])
+	if err != nil {
+		return err
+	}
+
+	if !historyExportBundle {
+		out, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return err
+		}
+		console.Output(string(out))
+		return nil
+	}
+
+	bundlePath := historyExportOutput
+	if bundlePath == "" {
+		bundlePath = "cog-prediction-" + entry.ID + ".tar.gz"
+	}
+	f, err := os.Create(bundlePath)
+	if err != nil {
+		return err
+	}
+	if err := history.WriteBundle(dir, entry, f); err != nil {
+		f.Close()
+		os.Remove(bundlePath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	console.Infof("Wrote prediction %s to %s. Extract it and run reproduce.sh to run it again", entry.ID, bundlePath)
+	return nil
+}
@@ -19,16 +19,31 @@ var cogYamlContent []byte
 //go:embed init-templates/predict.py
 var predictPyContent []byte
 
+var (
+	initInteractive bool
+	initFrom        string
+)
+
 func newInitCommand() *cobra.Command {
 	var cmd = &cobra.Command{
 		Use:        "init",
 		SuggestFor: []string{"new", "start"},
 		Short:      "Configure your project for use with Cog",
+		Long: `Configure your project for use with Cog.
+
+This creates cog.yaml and predict.py in the current directory. With --from,
+it also pulls your organization's template repository, merges the cog.yaml
+in it into cog.yaml, and copies every other file in it, like CI
+configuration, into the current directory. If cog.yaml already exists, run
+it with --from to bring the project up to date with the template.`,
+		Example: `cog init --from git@github.com:your-org/cog-template.git`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return initCommand(args)
 		},
 		Args: cobra.MaximumNArgs(0),
 	}
+	cmd.Flags().BoolVarP(&initInteractive, "interactive", "i", false, "Ask what your model needs, and generate cog.yaml and predict.py to match")
+	cmd.Flags().StringVar(&initFrom, "from", "", "A template repository, or directory, to pull cog.yaml defaults, lint rules, and CI files from")
 
 	return cmd
 }
@@ -49,11 +64,41 @@ func initCommand(args []string) error {
 		return err
 	}
 
+	templateDir := ""
+	if initFrom != "" {
+		var cleanup func()
+		templateDir, cleanup, err = fetchTemplate(initFrom)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+
 	if cogYamlPathExists {
-		return fmt.Errorf("Found an existing cog.yaml.\nExiting without overwriting (to be on the safe side!)")
+		if templateDir == "" {
+			return fmt.Errorf("Found an existing cog.yaml.\nExiting without overwriting (to be on the safe side!)")
+		}
+		return updateFromTemplate(templateDir, cwd, cogYamlPath)
 	}
 
-	err = os.WriteFile(cogYamlPath, cogYamlContent, 0o644)
+	cogYaml, predictPy := cogYamlContent, predictPyContent
+	if initInteractive {
+		cogYaml, predictPy, err = interactiveInitFiles(cwd)
+		if err != nil {
+			return err
+		}
+	}
+	if templateDir != "" {
+		cogYaml, err = applyTemplate(templateDir, cwd, cogYaml)
+		if err != nil {
+			return err
+		}
+		if templatePredictPy, err := os.ReadFile(path.Join(templateDir, "predict.py")); err == nil {
+			predictPy = templatePredictPy
+		}
+	}
+
+	err = os.WriteFile(cogYamlPath, cogYaml, 0o644)
 	if err != nil {
 		return fmt.Errorf("Error writing %s: %w", cogYamlPath, err)
 	}
@@ -71,7 +116,7 @@ func initCommand(args []string) error {
 		return fmt.Errorf("Found an existing predict.py.\nExiting without overwriting (to be on the safe side!)")
 	}
 
-	err = os.WriteFile(predictPyPath, predictPyContent, 0o644)
+	err = os.WriteFile(predictPyPath, predictPy, 0o644)
 	if err != nil {
 		return fmt.Errorf("Error writing %s: %w", predictPyPath, err)
 	}
@@ -81,3 +126,21 @@ func initCommand(args []string) error {
 
 	return nil
 }
+
+// updateFromTemplate brings an existing project up to date with the
+// template in templateDir.
+func updateFromTemplate(templateDir string, dir string, cogYamlPath string) error {
+	cogYaml, err := os.ReadFile(cogYamlPath)
+	if err != nil {
+		return err
+	}
+	cogYaml, err = applyTemplate(templateDir, dir, cogYaml)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cogYamlPath, cogYaml, 0o644); err != nil {
+		return fmt.Errorf("Error writing %s: %w", cogYamlPath, err)
+	}
+	console.Infof("✅ Updated %s", cogYamlPath)
+	return nil
+}
@@ -0,0 +1,242 @@
+package cli
+
+import (
+	"bytes"
+	// blank import for embeds
+	_ "embed"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/files"
+	"github.com/replicate/cog/pkg/util/version"
+)
+
+//go:embed init-templates/interactive/cog.yaml.tmpl
+var cogYamlTemplate string
+
+//go:embed init-templates/interactive/predict.py.tmpl
+var predictPyTemplate string
+
+const (
+	frameworkPyTorch    = "pytorch"
+	frameworkTensorFlow = "tensorflow"
+	frameworkNone       = "none"
+
+	// The oldest version of Python that Cog's Python package supports
+	minPythonVersion = "3.7"
+)
+
+// initAnswers are the answers to the questions asked by
+// `cog init --interactive`.
+type initAnswers struct {
+	Framework        string
+	FrameworkVersion string
+	GPU              bool
+	CUDA             string
+	PythonVersion    string
+	PythonPackages   []string
+	Weights          string
+}
+
+func (a *initAnswers) FrameworkName() string {
+	switch a.Framework {
+	case frameworkPyTorch:
+		return "PyTorch " + a.FrameworkVersion
+	case frameworkTensorFlow:
+		return "TensorFlow " + a.FrameworkVersion
+	}
+	return a.Framework
+}
+
+// askInitQuestions asks what the model needs, only offering options that
+// are compatible with the answers so far.
+func askInitQuestions(dir string) (*initAnswers, error) {
+	answers := &initAnswers{}
+	var err error
+
+	answers.Framework, err = console.Interactive{
+		Prompt:  "Which framework does your model use?",
+		Default: frameworkPyTorch,
+		Options: []string{frameworkPyTorch, frameworkTensorFlow, frameworkNone},
+	}.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	pythons := []string{}
+	cudas := []string{}
+	switch answers.Framework {
+	case frameworkPyTorch:
+		versions := config.TorchVersions()
+		answers.FrameworkVersion, err = console.Interactive{
+			Prompt:  "Which version of PyTorch?",
+			Default: versions[0],
+			Options: versions,
+		}.Read()
+		if err != nil {
+			return nil, err
+		}
+		torchvision, torchPythons, torchCUDAs := config.TorchCompatibilityFor(answers.FrameworkVersion)
+		pythons = torchPythons
+		cudas = torchCUDAs
+		answers.PythonPackages = []string{"torch==" + answers.FrameworkVersion}
+		if torchvision != "" {
+			answers.PythonPackages = append(answers.PythonPackages, "torchvision=="+torchvision)
+		}
+	case frameworkTensorFlow:
+		versions := config.TFVersions()
+		answers.FrameworkVersion, err = console.Interactive{
+			Prompt:  "Which version of TensorFlow?",
+			Default: versions[0],
+			Options: versions,
+		}.Read()
+		if err != nil {
+			return nil, err
+		}
+		compat, _ := config.TFCompatibilityFor(answers.FrameworkVersion)
+		pythons = compat.Pythons
+		// TensorFlow is built against one version of CUDA
+		cudas = []string{compat.CUDA}
+		answers.PythonPackages = []string{"tensorflow==" + answers.FrameworkVersion}
+	default:
+		pythons = []string{"3.11", "3.10", "3.9", "3.8", "3.7"}
+	}
+
+	gpu, err := console.Interactive{
+		Prompt:  "Does your model need a GPU?",
+		Default: "no",
+		Options: []string{"yes", "no"},
+	}.Read()
+	if err != nil {
+		return nil, err
+	}
+	answers.GPU = gpu == "yes"
+
+	pythons = supportedPythons(pythons)
+	if len(pythons) == 0 {
+		return nil, fmt.Errorf("%s doesn't support any version of Python that Cog supports", answers.FrameworkName())
+	}
+	answers.PythonVersion, err = console.Interactive{
+		Prompt:  "Which version of Python?",
+		Default: pythons[0],
+		Options: pythons,
+	}.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	if answers.GPU && answers.Framework != frameworkNone {
+		if len(cudas) == 0 {
+			return nil, fmt.Errorf("Cog doesn't have a CUDA base image that is compatible with %s. Choose a different version.", answers.FrameworkName())
+		}
+		if len(cudas) == 1 {
+			answers.CUDA = cudas[0]
+			console.Infof("Using CUDA %s, which is what %s needs", answers.CUDA, answers.FrameworkName())
+		} else {
+			answers.CUDA, err = console.Interactive{
+				Prompt:  "Which version of CUDA?",
+				Default: cudas[0],
+				Options: cudas,
+			}.Read()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for {
+		answers.Weights, err = console.Interactive{
+			Prompt: "Where are your model's weights, relative to this directory? Leave this empty if you haven't got them yet",
+		}.Read()
+		if err != nil {
+			return nil, err
+		}
+		if err := validateWeightsPath(dir, answers.Weights); err != nil {
+			console.Warnf("%s", err)
+			continue
+		}
+		break
+	}
+
+	return answers, nil
+}
+
+// supportedPythons filters out versions of Python that are too old for Cog.
+func supportedPythons(pythons []string) []string {
+	supported := []string{}
+	for _, python := range pythons {
+		if !version.Greater(minPythonVersion, python) {
+			supported = append(supported, python)
+		}
+	}
+	return supported
+}
+
+func validateWeightsPath(dir string, weights string) error {
+	if weights == "" {
+		return nil
+	}
+	if filepath.IsAbs(weights) || strings.HasPrefix(filepath.Clean(weights), "..") {
+		return fmt.Errorf("The weights must be inside this directory, so they can be built into the image")
+	}
+	exists, err := files.Exists(filepath.Join(dir, weights))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		console.Warnf("%s doesn't exist yet. Make sure it's there before you build the model.", weights)
+	}
+	return nil
+}
+
+// render generates cog.yaml and predict.py from the answers, and checks
+// that the config is valid.
+func (a *initAnswers) render(dir string) (cogYaml []byte, predictPy []byte, err error) {
+	cogYaml, err = renderInitTemplate("cog.yaml", cogYamlTemplate, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	predictPy, err = renderInitTemplate("predict.py", predictPyTemplate, a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := config.FromYAML(cogYaml)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.ValidateAndComplete(dir); err != nil {
+		return nil, nil, fmt.Errorf("Those answers don't make a valid cog.yaml: %w", err)
+	}
+	return cogYaml, predictPy, nil
+}
+
+func renderInitTemplate(name string, text string, data interface{}) ([]byte, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("Failed to generate %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// interactiveInitFiles asks what the model needs and returns the contents
+// of cog.yaml and predict.py.
+func interactiveInitFiles(dir string) ([]byte, []byte, error) {
+	if !console.IsTerminal() {
+		return nil, nil, fmt.Errorf("--interactive needs a terminal to ask questions")
+	}
+	answers, err := askInitQuestions(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	console.Info("")
+	return answers.render(dir)
+}
@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+// fetchTemplate returns a directory with the contents of the template
+// repository at source, which is cloned with git unless it's a local
+// directory. cleanup removes anything that was cloned.
+func fetchTemplate(source string) (dir string, cleanup func(), err error) {
+	if isDir, _ := files.IsDir(source); isDir {
+		return source, func() {}, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "cog-template-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			console.Warnf("Failed to remove %s: %s", tmpDir, err)
+		}
+	}
+	console.Infof("Fetching template from %s...", source)
+	cmd := exec.Command("git", "clone", "--quiet", "--depth", "1", source, tmpDir)
+	cmd.Stderr = os.Stderr
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("Failed to clone the template %s: %w", source, err)
+	}
+	return tmpDir, cleanup, nil
+}
+
+// applyTemplate copies the files in templateDir into dir, replacing any that
+// are already there, and returns cogYaml with the template's cog.yaml
+// merged into it. The template's cog.yaml and predict.py aren't copied,
+// because cog.yaml is merged and predict.py is the model's own code.
+func applyTemplate(templateDir string, dir string, cogYaml []byte) ([]byte, error) {
+	err := filepath.WalkDir(templateDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(templateDir, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == "cog.yaml" || rel == "predict.py" {
+			return nil
+		}
+		target := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := files.CopyFile(path, target); err != nil {
+			return err
+		}
+		console.Infof("✅ Created %s", target)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fragment, err := os.ReadFile(filepath.Join(templateDir, "cog.yaml"))
+	if os.IsNotExist(err) {
+		return cogYaml, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	merged, err := config.MergeYAML(cogYaml, fragment)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to merge the template's cog.yaml: %w", err)
+	}
+	if _, err := config.FromYAML(merged); err != nil {
+		return nil, fmt.Errorf("The template's cog.yaml makes an invalid cog.yaml: %w", err)
+	}
+	return merged, nil
+}
@@ -19,3 +19,93 @@ func TestInit(t *testing.T) {
 	require.FileExists(t, path.Join(dir, "cog.yaml"))
 	require.FileExists(t, path.Join(dir, "predict.py"))
 }
+
+func TestInitInteractiveRender(t *testing.T) {
+	dir := t.TempDir()
+
+	answers := &initAnswers{
+		Framework:        frameworkPyTorch,
+		FrameworkVersion: "1.13.0",
+		GPU:              true,
+		CUDA:             "11.7",
+		PythonVersion:    "3.10",
+		PythonPackages:   []string{"torch==1.13.0", "torchvision==0.14.0"},
+		Weights:          "weights/model.pth",
+	}
+	cogYaml, predictPy, err := answers.render(dir)
+	require.NoError(t, err)
+	require.Contains(t, string(cogYaml), `  gpu: true
+
+  # the version of CUDA to install, which must be compatible with PyTorch 1.13.0
+  cuda: "11.7"
+`)
+	require.Contains(t, string(cogYaml), `  python_version: "3.10"`)
+	require.Contains(t, string(cogYaml), `  python_packages:
+    - "torch==1.13.0"
+    - "torchvision==0.14.0"
+`)
+	require.Contains(t, string(predictPy), "import torch\n")
+	require.Contains(t, string(predictPy), `self.model = torch.load("weights/model.pth", map_location=self.device)`)
+}
+
+func TestInitInteractiveRenderNoFramework(t *testing.T) {
+	dir := t.TempDir()
+
+	answers := &initAnswers{Framework: frameworkNone, PythonVersion: "3.11"}
+	cogYaml, predictPy, err := answers.render(dir)
+	require.NoError(t, err)
+	require.Contains(t, string(cogYaml), "  gpu: false\n\n  # a list of ubuntu apt packages")
+	require.Contains(t, string(cogYaml), "  # python_packages:")
+	require.NotContains(t, string(predictPy), "import torch")
+}
+
+func TestInitInteractiveRenderInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	answers := &initAnswers{
+		Framework:        frameworkPyTorch,
+		FrameworkVersion: "1.13.0",
+		GPU:              true,
+		CUDA:             "9.9",
+		PythonVersion:    "3.10",
+		PythonPackages:   []string{"torch==1.13.0"},
+	}
+	_, _, err := answers.render(dir)
+	require.ErrorContains(t, err, "CUDA 9.9 is not supported")
+}
+
+func TestSupportedPythons(t *testing.T) {
+	require.Equal(t, []string{"3.11", "3.7"}, supportedPythons([]string{"3.11", "3.7", "3.6"}))
+}
+
+func TestInitFromTemplate(t *testing.T) {
+	templateDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(templateDir, "cog.yaml"), []byte("build:\n  python_version: \"3.11\"\nlint:\n  rules:\n    print: error\n"), 0o644))
+	require.NoError(t, os.MkdirAll(path.Join(templateDir, ".github", "workflows"), 0o755))
+	require.NoError(t, os.WriteFile(path.Join(templateDir, ".github", "workflows", "ci.yaml"), []byte("on: push\n"), 0o644))
+	require.NoError(t, os.MkdirAll(path.Join(templateDir, ".git"), 0o755))
+	require.NoError(t, os.WriteFile(path.Join(templateDir, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0o644))
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	initFrom = templateDir
+	defer func() { initFrom = "" }()
+
+	require.NoError(t, initCommand([]string{}))
+
+	cogYaml, err := os.ReadFile(path.Join(dir, "cog.yaml"))
+	require.NoError(t, err)
+	require.Contains(t, string(cogYaml), `python_version: "3.11"`)
+	require.Contains(t, string(cogYaml), "print: error")
+	require.FileExists(t, path.Join(dir, "predict.py"))
+	require.FileExists(t, path.Join(dir, ".github", "workflows", "ci.yaml"))
+	require.NoFileExists(t, path.Join(dir, ".git", "HEAD"))
+
+	// Running it again updates the project from the template
+	require.NoError(t, os.WriteFile(path.Join(templateDir, "cog.yaml"), []byte("build:\n  python_version: \"3.12\"\n"), 0o644))
+	require.NoError(t, initCommand([]string{}))
+	cogYaml, err = os.ReadFile(path.Join(dir, "cog.yaml"))
+	require.NoError(t, err)
+	require.Contains(t, string(cogYaml), `python_version: "3.12"`)
+	require.Contains(t, string(cogYaml), "print: error")
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/lint"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/slices"
+)
+
+var lintJSON bool
+
+func newLintCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Check the predictor for common problems",
+		Long: `Check the predictor for common problems, without building or running it.
+
+It reports predictors without setup(), outputs typed as a bare dict,
+unsupported input types, use of print() instead of logging, and files
+written outside /tmp. It exits with an error if any problems are errors
+rather than warnings. The severity of each rule can be changed, or the rule
+turned off, with lint.rules in cog.yaml.`,
+		RunE: cmdLint,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().BoolVar(&lintJSON, "json", false, "Print the problems found as JSON")
+	return cmd
+}
+
+func cmdLint(cmd *cobra.Command, args []string) error {
+	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	if err != nil {
+		return err
+	}
+	if cfg.Predict == "" {
+		return fmt.Errorf("'predict' must be set in cog.yaml to lint the predictor")
+	}
+	file, class, _ := strings.Cut(cfg.Predict, ":")
+	source, err := os.ReadFile(path.Join(projectDir, file))
+	if err != nil {
+		return err
+	}
+
+	findings := lint.Lint(file, source, class)
+	if cfg.Lint != nil {
+		rules := map[string]lint.Severity{}
+		for rule, severity := range cfg.Lint.Rules {
+			if !slices.ContainsString(lint.Rules, rule) {
+				console.Warnf("There is no lint rule called %s in cog.yaml", rule)
+			}
+			rules[rule] = lint.Severity(severity)
+		}
+		findings = lint.ApplyRules(findings, rules)
+	}
+
+	if lintJSON {
+		out, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return err
+		}
+		console.Output(string(out))
+	} else {
+		for _, finding := range findings {
+			console.Output(finding.String())
+		}
+	}
+
+	errors := 0
+	for _, finding := range findings {
+		if finding.Severity == lint.SeverityError {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("Found %d errors in %s", errors, file)
+	}
+	if len(findings) == 0 && !lintJSON {
+		console.Infof("No problems found in %s", file)
+	}
+	return nil
+}
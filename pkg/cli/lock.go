@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var (
+	lockUpdateBase     bool
+	lockUpdatePackages bool
+)
+
+func newLockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Pin what the model is built from in " + config.LockFilename,
+		Long: `Pin what the model is built from in ` + config.LockFilename + `.
+
+The base image is pinned to a digest the first time the model is built with
+cog build or cog push, or by cog lock, so later builds aren't affected when
+the upstream tag changes. Other commands, and offline builds, only read it.
+Pass --update-base to re-resolve the base image tag to its current digest.
+
+The Python packages in cog.yaml, and every package they depend on, are
+resolved with pip-tools to pinned versions with their hashes, in
+` + config.PythonLockFilename + `. Builds install them from it with --require-hashes,
+until the Python packages in cog.yaml change. Pass --update-packages to resolve them
+again, like to get new versions of the packages they depend on.`,
+		RunE: cmdLock,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().BoolVar(&lockUpdateBase, "update-base", false, "Update the pinned base image to the current digest of its tag")
+	cmd.Flags().BoolVar(&lockUpdatePackages, "update-packages", false, "Resolve the Python packages again, even if they haven't changed")
+	return cmd
+}
+
+func cmdLock(cmd *cobra.Command, args []string) error {
+	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	if err != nil {
+		return err
+	}
+
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	lock, err := config.LoadLock(projectDir)
+	if err != nil {
+		return err
+	}
+	generator, err := dockerfile.NewGenerator(cfg, projectDir, false)
+	if err != nil {
+		return fmt.Errorf("Error creating Dockerfile generator: %w", err)
+	}
+	defer func() {
+		if err := generator.Cleanup(); err != nil {
+			console.Warnf("Error cleaning up Dockerfile generator: %s", err)
+		}
+	}()
+	generator.RegistryMirrors = userConfig.RegistryMirrors
+
+	changed, err := image.LockBaseImage(generator, lock, lockUpdateBase)
+	if err != nil {
+		return err
+	}
+	if cfg.Build.Poetry {
+		console.Infof("Python packages are pinned by %s", config.PoetryLockFilename)
+	} else {
+		packagesChanged, err := image.LockPythonRequirements(generator, lock, projectDir, lockUpdatePackages)
+		if err != nil {
+			return err
+		}
+		changed = changed || packagesChanged
+	}
+	if !changed {
+		console.Infof("%s is up to date", config.LockFilename)
+		return nil
+	}
+	return lock.Save(projectDir)
+}
@@ -14,7 +14,9 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/auth"
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/credentials"
 	"github.com/replicate/cog/pkg/global"
 	"github.com/replicate/cog/pkg/util/console"
 )
@@ -28,13 +30,22 @@ func newLoginCommand() *cobra.Command {
 		Use:        "login",
 		SuggestFor: []string{"auth", "authenticate", "authorize"},
 		Short:      "Log in to Replicate Docker registry",
-		RunE:       login,
-		Args:       cobra.MaximumNArgs(0),
+		Long: `Log in to Replicate Docker registry.
+
+If the registry passed with --registry has an OpenID Connect provider in
+'oidc' in the user config, like a private registry or build service, it logs
+in with the provider instead, with a code to approve in a browser. The
+short-lived tokens it gets are refreshed when they expire.
+
+Tokens are kept in the OS keychain, or, on machines without one, in a file
+encrypted with a passphrase, never in plaintext. See 'cog credentials'.`,
+		RunE: login,
+		Args: cobra.MaximumNArgs(0),
 	}
 
 	cmd.Flags().Bool("token-stdin", false, "Pass login token on stdin instead of opening a browser. You can find your Replicate login token at https://replicate.com/auth/token")
-	cmd.Flags().String("registry", global.ReplicateRegistryHost, "Registry host")
-	_ = cmd.Flags().MarkHidden("registry")
+	cmd.Flags().String("registry", global.ReplicateRegistryHost, "Registry host, or the host of a build service with an OpenID Connect provider in the user config")
+	cmd.Flags().Bool("print-token", false, "Print an access token for a host logged in to with OpenID Connect, refreshing it if it has expired")
 
 	return cmd
 }
@@ -48,6 +59,32 @@ func login(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	printToken, err := cmd.Flags().GetBool("print-token")
+	if err != nil {
+		return err
+	}
+
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	if provider, ok := userConfig.OIDC[registryHost]; ok {
+		if printToken {
+			token, err := auth.AccessToken(registryHost, provider)
+			if err != nil {
+				return err
+			}
+			console.Output(token)
+			return nil
+		}
+		if tokenStdin {
+			return fmt.Errorf("--token-stdin can't be used with hosts logged in to with OpenID Connect")
+		}
+		return oidcLogin(registryHost, provider)
+	}
+	if printToken {
+		return fmt.Errorf("--print-token only works for hosts with an OpenID Connect provider in 'oidc' in the user config")
+	}
 
 	var token string
 	if tokenStdin {
@@ -68,12 +105,35 @@ func login(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	if err := docker.SaveLoginToken(registryHost, username, token); err != nil {
+	location, err := credentials.SaveRegistryLogin(registryHost, username, token)
+	if err != nil {
 		return err
 	}
 
-	console.Infof("You've successfully authenticated as %s! You can now use the '%s' registry.", username, registryHost)
+	console.Infof("You've successfully authenticated as %s! You can now use the '%s' registry. Your token is kept in %s.", username, registryHost, location)
+
+	return nil
+}
 
+// oidcLogin logs in to host with its OpenID Connect provider, with a code
+// to approve in a browser, which works on machines without one too.
+func oidcLogin(host string, provider config.OIDCProvider) error {
+	console.Infof("Logging in to %s with %s...", host, provider.Issuer)
+	username, err := auth.Login(host, provider, func(code auth.DeviceCode) {
+		console.Info("")
+		console.Infof("To log in, open %s in a web browser and enter the code %s", code.VerificationURI, code.UserCode)
+		if code.VerificationURIComplete != "" {
+			maybeOpenBrowser(code.VerificationURIComplete)
+		} else {
+			maybeOpenBrowser(code.VerificationURI)
+		}
+		console.Info("")
+		console.Info("Waiting for the login to be approved...")
+	})
+	if err != nil {
+		return err
+	}
+	console.Infof("You've successfully authenticated as %s! The tokens for %s are refreshed when they expire.", username, host)
 	return nil
 }
 
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var (
+	migrateDryRun bool
+	migrateYes    bool
+)
+
+func newMigrateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Update deprecated fields in " + global.ConfigFilename,
+		Long: `Update deprecated fields in ` + global.ConfigFilename + `.
+
+Deprecated fields are rewritten to their current equivalents, keeping
+comments. The changes are shown as a diff, and you are asked to confirm
+them before ` + global.ConfigFilename + ` is written.`,
+		RunE: cmdMigrate,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "Show the changes without writing them")
+	cmd.Flags().BoolVarP(&migrateYes, "yes", "y", false, "Write the changes without asking for confirmation")
+	return cmd
+}
+
+func cmdMigrate(cmd *cobra.Command, args []string) error {
+	configPath, err := projectConfigPath()
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	migrated, changed, err := config.Migrate(contents)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		console.Infof("%s is up to date", global.ConfigFilename)
+		return nil
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(contents)),
+		B:        difflib.SplitLines(string(migrated)),
+		FromFile: "a/" + global.ConfigFilename,
+		ToFile:   "b/" + global.ConfigFilename,
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	for _, deprecation := range changed {
+		console.Infof("Replacing %s with %s", deprecation.Field, deprecation.Replacement)
+	}
+	fmt.Print(diff)
+
+	if migrateDryRun {
+		return nil
+	}
+	if !migrateYes {
+		ok, err := console.InteractiveBool{
+			Prompt:         "Write these changes to " + global.ConfigFilename + "?",
+			Default:        false,
+			NonDefaultFlag: "--yes",
+		}.Read()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(configPath, migrated, info.Mode()); err != nil {
+		return err
+	}
+	console.Infof("Updated %s", global.ConfigFilename)
+	return nil
+}
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+)
+
+// The environment variables the model's container is started with, so a
+// predictor can adapt to where it's running. python/cog/env.py fills in the
+// ones that aren't set, like when the image is run with docker run.
+const (
+	EnvModelName   = "COG_MODEL_NAME"
+	EnvImageDigest = "COG_IMAGE_DIGEST"
+	EnvGPUCount    = "COG_GPU_COUNT"
+	EnvCacheDir    = "COG_CACHE_DIR"
+)
+
+// DefaultCacheDir is COG_CACHE_DIR, unless it's set with --env
+const DefaultCacheDir = "/var/cache/cog"
+
+var envFlags []string
+
+func addEnvFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&envFlags, "env", "e", []string{}, "Set an environment variable in the model's container, like COG_CACHE_DIR=/cache, or pass it through from this one with just its name. Overrides the COG_* variables Cog sets")
+}
+
+// modelEnv returns the COG_* environment variables for running imageName,
+// which is the model in projectDir if it's set, with the variables in
+// --env overriding them.
+func modelEnv(cfg *config.Config, imageName string, projectDir string, runOptions docker.RunOptions) ([]string, error) {
+	env := map[string]string{
+		EnvModelName: modelName(cfg, imageName, projectDir),
+		EnvCacheDir:  DefaultCacheDir,
+	}
+	// All GPUs are counted in the container, as there's no telling how
+	// many there are from outside it
+	count, all := cdiGPUs(runOptions.Devices)
+	if !all && (runOptions.GPUs == "" || count > 0) {
+		env[EnvGPUCount] = strconv.Itoa(count)
+	}
+	if inspect, err := docker.ImageInspect(imageName); err == nil {
+		env[EnvImageDigest] = inspect.ID
+		if len(inspect.RepoDigests) > 0 {
+			_, digest, _ := strings.Cut(inspect.RepoDigests[0], "@")
+			env[EnvImageDigest] = digest
+		}
+	}
+
+	passThrough := []string{}
+	for _, flag := range envFlags {
+		name, value, ok := strings.Cut(flag, "=")
+		if name == "" {
+			return nil, fmt.Errorf("Invalid --env %s. It must be in the form NAME=value, or a NAME to pass through", flag)
+		}
+		if !ok {
+			delete(env, name)
+			passThrough = append(passThrough, name)
+			continue
+		}
+		env[name] = value
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []string{}
+	for _, name := range names {
+		result = append(result, name+"="+env[name])
+	}
+	return append(result, passThrough...), nil
+}
+
+// modelName returns the name of the model: the image in cog.yaml, or else
+// the name of the image it's run from without its tag.
+func modelName(cfg *config.Config, imageName string, projectDir string) string {
+	if cfg.Image != "" {
+		return cfg.Image
+	}
+	if projectDir != "" {
+		return config.DockerImageName(projectDir)
+	}
+	name, _, _ := strings.Cut(imageName, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+// cdiGPUs returns how many of devices are single GPUs, like
+// nvidia.com/gpu=0, and whether any of them are all GPUs.
+func cdiGPUs(devices []string) (count int, all bool) {
+	for _, device := range devices {
+		kind, name, _ := strings.Cut(device, "=")
+		if !docker.IsCDIDevice(device) || path.Base(kind) != "gpu" {
+			continue
+		}
+		if name == "all" {
+			all = true
+		} else {
+			count++
+		}
+	}
+	return count, all
+}
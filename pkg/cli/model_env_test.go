@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+)
+
+func TestModelEnv(t *testing.T) {
+	envFlags = []string{"COG_CACHE_DIR=/cache", "HF_TOKEN"}
+	defer func() { envFlags = nil }()
+
+	env, err := modelEnv(&config.Config{}, "cog-missing-image-for-test", "/home/me/SDXL Turbo", docker.RunOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"COG_CACHE_DIR=/cache",
+		"COG_GPU_COUNT=0",
+		"COG_MODEL_NAME=cog-sdxl-turbo",
+		"HF_TOKEN",
+	}, env)
+
+	// All GPUs are counted in the container
+	env, err = modelEnv(&config.Config{Image: "r8.im/acme/sdxl"}, "cog-missing-image-for-test", "", docker.RunOptions{GPUs: "all"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"COG_CACHE_DIR=/cache", "COG_MODEL_NAME=r8.im/acme/sdxl", "HF_TOKEN"}, env)
+
+	envFlags = []string{"=x"}
+	_, err = modelEnv(&config.Config{}, "cog-missing-image-for-test", "", docker.RunOptions{})
+	require.ErrorContains(t, err, "Invalid --env =x")
+}
+
+func TestModelName(t *testing.T) {
+	for image, name := range map[string]string{
+		"r8.im/acme/sdxl:v2":                  "r8.im/acme/sdxl",
+		"localhost:5000/sdxl":                 "localhost:5000/sdxl",
+		"localhost:5000/sdxl@sha256:abcdef12": "localhost:5000/sdxl",
+	} {
+		require.Equal(t, name, modelName(&config.Config{}, image, ""), image)
+	}
+}
+
+func TestCDIGPUs(t *testing.T) {
+	count, all := cdiGPUs([]string{"nvidia.com/gpu=0", "nvidia.com/gpu=1", "/dev/fuse"})
+	require.Equal(t, 2, count)
+	require.False(t, all)
+	_, all = cdiGPUs([]string{"nvidia.com/gpu=all"})
+	require.True(t, all)
+}
@@ -3,11 +3,18 @@ package cli
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/mitchellh/go-homedir"
@@ -17,14 +24,22 @@ import (
 	"github.com/replicate/cog/pkg/config"
 	"github.com/replicate/cog/pkg/docker"
 	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/nvidia"
 	"github.com/replicate/cog/pkg/predict"
+	"github.com/replicate/cog/pkg/storage"
 	"github.com/replicate/cog/pkg/util/console"
 	"github.com/replicate/cog/pkg/util/mime"
 )
 
 var (
-	inputFlags []string
-	outPath    string
+	inputFlags     []string
+	outPath        string
+	predictExample string
+	predictBind    string
+	predictModel   string
+	predictDetach  bool
+	predictGet     string
+	predictWait    string
 )
 
 func newPredictCommand() *cobra.Command {
@@ -37,84 +52,84 @@ If 'image' is passed, it will run the prediction on that Docker image.
 It must be an image that has been built by Cog.
 
 Otherwise, it will build the model in the current directory and run
-the prediction on that.`,
+the prediction on that.
+
+With --detach, the prediction is left running in its container, and its ID
+is printed. Its status can then be fetched with --get <id>, or waited for
+with --wait <id>, which writes its output and stops the container.`,
 		RunE:       cmdPredict,
 		Args:       cobra.MaximumNArgs(1),
 		SuggestFor: []string{"infer"},
 	}
 	addBuildProgressOutputFlag(cmd)
-	cmd.Flags().StringArrayVarP(&inputFlags, "input", "i", []string{}, "Inputs, in the form name=value. if value is prefixed with @, then it is read from a file on disk. E.g. -i path=@image.jpg")
-	cmd.Flags().StringVarP(&outPath, "output", "o", "", "Output path")
+	cmd.Flags().StringArrayVarP(&inputFlags, "input", "i", []string{}, "Inputs, in the form name=value. if value is prefixed with @, then it is read from a file on disk or a URI. E.g. -i path=@image.jpg or -i path=@s3://bucket/image.jpg")
+	cmd.Flags().StringVarP(&outPath, "output", "o", "", "Output path, or an s3://, gs://, az://, or https:// URI to upload it to")
+	cmd.Flags().StringVar(&predictExample, "example", "", "Use the inputs of this example from 'examples' in cog.yaml. Inputs passed with -i override them")
+	cmd.Flags().StringVar(&predictModel, "model", "", "Run the prediction with this model from 'models' in cog.yaml")
+	cmd.Flags().BoolVar(&predictDetach, "detach", false, "Start the prediction, print its ID, and leave it running in its container")
+	cmd.Flags().StringVar(&predictGet, "get", "", "Print the status of a prediction started with --detach, and its output if it has finished")
+	cmd.Flags().StringVar(&predictWait, "wait", "", "Wait for a prediction started with --detach to finish, write its output, and stop its container")
+	cmd.MarkFlagsMutuallyExclusive("detach", "get", "wait")
 	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
+	addBindFlag(cmd, &predictBind, "")
+	addDeviceFlag(cmd)
+	addEnvFlag(cmd)
 
 	return cmd
 }
 
 func cmdPredict(cmd *cobra.Command, args []string) error {
-	imageName := ""
-	volumes := []docker.Volume{}
-	gpus := ""
-
-	if len(args) == 0 {
-		// Build image
-
-		cfg, projectDir, err := config.GetConfig(projectDirFlag)
-		if err != nil {
-			return err
+	if predictGet != "" || predictWait != "" {
+		if len(args) > 0 || len(inputFlags) > 0 {
+			return fmt.Errorf("--get and --wait don't take an image or inputs")
 		}
-
-		if imageName, err = image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile); err != nil {
-			return err
+		if predictGet != "" {
+			return getDetachedPrediction(predictGet)
 		}
+		return waitForDetachedPrediction(predictWait)
+	}
 
-		// Base image doesn't have /src in it, so mount as volume
-		volumes = append(volumes, docker.Volume{
-			Source:      projectDir,
-			Destination: "/src",
-		})
-
-		if cfg.Build.GPU {
-			gpus = "all"
-		}
+	// Read input files while the image is built or pulled and started
+	prefetch := prefetchInputFlags(inputFlags)
 
-	} else {
-		// Use existing image
-		imageName = args[0]
+	runOptions, cfg, projectDir, err := modelRunOptions(args, predictBind)
+	if err != nil {
+		return err
+	}
 
-		exists, err := docker.ImageExists(imageName)
-		if err != nil {
-			return fmt.Errorf("Failed to determine if %s exists: %w", imageName, err)
+	if predictModel != "" {
+		if err := checkModel(cfg, predictModel); err != nil {
+			return err
 		}
-		if !exists {
-			console.Infof("Pulling image: %s", imageName)
-			if err := docker.Pull(imageName); err != nil {
-				return fmt.Errorf("Failed to pull %s: %w", imageName, err)
+	}
+
+	var baseInputs predict.Inputs
+	if predictExample != "" {
+		if projectDir != "" {
+			example, err := findExample(cfg, predictExample)
+			if err != nil {
+				return err
 			}
-		}
-		conf, err := image.GetConfig(imageName)
-		if err != nil {
+			baseInputs = predict.NewInputsWithBaseDir(example.Input, projectDir)
+		} else if baseInputs, err = imageExampleInputs(runOptions.Image, cfg, predictExample); err != nil {
 			return err
 		}
-		if conf.Build.GPU {
-			gpus = "all"
-		}
 	}
 
 	console.Info("")
-	console.Infof("Starting Docker image %s and running setup()...", imageName)
+	console.Infof("Starting Docker image %s and running setup()...", runOptions.Image)
 
-	predictor := predict.NewPredictor(docker.RunOptions{
-		GPUs:    gpus,
-		Image:   imageName,
-		Volumes: volumes,
-	})
+	predictor := predict.NewPredictor(runOptions)
 
+	interrupted := make(chan struct{})
 	go func() {
 		captureSignal := make(chan os.Signal, 1)
 		signal.Notify(captureSignal, syscall.SIGINT)
 
 		<-captureSignal
 
+		close(interrupted)
 		console.Info("Stopping container...")
 		if err := predictor.Stop(); err != nil {
 			console.Warnf("Failed to stop container: %s", err)
@@ -122,9 +137,20 @@ func cmdPredict(cmd *cobra.Command, args []string) error {
 	}()
 
 	if err := predictor.Start(os.Stderr); err != nil {
+		reportCrash(&predictor, projectDir, err, interrupted)
 		return err
 	}
 
+	if predictDetach {
+		if err := detachPrediction(&predictor, projectDir, inputFlags, prefetch, baseInputs, predictModel); err != nil {
+			if err := predictor.Stop(); err != nil {
+				console.Warnf("Failed to stop container: %s", err)
+			}
+			return err
+		}
+		return nil
+	}
+
 	// FIXME: will not run on signal
 	defer func() {
 		console.Debugf("Stopping container...")
@@ -133,24 +159,281 @@ func cmdPredict(cmd *cobra.Command, args []string) error {
 		}
 	}()
 
-	return predictIndividualInputs(predictor, inputFlags, outPath)
+	err = predictIndividualInputs(predictor, projectDir, inputFlags, prefetch, outPath, baseInputs, predictModel)
+	if errors.Is(err, errPredictionFailed) || (err != nil && predictor.Crashed()) {
+		reportCrash(&predictor, projectDir, err, interrupted)
+	}
+	return err
+}
+
+// errPredictionFailed is returned when the model raises an error during a
+// prediction
+var errPredictionFailed = errors.New("The prediction failed")
+
+// reportCrash writes a crash bundle for a failure of setup or a prediction
+// to the project directory, or the current directory if there isn't one, and
+// prints where it is. Failures caused by stopping the container with Ctrl-C
+// aren't crashes.
+func reportCrash(predictor *predict.Predictor, projectDir string, cause error, interrupted chan struct{}) {
+	select {
+	case <-interrupted:
+		return
+	default:
+	}
+	if projectDir == "" {
+		projectDir = "."
+	}
+	bundle, err := predictor.WriteCrashBundle(projectDir, cause)
+	if err != nil {
+		console.Warnf("Failed to write a crash bundle: %s", err)
+		return
+	}
+	console.Warnf("Wrote the container's logs and details of the crash to %s. Attach it when you report a bug", bundle)
+}
+
+// checkNvidiaDriver fails with a clear error if the NVIDIA driver is too old
+// for the model's version of CUDA, rather than leaving CUDA to fail to
+// initialize in the container.
+func checkNvidiaDriver(cfg *config.Config) error {
+	if cfg.Build.CUDA == "" {
+		return nil
+	}
+	minimum, err := config.MinimumDriverVersion(cfg.Build.CUDA)
+	if err != nil {
+		console.Debugf("Not checking the NVIDIA driver: %s", err)
+		return nil
+	}
+	return nvidia.CheckDriver(minimum, cfg.Build.CUDA)
+}
+
+// applyResources limits the container to the resources in cog.yaml.
+func applyResources(runOptions *docker.RunOptions, cfg *config.Config) {
+	if cfg.Resources == nil {
+		return
+	}
+	runOptions.CPUs = cfg.Resources.CPUs
+	runOptions.Memory = cfg.Resources.MemoryBytes()
+}
+
+// modelRunOptions returns the options to run a model with, and its config.
+// If an image is passed in args, it's pulled if necessary and its config is
+// read from it. Otherwise, the model in the current directory is built and
+// mounted in the container, and its directory is returned too. The HTTP
+// server is published on bind, if it's set.
+func modelRunOptions(args []string, bind string) (docker.RunOptions, *config.Config, string, error) {
+	runOptions := docker.RunOptions{Devices: devices}
+
+	port, published, err := bindPort(bind)
+	if err != nil {
+		return runOptions, nil, "", err
+	}
+
+	if len(args) == 0 {
+		// Build image
+
+		cfg, projectDir, err := getBuildConfig()
+		if err != nil {
+			return runOptions, nil, "", err
+		}
+
+		if runOptions.Image, err = image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile, docker.BuildOptions{}); err != nil {
+			return runOptions, nil, "", err
+		}
+
+		// Base image doesn't have /src in it, so mount as volume
+		runOptions.Volumes = append(runOptions.Volumes, docker.Volume{
+			Source:      projectDir,
+			Destination: "/src",
+		})
+
+		if cfg.Build.GPU {
+			runOptions.GPUs = "all"
+			runOptions.GPUVendor = cfg.Build.GPUVendor
+			if err := checkNvidiaDriver(cfg); err != nil {
+				return runOptions, nil, "", err
+			}
+		}
+		runOptions.Env = append(runOptions.Env, weightsRunEnv(cfg)...)
+		env, err := modelEnv(cfg, runOptions.Image, projectDir, runOptions)
+		if err != nil {
+			return runOptions, nil, "", err
+		}
+		runOptions.Env = append(runOptions.Env, env...)
+		applyResources(&runOptions, cfg)
+		volume, err := sharedWeightsVolume(cfg, runOptions.Image, projectDir)
+		if err != nil {
+			return runOptions, nil, "", err
+		}
+		if volume != nil {
+			runOptions.Volumes = append(runOptions.Volumes, *volume)
+		}
+		if published {
+			port.ContainerPort = cfg.ServingPort()
+			runOptions.Ports = append(runOptions.Ports, port)
+		}
+		return runOptions, cfg, projectDir, nil
+	}
+
+	// Use existing image
+	runOptions.Image = args[0]
+
+	exists, err := docker.ImageExists(runOptions.Image)
+	if err != nil {
+		return runOptions, nil, "", fmt.Errorf("Failed to determine if %s exists: %w", runOptions.Image, err)
+	}
+	if !exists {
+		console.Infof("Pulling image: %s", runOptions.Image)
+		if err := docker.Pull(runOptions.Image); err != nil {
+			return runOptions, nil, "", fmt.Errorf("Failed to pull %s: %w", runOptions.Image, err)
+		}
+	}
+	conf, err := image.GetConfig(runOptions.Image)
+	if err != nil {
+		return runOptions, nil, "", err
+	}
+	if conf.Build.GPU {
+		runOptions.GPUs = "all"
+		runOptions.GPUVendor = conf.Build.GPUVendor
+		if err := checkNvidiaDriver(conf); err != nil {
+			return runOptions, nil, "", err
+		}
+	}
+	runOptions.Env = append(runOptions.Env, weightsRunEnv(conf)...)
+	env, err := modelEnv(conf, runOptions.Image, "", runOptions)
+	if err != nil {
+		return runOptions, nil, "", err
+	}
+	runOptions.Env = append(runOptions.Env, env...)
+	applyResources(&runOptions, conf)
+	volume, err := sharedWeightsVolume(conf, runOptions.Image, "")
+	if err != nil {
+		return runOptions, nil, "", err
+	}
+	if volume != nil {
+		runOptions.Volumes = append(runOptions.Volumes, *volume)
+	}
+	if published {
+		port.ContainerPort = conf.ServingPort()
+		runOptions.Ports = append(runOptions.Ports, port)
+	}
+	return runOptions, conf, "", nil
+}
+
+// checkModel returns an error if cfg doesn't have a model called name.
+func checkModel(cfg *config.Config, name string) error {
+	if _, ok := cfg.Models[name]; ok {
+		return nil
+	}
+	if len(cfg.Models) == 0 {
+		return fmt.Errorf("There are no models in cog.yaml")
+	}
+	names := []string{}
+	for n := range cfg.Models {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("There is no model called %s in cog.yaml. Models are: %s", name, strings.Join(names, ", "))
 }
 
-func predictIndividualInputs(predictor predict.Predictor, inputFlags []string, outputPath string) error {
+// findExample returns the example called name from cfg.
+func findExample(cfg *config.Config, name string) (*config.Example, error) {
+	example, ok := cfg.Examples[name]
+	if !ok || example == nil {
+		names := []string{}
+		for n := range cfg.Examples {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("There are no examples in cog.yaml")
+		}
+		return nil, fmt.Errorf("There is no example called %s in cog.yaml. Examples are: %s", name, strings.Join(names, ", "))
+	}
+	return example, nil
+}
+
+// imageExampleInputs returns the inputs of an example, with its files read
+// from the copies built into imageName, so it works without the project
+// directory.
+func imageExampleInputs(imageName string, cfg *config.Config, name string) (predict.Inputs, error) {
+	example, err := findExample(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	inputs := predict.Inputs{}
+	for key, value := range example.Input {
+		value := value
+		if !strings.HasPrefix(value, "@") {
+			inputs[key] = predict.Input{String: &value}
+			continue
+		}
+		asset := path.Clean(value[1:])
+		content, err := docker.ReadImageFile(imageName, path.Join(config.ExampleAssetsDir, asset))
+		if err != nil {
+			return nil, err
+		}
+		dataURL := dataurl.New(content, mime.TypeByExtension(filepath.Ext(asset))).String()
+		inputs[key] = predict.Input{String: &dataURL}
+	}
+	return inputs, nil
+}
+
+// predictIndividualInputs runs a prediction and writes its output. It's
+// recorded in the history in projectDir, or the current directory if there
+// isn't one.
+func predictIndividualInputs(predictor predict.Predictor, projectDir string, inputFlags []string, prefetch *predict.Prefetch, outputPath string, baseInputs predict.Inputs, model string) error {
 	console.Info("Running prediction...")
 	schema, err := predictor.GetSchema()
 	if err != nil {
 		return err
 	}
-
-	inputs, err := parseInputFlags(inputFlags, schema)
+	inputs, err := predictionInputs(schema, inputFlags, prefetch, baseInputs)
 	if err != nil {
 		return err
 	}
-	prediction, err := predictor.Predict(inputs)
+	start := time.Now()
+	prediction, err := predictor.Predict(inputs, model)
+	recordPrediction(&predictor, projectDir, model, outputPath, start, prediction, err)
 	if err != nil {
 		return err
 	}
+	defer prediction.Cleanup()
+	return writePrediction(prediction, schema, outputPath)
+}
+
+// predictionInputs returns the inputs passed with -i, with inputs from
+// --example filled in.
+func predictionInputs(schema *openapi3.T, inputFlags []string, prefetch *predict.Prefetch, baseInputs predict.Inputs) (predict.Inputs, error) {
+	inputs, err := parseInputFlags(inputFlags, schema)
+	if err != nil {
+		return nil, err
+	}
+	if inputs, err = prefetch.Resolve(inputs); err != nil {
+		return nil, err
+	}
+	for key, input := range baseInputs {
+		if _, ok := inputs[key]; !ok {
+			inputs[key] = input
+		}
+	}
+	return inputs, nil
+}
+
+// writePrediction writes the output of a finished prediction to outputPath,
+// or prints it if outputPath is empty.
+func writePrediction(prediction *predict.Response, schema *openapi3.T, outputPath string) error {
+	if prediction.Status == "canceled" {
+		return fmt.Errorf("The prediction was canceled")
+	}
+	if prediction.Status == "failed" {
+		return fmt.Errorf("%w: %s", errPredictionFailed, prediction.Error)
+	}
+	if prediction.Status == "preempted" {
+		if prediction.Output == nil {
+			return fmt.Errorf("The prediction was preempted before it had any output")
+		}
+		console.Warn("The prediction was preempted, so its output might be incomplete")
+	}
 
 	// Generate output depending on type in schema
 	var out []byte
@@ -163,18 +446,7 @@ func predictIndividualInputs(predictor predict.Predictor, inputFlags []string, o
 	}
 
 	if outputSchema.Type == "string" && outputSchema.Format == "uri" {
-		dataurlObj, err := dataurl.DecodeString((*prediction.Output).(string))
-		if err != nil {
-			return fmt.Errorf("Failed to decode dataurl: %w", err)
-		}
-		out = dataurlObj.Data
-		if outputPath == "" {
-			outputPath = "output"
-			extension := mime.ExtensionByType(dataurlObj.ContentType())
-			if extension != "" {
-				outputPath += extension
-			}
-		}
+		return writeFileOutput(prediction, (*prediction.Output).(string), outputPath, "output")
 	} else if outputSchema.Type == "string" {
 		// Handle strings separately because if we encode it to JSON it will be surrounded by quotes.
 		s := (*prediction.Output).(string)
@@ -213,6 +485,10 @@ func predictIndividualInputs(predictor predict.Predictor, inputFlags []string, o
 }
 
 func writeOutput(outputPath string, output []byte) error {
+	if storage.IsURI(outputPath) {
+		return uploadOutput(outputPath, output)
+	}
+
 	outputPath, err := homedir.Expand(outputPath)
 	if err != nil {
 		return err
@@ -234,6 +510,95 @@ func writeOutput(outputPath string, output []byte) error {
 	return nil
 }
 
+// writeFileOutput writes an output file to outputPath, or, if it's empty, to
+// name with the extension of the file's content type. Large files were
+// already downloaded to a temporary file, so they are moved into place.
+func writeFileOutput(prediction *predict.Response, output string, outputPath string, name string) error {
+	// Ignore @, to make it behave the same as -i
+	outputPath = strings.TrimPrefix(outputPath, "@")
+
+	if file, ok := prediction.File(output); ok {
+		if outputPath == "" {
+			outputPath = name + mime.ExtensionByType(file.ContentType)
+		}
+		return moveOutput(file.Path, outputPath)
+	}
+
+	dataurlObj, err := dataurl.DecodeString(output)
+	if err != nil {
+		return fmt.Errorf("Failed to decode dataurl: %w", err)
+	}
+	if outputPath == "" {
+		outputPath = name + mime.ExtensionByType(dataurlObj.ContentType())
+	}
+	return writeOutput(outputPath, dataurlObj.Data)
+}
+
+// moveOutput moves a downloaded output file to outputPath, copying it if
+// they're on different filesystems.
+func moveOutput(tempPath string, outputPath string) error {
+	if storage.IsURI(outputPath) {
+		if err := storage.Upload(tempPath, outputPath); err != nil {
+			return err
+		}
+		console.Infof("Written output to %s", outputPath)
+		return nil
+	}
+
+	outputPath, err := homedir.Expand(outputPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, outputPath); err == nil {
+		if err := os.Chmod(outputPath, 0o644); err != nil {
+			return err
+		}
+		console.Infof("Written output to %s", outputPath)
+		return nil
+	}
+
+	src, err := os.Open(tempPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	console.Infof("Written output to %s", outputPath)
+	return nil
+}
+
+// uploadOutput writes output to a URI on cloud storage or an HTTP server.
+func uploadOutput(uri string, output []byte) error {
+	f, err := os.CreateTemp("", "cog-output-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(output); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := storage.Upload(f.Name(), uri); err != nil {
+		return err
+	}
+	console.Infof("Written output to %s", uri)
+	return nil
+}
+
 func handleMultipleFileOutput(prediction *predict.Response, outputSchema *openapi3.Schema) error {
 	outputs, ok := (*prediction.Output).([]interface{})
 	if !ok {
@@ -241,15 +606,7 @@ func handleMultipleFileOutput(prediction *predict.Response, outputSchema *openap
 	}
 
 	for i, output := range outputs {
-		outputString := output.(string)
-		dataurlObj, err := dataurl.DecodeString(outputString)
-		if err != nil {
-			return fmt.Errorf("Failed to decode dataurl: %w", err)
-		}
-		out := dataurlObj.Data
-		extension := mime.ExtensionByType(dataurlObj.ContentType())
-		outputPath := fmt.Sprintf("output.%d%s", i, extension)
-		if err := writeOutput(outputPath, out); err != nil {
+		if err := writeFileOutput(prediction, output.(string), "", fmt.Sprintf("output.%d", i)); err != nil {
 			return err
 		}
 	}
@@ -261,28 +618,46 @@ func parseInputFlags(inputs []string, schema *openapi3.T) (predict.Inputs, error
 	var err error
 	keyVals := map[string]string{}
 	for _, input := range inputs {
-		var name, value string
+		name, value := splitInputFlag(input)
 
 		// Default input name is "input"
-		if !strings.Contains(input, "=") {
+		if name == "" {
 			name, err = getFirstInput(schema)
 			if err != nil {
 				return nil, err
 			}
-			value = input
-		} else {
-			split := strings.SplitN(input, "=", 2)
-			name = split[0]
-			value = split[1]
-		}
-		if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
-			value = value[1 : len(value)-1]
 		}
 		keyVals[name] = value
 	}
 	return predict.NewInputs(keyVals), nil
 }
 
+// splitInputFlag splits an -i flag into its name and value. The name is
+// empty if it's just a value, for the first input.
+func splitInputFlag(input string) (name string, value string) {
+	value = input
+	if strings.Contains(input, "=") {
+		split := strings.SplitN(input, "=", 2)
+		name = split[0]
+		value = split[1]
+	}
+	if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	return name, value
+}
+
+// prefetchInputFlags starts reading the files and downloading the URIs
+// passed with -i in the background.
+func prefetchInputFlags(inputs []string) *predict.Prefetch {
+	keyVals := map[string]string{}
+	for i, input := range inputs {
+		_, value := splitInputFlag(input)
+		keyVals[strconv.Itoa(i)] = value
+	}
+	return predict.PrefetchInputs(predict.NewInputs(keyVals))
+}
+
 func getFirstInput(schema *openapi3.T) (string, error) {
 	inputProperties := schema.Components.Schemas["Input"].Value.Properties
 	for k, v := range inputProperties {
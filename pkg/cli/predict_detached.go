@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/predict"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// detachedPollInterval is how often --wait checks whether a prediction has
+// finished
+const detachedPollInterval = time.Second
+
+// detachPrediction starts a prediction in the predictor's container without
+// waiting for it, and prints its ID. It's recorded in the project directory,
+// or the current directory if there isn't one, so --get and --wait can find
+// the container it's running in.
+func detachPrediction(predictor *predict.Predictor, projectDir string, inputFlags []string, prefetch *predict.Prefetch, baseInputs predict.Inputs, model string) error {
+	schema, err := predictor.GetSchema()
+	if err != nil {
+		return err
+	}
+	inputs, err := predictionInputs(schema, inputFlags, prefetch, baseInputs)
+	if err != nil {
+		return err
+	}
+	id, err := newPredictionID()
+	if err != nil {
+		return err
+	}
+	if _, err := predictor.PredictAsync(inputs, model, id); err != nil {
+		return err
+	}
+	if projectDir == "" {
+		projectDir = "."
+	}
+	if err := predictor.Detach(projectDir, id); err != nil {
+		return fmt.Errorf("Failed to record the prediction: %w", err)
+	}
+
+	console.Infof("Started prediction %s. Run 'cog predict --get %s' to see how it's going, or 'cog predict --wait %s' to wait for its output", id, id, id)
+	console.Output(id)
+	return nil
+}
+
+func newPredictionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// loadDetachedPrediction finds a prediction started with --detach, in the
+// project directory, or the current directory for predictions on an image.
+func loadDetachedPrediction(id string) (*predict.Detached, string, error) {
+	dirs := []string{}
+	if projectDir, err := config.GetProjectDir(projectDirFlag); err == nil {
+		dirs = append(dirs, projectDir)
+	}
+	dirs = append(dirs, ".")
+	for _, dir := range dirs {
+		detached, err := predict.LoadDetached(dir, id)
+		if err == nil {
+			return detached, dir, nil
+		}
+		if !errors.Is(err, predict.ErrUnknownPrediction) {
+			return nil, "", err
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s", predict.ErrUnknownPrediction, id)
+}
+
+func getDetachedPrediction(id string) error {
+	detached, _, err := loadDetachedPrediction(id)
+	if err != nil {
+		return err
+	}
+	predictor := detached.Predictor()
+	prediction, err := predictor.GetPrediction(id)
+	if err != nil {
+		return err
+	}
+	console.Infof("Prediction %s is %s", id, prediction.Status)
+	if !prediction.Done() {
+		return nil
+	}
+	schema, err := predictor.GetSchema()
+	if err != nil {
+		return err
+	}
+	return writePrediction(prediction, schema, outPath)
+}
+
+// waitForDetachedPrediction waits for a prediction started with --detach to
+// finish, writes its output, and stops the container it ran in.
+func waitForDetachedPrediction(id string) error {
+	detached, dir, err := loadDetachedPrediction(id)
+	if err != nil {
+		return err
+	}
+	predictor := detached.Predictor()
+
+	console.Infof("Waiting for prediction %s...", id)
+	var prediction *predict.Response
+	for {
+		if prediction, err = predictor.GetPrediction(id); err != nil {
+			return err
+		}
+		if prediction.Done() {
+			break
+		}
+		time.Sleep(detachedPollInterval)
+	}
+
+	schema, err := predictor.GetSchema()
+	if err != nil {
+		return err
+	}
+	err = writePrediction(prediction, schema, outPath)
+
+	console.Debugf("Stopping container...")
+	if err := predictor.Stop(); err != nil {
+		console.Warnf("Failed to stop container: %s", err)
+	}
+	if err := detached.Remove(dir); err != nil {
+		console.Warnf("Failed to remove the record of prediction %s: %s", id, err)
+	}
+	return err
+}
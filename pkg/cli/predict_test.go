@@ -0,0 +1,24 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitInputFlag(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		name  string
+		value string
+	}{
+		{"prompt=a photo of a cat", "prompt", "a photo of a cat"},
+		{"image=@cat.jpg", "image", "@cat.jpg"},
+		{`prompt="a=b"`, "prompt", "a=b"},
+		{"@cat.jpg", "", "@cat.jpg"},
+	} {
+		name, value := splitInputFlag(tt.input)
+		require.Equal(t, tt.name, name, tt.input)
+		require.Equal(t, tt.value, value, tt.input)
+	}
+}
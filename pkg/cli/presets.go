@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+func newPresetsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "presets",
+		Short: "List the presets build.preset can be set to",
+		Long: `List the presets build.preset in cog.yaml can be set to.
+
+A preset is a curated set of Python and system packages for a framework,
+pinned to versions that are known to work together. Packages in
+python_packages or python_requirements take precedence over the preset's,
+so you can override a version.`,
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the presets",
+		RunE:  cmdPresetsList,
+		Args:  cobra.NoArgs,
+	}
+
+	show := &cobra.Command{
+		Use:     "show NAME",
+		Short:   "Show what a preset installs",
+		Example: `cog presets show diffusers-cuda12`,
+		RunE:    cmdPresetsShow,
+		Args:    cobra.ExactArgs(1),
+	}
+
+	cmd.AddCommand(list, show)
+	return cmd
+}
+
+func cmdPresetsList(cmd *cobra.Command, args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCUDA\tDESCRIPTION")
+	for _, name := range config.PresetNames() {
+		preset, _ := config.LookupPreset(name)
+		cuda := preset.CUDA
+		if cuda == "" {
+			cuda = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", preset.Name, cuda, preset.Description)
+	}
+	return w.Flush()
+}
+
+func cmdPresetsShow(cmd *cobra.Command, args []string) error {
+	preset, ok := config.LookupPreset(args[0])
+	if !ok {
+		return fmt.Errorf("There's no preset called %q. It must be one of: %s", args[0], strings.Join(config.PresetNames(), ", "))
+	}
+	console.Output(preset.Description)
+	console.Output("")
+	if preset.GPU {
+		console.Output("gpu: true")
+	}
+	if preset.CUDA != "" {
+		console.Output("cuda: " + preset.CUDA)
+	}
+	if len(preset.SystemPackages) > 0 {
+		console.Output("system_packages:")
+		for _, pkg := range preset.SystemPackages {
+			console.Output("  - " + pkg)
+		}
+	}
+	console.Output("python_packages:")
+	for _, pkg := range preset.PythonPackages {
+		console.Output("  - " + pkg)
+	}
+	return nil
+}
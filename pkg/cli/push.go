@@ -6,8 +6,6 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/replicate/cog/pkg/config"
-	"github.com/replicate/cog/pkg/docker"
 	"github.com/replicate/cog/pkg/global"
 	"github.com/replicate/cog/pkg/image"
 	"github.com/replicate/cog/pkg/util/console"
@@ -24,11 +22,18 @@ func newPushCommand() *cobra.Command {
 	}
 	addBuildProgressOutputFlag(cmd)
 	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
+	addBuildIsolationFlags(cmd)
+	addBuildVerifyFlag(cmd)
+	addBuildStrictFlag(cmd)
+	addBuildSSHFlag(cmd)
+	addBuildOfflineFlags(cmd)
+	addBuildPlatformFlag(cmd)
 	return cmd
 }
 
 func push(cmd *cobra.Command, args []string) error {
-	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	cfg, projectDir, err := getBuildConfig()
 	if err != nil {
 		return err
 	}
@@ -42,13 +47,19 @@ func push(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("To push images, you must either set the 'image' option in cog.yaml or pass an image name as an argument. For example, 'cog push registry.hooli.corp/hotdog-detector'")
 	}
 
-	if err := image.Build(cfg, projectDir, imageName, buildProgressOutput, groupFile); err != nil {
+	if err := validateBuildIsolationFlags(); err != nil {
 		return err
 	}
 
-	console.Infof("\nPushing image '%s'...", imageName)
+	if err := validateBuildPlatform(); err != nil {
+		return err
+	}
+
+	if err := image.CheckPushPolicy(imageName); err != nil {
+		return err
+	}
 
-	exitStatus := docker.Push(imageName)
+	exitStatus := buildAndPushImage(cfg, projectDir, imageName)
 	if exitStatus == nil {
 		console.Infof("Image '%s' pushed", imageName)
 		replicatePrefix := fmt.Sprintf("%s/", global.ReplicateRegistryHost)
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/predict"
+	"github.com/replicate/cog/pkg/replay"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var (
+	replayFrom      string
+	replayTolerance float64
+)
+
+func newReplayCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay [image]",
+		Short: "Replay captured requests against a local build",
+		Long: `Replay captured requests against a local build.
+
+Each line of the --from file is a prediction request in the format of the
+queue API, like {"id": "...", "input": {...}}. It can also have the
+"status_code" that production responded with, and the completed prediction
+in "response", as it was sent to the webhook. The requests are run one at a
+time, and the status codes, statuses, and outputs of the local build are
+compared with production's.
+
+If 'image' is passed, the requests are run on that image. Otherwise, the
+model in the current directory is built first.`,
+		Example: `  cog replay --from requests.ndjson`,
+		RunE:    cmdReplay,
+		Args:    cobra.MaximumNArgs(1),
+	}
+	addBuildProgressOutputFlag(cmd)
+	addGroupFileFlag(cmd)
+	cmd.Flags().StringVar(&replayFrom, "from", "", "Newline-delimited JSON file of captured requests")
+	cmd.Flags().Float64Var(&replayTolerance, "tolerance", 0, "How far numbers in outputs can be from production's and still be the same")
+	_ = cmd.MarkFlagRequired("from")
+	return cmd
+}
+
+func cmdReplay(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(replayFrom)
+	if err != nil {
+		return err
+	}
+	requests, err := replay.ReadRequests(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", replayFrom, err)
+	}
+	if len(requests) == 0 {
+		return fmt.Errorf("There are no requests in %s", replayFrom)
+	}
+
+	runOptions, _, _, err := modelRunOptions(args, "")
+	if err != nil {
+		return err
+	}
+
+	console.Info("")
+	console.Infof("Starting Docker image %s and running setup()...", runOptions.Image)
+
+	predictor := predict.NewPredictor(runOptions)
+
+	go func() {
+		captureSignal := make(chan os.Signal, 1)
+		signal.Notify(captureSignal, syscall.SIGINT)
+
+		<-captureSignal
+
+		console.Info("Stopping container...")
+		if err := predictor.Stop(); err != nil {
+			console.Warnf("Failed to stop container: %s", err)
+		}
+	}()
+
+	if err := predictor.Start(os.Stderr); err != nil {
+		return err
+	}
+
+	// FIXME: will not run on signal
+	defer func() {
+		console.Debugf("Stopping container...")
+		if err := predictor.Stop(); err != nil {
+			console.Warnf("Failed to stop container: %s", err)
+		}
+	}()
+
+	different := 0
+	for _, request := range requests {
+		statusCode, response, err := predictor.PredictJSON(request.Input)
+		if err != nil {
+			return fmt.Errorf("Failed to replay %s: %w", request.Name(), err)
+		}
+		var prediction *replay.Prediction
+		if response != nil {
+			prediction = &replay.Prediction{Status: string(response.Status), Error: response.Error}
+			if response.Output != nil {
+				prediction.Output = *response.Output
+			}
+		}
+
+		diffs := replay.Compare(request, statusCode, prediction, replayTolerance)
+		if len(diffs) == 0 {
+			console.Infof("✓ %s", request.Name())
+			continue
+		}
+		different++
+		console.Infof("✗ %s", request.Name())
+		for _, diff := range diffs {
+			console.Infof("    %s", diff)
+		}
+	}
+
+	console.Info("")
+	if different > 0 {
+		return fmt.Errorf("%d of %d requests were different from production", different, len(requests))
+	}
+	console.Infof("All %d requests were the same as production", len(requests))
+	return nil
+}
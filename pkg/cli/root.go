@@ -2,9 +2,13 @@ package cli
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 
+	"github.com/replicate/cog/pkg/docker"
 	"github.com/replicate/cog/pkg/global"
 	"github.com/replicate/cog/pkg/update"
 	"github.com/replicate/cog/pkg/util/console"
@@ -29,6 +33,11 @@ https://github.com/replicate/cog`,
 				console.SetLevel(console.DebugLevel)
 			}
 			cmd.SilenceUsage = true
+			// Docker runs the credential helper on every pull and push,
+			// and reads what it prints
+			if cmd.Name() == dockerCredentialHelperCommand {
+				return
+			}
 			if err := update.DisplayAndCheckForRelease(); err != nil {
 				console.Debugf("%s", err)
 			}
@@ -39,18 +48,45 @@ https://github.com/replicate/cog`,
 
 	rootCmd.AddCommand(
 		newBuildCommand(),
+		newCodegenCommand(),
+		newConfigCommand(),
+		newCredentialsCommand(),
 		newDebugCommand(),
+		newDedupeReportCommand(),
+		newDockerCredentialHelperCommand(),
+		newEnvCommand(),
+		newExplainCommand(),
+		newExportCommand(),
+		newHistoryCommand(),
 		newInitCommand(),
+		newLintCommand(),
+		newLockCommand(),
 		newLoginCommand(),
+		newMigrateCommand(),
 		newPredictCommand(),
+		newPresetsCommand(),
 		newPushCommand(),
+		newReplayCommand(),
 		newRunCommand(),
+		newServeCommand(),
 		newTrainCommand(),
+		newUpgradeCommand(),
+		newVersionCommand(),
+		newWeightsCommand(),
 	)
 
 	return &rootCmd, nil
 }
 
+// RunAsDockerCredentialHelper runs Cog as Docker's credential helper if
+// it was run as docker-credential-cog, which is a link to cog.
+func RunAsDockerCredentialHelper(cmd *cobra.Command, program string) {
+	name := strings.TrimSuffix(filepath.Base(program), ".exe")
+	if name == "docker-credential-"+docker.CogCredentialHelper {
+		cmd.SetArgs(append([]string{dockerCredentialHelperCommand}, os.Args[1:]...))
+	}
+}
+
 func setPersistentFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().BoolVar(&global.Debug, "debug", false, "Show debugging output")
 	cmd.PersistentFlags().BoolVar(&global.ProfilingEnabled, "profile", false, "Enable profiling")
@@ -4,7 +4,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/replicate/cog/pkg/config"
 	"github.com/replicate/cog/pkg/docker"
 	"github.com/replicate/cog/pkg/image"
 	"github.com/replicate/cog/pkg/util/console"
@@ -13,6 +12,7 @@ import (
 
 var (
 	runPorts []string
+	devices  []string
 )
 
 func newRunCommand() *cobra.Command {
@@ -30,19 +30,23 @@ func newRunCommand() *cobra.Command {
 	// This is called `publish` for consistency with `docker run`
 	cmd.Flags().StringArrayVarP(&runPorts, "publish", "p", []string{}, "Publish a container's port to the host, e.g. -p 8000")
 
+	addDeviceFlag(cmd)
+	addEnvFlag(cmd)
+
 	flags.SetInterspersed(false)
 	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
 
 	return cmd
 }
 
 func run(cmd *cobra.Command, args []string) error {
-	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	cfg, projectDir, err := getBuildConfig()
 	if err != nil {
 		return err
 	}
 
-	imageName, err := image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile)
+	imageName, err := image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile, docker.BuildOptions{})
 	if err != nil {
 		return err
 	}
@@ -53,13 +57,21 @@ func run(cmd *cobra.Command, args []string) error {
 	}
 
 	runOptions := docker.RunOptions{
-		Args:    args,
-		GPUs:    gpus,
-		Image:   imageName,
-		Volumes: []docker.Volume{{Source: projectDir, Destination: "/src"}},
-		Workdir: "/src",
+		Args:      args,
+		Devices:   devices,
+		GPUs:      gpus,
+		GPUVendor: cfg.Build.GPUVendor,
+		Image:     imageName,
+		Volumes:   []docker.Volume{{Source: projectDir, Destination: "/src"}},
+		Workdir:   "/src",
 	}
 
+	env, err := modelEnv(cfg, imageName, projectDir, runOptions)
+	if err != nil {
+		return err
+	}
+	runOptions.Env = env
+
 	for _, portString := range runPorts {
 		port, err := strconv.Atoi(portString)
 		if err != nil {
@@ -73,3 +85,7 @@ func run(cmd *cobra.Command, args []string) error {
 	console.Infof("Running '%s' in Docker with the current directory mounted as a volume...", strings.Join(args, " "))
 	return docker.Run(runOptions)
 }
+
+func addDeviceFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&devices, "device", []string{}, "Add a device to the container, e.g. /dev/fuse, or a CDI device like nvidia.com/gpu=0, which is used instead of all GPUs")
+}
@@ -0,0 +1,194 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var (
+	serveBind string
+	serveUnix string
+)
+
+// The directory the directory of the socket passed to --unix is mounted at
+// in the container
+const containerSocketDir = "/var/run/cog"
+
+func newServeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Run the HTTP server for the model in the current directory",
+		Long: `Run the HTTP server for the model in the current directory.
+
+This builds the model, and runs its HTTP server with the current directory
+mounted, so changes to the code are picked up when it is restarted. The
+server listens on both IPv4 and IPv6 inside the container, and --bind sets
+the address it is published on, which can be IPv6.
+
+With --unix, it listens on a Unix domain socket instead, and no port is
+published, so only processes on this machine that can reach the socket can
+use it. The directory the socket is in is mounted into the container, so
+use a directory of its own, and set its permissions to control who can
+connect. This only works where Docker runs on the same kernel, like Linux,
+and not with Docker Desktop.`,
+		Example: `cog serve
+cog serve --bind 127.0.0.1:8080
+cog serve --bind [::]:5000
+cog serve --unix /run/cog/model.sock`,
+		RunE: cmdServe,
+		Args: cobra.NoArgs,
+	}
+	addBuildProgressOutputFlag(cmd)
+	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
+	addBindFlag(cmd, &serveBind, ":5000")
+	addDeviceFlag(cmd)
+	addEnvFlag(cmd)
+	cmd.Flags().StringVar(&serveUnix, "unix", "", "Listen on this Unix domain socket instead of publishing a port")
+	return cmd
+}
+
+// addBindFlag adds --bind to cmd. Each command has its own variable,
+// because they have different defaults.
+func addBindFlag(cmd *cobra.Command, bind *string, defaultBind string) {
+	usage := "Address to publish the HTTP server on, as host:port. Either can be left out, like [::]: or :5000"
+	if defaultBind == "" {
+		usage += ". Defaults to a free port on all addresses"
+	}
+	cmd.Flags().StringVar(bind, "bind", defaultBind, usage)
+}
+
+// bindPort returns the port to publish the HTTP server in the container on
+// for a --bind of bind, and whether it was set.
+func bindPort(bind string) (port docker.Port, ok bool, err error) {
+	if bind == "" {
+		return docker.Port{}, false, nil
+	}
+	port, err = parseBind(bind)
+	return port, err == nil, err
+}
+
+func parseBind(bind string) (docker.Port, error) {
+	host, portString, err := net.SplitHostPort(bind)
+	if err != nil {
+		return docker.Port{}, fmt.Errorf("Invalid --bind %s. It must be in the form host:port, like 127.0.0.1:5000, or [::]:5000 for IPv6", bind)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return docker.Port{}, fmt.Errorf("Invalid --bind %s. The host must be an IP address, like 127.0.0.1 or ::1", bind)
+	}
+	hostPort := 0
+	if portString != "" {
+		hostPort, err = strconv.Atoi(portString)
+		if err != nil || hostPort < 0 || hostPort > 65535 {
+			return docker.Port{}, fmt.Errorf("Invalid --bind %s. The port must be a number between 0 and 65535", bind)
+		}
+	}
+	return docker.Port{HostIP: host, HostPort: hostPort, ContainerPort: config.DefaultServingPort}, nil
+}
+
+func cmdServe(cmd *cobra.Command, args []string) error {
+	if serveUnix != "" && cmd.Flags().Changed("bind") {
+		return fmt.Errorf("Only one of --bind and --unix can be set")
+	}
+	port, _, err := bindPort(serveBind)
+	if err != nil {
+		return err
+	}
+
+	cfg, projectDir, err := getBuildConfig()
+	if err != nil {
+		return err
+	}
+
+	imageName, err := image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile, docker.BuildOptions{})
+	if err != nil {
+		return err
+	}
+
+	gpus := ""
+	if cfg.Build.GPU {
+		gpus = "all"
+	}
+
+	runOptions := docker.RunOptions{
+		Args:      cfg.ServerCommand(),
+		Devices:   devices,
+		Env:       weightsRunEnv(cfg),
+		GPUs:      gpus,
+		GPUVendor: cfg.Build.GPUVendor,
+		Image:     imageName,
+		Volumes:   []docker.Volume{{Source: projectDir, Destination: "/src"}},
+		Workdir:   "/src",
+	}
+	runOptions.Env = append(runOptions.Env, webhookAuthEnv()...)
+	env, err := modelEnv(cfg, imageName, projectDir, runOptions)
+	if err != nil {
+		return err
+	}
+	runOptions.Env = append(runOptions.Env, env...)
+	applyResources(&runOptions, cfg)
+	volume, err := sharedWeightsVolume(cfg, imageName, projectDir)
+	if err != nil {
+		return err
+	}
+	if volume != nil {
+		runOptions.Volumes = append(runOptions.Volumes, *volume)
+	}
+
+	console.Info("")
+	if serveUnix != "" {
+		socketDir, err := unixSocketDir(serveUnix)
+		if err != nil {
+			return err
+		}
+		runOptions.Args = append(runOptions.Args, "--unix-socket", path.Join(containerSocketDir, filepath.Base(serveUnix)))
+		runOptions.Volumes = append(runOptions.Volumes, docker.Volume{Source: socketDir, Destination: containerSocketDir})
+		console.Infof("Serving the model on %s", serveUnix)
+		return docker.Run(runOptions)
+	}
+
+	port.ContainerPort = cfg.ServingPort()
+	runOptions.Ports = []docker.Port{port}
+	if port.HostPort == 0 {
+		console.Infof("Serving the model on a free port. Run 'docker ps' to find which one")
+	} else {
+		host := port.HostIP
+		if host == "" {
+			host = "localhost"
+		}
+		console.Infof("Serving the model at http://%s", net.JoinHostPort(host, strconv.Itoa(port.HostPort)))
+	}
+	return docker.Run(runOptions)
+}
+
+// unixSocketDir returns the absolute path of the directory the socket at
+// socketPath is created in, which must exist.
+func unixSocketDir(socketPath string) (string, error) {
+	abs, err := filepath.Abs(socketPath)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(abs)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("The directory for the socket %s doesn't exist: %w", socketPath, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s isn't a directory", dir)
+	}
+	if info, err := os.Lstat(abs); err == nil && info.Mode()&os.ModeSocket == 0 {
+		return "", fmt.Errorf("%s already exists and isn't a socket", socketPath)
+	}
+	return dir, nil
+}
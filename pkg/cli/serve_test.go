@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/docker"
+)
+
+func TestParseBind(t *testing.T) {
+	for _, tt := range []struct {
+		bind     string
+		expected docker.Port
+	}{
+		{":5000", docker.Port{HostPort: 5000, ContainerPort: 5000}},
+		{"127.0.0.1:8080", docker.Port{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 5000}},
+		{"[::]:5000", docker.Port{HostIP: "::", HostPort: 5000, ContainerPort: 5000}},
+		{"[::1]:", docker.Port{HostIP: "::1", ContainerPort: 5000}},
+	} {
+		port, err := parseBind(tt.bind)
+		require.NoError(t, err, tt.bind)
+		require.Equal(t, tt.expected, port, tt.bind)
+	}
+
+	for _, bind := range []string{"5000", "::1:5000", "localhost:5000", "[::]:http", ":70000"} {
+		_, err := parseBind(bind)
+		require.Error(t, err, bind)
+	}
+}
+
+func TestUnixSocketDir(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	dir, err := unixSocketDir(filepath.Join(tmpDir, "cog.sock"))
+	require.NoError(t, err)
+	require.Equal(t, tmpDir, dir)
+
+	_, err = unixSocketDir(filepath.Join(tmpDir, "missing", "cog.sock"))
+	require.ErrorContains(t, err, "doesn't exist")
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "predict.py"), []byte{}, 0o644))
+	_, err = unixSocketDir(filepath.Join(tmpDir, "predict.py"))
+	require.ErrorContains(t, err, "isn't a socket")
+}
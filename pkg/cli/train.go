@@ -5,7 +5,6 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/replicate/cog/pkg/config"
 	"github.com/replicate/cog/pkg/docker"
 	"github.com/replicate/cog/pkg/image"
 	"github.com/replicate/cog/pkg/predict"
@@ -15,6 +14,7 @@ import (
 
 var (
 	trainInputFlags []string
+	trainOutPath    string
 )
 
 func newTrainCommand() *cobra.Command {
@@ -29,26 +29,31 @@ It will build the model in the current directory and train it.`,
 		Hidden: true,
 	}
 	addBuildProgressOutputFlag(cmd)
-	cmd.Flags().StringArrayVarP(&trainInputFlags, "input", "i", []string{}, "Inputs, in the form name=value. if value is prefixed with @, then it is read from a file on disk. E.g. -i path=@image.jpg")
+	cmd.Flags().StringArrayVarP(&trainInputFlags, "input", "i", []string{}, "Inputs, in the form name=value. if value is prefixed with @, then it is read from a file on disk or a URI. E.g. -i path=@image.jpg or -i path=@s3://bucket/image.jpg")
+	cmd.Flags().StringVarP(&trainOutPath, "output", "o", "weights", "Path to write the weights to, or an s3://, gs://, az://, or https:// URI to upload them to")
+	addEnvFlag(cmd)
 	addGroupFileFlag(cmd)
+	addConfigFileFlag(cmd)
 
 	return cmd
 }
 
 func cmdTrain(cmd *cobra.Command, args []string) error {
+	// Read input files while the image is built and started
+	prefetch := prefetchInputFlags(trainInputFlags)
+
 	imageName := ""
 	volumes := []docker.Volume{}
 	gpus := ""
-	weightsPath := "weights"
 
 	// Build image
 
-	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	cfg, projectDir, err := getBuildConfig()
 	if err != nil {
 		return err
 	}
 
-	if imageName, err = image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile); err != nil {
+	if imageName, err = image.BuildBase(cfg, projectDir, buildProgressOutput, groupFile, docker.BuildOptions{}); err != nil {
 		return err
 	}
 
@@ -65,12 +70,21 @@ func cmdTrain(cmd *cobra.Command, args []string) error {
 	console.Info("")
 	console.Infof("Starting Docker image %s...", imageName)
 
-	predictor := predict.NewPredictor(docker.RunOptions{
-		GPUs:    gpus,
-		Image:   imageName,
-		Volumes: volumes,
-		Args:    []string{"python", "-m", "cog.server.http", "--x-mode", "train"},
-	})
+	runOptions := docker.RunOptions{
+		Env:       weightsRunEnv(cfg),
+		GPUs:      gpus,
+		GPUVendor: cfg.Build.GPUVendor,
+		Image:     imageName,
+		Volumes:   volumes,
+		Args:      append(cfg.ServerCommand(), "--x-mode", "train"),
+	}
+	env, err := modelEnv(cfg, imageName, projectDir, runOptions)
+	if err != nil {
+		return err
+	}
+	runOptions.Env = append(runOptions.Env, env...)
+
+	predictor := predict.NewPredictor(runOptions)
 
 	go func() {
 		captureSignal := make(chan os.Signal, 1)
@@ -96,5 +110,5 @@ func cmdTrain(cmd *cobra.Command, args []string) error {
 		}
 	}()
 
-	return predictIndividualInputs(predictor, trainInputFlags, weightsPath)
+	return predictIndividualInputs(predictor, projectDir, trainInputFlags, prefetch, trainOutPath, nil, "")
 }
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/update"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var upgradeForce bool
+
+func newUpgradeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade Cog to the latest release",
+		Long: `Upgrade Cog to the latest release.
+
+This fetches the latest release from the release channel, which is
+release_channel.url in your user config or the one Cog was built with,
+verifies it's signed with the
+channel's public key, and replaces this binary with it.`,
+		RunE: cmdUpgrade,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().BoolVar(&upgradeForce, "force", false, "Install the latest release even if it isn't newer than this version")
+	return cmd
+}
+
+func cmdUpgrade(cmd *cobra.Command, args []string) error {
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	url, publicKey, err := releaseChannel(userConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), 10*time.Minute)
+	defer cancel()
+	release, err := update.LatestRelease(ctx, url, publicKey)
+	if err != nil {
+		return err
+	}
+	if !upgradeForce && !update.IsOlder(global.Version, release.Version) {
+		console.Infof("Cog %s is the latest release", global.Version)
+		return nil
+	}
+	if err := update.Upgrade(ctx, release); err != nil {
+		return err
+	}
+	console.Infof("Upgraded Cog from %s to %s", global.Version, release.Version)
+	return nil
+}
+
+// releaseChannel returns the URL of the release channel in the user config
+// and the key its releases are signed with, falling back to the default
+// channel Cog was built with.
+func releaseChannel(userConfig *config.UserConfig) (url string, publicKey string, err error) {
+	if userConfig.ReleaseChannel.URL != "" {
+		return userConfig.ReleaseChannel.URL, userConfig.ReleaseChannel.PublicKey, nil
+	}
+	if global.ReleaseURL == "" {
+		return "", "", fmt.Errorf("No release channel is configured. This build of Cog doesn't have a default one, so set release_channel.url and release_channel.public_key in your user config, or install a new version of Cog the way you installed this one")
+	}
+	return global.ReleaseURL, global.ReleasePublicKey, nil
+}
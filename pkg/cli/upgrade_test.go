@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/global"
+)
+
+func TestReleaseChannel(t *testing.T) {
+	defer func(url, key string) {
+		global.ReleaseURL, global.ReleasePublicKey = url, key
+	}(global.ReleaseURL, global.ReleasePublicKey)
+	global.ReleaseURL, global.ReleasePublicKey = "", ""
+
+	_, _, err := releaseChannel(&config.UserConfig{})
+	require.ErrorContains(t, err, "No release channel is configured")
+
+	userConfig := &config.UserConfig{ReleaseChannel: config.ReleaseChannel{URL: "https://releases.example.com/stable.json", PublicKey: "user-key"}}
+	url, key, err := releaseChannel(userConfig)
+	require.NoError(t, err)
+	require.Equal(t, "https://releases.example.com/stable.json", url)
+	require.Equal(t, "user-key", key)
+
+	global.ReleaseURL, global.ReleasePublicKey = "https://cog.example.com/stable.json", "build-key"
+	url, key, err = releaseChannel(&config.UserConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "https://cog.example.com/stable.json", url)
+	require.Equal(t, "build-key", key)
+
+	// The user config's channel is used with its own key, not Cog's
+	url, key, err = releaseChannel(userConfig)
+	require.NoError(t, err)
+	require.Equal(t, "https://releases.example.com/stable.json", url)
+	require.Equal(t, "user-key", key)
+}
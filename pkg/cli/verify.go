@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/image"
+	"github.com/replicate/cog/pkg/predict"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var buildVerify string
+
+func addBuildVerifyFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&buildVerify, "verify", "", "After building, run an example from 'examples' in cog.yaml ('default' if no name is given), and only tag the image if it succeeds")
+	cmd.Flags().Lookup("verify").NoOptDefVal = "default"
+}
+
+// buildImage builds the model as imageName. With --verify, the image is
+// built under a temporary name, and is only tagged as imageName once the
+// example has run successfully on it.
+func buildImage(cfg *config.Config, projectDir string, imageName string) error {
+	if err := checkVerifyExample(cfg); err != nil {
+		return err
+	}
+	return newImageSteps(cfg, projectDir).buildVerified(imageName, buildVerify)
+}
+
+// buildAndPushImage builds the model as imageName like buildImage, and
+// pushes it.
+func buildAndPushImage(cfg *config.Config, projectDir string, imageName string) error {
+	if err := checkVerifyExample(cfg); err != nil {
+		return err
+	}
+	return newImageSteps(cfg, projectDir).buildAndPush(imageName, buildVerify)
+}
+
+// checkVerifyExample checks the example --verify runs exists, before time
+// is spent on a build.
+func checkVerifyExample(cfg *config.Config) error {
+	if buildVerify == "" {
+		return nil
+	}
+	_, err := findExample(cfg, buildVerify)
+	return err
+}
+
+// imageSteps are how an image is built, verified, tagged, and pushed. They're
+// fields, so tests can check which images are tagged and pushed without
+// Docker.
+type imageSteps struct {
+	build  func(imageName string) error
+	verify func(imageName string, exampleName string) error
+	tag    func(source string, target string) error
+	untag  func(imageName string) error
+	push   func(imageName string) error
+}
+
+func newImageSteps(cfg *config.Config, projectDir string) imageSteps {
+	return imageSteps{
+		build: func(imageName string) error {
+			return image.Build(cfg, projectDir, imageName, buildProgressOutput, groupFile, buildOptions())
+		},
+		verify: func(imageName string, exampleName string) error {
+			return verifyImage(imageName, cfg, exampleName)
+		},
+		tag:   docker.Tag,
+		untag: docker.Untag,
+		push: func(imageName string) error {
+			if err := image.CheckPushSize(imageName); err != nil {
+				return err
+			}
+			console.Infof("\nPushing image '%s'...", imageName)
+			return image.Push(cfg, imageName)
+		},
+	}
+}
+
+// buildVerified builds the model as imageName. If exampleName isn't empty,
+// it's built as imageName:unverified first, and only tagged as imageName
+// once the example has run successfully on it. If the example fails, the
+// image is left as imageName:unverified, to debug.
+func (s imageSteps) buildVerified(imageName string, exampleName string) error {
+	if exampleName == "" {
+		return s.build(imageName)
+	}
+
+	unverifiedImageName := config.MatrixImageName(imageName, "unverified")
+	if err := s.build(unverifiedImageName); err != nil {
+		return err
+	}
+	if err := s.verify(unverifiedImageName, exampleName); err != nil {
+		return fmt.Errorf("Not tagging the image as %s, because verification failed. It's left as %s to debug: %w", imageName, unverifiedImageName, err)
+	}
+	console.Infof("Verified the image with the %s example", exampleName)
+
+	if err := s.tag(unverifiedImageName, imageName); err != nil {
+		return err
+	}
+	if err := s.untag(unverifiedImageName); err != nil {
+		console.Warnf("%s", err)
+	}
+	return nil
+}
+
+// buildAndPush builds the model as imageName like buildVerified, and
+// pushes it. Only imageName is pushed, so an image that fails verification
+// never is.
+func (s imageSteps) buildAndPush(imageName string, exampleName string) error {
+	if err := s.buildVerified(imageName, exampleName); err != nil {
+		return err
+	}
+	return s.push(imageName)
+}
+
+// verifyImage starts imageName and runs the example called exampleName on
+// it, returning an error if setup or the prediction fails.
+func verifyImage(imageName string, cfg *config.Config, exampleName string) error {
+	inputs, err := imageExampleInputs(imageName, cfg, exampleName)
+	if err != nil {
+		return err
+	}
+
+	console.Info("")
+	console.Infof("Starting Docker image %s and running the %s example...", imageName, exampleName)
+
+	gpus := ""
+	if cfg.Build.GPU {
+		gpus = "all"
+	}
+	predictor := predict.NewPredictor(docker.RunOptions{
+		Env:       weightsRunEnv(cfg),
+		GPUs:      gpus,
+		GPUVendor: cfg.Build.GPUVendor,
+		Image:     imageName,
+	})
+	if err := predictor.Start(os.Stderr); err != nil {
+		return err
+	}
+	defer func() {
+		if err := predictor.Stop(); err != nil {
+			console.Warnf("Failed to stop container: %s", err)
+		}
+	}()
+
+	prediction, err := predictor.Predict(inputs, "")
+	if err != nil {
+		return err
+	}
+	defer prediction.Cleanup()
+	if prediction.Status != "succeeded" {
+		return fmt.Errorf("The %s example %s: %s", exampleName, prediction.Status, prediction.Error)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeImages records what imageSteps do to images, instead of doing it
+// with Docker
+type fakeImages struct {
+	tags       map[string]bool
+	pushed     []string
+	verifyErr  error
+	verifiedAs string
+}
+
+func (f *fakeImages) steps() imageSteps {
+	f.tags = map[string]bool{}
+	return imageSteps{
+		build: func(imageName string) error {
+			f.tags[imageName] = true
+			return nil
+		},
+		verify: func(imageName string, exampleName string) error {
+			f.verifiedAs = imageName
+			return f.verifyErr
+		},
+		tag: func(source string, target string) error {
+			f.tags[target] = true
+			return nil
+		},
+		untag: func(imageName string) error {
+			delete(f.tags, imageName)
+			return nil
+		},
+		push: func(imageName string) error {
+			f.pushed = append(f.pushed, imageName)
+			return nil
+		},
+	}
+}
+
+func TestBuildVerified(t *testing.T) {
+	images := &fakeImages{}
+	require.NoError(t, images.steps().buildVerified("r8.im/user/model", "default"))
+	require.Equal(t, "r8.im/user/model:unverified", images.verifiedAs)
+	require.Equal(t, map[string]bool{"r8.im/user/model": true}, images.tags)
+
+	images = &fakeImages{}
+	require.NoError(t, images.steps().buildVerified("r8.im/user/model", ""))
+	require.Empty(t, images.verifiedAs)
+	require.Equal(t, map[string]bool{"r8.im/user/model": true}, images.tags)
+}
+
+func TestBuildVerifiedFailure(t *testing.T) {
+	// A failed example leaves only the unverified tag, to debug
+	images := &fakeImages{verifyErr: fmt.Errorf("The default example failed: boom")}
+	err := images.steps().buildVerified("r8.im/user/model:v1", "default")
+	require.ErrorContains(t, err, "Not tagging the image as r8.im/user/model:v1")
+	require.ErrorContains(t, err, "left as r8.im/user/model:v1-unverified")
+	require.ErrorContains(t, err, "boom")
+	require.Equal(t, map[string]bool{"r8.im/user/model:v1-unverified": true}, images.tags)
+}
+
+func TestBuildAndPushVerified(t *testing.T) {
+	images := &fakeImages{}
+	require.NoError(t, images.steps().buildAndPush("r8.im/user/model", "default"))
+	require.Equal(t, []string{"r8.im/user/model"}, images.pushed)
+
+	// The unverified image is never pushed
+	images = &fakeImages{verifyErr: fmt.Errorf("The default example failed: boom")}
+	require.Error(t, images.steps().buildAndPush("r8.im/user/model", "default"))
+	require.Empty(t, images.pushed)
+}
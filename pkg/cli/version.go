@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/update"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+var versionCheck bool
+
+func newVersionCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Show the version of Cog",
+		Long: `Show the version of Cog.
+
+With --check, this also checks Cog is at least the version required by the
+base image of the model in the current directory, from the image's
+` + update.MinimumVersionLabel + ` label, and fails if it isn't.`,
+		RunE: cmdVersion,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().BoolVar(&versionCheck, "check", false, "Check Cog is new enough for the model's base image")
+	return cmd
+}
+
+func cmdVersion(cmd *cobra.Command, args []string) error {
+	fmt.Printf("cog version %s (built %s)\n", global.Version, global.BuildTime)
+	if !versionCheck {
+		return nil
+	}
+
+	cfg, projectDir, err := config.GetConfig(projectDirFlag)
+	if err != nil {
+		return err
+	}
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	generator, err := dockerfile.NewGenerator(cfg, projectDir, false)
+	if err != nil {
+		return fmt.Errorf("Error creating Dockerfile generator: %w", err)
+	}
+	defer func() {
+		if err := generator.Cleanup(); err != nil {
+			console.Warnf("Error cleaning up Dockerfile generator: %s", err)
+		}
+	}()
+	baseImage, err := generator.BaseImage()
+	if err != nil {
+		return err
+	}
+	baseImage = config.MirrorImage(baseImage, userConfig.RegistryMirrors)
+
+	minimum, err := update.MinimumVersion(baseImage)
+	if err != nil {
+		return err
+	}
+	if minimum != "" && update.IsOlder(global.Version, minimum) {
+		return fmt.Errorf("Cog %s is older than %s, the minimum version required by the base image %s. Run 'cog upgrade' to upgrade", global.Version, minimum, baseImage)
+	}
+	console.Infof("Cog %s can build on %s", global.Version, baseImage)
+	return nil
+}
@@ -0,0 +1,197 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/files"
+	"github.com/replicate/cog/pkg/weights"
+)
+
+var (
+	weightsKeyEnv   string
+	weightsManifest string
+)
+
+func newWeightsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "weights",
+		Short: "Manage model weights",
+	}
+
+	generateKey := &cobra.Command{
+		Use:   "generate-key",
+		Short: "Generate a key for encrypting weights",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, err := weights.GenerateKey()
+			if err != nil {
+				return err
+			}
+			console.Output(key)
+			return nil
+		},
+	}
+
+	encrypt := &cobra.Command{
+		Use:   "encrypt <path> [path...]",
+		Short: "Encrypt weights so they can only be loaded with a key",
+		Long: `Encrypt weights so they can only be loaded with a key.
+
+Each file is encrypted to <path>.enc with the base64-encoded key in the
+` + config.DefaultWeightsKeyEnv + ` environment variable. List the encrypted files under
+weights.encryption.files in cog.yaml, and keep the original files out of
+the image with .dockerignore.`,
+		Example: `export ` + config.DefaultWeightsKeyEnv + `=$(cog weights generate-key)
+cog weights encrypt weights/model.safetensors`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: cmdWeightsEncrypt,
+	}
+	encrypt.Flags().StringVar(&weightsKeyEnv, "key-env", config.DefaultWeightsKeyEnv, "Environment variable containing the key")
+
+	validate := &cobra.Command{
+		Use:   "validate [path...]",
+		Short: "Check that weights files are complete and for the right model",
+		Long: `Check that weights files are complete and for the right model.
+
+Safetensors files are checked from their header, that every tensor's data
+is in the file, and optionally against a manifest of the tensors the model
+expects. PyTorch checkpoints are only checked that they're complete.
+
+With no paths, the files in weights.validate in cog.yaml are checked, which
+is also done before each build.`,
+		Example: `cog weights validate weights/model.safetensors --manifest weights/manifest.json`,
+		RunE:    cmdWeightsValidate,
+	}
+	validate.Flags().StringVar(&weightsManifest, "manifest", "", "JSON manifest of the tensors the files should have")
+
+	cmd.AddCommand(generateKey, encrypt, validate)
+
+	return cmd
+}
+
+func cmdWeightsEncrypt(cmd *cobra.Command, args []string) error {
+	encodedKey := os.Getenv(weightsKeyEnv)
+	if encodedKey == "" {
+		return fmt.Errorf("Set %s to the key to encrypt weights with. You can generate one with 'cog weights generate-key'", weightsKeyEnv)
+	}
+	key, err := weights.ParseKey(encodedKey)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range args {
+		dest := path + weights.EncryptedSuffix
+		if err := weights.EncryptFile(path, dest, key); err != nil {
+			return err
+		}
+		console.Infof("Encrypted %s to %s", path, dest)
+	}
+	return nil
+}
+
+func cmdWeightsValidate(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		if weightsManifest != "" {
+			return fmt.Errorf("--manifest can only be used with paths. Set manifests in weights.validate in cog.yaml")
+		}
+		cfg, projectDir, err := config.GetConfig(projectDirFlag)
+		if err != nil {
+			return err
+		}
+		if cfg.Weights == nil || len(cfg.Weights.Validate) == 0 {
+			return fmt.Errorf("There are no weights in weights.validate in cog.yaml. Pass the paths of the files to check")
+		}
+		if err := weights.ValidateConfig(cfg, projectDir); err != nil {
+			return err
+		}
+		console.Infof("Checked %d weights files", len(cfg.Weights.Validate))
+		return nil
+	}
+
+	var manifest *weights.Manifest
+	if weightsManifest != "" {
+		var err error
+		if manifest, err = weights.LoadManifest(weightsManifest); err != nil {
+			return err
+		}
+	}
+	for _, path := range args {
+		if err := weights.ValidateFile(path, manifest); err != nil {
+			return err
+		}
+		console.Infof("%s is valid", path)
+	}
+	return nil
+}
+
+// weightsRunEnv returns the environment variables that should be passed
+// through to a container so it can decrypt its weights.
+func weightsRunEnv(cfg *config.Config) []string {
+	if cfg.Weights == nil || cfg.Weights.Encryption == nil {
+		return nil
+	}
+	keyEnv := cfg.Weights.Encryption.KeyEnv
+	if keyEnv == "" {
+		keyEnv = config.DefaultWeightsKeyEnv
+	}
+	if _, ok := os.LookupEnv(keyEnv); !ok {
+		if cfg.Weights.Encryption.KeyCommand == "" {
+			console.Warnf("This model has encrypted weights, but %s is not set", keyEnv)
+		}
+		return nil
+	}
+	// Passing just the name makes Docker read the value from our environment,
+	// which keeps the key out of the process list.
+	return []string{keyEnv}
+}
+
+// sharedWeightsVolume returns the volume to mount the model's shared
+// weights from, or nil if it doesn't have any. The first time the model runs
+// on this host, the volume is filled with the weights from projectDir, or
+// from imageName if it isn't running from a project directory.
+func sharedWeightsVolume(cfg *config.Config, imageName string, projectDir string) (*docker.Volume, error) {
+	if cfg.Weights == nil || cfg.Weights.Shared == nil {
+		return nil, nil
+	}
+	shared := cfg.Weights.Shared
+	exists, err := files.Exists(shared.HostPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		console.Infof("Copying weights to the shared volume %s...", shared.HostPath)
+		// Copy to a temporary directory first, so another replica starting
+		// at the same time never sees a partial copy
+		tmpDir, err := os.MkdirTemp(filepath.Dir(shared.HostPath), "."+filepath.Base(shared.HostPath)+"-")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create the shared weights volume: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		if projectDir != "" {
+			err = files.CopyDir(filepath.Join(projectDir, shared.Path), tmpDir)
+		} else {
+			err = docker.CopyImageDir(imageName, path.Join("/src", shared.Path), tmpDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(tmpDir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmpDir, shared.HostPath); err != nil {
+			// Another replica got there first
+			if exists, _ := files.Exists(shared.HostPath); !exists {
+				return nil, fmt.Errorf("Failed to create the shared weights volume: %w", err)
+			}
+		}
+	}
+	return &docker.Volume{Source: shared.HostPath, Destination: path.Join("/src", shared.Path), ReadOnly: true}, nil
+}
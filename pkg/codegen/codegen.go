@@ -0,0 +1,231 @@
+// Package codegen generates typed clients for a model's HTTP API from its
+// OpenAPI schema.
+package codegen
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// Languages are the languages clients can be generated in
+var Languages = []string{"go", "python", "typescript"}
+
+// Kind is the kind of a value in an input or output
+type Kind string
+
+const (
+	KindString  Kind = "string"
+	KindInteger Kind = "integer"
+	KindNumber  Kind = "number"
+	KindBoolean Kind = "boolean"
+	KindArray   Kind = "array"
+	KindObject  Kind = "object"
+	KindAny     Kind = "any"
+)
+
+// Type is the type of an input, output, or field of an output
+type Type struct {
+	Kind Kind
+	// Format is "uri" for files
+	Format string
+	// Items is the type of the items of arrays
+	Items *Type
+	// Enum is the values it can have, if it's limited to a set of choices
+	Enum []interface{}
+	// Fields are the fields of objects, if they're known
+	Fields []Field
+}
+
+// Field is an input, or a field of an object
+type Field struct {
+	Name        string
+	Description string
+	Type        Type
+	Required    bool
+}
+
+// Model is the inputs and output of a model
+type Model struct {
+	Inputs []Field
+	Output Type
+	// Iterator is whether predict() yields its output, so it's sent a piece
+	// at a time to webhooks of asynchronous predictions
+	Iterator bool
+}
+
+// Parse returns the inputs and output of the model with schema.
+func Parse(schema *openapi3.T) (*Model, error) {
+	if schema.Components.Schemas == nil {
+		return nil, fmt.Errorf("The OpenAPI schema doesn't have any components")
+	}
+	inputRef, ok := schema.Components.Schemas["Input"]
+	if !ok || inputRef.Value == nil {
+		return nil, fmt.Errorf("The OpenAPI schema doesn't have an Input component")
+	}
+	outputRef, ok := schema.Components.Schemas["Output"]
+	if !ok || outputRef.Value == nil {
+		return nil, fmt.Errorf("The OpenAPI schema doesn't have an Output component")
+	}
+
+	model := &Model{
+		Inputs: fields(inputRef.Value),
+		Output: typeOf(outputRef.Value),
+	}
+	sort.SliceStable(model.Inputs, func(i, j int) bool {
+		return order(inputRef.Value.Properties[model.Inputs[i].Name].Value) < order(inputRef.Value.Properties[model.Inputs[j].Name].Value)
+	})
+	if arrayType, ok := outputRef.Value.Extensions["x-cog-array-type"]; ok {
+		model.Iterator = extensionString(arrayType) == "iterator"
+	}
+	return model, nil
+}
+
+// Options are options for generating clients
+type Options struct {
+	// GoPackage is the package of Go clients
+	GoPackage string
+}
+
+// Generate returns the source of a client for the model with schema, in
+// lang.
+func Generate(schema *openapi3.T, lang string, options Options) (string, error) {
+	model, err := Parse(schema)
+	if err != nil {
+		return "", err
+	}
+	switch lang {
+	case "go":
+		pkg := options.GoPackage
+		if pkg == "" {
+			pkg = "client"
+		}
+		return generateGo(model, pkg)
+	case "python":
+		return generatePython(model), nil
+	case "typescript":
+		return generateTypeScript(model), nil
+	}
+	return "", fmt.Errorf("Can't generate a client in %s. Languages are: %s", lang, strings.Join(Languages, ", "))
+}
+
+func fields(schema *openapi3.Schema) []Field {
+	names := []string{}
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	required := map[string]bool{}
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	fields := []Field{}
+	for _, name := range names {
+		prop := schema.Properties[name].Value
+		if prop == nil {
+			continue
+		}
+		fields = append(fields, Field{
+			Name:        name,
+			Description: prop.Description,
+			Type:        typeOf(prop),
+			Required:    required[name],
+		})
+	}
+	return fields
+}
+
+func typeOf(schema *openapi3.Schema) Type {
+	// Choices and custom output types are references, which can be wrapped
+	// in allOf
+	if schema.Type == "" && len(schema.AllOf) == 1 && schema.AllOf[0].Value != nil {
+		return typeOf(schema.AllOf[0].Value)
+	}
+	t := Type{Kind: KindAny, Format: schema.Format, Enum: schema.Enum}
+	switch schema.Type {
+	case "string", "integer", "number", "boolean":
+		t.Kind = Kind(schema.Type)
+	case "array":
+		t.Kind = KindArray
+		items := Type{Kind: KindAny}
+		if schema.Items != nil && schema.Items.Value != nil {
+			items = typeOf(schema.Items.Value)
+		}
+		t.Items = &items
+	case "object":
+		t.Kind = KindObject
+		t.Fields = fields(schema)
+	}
+	return t
+}
+
+func order(schema *openapi3.Schema) int {
+	if schema == nil {
+		return 0
+	}
+	raw, ok := schema.Extensions["x-order"]
+	if !ok {
+		return 0
+	}
+	var order int
+	if msg, ok := raw.(json.RawMessage); ok {
+		_ = json.Unmarshal(msg, &order)
+	}
+	return order
+}
+
+func extensionString(raw interface{}) string {
+	var s string
+	switch v := raw.(type) {
+	case json.RawMessage:
+		_ = json.Unmarshal(v, &s)
+	case string:
+		s = v
+	}
+	return s
+}
+
+// describe returns the documentation of a field, from its description and
+// its type. Choices are included for languages that can't express them in
+// the type.
+func describe(field Field, choices bool) string {
+	sentences := []string{}
+	if field.Description != "" {
+		description := strings.TrimSpace(field.Description)
+		if !strings.HasSuffix(description, ".") {
+			description += "."
+		}
+		sentences = append(sentences, description)
+	}
+	if field.Type.Format == "uri" {
+		sentences = append(sentences, "A URL or data URI.")
+	}
+	if choices && len(field.Type.Enum) > 0 {
+		values := []string{}
+		for _, v := range field.Type.Enum {
+			values = append(values, literal(v))
+		}
+		sentences = append(sentences, "One of "+strings.Join(values, ", ")+".")
+	}
+	return strings.Join(sentences, " ")
+}
+
+// camelCase converts a snake_case name to CamelCase.
+func camelCase(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' })
+	for i, part := range parts {
+		parts[i] = strings.ToUpper(part[:1]) + part[1:]
+	}
+	return strings.Join(parts, "")
+}
+
+// literal returns v as a JSON literal. Strings and numbers are written the
+// same way in Python, TypeScript, and Go.
+func literal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
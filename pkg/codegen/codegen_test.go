@@ -0,0 +1,121 @@
+package codegen
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/stretchr/testify/require"
+)
+
+const testSchema = `{
+  "openapi": "3.0.2",
+  "info": {"title": "Cog", "version": "0.1.0"},
+  "paths": {},
+  "components": {
+    "schemas": {
+      "Input": {
+        "title": "Input",
+        "required": ["image", "choices"],
+        "type": "object",
+        "properties": {
+          "scale": {"title": "Scale", "type": "number", "default": 1.5, "x-order": 2},
+          "image": {"title": "Image", "description": "Image to scale", "type": "string", "format": "uri", "x-order": 0},
+          "choices": {"allOf": [{"$ref": "#/components/schemas/choices"}], "x-order": 1},
+          "tags": {"title": "Tags", "type": "array", "items": {"type": "string"}, "x-order": 3}
+        }
+      },
+      "Output": {
+        "title": "Output",
+        "type": "array",
+        "items": {"type": "string", "format": "uri"},
+        "x-cog-array-type": "iterator"
+      },
+      "choices": {"title": "choices", "enum": ["foo", "bar"], "type": "string"}
+    }
+  }
+}`
+
+func loadTestSchema(t *testing.T, schema string) *openapi3.T {
+	doc, err := openapi3.NewLoader().LoadFromData([]byte(schema))
+	require.NoError(t, err)
+	return doc
+}
+
+func TestParse(t *testing.T) {
+	model, err := Parse(loadTestSchema(t, testSchema))
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, input := range model.Inputs {
+		names = append(names, input.Name)
+	}
+	require.Equal(t, []string{"image", "choices", "scale", "tags"}, names)
+	require.True(t, model.Inputs[0].Required)
+	require.Equal(t, "uri", model.Inputs[0].Type.Format)
+	require.Equal(t, KindString, model.Inputs[1].Type.Kind)
+	require.Equal(t, []interface{}{"foo", "bar"}, model.Inputs[1].Type.Enum)
+	require.False(t, model.Inputs[2].Required)
+	require.Equal(t, KindArray, model.Output.Kind)
+	require.Equal(t, KindString, model.Output.Items.Kind)
+	require.True(t, model.Iterator)
+}
+
+func TestParseMissingInput(t *testing.T) {
+	_, err := Parse(loadTestSchema(t, `{"openapi": "3.0.2", "info": {"title": "Cog", "version": "0.1.0"}, "paths": {}, "components": {"schemas": {}}}`))
+	require.Error(t, err)
+}
+
+func TestGenerateGo(t *testing.T) {
+	source, err := Generate(loadTestSchema(t, testSchema), "go", Options{GoPackage: "scaler"})
+	require.NoError(t, err)
+	require.Contains(t, source, "package scaler")
+	require.Contains(t, source, "// Image to scale. A URL or data URI.\n\tImage string `json:\"image\"`")
+	require.Contains(t, source, "Scale   *float64 `json:\"scale,omitempty\"`")
+	require.Contains(t, source, "type Output = []string")
+
+	// The client type checks
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "client.go", source, 0)
+	require.NoError(t, err)
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	_, err = conf.Check("scaler", fset, []*ast.File{file}, nil)
+	require.NoError(t, err)
+}
+
+func TestGeneratePython(t *testing.T) {
+	source, err := Generate(loadTestSchema(t, testSchema), "python", Options{})
+	require.NoError(t, err)
+	require.Contains(t, source, "Output = List[str]")
+	require.Contains(t, source, `def predict(self, *, image: str, choices: Literal["foo", "bar"], scale: Optional[float] = None, tags: Optional[List[str]] = None) -> Output:`)
+	require.Contains(t, source, "async def predict_async(")
+
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 isn't installed")
+	}
+	path := filepath.Join(t.TempDir(), "client.py")
+	require.NoError(t, os.WriteFile(path, []byte(source), 0o644))
+	out, err := exec.Command(python, "-c", "import ast, sys; ast.parse(open(sys.argv[1]).read())", path).CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestGenerateTypeScript(t *testing.T) {
+	source, err := Generate(loadTestSchema(t, testSchema), "typescript", Options{})
+	require.NoError(t, err)
+	require.Contains(t, source, `"choices": "foo" | "bar";`)
+	require.Contains(t, source, `"scale"?: number;`)
+	require.Contains(t, source, "export type Output = string[];")
+}
+
+func TestGenerateUnknownLanguage(t *testing.T) {
+	_, err := Generate(loadTestSchema(t, testSchema), "cobol", Options{})
+	require.Error(t, err)
+}
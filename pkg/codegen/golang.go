@@ -0,0 +1,188 @@
+package codegen
+
+import (
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+func goType(t Type) string {
+	switch t.Kind {
+	case KindString:
+		return "string"
+	case KindInteger:
+		return "int64"
+	case KindNumber:
+		return "float64"
+	case KindBoolean:
+		return "bool"
+	case KindArray:
+		return "[]" + goType(*t.Items)
+	case KindObject:
+		return "map[string]interface{}"
+	}
+	return "interface{}"
+}
+
+// goFieldType returns the type of a struct field, which is a pointer for
+// optional scalars so they're left out of the JSON if they aren't set.
+func goFieldType(t Type, required bool) string {
+	typ := goType(t)
+	if required || t.Kind == KindArray || t.Kind == KindObject || t.Kind == KindAny {
+		return typ
+	}
+	return "*" + typ
+}
+
+func generateGo(model *Model, pkg string) (string, error) {
+	var b strings.Builder
+	b.WriteString("// Code generated by cog codegen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "// Package %s is a client for a Cog model's HTTP API.\n", pkg)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	b.WriteString(`import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+`)
+
+	b.WriteString("type Input struct {\n")
+	for _, input := range model.Inputs {
+		if doc := describe(input, true); doc != "" {
+			fmt.Fprintf(&b, "// %s\n", doc)
+		}
+		tag := input.Name
+		if !input.Required {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&b, "%s %s `json:%q`\n", camelCase(input.Name), goFieldType(input.Type, input.Required), tag)
+	}
+	b.WriteString("}\n\n")
+
+	if model.Output.Kind == KindObject && len(model.Output.Fields) > 0 {
+		b.WriteString("type Output struct {\n")
+		for _, field := range model.Output.Fields {
+			fmt.Fprintf(&b, "%s %s `json:%q`\n", camelCase(field.Name), goFieldType(field.Type, false), field.Name+",omitempty")
+		}
+		b.WriteString("}\n\n")
+	} else {
+		if model.Iterator {
+			b.WriteString("// Output is yielded by the model, so webhooks for \"output\" events are sent\n// the output so far as it's produced.\n")
+		}
+		fmt.Fprintf(&b, "type Output = %s\n\n", goType(model.Output))
+	}
+
+	b.WriteString(goClient)
+
+	source, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return "", fmt.Errorf("Failed to format the generated Go client: %w", err)
+	}
+	return string(source), nil
+}
+
+const goClient = `type WebhookEvent string
+
+const (
+	WebhookEventStart     WebhookEvent = "start"
+	WebhookEventOutput    WebhookEvent = "output"
+	WebhookEventLogs      WebhookEvent = "logs"
+	WebhookEventCompleted WebhookEvent = "completed"
+)
+
+type Prediction struct {
+	ID     string  ` + "`json:\"id,omitempty\"`" + `
+	Status string  ` + "`json:\"status\"`" + `
+	Output *Output ` + "`json:\"output\"`" + `
+	Error  string  ` + "`json:\"error\"`" + `
+	Logs   string  ` + "`json:\"logs\"`" + `
+}
+
+// PredictionError is returned when a prediction doesn't succeed
+type PredictionError struct {
+	Prediction *Prediction
+}
+
+func (e *PredictionError) Error() string {
+	if e.Prediction.Error != "" {
+		return e.Prediction.Error
+	}
+	return "prediction " + e.Prediction.Status
+}
+
+type AsyncOptions struct {
+	Webhook             string
+	WebhookEventsFilter []WebhookEvent
+}
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{BaseURL: baseURL, HTTPClient: http.DefaultClient}
+}
+
+// Predict runs a prediction and waits for its output.
+func (c *Client) Predict(ctx context.Context, input Input) (*Output, error) {
+	prediction, err := c.post(ctx, "/predictions", map[string]interface{}{"input": input}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prediction.Status != "succeeded" {
+		return nil, &PredictionError{Prediction: prediction}
+	}
+	return prediction.Output, nil
+}
+
+// PredictAsync starts a prediction without waiting for it. Its progress is
+// sent to the webhook.
+func (c *Client) PredictAsync(ctx context.Context, input Input, options AsyncOptions) (*Prediction, error) {
+	body := map[string]interface{}{"input": input, "webhook": options.Webhook}
+	if options.WebhookEventsFilter != nil {
+		body["webhook_events_filter"] = options.WebhookEventsFilter
+	}
+	return c.post(ctx, "/predictions", body, map[string]string{"Prefer": "respond-async"})
+}
+
+func (c *Client) Cancel(ctx context.Context, predictionID string) error {
+	_, err := c.post(ctx, "/predictions/"+url.PathEscape(predictionID)+"/cancel", map[string]interface{}{}, nil)
+	return err
+}
+
+func (c *Client) post(ctx context.Context, path string, body interface{}, headers map[string]string) (*Prediction, error) {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("POST %s returned status %d: %s", path, resp.StatusCode, message)
+	}
+	prediction := &Prediction{}
+	if err := json.NewDecoder(resp.Body).Decode(prediction); err != nil {
+		return nil, err
+	}
+	return prediction, nil
+}
+`
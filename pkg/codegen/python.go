@@ -0,0 +1,156 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+func pythonType(t Type) string {
+	if len(t.Enum) > 0 && (t.Kind == KindString || t.Kind == KindInteger) {
+		values := []string{}
+		for _, v := range t.Enum {
+			values = append(values, literal(v))
+		}
+		return "Literal[" + strings.Join(values, ", ") + "]"
+	}
+	switch t.Kind {
+	case KindString:
+		return "str"
+	case KindInteger:
+		return "int"
+	case KindNumber:
+		return "float"
+	case KindBoolean:
+		return "bool"
+	case KindArray:
+		return "List[" + pythonType(*t.Items) + "]"
+	case KindObject:
+		return "Dict[str, Any]"
+	}
+	return "Any"
+}
+
+func generatePython(model *Model) string {
+	var b strings.Builder
+	b.WriteString(`# Code generated by cog codegen. DO NOT EDIT.
+"""
+A client for a Cog model's HTTP API. It needs httpx.
+"""
+
+from typing import Any, Dict, List, Literal, Optional, TypedDict
+
+import httpx
+
+WebhookEvent = Literal["start", "output", "logs", "completed"]
+
+`)
+	if model.Output.Kind == KindObject && len(model.Output.Fields) > 0 {
+		b.WriteString("\nclass Output(TypedDict, total=False):\n")
+		for _, field := range model.Output.Fields {
+			fmt.Fprintf(&b, "    %s: %s\n", field.Name, pythonType(field.Type))
+		}
+		b.WriteString("\n")
+	} else {
+		fmt.Fprintf(&b, "Output = %s\n\n", pythonType(model.Output))
+	}
+
+	b.WriteString(`
+class Prediction(TypedDict, total=False):
+    id: str
+    status: Literal["starting", "processing", "succeeded", "canceled", "failed", "preempted"]
+    output: Optional[Output]
+    error: Optional[str]
+    logs: str
+
+
+class PredictionError(Exception):
+    def __init__(self, prediction: Prediction) -> None:
+        super().__init__(prediction.get("error") or f"prediction {prediction.get('status')}")
+        self.prediction = prediction
+
+
+def _without_none(input: Dict[str, Any]) -> Dict[str, Any]:
+    # Inputs that aren't passed get their defaults from the model
+    return {k: v for k, v in input.items() if v is not None}
+
+
+def _output(prediction: Prediction) -> Output:
+    if prediction.get("status") != "succeeded":
+        raise PredictionError(prediction)
+    return prediction["output"]  # type: ignore
+
+`)
+	writePythonClient(&b, model, false)
+	writePythonClient(&b, model, true)
+	return b.String()
+}
+
+func writePythonClient(b *strings.Builder, model *Model, async bool) {
+	name, httpxClient, def, await := "Client", "httpx.Client", "def", ""
+	if async {
+		name, httpxClient, def, await = "AsyncClient", "httpx.AsyncClient", "async def", "await "
+	}
+
+	params := []string{}
+	inputs := []string{}
+	docs := []string{}
+	for _, input := range model.Inputs {
+		if input.Required {
+			params = append(params, fmt.Sprintf("%s: %s", input.Name, pythonType(input.Type)))
+		} else {
+			params = append(params, fmt.Sprintf("%s: Optional[%s] = None", input.Name, pythonType(input.Type)))
+		}
+		inputs = append(inputs, fmt.Sprintf("%q: %s", input.Name, input.Name))
+		if doc := describe(input, false); doc != "" {
+			docs = append(docs, fmt.Sprintf("            %s: %s", input.Name, doc))
+		}
+	}
+	paramList := ""
+	if len(params) > 0 {
+		paramList = ", *, " + strings.Join(params, ", ")
+	}
+	inputDict := "{" + strings.Join(inputs, ", ") + "}"
+	argsDoc := ""
+	if len(docs) > 0 {
+		argsDoc = "\n\n        Args:\n" + strings.Join(docs, "\n")
+	}
+	iteratorDoc := ""
+	if model.Iterator {
+		iteratorDoc = "\n\n        The model yields its output, so webhooks for \"output\" events are sent the\n        output so far as it's produced."
+	}
+
+	fmt.Fprintf(b, `
+class %s:
+    def __init__(self, base_url: str = "http://localhost:5000", timeout: Optional[float] = None) -> None:
+        self._client = %s(base_url=base_url, timeout=timeout)
+
+    %s predict(self%s) -> Output:
+        """
+        Run a prediction and wait for its output.%s
+        """
+        response = %sself._client.post("/predictions", json={"input": _without_none(%s)})
+        response.raise_for_status()
+        return _output(response.json())
+
+    %s predict_async(
+        self%s,
+        webhook: str,
+        webhook_events_filter: Optional[List[WebhookEvent]] = None,
+    ) -> Prediction:
+        """
+        Start a prediction without waiting for it. Its progress is sent to
+        webhook.%s
+        """
+        request: Dict[str, Any] = {"input": _without_none(%s), "webhook": webhook}
+        if webhook_events_filter is not None:
+            request["webhook_events_filter"] = webhook_events_filter
+        response = %sself._client.post("/predictions", json=request, headers={"Prefer": "respond-async"})
+        response.raise_for_status()
+        return response.json()
+
+    %s cancel(self, prediction_id: str) -> None:
+        response = %sself._client.post(f"/predictions/{prediction_id}/cancel")
+        response.raise_for_status()
+
+`, name, httpxClient, def, paramList, argsDoc, await, inputDict, def, paramList, iteratorDoc, inputDict, await, def, await)
+}
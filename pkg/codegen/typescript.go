@@ -0,0 +1,133 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+func typeScriptType(t Type) string {
+	if len(t.Enum) > 0 {
+		values := []string{}
+		for _, v := range t.Enum {
+			values = append(values, literal(v))
+		}
+		return strings.Join(values, " | ")
+	}
+	switch t.Kind {
+	case KindString:
+		return "string"
+	case KindInteger, KindNumber:
+		return "number"
+	case KindBoolean:
+		return "boolean"
+	case KindArray:
+		items := typeScriptType(*t.Items)
+		if strings.Contains(items, " | ") {
+			items = "(" + items + ")"
+		}
+		return items + "[]"
+	case KindObject:
+		return "Record<string, unknown>"
+	}
+	return "unknown"
+}
+
+func generateTypeScript(model *Model) string {
+	var b strings.Builder
+	b.WriteString("// Code generated by cog codegen. DO NOT EDIT.\n\n")
+	b.WriteString("// A client for a Cog model's HTTP API.\n\n")
+
+	b.WriteString("export interface Input {\n")
+	for _, input := range model.Inputs {
+		if doc := describe(input, false); doc != "" {
+			fmt.Fprintf(&b, "  /** %s */\n", doc)
+		}
+		optional := "?"
+		if input.Required {
+			optional = ""
+		}
+		fmt.Fprintf(&b, "  %s%s: %s;\n", literal(input.Name), optional, typeScriptType(input.Type))
+	}
+	b.WriteString("}\n\n")
+
+	if model.Output.Kind == KindObject && len(model.Output.Fields) > 0 {
+		b.WriteString("export interface Output {\n")
+		for _, field := range model.Output.Fields {
+			fmt.Fprintf(&b, "  %s?: %s;\n", literal(field.Name), typeScriptType(field.Type))
+		}
+		b.WriteString("}\n\n")
+	} else {
+		if model.Iterator {
+			b.WriteString("// The model yields its output, so webhooks for \"output\" events are sent\n// the output so far as it's produced.\n")
+		}
+		fmt.Fprintf(&b, "export type Output = %s;\n\n", typeScriptType(model.Output))
+	}
+
+	b.WriteString(`export type WebhookEvent = "start" | "output" | "logs" | "completed";
+
+export interface Prediction {
+  id?: string;
+  status: "starting" | "processing" | "succeeded" | "canceled" | "failed" | "preempted";
+  output?: Output | null;
+  error?: string | null;
+  logs?: string;
+}
+
+export interface AsyncOptions {
+  webhook: string;
+  webhookEventsFilter?: WebhookEvent[];
+}
+
+export class PredictionError extends Error {
+  constructor(public prediction: Prediction) {
+    super(prediction.error ?? ` + "`prediction ${prediction.status}`" + `);
+  }
+}
+
+export class Client {
+  constructor(
+    private baseURL: string = "http://localhost:5000",
+    private fetchImpl: typeof fetch = fetch,
+  ) {}
+
+  /** Run a prediction and wait for its output. */
+  async predict(input: Input): Promise<Output> {
+    const prediction = await this.post("/predictions", { input });
+    if (prediction.status !== "succeeded") {
+      throw new PredictionError(prediction);
+    }
+    return prediction.output as Output;
+  }
+
+  /** Start a prediction without waiting for it. Its progress is sent to the webhook. */
+  async predictAsync(input: Input, options: AsyncOptions): Promise<Prediction> {
+    const body: Record<string, unknown> = { input, webhook: options.webhook };
+    if (options.webhookEventsFilter !== undefined) {
+      body.webhook_events_filter = options.webhookEventsFilter;
+    }
+    return this.post("/predictions", body, { Prefer: "respond-async" });
+  }
+
+  async cancel(predictionId: string): Promise<void> {
+    await this.post(` + "`/predictions/${encodeURIComponent(predictionId)}/cancel`" + `, {});
+  }
+
+  private async post(
+    path: string,
+    body: unknown,
+    headers: Record<string, string> = {},
+  ): Promise<Prediction> {
+    const response = await this.fetchImpl(this.baseURL + path, {
+      method: "POST",
+      headers: { "Content-Type": "application/json", Accept: "application/json", ...headers },
+      body: JSON.stringify(body),
+    });
+    if (!response.ok) {
+      throw new Error(` + "`POST ${path} returned status ${response.status}: ${await response.text()}`" + `);
+    }
+    return (await response.json()) as Prediction;
+  }
+}
+`)
+	return b.String()
+}
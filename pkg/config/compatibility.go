@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/replicate/cog/pkg/util"
 	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/slices"
 
 	"github.com/replicate/cog/pkg/util/version"
 )
@@ -152,8 +154,14 @@ func compatibleCuDNNsForCUDA(cuda string) []string {
 	return cuDNNs
 }
 
+// defaultCUDAVersion is the CUDA version of GPU models that don't use
+// PyTorch or TensorFlow and don't set one. It's fixed, rather than following
+// the compatibility matrices, so adding newer versions to them doesn't change
+// the base image of models that didn't ask for one.
+const defaultCUDAVersion = "11.2"
+
 func defaultCUDA() string {
-	return latestTF().CUDA
+	return defaultCUDAVersion
 }
 
 func latestCUDAFrom(cudas []string) string {
@@ -209,26 +217,6 @@ func latestCuDNNForCUDA(cuda string) (string, error) {
 	return cuDNNs[0], nil
 }
 
-func latestTF() TFCompatibility {
-	var latest *TFCompatibility
-	for _, compat := range TFCompatibilityMatrix {
-		compat := compat
-		if latest == nil {
-			latest = &compat
-		} else {
-			greater, err := versionGreater(compat.TF, latest.TF)
-			if err != nil {
-				// should never happen
-				panic(fmt.Sprintf("Invalid tensorflow version: %s", err))
-			}
-			if greater {
-				latest = &compat
-			}
-		}
-	}
-	return *latest
-}
-
 func versionGreater(a string, b string) (bool, error) {
 	// TODO(andreas): use library
 	aVer, err := version.NewVersion(a)
@@ -251,6 +239,38 @@ func CUDABaseImageFor(cuda string, cuDNN string) (string, error) {
 	return "", fmt.Errorf("No matching base image for CUDA %s and CuDNN %s", cuda, cuDNN)
 }
 
+// minimumDriverVersions is the oldest NVIDIA driver on Linux that can run
+// each version of CUDA. From CUDA 11, minor version compatibility means a
+// driver that runs the first release of a major version runs all of it, so
+// those are by major version.
+var minimumDriverVersions = map[string]string{
+	"8.0":  "375.26",
+	"9.0":  "384.81",
+	"9.1":  "390.46",
+	"9.2":  "396.26",
+	"10.0": "410.48",
+	"10.1": "418.39",
+	"10.2": "440.33",
+	"11":   "450.80.02",
+	"12":   "525.60.13",
+}
+
+// MinimumDriverVersion returns the oldest NVIDIA driver on Linux that can
+// run the CUDA version cuda, like 11.8 or 11.8.0.
+func MinimumDriverVersion(cuda string) (string, error) {
+	ver, err := version.NewVersion(cuda)
+	if err != nil {
+		return "", fmt.Errorf("Invalid CUDA version %s: %w", cuda, err)
+	}
+	if driver, ok := minimumDriverVersions[strconv.Itoa(ver.Major)]; ok {
+		return driver, nil
+	}
+	if driver, ok := minimumDriverVersions[fmt.Sprintf("%d.%d", ver.Major, ver.Minor)]; ok {
+		return driver, nil
+	}
+	return "", fmt.Errorf("Cog doesn't know the minimum NVIDIA driver for CUDA %s", cuda)
+}
+
 func tfGPUPackage(ver string, cuda string) (name string, cpuVersion string, err error) {
 	for _, compat := range TFCompatibilityMatrix {
 		if compat.TF == ver && version.Equal(compat.CUDA, cuda) {
@@ -264,7 +284,7 @@ func tfGPUPackage(ver string, cuda string) (name string, cpuVersion string, err
 func torchCPUPackage(ver, goos, goarch string) (name, cpuVersion, findLinks, extraIndexURL string, err error) {
 	for _, compat := range TorchCompatibilityMatrix {
 		if compat.TorchVersion() == ver && compat.CUDA == nil {
-			return "torch", torchStripCPUSuffixForM1(compat.Torch, goos, goarch), compat.FindLinks, compat.ExtraIndexURL, nil
+			return "torch", torchStripCPUSuffixForARM(compat.Torch, goos, goarch), compat.FindLinks, compat.ExtraIndexURL, nil
 		}
 	}
 
@@ -310,10 +330,51 @@ func torchGPUPackage(ver string, cuda string) (name, cpuVersion, findLinks, extr
 	return "torch", latest.Torch, latest.FindLinks, latest.ExtraIndexURL, nil
 }
 
+// torchCUDAKnown returns whether the compatibility matrix has a CUDA build
+// of a version of torch or torchvision.
+func torchCUDAKnown(name, ver string) bool {
+	for _, compat := range TorchCompatibilityMatrix {
+		if compat.CUDA == nil {
+			continue
+		}
+		if (name == "torch" && compat.TorchVersion() == ver) || (name == "torchvision" && compat.TorchvisionVersion() == ver) {
+			return true
+		}
+	}
+	return false
+}
+
+// torchCUDAIndexURL returns the PyTorch index for the newest CUDA that
+// PyTorch has published wheels for, and that's no newer than cuda, with the
+// same major version. PyTorch's wheels bundle the CUDA libraries they need,
+// so they only need a driver that supports them. It returns "" if there
+// isn't one.
+func torchCUDAIndexURL(cuda string) string {
+	var latestCUDA, indexURL string
+	for _, compat := range TorchCompatibilityMatrix {
+		if compat.CUDA == nil || !strings.HasPrefix(compat.ExtraIndexURL, "https://download.pytorch.org/whl/cu") {
+			continue
+		}
+		if strings.Split(*compat.CUDA, ".")[0] != strings.Split(cuda, ".")[0] {
+			continue
+		}
+		if greater, err := versionGreater(*compat.CUDA, cuda); err != nil || greater {
+			continue
+		}
+		if latestCUDA != "" {
+			if greater, err := versionGreater(*compat.CUDA, latestCUDA); err != nil || !greater {
+				continue
+			}
+		}
+		latestCUDA, indexURL = *compat.CUDA, compat.ExtraIndexURL
+	}
+	return indexURL
+}
+
 func torchvisionCPUPackage(ver, goos, goarch string) (name, cpuVersion, findLinks, extraIndexURL string, err error) {
 	for _, compat := range TorchCompatibilityMatrix {
 		if compat.TorchvisionVersion() == ver && compat.CUDA == nil {
-			return "torchvision", torchStripCPUSuffixForM1(compat.Torchvision, goos, goarch), compat.FindLinks, compat.ExtraIndexURL, nil
+			return "torchvision", torchStripCPUSuffixForARM(compat.Torchvision, goos, goarch), compat.FindLinks, compat.ExtraIndexURL, nil
 		}
 	}
 	// Fall back to just installing default version. For older torchvision versions, they don't have any CPU versions.
@@ -361,10 +422,87 @@ func torchvisionGPUPackage(ver, cuda string) (name, cpuVersion, findLinks, extra
 
 // aarch64 packages don't have +cpu suffix: https://download.pytorch.org/whl/torch_stable.html
 // TODO(andreas): clean up this hack by actually parsing the torch_stable.html list in the generator
-func torchStripCPUSuffixForM1(version string, goos string, goarch string) string {
+func torchStripCPUSuffixForARM(version string, goos string, goarch string) string {
 	// TODO(andreas): clean up this hack
-	if util.IsM1Mac(goos, goarch) {
+	if util.IsM1Mac(goos, goarch) || (goos == "linux" && goarch == "arm64") {
 		return strings.ReplaceAll(version, "+cpu", "")
 	}
 	return version
 }
+
+// TorchVersions returns the versions of PyTorch that Cog knows about, newest
+// first.
+func TorchVersions() []string {
+	versions := []string{}
+	for _, compat := range TorchCompatibilityMatrix {
+		if !slices.ContainsString(versions, compat.TorchVersion()) {
+			versions = append(versions, compat.TorchVersion())
+		}
+	}
+	sortVersionsDescending(versions)
+	return versions
+}
+
+// TorchCompatibilityFor returns the torchvision version, Python versions,
+// and CUDA versions that are compatible with a version of PyTorch. Only CUDA
+// versions that Cog has a base image for are returned.
+func TorchCompatibilityFor(ver string) (torchvision string, pythons []string, cudas []string) {
+	pythons = []string{}
+	cudas = []string{}
+	for _, compat := range TorchCompatibilityMatrix {
+		if compat.TorchVersion() != ver {
+			continue
+		}
+		torchvision = compat.TorchvisionVersion()
+		for _, python := range compat.Pythons {
+			if !slices.ContainsString(pythons, python) {
+				pythons = append(pythons, python)
+			}
+		}
+		if compat.CUDA != nil && hasCUDABaseImage(*compat.CUDA) && !slices.ContainsString(cudas, *compat.CUDA) {
+			cudas = append(cudas, *compat.CUDA)
+		}
+	}
+	sortVersionsDescending(pythons)
+	sortVersionsDescending(cudas)
+	return torchvision, pythons, cudas
+}
+
+// TFVersions returns the versions of TensorFlow that Cog knows about, newest
+// first.
+func TFVersions() []string {
+	versions := []string{}
+	for _, compat := range TFCompatibilityMatrix {
+		if !slices.ContainsString(versions, compat.TF) {
+			versions = append(versions, compat.TF)
+		}
+	}
+	sortVersionsDescending(versions)
+	return versions
+}
+
+// TFCompatibilityFor returns what is compatible with a version of
+// TensorFlow.
+func TFCompatibilityFor(ver string) (TFCompatibility, bool) {
+	for _, compat := range TFCompatibilityMatrix {
+		if compat.TF == ver {
+			return compat, true
+		}
+	}
+	return TFCompatibility{}, false
+}
+
+func hasCUDABaseImage(cuda string) bool {
+	patch, err := resolveMinorToPatch(cuda)
+	if err != nil {
+		return false
+	}
+	_, err = latestCuDNNForCUDA(patch)
+	return err == nil
+}
+
+func sortVersionsDescending(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return version.Greater(versions[i], versions[j])
+	})
+}
@@ -22,3 +22,14 @@ func TestResolveMinorToPatch(t *testing.T) {
 	_, err = resolveMinorToPatch("1214348324.432879432")
 	require.Error(t, err)
 }
+
+func TestMinimumDriverVersion(t *testing.T) {
+	driver, err := MinimumDriverVersion("11.8.0")
+	require.NoError(t, err)
+	require.Equal(t, "450.80.02", driver)
+	driver, err = MinimumDriverVersion("10.2")
+	require.NoError(t, err)
+	require.Equal(t, "440.33", driver)
+	_, err = MinimumDriverVersion("7.5")
+	require.Error(t, err)
+}
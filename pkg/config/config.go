@@ -2,16 +2,26 @@ package config
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/docker/go-units"
 	"gopkg.in/yaml.v2"
 
+	"github.com/replicate/cog/pkg/global"
 	"github.com/replicate/cog/pkg/util/console"
 	"github.com/replicate/cog/pkg/util/slices"
+	"github.com/replicate/cog/pkg/util/version"
 )
 
 // TODO(andreas): support conda packages
@@ -19,30 +29,457 @@ import (
 // TODO(andreas): custom cpu/gpu installs
 // TODO(andreas): suggest valid torchvision versions (e.g. if the user wants to use 0.8.0, suggest 0.8.1)
 
+// DefaultWeightsKeyEnv is the environment variable the key for encrypted
+// weights is read from at runtime, unless weights.encryption.key_env is set.
+const DefaultWeightsKeyEnv = "COG_WEIGHTS_KEY"
+
+// DefaultWeightsShards is how many shards each file in weights.sharding is
+// split into, unless weights.sharding.shards is set.
+const DefaultWeightsShards = 8
+
+// maxWeightsShards keeps sharded files well under the limit on the number of
+// layers in an image
+const maxWeightsShards = 64
+
+// DistroUBI9 builds on Red Hat Universal Base Image 9, with OpenSSL in FIPS
+// mode.
+const DistroUBI9 = "ubi9"
+
+// Values of build.symlinks. Symlinks are preserved by default.
+const (
+	SymlinksPreserve = "preserve"
+	SymlinksFollow   = "follow"
+)
+
+// What a custom base image can provide, so Cog doesn't install it
+const (
+	ProvidesPython = "python"
+	ProvidesCUDA   = "cuda"
+)
+
+// How Python is installed, when Cog installs it. pyenv is the default.
+const (
+	PythonInstallPyenv      = "pyenv"
+	PythonInstallStandalone = "standalone"
+)
+
+// What installs Python packages. pip is the default.
+const (
+	InstallerPip = "pip"
+	InstallerUV  = "uv"
+)
+
+// How the layers of an image are compressed when it's pushed
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// sha256Regexp matches the checksums in build.download and prefetch
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// userRegexp matches the values of build.run_as_user: a user name that
+// useradd accepts, or a numeric UID
+var userRegexp = regexp.MustCompile(`^([a-z_][a-z0-9_-]*|[0-9]+)$`)
+
+// pythonPatchVersions are the minor versions of Python that Cog supports,
+// and the latest patch version of each that Cog knows of, which
+// python_version is installed as if it's a minor version.
+var pythonPatchVersions = map[string]string{
+	"3.7":  "3.7.17",
+	"3.8":  "3.8.20",
+	"3.9":  "3.9.20",
+	"3.10": "3.10.15",
+	"3.11": "3.11.10",
+	"3.12": "3.12.7",
+	"3.13": "3.13.0",
+}
+
+// pythonStandaloneRelease is the release of python-build-standalone that
+// 'python_install: standalone' downloads Python from. It has the patch
+// versions in pythonPatchVersions of Python 3.9 and later.
+const pythonStandaloneRelease = "20241016"
+
+// pythonVersionRegexp matches a minor or patch version of Python 3
+var pythonVersionRegexp = regexp.MustCompile(`^3\.[0-9]+(\.[0-9]+)?$`)
+
+// ubi9PythonVersions are the Python versions packaged for UBI 9.
+var ubi9PythonVersions = []string{"3.9", "3.11", "3.12"}
+
 type Build struct {
-	GPU                bool     `json:"gpu,omitempty" yaml:"gpu"`
-	PythonVersion      string   `json:"python_version,omitempty" yaml:"python_version"`
-	PythonRequirements string   `json:"python_requirements,omitempty" yaml:"python_requirements"`
-	PythonPackages     []string `json:"python_packages,omitempty" yaml:"python_packages"` // Deprecated, but included for backwards compatibility
-	Run                []string `json:"run,omitempty" yaml:"run"`
-	SystemPackages     []string `json:"system_packages,omitempty" yaml:"system_packages"`
-	PreInstall         []string `json:"pre_install,omitempty" yaml:"pre_install"` // Deprecated, but included for backwards compatibility
-	CUDA               string   `json:"cuda,omitempty" yaml:"cuda"`
-	CuDNN              string   `json:"cudnn,omitempty" yaml:"cudnn"`
+	GPU                 bool       `json:"gpu,omitempty" yaml:"gpu"`
+	GPUVendor           string     `json:"gpu_vendor,omitempty" yaml:"gpu_vendor"`
+	PythonVersion       string     `json:"python_version,omitempty" yaml:"python_version"`
+	PythonRequirements  string     `json:"python_requirements,omitempty" yaml:"python_requirements"`
+	PythonInstall       string     `json:"python_install,omitempty" yaml:"python_install"`
+	PythonPackages      []string   `json:"python_packages,omitempty" yaml:"python_packages"` // Deprecated, but included for backwards compatibility
+	Poetry              bool       `json:"poetry,omitempty" yaml:"poetry"`
+	Preset              string     `json:"preset,omitempty" yaml:"preset"`
+	Installer           string     `json:"installer,omitempty" yaml:"installer"`
+	Run                 []RunItem  `json:"run,omitempty" yaml:"run"`
+	Download            []Download `json:"download,omitempty" yaml:"download"`
+	SystemPackages      []string   `json:"system_packages,omitempty" yaml:"system_packages"`
+	InstallRetries      int        `json:"install_retries,omitempty" yaml:"install_retries"`
+	StepTimeout         string     `json:"step_timeout,omitempty" yaml:"step_timeout"`
+	AptMirror           string     `json:"apt_mirror,omitempty" yaml:"apt_mirror"`
+	PipIndexURL         string     `json:"pip_index_url,omitempty" yaml:"pip_index_url"`
+	PipExtraIndexURLs   []string   `json:"pip_extra_index_urls,omitempty" yaml:"pip_extra_index_urls"`
+	PipFallbackIndexURL string     `json:"pip_fallback_index_url,omitempty" yaml:"pip_fallback_index_url"`
+	SSH                 bool       `json:"ssh,omitempty" yaml:"ssh"`
+	PreInstall          []string   `json:"pre_install,omitempty" yaml:"pre_install"` // Deprecated, but included for backwards compatibility
+	CUDA                string     `json:"cuda,omitempty" yaml:"cuda"`
+	CuDNN               string     `json:"cudnn,omitempty" yaml:"cudnn"`
+	ROCm                string     `json:"rocm,omitempty" yaml:"rocm"`
+	Distro              string     `json:"distro,omitempty" yaml:"distro"`
+	BaseImage           string     `json:"base_image,omitempty" yaml:"base_image"`
+	BaseImageProvides   []string   `json:"base_image_provides,omitempty" yaml:"base_image_provides"`
+	SourceOwner         string     `json:"source_owner,omitempty" yaml:"source_owner"`
+	RunAsUser           string     `json:"run_as_user,omitempty" yaml:"run_as_user"`
+	LayerGroups         int        `json:"layer_groups,omitempty" yaml:"layer_groups"`
+	LargeFileThreshold  string     `json:"large_file_threshold,omitempty" yaml:"large_file_threshold"`
+	Compression         string     `json:"compression,omitempty" yaml:"compression"`
+	CompressionLevel    int        `json:"compression_level,omitempty" yaml:"compression_level"`
+	Symlinks            string     `json:"symlinks,omitempty" yaml:"symlinks"`
+	Wheelhouse          string     `json:"wheelhouse,omitempty" yaml:"wheelhouse"`
 
 	pythonRequirementsContent []string
+	// pythonVersionSet, cudaSource, and cudnnSource are where the versions
+	// of Python, CUDA, and cuDNN came from, for cog explain
+	pythonVersionSet bool
+	cudaSource       string
+	cudnnSource      string
+}
+
+// DefaultPipIndexURL is the Python package index packages are installed
+// from if build.pip_index_url isn't set.
+const DefaultPipIndexURL = "https://pypi.tuna.tsinghua.edu.cn/simple"
+
+// ExampleAssetsDir is where files used as example inputs are copied to in
+// the image, at the same path they have in the project directory.
+const ExampleAssetsDir = "/cog/examples"
+
+// RunItem is a command in build.run. It's either a string, or an object with
+// the command and how to run it.
+type RunItem struct {
+	Command string `json:"command" yaml:"command"`
+	// Retries is how many times to retry the command if it fails
+	Retries int `json:"retries,omitempty" yaml:"retries"`
+	// Timeout is how long the command can run for, like 30m. It overrides
+	// build.step_timeout.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout"`
+	// RequiresGPU runs the command with the builder's GPUs. If the builder
+	// doesn't have any, it's run when the model first starts instead.
+	RequiresGPU bool `json:"requires_gpu,omitempty" yaml:"requires_gpu"`
+}
+
+// Download is a file in build.download or prefetch, which is downloaded
+// into the image when it's built.
+type Download struct {
+	URL string `json:"url" yaml:"url"`
+	// Dest is where it's downloaded to: a path in the project directory, or
+	// an absolute path in the image
+	Dest string `json:"dest" yaml:"dest"`
+	// SHA256 is the checksum the file must have, if it's set
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256"`
+}
+
+// Downloads returns the files in build.download and prefetch.
+func (c *Config) Downloads() []Download {
+	downloads := append([]Download{}, c.Build.Download...)
+	return append(downloads, c.Prefetch...)
+}
+
+// ProjectPath returns where the file goes in the project directory, which
+// is mounted over /src when the model runs from it, or "" if it goes
+// somewhere else in the image.
+func (d Download) ProjectPath() string {
+	dest := path.Clean(d.Dest)
+	if !path.IsAbs(dest) {
+		return dest
+	}
+	if strings.HasPrefix(dest, "/src/") {
+		return strings.TrimPrefix(dest, "/src/")
+	}
+	return ""
+}
+
+// TimeoutDuration returns the command's timeout, or 0 if it doesn't have
+// one. The config must have been validated.
+func (r RunItem) TimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(r.Timeout)
+	return timeout
+}
+
+func (r *RunItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&r.Command); err == nil {
+		return nil
+	}
+	type runItem RunItem
+	return unmarshal((*runItem)(r))
+}
+
+func (r *RunItem) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Command); err == nil {
+		return nil
+	}
+	type runItem RunItem
+	return json.Unmarshal(data, (*runItem)(r))
+}
+
+// MarshalJSON writes commands without options as strings, so images can be
+// read by versions of Cog from before run commands had options.
+func (r RunItem) MarshalJSON() ([]byte, error) {
+	if r.Retries == 0 && r.Timeout == "" && !r.RequiresGPU {
+		return json.Marshal(r.Command)
+	}
+	type runItem RunItem
+	return json.Marshal(runItem(r))
 }
 
 type Example struct {
 	Input  map[string]string `json:"input" yaml:"input"`
-	Output string            `json:"output" yaml:"output"`
+	Output string            `json:"output,omitempty" yaml:"output"`
+}
+
+// Assets returns the paths of the files, relative to the project directory,
+// used as inputs to the example. File inputs are prefixed with @.
+func (e *Example) Assets() []string {
+	assets := []string{}
+	for _, value := range e.Input {
+		if strings.HasPrefix(value, "@") {
+			assets = append(assets, value[1:])
+		}
+	}
+	sort.Strings(assets)
+	return assets
+}
+
+// FirstBoot is work that's done once per container, when the model first
+// starts, before setup, for what can't or shouldn't be done when the image
+// is built.
+type FirstBoot struct {
+	// CacheDir is where downloads are cached. Mount a volume on it so they're
+	// shared between containers.
+	CacheDir string          `json:"cache_dir,omitempty" yaml:"cache_dir"`
+	Steps    []FirstBootStep `json:"steps" yaml:"steps"`
+}
+
+// FirstBootStep is either a command to run, or a file to download to Dest,
+// a path in the project directory.
+type FirstBootStep struct {
+	Run      string `json:"run,omitempty" yaml:"run"`
+	Download string `json:"download,omitempty" yaml:"download"`
+	Dest     string `json:"dest,omitempty" yaml:"dest"`
+}
+
+// Warmup is a prediction that is run after setup, before the model reports
+// that it is ready.
+type Warmup struct {
+	Input map[string]interface{} `json:"input" yaml:"input"`
+}
+
+type WeightsEncryption struct {
+	Files      []string `json:"files" yaml:"files"`
+	KeyEnv     string   `json:"key_env,omitempty" yaml:"key_env"`
+	KeyCommand string   `json:"key_command,omitempty" yaml:"key_command"`
+}
+
+// SharedWeights is a directory of weights that replicas on the same host
+// mount from a shared volume, rather than each reading their own copy from
+// the image.
+type SharedWeights struct {
+	// Path is the directory in the project, relative to it
+	Path string `json:"path" yaml:"path"`
+	// HostPath is the absolute path of the volume on the host
+	HostPath string `json:"host_path" yaml:"host_path"`
+}
+
+// WeightsSharding splits large weights files into shards, each in a layer
+// of its own, so they're pulled in parallel. The shards are joined again
+// when the model starts.
+type WeightsSharding struct {
+	Files  []string `json:"files" yaml:"files"`
+	Shards int      `json:"shards,omitempty" yaml:"shards"`
+}
+
+// WeightsCheck is a weights file that's checked when the model is built,
+// so corrupt weights, or weights for the wrong architecture, fail the build
+// rather than the first prediction.
+type WeightsCheck struct {
+	Path string `json:"path" yaml:"path"`
+	// Manifest is a JSON file in the project directory with what the
+	// weights should have, like the names of their tensors
+	Manifest string `json:"manifest,omitempty" yaml:"manifest"`
+}
+
+type Weights struct {
+	Encryption *WeightsEncryption `json:"encryption,omitempty" yaml:"encryption"`
+	Shared     *SharedWeights     `json:"shared,omitempty" yaml:"shared"`
+	Sharding   *WeightsSharding   `json:"sharding,omitempty" yaml:"sharding"`
+	Validate   []WeightsCheck     `json:"validate,omitempty" yaml:"validate"`
+	// Paths are files and directories in the project that are copied into
+	// layers of their own, after the code
+	Paths []string `json:"paths,omitempty" yaml:"paths"`
+}
+
+// Model is a variant of the model, which shares its code but is set up with
+// different weights.
+type Model struct {
+	// Weights is a path in the project directory or a URL
+	Weights string `json:"weights" yaml:"weights"`
+}
+
+// Serving configures the HTTP server in the image.
+type Serving struct {
+	Compression    []string `json:"compression,omitempty" yaml:"compression"`
+	OutputEncoding string   `json:"output_encoding,omitempty" yaml:"output_encoding"`
+	MaxQueueSize   int      `json:"max_queue_size,omitempty" yaml:"max_queue_size"`
+	QueueTimeout   float64  `json:"queue_timeout,omitempty" yaml:"queue_timeout"`
+	// PreemptionGrace is how many seconds a running prediction has to
+	// return once it's preempted by SIGTERM
+	PreemptionGrace float64 `json:"preemption_grace,omitempty" yaml:"preemption_grace"`
+	// Priorities are the queue's lanes, from highest to lowest
+	Priorities      []string `json:"priorities,omitempty" yaml:"priorities"`
+	DefaultPriority string   `json:"default_priority,omitempty" yaml:"default_priority"`
+	// MaxLoadedModels is how many variants from Models can be loaded at
+	// once, or 0 for no limit
+	MaxLoadedModels int `json:"max_loaded_models,omitempty" yaml:"max_loaded_models"`
+	// TmpDirQuota is how much each prediction can write to its temporary
+	// directory, like 10GB
+	TmpDirQuota string `json:"tmp_dir_quota,omitempty" yaml:"tmp_dir_quota"`
+	// MinFreeDisk is how much disk space must be free to start a
+	// prediction, like 5GB
+	MinFreeDisk string `json:"min_free_disk,omitempty" yaml:"min_free_disk"`
+	// EvictDirs are directories whose files can be removed to free disk
+	// space for MinFreeDisk
+	EvictDirs []string `json:"evict_dirs,omitempty" yaml:"evict_dirs"`
+	// Port is the port the HTTP server listens on in the container, if it
+	// isn't DefaultServingPort
+	Port int `json:"port,omitempty" yaml:"port"`
+	// Healthcheck tunes the HEALTHCHECK the image is built with
+	Healthcheck *Healthcheck `json:"healthcheck,omitempty" yaml:"healthcheck"`
+}
+
+// Healthcheck is how Docker checks the HTTP server in the image is healthy,
+// so orchestrators that read Docker's health status, like ECS and Nomad,
+// know when the model is ready. Durations are like 30s.
+type Healthcheck struct {
+	Disabled    bool   `json:"disabled,omitempty" yaml:"disabled"`
+	Interval    string `json:"interval,omitempty" yaml:"interval"`
+	Timeout     string `json:"timeout,omitempty" yaml:"timeout"`
+	StartPeriod string `json:"start_period,omitempty" yaml:"start_period"`
+	Retries     int    `json:"retries,omitempty" yaml:"retries"`
+}
+
+// The HEALTHCHECK options, unless they're set in serving.healthcheck. The
+// start period is long, as setup can download weights, and the model isn't
+// healthy until it's finished.
+const (
+	DefaultHealthcheckInterval    = "30s"
+	DefaultHealthcheckTimeout     = "10s"
+	DefaultHealthcheckStartPeriod = "10m"
+	DefaultHealthcheckRetries     = 3
+)
+
+// ServingHealthcheck returns serving.healthcheck with the defaults filled
+// in, or nil if it's disabled.
+func (c *Config) ServingHealthcheck() *Healthcheck {
+	healthcheck := Healthcheck{}
+	if c.Serving != nil && c.Serving.Healthcheck != nil {
+		healthcheck = *c.Serving.Healthcheck
+	}
+	if healthcheck.Disabled {
+		return nil
+	}
+	if healthcheck.Interval == "" {
+		healthcheck.Interval = DefaultHealthcheckInterval
+	}
+	if healthcheck.Timeout == "" {
+		healthcheck.Timeout = DefaultHealthcheckTimeout
+	}
+	if healthcheck.StartPeriod == "" {
+		healthcheck.StartPeriod = DefaultHealthcheckStartPeriod
+	}
+	if healthcheck.Retries == 0 {
+		healthcheck.Retries = DefaultHealthcheckRetries
+	}
+	return &healthcheck
+}
+
+// DefaultServingPort is the port the HTTP server listens on in the
+// container, unless serving.port is set
+const DefaultServingPort = 5000
+
+// ServingPort returns the port the HTTP server listens on in the container.
+func (c *Config) ServingPort() int {
+	if c.Serving != nil && c.Serving.Port != 0 {
+		return c.Serving.Port
+	}
+	return DefaultServingPort
+}
+
+// ServerCommand returns the command that runs the HTTP server in the
+// container, listening on serving.port.
+func (c *Config) ServerCommand() []string {
+	command := []string{"python", "-m", "cog.server.http"}
+	if port := c.ServingPort(); port != DefaultServingPort {
+		command = append(command, "--port", strconv.Itoa(port))
+	}
+	return command
+}
+
+// Matrix lists build options to build every combination of with
+// `cog build --matrix`.
+type Matrix struct {
+	CUDA          []string `json:"cuda,omitempty" yaml:"cuda"`
+	PythonVersion []string `json:"python_version,omitempty" yaml:"python_version"`
+}
+
+// Lint configures `cog lint`. Rules maps the name of a rule to the
+// severity it's reported with: error, warning, or off.
+type Lint struct {
+	Rules map[string]string `json:"rules,omitempty" yaml:"rules"`
+}
+
+// Resources limits what the model can use when it's run.
+type Resources struct {
+	CPUs float64 `json:"cpus,omitempty" yaml:"cpus"`
+	// Memory is a size like 16GiB
+	Memory string `json:"memory,omitempty" yaml:"memory"`
+	// GPUMemory is how much GPU memory the model needs, like 24GB. It isn't
+	// enforced, but is kept in the image's labels with the rest of cog.yaml
+	// so it can be scheduled on a GPU that's big enough.
+	GPUMemory string `json:"gpu_memory,omitempty" yaml:"gpu_memory"`
+}
+
+// MemoryBytes returns the memory limit in bytes, or 0 if there isn't one.
+func (r *Resources) MemoryBytes() int64 {
+	if r == nil || r.Memory == "" {
+		return 0
+	}
+	// It's checked when the config is validated
+	bytes, _ := units.RAMInBytes(r.Memory)
+	return bytes
 }
 
 type Config struct {
-	Build   *Build `json:"build" yaml:"build"`
-	Image   string `json:"image,omitempty" yaml:"image"`
-	Predict string `json:"predict,omitempty" yaml:"predict"`
-	Train   string `json:"train,omitempty" yaml:"train"`
+	Build        *Build              `json:"build" yaml:"build"`
+	DefaultModel string              `json:"default_model,omitempty" yaml:"default_model"`
+	Environment  map[string]string   `json:"environment,omitempty" yaml:"environment"`
+	Examples     map[string]*Example `json:"examples,omitempty" yaml:"examples"`
+	FirstBoot    *FirstBoot          `json:"first_boot,omitempty" yaml:"first_boot"`
+	Image        string              `json:"image,omitempty" yaml:"image"`
+	Labels       map[string]string   `json:"labels,omitempty" yaml:"labels"`
+	Lint         *Lint               `json:"lint,omitempty" yaml:"lint"`
+	Matrix       *Matrix             `json:"matrix,omitempty" yaml:"matrix"`
+	Models       map[string]*Model   `json:"models,omitempty" yaml:"models"`
+	Predict      string              `json:"predict,omitempty" yaml:"predict"`
+	Prefetch     []Download          `json:"prefetch,omitempty" yaml:"prefetch"`
+	Resources    *Resources          `json:"resources,omitempty" yaml:"resources"`
+	Serving      *Serving            `json:"serving,omitempty" yaml:"serving"`
+	Train        string              `json:"train,omitempty" yaml:"train"`
+	Warmup       []Warmup            `json:"warmup,omitempty" yaml:"warmup"`
+	Weights      *Weights            `json:"weights,omitempty" yaml:"weights"`
 }
 
 func DefaultConfig() *Config {
@@ -68,9 +505,100 @@ func FromYAML(contents []byte) (*Config, error) {
 	} else {
 		config.Build = DefaultConfig().Build
 	}
+	// The default is set before it's parsed, so whether it was set has to
+	// be found out separately
+	var set struct {
+		Build *struct {
+			PythonVersion string `yaml:"python_version"`
+		} `yaml:"build"`
+	}
+	if err := yaml.Unmarshal(contents, &set); err == nil && set.Build != nil {
+		config.Build.pythonVersionSet = set.Build.PythonVersion != ""
+	}
 	return config, nil
 }
 
+// FromJSON parses a config written as JSON, like cog.json. It's the same
+// as cog.yaml, so it's converted to YAML and parsed with FromYAML.
+func FromJSON(contents []byte) (*Config, error) {
+	var doc interface{}
+	if err := json.Unmarshal(contents, &doc); err != nil {
+		return nil, fmt.Errorf("Failed to parse config json: %w", err)
+	}
+	return fromDocument(doc)
+}
+
+// FromTOML parses a config written as TOML, like cog.toml, with the same
+// tables and keys as cog.yaml.
+func FromTOML(contents []byte) (*Config, error) {
+	doc := map[string]interface{}{}
+	if _, err := toml.Decode(string(contents), &doc); err != nil {
+		return nil, fmt.Errorf("Failed to parse config toml: %w", err)
+	}
+	return fromDocument(doc)
+}
+
+// FromFile parses a config in the format of filename's extension: .json,
+// .toml, or YAML otherwise. If filename is empty, like for a config read
+// from stdin, the format is worked out from the contents.
+func FromFile(filename string, contents []byte) (*Config, error) {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".json":
+		return FromJSON(contents)
+	case ".toml":
+		return FromTOML(contents)
+	case "":
+		if filename == "" {
+			return fromUnknownFormat(contents)
+		}
+	}
+	return FromYAML(contents)
+}
+
+// fromUnknownFormat parses a JSON object as JSON, and anything else as
+// YAML, unless it isn't a YAML mapping and is TOML
+func fromUnknownFormat(contents []byte) (*Config, error) {
+	trimmed := bytes.TrimSpace(contents)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return FromJSON(contents)
+	}
+	var doc interface{}
+	err := yaml.Unmarshal(contents, &doc)
+	if _, isMapping := doc.(map[interface{}]interface{}); err != nil || (doc != nil && !isMapping) {
+		if config, tomlErr := FromTOML(contents); tomlErr == nil {
+			return config, nil
+		}
+	}
+	return FromYAML(contents)
+}
+
+func fromDocument(doc interface{}) (*Config, error) {
+	contents, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return FromYAML(contents)
+}
+
+// PythonVersionSource returns where build.python_version came from, to
+// follow "because".
+func (b *Build) PythonVersionSource() string {
+	if b.pythonVersionSet {
+		return "it's set in build.python_version"
+	}
+	return "it's the default, because build.python_version isn't set"
+}
+
+// CUDASource and CuDNNSource return where the versions of CUDA and cuDNN
+// came from, to follow "because". The config must have been completed.
+func (b *Build) CUDASource() string {
+	return b.cudaSource
+}
+
+func (b *Build) CuDNNSource() string {
+	return b.cudnnSource
+}
+
 func (c *Config) CUDABaseImageTag() (string, error) {
 	return CUDABaseImageFor(c.Build.CUDA, c.Build.CuDNN)
 }
@@ -150,15 +678,649 @@ func (c *Config) ValidateAndComplete(projectDir string) error {
 		c.Build.pythonRequirementsContent = c.Build.PythonPackages
 	}
 
-	if c.Build.GPU {
+	if err := c.completePreset(); err != nil {
+		return err
+	}
+
+	if err := c.validatePythonVersion(); err != nil {
+		return err
+	}
+
+	if err := c.completePoetry(projectDir); err != nil {
+		return err
+	}
+
+	if c.Build.Distro == DistroUBI9 {
+		if err := c.validateUBI9(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateBaseImage(); err != nil {
+		return err
+	}
+
+	if c.Build.AptMirror != "" {
+		u, err := url.Parse(c.Build.AptMirror)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("'build.apt_mirror' in cog.yaml must be an http:// or https:// URL")
+		}
+	}
+
+	if err := c.validateGPUVendor(); err != nil {
+		return err
+	}
+	if c.Build.IsAMD() {
+		if err := c.validateAndCompleteROCm(); err != nil {
+			return err
+		}
+	} else if c.Build.GPU {
 		if err := c.validateAndCompleteCUDA(); err != nil {
 			return err
 		}
 	}
 
+	if c.Build.LayerGroups < 0 {
+		return fmt.Errorf("'build.layer_groups' in cog.yaml can't be negative")
+	}
+	if c.Build.LargeFileThreshold != "" {
+		if _, err := units.FromHumanSize(c.Build.LargeFileThreshold); err != nil {
+			return fmt.Errorf("'build.large_file_threshold' in cog.yaml must be a size like 200MB")
+		}
+	}
+
+	if err := c.validateCompression(); err != nil {
+		return err
+	}
+
+	if err := c.validateDownloads(); err != nil {
+		return err
+	}
+
+	if wheelhouse := c.Build.Wheelhouse; wheelhouse != "" && (path.IsAbs(wheelhouse) || strings.HasPrefix(path.Clean(wheelhouse), "..")) {
+		return fmt.Errorf("'build.wheelhouse' in cog.yaml must be a directory inside the project directory")
+	}
+
+	if err := c.validateEnvironment(); err != nil {
+		return err
+	}
+
+	if err := c.validateLabels(); err != nil {
+		return err
+	}
+
+	if user := c.Build.RunAsUser; user != "" {
+		if !userRegexp.MatchString(user) {
+			return fmt.Errorf("'build.run_as_user' in cog.yaml must be a user name or a numeric UID")
+		}
+		if user == "root" || strings.TrimLeft(user, "0") == "" {
+			return fmt.Errorf("'build.run_as_user' in cog.yaml must be a user other than root")
+		}
+	}
+
+	if c.Build.InstallRetries < 0 {
+		return fmt.Errorf("'build.install_retries' in cog.yaml can't be negative")
+	}
+	if c.Build.StepTimeout != "" && !isPositiveDuration(c.Build.StepTimeout) {
+		return fmt.Errorf("'build.step_timeout' in cog.yaml must be a duration like 30m")
+	}
+	for _, run := range c.Build.Run {
+		if strings.TrimSpace(run.Command) == "" {
+			return fmt.Errorf("The commands in 'build.run' in cog.yaml can't be empty")
+		}
+		if run.Retries < 0 {
+			return fmt.Errorf("The retries of '%s' in 'build.run' in cog.yaml can't be negative", run.Command)
+		}
+		if run.Timeout != "" && !isPositiveDuration(run.Timeout) {
+			return fmt.Errorf("The timeout of '%s' in 'build.run' in cog.yaml must be a duration like 30m", run.Command)
+		}
+	}
+
+	if c.Weights != nil && c.Weights.Encryption != nil {
+		if err := c.validateAndCompleteWeightsEncryption(projectDir); err != nil {
+			return err
+		}
+	}
+
+	if c.Weights != nil && c.Weights.Shared != nil {
+		if err := c.validateSharedWeights(); err != nil {
+			return err
+		}
+	}
+
+	if c.Weights != nil && c.Weights.Sharding != nil {
+		if err := c.validateAndCompleteWeightsSharding(projectDir); err != nil {
+			return err
+		}
+	}
+
+	if c.Weights != nil && len(c.Weights.Paths) > 0 {
+		if err := c.validateWeightsPaths(projectDir); err != nil {
+			return err
+		}
+	}
+
+	if c.Weights != nil {
+		for _, check := range c.Weights.Validate {
+			for _, p := range []string{check.Path, check.Manifest} {
+				if path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+					return fmt.Errorf("%s in 'weights.validate' in cog.yaml must be inside the project directory", p)
+				}
+			}
+		}
+	}
+
+	if c.FirstBoot != nil {
+		if err := c.FirstBoot.validate(); err != nil {
+			return err
+		}
+	}
+
+	for name, example := range c.Examples {
+		if err := validateExample(projectDir, name, example); err != nil {
+			return err
+		}
+	}
+
+	if c.Matrix != nil && len(c.Matrix.CUDA) > 0 && !c.Build.GPU {
+		return fmt.Errorf("'matrix.cuda' in cog.yaml can only be set if 'gpu' is true")
+	}
+
+	for name, model := range c.Models {
+		if err := validateModel(name, model); err != nil {
+			return err
+		}
+	}
+	if c.DefaultModel != "" {
+		if _, ok := c.Models[c.DefaultModel]; !ok {
+			return fmt.Errorf("'default_model' in cog.yaml must be one of 'models'")
+		}
+	}
+
+	if c.Serving != nil && c.Serving.DefaultPriority != "" && !slices.ContainsString(c.Serving.Priorities, c.Serving.DefaultPriority) {
+		return fmt.Errorf("'serving.default_priority' in cog.yaml must be one of 'serving.priorities'")
+	}
+
+	if c.Serving != nil {
+		if err := c.Serving.validateDisk(); err != nil {
+			return err
+		}
+		if err := c.Serving.validateHealthcheck(); err != nil {
+			return err
+		}
+	}
+
+	if c.Resources != nil {
+		if c.Resources.CPUs < 0 {
+			return fmt.Errorf("'resources.cpus' in cog.yaml must be positive")
+		}
+		if c.Resources.Memory != "" {
+			if bytes, err := units.RAMInBytes(c.Resources.Memory); err != nil || bytes <= 0 {
+				return fmt.Errorf("'resources.memory' in cog.yaml must be a size like 16GiB")
+			}
+		}
+		if c.Resources.GPUMemory != "" {
+			if bytes, err := units.RAMInBytes(c.Resources.GPUMemory); err != nil || bytes <= 0 {
+				return fmt.Errorf("'resources.gpu_memory' in cog.yaml must be a size like 24GiB")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Serving) validateHealthcheck() error {
+	if s.Healthcheck == nil {
+		return nil
+	}
+	for name, value := range map[string]string{
+		"interval":     s.Healthcheck.Interval,
+		"timeout":      s.Healthcheck.Timeout,
+		"start_period": s.Healthcheck.StartPeriod,
+	} {
+		if value != "" && !isPositiveDuration(value) {
+			return fmt.Errorf("'serving.healthcheck.%s' in cog.yaml must be a duration like 30s", name)
+		}
+	}
+	if s.Healthcheck.Retries < 0 {
+		return fmt.Errorf("'serving.healthcheck.retries' in cog.yaml can't be negative")
+	}
+	return nil
+}
+
+func (s *Serving) validateDisk() error {
+	if s.TmpDirQuota != "" {
+		if size, err := units.FromHumanSize(s.TmpDirQuota); err != nil || size <= 0 {
+			return fmt.Errorf("'serving.tmp_dir_quota' in cog.yaml must be a size like 10GB")
+		}
+	}
+	if s.MinFreeDisk != "" {
+		if size, err := units.FromHumanSize(s.MinFreeDisk); err != nil || size <= 0 {
+			return fmt.Errorf("'serving.min_free_disk' in cog.yaml must be a size like 5GB")
+		}
+	}
+	if len(s.EvictDirs) > 0 && s.MinFreeDisk == "" {
+		return fmt.Errorf("'serving.evict_dirs' in cog.yaml can only be set with 'serving.min_free_disk'")
+	}
+	for _, dir := range s.EvictDirs {
+		if !path.IsAbs(dir) || path.Clean(dir) == "/" {
+			return fmt.Errorf("%s in 'serving.evict_dirs' in cog.yaml must be an absolute path, other than /", dir)
+		}
+	}
+	return nil
+}
+
+func (f *FirstBoot) validate() error {
+	if f.CacheDir != "" && !path.IsAbs(f.CacheDir) {
+		return fmt.Errorf("'first_boot.cache_dir' in cog.yaml must be an absolute path")
+	}
+	for _, step := range f.Steps {
+		if (step.Run == "") == (step.Download == "") {
+			return fmt.Errorf("Each step in 'first_boot.steps' in cog.yaml must have one of 'run' or 'download'")
+		}
+		if step.Run != "" {
+			if step.Dest != "" {
+				return fmt.Errorf("'dest' in 'first_boot.steps' in cog.yaml is only for steps with 'download'")
+			}
+			continue
+		}
+		u, err := url.Parse(step.Download)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s in 'first_boot.steps' in cog.yaml must be an http:// or https:// URL", step.Download)
+		}
+		if step.Dest == "" {
+			return fmt.Errorf("The download of %s in 'first_boot.steps' in cog.yaml needs a 'dest'", step.Download)
+		}
+		if path.IsAbs(step.Dest) || strings.HasPrefix(path.Clean(step.Dest), "..") {
+			return fmt.Errorf("%s in 'first_boot.steps' in cog.yaml must be inside the project directory", step.Dest)
+		}
+	}
+	return nil
+}
+
+func validateExample(projectDir string, name string, example *Example) error {
+	if example == nil {
+		return fmt.Errorf("Example %s in cog.yaml has no inputs", name)
+	}
+	for _, asset := range example.Assets() {
+		if path.IsAbs(asset) || strings.HasPrefix(path.Clean(asset), "..") {
+			return fmt.Errorf("Input file %s of example %s in cog.yaml must be a path inside the project directory", asset, name)
+		}
+		if _, err := os.Stat(path.Join(projectDir, asset)); err != nil {
+			return fmt.Errorf("Input file %s of example %s in cog.yaml does not exist", asset, name)
+		}
+	}
+	return nil
+}
+
+func validateModel(name string, model *Model) error {
+	if model == nil || model.Weights == "" {
+		return fmt.Errorf("Model %s in cog.yaml has no weights", name)
+	}
+	if strings.Contains(model.Weights, "://") || strings.HasPrefix(model.Weights, "data:") {
+		return nil
+	}
+	if path.IsAbs(model.Weights) || strings.HasPrefix(path.Clean(model.Weights), "..") {
+		return fmt.Errorf("The weights of model %s in cog.yaml must be a path inside the project directory, or a URL", name)
+	}
 	return nil
 }
 
+// ExampleAssets returns the paths of all the files used by examples,
+// relative to the project directory.
+func (c *Config) ExampleAssets() []string {
+	seen := map[string]bool{}
+	assets := []string{}
+	for _, example := range c.Examples {
+		if example == nil {
+			continue
+		}
+		for _, asset := range example.Assets() {
+			asset = path.Clean(asset)
+			if !seen[asset] {
+				seen[asset] = true
+				assets = append(assets, asset)
+			}
+		}
+	}
+	sort.Strings(assets)
+	return assets
+}
+
+func (c *Config) validateAndCompleteWeightsEncryption(projectDir string) error {
+	encryption := c.Weights.Encryption
+	if len(encryption.Files) == 0 {
+		return fmt.Errorf("'weights.encryption.files' in cog.yaml must list at least one encrypted file")
+	}
+	for _, file := range encryption.Files {
+		if !strings.HasSuffix(file, ".enc") {
+			return fmt.Errorf("Encrypted weights file %s in cog.yaml must end in .enc. You can create it with 'cog weights encrypt %s'", file, strings.TrimSuffix(file, ".enc"))
+		}
+		// The decrypted file must not be built into the image, otherwise
+		// encrypting it is pointless.
+		plaintext := path.Join(projectDir, strings.TrimSuffix(file, ".enc"))
+		if _, err := os.Stat(plaintext); err == nil {
+			console.Warnf("%s is not encrypted and will be copied into the image. Add it to .dockerignore to keep it out.", plaintext)
+		}
+	}
+	if encryption.KeyEnv == "" {
+		encryption.KeyEnv = DefaultWeightsKeyEnv
+	}
+	return nil
+}
+
+func (c *Config) validateSharedWeights() error {
+	shared := c.Weights.Shared
+	if path.IsAbs(shared.Path) || strings.HasPrefix(path.Clean(shared.Path), "..") || path.Clean(shared.Path) == "." {
+		return fmt.Errorf("'weights.shared.path' in cog.yaml must be a directory inside the project directory")
+	}
+	if !path.IsAbs(shared.HostPath) {
+		return fmt.Errorf("'weights.shared.host_path' in cog.yaml must be an absolute path")
+	}
+	// The shared volume is mounted read-only, so encrypted weights in it
+	// can't be decrypted next to themselves
+	if c.Weights.Encryption != nil {
+		for _, file := range c.Weights.Encryption.Files {
+			if strings.HasPrefix(path.Clean(file), path.Clean(shared.Path)+"/") {
+				return fmt.Errorf("Encrypted weights file %s in cog.yaml can't be in 'weights.shared.path', because the shared volume is read-only", file)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateAndCompleteWeightsSharding(projectDir string) error {
+	sharding := c.Weights.Sharding
+	if len(sharding.Files) == 0 {
+		return fmt.Errorf("'weights.sharding.files' in cog.yaml must list at least one file")
+	}
+	for _, file := range sharding.Files {
+		if path.IsAbs(file) || strings.HasPrefix(path.Clean(file), "..") {
+			return fmt.Errorf("Sharded weights file %s in cog.yaml must be inside the project directory", file)
+		}
+		info, err := os.Stat(path.Join(projectDir, file))
+		if err != nil {
+			return fmt.Errorf("Sharded weights file %s in cog.yaml doesn't exist", file)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("Sharded weights file %s in cog.yaml must be a file", file)
+		}
+		// The shards are joined next to themselves, which can't be done on
+		// the read-only shared volume
+		if c.Weights.Shared != nil && strings.HasPrefix(path.Clean(file), path.Clean(c.Weights.Shared.Path)+"/") {
+			return fmt.Errorf("Sharded weights file %s in cog.yaml can't be in 'weights.shared.path', because the shared volume is read-only", file)
+		}
+	}
+	if sharding.Shards == 0 {
+		sharding.Shards = DefaultWeightsShards
+	}
+	if sharding.Shards < 2 || sharding.Shards > maxWeightsShards {
+		return fmt.Errorf("'weights.sharding.shards' in cog.yaml must be from 2 to %d", maxWeightsShards)
+	}
+	return nil
+}
+
+func (c *Config) validateWeightsPaths(projectDir string) error {
+	sharded := []string{}
+	if c.Weights.Sharding != nil {
+		sharded = c.Weights.Sharding.Files
+	}
+	for _, p := range c.Weights.Paths {
+		clean := path.Clean(p)
+		if path.IsAbs(p) || clean == "." || strings.HasPrefix(clean, "..") {
+			return fmt.Errorf("%s in 'weights.paths' in cog.yaml must be inside the project directory", p)
+		}
+		if _, err := os.Stat(path.Join(projectDir, p)); err != nil {
+			return fmt.Errorf("%s in 'weights.paths' in cog.yaml doesn't exist", p)
+		}
+		// Sharded files are already copied into layers of their own
+		for _, file := range sharded {
+			file = path.Clean(file)
+			if file == clean || strings.HasPrefix(file, clean+"/") {
+				return fmt.Errorf("Sharded weights file %s in cog.yaml can't also be in 'weights.paths'", file)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateBaseImage() error {
+	if c.Build.BaseImage == "" {
+		if len(c.Build.BaseImageProvides) > 0 {
+			return fmt.Errorf("'build.base_image_provides' in cog.yaml can only be set with 'build.base_image'")
+		}
+		return nil
+	}
+	if c.Build.Distro != "" {
+		return fmt.Errorf("'build.base_image' and 'build.distro' in cog.yaml can't both be set")
+	}
+	for _, provides := range c.Build.BaseImageProvides {
+		if provides != ProvidesPython && provides != ProvidesCUDA {
+			return fmt.Errorf("'build.base_image_provides' in cog.yaml can only contain %s and %s", ProvidesPython, ProvidesCUDA)
+		}
+	}
+	// Cog's CUDA comes from its base images, so it can't install it
+	if c.Build.GPU && !c.Build.BaseImageHas(ProvidesCUDA) {
+		return fmt.Errorf("Cog can't install CUDA on 'build.base_image', so it must already have it to use GPUs. Add 'cuda' to 'build.base_image_provides' in cog.yaml")
+	}
+	return nil
+}
+
+// PipIndex returns the Python package index to install packages from.
+func (b *Build) PipIndex() string {
+	if b.PipIndexURL == "" {
+		return DefaultPipIndexURL
+	}
+	return b.PipIndexURL
+}
+
+// LargeFileThresholdBytes returns build.large_file_threshold in bytes, or 0
+// if it isn't set. The config must have been validated.
+func (b *Build) LargeFileThresholdBytes() int64 {
+	size, _ := units.FromHumanSize(b.LargeFileThreshold)
+	return size
+}
+
+func (c *Config) validateCompression() error {
+	switch c.Build.Compression {
+	case "":
+		if c.Build.CompressionLevel != 0 {
+			return fmt.Errorf("'build.compression_level' in cog.yaml can only be set with 'build.compression'")
+		}
+	case CompressionGzip:
+		if c.Build.CompressionLevel < 0 || c.Build.CompressionLevel > 9 {
+			return fmt.Errorf("'build.compression_level' in cog.yaml must be from 1 to 9 for gzip")
+		}
+	case CompressionZstd:
+		if c.Build.CompressionLevel < 0 || c.Build.CompressionLevel > 22 {
+			return fmt.Errorf("'build.compression_level' in cog.yaml must be from 1 to 22 for zstd")
+		}
+	default:
+		return fmt.Errorf("'build.compression' in cog.yaml must be %s or %s", CompressionGzip, CompressionZstd)
+	}
+	return nil
+}
+
+func (c *Config) validateDownloads() error {
+	if err := validateDownloadList("build.download", c.Build.Download); err != nil {
+		return err
+	}
+	return validateDownloadList("prefetch", c.Prefetch)
+}
+
+// validateDownloadList validates the files in build.download or prefetch,
+// which are named by key in errors.
+func validateDownloadList(key string, downloads []Download) error {
+	for _, download := range downloads {
+		u, err := url.Parse(download.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s in '%s' in cog.yaml must be an http:// or https:// URL", download.URL, key)
+		}
+		if download.Dest == "" {
+			return fmt.Errorf("The download of %s in '%s' in cog.yaml needs a 'dest'", download.URL, key)
+		}
+		if !path.IsAbs(download.Dest) && strings.HasPrefix(path.Clean(download.Dest), "..") {
+			return fmt.Errorf("%s in '%s' in cog.yaml must be inside the project directory, or an absolute path", download.Dest, key)
+		}
+		if download.SHA256 != "" && !sha256Regexp.MatchString(download.SHA256) {
+			return fmt.Errorf("The sha256 of %s in '%s' in cog.yaml must be 64 lowercase hex digits", download.URL, key)
+		}
+	}
+	return nil
+}
+
+// ReservedEnvironment are the environment variables Cog sets in the image,
+// which can't be set with environment in cog.yaml
+var ReservedEnvironment = []string{"DEBIAN_FRONTEND", "LD_LIBRARY_PATH", "PATH", "PYTHONUNBUFFERED"}
+
+var environmentNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (c *Config) validateEnvironment() error {
+	for name, value := range c.Environment {
+		if !environmentNameRegexp.MatchString(name) {
+			return fmt.Errorf("%s in 'environment' in cog.yaml must be a name of letters, numbers and '_', that doesn't start with a number", name)
+		}
+		if slices.ContainsString(ReservedEnvironment, name) {
+			return fmt.Errorf("%s in 'environment' in cog.yaml is set by Cog, so it can't be set in cog.yaml. Cog sets %s", name, strings.Join(ReservedEnvironment, ", "))
+		}
+		if strings.ContainsAny(value, "\n\r") {
+			return fmt.Errorf("The value of %s in 'environment' in cog.yaml can't have a newline in it", name)
+		}
+	}
+	return nil
+}
+
+// reservedLabelPrefixes are the prefixes of the labels Cog sets on images,
+// which can't be set with labels in cog.yaml
+var reservedLabelPrefixes = []string{global.LabelNamespace, "org.cogmodel."}
+
+var labelKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+func (c *Config) validateLabels() error {
+	for key, value := range c.Labels {
+		if !labelKeyRegexp.MatchString(key) {
+			return fmt.Errorf("%s in 'labels' in cog.yaml must be a key of letters, numbers, '.', '_', '/' and '-', like org.opencontainers.image.licenses", key)
+		}
+		for _, prefix := range reservedLabelPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				return fmt.Errorf("%s in 'labels' in cog.yaml starts with %s, which is reserved for the labels Cog sets", key, prefix)
+			}
+		}
+		if strings.ContainsAny(value, "\n\r") {
+			return fmt.Errorf("The value of %s in 'labels' in cog.yaml can't have a newline in it", key)
+		}
+	}
+	return nil
+}
+
+// StepTimeoutDuration returns build.step_timeout, or 0 if it isn't set. The
+// config must have been validated.
+func (b *Build) StepTimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(b.StepTimeout)
+	return timeout
+}
+
+func isPositiveDuration(s string) bool {
+	d, err := time.ParseDuration(s)
+	return err == nil && d > 0
+}
+
+// RunRequiresGPU returns whether any of the commands in build.run need a GPU.
+func (b *Build) RunRequiresGPU() bool {
+	for _, run := range b.Run {
+		if run.RequiresGPU {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseImageHas returns whether build.base_image_provides has provides.
+func (b *Build) BaseImageHas(provides string) bool {
+	return slices.ContainsString(b.BaseImageProvides, provides)
+}
+
+func (c *Config) validateUBI9() error {
+	if c.Build.GPU {
+		return fmt.Errorf("'distro: ubi9' in cog.yaml does not support GPUs yet")
+	}
+	if c.Build.AptMirror != "" {
+		return fmt.Errorf("'build.apt_mirror' in cog.yaml can't be used with 'distro: ubi9', which doesn't use apt")
+	}
+	if !slices.ContainsString(ubi9PythonVersions, c.Build.PythonMinorVersion()) {
+		return fmt.Errorf("Python %s is not available on UBI 9. Set 'python_version' in cog.yaml to one of: %s", c.Build.PythonVersion, strings.Join(ubi9PythonVersions, ", "))
+	}
+	return nil
+}
+
+// validatePythonVersion checks python_version is a version of Python that
+// Cog supports, so a typo fails now rather than partway through the build.
+// A base image that has Python can have any version of it.
+func (c *Config) validatePythonVersion() error {
+	if !pythonVersionRegexp.MatchString(c.Build.PythonVersion) {
+		return fmt.Errorf("'build.python_version' in cog.yaml must be a version of Python 3, like \"3.11\" or \"3.11.9\", not %q", c.Build.PythonVersion)
+	}
+	if c.Build.BaseImageHas("python") {
+		return nil
+	}
+	if _, ok := pythonPatchVersions[c.Build.PythonMinorVersion()]; !ok {
+		return fmt.Errorf("Cog doesn't support Python %s. Set 'build.python_version' in cog.yaml to one of: %s. You might need to upgrade Cog: https://github.com/replicate/cog#upgrade", c.Build.PythonVersion, strings.Join(PythonVersions(), ", "))
+	}
+	return nil
+}
+
+// PythonVersions returns the minor versions of Python that Cog supports,
+// newest first.
+func PythonVersions() []string {
+	versions := make([]string, 0, len(pythonPatchVersions))
+	for version := range pythonPatchVersions {
+		versions = append(versions, version)
+	}
+	sortVersionsDescending(versions)
+	return versions
+}
+
+// PythonPatchVersion returns python_version as a patch version. If it's a
+// minor version, like 3.11, it's the latest patch version of it that Cog
+// knows of.
+func (b *Build) PythonPatchVersion() string {
+	if patch, ok := pythonPatchVersions[b.PythonVersion]; ok {
+		return patch
+	}
+	return b.PythonVersion
+}
+
+// PythonStandaloneRelease returns the release of python-build-standalone
+// that has python_version, for 'python_install: standalone'. Each release
+// has one patch version of each minor version, so it's an error if
+// python_version is a patch version that isn't in it.
+func (b *Build) PythonStandaloneRelease() (string, error) {
+	minor := b.PythonMinorVersion()
+	if version.Greater("3.9", minor) {
+		return "", fmt.Errorf("python-build-standalone doesn't have Python %s. Remove 'build.python_install: standalone' from cog.yaml to compile it with pyenv", minor)
+	}
+	if patch := b.PythonPatchVersion(); patch != pythonPatchVersions[minor] {
+		return "", fmt.Errorf("The python-build-standalone release Cog uses has Python %s, not %s. Set 'build.python_version' in cog.yaml to %q, or remove 'build.python_install: standalone' to compile it with pyenv", pythonPatchVersions[minor], patch, minor)
+	}
+	return pythonStandaloneRelease, nil
+}
+
+// PythonMinorVersion returns the minor version of python_version, e.g. 3.8
+// for 3.8.1.
+func (b *Build) PythonMinorVersion() string {
+	parts := strings.Split(b.PythonVersion, ".")
+	if len(parts) < 2 {
+		return b.PythonVersion
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// PythonRequirementLines returns the lines of python_requirements, or
+// python_packages. It's only set once the config has been validated.
+func (b *Build) PythonRequirementLines() []string {
+	return b.pythonRequirementsContent
+}
+
 // PythonRequirementsForArch returns a requirements.txt file with all the GPU packages resolved for given OS and architecture.
 func (c *Config) PythonRequirementsForArch(goos string, goarch string) (string, error) {
 	packages := []string{}
@@ -178,13 +1340,24 @@ func (c *Config) PythonRequirementsForArch(goos string, goarch string) (string,
 		}
 	}
 
+	// PyPI's builds of PyTorch are for one version of CUDA, or none, so
+	// torch packages Cog doesn't know the CUDA build of are installed from
+	// PyTorch's index for the base image's CUDA, unless they're already
+	// from a PyTorch index
+	if len(findLinksSet) == 0 && len(extraIndexURLSet) == 0 && c.needsTorchCUDAIndex(goarch) {
+		if indexURL := torchCUDAIndexURL(c.Build.CUDA); indexURL != "" {
+			extraIndexURLSet[indexURL] = true
+		}
+	}
+
 	// Create final requirements.txt output
-	// Put index URLs first
+	// Put index URLs first, sorted, so the requirements are the same every
+	// time
 	lines := []string{}
-	for findLinks := range findLinksSet {
+	for _, findLinks := range sortedKeys(findLinksSet) {
 		lines = append(lines, "--find-links "+findLinks)
 	}
-	for extraIndexURL := range extraIndexURLSet {
+	for _, extraIndexURL := range sortedKeys(extraIndexURLSet) {
 		lines = append(lines, "--extra-index-url "+extraIndexURL)
 	}
 
@@ -194,6 +1367,37 @@ func (c *Config) PythonRequirementsForArch(goos string, goarch string) (string,
 	return strings.Join(lines, "\n"), nil
 }
 
+// torchPackageRe matches the name of a PyTorch package at the start of a
+// requirement
+var torchPackageRe = regexp.MustCompile(`^(torch|torchvision|torchaudio)\s*($|[=<>!~\[;])`)
+
+// needsTorchCUDAIndex returns whether the model installs PyTorch packages for
+// CUDA that Cog doesn't know the CUDA builds of, like unpinned ones, or
+// versions newer than Cog. Packages pinned to a local version like +cu121,
+// or requirements that already name a PyTorch index, are left alone.
+func (c *Config) needsTorchCUDAIndex(goarch string) bool {
+	if !c.Build.GPU || c.Build.IsAMD() || c.Build.CUDA == "" || goarch == "arm64" {
+		return false
+	}
+	found := false
+	for _, line := range c.Build.pythonRequirementsContent {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, "download.pytorch.org") {
+			return false
+		}
+		if !torchPackageRe.MatchString(line) || strings.Contains(line, "+") {
+			continue
+		}
+		if name, version, err := splitPinnedPythonRequirement(line); err == nil && torchCUDAKnown(name, version) {
+			// The compatibility matrix says where its CUDA build is, and
+			// torchaudio comes from the same place
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
 // pythonPackageForArch takes a package==version line and
 // returns a package==version and index URL resolved to the correct GPU package for the given OS and architecture
 func (c *Config) pythonPackageForArch(pkg, goos, goarch string) (actualPackage, findLinks, extraIndexURL string, err error) {
@@ -202,7 +1406,15 @@ func (c *Config) pythonPackageForArch(pkg, goos, goarch string) (actualPackage,
 		// It's not pinned, so just return the line verbatim
 		return pkg, "", "", nil
 	}
-	if name == "tensorflow" {
+	// PyTorch only publishes CPU wheels of torch for aarch64, so they're
+	// installed for arm64 whether or not the model uses a GPU
+	gpuTorch := c.Build.GPU && goarch != "arm64"
+	if c.Build.GPU && goarch == "arm64" && (name == "torch" || name == "torchvision") {
+		console.Warnf("PyTorch doesn't publish CUDA wheels of %s for arm64, so the CPU wheel of %s==%s is installed. For CUDA on Jetson, set 'build.base_image' to an NVIDIA L4T PyTorch image", name, name, version)
+	}
+	if c.Build.IsAMD() {
+		name, version, extraIndexURL = c.rocmPythonPackage(name, version)
+	} else if name == "tensorflow" {
 		if c.Build.GPU {
 			name, version, err = tfGPUPackage(version, c.Build.CUDA)
 			if err != nil {
@@ -211,7 +1423,7 @@ func (c *Config) pythonPackageForArch(pkg, goos, goarch string) (actualPackage,
 		}
 		// There is no CPU case for tensorflow because the default package is just the CPU package, so no transformation of version is needed
 	} else if name == "torch" {
-		if c.Build.GPU {
+		if gpuTorch {
 			name, version, findLinks, extraIndexURL, err = torchGPUPackage(version, c.Build.CUDA)
 			if err != nil {
 				return "", "", "", err
@@ -223,7 +1435,7 @@ func (c *Config) pythonPackageForArch(pkg, goos, goarch string) (actualPackage,
 			}
 		}
 	} else if name == "torchvision" {
-		if c.Build.GPU {
+		if gpuTorch {
 			name, version, findLinks, extraIndexURL, err = torchvisionGPUPackage(version, c.Build.CUDA)
 			if err != nil {
 				return "", "", "", err
@@ -243,6 +1455,12 @@ func (c *Config) pythonPackageForArch(pkg, goos, goarch string) (actualPackage,
 }
 
 func (c *Config) validateAndCompleteCUDA() error {
+	if c.Build.CUDA != "" && c.Build.cudaSource == "" {
+		c.Build.cudaSource = "it's set in build.cuda"
+	}
+	if c.Build.CuDNN != "" && c.Build.cudnnSource == "" {
+		c.Build.cudnnSource = "it's set in build.cudnn"
+	}
 	if c.Build.CUDA != "" && c.Build.CuDNN != "" {
 		compatibleCuDNNs := compatibleCuDNNsForCUDA(c.Build.CUDA)
 		if !sliceContains(compatibleCuDNNs, c.Build.CuDNN) {
@@ -269,6 +1487,7 @@ Compatible CuDNN versions are: %s`, c.Build.CUDA, c.Build.CuDNN, strings.Join(co
 			}
 			console.Debugf("Setting CUDA to version %s from Tensorflow version", tfCUDA)
 			c.Build.CUDA = tfCUDA
+			c.Build.cudaSource = fmt.Sprintf("tensorflow==%s needs it", tfVersion)
 		} else if tfCUDA != c.Build.CUDA {
 			// TODO: can we suggest a CUDA version known to be compatible?
 			console.Warnf("Cog doesn't know if CUDA %s is compatible with Tensorflow %s. This might cause CUDA problems.", c.Build.CUDA, tfVersion)
@@ -276,11 +1495,13 @@ Compatible CuDNN versions are: %s`, c.Build.CUDA, c.Build.CuDNN, strings.Join(co
 		if c.Build.CuDNN == "" && tfCuDNN != "" {
 			console.Debugf("Setting CuDNN to version %s from Tensorflow version", tfCuDNN)
 			c.Build.CuDNN = tfCuDNN
+			c.Build.cudnnSource = fmt.Sprintf("tensorflow==%s needs it", tfVersion)
 		} else if c.Build.CuDNN == "" {
 			c.Build.CuDNN, err = latestCuDNNForCUDA(c.Build.CUDA)
 			if err != nil {
 				return err
 			}
+			c.Build.cudnnSource = fmt.Sprintf("it's the latest for CUDA %s", c.Build.CUDA)
 			console.Debugf("Setting CuDNN to version %s", c.Build.CUDA)
 		} else if tfCuDNN != c.Build.CuDNN {
 			console.Warnf("Cog doesn't know if cuDNN %s is compatible with Tensorflow %s. This might cause CUDA problems.", c.Build.CuDNN, tfVersion)
@@ -299,6 +1520,7 @@ Compatible cuDNN version is: %s`,
 				return err
 			}
 			console.Debugf("Setting CUDA to version %s from Torch version", c.Build.CUDA)
+			c.Build.cudaSource = fmt.Sprintf("it's the latest CUDA torch==%s is built for", torchVersion)
 		} else if !slices.ContainsString(torchCUDAs, c.Build.CUDA) {
 			// TODO: can we suggest a CUDA version known to be compatible?
 			console.Warnf("Cog doesn't know if CUDA %s is compatible with PyTorch %s. This might cause CUDA problems.", c.Build.CUDA, torchVersion)
@@ -309,11 +1531,13 @@ Compatible cuDNN version is: %s`,
 			if err != nil {
 				return err
 			}
+			c.Build.cudnnSource = fmt.Sprintf("it's the latest for CUDA %s", c.Build.CUDA)
 			console.Debugf("Setting CuDNN to version %s", c.Build.CUDA)
 		}
 	} else {
 		if c.Build.CUDA == "" {
 			c.Build.CUDA = defaultCUDA()
+			c.Build.cudaSource = "it's the default, because no packages need a particular version"
 			console.Debugf("Setting CUDA to version %s", c.Build.CUDA)
 		}
 		if c.Build.CuDNN == "" {
@@ -321,6 +1545,7 @@ Compatible cuDNN version is: %s`,
 			if err != nil {
 				return err
 			}
+			c.Build.cudnnSource = fmt.Sprintf("it's the latest for CUDA %s", c.Build.CUDA)
 			console.Debugf("Setting CuDNN to version %s", c.Build.CUDA)
 		}
 	}
@@ -339,6 +1564,15 @@ func splitPinnedPythonRequirement(requirement string) (name string, version stri
 	return match[1], match[2], nil
 }
 
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func sliceContains(slice []string, s string) bool {
 	for _, el := range slice {
 		if el == s {
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -53,6 +55,86 @@ foo==1.0.0`
 	require.Equal(t, expected, requirements)
 }
 
+func TestPythonRequirementsResolvesTorch2CUDA(t *testing.T) {
+	tmpDir := t.TempDir()
+	err := os.WriteFile(path.Join(tmpDir, "requirements.txt"), []byte(`torch==2.3.1
+torchvision==0.18.1
+foo==1.0.0`), 0o644)
+	require.NoError(t, err)
+
+	config := &Config{
+		Build: &Build{
+			GPU:                true,
+			PythonVersion:      "3.11",
+			PythonRequirements: "requirements.txt",
+		},
+	}
+	err = config.ValidateAndComplete(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, "12.1.1", config.Build.CUDA)
+	require.Equal(t, "8", config.Build.CuDNN)
+	image, err := config.CUDABaseImageTag()
+	require.NoError(t, err)
+	require.Equal(t, "nvidia/cuda:12.1.1-cudnn8-devel-ubuntu22.04", image)
+
+	requirements, err := config.PythonRequirementsForArch("", "")
+	require.NoError(t, err)
+	expected := `--extra-index-url https://download.pytorch.org/whl/cu121
+torch==2.3.1+cu121
+torchvision==0.18.1+cu121
+foo==1.0.0`
+	require.Equal(t, expected, requirements)
+}
+
+func TestPythonRequirementsAddsTorchCUDAIndex(t *testing.T) {
+	requirementsFor := func(gpu bool, packages []string, goarch string) string {
+		config := &Config{
+			Build: &Build{
+				GPU:            gpu,
+				PythonVersion:  "3.11",
+				PythonPackages: packages,
+			},
+		}
+		if gpu {
+			config.Build.CUDA = "12.2"
+		}
+		require.NoError(t, config.ValidateAndComplete(""))
+		requirements, err := config.PythonRequirementsForArch("linux", goarch)
+		require.NoError(t, err)
+		return requirements
+	}
+
+	// There are no PyTorch wheels for CUDA 12.2 that Cog knows of, so it's
+	// the newest before it
+	require.Equal(t, `--extra-index-url https://download.pytorch.org/whl/cu121
+torch
+torchaudio>=2.0
+foo==1.0.0`, requirementsFor(true, []string{"torch", "torchaudio>=2.0", "foo==1.0.0"}, "amd64"))
+
+	// PyTorch only publishes CPU wheels for arm64
+	require.Equal(t, "torch", requirementsFor(true, []string{"torch"}, "arm64"))
+	require.Equal(t, "torch", requirementsFor(false, []string{"torch"}, "amd64"))
+
+	// A PyTorch index that's already there is left alone
+	require.Equal(t, "--extra-index-url https://download.pytorch.org/whl/cu118\ntorch", requirementsFor(true, []string{"--extra-index-url https://download.pytorch.org/whl/cu118", "torch"}, "amd64"))
+}
+
+func TestCUDAFromTensorflow2(t *testing.T) {
+	config := &Config{
+		Build: &Build{
+			GPU:            true,
+			PythonVersion:  "3.11",
+			PythonPackages: []string{"tensorflow==2.15.0"},
+		},
+	}
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "12.2", config.Build.CUDA)
+	require.Equal(t, "8", config.Build.CuDNN)
+	image, err := config.CUDABaseImageTag()
+	require.NoError(t, err)
+	require.Equal(t, "nvidia/cuda:12.2.0-cudnn8-devel-ubuntu22.04", image)
+}
+
 func TestPythonRequirementsResolvesPythonPackagesAndCudaVersionsWithExtraIndexURL(t *testing.T) {
 	tmpDir := t.TempDir()
 	err := os.WriteFile(path.Join(tmpDir, "requirements.txt"), []byte(`torch==1.12.1
@@ -370,3 +452,849 @@ func TestBlankBuild(t *testing.T) {
 	require.Equal(t, false, config.Build.GPU)
 
 }
+
+func TestWeightsEncryption(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.8"
+weights:
+  encryption:
+    files:
+      - weights/model.bin.enc
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(t.TempDir()))
+	require.Equal(t, DefaultWeightsKeyEnv, config.Weights.Encryption.KeyEnv)
+
+	config.Weights.Encryption.Files = []string{"weights/model.bin"}
+	err = config.ValidateAndComplete(t.TempDir())
+	require.ErrorContains(t, err, "must end in .enc")
+}
+
+func TestUBI9(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  distro: ubi9
+  python_version: "3.11.4"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Build.PythonVersion = "3.10"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "not available on UBI 9")
+
+	config.Build.PythonVersion = "3.11"
+	config.Build.GPU = true
+	require.ErrorContains(t, config.ValidateAndComplete(""), "does not support GPUs")
+}
+
+func TestRunItems(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  install_retries: 2
+  run:
+    - echo hello
+    - command: curl -fsSL https://example.com/weights.tar | tar -x
+      retries: 3
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, 2, config.Build.InstallRetries)
+	require.Equal(t, []RunItem{
+		{Command: "echo hello"},
+		{Command: "curl -fsSL https://example.com/weights.tar | tar -x", Retries: 3},
+	}, config.Build.Run)
+
+	// Commands without options are stored in images as strings
+	data, err := json.Marshal(config.Build.Run)
+	require.NoError(t, err)
+	require.JSONEq(t, `["echo hello", {"command": "curl -fsSL https://example.com/weights.tar | tar -x", "retries": 3}]`, string(data))
+	run := []RunItem{}
+	require.NoError(t, json.Unmarshal(data, &run))
+	require.Equal(t, config.Build.Run, run)
+
+	_, err = FromYAML([]byte(`
+build:
+  run:
+    - command: echo hello
+      retries: -1
+`))
+	require.Error(t, err)
+}
+
+func TestRunItemRequiresGPUJSON(t *testing.T) {
+	run := []RunItem{{Command: "python download.py", RequiresGPU: true}}
+	data, err := json.Marshal(run)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"command": "python download.py", "requires_gpu": true}]`, string(data))
+	unmarshalled := []RunItem{}
+	require.NoError(t, json.Unmarshal(data, &unmarshalled))
+	require.Equal(t, run, unmarshalled)
+}
+
+func TestStepTimeoutValidation(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  step_timeout: 30m
+  run:
+    - command: make
+      timeout: 2h
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, 30*time.Minute, config.Build.StepTimeoutDuration())
+	require.Equal(t, 2*time.Hour, config.Build.Run[0].TimeoutDuration())
+
+	config.Build.StepTimeout = "30"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'build.step_timeout' in cog.yaml must be a duration")
+
+	config.Build.StepTimeout = ""
+	config.Build.Run[0].Timeout = "-1h"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "The timeout of 'make'")
+}
+
+func TestBaseImageValidation(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  gpu: true
+  base_image: registry.example.com/hardened/cuda:12.1
+  base_image_provides: [python, cuda]
+  python_version: "3.11"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.True(t, config.Build.BaseImageHas(ProvidesPython))
+
+	config, err = FromYAML([]byte(`
+build:
+  gpu: true
+  base_image: registry.example.com/hardened/cuda:12.1
+  base_image_provides: [python]
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "Add 'cuda' to 'build.base_image_provides'")
+
+	config, err = FromYAML([]byte(`
+build:
+  base_image_provides: [python]
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "can only be set with 'build.base_image'")
+
+	_, err = FromYAML([]byte(`
+build:
+  base_image: debian:bookworm
+  base_image_provides: [rust]
+`))
+	require.Error(t, err)
+}
+
+func TestAptMirrorValidation(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  apt_mirror: "https://mirror.example.com/"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Build.AptMirror = "mirror.example.com"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must be an http:// or https:// URL")
+
+	config.Build.AptMirror = "https://mirror.example.com"
+	config.Build.Distro = DistroUBI9
+	config.Build.PythonVersion = "3.11"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "doesn't use apt")
+}
+
+func TestSourceOwnerValidation(t *testing.T) {
+	_, err := FromYAML([]byte(`
+build:
+  source_owner: "cog:cog"
+`))
+	require.NoError(t, err)
+
+	_, err = FromYAML([]byte(`
+build:
+  source_owner: "cog cog"
+`))
+	require.Error(t, err)
+}
+
+func TestWarmup(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.8"
+warmup:
+  - input:
+      prompt: "a photo of a cat"
+      steps: 1
+`))
+	require.NoError(t, err)
+	require.Equal(t, []Warmup{{Input: map[string]interface{}{"prompt": "a photo of a cat", "steps": 1}}}, config.Warmup)
+
+	_, err = FromYAML([]byte(`
+build:
+  python_version: "3.8"
+warmup:
+  - prompt: "a photo of a cat"
+`))
+	require.Error(t, err)
+}
+
+func TestExamples(t *testing.T) {
+	projectDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(projectDir, "examples"), 0o755))
+	require.NoError(t, os.WriteFile(path.Join(projectDir, "examples", "cat.jpg"), []byte("cat"), 0o644))
+
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.8"
+examples:
+  default:
+    input:
+      image: "@examples/cat.jpg"
+      scale: 2
+  mask:
+    input:
+      image: "@./examples/cat.jpg"
+      mask: "@examples/cat.jpg"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(projectDir))
+	require.Equal(t, "2", config.Examples["default"].Input["scale"])
+	require.Equal(t, []string{"examples/cat.jpg"}, config.ExampleAssets())
+
+	config.Examples["default"].Input["image"] = "@examples/dog.jpg"
+	require.ErrorContains(t, config.ValidateAndComplete(projectDir), "does not exist")
+
+	config.Examples["default"].Input["image"] = "@../cat.jpg"
+	require.ErrorContains(t, config.ValidateAndComplete(projectDir), "inside the project directory")
+}
+
+func TestServingPriorities(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+serving:
+  max_queue_size: 8
+  priorities: ["interactive", "batch"]
+  default_priority: batch
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, []string{"interactive", "batch"}, config.Serving.Priorities)
+
+	config, err = FromYAML([]byte(`
+build:
+  python_version: "3.10"
+serving:
+  priorities: ["interactive", "batch"]
+  default_priority: urgent
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "serving.default_priority")
+}
+
+func TestResources(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+resources:
+  cpus: 3.5
+  memory: 16GiB
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, 3.5, config.Resources.CPUs)
+	require.Equal(t, int64(16*1024*1024*1024), config.Resources.MemoryBytes())
+
+	config, err = FromYAML([]byte(`
+build:
+  python_version: "3.10"
+resources:
+  memory: lots
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "resources.memory")
+
+	config, err = FromYAML([]byte(`
+build:
+  python_version: "3.10"
+resources:
+  gpu_memory: lots
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "resources.gpu_memory")
+}
+
+func TestModels(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+models:
+  base:
+    weights: weights/base.safetensors
+  anime:
+    weights: https://example.com/anime.safetensors
+default_model: base
+serving:
+  max_loaded_models: 1
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "https://example.com/anime.safetensors", config.Models["anime"].Weights)
+	require.Equal(t, 1, config.Serving.MaxLoadedModels)
+
+	config.DefaultModel = "watercolor"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "default_model")
+
+	config.DefaultModel = ""
+	config.Models["base"].Weights = "../weights/base.safetensors"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "inside the project directory")
+
+	_, err = FromYAML([]byte(`
+build:
+  python_version: "3.10"
+models:
+  base: {}
+`))
+	require.Error(t, err)
+}
+
+func TestSharedWeights(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+weights:
+  shared:
+    path: weights
+    host_path: /var/lib/cog/weights/sdxl
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Weights.Shared.HostPath = "weights/sdxl"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "absolute path")
+
+	config.Weights.Shared.HostPath = "/var/lib/cog/weights/sdxl"
+	config.Weights.Shared.Path = "../weights"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "inside the project directory")
+
+	config.Weights.Shared.Path = "weights"
+	config.Weights.Encryption = &WeightsEncryption{Files: []string{"weights/model.safetensors.enc"}}
+	require.ErrorContains(t, config.ValidateAndComplete(""), "read-only")
+}
+
+func TestCompressionValidation(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  compression: zstd
+  compression_level: 19
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Build.Compression = "gzip"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must be from 1 to 9 for gzip")
+
+	config.Build.Compression = ""
+	require.ErrorContains(t, config.ValidateAndComplete(""), "can only be set with 'build.compression'")
+
+	config.Build.Compression = "lz4"
+	config.Build.CompressionLevel = 0
+	require.ErrorContains(t, config.ValidateAndComplete(""), "build.compression must be one of the following")
+}
+
+func TestWeightsSharding(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "model.safetensors"), []byte("x"), 0o644))
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+weights:
+  sharding:
+    files:
+      - model.safetensors
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(dir))
+	require.Equal(t, DefaultWeightsShards, config.Weights.Sharding.Shards)
+
+	config.Weights.Sharding.Shards = 100
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "less than or equal to 64")
+
+	config.Weights.Sharding.Shards = 4
+	config.Weights.Sharding.Files = []string{"missing.safetensors"}
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "doesn't exist")
+
+	config.Weights.Sharding.Files = []string{"../model.safetensors"}
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "inside the project directory")
+}
+
+func TestWeightsPaths(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "checkpoints"), 0o755))
+	require.NoError(t, os.WriteFile(path.Join(dir, "checkpoints", "model.safetensors"), []byte("x"), 0o644))
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+weights:
+  paths:
+    - checkpoints
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(dir))
+
+	config.Weights.Paths = []string{"missing"}
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "doesn't exist")
+
+	config.Weights.Paths = []string{"../checkpoints"}
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "inside the project directory")
+
+	config.Weights.Paths = []string{"checkpoints"}
+	config.Weights.Sharding = &WeightsSharding{Files: []string{"checkpoints/model.safetensors"}}
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "can't also be in 'weights.paths'")
+}
+
+func TestWeightsValidate(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+weights:
+  validate:
+    - path: weights/model.safetensors
+      manifest: weights/manifest.json
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(t.TempDir()))
+	require.Equal(t, []WeightsCheck{{Path: "weights/model.safetensors", Manifest: "weights/manifest.json"}}, config.Weights.Validate)
+
+	config.Weights.Validate[0].Manifest = "../manifest.json"
+	require.ErrorContains(t, config.ValidateAndComplete(t.TempDir()), "inside the project directory")
+}
+
+func TestRunAsUser(t *testing.T) {
+	for _, user := range []string{"cog", "1000", "model-user"} {
+		config := &Config{Build: &Build{PythonVersion: "3.10", RunAsUser: user}}
+		require.NoError(t, config.ValidateAndComplete(""), user)
+	}
+	for user, message := range map[string]string{
+		"root":       "must be a user other than root",
+		"0":          "must be a user other than root",
+		"cog:cog":    "must be a user name or a numeric UID",
+		"Model User": "must be a user name or a numeric UID",
+	} {
+		config := &Config{Build: &Build{PythonVersion: "3.10", RunAsUser: user}}
+		require.ErrorContains(t, config.ValidateAndComplete(""), message, user)
+	}
+}
+
+func TestFirstBoot(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+first_boot:
+  cache_dir: /mnt/cache
+  steps:
+    - run: python compile_kernels.py
+    - download: https://example.com/model.safetensors
+      dest: weights/model.safetensors
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, []FirstBootStep{
+		{Run: "python compile_kernels.py"},
+		{Download: "https://example.com/model.safetensors", Dest: "weights/model.safetensors"},
+	}, config.FirstBoot.Steps)
+
+	config.FirstBoot.Steps[1].Dest = ""
+	require.ErrorContains(t, config.ValidateAndComplete(""), "needs a 'dest'")
+
+	config.FirstBoot.Steps[1] = FirstBootStep{Download: "s3://bucket/model.safetensors", Dest: "weights/model.safetensors"}
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must be an http:// or https:// URL")
+
+	config.FirstBoot.Steps[1] = FirstBootStep{Run: "true", Download: "https://example.com/model.safetensors"}
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must have one of 'run' or 'download'")
+}
+
+func TestPoetry(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "pyproject.toml"), []byte(`
+[tool.poetry]
+name = "model"
+
+[tool.poetry.dependencies]
+python = "^3.10"
+torch = "1.12.1"
+`), 0o644))
+
+	config := &Config{Build: &Build{PythonVersion: "3.10", GPU: true}}
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "Run 'poetry lock' to create it")
+
+	require.NoError(t, os.WriteFile(path.Join(dir, "poetry.lock"), []byte(`
+[[package]]
+name = "torch"
+version = "1.12.1"
+
+[[package]]
+name = "numpy"
+version = "1.25.2"
+`), 0o644))
+	config = &Config{Build: &Build{PythonVersion: "3.10", GPU: true}}
+	require.NoError(t, config.ValidateAndComplete(dir))
+	require.True(t, config.Build.Poetry)
+	require.Equal(t, []string{"torch==1.12.1", "numpy==1.25.2"}, config.Build.pythonRequirementsContent)
+	// The CUDA version is worked out from the version of torch in poetry.lock
+	require.Equal(t, "11.6.2", config.Build.CUDA)
+
+	// Python packages in cog.yaml are used instead
+	config = &Config{Build: &Build{PythonVersion: "3.10", PythonPackages: []string{"numpy==1.25.2"}}}
+	require.NoError(t, config.ValidateAndComplete(dir))
+	require.False(t, config.Build.Poetry)
+
+	config = &Config{Build: &Build{PythonVersion: "3.10", Poetry: true, PythonPackages: []string{"numpy==1.25.2"}}}
+	require.ErrorContains(t, config.ValidateAndComplete(dir), "Only one of poetry or python_requirements")
+}
+
+func TestServingTmpDirQuota(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+serving:
+  tmp_dir_quota: 10GB
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Serving.TmpDirQuota = "lots"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'serving.tmp_dir_quota' in cog.yaml must be a size")
+}
+
+func TestBuildDownload(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+  download:
+    - url: https://example.com/model.safetensors
+      dest: weights/model.safetensors
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Build.Download[0].Dest = "/models/model.safetensors"
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Build.Download[0].Dest = "../model.safetensors"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must be inside the project directory")
+
+	config.Build.Download[0].Dest = "weights/model.safetensors"
+	config.Build.Download[0].URL = "s3://bucket/model.safetensors"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must be an http:// or https:// URL")
+
+	config.Build.Download[0].URL = "https://example.com/model.safetensors"
+	config.Build.Download[0].SHA256 = "abc"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must be 64 lowercase hex digits")
+}
+
+func TestDownloadProjectPath(t *testing.T) {
+	require.Equal(t, "weights/model.safetensors", Download{Dest: "weights/model.safetensors"}.ProjectPath())
+	require.Equal(t, "weights/model.safetensors", Download{Dest: "./weights//model.safetensors"}.ProjectPath())
+	require.Equal(t, "weights/model.safetensors", Download{Dest: "/src/weights/model.safetensors"}.ProjectPath())
+	require.Equal(t, "", Download{Dest: "/models/model.safetensors"}.ProjectPath())
+}
+
+func TestPrefetch(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+prefetch:
+  - url: https://example.com/tokenizer.json
+    dest: tokenizer/tokenizer.json
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Prefetch[0].URL = "s3://bucket/tokenizer.json"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "s3://bucket/tokenizer.json in 'prefetch' in cog.yaml must be an http:// or https:// URL")
+
+	config.Prefetch[0].URL = "https://example.com/tokenizer.json"
+	config.Prefetch[0].Dest = ""
+	require.ErrorContains(t, config.ValidateAndComplete(""), "needs a 'dest'")
+}
+
+func TestBuildWheelhouse(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+  wheelhouse: ./wheels
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Build.Wheelhouse = "../wheels"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'build.wheelhouse' in cog.yaml must be a directory inside the project directory")
+
+	config.Build.Wheelhouse = "/wheels"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'build.wheelhouse' in cog.yaml must be a directory inside the project directory")
+}
+
+func TestVersionSources(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  gpu: true
+  cuda: "11.8"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "it's the default, because build.python_version isn't set", config.Build.PythonVersionSource())
+	require.Equal(t, "it's set in build.cuda", config.Build.CUDASource())
+	require.Equal(t, "it's the latest for CUDA 11.8", config.Build.CuDNNSource())
+
+	config, err = FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  preset: diffusers-cuda12
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "it's set in build.python_version", config.Build.PythonVersionSource())
+	require.Equal(t, "build.preset is diffusers-cuda12", config.Build.CUDASource())
+}
+
+func TestPythonVersion(t *testing.T) {
+	config, err := FromYAML([]byte(`build:
+  python_version: "3.11"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "3.11", config.Build.PythonVersion)
+	require.Equal(t, "3.11.10", config.Build.PythonPatchVersion())
+
+	config, err = FromYAML([]byte(`build:
+  python_version: "3.11.4"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "3.11.4", config.Build.PythonPatchVersion())
+
+	config, err = FromYAML([]byte(`build:
+  python_version: "3.5"
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "Cog doesn't support Python 3.5. Set 'build.python_version' in cog.yaml to one of: 3.13, 3.12, 3.11, 3.10, 3.9, 3.8, 3.7.")
+
+	config, err = FromYAML([]byte(`build:
+  python_version: "3.11.x"
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'build.python_version' in cog.yaml must be a version of Python 3")
+
+	// A base image with Python can have any version of it
+	config, err = FromYAML([]byte(`build:
+  python_version: "3.5"
+  base_image: registry.example.com/python:3.5
+  base_image_provides:
+    - python
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+}
+
+func TestServingMinFreeDisk(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+serving:
+  min_free_disk: 5GB
+  evict_dirs:
+    - /root/.cache/huggingface
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	config.Serving.EvictDirs = []string{"cache"}
+	require.ErrorContains(t, config.ValidateAndComplete(""), "must be an absolute path")
+
+	config.Serving.EvictDirs = []string{"/cache"}
+	config.Serving.MinFreeDisk = ""
+	require.ErrorContains(t, config.ValidateAndComplete(""), "can only be set with 'serving.min_free_disk'")
+
+	config.Serving.MinFreeDisk = "lots"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'serving.min_free_disk' in cog.yaml must be a size")
+}
+
+func TestGPUVendorAMD(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  gpu: true
+  gpu_vendor: amd
+  python_version: "3.11"
+  python_packages:
+    - tensorflow==2.13.0
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "5.7", config.Build.ROCm)
+	require.Equal(t, "", config.Build.CUDA)
+
+	requirements, err := config.PythonRequirementsForArch("", "")
+	require.NoError(t, err)
+	require.Equal(t, "tensorflow-rocm==2.13.0.570", requirements)
+
+	config.Build.ROCm = "4.0"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "ROCm 4.0 is not supported by Cog")
+
+	config.Build.ROCm = ""
+	config.Build.CUDA = "12.1"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "can't be set with 'gpu_vendor: amd'")
+
+	config.Build.CUDA = ""
+	config.Build.GPU = false
+	require.ErrorContains(t, config.ValidateAndComplete(""), "needs 'gpu: true'")
+
+	config.Build.GPU = true
+	config.Build.GPUVendor = "intel"
+	require.ErrorContains(t, config.ValidateAndComplete(""), "build.gpu_vendor must be one of the following")
+}
+
+func TestEnvironment(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.11"
+environment:
+  HF_HOME: /src/.cache
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, map[string]string{"HF_HOME": "/src/.cache"}, config.Environment)
+
+	for yaml, message := range map[string]string{
+		"PYTHONUNBUFFERED: \"0\"": "PYTHONUNBUFFERED in 'environment' in cog.yaml is set by Cog",
+		"PATH: /opt/bin":          "PATH in 'environment' in cog.yaml is set by Cog",
+		"1NAME: x":                "1NAME in 'environment' in cog.yaml must be a name",
+		"MY-NAME: x":              "MY-NAME in 'environment' in cog.yaml must be a name",
+		"NAME: \"a\\nb\"":         "can't have a newline",
+	} {
+		config, err := FromYAML([]byte("build:\n  python_version: \"3.11\"\nenvironment:\n  " + yaml + "\n"))
+		require.NoError(t, err)
+		require.ErrorContains(t, config.ValidateAndComplete(""), message, yaml)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.11"
+labels:
+  org.opencontainers.image.licenses: Apache-2.0
+  com.example/team: vision
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, "vision", config.Labels["com.example/team"])
+
+	for yaml, message := range map[string]string{
+		"run.cog.version: \"1.0\"": "starts with run.cog., which is reserved",
+		"org.cogmodel.foo: bar":    "starts with org.cogmodel., which is reserved",
+		"\"team name\": vision":    "must be a key of letters",
+		"team: \"a\\nb\"":          "can't have a newline",
+	} {
+		config, err := FromYAML([]byte("build:\n  python_version: \"3.11\"\nlabels:\n  " + yaml + "\n"))
+		require.NoError(t, err)
+		require.ErrorContains(t, config.ValidateAndComplete(""), message, yaml)
+	}
+}
+
+func TestServingPort(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.11"
+`))
+	require.NoError(t, err)
+	require.Equal(t, 5000, config.ServingPort())
+	require.Equal(t, []string{"python", "-m", "cog.server.http"}, config.ServerCommand())
+
+	config, err = FromYAML([]byte(`
+build:
+  python_version: "3.11"
+serving:
+  port: 8080
+`))
+	require.NoError(t, err)
+	require.Equal(t, 8080, config.ServingPort())
+	require.Equal(t, []string{"python", "-m", "cog.server.http", "--port", "8080"}, config.ServerCommand())
+
+	_, err = FromYAML([]byte(`
+build:
+  python_version: "3.11"
+serving:
+  port: 70000
+`))
+	require.Error(t, err)
+}
+
+func TestPreset(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  preset: whisper-cuda12
+  system_packages:
+    - git
+  python_packages:
+    - openai_whisper==20240930
+    - numpy==1.26.4
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.True(t, config.Build.GPU)
+	require.Equal(t, "12.1", config.Build.CUDA)
+	require.Equal(t, []string{"git", "ffmpeg"}, config.Build.SystemPackages)
+	// The model's own version of a package takes precedence
+	require.Equal(t, []string{"torch==2.3.1", "torchaudio==2.3.1", "openai_whisper==20240930", "numpy==1.26.4"}, config.Build.PythonRequirementLines())
+
+	requirements, err := config.PythonRequirementsForArch("linux", "amd64")
+	require.NoError(t, err)
+	require.Contains(t, requirements, "torch==2.3.1+cu121")
+}
+
+func TestPresetErrors(t *testing.T) {
+	for yaml, message := range map[string]string{
+		"preset: pytorch": "isn't a preset. It must be one of: diffusers-cuda11",
+		"preset: diffusers-cuda12\n  cuda: \"11.8\"": "is for CUDA 12.1, but 'build.cuda' is 11.8",
+		"preset: opencv-cpu\n  poetry: true":         "can't be used with Poetry",
+	} {
+		config, err := FromYAML([]byte("build:\n  python_version: \"3.11\"\n  " + yaml + "\n"))
+		require.NoError(t, err)
+		require.ErrorContains(t, config.ValidateAndComplete(""), message, yaml)
+	}
+}
+
+func TestServingHealthcheck(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.11"
+`))
+	require.NoError(t, err)
+	require.Equal(t, &Healthcheck{Interval: "30s", Timeout: "10s", StartPeriod: "10m", Retries: 3}, config.ServingHealthcheck())
+
+	config, err = FromYAML([]byte(`
+build:
+  python_version: "3.11"
+serving:
+  healthcheck:
+    timeout: 3s
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.Equal(t, &Healthcheck{Interval: "30s", Timeout: "3s", StartPeriod: "10m", Retries: 3}, config.ServingHealthcheck())
+
+	config, err = FromYAML([]byte(`
+build:
+  python_version: "3.11"
+serving:
+  healthcheck:
+    interval: often
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'serving.healthcheck.interval' in cog.yaml must be a duration like 30s")
+}
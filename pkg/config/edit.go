@@ -0,0 +1,214 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Values that YAML would read as floats, which would mangle versions like
+// 3.10 (which becomes 3.1)
+var floatLikeRegexp = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+
+// GetValue returns the value at key, a dot-separated path like
+// build.python_version, in the YAML document contents. Lists and mappings
+// are returned as YAML.
+func GetValue(contents []byte, key string) (string, error) {
+	doc, err := parseDocument(contents)
+	if err != nil {
+		return "", err
+	}
+	node := doc
+	for _, part := range strings.Split(key, ".") {
+		node = mappingValue(node, part)
+		if node == nil {
+			return "", fmt.Errorf("%s is not set", key)
+		}
+	}
+	if node.Kind == yamlv3.ScalarNode {
+		return node.Value, nil
+	}
+	out, err := encodeYAML(node)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// SetValue sets key, a dot-separated path like build.python_version, to
+// value in the YAML document contents. value is parsed as YAML, so it can
+// be a list or mapping. Comments and the order of keys are kept.
+func SetValue(contents []byte, key string, value string) ([]byte, error) {
+	doc, err := parseDocument(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	valueNode, err := parseValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(key, ".")
+	node := doc
+	for i, part := range parts {
+		if node.Kind != yamlv3.MappingNode {
+			return nil, fmt.Errorf("Can't set %s, because %s is not a mapping", key, strings.Join(parts[:i], "."))
+		}
+		last := i == len(parts)-1
+		child := mappingValue(node, part)
+		if child == nil {
+			child = &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+			if last {
+				child = valueNode
+			}
+			node.Content = append(node.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: part}, child)
+		} else if last {
+			// Keep comments attached to the old value
+			valueNode.HeadComment = child.HeadComment
+			valueNode.LineComment = child.LineComment
+			valueNode.FootComment = child.FootComment
+			*child = *valueNode
+		} else if child.Kind == yamlv3.ScalarNode && child.Tag == "!!null" {
+			// e.g. "build:" with nothing under it
+			*child = yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+		}
+		node = child
+	}
+
+	root := &yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{doc}}
+	return encodeYAML(root)
+}
+
+// MergeYAML merges the YAML document fragment into contents, like a
+// cog.yaml fragment from a template. Mappings are merged key by key, lists
+// get the items in fragment that aren't already in contents, and any other
+// value in fragment replaces the one in contents. Comments and the order of
+// keys in contents are kept.
+func MergeYAML(contents []byte, fragment []byte) ([]byte, error) {
+	doc, err := parseDocument(contents)
+	if err != nil {
+		return nil, err
+	}
+	fragmentDoc, err := parseDocument(fragment)
+	if err != nil {
+		return nil, err
+	}
+	mergeNodes(doc, fragmentDoc)
+
+	root := &yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{doc}}
+	return encodeYAML(root)
+}
+
+func mergeNodes(node *yamlv3.Node, fragment *yamlv3.Node) {
+	switch {
+	case node.Kind == yamlv3.MappingNode && fragment.Kind == yamlv3.MappingNode:
+		for i := 0; i+1 < len(fragment.Content); i += 2 {
+			key, value := fragment.Content[i], fragment.Content[i+1]
+			if child := mappingValue(node, key.Value); child != nil {
+				mergeNodes(child, value)
+			} else {
+				node.Content = append(node.Content, key, value)
+			}
+		}
+	case node.Kind == yamlv3.SequenceNode && fragment.Kind == yamlv3.SequenceNode:
+		for _, item := range fragment.Content {
+			if !containsNode(node.Content, item) {
+				node.Content = append(node.Content, item)
+			}
+		}
+	default:
+		fragment.HeadComment = node.HeadComment
+		fragment.LineComment = node.LineComment
+		fragment.FootComment = node.FootComment
+		*node = *fragment
+	}
+}
+
+func containsNode(nodes []*yamlv3.Node, node *yamlv3.Node) bool {
+	for _, n := range nodes {
+		if n.Kind == yamlv3.ScalarNode && node.Kind == yamlv3.ScalarNode && n.Value == node.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDocument(contents []byte) (*yamlv3.Node, error) {
+	root := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(contents, root); err != nil {
+		return nil, fmt.Errorf("Failed to parse config yaml: %w", err)
+	}
+	if len(root.Content) == 0 {
+		// Empty file
+		return &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}, nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yamlv3.MappingNode {
+		return nil, fmt.Errorf("Failed to parse config yaml: expected a mapping at the top level")
+	}
+	// Keep comments at the top of the file
+	doc.HeadComment = strings.TrimSpace(root.HeadComment + "\n" + doc.HeadComment)
+	return doc, nil
+}
+
+func parseValue(value string) (*yamlv3.Node, error) {
+	root := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal([]byte(value), root); err != nil {
+		return nil, fmt.Errorf("Failed to parse value %q as YAML: %w", value, err)
+	}
+	if len(root.Content) == 0 {
+		return &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+	node := root.Content[0]
+	if node.Kind == yamlv3.ScalarNode && node.Style == 0 && floatLikeRegexp.MatchString(node.Value) && strings.Contains(node.Value, ".") {
+		node.Tag = "!!str"
+		node.Style = yamlv3.DoubleQuotedStyle
+	}
+	return node, nil
+}
+
+// mappingValue returns the value of key in the mapping node, or nil.
+func mappingValue(node *yamlv3.Node, key string) *yamlv3.Node {
+	_, value := mappingEntry(node, key)
+	return value
+}
+
+// mappingEntry returns the key and value nodes of key in the mapping node,
+// or nils.
+func mappingEntry(node *yamlv3.Node, key string) (*yamlv3.Node, *yamlv3.Node) {
+	if node == nil || node.Kind != yamlv3.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func removeMappingKey(node *yamlv3.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func encodeYAML(node *yamlv3.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yamlv3.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const editTestConfig = `# Configuration for Cog
+build:
+  gpu: true # needs an A100
+  python_version: "3.8"
+  system_packages:
+    - ffmpeg
+predict: "predict.py:Predictor"
+`
+
+func TestGetValue(t *testing.T) {
+	value, err := GetValue([]byte(editTestConfig), "build.python_version")
+	require.NoError(t, err)
+	require.Equal(t, "3.8", value)
+
+	value, err = GetValue([]byte(editTestConfig), "build.system_packages")
+	require.NoError(t, err)
+	require.Equal(t, "- ffmpeg", value)
+
+	_, err = GetValue([]byte(editTestConfig), "image")
+	require.ErrorContains(t, err, "image is not set")
+}
+
+func TestSetValue(t *testing.T) {
+	contents, err := SetValue([]byte(editTestConfig), "build.python_version", "3.10")
+	require.NoError(t, err)
+	contents, err = SetValue(contents, "build.gpu", "false")
+	require.NoError(t, err)
+	contents, err = SetValue(contents, "image", "r8.im/user/model")
+	require.NoError(t, err)
+	contents, err = SetValue(contents, "build.run", `["echo hello"]`)
+	require.NoError(t, err)
+
+	require.Equal(t, `# Configuration for Cog
+build:
+  gpu: false # needs an A100
+  python_version: "3.10"
+  system_packages:
+    - ffmpeg
+  run: ["echo hello"]
+predict: "predict.py:Predictor"
+image: r8.im/user/model
+`, string(contents))
+
+	config, err := FromYAML(contents)
+	require.NoError(t, err)
+	require.Equal(t, "3.10", config.Build.PythonVersion)
+
+	_, err = SetValue(contents, "predict.foo", "bar")
+	require.ErrorContains(t, err, "predict is not a mapping")
+}
+
+func TestSetValueEmpty(t *testing.T) {
+	contents, err := SetValue([]byte("build:\n"), "build.python_version", "3.11")
+	require.NoError(t, err)
+	require.Equal(t, "build:\n  python_version: \"3.11\"\n", string(contents))
+
+	contents, err = SetValue([]byte(""), "weights.encryption.key_env", "MY_KEY")
+	require.NoError(t, err)
+	require.Equal(t, "weights:\n  encryption:\n    key_env: MY_KEY\n", string(contents))
+}
+
+func TestMergeYAML(t *testing.T) {
+	fragment := `build:
+  python_version: "3.11"
+  system_packages:
+    - ffmpeg
+    - libgl1
+lint:
+  rules:
+    print: error
+`
+	contents, err := MergeYAML([]byte(editTestConfig), []byte(fragment))
+	require.NoError(t, err)
+	require.Equal(t, `# Configuration for Cog
+build:
+  gpu: true # needs an A100
+  python_version: "3.11"
+  system_packages:
+    - ffmpeg
+    - libgl1
+predict: "predict.py:Predictor"
+lint:
+  rules:
+    print: error
+`, string(contents))
+
+	config, err := FromYAML(contents)
+	require.NoError(t, err)
+	require.Equal(t, "error", config.Lint.Rules["print"])
+}
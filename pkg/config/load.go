@@ -2,17 +2,23 @@ package config
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 
 	"github.com/replicate/cog/pkg/errors"
 	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/util/console"
 	"github.com/replicate/cog/pkg/util/files"
 )
 
 const maxSearchDepth = 100
 
+// ConfigFilenames are the names the config can have in a project, in the
+// formats it can be written in
+var ConfigFilenames = []string{global.ConfigFilename, "cog.json", "cog.toml"}
+
 // Returns the project's root directory, or the directory specified by the --project-dir flag
 func GetProjectDir(customDir string) (string, error) {
 	if customDir != "" {
@@ -34,15 +40,59 @@ func GetConfig(customDir string) (*Config, string, error) {
 	if err != nil {
 		return nil, "", err
 	}
-	configPath := path.Join(rootDir, global.ConfigFilename)
+	configPath, err := findConfigPathInDirectory(rootDir)
+	if err != nil {
+		return nil, "", err
+	}
 
 	// Then try to load the config file from there
 	config, err := loadConfigFromFile(configPath)
 	if err != nil {
 		return nil, "", err
 	}
+	return completeConfig(config, rootDir)
+}
 
-	err = config.ValidateAndComplete(rootDir)
+// GetConfigFromFile loads the config from file, instead of the project's
+// cog.yaml, or from stdin if file is "-". The project is the directory
+// specified by customDir, or the current working directory, not the
+// directory file is in, like `docker build -f`.
+func GetConfigFromFile(customDir string, file string, stdin io.Reader) (*Config, string, error) {
+	rootDir := customDir
+	if rootDir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, "", err
+		}
+		rootDir = cwd
+	}
+
+	var config *Config
+	if file == "-" {
+		contents, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to read config from stdin: %w", err)
+		}
+		config, err = FromFile("", contents)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		var err error
+		config, err = loadConfigFromFile(file)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return completeConfig(config, rootDir)
+}
+
+func completeConfig(config *Config, rootDir string) (*Config, string, error) {
+	for _, deprecation := range config.Deprecations() {
+		console.Warnf("%s Run 'cog migrate' to update %s.", deprecation, global.ConfigFilename)
+	}
+
+	err := config.ValidateAndComplete(rootDir)
 
 	return config, rootDir, err
 }
@@ -55,7 +105,7 @@ func loadConfigFromFile(file string) (*Config, error) {
 	}
 
 	if !exists {
-		return nil, fmt.Errorf("%s does not exist in %s. Are you in the right directory?", global.ConfigFilename, filepath.Dir(file))
+		return nil, fmt.Errorf("%s does not exist in %s. Are you in the right directory?", filepath.Base(file), filepath.Dir(file))
 	}
 
 	contents, err := os.ReadFile(file)
@@ -63,7 +113,7 @@ func loadConfigFromFile(file string) (*Config, error) {
 		return nil, err
 	}
 
-	config, err := FromYAML(contents)
+	config, err := FromFile(file, contents)
 	if err != nil {
 		return nil, err
 	}
@@ -74,19 +124,28 @@ func loadConfigFromFile(file string) (*Config, error) {
 
 // Given a directory, find the cog config file in that directory
 func findConfigPathInDirectory(dir string) (configPath string, err error) {
-	filePath := path.Join(dir, global.ConfigFilename)
-	exists, err := files.Exists(filePath)
-	if err != nil {
-		return "", fmt.Errorf("Failed to scan directory %s for %s: %s", dir, filePath, err)
-	} else if exists {
-		return filePath, nil
+	found := []string{}
+	for _, filename := range ConfigFilenames {
+		filePath := path.Join(dir, filename)
+		exists, err := files.Exists(filePath)
+		if err != nil {
+			return "", fmt.Errorf("Failed to scan directory %s for %s: %s", dir, filePath, err)
+		} else if exists {
+			found = append(found, filePath)
+		}
+	}
+	if len(found) > 1 {
+		return "", fmt.Errorf("%s and %s are both in %s. Remove one of them", filepath.Base(found[0]), filepath.Base(found[1]), dir)
+	} else if len(found) == 1 {
+		return found[0], nil
 	}
 
 	return "", errors.ConfigNotFound(fmt.Sprintf("%s not found in %s", global.ConfigFilename, dir))
 }
 
 // Walk up the directory tree to find the root of the project.
-// The project root is defined as the directory housing a `cog.yaml` file.
+// The project root is defined as the directory housing a `cog.yaml` file,
+// or cog.json or cog.toml.
 func findProjectRootDir(startDir string) (string, error) {
 	dir := startDir
 	for i := 0; i < maxSearchDepth; i++ {
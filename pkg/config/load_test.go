@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -64,3 +65,68 @@ func TestFindProjectRootDirShouldReturnErrIfNoConfig(t *testing.T) {
 	_, err = findProjectRootDir(subdir)
 	require.Error(t, err)
 }
+
+func TestGetConfigLoadsJSONAndTOML(t *testing.T) {
+	for filename, contents := range map[string]string{
+		"cog.json": `{"build": {"python_version": "3.8", "system_packages": ["libgl1-mesa-glx"]}, "predict": "predict.py:SomePredictor"}`,
+		"cog.toml": `
+predict = "predict.py:SomePredictor"
+
+[build]
+python_version = "3.8"
+system_packages = ["libgl1-mesa-glx"]
+`,
+	} {
+		t.Run(filename, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(path.Join(dir, filename), []byte(contents), 0o644))
+
+			conf, _, err := GetConfig(dir)
+			require.NoError(t, err)
+			require.Equal(t, "predict.py:SomePredictor", conf.Predict)
+			require.Equal(t, "3.8", conf.Build.PythonVersion)
+			require.Equal(t, "3.8.20", conf.Build.PythonPatchVersion())
+			require.Equal(t, []string{"libgl1-mesa-glx"}, conf.Build.SystemPackages)
+		})
+	}
+}
+
+func TestGetConfigRejectsSeveralFormats(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "cog.yaml"), []byte(testConfig), 0o644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "cog.toml"), []byte(`predict = "predict.py:SomePredictor"`), 0o644))
+
+	_, _, err := GetConfig(dir)
+	require.ErrorContains(t, err, "cog.yaml and cog.toml are both in")
+}
+
+func TestGetConfigFromStdin(t *testing.T) {
+	for name, contents := range map[string]string{
+		"yaml": testConfig,
+		"json": `{"build": {"python_version": "3.8", "python_requirements": "requirements.txt"}, "predict": "predict.py:SomePredictor"}`,
+		"toml": `
+predict = "predict.py:SomePredictor"
+
+[build]
+python_version = "3.8"
+python_requirements = "requirements.txt"
+`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(path.Join(dir, "requirements.txt"), []byte("torch==1.0.0"), 0o644))
+
+			conf, projectDir, err := GetConfigFromFile(dir, "-", strings.NewReader(contents))
+			require.NoError(t, err)
+			require.Equal(t, dir, projectDir)
+			require.Equal(t, "predict.py:SomePredictor", conf.Predict)
+			require.Equal(t, "3.8", conf.Build.PythonVersion)
+			require.Equal(t, "requirements.txt", conf.Build.PythonRequirements)
+		})
+	}
+}
+
+func TestGetConfigFromStdinValidates(t *testing.T) {
+	_, _, err := GetConfigFromFile(t.TempDir(), "-", strings.NewReader(`{"build": {"gpu": "yes"}}`))
+	require.Error(t, err)
+}
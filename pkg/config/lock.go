@@ -0,0 +1,76 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+// LockFilename is the name of the file, next to cog.yaml, that pins what a
+// model is built from.
+const LockFilename = "cog.lock"
+
+// PythonLockFilename is the name of the file, next to cog.yaml, that pins
+// every Python package the model installs, and their hashes, in the format
+// of requirements.txt.
+const PythonLockFilename = "requirements.lock"
+
+type Lock struct {
+	// BaseImages maps base image tags to the digest they resolved to, so
+	// builds keep using the same image when the upstream tag moves.
+	BaseImages map[string]string `json:"base_images,omitempty"`
+	// PythonRequirements is the hash of the requirements PythonLockFilename
+	// was resolved from, so it isn't used once they've changed.
+	PythonRequirements string `json:"python_requirements,omitempty"`
+}
+
+// PythonRequirementsHash returns the hash of requirements recorded in
+// Lock.PythonRequirements.
+func PythonRequirementsHash(requirements string) string {
+	sum := sha256.Sum256([]byte(requirements))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// LoadLock loads the lock file in projectDir, returning an empty lock if it
+// does not exist.
+func LoadLock(projectDir string) (*Lock, error) {
+	lock := &Lock{BaseImages: map[string]string{}}
+
+	p := path.Join(projectDir, LockFilename)
+	exists, err := files.Exists(p)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return lock, nil
+	}
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, lock); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %w", p, err)
+	}
+	if lock.BaseImages == nil {
+		lock.BaseImages = map[string]string{}
+	}
+	return lock, nil
+}
+
+// Save writes the lock file to projectDir.
+func (l *Lock) Save(projectDir string) error {
+	contents, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := path.Join(projectDir, LockFilename)
+	if err := os.WriteFile(p, append(contents, '\n'), 0o644); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := LoadLock(dir)
+	require.NoError(t, err)
+	require.Empty(t, lock.BaseImages)
+
+	lock.BaseImages["python:3.8"] = "sha256:abc123"
+	lock.PythonRequirements = PythonRequirementsHash("torch==2.3.1")
+	require.NoError(t, lock.Save(dir))
+
+	lock, err = LoadLock(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"python:3.8": "sha256:abc123"}, lock.BaseImages)
+	require.Equal(t, PythonRequirementsHash("torch==2.3.1"), lock.PythonRequirements)
+	require.NotEqual(t, PythonRequirementsHash("torch==2.3.0"), lock.PythonRequirements)
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MatrixVariant is one combination of the options in the build matrix.
+type MatrixVariant struct {
+	// Name identifies the variant in image tags, e.g. cuda11.8-py3.10
+	Name   string
+	Config *Config
+}
+
+// MatrixVariants expands the build matrix into a config for every
+// combination of its options. It must be called on a config that has been
+// through ValidateAndComplete. The cuDNN version of each variant is resolved
+// again from its CUDA version.
+func (c *Config) MatrixVariants() ([]MatrixVariant, error) {
+	if c.Matrix == nil || (len(c.Matrix.CUDA) == 0 && len(c.Matrix.PythonVersion) == 0) {
+		return nil, fmt.Errorf("There is no 'matrix' in cog.yaml to build")
+	}
+
+	cudas := c.Matrix.CUDA
+	if len(cudas) == 0 {
+		cudas = []string{""}
+	}
+	pythonVersions := c.Matrix.PythonVersion
+	if len(pythonVersions) == 0 {
+		pythonVersions = []string{""}
+	}
+
+	variants := []MatrixVariant{}
+	for _, cuda := range cudas {
+		for _, pythonVersion := range pythonVersions {
+			variant := *c
+			build := *c.Build
+			variant.Build = &build
+			variant.Matrix = nil
+
+			nameParts := []string{}
+			if cuda != "" {
+				build.CUDA = cuda
+				build.CuDNN = ""
+				if err := variant.validateAndCompleteCUDA(); err != nil {
+					return nil, err
+				}
+				nameParts = append(nameParts, "cuda"+cuda)
+			}
+			if pythonVersion != "" {
+				build.PythonVersion = pythonVersion
+				nameParts = append(nameParts, "py"+pythonVersion)
+			}
+			variants = append(variants, MatrixVariant{
+				Name:   strings.Join(nameParts, "-"),
+				Config: &variant,
+			})
+		}
+	}
+	return variants, nil
+}
+
+// The hardware variants cog build --variant builds
+const (
+	VariantCPU = "cpu"
+	VariantGPU = "gpu"
+)
+
+// HardwareVariants returns a config for each of names, which are VariantCPU
+// or VariantGPU, that's the same as c but built to run on a CPU, or an
+// NVIDIA GPU, so one cog.yaml can be built for both. It must be called on a
+// config that has been through ValidateAndComplete. The GPU variant of a
+// CPU config gets the version of CUDA that suits its packages.
+func (c *Config) HardwareVariants(names []string) ([]MatrixVariant, error) {
+	variants := []MatrixVariant{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("The variant %s is listed more than once", name)
+		}
+		seen[name] = true
+
+		variant := *c
+		build := *c.Build
+		variant.Build = &build
+		variant.Matrix = nil
+		switch name {
+		case VariantCPU:
+			build.GPU = false
+			build.GPUVendor = ""
+			build.CUDA = ""
+			build.CuDNN = ""
+			build.ROCm = ""
+		case VariantGPU:
+			if !build.GPU {
+				build.GPU = true
+				if err := variant.validateAndCompleteCUDA(); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("There is no variant called %s. Variants are %s and %s", name, VariantCPU, VariantGPU)
+		}
+		variants = append(variants, MatrixVariant{Name: name, Config: &variant})
+	}
+	return variants, nil
+}
+
+// MatrixImageName returns the name of the image for a matrix variant, by
+// adding the variant's name to the tag of imageName.
+func MatrixImageName(imageName string, variantName string) string {
+	// A colon after the last slash is a tag, rather than a registry port
+	lastSlash := strings.LastIndex(imageName, "/")
+	if i := strings.LastIndex(imageName, ":"); i > lastSlash {
+		return imageName + "-" + variantName
+	}
+	return imageName + ":" + variantName
+}
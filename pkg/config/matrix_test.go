@@ -0,0 +1,100 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatrixVariants(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  gpu: true
+  python_version: "3.10"
+matrix:
+  cuda: ["11.7", "11.8"]
+  python_version: ["3.10", "3.11"]
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	variants, err := config.MatrixVariants()
+	require.NoError(t, err)
+	names := []string{}
+	for _, variant := range variants {
+		names = append(names, variant.Name)
+		require.Nil(t, variant.Config.Matrix)
+		_, err := variant.Config.CUDABaseImageTag()
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"cuda11.7-py3.10", "cuda11.7-py3.11", "cuda11.8-py3.10", "cuda11.8-py3.11"}, names)
+	require.Equal(t, "11.7", variants[1].Config.Build.CUDA)
+	require.Equal(t, "3.11", variants[1].Config.Build.PythonVersion)
+
+	// The original config is left alone
+	require.Equal(t, "3.10", config.Build.PythonVersion)
+}
+
+func TestMatrixCUDARequiresGPU(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.10"
+matrix:
+  cuda: ["11.8"]
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, config.ValidateAndComplete(""), "'gpu' is true")
+}
+
+func TestMatrixImageName(t *testing.T) {
+	require.Equal(t, "cog-model:py3.10", MatrixImageName("cog-model", "py3.10"))
+	require.Equal(t, "r8.im/user/model:v1-py3.10", MatrixImageName("r8.im/user/model:v1", "py3.10"))
+	require.Equal(t, "localhost:5000/model:py3.10", MatrixImageName("localhost:5000/model", "py3.10"))
+}
+
+func TestHardwareVariants(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  python_packages:
+    - torch==2.3.1
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+
+	variants, err := config.HardwareVariants([]string{"cpu", "gpu"})
+	require.NoError(t, err)
+	require.Len(t, variants, 2)
+	require.Equal(t, "cpu", variants[0].Name)
+	require.False(t, variants[0].Config.Build.GPU)
+	require.Equal(t, "gpu", variants[1].Name)
+	require.True(t, variants[1].Config.Build.GPU)
+	require.Equal(t, "12.1.1", variants[1].Config.Build.CUDA)
+	_, err = variants[1].Config.CUDABaseImageTag()
+	require.NoError(t, err)
+
+	// The original config is left alone
+	require.False(t, config.Build.GPU)
+}
+
+func TestHardwareVariantsCPUFromGPU(t *testing.T) {
+	config, err := FromYAML([]byte(`
+build:
+  gpu: true
+  python_version: "3.11"
+`))
+	require.NoError(t, err)
+	require.NoError(t, config.ValidateAndComplete(""))
+	require.NotEmpty(t, config.Build.CUDA)
+
+	variants, err := config.HardwareVariants([]string{"cpu"})
+	require.NoError(t, err)
+	require.False(t, variants[0].Config.Build.GPU)
+	require.Empty(t, variants[0].Config.Build.CUDA)
+	require.Empty(t, variants[0].Config.Build.CuDNN)
+
+	_, err = config.HardwareVariants([]string{"tpu"})
+	require.ErrorContains(t, err, "There is no variant called tpu")
+	_, err = config.HardwareVariants([]string{"cpu", "cpu"})
+	require.ErrorContains(t, err, "more than once")
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+
+	yamlv3 "gopkg.in/yaml.v3"
+
+	"github.com/replicate/cog/pkg/global"
+)
+
+// Deprecation is a field in cog.yaml that has been replaced and can be
+// rewritten by `cog migrate`.
+type Deprecation struct {
+	Field       string
+	Replacement string
+}
+
+func (d Deprecation) String() string {
+	return fmt.Sprintf("%s in %s is deprecated. Use %s instead.", d.Field, global.ConfigFilename, d.Replacement)
+}
+
+type migration struct {
+	Deprecation
+	isSet   func(c *Config) bool
+	migrate func(doc *yamlv3.Node) error
+}
+
+var migrations = []migration{
+	{
+		Deprecation: Deprecation{Field: "build.pre_install", Replacement: "build.run"},
+		isSet:       func(c *Config) bool { return len(c.Build.PreInstall) > 0 },
+		migrate:     migratePreInstall,
+	},
+}
+
+// Deprecations returns the deprecated fields set in the config.
+func (c *Config) Deprecations() []Deprecation {
+	deprecations := []Deprecation{}
+	if c.Build == nil {
+		return deprecations
+	}
+	for _, m := range migrations {
+		if m.isSet(c) {
+			deprecations = append(deprecations, m.Deprecation)
+		}
+	}
+	return deprecations
+}
+
+// Migrate rewrites deprecated fields in the YAML document contents to their
+// current equivalents, keeping comments. It returns the new contents and
+// the fields that were changed.
+func Migrate(contents []byte) ([]byte, []Deprecation, error) {
+	config, err := FromYAML(contents)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := parseDocument(contents)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed := []Deprecation{}
+	for _, m := range migrations {
+		if !m.isSet(config) {
+			continue
+		}
+		if err := m.migrate(doc); err != nil {
+			return nil, nil, fmt.Errorf("Failed to migrate %s: %w", m.Field, err)
+		}
+		changed = append(changed, m.Deprecation)
+	}
+	if len(changed) == 0 {
+		return contents, changed, nil
+	}
+
+	root := &yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{doc}}
+	migrated, err := encodeYAML(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrated, changed, nil
+}
+
+// migratePreInstall moves build.pre_install to the end of build.run, which
+// is the order they were run in.
+func migratePreInstall(doc *yamlv3.Node) error {
+	build := mappingValue(doc, "build")
+	preInstallKey, preInstall := mappingEntry(build, "pre_install")
+	if preInstall.Kind != yamlv3.SequenceNode {
+		return fmt.Errorf("expected a list")
+	}
+
+	run := mappingValue(build, "run")
+	if run == nil || (run.Kind == yamlv3.ScalarNode && run.Tag == "!!null") {
+		removeMappingKey(build, "run")
+		preInstallKey.Value = "run"
+		return nil
+	}
+	if run.Kind != yamlv3.SequenceNode {
+		return fmt.Errorf("build.run is not a list")
+	}
+	run.Content = append(run.Content, preInstall.Content...)
+	removeMappingKey(build, "pre_install")
+	return nil
+}
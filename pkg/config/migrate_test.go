@@ -0,0 +1,60 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigratePreInstall(t *testing.T) {
+	contents := []byte(`build:
+  python_version: "3.8"
+  run:
+    - echo hello
+  # install things
+  pre_install:
+    - pip install foo # needs network
+predict: "predict.py:Predictor"
+`)
+	config, err := FromYAML(contents)
+	require.NoError(t, err)
+	require.Equal(t, []Deprecation{{Field: "build.pre_install", Replacement: "build.run"}}, config.Deprecations())
+
+	migrated, changed, err := Migrate(contents)
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	require.Equal(t, `build:
+  python_version: "3.8"
+  run:
+    - echo hello
+    - pip install foo # needs network
+predict: "predict.py:Predictor"
+`, string(migrated))
+
+	config, err = FromYAML(migrated)
+	require.NoError(t, err)
+	require.Empty(t, config.Deprecations())
+}
+
+func TestMigratePreInstallWithoutRun(t *testing.T) {
+	contents := []byte(`build:
+  # install things
+  pre_install:
+    - pip install foo
+`)
+	migrated, _, err := Migrate(contents)
+	require.NoError(t, err)
+	require.Equal(t, `build:
+  # install things
+  run:
+    - pip install foo
+`, string(migrated))
+}
+
+func TestMigrateUpToDate(t *testing.T) {
+	contents := []byte("build:\n  python_version: '3.8'\n")
+	migrated, changed, err := Migrate(contents)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+	require.Equal(t, contents, migrated)
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+// Where Poetry keeps a project's dependencies, in the project directory
+const (
+	PyprojectFilename  = "pyproject.toml"
+	PoetryLockFilename = "poetry.lock"
+)
+
+type pyproject struct {
+	Tool struct {
+		Poetry map[string]interface{} `toml:"poetry"`
+	} `toml:"tool"`
+}
+
+type poetryLock struct {
+	Package []struct {
+		Name    string `toml:"name"`
+		Version string `toml:"version"`
+	} `toml:"package"`
+}
+
+// completePoetry sets build.poetry if the project manages its dependencies
+// with Poetry and cog.yaml doesn't list any Python packages, and reads the
+// versions of the packages from poetry.lock, so the CUDA version can be
+// worked out from them.
+func (c *Config) completePoetry(projectDir string) error {
+	hasPackages := c.Build.PythonRequirements != "" || len(c.Build.PythonPackages) > 0 || c.Build.Preset != ""
+	if c.Build.Poetry && hasPackages {
+		return fmt.Errorf("Only one of poetry or python_requirements can be set in your cog.yaml, not both")
+	}
+	if !c.Build.Poetry && !hasPackages {
+		isPoetry, err := isPoetryProject(projectDir)
+		if err != nil {
+			return err
+		}
+		c.Build.Poetry = isPoetry
+	}
+	if !c.Build.Poetry {
+		return nil
+	}
+
+	exists, err := files.Exists(path.Join(projectDir, PyprojectFilename))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("build.poetry is set in cog.yaml, but there's no %s", PyprojectFilename)
+	}
+	lockPath := path.Join(projectDir, PoetryLockFilename)
+	exists, err = files.Exists(lockPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("build.poetry is set in cog.yaml, but there's no %s. Run 'poetry lock' to create it", PoetryLockFilename)
+	}
+	lock := poetryLock{}
+	if _, err := toml.DecodeFile(lockPath, &lock); err != nil {
+		return fmt.Errorf("Failed to parse %s: %w", lockPath, err)
+	}
+	for _, pkg := range lock.Package {
+		c.Build.pythonRequirementsContent = append(c.Build.pythonRequirementsContent, pkg.Name+"=="+pkg.Version)
+	}
+	return nil
+}
+
+// isPoetryProject returns whether the project in projectDir has a
+// pyproject.toml that Poetry manages.
+func isPoetryProject(projectDir string) (bool, error) {
+	p := path.Join(projectDir, PyprojectFilename)
+	exists, err := files.Exists(p)
+	if err != nil || !exists {
+		return false, err
+	}
+	project := pyproject{}
+	if _, err := toml.DecodeFile(p, &project); err != nil {
+		return false, fmt.Errorf("Failed to parse %s: %w", p, err)
+	}
+	return project.Tool.Poetry != nil, nil
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Preset is a curated set of packages for a framework, pinned to versions
+// that are known to work together, that build.preset expands to.
+type Preset struct {
+	Name        string
+	Description string
+	// GPU turns on build.gpu, and CUDA is the version of CUDA the packages
+	// are built for, which build.cuda defaults to
+	GPU            bool
+	CUDA           string
+	PythonPackages []string
+	SystemPackages []string
+}
+
+// Presets are the presets build.preset can be set to. Keep them pinned to
+// versions in torch_compatability_matrix.json, so the right CUDA builds of
+// torch are installed.
+var Presets = []Preset{
+	{
+		Name:        "diffusers-cuda11",
+		Description: "Diffusion models with Hugging Face Diffusers, on CUDA 11",
+		GPU:         true,
+		CUDA:        "11.8",
+		PythonPackages: []string{
+			"torch==2.3.1",
+			"torchvision==0.18.1",
+			"diffusers==0.29.2",
+			"transformers==4.42.4",
+			"accelerate==0.32.1",
+			"safetensors==0.4.3",
+		},
+	},
+	{
+		Name:        "diffusers-cuda12",
+		Description: "Diffusion models with Hugging Face Diffusers, on CUDA 12",
+		GPU:         true,
+		CUDA:        "12.1",
+		PythonPackages: []string{
+			"torch==2.3.1",
+			"torchvision==0.18.1",
+			"diffusers==0.29.2",
+			"transformers==4.42.4",
+			"accelerate==0.32.1",
+			"safetensors==0.4.3",
+		},
+	},
+	{
+		Name:        "opencv-cpu",
+		Description: "Image processing with OpenCV, without a GPU",
+		PythonPackages: []string{
+			"numpy==1.26.4",
+			"opencv-python-headless==4.10.0.84",
+			"pillow==10.4.0",
+		},
+	},
+	{
+		Name:        "transformers-cpu",
+		Description: "Language models with Hugging Face Transformers, without a GPU",
+		PythonPackages: []string{
+			"torch==2.3.1",
+			"transformers==4.42.4",
+			"sentencepiece==0.2.0",
+			"safetensors==0.4.3",
+		},
+	},
+	{
+		Name:        "transformers-cuda12",
+		Description: "Language models with Hugging Face Transformers, on CUDA 12",
+		GPU:         true,
+		CUDA:        "12.1",
+		PythonPackages: []string{
+			"torch==2.3.1",
+			"transformers==4.42.4",
+			"accelerate==0.32.1",
+			"sentencepiece==0.2.0",
+			"safetensors==0.4.3",
+		},
+	},
+	{
+		Name:        "whisper-cuda12",
+		Description: "Speech recognition with OpenAI Whisper, on CUDA 12",
+		GPU:         true,
+		CUDA:        "12.1",
+		PythonPackages: []string{
+			"torch==2.3.1",
+			"torchaudio==2.3.1",
+			"openai-whisper==20231117",
+		},
+		SystemPackages: []string{"ffmpeg"},
+	},
+}
+
+// LookupPreset returns the preset called name.
+func LookupPreset(name string) (*Preset, bool) {
+	for i := range Presets {
+		if Presets[i].Name == name {
+			return &Presets[i], true
+		}
+	}
+	return nil, false
+}
+
+// PresetNames returns the names of the presets, in order.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for _, preset := range Presets {
+		names = append(names, preset.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requirementNameRegexp matches the name of the package at the start of a
+// line of requirements.txt
+var requirementNameRegexp = regexp.MustCompile(`^\s*([A-Za-z0-9][A-Za-z0-9._-]*)`)
+
+// requirementName returns the normalized name of the package a line of
+// requirements.txt installs, or "" if it isn't a package, like an option
+func requirementName(line string) string {
+	match := requirementNameRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return ""
+	}
+	return strings.ToLower(strings.NewReplacer("_", "-", ".", "-").Replace(match[1]))
+}
+
+// completePreset expands build.preset into the build's Python and system
+// packages. Packages in python_packages or python_requirements take
+// precedence over the preset's, so a version can be overridden.
+func (c *Config) completePreset() error {
+	if c.Build.Preset == "" {
+		return nil
+	}
+	preset, ok := LookupPreset(c.Build.Preset)
+	if !ok {
+		return fmt.Errorf("'build.preset' in cog.yaml is %q, which isn't a preset. It must be one of: %s. Run 'cog presets list' to see what they install", c.Build.Preset, strings.Join(PresetNames(), ", "))
+	}
+	if c.Build.Poetry {
+		return fmt.Errorf("'build.preset' in cog.yaml can't be used with Poetry. Add the preset's packages to pyproject.toml instead. Run 'cog presets show %s' to see them", preset.Name)
+	}
+	if preset.GPU {
+		c.Build.GPU = true
+	}
+	if preset.CUDA != "" {
+		if c.Build.CUDA == "" {
+			c.Build.CUDA = preset.CUDA
+			c.Build.cudaSource = fmt.Sprintf("build.preset is %s", preset.Name)
+		} else if cudaMajor(c.Build.CUDA) != cudaMajor(preset.CUDA) {
+			return fmt.Errorf("'build.preset' %s in cog.yaml is for CUDA %s, but 'build.cuda' is %s. Use a preset for CUDA %s, or remove 'build.cuda'", preset.Name, preset.CUDA, c.Build.CUDA, cudaMajor(c.Build.CUDA))
+		}
+	}
+
+	own := map[string]bool{}
+	for _, line := range c.Build.pythonRequirementsContent {
+		if name := requirementName(line); name != "" {
+			own[name] = true
+		}
+	}
+	requirements := []string{}
+	for _, pkg := range preset.PythonPackages {
+		if !own[requirementName(pkg)] {
+			requirements = append(requirements, pkg)
+		}
+	}
+	c.Build.pythonRequirementsContent = append(requirements, c.Build.pythonRequirementsContent...)
+
+	for _, pkg := range preset.SystemPackages {
+		if !sliceContains(c.Build.SystemPackages, pkg) {
+			c.Build.SystemPackages = append(c.Build.SystemPackages, pkg)
+		}
+	}
+	return nil
+}
+
+func cudaMajor(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
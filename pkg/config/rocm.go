@@ -0,0 +1,200 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/version"
+)
+
+// Values of build.gpu_vendor
+const (
+	GPUVendorNVIDIA = "nvidia"
+	GPUVendorAMD    = "amd"
+)
+
+// ROCmTorchCompatibility is a version of torch, and the torchvision that goes
+// with it, that PyTorch publishes wheels of for a version of ROCm.
+type ROCmTorchCompatibility struct {
+	Torch       string
+	Torchvision string
+	ROCm        string
+}
+
+// ROCmTFCompatibility is a version of tensorflow-rocm, the build of
+// TensorFlow for AMD GPUs, and the version of ROCm it's built for.
+type ROCmTFCompatibility struct {
+	TF            string
+	TFROCmPackage string
+	ROCm          string
+}
+
+// ROCmTorchCompatibilityMatrix lists, for each version of torch, the latest
+// version of ROCm there are wheels of it for, at
+// https://download.pytorch.org/whl/rocm<version>.
+var ROCmTorchCompatibilityMatrix = []ROCmTorchCompatibility{
+	{Torch: "2.3.1", Torchvision: "0.18.1", ROCm: "6.0"},
+	{Torch: "2.3.0", Torchvision: "0.18.0", ROCm: "6.0"},
+	{Torch: "2.2.2", Torchvision: "0.17.2", ROCm: "5.7"},
+	{Torch: "2.2.1", Torchvision: "0.17.1", ROCm: "5.7"},
+	{Torch: "2.2.0", Torchvision: "0.17.0", ROCm: "5.7"},
+	{Torch: "2.1.2", Torchvision: "0.16.2", ROCm: "5.6"},
+	{Torch: "2.1.1", Torchvision: "0.16.1", ROCm: "5.6"},
+	{Torch: "2.1.0", Torchvision: "0.16.0", ROCm: "5.6"},
+	{Torch: "2.0.1", Torchvision: "0.15.2", ROCm: "5.4.2"},
+	{Torch: "2.0.0", Torchvision: "0.15.1", ROCm: "5.4.2"},
+}
+
+// ROCmTFCompatibilityMatrix lists the versions of tensorflow-rocm for each
+// version of TensorFlow.
+var ROCmTFCompatibilityMatrix = []ROCmTFCompatibility{
+	{TF: "2.14.0", TFROCmPackage: "tensorflow-rocm==2.14.0.600", ROCm: "6.0"},
+	{TF: "2.13.0", TFROCmPackage: "tensorflow-rocm==2.13.0.570", ROCm: "5.7"},
+	{TF: "2.12.0", TFROCmPackage: "tensorflow-rocm==2.12.0.560", ROCm: "5.6"},
+}
+
+// ROCmBaseImages are the ROCm development images, by ROCm version.
+var ROCmBaseImages = map[string]string{
+	"6.0":   "rocm/dev-ubuntu-22.04:6.0",
+	"5.7":   "rocm/dev-ubuntu-22.04:5.7",
+	"5.6":   "rocm/dev-ubuntu-22.04:5.6",
+	"5.4.2": "rocm/dev-ubuntu-20.04:5.4.2",
+}
+
+// defaultROCmVersion is used when the version of ROCm can't be worked out
+// from torch or tensorflow.
+const defaultROCmVersion = "6.0"
+
+// ROCmBaseImageFor returns the base image for a version of ROCm.
+func ROCmBaseImageFor(rocm string) (string, error) {
+	image, ok := ROCmBaseImages[rocm]
+	if !ok {
+		return "", fmt.Errorf("ROCm %s is not supported by Cog. Supported versions are: %s", rocm, strings.Join(rocmVersions(), ", "))
+	}
+	return image, nil
+}
+
+// IsAMD returns whether the model runs on AMD GPUs.
+func (b *Build) IsAMD() bool {
+	return b.GPU && b.GPUVendor == GPUVendorAMD
+}
+
+func rocmVersions() []string {
+	versions := []string{}
+	for rocm := range ROCmBaseImages {
+		versions = append(versions, rocm)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return version.Greater(versions[i], versions[j])
+	})
+	return versions
+}
+
+func (c *Config) validateGPUVendor() error {
+	switch c.Build.GPUVendor {
+	case "", GPUVendorNVIDIA:
+		if c.Build.ROCm != "" {
+			return fmt.Errorf("'build.rocm' in cog.yaml can only be set with 'gpu_vendor: amd'")
+		}
+		return nil
+	case GPUVendorAMD:
+	default:
+		return fmt.Errorf("'build.gpu_vendor' in cog.yaml must be %s or %s", GPUVendorNVIDIA, GPUVendorAMD)
+	}
+	if !c.Build.GPU {
+		return fmt.Errorf("'gpu_vendor: amd' in cog.yaml needs 'gpu: true'")
+	}
+	if c.Build.CUDA != "" || c.Build.CuDNN != "" {
+		return fmt.Errorf("'build.cuda' and 'build.cudnn' in cog.yaml can't be set with 'gpu_vendor: amd'. Set 'build.rocm' instead")
+	}
+	if c.Build.BaseImage != "" {
+		return fmt.Errorf("'gpu_vendor: amd' in cog.yaml can't be used with 'build.base_image'")
+	}
+	return nil
+}
+
+// validateAndCompleteROCm picks the version of ROCm for torch or tensorflow,
+// like validateAndCompleteCUDA does for CUDA.
+func (c *Config) validateAndCompleteROCm() error {
+	var rocm, from string
+	if tfVersion, ok := c.pythonPackageVersion("tensorflow"); ok {
+		compat, ok := rocmTFCompatibility(tfVersion)
+		if !ok {
+			return fmt.Errorf("Cog doesn't know of a build of tensorflow==%s for AMD GPUs. Versions with builds are: %s", tfVersion, strings.Join(rocmTFVersions(), ", "))
+		}
+		rocm, from = compat.ROCm, "tensorflow=="+tfVersion
+	} else if torchVersion, ok := c.pythonPackageVersion("torch"); ok {
+		compat, ok := rocmTorchCompatibility(torchVersion)
+		if !ok {
+			return fmt.Errorf("Cog doesn't know of a build of torch==%s for AMD GPUs. You might need to upgrade Cog: https://github.com/replicate/cog#upgrade", torchVersion)
+		}
+		rocm, from = compat.ROCm, "torch=="+torchVersion
+	}
+
+	if c.Build.ROCm == "" {
+		c.Build.ROCm = rocm
+		if c.Build.ROCm == "" {
+			c.Build.ROCm = defaultROCmVersion
+		}
+		console.Debugf("Setting ROCm to version %s", c.Build.ROCm)
+	} else if rocm != "" && rocm != c.Build.ROCm {
+		console.Warnf("Cog doesn't know if ROCm %s is compatible with %s, which is built for ROCm %s. This might cause problems.", c.Build.ROCm, from, rocm)
+	}
+	_, err := ROCmBaseImageFor(c.Build.ROCm)
+	return err
+}
+
+func rocmTorchCompatibility(torch string) (ROCmTorchCompatibility, bool) {
+	for _, compat := range ROCmTorchCompatibilityMatrix {
+		if compat.Torch == torch {
+			return compat, true
+		}
+	}
+	return ROCmTorchCompatibility{}, false
+}
+
+func rocmTFCompatibility(tf string) (ROCmTFCompatibility, bool) {
+	for _, compat := range ROCmTFCompatibilityMatrix {
+		if compat.TF == tf {
+			return compat, true
+		}
+	}
+	return ROCmTFCompatibility{}, false
+}
+
+func rocmTFVersions() []string {
+	versions := []string{}
+	for _, compat := range ROCmTFCompatibilityMatrix {
+		versions = append(versions, compat.TF)
+	}
+	return versions
+}
+
+// rocmPythonPackage returns the build of a pinned torch, torchvision, or
+// tensorflow for AMD GPUs, and the index it's on. Other packages are
+// returned as they are.
+func (c *Config) rocmPythonPackage(name, ver string) (actualName, actualVersion, extraIndexURL string) {
+	indexURL := "https://download.pytorch.org/whl/rocm" + c.Build.ROCm
+	switch name {
+	case "torch":
+		if _, ok := rocmTorchCompatibility(ver); ok {
+			return name, ver + "+rocm" + c.Build.ROCm, indexURL
+		}
+	case "torchvision":
+		for _, compat := range ROCmTorchCompatibilityMatrix {
+			if compat.Torchvision == ver {
+				return name, ver + "+rocm" + c.Build.ROCm, indexURL
+			}
+		}
+		console.Warnf("Cog doesn't know of a build of torchvision==%s for ROCm %s. This might cause problems.", ver, c.Build.ROCm)
+	case "tensorflow":
+		if compat, ok := rocmTFCompatibility(ver); ok {
+			if pkgName, pkgVersion, err := splitPinnedPythonRequirement(compat.TFROCmPackage); err == nil {
+				return pkgName, pkgVersion, ""
+			}
+		}
+	}
+	return name, ver, ""
+}
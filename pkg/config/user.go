@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v2"
+
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+const dockerHubRegistry = "docker.io"
+
+// UserConfig is configuration for the person running Cog, as opposed to
+// cog.yaml which is configuration for a model.
+type UserConfig struct {
+	// RegistryMirrors maps a registry host (e.g. docker.io) to a mirror that
+	// base images are pulled from instead.
+	RegistryMirrors map[string]string `yaml:"registry_mirrors"`
+	// ImageSizeWarning is the estimated image size, e.g. 5GB, above which
+	// Cog warns before building.
+	ImageSizeWarning string `yaml:"image_size_warning"`
+	// RegistryLimits maps a registry host to the size limits it enforces on
+	// pushes.
+	RegistryLimits map[string]RegistryLimit `yaml:"registry_limits"`
+	// ReleaseChannel is where `cog upgrade` gets new versions of Cog from.
+	ReleaseChannel ReleaseChannel `yaml:"release_channel"`
+	// Policy is the path to a file of rules that builds and pushes must
+	// follow. It can be overridden with the COG_POLICY environment variable.
+	Policy string `yaml:"policy"`
+	// OIDC maps the host of a registry or build service to the OpenID
+	// Connect provider that `cog login` gets tokens for it from.
+	OIDC map[string]OIDCProvider `yaml:"oidc"`
+}
+
+// OIDCProvider is an OpenID Connect provider that issues short-lived tokens
+// with the device authorization flow.
+type OIDCProvider struct {
+	// Issuer is the URL the provider's discovery document is under, at
+	// /.well-known/openid-configuration
+	Issuer   string   `yaml:"issuer"`
+	ClientID string   `yaml:"client_id"`
+	Scopes   []string `yaml:"scopes"`
+	// Username is who to log in to the registry as, for registries that
+	// take the token with a fixed username. It defaults to the username in
+	// the ID token.
+	Username string `yaml:"username"`
+}
+
+// ReleaseChannel is a URL that serves the latest release of Cog, and the
+// public key its releases are signed with.
+type ReleaseChannel struct {
+	URL       string `yaml:"url"`
+	PublicKey string `yaml:"public_key"`
+}
+
+// RegistryLimit is the largest image, and largest single layer, a registry
+// accepts, as sizes like 10GB.
+type RegistryLimit struct {
+	MaxImageSize string `yaml:"max_image_size"`
+	MaxLayerSize string `yaml:"max_layer_size"`
+}
+
+// UserConfigPath returns the path to the user config file. It can be
+// overridden with the COG_USER_CONFIG environment variable.
+func UserConfigPath() (string, error) {
+	if p := os.Getenv("COG_USER_CONFIG"); p != "" {
+		return p, nil
+	}
+	return homedir.Expand("~/.config/cog/config.yaml")
+}
+
+// LoadUserConfig loads the user config, returning an empty config if it does
+// not exist.
+func LoadUserConfig() (*UserConfig, error) {
+	userConfig := &UserConfig{}
+
+	p, err := UserConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := files.Exists(p)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return userConfig, nil
+	}
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(contents, userConfig); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %w", p, err)
+	}
+	return userConfig, nil
+}
+
+// MirrorImage rewrites image to be pulled from a mirror of its registry, if
+// there is one in mirrors. For example, with a mirror of docker.io at
+// mirror.corp/dockerhub, python:3.8 becomes mirror.corp/dockerhub/library/python:3.8.
+func MirrorImage(image string, mirrors map[string]string) string {
+	if len(mirrors) == 0 {
+		return image
+	}
+	registry, repository := splitImageRegistry(image)
+	mirror, ok := mirrors[registry]
+	if !ok {
+		return image
+	}
+	return strings.TrimSuffix(mirror, "/") + "/" + repository
+}
+
+// ImageRegistry returns the host of the registry image is pushed to and
+// pulled from, e.g. docker.io for python:3.8.
+func ImageRegistry(image string) string {
+	registry, _ := splitImageRegistry(image)
+	return registry
+}
+
+// splitImageRegistry splits an image reference into its registry host and
+// the rest of the reference, normalizing Docker Hub references the same way
+// Docker does.
+func splitImageRegistry(image string) (registry string, repository string) {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		return dockerHubRegistry, "library/" + image
+	}
+	host := parts[0]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHubRegistry, image
+	}
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		host = dockerHubRegistry
+	}
+	return host, parts[1]
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorImage(t *testing.T) {
+	mirrors := map[string]string{
+		"docker.io": "mirror.corp/dockerhub/",
+		"nvcr.io":   "mirror.corp/nvcr",
+	}
+	for _, tc := range []struct {
+		image    string
+		expected string
+	}{
+		{"python:3.8", "mirror.corp/dockerhub/library/python:3.8"},
+		{"nvidia/cuda:11.2.0-cudnn8-devel-ubuntu20.04", "mirror.corp/dockerhub/nvidia/cuda:11.2.0-cudnn8-devel-ubuntu20.04"},
+		{"docker.io/nvidia/cuda:11.2.0", "mirror.corp/dockerhub/nvidia/cuda:11.2.0"},
+		{"index.docker.io/library/python:3.9", "mirror.corp/dockerhub/library/python:3.9"},
+		{"nvcr.io/nvidia/pytorch:22.12-py3", "mirror.corp/nvcr/nvidia/pytorch:22.12-py3"},
+		{"ghcr.io/org/image:latest", "ghcr.io/org/image:latest"},
+		{"localhost:5000/image", "localhost:5000/image"},
+	} {
+		require.Equal(t, tc.expected, MirrorImage(tc.image, mirrors), tc.image)
+	}
+	require.Equal(t, "python:3.8", MirrorImage("python:3.8", nil))
+}
+
+func TestLoadUserConfig(t *testing.T) {
+	p := path.Join(t.TempDir(), "config.yaml")
+	t.Setenv("COG_USER_CONFIG", p)
+
+	userConfig, err := LoadUserConfig()
+	require.NoError(t, err)
+	require.Empty(t, userConfig.RegistryMirrors)
+
+	require.NoError(t, os.WriteFile(p, []byte(`
+registry_mirrors:
+  docker.io: mirror.corp/dockerhub
+`), 0o644))
+	userConfig, err = LoadUserConfig()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"docker.io": "mirror.corp/dockerhub"}, userConfig.RegistryMirrors)
+}
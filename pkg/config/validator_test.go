@@ -79,3 +79,58 @@ func TestValidatePythonVersionIsRequired(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "Additional property python_versions is not allowed")
 }
+
+func TestValidateServing(t *testing.T) {
+	config := `build:
+  python_version: "3.8"
+serving:
+  compression: ["zstd", "gzip"]
+  output_encoding: binary`
+
+	err := Validate(config, "1.0")
+	require.NoError(t, err)
+
+	config = `build:
+  python_version: "3.8"
+serving:
+  compression: ["brotli"]`
+
+	err = Validate(config, "1.0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "serving.compression.0")
+
+	config = `build:
+  python_version: "3.8"
+serving:
+  max_queue_size: 4
+  queue_timeout: 2.5`
+
+	err = Validate(config, "1.0")
+	require.NoError(t, err)
+
+	config = `build:
+  python_version: "3.8"
+serving:
+  max_queue_size: -1`
+
+	err = Validate(config, "1.0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "greater than or equal to 0")
+
+	config = `build:
+  python_version: "3.8"
+serving:
+  preemption_grace: 30`
+
+	err = Validate(config, "1.0")
+	require.NoError(t, err)
+
+	config = `build:
+  python_version: "3.8"
+serving:
+  preemption_grace: 0`
+
+	err = Validate(config, "1.0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "greater than 0")
+}
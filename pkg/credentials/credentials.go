@@ -0,0 +1,112 @@
+// Package credentials keeps secrets, like registry tokens and the token
+// webhooks are sent with, in the OS keychain (macOS Keychain, Windows
+// Credential Manager, or Secret Service on Linux), or in a file encrypted
+// with a passphrase on machines without one, rather than in plaintext where
+// anyone else on a shared workstation could read them.
+package credentials
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+
+	"github.com/replicate/cog/pkg/docker"
+)
+
+// WebhookAuthToken is the name of the token cog serve sends webhooks with,
+// as WEBHOOK_AUTH_TOKEN
+const WebhookAuthToken = "webhook_auth_token"
+
+// Names are the secrets that can be set with cog credentials, and what
+// they're for
+var Names = map[string]string{
+	WebhookAuthToken: "The token cog serve sends webhooks with, as WEBHOOK_AUTH_TOKEN",
+}
+
+var nameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_./:-]*$`)
+
+// Store keeps secrets by name.
+type Store interface {
+	// Get returns the secret called name. ok is false if there isn't one.
+	Get(name string) (secret string, ok bool, err error)
+	Set(name string, secret string) error
+	// Delete removes the secret called name, if there is one.
+	Delete(name string) error
+	// Location says where the secrets are kept, for messages
+	Location() string
+}
+
+// Open returns the store in the OS keychain, or the encrypted file if
+// there's no keychain. If the file's passphrase isn't set with
+// COG_CREDENTIALS_PASSPHRASE, it's asked for if prompt is true and this is
+// run in a terminal.
+func Open(prompt bool) (Store, error) {
+	if helper, ok := docker.DefaultCredentialHelper(); ok {
+		return &keychainStore{helper: helper}, nil
+	}
+	return OpenFile(prompt)
+}
+
+// keychainStore keeps secrets with a Docker credential helper, under
+// cog:// URLs so they don't clash with registry credentials
+type keychainStore struct {
+	helper string
+}
+
+func (s *keychainStore) serverURL(name string) string {
+	return "cog://" + name
+}
+
+func (s *keychainStore) Get(name string) (string, bool, error) {
+	if err := validateName(name); err != nil {
+		return "", false, err
+	}
+	_, secret, ok, err := docker.GetCredential(s.helper, s.serverURL(name))
+	return secret, ok, err
+}
+
+func (s *keychainStore) Set(name string, secret string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	return docker.StoreCredential(s.helper, s.serverURL(name), name, secret)
+}
+
+func (s *keychainStore) Delete(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	return docker.EraseCredential(s.helper, s.serverURL(name))
+}
+
+func (s *keychainStore) Location() string {
+	if helper, ok := keychainNames[s.helper]; ok {
+		return helper
+	}
+	return "docker-credential-" + s.helper
+}
+
+// keychainNames are what the OS keychains Docker's credential helpers keep
+// secrets in are called
+var keychainNames = map[string]string{
+	"osxkeychain":   "the macOS Keychain",
+	"secretservice": "the Secret Service keyring",
+	"wincred":       "the Windows Credential Manager",
+}
+
+func validateName(name string) error {
+	if !nameRegex.MatchString(name) {
+		return fmt.Errorf("Invalid credential name %q. It must be lowercase letters, digits, and _ . / : -", name)
+	}
+	return nil
+}
+
+// noKeychainError explains how to keep secrets when there's no keychain,
+// nor passphrase for the encrypted file
+func noKeychainError() error {
+	helper := map[string]string{"darwin": "osxkeychain", "windows": "wincred"}[runtime.GOOS]
+	if helper == "" {
+		helper = "secretservice"
+	}
+	return fmt.Errorf("There's no OS keychain to keep credentials in, so they're kept in an encrypted file, which needs a passphrase. Set %s, or run this in a terminal to type it in. Or, install docker-credential-%s to keep them in the OS keychain", PassphraseEnv, helper)
+}
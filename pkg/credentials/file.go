@@ -0,0 +1,250 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// PassphraseEnv is the environment variable the encrypted file's passphrase
+// is read from
+const PassphraseEnv = "COG_CREDENTIALS_PASSPHRASE"
+
+// FileEnv is the environment variable that overrides where the encrypted
+// file is
+const FileEnv = "COG_CREDENTIALS_FILE"
+
+// typedPassphrase is the passphrase that was typed in, so it's only asked
+// for once. It's never put in the environment, where the commands Cog runs
+// would get it.
+var typedPassphrase string
+
+const (
+	kdfPBKDF2SHA256 = "pbkdf2-sha256"
+	// defaultIterations is what OWASP recommends for PBKDF2-HMAC-SHA256
+	defaultIterations = 600000
+	saltSize          = 16
+	keySize           = 32
+)
+
+// FilePath returns the path to the encrypted file, which is
+// ~/.config/cog/credentials.enc unless it's set with COG_CREDENTIALS_FILE.
+func FilePath() (string, error) {
+	if p := os.Getenv(FileEnv); p != "" {
+		return p, nil
+	}
+	return homedir.Expand("~/.config/cog/credentials.enc")
+}
+
+// OpenFile returns the store in the encrypted file, whether or not there's
+// a keychain. See Open for how the passphrase is read.
+func OpenFile(prompt bool) (Store, error) {
+	path, err := FilePath()
+	if err != nil {
+		return nil, err
+	}
+	passphrase := os.Getenv(PassphraseEnv)
+	if passphrase == "" {
+		passphrase = typedPassphrase
+	}
+	if passphrase == "" {
+		if !prompt || !console.IsTerminal() {
+			return nil, noKeychainError()
+		}
+		if passphrase, err = readPassphrase(path); err != nil {
+			return nil, err
+		}
+		typedPassphrase = passphrase
+	}
+	return NewFileStore(path, passphrase), nil
+}
+
+// readPassphrase asks for the passphrase of the file at path, twice if the
+// file is being created
+func readPassphrase(path string) (string, error) {
+	if _, err := os.Stat(path); err == nil {
+		return console.ReadPassword(fmt.Sprintf("Passphrase for %s: ", path))
+	}
+	console.Infof("There's no OS keychain to keep credentials in, so they'll be kept in %s, encrypted with a passphrase.", path)
+	passphrase, err := console.ReadPassword("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("The passphrase can't be empty")
+	}
+	confirmation, err := console.ReadPassword("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirmation {
+		return "", fmt.Errorf("The passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+// FileStore keeps secrets in a file, encrypted with AES-256-GCM with a key
+// derived from a passphrase with PBKDF2. The whole file is encrypted, so it
+// doesn't give away what secrets are in it.
+type FileStore struct {
+	path       string
+	passphrase string
+	iterations int
+}
+
+// NewFileStore returns the store in the file at path, which is created when
+// a secret is first set.
+func NewFileStore(path string, passphrase string) *FileStore {
+	return &FileStore{path: path, passphrase: passphrase, iterations: defaultIterations}
+}
+
+// encryptedFile is the format of the file on disk
+type encryptedFile struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (s *FileStore) Get(name string) (string, bool, error) {
+	if err := validateName(name); err != nil {
+		return "", false, err
+	}
+	secrets, err := s.load()
+	if err != nil {
+		return "", false, err
+	}
+	secret, ok := secrets[name]
+	return secret, ok, nil
+}
+
+func (s *FileStore) Set(name string, secret string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	secrets[name] = secret
+	return s.save(secrets)
+}
+
+func (s *FileStore) Delete(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return nil
+	}
+	delete(secrets, name)
+	return s.save(secrets)
+}
+
+func (s *FileStore) Location() string {
+	return "the encrypted file " + s.path
+}
+
+func (s *FileStore) load() (map[string]string, error) {
+	secrets := map[string]string{}
+	contents, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := &encryptedFile{}
+	if err := json.Unmarshal(contents, file); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %w", s.path, err)
+	}
+	if file.KDF != kdfPBKDF2SHA256 || file.Iterations <= 0 {
+		return nil, fmt.Errorf("%s was encrypted in a way this version of Cog doesn't support", s.path)
+	}
+	aead, err := newAEAD(s.passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt %s. Check the passphrase is right", s.path)
+	}
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %w", s.path, err)
+	}
+	return secrets, nil
+}
+
+// save encrypts secrets with a new salt and nonce, and replaces the file
+// with them, so it's never left half-written
+func (s *FileStore) save(secrets map[string]string) error {
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	file := &encryptedFile{KDF: kdfPBKDF2SHA256, Iterations: s.iterations, Salt: make([]byte, saltSize)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(s.passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, nil)
+	contents, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("Failed to save %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func newAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, iterations, keySize, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
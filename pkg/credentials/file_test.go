@@ -0,0 +1,112 @@
+package credentials
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testFileStore(t *testing.T, passphrase string) *FileStore {
+	store := NewFileStore(filepath.Join(t.TempDir(), "credentials.enc"), passphrase)
+	store.iterations = 1000
+	return store
+}
+
+func TestFileStore(t *testing.T) {
+	store := testFileStore(t, "correct horse")
+
+	_, ok, err := store.Get(WebhookAuthToken)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, store.Set(WebhookAuthToken, "s3cret"))
+	require.NoError(t, store.Set("registry/r8.im", "token"))
+	secret, ok, err := store.Get(WebhookAuthToken)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "s3cret", secret)
+
+	info, err := os.Stat(store.path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	// Neither the names nor the secrets are in plaintext
+	contents, err := os.ReadFile(store.path)
+	require.NoError(t, err)
+	require.NotContains(t, string(contents), "s3cret")
+	require.NotContains(t, string(contents), WebhookAuthToken)
+
+	require.NoError(t, store.Delete(WebhookAuthToken))
+	_, ok, err = store.Get(WebhookAuthToken)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = store.Get("registry/r8.im")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestFileStoreWrongPassphrase(t *testing.T) {
+	store := testFileStore(t, "correct horse")
+	require.NoError(t, store.Set(WebhookAuthToken, "s3cret"))
+
+	wrong := NewFileStore(store.path, "battery staple")
+	_, _, err := wrong.Get(WebhookAuthToken)
+	require.ErrorContains(t, err, "Check the passphrase is right")
+}
+
+func TestFileStoreInvalidName(t *testing.T) {
+	store := testFileStore(t, "correct horse")
+	require.ErrorContains(t, store.Set("Webhook Token", "s3cret"), "Invalid credential name")
+}
+
+func TestOpenFileTypedPassphrase(t *testing.T) {
+	t.Setenv(FileEnv, filepath.Join(t.TempDir(), "credentials.enc"))
+	t.Setenv(PassphraseEnv, "")
+	typedPassphrase = "correct horse"
+	t.Cleanup(func() { typedPassphrase = "" })
+
+	store, err := OpenFile(false)
+	require.NoError(t, err)
+	require.Equal(t, "correct horse", store.(*FileStore).passphrase)
+	// The commands Cog runs don't get it
+	require.Empty(t, os.Getenv(PassphraseEnv))
+}
+
+func TestServeDockerHelper(t *testing.T) {
+	t.Setenv(FileEnv, filepath.Join(t.TempDir(), "credentials.enc"))
+	t.Setenv(PassphraseEnv, "correct horse")
+
+	run := func(action string, input string) (string, error) {
+		out := &bytes.Buffer{}
+		err := ServeDockerHelper(action, strings.NewReader(input), out)
+		return out.String(), err
+	}
+
+	out, err := run("get", "r8.im\n")
+	require.Error(t, err)
+	require.Contains(t, out, "credentials not found")
+
+	_, err = run("store", `{"ServerURL": "https://R8.im", "Username": "ada", "Secret": "token"}`)
+	require.NoError(t, err)
+	out, err = run("get", "r8.im")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"ServerURL": "r8.im", "Username": "ada", "Secret": "token"}`, out)
+	out, err = run("list", "")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"r8.im": "ada"}`, out)
+
+	_, err = run("erase", "r8.im")
+	require.NoError(t, err)
+	_, err = run("get", "r8.im")
+	require.Error(t, err)
+}
+
+func TestServeDockerHelperWithoutPassphrase(t *testing.T) {
+	t.Setenv(FileEnv, filepath.Join(t.TempDir(), "credentials.enc"))
+	t.Setenv(PassphraseEnv, "")
+	err := ServeDockerHelper("get", strings.NewReader("r8.im"), &bytes.Buffer{})
+	require.ErrorContains(t, err, PassphraseEnv)
+}
@@ -0,0 +1,144 @@
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/replicate/cog/pkg/docker"
+)
+
+// errNotFound is what Docker's credential helpers print when they don't
+// have the credentials for a registry
+const errNotFound = "credentials not found in native keychain"
+
+// registryCredential is how registry credentials are kept in the encrypted
+// file
+type registryCredential struct {
+	Username string `json:"username"`
+	Secret   string `json:"secret"`
+}
+
+func registryName(serverURL string) string {
+	return "registry/" + strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(serverURL, "https://"), "http://"))
+}
+
+// SaveRegistryLogin saves token as the Docker credentials for registryHost,
+// in the OS keychain, or else in the encrypted file, which Docker reads with
+// Cog installed as docker-credential-cog. They're never kept in plaintext in
+// Docker's config.json. It returns where they were kept.
+func SaveRegistryLogin(registryHost string, username string, token string) (location string, err error) {
+	if helper, err := docker.KeychainHelper(registryHost); err == nil {
+		if err := docker.SaveLoginTokenToKeychain(registryHost, username, token); err != nil {
+			return "", err
+		}
+		return (&keychainStore{helper: helper}).Location(), nil
+	}
+	if _, err := exec.LookPath("docker-credential-" + docker.CogCredentialHelper); err != nil {
+		return "", fmt.Errorf("There's no OS keychain to keep the credentials for %s in, and Docker can't read them from Cog's encrypted file because docker-credential-cog isn't installed. Link it to cog with:\n\n    ln -s \"$(which cog)\" /usr/local/bin/docker-credential-cog", registryHost)
+	}
+	store, err := OpenFile(true)
+	if err != nil {
+		return "", err
+	}
+	secret, err := json.Marshal(registryCredential{Username: username, Secret: token})
+	if err != nil {
+		return "", err
+	}
+	if err := store.Set(registryName(registryHost), string(secret)); err != nil {
+		return "", err
+	}
+	if err := docker.SetCredentialHelper(registryHost, docker.CogCredentialHelper); err != nil {
+		return "", err
+	}
+	return store.Location(), nil
+}
+
+// helperCredential is what Docker's credential helper protocol sends and
+// receives
+type helperCredential struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// ServeDockerHelper runs action of Docker's credential helper protocol
+// (get, store, erase or list) on the registry credentials in the encrypted
+// file, reading the request from in and writing the response to out. It's
+// what Cog does when it's run as docker-credential-cog.
+func ServeDockerHelper(action string, in io.Reader, out io.Writer) error {
+	store, err := OpenFile(false)
+	if err != nil {
+		return err
+	}
+	fileStore := store.(*FileStore)
+	switch action {
+	case "get":
+		serverURL, err := readServerURL(in)
+		if err != nil {
+			return err
+		}
+		secret, ok, err := fileStore.Get(registryName(serverURL))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(out, errNotFound)
+			return errors.New(errNotFound)
+		}
+		credential := registryCredential{}
+		if err := json.Unmarshal([]byte(secret), &credential); err != nil {
+			return err
+		}
+		return json.NewEncoder(out).Encode(helperCredential{ServerURL: serverURL, Username: credential.Username, Secret: credential.Secret})
+	case "store":
+		credential := helperCredential{}
+		if err := json.NewDecoder(in).Decode(&credential); err != nil {
+			return fmt.Errorf("Failed to read the credentials to store: %w", err)
+		}
+		secret, err := json.Marshal(registryCredential{Username: credential.Username, Secret: credential.Secret})
+		if err != nil {
+			return err
+		}
+		return fileStore.Set(registryName(credential.ServerURL), string(secret))
+	case "erase":
+		serverURL, err := readServerURL(in)
+		if err != nil {
+			return err
+		}
+		return fileStore.Delete(registryName(serverURL))
+	case "list":
+		secrets, err := fileStore.load()
+		if err != nil {
+			return err
+		}
+		registries := map[string]string{}
+		for name, secret := range secrets {
+			if !strings.HasPrefix(name, "registry/") {
+				continue
+			}
+			credential := registryCredential{}
+			if err := json.Unmarshal([]byte(secret), &credential); err != nil {
+				return err
+			}
+			registries[strings.TrimPrefix(name, "registry/")] = credential.Username
+		}
+		return json.NewEncoder(out).Encode(registries)
+	}
+	return fmt.Errorf("Unknown credential helper action %q. It must be get, store, erase or list", action)
+}
+
+func readServerURL(in io.Reader) (string, error) {
+	contents, err := io.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+	serverURL := strings.TrimSpace(string(contents))
+	if serverURL == "" {
+		return "", fmt.Errorf("No server URL was passed on stdin")
+	}
+	return serverURL, nil
+}
@@ -4,46 +4,210 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 
+	"github.com/mattn/go-isatty"
+
 	"github.com/replicate/cog/pkg/util"
 	"github.com/replicate/cog/pkg/util/console"
 )
 
-func Build(dir, dockerfile, imageName string, progressOutput string) error {
-	var args []string
-	if util.IsM1Mac(runtime.GOOS, runtime.GOARCH) {
-		args = m1BuildxBuildArgs()
-	} else {
-		args = buildKitBuildArgs()
+// BuildOptions are options for building a model. Most of them keep builds
+// apart from each other, for build servers that are shared between many
+// users.
+type BuildOptions struct {
+	// Builder is the buildx builder to build with, instead of the default
+	Builder string
+	// CacheScope prefixes the IDs of cache mounts, so builds in different
+	// scopes don't share package caches
+	CacheScope string
+	// CPUs and Memory (e.g. 8g) limit the resources a build can use
+	CPUs   float64
+	Memory string
+	// Strict fails the build on problems in the model that are otherwise
+	// warnings
+	Strict bool
+	// Exclude are paths to leave out of the build context, as well as what
+	// is in .dockerignore
+	Exclude []string
+	// Stages are shown by name in the build's output, if it's plain text
+	Stages []BuildStage
+	// NoCacheFilter are the stages of the Dockerfile to build without the
+	// cache
+	NoCacheFilter []string
+	// Target is the stage of the Dockerfile to stop the build at
+	Target string
+	// NoCache builds every step without the cache
+	NoCache bool
+	// SSH is the SSH agent socket or keys to forward to the build, as
+	// "default" or "default=<path>", like docker build --ssh
+	SSH string
+	// Platform is the platform to build for, like linux/arm64, if it isn't
+	// the one Docker runs on
+	Platform string
+	// Offline builds without the internet, installing Python from
+	// PythonTarball and packages from Wheelhouse
+	Offline       bool
+	PythonTarball string
+	Wheelhouse    string
+	// Backend is one of Backends. It's dockerfile if it's empty, and the
+	// model is built with Build. With llb, it's built with BuildLLB
+	Backend string
+}
+
+// ProgressOutputs are the types of progress output builds can show. json is
+// BuildKit's rawjson, a JSON object for each update to the build, for
+// programs to read.
+var ProgressOutputs = []string{"auto", "plain", "tty", "json"}
+
+// buildProgress returns the docker build --progress for progressOutput
+func buildProgress(progressOutput string) (string, error) {
+	switch progressOutput {
+	case "auto", "plain", "tty":
+		return progressOutput, nil
+	case "json":
+		return "rawjson", nil
+	}
+	return "", fmt.Errorf("--progress must be one of %s, not '%s'", strings.Join(ProgressOutputs, ", "), progressOutput)
+}
+
+func Build(dir, dockerfile, imageName string, progressOutput string, opts BuildOptions) error {
+	progress, err := buildProgress(progressOutput)
+	if err != nil {
+		return err
+	}
+	builder, err := opts.builder()
+	if err != nil {
+		return err
+	}
+
+	platform := opts.Platform
+	if platform == "" && util.IsM1Mac(runtime.GOOS, runtime.GOARCH) {
+		platform = "linux/amd64"
+	}
+	logWriter := newStageLogWriter(progressOutput, opts.Stages)
+	if progress == "rawjson" {
+		if err := checkBuildx(); err != nil {
+			return err
+		}
+	}
+	args := buildCommand(builder, platform, progress)
+	dockerfilePath := "-"
+	if len(opts.Exclude) > 0 {
+		tmpDir, err := os.MkdirTemp("", "cog-build")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		if dockerfilePath, err = writeDockerfileWithIgnore(tmpDir, dir, dockerfile, opts.Exclude); err != nil {
+			return err
+		}
 	}
 	args = append(args,
-		"--file", "-",
+		"--file", dockerfilePath,
 		"--build-arg", "BUILDKIT_INLINE_CACHE=1",
 		"--tag", imageName,
-		"--progress", progressOutput,
-		".",
+		"--progress", progress,
 	)
+	if opts.SSH != "" {
+		args = append(args, "--ssh", opts.SSH)
+	}
+	if len(opts.NoCacheFilter) > 0 {
+		args = append(args, "--no-cache-filter", strings.Join(opts.NoCacheFilter, ","))
+	}
+	if opts.Target != "" {
+		args = append(args, "--target", opts.Target)
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+	args = append(args, ".")
 	cmd := exec.Command("docker", args...)
 	cmd.Env = append(os.Environ(), "DOCKER_BUILDKIT=1")
 	cmd.Dir = dir
 	cmd.Stdout = os.Stderr // redirect stdout to stderr - build output is all messaging
 	cmd.Stderr = os.Stderr
-	cmd.Stdin = strings.NewReader(dockerfile)
+	if dockerfilePath == "-" {
+		cmd.Stdin = strings.NewReader(dockerfile)
+	}
+
+	if logWriter != nil {
+		cmd.Stdout = logWriter
+		cmd.Stderr = logWriter
+	}
 
 	console.Debug("$ " + strings.Join(cmd.Args, " "))
-	return cmd.Run()
+	return stageFailure(cmd.Run(), logWriter)
 }
 
-func BuildAddLabelsToImage(image string, labels map[string]string) error {
+// newStageLogWriter returns a writer that names the stages in the build's
+// output, or nil if they aren't named. BuildKit's interactive output can't
+// be rewritten, so stages are only named when it's plain text.
+func newStageLogWriter(progressOutput string, stages []BuildStage) *buildLogWriter {
+	if len(stages) > 0 && (progressOutput == "plain" || (progressOutput == "auto" && !isatty.IsTerminal(os.Stderr.Fd()))) {
+		return newBuildLogWriter(os.Stderr, stages)
+	}
+	return nil
+}
+
+// stageFailure returns an error with the output of the stage that failed,
+// if the build failed in one, or err otherwise.
+func stageFailure(err error, logWriter *buildLogWriter) error {
+	if err != nil && logWriter != nil {
+		if stageErr := logWriter.failure(); stageErr != nil {
+			return stageErr
+		}
+	}
+	return err
+}
+
+// writeDockerfileWithIgnore writes dockerfile to tmpDir, with a
+// Dockerfile-specific ignore file next to it that has the patterns in the
+// .dockerignore in dir as well as exclude. BuildKit uses that instead of
+// .dockerignore, and it can only be used if the Dockerfile is in a file.
+func writeDockerfileWithIgnore(tmpDir string, dir string, dockerfile string, exclude []string) (string, error) {
+	ignore, err := os.ReadFile(filepath.Join(dir, ".dockerignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	lines := []string{strings.TrimRight(string(ignore), "\n")}
+	for _, path := range exclude {
+		lines = append(lines, escapeDockerignorePattern(path))
+	}
+
+	dockerfilePath := filepath.Join(tmpDir, "Dockerfile")
+	if err := os.WriteFile(dockerfilePath, []byte(dockerfile), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(dockerfilePath+".dockerignore", []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return dockerfilePath, nil
+}
+
+// escapeDockerignorePattern returns a .dockerignore pattern that only
+// matches path.
+func escapeDockerignorePattern(path string) string {
+	var b strings.Builder
+	for i, c := range path {
+		if strings.ContainsRune(`*?[]\`, c) || (i == 0 && (c == '!' || c == '#')) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// BuildAddLabelsToImage adds labels to an image. platform is the platform
+// the image was built for, if it was set when it was built.
+func BuildAddLabelsToImage(image string, labels map[string]string, platform string) error {
 	dockerfile := "FROM " + image
-	var args []string
-	if util.IsM1Mac(runtime.GOOS, runtime.GOARCH) {
-		args = m1BuildxBuildArgs()
-	} else {
-		args = buildKitBuildArgs()
+	if platform == "" && util.IsM1Mac(runtime.GOOS, runtime.GOARCH) {
+		platform = "linux/amd64"
 	}
+	args := buildArgs(platform)
 
 	args = append(args,
 		"--file", "-",
@@ -68,10 +232,93 @@ func BuildAddLabelsToImage(image string, labels map[string]string) error {
 	return nil
 }
 
-func m1BuildxBuildArgs() []string {
-	return []string{"buildx", "build", "--platform", "linux/amd64", "--load"}
+// builder returns the builder to build with. Resource limits are set on
+// builders rather than builds, so a builder with the limits is created the
+// first time they are used.
+func (opts BuildOptions) builder() (string, error) {
+	if opts.CPUs == 0 && opts.Memory == "" {
+		return opts.Builder, nil
+	}
+	if opts.Builder != "" {
+		return "", fmt.Errorf("Resource limits can't be set on an existing builder. Set them when you create the builder with 'docker buildx create'")
+	}
+
+	name := "cog"
+	if opts.CacheScope != "" {
+		name += "-" + opts.CacheScope
+	}
+	driverOpts := []string{}
+	if opts.CPUs != 0 {
+		name += fmt.Sprintf("-%gcpu", opts.CPUs)
+		driverOpts = append(driverOpts, "cpu-period=100000", fmt.Sprintf("cpu-quota=%d", int64(opts.CPUs*100000)))
+	}
+	if opts.Memory != "" {
+		name += "-" + opts.Memory
+		driverOpts = append(driverOpts, "memory="+opts.Memory)
+	}
+	name = strings.ReplaceAll(name, ".", "_")
+
+	if err := ensureBuilder(name, driverOpts); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// ensureBuilder creates a builder that runs in a container with driverOpts,
+// if one called name doesn't exist yet.
+func ensureBuilder(name string, driverOpts []string) error {
+	inspect := exec.Command("docker", "buildx", "inspect", name)
+	console.Debug("$ " + strings.Join(inspect.Args, " "))
+	if err := inspect.Run(); err == nil {
+		return nil
+	}
+
+	args := []string{"buildx", "create", "--name", name, "--driver", "docker-container"}
+	for _, opt := range driverOpts {
+		args = append(args, "--driver-opt", opt)
+	}
+	cmd := exec.Command("docker", args...)
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to create builder %s: %s", name, strings.TrimSpace(string(out)))
+	}
+	console.Infof("Created builder %s", name)
+	return nil
+}
+
+// buildCommand returns the command to build an image with builder, for
+// platform. JSON progress is only shown by buildx, so it's built with buildx
+// then too, even if there isn't a builder or platform.
+func buildCommand(builder string, platform string, progress string) []string {
+	if builder == "" && progress != "rawjson" {
+		return buildArgs(platform)
+	}
+	args := []string{"buildx", "build"}
+	if builder != "" {
+		args = append(args, "--builder", builder)
+	}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	return append(args, "--load")
+}
+
+// checkBuildx returns an error if Docker Buildx isn't installed, for
+// --progress json, which needs it.
+func checkBuildx() error {
+	cmd := exec.Command("docker", "buildx", "version")
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("--progress json needs Docker Buildx 0.13 or later. Install it from https://docs.docker.com/build/install-buildx/")
+	}
+	return nil
 }
 
-func buildKitBuildArgs() []string {
+// buildArgs returns the command to build an image for platform, which needs
+// buildx, or for the platform Docker runs on if it's empty.
+func buildArgs(platform string) []string {
+	if platform != "" {
+		return []string{"buildx", "build", "--platform", platform, "--load"}
+	}
 	return []string{"build"}
 }
@@ -0,0 +1,164 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// failedStageLines is how many of the last lines a failed build stage
+// printed are shown in the error
+const failedStageLines = 20
+
+// BuildStage is a step of a build that's shown by name in the build's
+// output, like installing Python packages or one of the run commands in
+// cog.yaml.
+type BuildStage struct {
+	Name string
+	// Instruction is the RUN instruction in the Dockerfile, which is how
+	// the stage is recognized in BuildKit's output
+	Instruction string
+}
+
+// stageLog is the output of a stage that's running, or has run
+type stageLog struct {
+	stage *BuildStage
+	tail  []string
+}
+
+// buildLogWriter rewrites BuildKit's plain progress output, so the output of
+// each of the stages is prefixed with the stage's name and how long it has
+// been running. Everything else is passed through as it is. It keeps the
+// last lines each stage printed, to show them if it fails.
+type buildLogWriter struct {
+	out    io.Writer
+	stages []BuildStage
+
+	mu      sync.Mutex
+	partial []byte
+	// vertices maps BuildKit's IDs of the steps of the build to the stages
+	// they run
+	vertices map[string]*stageLog
+	failed   *stageLog
+}
+
+func newBuildLogWriter(out io.Writer, stages []BuildStage) *buildLogWriter {
+	return &buildLogWriter{out: out, stages: stages, vertices: map[string]*stageLog{}}
+}
+
+func (w *buildLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.partial[:i])
+		w.partial = w.partial[i+1:]
+		if _, err := io.WriteString(w.out, w.formatLine(line)+"\n"); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// formatLine formats a line of BuildKit's plain progress output, which is
+// in the form "#<vertex> <rest>".
+func (w *buildLogWriter) formatLine(line string) string {
+	if !strings.HasPrefix(line, "#") {
+		return line
+	}
+	vertex, rest, ok := strings.Cut(line[1:], " ")
+	if !ok {
+		return line
+	}
+
+	// The first line of a step is its name, like
+	// "[stage-0 5/9] RUN pip install -r /tmp/requirements.txt"
+	if strings.HasPrefix(rest, "[") {
+		if _, instruction, ok := strings.Cut(rest, "] "); ok {
+			if stage := w.findStage(instruction); stage != nil {
+				if _, ok := w.vertices[vertex]; !ok {
+					w.vertices[vertex] = &stageLog{stage: stage}
+				}
+				return fmt.Sprintf("[%s] %s", stage.Name, instruction)
+			}
+		}
+		return line
+	}
+
+	log, ok := w.vertices[vertex]
+	if !ok {
+		return line
+	}
+	switch {
+	case strings.HasPrefix(rest, "DONE "):
+		return fmt.Sprintf("[%s] Done in %s", log.stage.Name, strings.TrimPrefix(rest, "DONE "))
+	case rest == "CACHED":
+		return fmt.Sprintf("[%s] Cached", log.stage.Name)
+	case strings.HasPrefix(rest, "ERROR"):
+		w.failed = log
+		return fmt.Sprintf("[%s] %s", log.stage.Name, rest)
+	}
+
+	// Output is in the form "<seconds since the step started> <line>"
+	elapsed, text, _ := strings.Cut(rest, " ")
+	seconds, err := strconv.ParseFloat(elapsed, 64)
+	if err != nil {
+		return line
+	}
+	log.tail = append(log.tail, text)
+	if len(log.tail) > failedStageLines {
+		log.tail = log.tail[len(log.tail)-failedStageLines:]
+	}
+	return fmt.Sprintf("[%s %.1fs] %s", log.stage.Name, seconds, text)
+}
+
+// findStage returns the stage that runs instruction, a RUN instruction as
+// BuildKit shows it.
+func (w *buildLogWriter) findStage(instruction string) *BuildStage {
+	command := runCommand(instruction)
+	if command == "" {
+		return nil
+	}
+	for i, stage := range w.stages {
+		if runCommand(stage.Instruction) == command {
+			return &w.stages[i]
+		}
+	}
+	return nil
+}
+
+// failure returns an error with the last lines of output of the stage that
+// failed, if one did.
+func (w *buildLogWriter) failure() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed == nil {
+		return nil
+	}
+	if len(w.failed.tail) == 0 {
+		return fmt.Errorf("The %s step of the build failed", w.failed.stage.Name)
+	}
+	return fmt.Errorf("The %s step of the build failed. These are the last lines it printed:\n\n    %s", w.failed.stage.Name, strings.Join(w.failed.tail, "\n    "))
+}
+
+// runCommand returns the command of a RUN instruction, without its flags
+// like --mount, which are rewritten for cache scopes. Continued lines are
+// joined and whitespace is collapsed, as BuildKit shows it.
+func runCommand(instruction string) string {
+	fields := strings.Fields(strings.ReplaceAll(instruction, "\\\n", " "))
+	if len(fields) == 0 || fields[0] != "RUN" {
+		return ""
+	}
+	fields = fields[1:]
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		fields = fields[1:]
+	}
+	return strings.Join(fields, " ")
+}
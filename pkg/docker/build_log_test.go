@@ -0,0 +1,46 @@
+package docker
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildLogWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := newBuildLogWriter(out, []BuildStage{
+		{Name: "pip", Instruction: "RUN --mount=type=cache,target=/root/.cache/pip pip install -r /tmp/requirements.txt"},
+		{Name: "run 1/1", Instruction: "RUN python download.py"},
+	})
+	_, err := w.Write([]byte(`#5 [internal] load metadata
+#9 [stage-0 6/8] RUN --mount=type=cache,id=scope-pip,target=/root/.cache/pip pip install -r /tmp/requirements.txt
+#9 0.512 Collecting torch
+#9 DONE 12.3s
+#10 [stage-0 7/8] RUN python download.py
+#10 0.2`))
+	require.NoError(t, err)
+	_, err = w.Write([]byte(`01 Downloading weights
+#10 1.300 HTTPError: 404
+#10 ERROR: process "/bin/sh -c python download.py" did not complete successfully: exit code: 1
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, `#5 [internal] load metadata
+[pip] RUN --mount=type=cache,id=scope-pip,target=/root/.cache/pip pip install -r /tmp/requirements.txt
+[pip 0.5s] Collecting torch
+[pip] Done in 12.3s
+[run 1/1] RUN python download.py
+[run 1/1 0.2s] Downloading weights
+[run 1/1 1.3s] HTTPError: 404
+[run 1/1] ERROR: process "/bin/sh -c python download.py" did not complete successfully: exit code: 1
+`, out.String())
+	require.EqualError(t, w.failure(), "The run 1/1 step of the build failed. These are the last lines it printed:\n\n    Downloading weights\n    HTTPError: 404")
+}
+
+func TestBuildLogWriterSucceeded(t *testing.T) {
+	w := newBuildLogWriter(&bytes.Buffer{}, []BuildStage{{Name: "apt", Instruction: "RUN apt-get install -qqy ffmpeg"}})
+	_, err := w.Write([]byte("#4 [stage-0 3/5] RUN apt-get install -qqy ffmpeg\n#4 CACHED\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.failure())
+}
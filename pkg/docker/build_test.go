@@ -0,0 +1,34 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildProgress(t *testing.T) {
+	for progressOutput, expected := range map[string]string{
+		"auto":  "auto",
+		"plain": "plain",
+		"tty":   "tty",
+		"json":  "rawjson",
+	} {
+		progress, err := buildProgress(progressOutput)
+		require.NoError(t, err)
+		require.Equal(t, expected, progress)
+	}
+
+	_, err := buildProgress("rawjson")
+	require.ErrorContains(t, err, "--progress must be one of auto, plain, tty, json")
+}
+
+func TestBuildCommand(t *testing.T) {
+	require.Equal(t, []string{"build"}, buildCommand("", "", "plain"))
+	require.Equal(t, []string{"buildx", "build", "--platform", "linux/arm64", "--load"}, buildCommand("", "linux/arm64", "auto"))
+	require.Equal(t, []string{"buildx", "build", "--builder", "cog", "--load"}, buildCommand("cog", "", "tty"))
+	require.Equal(t, []string{"buildx", "build", "--builder", "cog", "--platform", "linux/arm64", "--load"}, buildCommand("cog", "linux/arm64", "plain"))
+
+	// The classic builder's --progress can't be rawjson
+	require.Equal(t, []string{"buildx", "build", "--load"}, buildCommand("", "", "rawjson"))
+	require.Equal(t, []string{"buildx", "build", "--platform", "linux/amd64", "--load"}, buildCommand("", "linux/amd64", "rawjson"))
+}
@@ -0,0 +1,108 @@
+package docker
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// IsCDIDevice returns whether device is a Container Device Interface (CDI)
+// device name, like nvidia.com/gpu=0, rather than a path like /dev/fuse.
+func IsCDIDevice(device string) bool {
+	kind, name, ok := strings.Cut(device, "=")
+	if !ok || name == "" || strings.HasPrefix(kind, "/") {
+		return false
+	}
+	vendor, class, ok := strings.Cut(kind, "/")
+	return ok && vendor != "" && class != ""
+}
+
+// isCDIGPU returns whether device is a CDI GPU, like nvidia.com/gpu=all
+func isCDIGPU(device string) bool {
+	if !IsCDIDevice(device) {
+		return false
+	}
+	kind, _, _ := strings.Cut(device, "=")
+	_, class, _ := strings.Cut(kind, "/")
+	return class == "gpu"
+}
+
+// cdiGPUDevices returns the CDI devices for the NVIDIA GPUs requested with
+// a --gpus value of gpus, like all or device=0,1.
+func cdiGPUDevices(gpus string) []string {
+	ids := strings.Split(strings.TrimPrefix(strings.Trim(gpus, `"`), "device="), ",")
+	if gpus == "all" {
+		ids = []string{"all"}
+	}
+	devices := []string{}
+	for _, id := range ids {
+		devices = append(devices, "nvidia.com/gpu="+id)
+	}
+	return devices
+}
+
+// GPUVendorAMD is the GPUVendor of AMD GPUs
+const GPUVendorAMD = "amd"
+
+// amdGPUArgs returns the arguments to docker run that give the container
+// all the AMD GPUs, which ROCm uses through the kernel driver's device and
+// the GPUs' render nodes.
+func amdGPUArgs() []string {
+	return []string{
+		"--device", "/dev/kfd",
+		"--device", "/dev/dri",
+		"--group-add", "video",
+		"--security-opt", "seccomp=unconfined",
+	}
+}
+
+var (
+	podmanOnce sync.Once
+	podman     bool
+)
+
+// isPodman returns whether the docker command is Podman, like when
+// podman-docker is installed.
+func isPodman() bool {
+	podmanOnce.Do(func() {
+		out, err := exec.Command("docker", "--version").Output()
+		if err != nil {
+			return
+		}
+		podman = strings.Contains(strings.ToLower(string(out)), "podman")
+		if podman {
+			console.Debugf("The docker command is Podman, so GPUs are requested as CDI devices")
+		}
+	})
+	return podman
+}
+
+// withEngineDevices returns options with GPUs requested as CDI devices if
+// the container engine is Podman, which doesn't support --gpus.
+func withEngineDevices(options RunOptions) RunOptions {
+	if options.GPUs == "" || options.GPUVendor == GPUVendorAMD || !isPodman() {
+		return options
+	}
+	options.Devices = append(append([]string{}, options.Devices...), cdiGPUDevices(options.GPUs)...)
+	options.GPUs = ""
+	return options
+}
+
+// BuilderHasGPU returns whether the buildx builder called builder, or the
+// default builder if it's empty, can give RUN instructions NVIDIA GPUs as
+// CDI devices.
+func BuilderHasGPU(builder string) bool {
+	args := []string{"buildx", "inspect"}
+	if builder != "" {
+		args = append(args, builder)
+	}
+	cmd := exec.Command("docker", args...)
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(out), "nvidia.com/gpu")
+}
@@ -0,0 +1,29 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// ImageDigest returns the digest of image in its registry, without pulling it.
+func ImageDigest(image string) (string, error) {
+	cmd := exec.Command("docker", "buildx", "imagetools", "inspect", "--format", "{{.Manifest.Digest}}", image)
+	cmd.Env = os.Environ()
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("Failed to resolve digest of %s: %s", image, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", fmt.Errorf("Failed to resolve digest of %s: %w", image, err)
+	}
+	digest := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("Unexpected digest for %s: %s", image, digest)
+	}
+	return digest, nil
+}
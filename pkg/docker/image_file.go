@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// ReadImageFile returns the contents of the file at path inside image, by
+// running a throwaway container from it. The image is pulled if necessary.
+func ReadImageFile(image string, path string) ([]byte, error) {
+	cmd := exec.Command("docker", "run", "--rm", "--entrypoint", "cat", image, path)
+	cmd.Env = os.Environ()
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("Failed to read %s from %s: %s", path, image, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("Failed to read %s from %s: %w", path, image, err)
+	}
+	return out, nil
+}
+
+// CopyImageDir copies the contents of the directory path in image to dest on
+// the host.
+func CopyImageDir(image string, path string, dest string) error {
+	cmd := exec.Command("docker", "run", "--rm",
+		"--mount", "type=bind,source="+dest+",destination=/cog-copy",
+		"--entrypoint", "cp", image, "-a", path+"/.", "/cog-copy")
+	cmd.Env = os.Environ()
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to copy %s from %s: %s", path, image, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// LayerSizes returns the uncompressed size of each layer in image, from the
+// base image up. Layers that don't change the filesystem are size 0.
+func LayerSizes(image string) ([]int64, error) {
+	cmd := exec.Command("docker", "history", "--no-trunc", "--human=false", "--format", "{{json .Size}}", image)
+	cmd.Env = os.Environ()
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("Failed to get history of %s: %s", image, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("Failed to get history of %s: %w", image, err)
+	}
+	sizes := []int64{}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	// docker history lists the newest layer first
+	for i := len(lines) - 1; i >= 0; i-- {
+		var size string
+		if err := json.Unmarshal([]byte(lines[i]), &size); err != nil {
+			return nil, fmt.Errorf("Failed to parse history of %s: %w", image, err)
+		}
+		var n int64
+		if _, err := fmt.Sscan(size, &n); err != nil {
+			return nil, fmt.Errorf("Failed to parse layer size %q of %s: %w", size, image, err)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
@@ -0,0 +1,375 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	containerdconsole "github.com/containerd/console"
+	"github.com/containerd/containerd/platforms"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/moby/buildkit/client"
+	_ "github.com/moby/buildkit/client/connhelper/dockercontainer" // for builders that run in a container
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"github.com/moby/buildkit/util/apicaps"
+	"github.com/moby/buildkit/util/progress/progressui"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/replicate/cog/pkg/util"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// Backends are the ways a model can be built. dockerfile builds the
+// generated Dockerfile with docker build. llb has Cog convert the model's
+// stages to LLB, the graph of operations BuildKit runs, and has BuildKit
+// solve that directly, so the build doesn't depend on the Dockerfile
+// frontend image or the version of docker build.
+var Backends = []string{"dockerfile", "llb"}
+
+// contextLocalName is the name the project directory is sent to BuildKit as
+const contextLocalName = "context"
+
+// LLBBuild is what converting a model to LLB needs from the build it's run
+// in.
+type LLBBuild struct {
+	// Platform is the platform the image is built for
+	Platform ocispecs.Platform
+	// Resolver resolves the configs of images, with the registry
+	// credentials Docker has
+	Resolver llb.ImageMetaResolver
+	// Context is the project directory, without what's excluded from the
+	// build context
+	Context llb.State
+	// NoCache builds every step without the cache
+	NoCache bool
+	// Caps are what the builder's LLB can use, or nil if they aren't known
+	Caps *apicaps.CapSet
+}
+
+// LLBConverter converts a model to LLB for build, and returns it with the
+// config of the image it builds, in the format of Docker's image config.
+type LLBConverter func(ctx context.Context, build LLBBuild) (*llb.Definition, []byte, error)
+
+// BuildLLB builds the LLB convert returns with BuildKit, on opts.Builder or
+// Docker's own BuildKit, and tags it imageName. It's like Build, but
+// BuildKit runs what Cog converted the model to instead of the Dockerfile
+// frontend.
+func BuildLLB(dir string, convert LLBConverter, imageName string, progressOutput string, opts BuildOptions) error {
+	progress, err := buildProgress(progressOutput)
+	if err != nil {
+		return err
+	}
+	builder, err := opts.builder()
+	if err != nil {
+		return err
+	}
+	platform := opts.Platform
+	if platform == "" && util.IsM1Mac(runtime.GOOS, runtime.GOARCH) {
+		platform = "linux/amd64"
+	}
+	var out io.Writer = os.Stderr
+	logWriter := newStageLogWriter(progressOutput, opts.Stages)
+	if logWriter != nil {
+		out = logWriter
+	}
+	return stageFailure(buildLLB(dir, convert, imageName, progress, builder, platform, out, opts), logWriter)
+}
+
+func buildLLB(dir string, convert LLBConverter, imageName string, progress string, builder string, platform string, out io.Writer, opts BuildOptions) error {
+	ctx := context.Background()
+	c, daemon, err := buildkitClient(ctx, builder)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var targetPlatform *ocispecs.Platform
+	if platform != "" {
+		p, err := platforms.Parse(platform)
+		if err != nil {
+			return err
+		}
+		targetPlatform = &p
+	}
+	excludes, err := contextExcludes(dir, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	attachables, err := sessionAttachables(opts.SSH)
+	if err != nil {
+		return err
+	}
+	solveOpt := client.SolveOpt{
+		LocalDirs:    map[string]string{contextLocalName: dir},
+		CacheExports: []client.CacheOptionsEntry{{Type: "inline"}},
+		Session:      attachables,
+	}
+
+	// Docker's own BuildKit can put images straight into Docker. Other
+	// builders export them as a tarball, which is loaded into Docker.
+	var load *dockerLoad
+	if daemon {
+		solveOpt.Exports = []client.ExportEntry{{Type: "moby", Attrs: map[string]string{"name": imageName}}}
+	} else {
+		if load, err = startDockerLoad(); err != nil {
+			return err
+		}
+		solveOpt.Exports = []client.ExportEntry{{
+			Type:  client.ExporterDocker,
+			Attrs: map[string]string{"name": imageName},
+			Output: func(map[string]string) (io.WriteCloser, error) {
+				return load.stdin, nil
+			},
+		}}
+	}
+
+	console.Debugf("Building %s with LLB on %s", imageName, builderName(builder))
+	ch := make(chan *client.SolveStatus)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := c.Build(ctx, solveOpt, "cog", func(ctx context.Context, gw gateway.Client) (*gateway.Result, error) {
+			build := llbBuild(gw.BuildOpts(), targetPlatform, excludes, opts.NoCache)
+			build.Resolver = gw
+			return solveLLB(ctx, gw, convert, build)
+		}, ch)
+		return err
+	})
+	eg.Go(func() error {
+		return displayProgress(progress, out, ch)
+	})
+	err = eg.Wait()
+	if load != nil {
+		loadErr := load.wait()
+		if err == nil && loadErr != nil {
+			return fmt.Errorf("Failed to load image into Docker: %w", loadErr)
+		}
+	}
+	return err
+}
+
+// llbBuild returns what a model is converted to LLB with, in a build on a
+// builder with buildOpts. The image is built for platform, or the platform
+// of the builder if it's nil.
+func llbBuild(buildOpts gateway.BuildOpts, platform *ocispecs.Platform, excludes []string, noCache bool) LLBBuild {
+	build := LLBBuild{
+		Context: llb.Local(contextLocalName,
+			llb.SessionID(buildOpts.SessionID),
+			llb.ExcludePatterns(excludes),
+			llb.SharedKeyHint(contextLocalName),
+			llb.WithCustomName("[internal] load build context"),
+		),
+		NoCache: noCache,
+		Caps:    &buildOpts.LLBCaps,
+	}
+	switch {
+	case platform != nil:
+		build.Platform = *platform
+	case len(buildOpts.Workers) > 0 && len(buildOpts.Workers[0].Platforms) > 0:
+		build.Platform = buildOpts.Workers[0].Platforms[0]
+	default:
+		build.Platform = platforms.DefaultSpec()
+		build.Platform.OS = "linux"
+	}
+	return build
+}
+
+// solveLLB is run by BuildKit's gateway to build what convert returns.
+func solveLLB(ctx context.Context, gw gateway.Client, convert LLBConverter, build LLBBuild) (*gateway.Result, error) {
+	def, config, err := convert(ctx, build)
+	if err != nil {
+		return nil, err
+	}
+	res, err := gw.Solve(ctx, gateway.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return nil, err
+	}
+	res.AddMeta(exptypes.ExporterImageConfigKey, config)
+	return res, nil
+}
+
+// contextExcludes returns the patterns in the .dockerignore in dir, as well
+// as exclude, which are left out of the build context.
+func contextExcludes(dir string, exclude []string) ([]string, error) {
+	var excludes []string
+	f, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		if excludes, err = dockerignore.ReadAll(f); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range exclude {
+		excludes = append(excludes, escapeDockerignorePattern(path))
+	}
+	return excludes, nil
+}
+
+// sessionAttachables returns what the build can use from the machine Cog
+// runs on: Docker's registry credentials, and the SSH agent or keys in ssh,
+// in the format of docker build --ssh.
+func sessionAttachables(ssh string) ([]session.Attachable, error) {
+	attachables := []session.Attachable{authprovider.NewDockerAuthProvider(os.Stderr)}
+	if ssh == "" {
+		return attachables, nil
+	}
+	id, paths, _ := strings.Cut(ssh, "=")
+	config := sshprovider.AgentConfig{ID: id}
+	if paths != "" {
+		config.Paths = strings.Split(paths, ",")
+	}
+	agent, err := sshprovider.NewSSHAgentProvider([]sshprovider.AgentConfig{config})
+	if err != nil {
+		return nil, err
+	}
+	return append(attachables, agent), nil
+}
+
+// displayProgress shows the progress of a build from ch on out, like docker
+// build does with progress.
+func displayProgress(progress string, out io.Writer, ch chan *client.SolveStatus) error {
+	if progress == "rawjson" {
+		enc := json.NewEncoder(out)
+		var err error
+		for status := range ch {
+			if err == nil {
+				err = enc.Encode(status)
+			}
+		}
+		return err
+	}
+	var c containerdconsole.Console
+	if progress != "plain" {
+		// With auto, the output is plain if it isn't a terminal
+		if cons, err := containerdconsole.ConsoleFromFile(os.Stderr); err == nil {
+			c = cons
+		}
+	}
+	// The build's context isn't used, so the last updates are shown if it's
+	// cancelled
+	_, err := progressui.DisplaySolveStatus(context.TODO(), "", c, out, ch)
+	return err
+}
+
+// buildkitClient connects to BuildKit on builder, or Docker's own if it's
+// empty. It returns whether it's Docker's own, which builds into Docker's
+// image store.
+func buildkitClient(ctx context.Context, builder string) (*client.Client, bool, error) {
+	if builder != "" {
+		driver, node, err := inspectBuilder(builder)
+		if err != nil {
+			return nil, false, err
+		}
+		switch driver {
+		case "docker":
+		case "docker-container":
+			c, err := client.New(ctx, "docker-container://buildx_buildkit_"+node)
+			return c, false, err
+		default:
+			return nil, false, fmt.Errorf("--backend llb can only build on Docker or builders with the docker-container driver, but %s has the %s driver", builder, driver)
+		}
+	}
+
+	api, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := client.New(ctx, "",
+		client.WithFailFast(),
+		client.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return api.DialHijack(ctx, "/grpc", "h2c", nil)
+		}),
+		client.WithSessionDialer(func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+			return api.DialHijack(ctx, "/session", proto, meta)
+		}),
+	)
+	return c, true, err
+}
+
+// inspectBuilder returns the driver of a buildx builder, and the name of
+// its first node.
+func inspectBuilder(builder string) (driver string, node string, err error) {
+	cmd := exec.Command("docker", "buildx", "inspect", builder)
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to inspect builder %s: %s", builder, strings.TrimSpace(string(out)))
+	}
+	driver, node = parseBuildxInspect(string(out))
+	return driver, node, nil
+}
+
+// parseBuildxInspect returns the driver and the name of the first node from
+// the output of docker buildx inspect, which has the builder's name and
+// driver, then a section for each of its nodes.
+func parseBuildxInspect(out string) (driver string, node string) {
+	inNodes := false
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case key == "Nodes":
+			inNodes = true
+		case key == "Driver" && driver == "":
+			driver = value
+		case key == "Name" && inNodes && node == "":
+			node = value
+		}
+	}
+	return driver, node
+}
+
+// builderName returns how builder is shown in messages
+func builderName(builder string) string {
+	if builder == "" {
+		return "Docker"
+	}
+	return "builder " + builder
+}
+
+// dockerLoad loads an image tarball that's written to it into Docker
+type dockerLoad struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func startDockerLoad() (*dockerLoad, error) {
+	cmd := exec.Command("docker", "load")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &dockerLoad{cmd: cmd, stdin: stdin}, nil
+}
+
+// wait waits for the image to be loaded. BuildKit closes stdin when it has
+// written the image, but it's closed here too in case the build failed.
+func (l *dockerLoad) wait() error {
+	_ = l.stdin.Close()
+	return l.cmd.Wait()
+}
@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextExcludes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.ckpt\n"), 0o644))
+
+	excludes, err := contextExcludes(dir, []string{"weights/[a].bin"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"*.ckpt", `weights/\[a\].bin`}, excludes)
+
+	excludes, err = contextExcludes(t.TempDir(), nil)
+	require.NoError(t, err)
+	require.Empty(t, excludes)
+}
+
+func TestLLBBuild(t *testing.T) {
+	arm := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+	buildOpts := gateway.BuildOpts{
+		SessionID: "session",
+		Workers:   []gateway.WorkerInfo{{Platforms: []ocispecs.Platform{{OS: "linux", Architecture: "amd64"}}}},
+	}
+
+	build := llbBuild(buildOpts, &arm, nil, true)
+	require.Equal(t, arm, build.Platform)
+	require.True(t, build.NoCache)
+	require.NotNil(t, build.Caps)
+
+	// The image is built for the builder's platform if there isn't one
+	build = llbBuild(buildOpts, nil, nil, false)
+	require.Equal(t, "amd64", build.Platform.Architecture)
+	require.False(t, build.NoCache)
+
+	build = llbBuild(gateway.BuildOpts{}, nil, nil, false)
+	require.Equal(t, "linux", build.Platform.OS)
+}
+
+func TestParseBuildxInspect(t *testing.T) {
+	driver, node := parseBuildxInspect(`Name:          cog-8cpu
+Driver:        docker-container
+Last Activity: 2024-05-01 10:00:00 +0000 UTC
+
+Nodes:
+Name:      cog-8cpu0
+Endpoint:  unix:///var/run/docker.sock
+Status:    running
+Platforms: linux/amd64, linux/arm64
+`)
+	require.Equal(t, "docker-container", driver)
+	require.Equal(t, "cog-8cpu0", node)
+
+	driver, node = parseBuildxInspect("Name:   default\nDriver: docker\n\nNodes:\nName:      default\n")
+	require.Equal(t, "docker", driver)
+	require.Equal(t, "default", node)
+}
@@ -1,15 +1,15 @@
 package docker
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
 
 	"github.com/docker/cli/cli/config"
-	"github.com/docker/cli/cli/config/configfile"
-	"github.com/docker/cli/cli/config/types"
 	"github.com/replicate/cog/pkg/util/console"
 )
 
@@ -19,27 +19,146 @@ type credentialHelperInput struct {
 	ServerURL string
 }
 
-func SaveLoginToken(registryHost string, username string, token string) error {
+// keychainHelpers are the Docker credential helpers that keep credentials
+// in the OS keychain, by GOOS
+var keychainHelpers = map[string]string{
+	"darwin":  "osxkeychain",
+	"linux":   "secretservice",
+	"windows": "wincred",
+}
+
+// DefaultCredentialHelper returns the Docker credential helper that keeps
+// secrets that aren't for a particular registry: the credsStore in Docker's
+// config.json, or else the one for the OS keychain if it's installed.
+// Cog's own helper isn't a keychain, so it isn't returned.
+func DefaultCredentialHelper() (string, bool) {
 	conf := config.LoadDefaultConfigFile(os.Stderr)
-	credsStore := conf.CredentialsStore
-	if credsStore == "" {
-		return saveAuthToConfig(conf, registryHost, username, token)
+	if conf.CredentialsStore != "" && conf.CredentialsStore != CogCredentialHelper {
+		return conf.CredentialsStore, true
+	}
+	helper, ok := keychainHelpers[runtime.GOOS]
+	if !ok {
+		return "", false
 	}
-	return saveAuthToCredentialsStore(credsStore, registryHost, username, token)
+	if _, err := exec.LookPath("docker-credential-" + helper); err != nil {
+		return "", false
+	}
+	return helper, true
 }
 
-func saveAuthToConfig(conf *configfile.ConfigFile, registryHost string, username string, token string) error {
-	// conf.Save() will base64 encode username and password
-	conf.AuthConfigs[registryHost] = types.AuthConfig{
-		Username: username,
-		Password: token,
+// CogCredentialHelper is the name of the credential helper Cog runs as when
+// it's installed as docker-credential-cog, which keeps credentials in an
+// encrypted file on machines without a keychain
+const CogCredentialHelper = "cog"
+
+// KeychainHelper returns the Docker credential helper that keeps credentials
+// for registryHost: the one set for it in Docker's config.json, or the one
+// for the OS keychain if it's installed. It's an error if there isn't one,
+// so callers don't fall back to keeping secrets in plaintext.
+func KeychainHelper(registryHost string) (string, error) {
+	conf := config.LoadDefaultConfigFile(os.Stderr)
+	if helper, ok := conf.CredentialHelpers[registryHost]; ok && helper != CogCredentialHelper {
+		return helper, nil
+	}
+	if helper, ok := DefaultCredentialHelper(); ok {
+		return helper, nil
+	}
+	helper, ok := keychainHelpers[runtime.GOOS]
+	if !ok {
+		return "", fmt.Errorf("There's no credential helper to keep the credentials for %s in. Set credsStore in Docker's config.json", registryHost)
+	}
+	return "", fmt.Errorf("There's no credential helper to keep the credentials for %s in the OS keychain. Install docker-credential-%s, or set credsStore in Docker's config.json", registryHost, helper)
+}
+
+// SaveLoginTokenToKeychain saves the token as the Docker credentials for
+// registryHost, but fails rather than keeping it in plaintext in Docker's
+// config.json.
+func SaveLoginTokenToKeychain(registryHost string, username string, token string) error {
+	helper, err := KeychainHelper(registryHost)
+	if err != nil {
+		return err
+	}
+	if err := StoreCredential(helper, registryHost, username, token); err != nil {
+		return err
+	}
+	return SetCredentialHelper(registryHost, helper)
+}
+
+// SetCredentialHelper sets the credential helper Docker gets the
+// credentials for registryHost from in config.json, unless it already gets
+// them from it.
+func SetCredentialHelper(registryHost string, helper string) error {
+	conf := config.LoadDefaultConfigFile(os.Stderr)
+	if conf.CredentialHelpers[registryHost] == helper {
+		return nil
 	}
+	if conf.CredentialsStore == helper {
+		if _, ok := conf.CredentialHelpers[registryHost]; !ok {
+			return nil
+		}
+	}
+	if conf.CredentialHelpers == nil {
+		conf.CredentialHelpers = map[string]string{}
+	}
+	conf.CredentialHelpers[registryHost] = helper
+	// Credentials saved by docker login before take precedence otherwise
+	delete(conf.AuthConfigs, registryHost)
 	if err := conf.Save(); err != nil {
 		return fmt.Errorf("Failed to save Docker config.json: %w", err)
 	}
 	return nil
 }
 
+// StoreCredential keeps a secret for serverURL with the credential helper.
+// serverURL doesn't need to be a registry, so helpers can keep other secrets
+// too.
+func StoreCredential(helper string, serverURL string, username string, secret string) error {
+	return saveAuthToCredentialsStore(helper, serverURL, username, secret)
+}
+
+// GetCredential returns the secret the credential helper keeps for
+// serverURL. ok is false if it doesn't have one.
+func GetCredential(helper string, serverURL string) (username string, secret string, ok bool, err error) {
+	binary := "docker-credential-" + helper
+	cmd := exec.Command(binary, "get")
+	cmd.Env = os.Environ()
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		// Helpers print this on stdout when they don't have the credentials
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return "", "", false, nil
+		}
+		return "", "", false, fmt.Errorf("Failed to run %s: %w", binary, err)
+	}
+	output := credentialHelperInput{}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return "", "", false, fmt.Errorf("Failed to parse the output of %s: %w", binary, err)
+	}
+	return output.Username, output.Secret, true, nil
+}
+
+// EraseCredential removes the secret the credential helper keeps for
+// serverURL, if it has one.
+func EraseCredential(helper string, serverURL string) error {
+	binary := "docker-credential-" + helper
+	cmd := exec.Command(binary, "erase")
+	cmd.Env = os.Environ()
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return nil
+		}
+		return fmt.Errorf("Failed to run %s: %w", binary, err)
+	}
+	return nil
+}
+
 func saveAuthToCredentialsStore(credsStore string, registryHost string, username string, token string) error {
 	binary := "docker-credential-" + credsStore
 	input := credentialHelperInput{
@@ -0,0 +1,161 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// Descriptor is an OCI content descriptor, which references a manifest from
+// an image index.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String returns the platform like linux/arm64/v8
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ManifestDescriptor returns a descriptor for the manifest of image, which
+// must already be pushed to a registry.
+func ManifestDescriptor(image string) (*Descriptor, error) {
+	out, err := rawManifest(image)
+	if err != nil {
+		return nil, err
+	}
+	return manifestDescriptor(image, out)
+}
+
+// manifestDescriptor returns a descriptor for out, the raw manifest of image.
+func manifestDescriptor(image string, out []byte) (*Descriptor, error) {
+	manifest := struct {
+		MediaType string `json:"mediaType"`
+	}{}
+	if err := json.Unmarshal(out, &manifest); err != nil {
+		return nil, fmt.Errorf("Failed to parse manifest of %s: %w", image, err)
+	}
+	if manifest.MediaType == "" {
+		return nil, fmt.Errorf("Manifest of %s has no media type", image)
+	}
+	return &Descriptor{
+		MediaType: manifest.MediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(out)),
+		Size:      int64(len(out)),
+	}, nil
+}
+
+// ManifestLayers returns the layers of image, which must already be pushed
+// to a registry, from the base image up. Their sizes are compressed, as
+// they're stored in the registry. If image is an image index, the layers of
+// its linux/amd64 image are returned.
+func ManifestLayers(image string) ([]Descriptor, error) {
+	out, err := rawManifest(image)
+	if err != nil {
+		return nil, err
+	}
+	manifest := struct {
+		Layers    []Descriptor `json:"layers"`
+		Manifests []Descriptor `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(out, &manifest); err != nil {
+		return nil, fmt.Errorf("Failed to parse manifest of %s: %w", image, err)
+	}
+	if len(manifest.Manifests) == 0 {
+		return manifest.Layers, nil
+	}
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
+			return ManifestLayers(repository(image) + "@" + m.Digest)
+		}
+	}
+	return nil, fmt.Errorf("%s is an image index without a linux/amd64 image", image)
+}
+
+// rawManifest returns the manifest of image from the registry it's pushed to.
+func rawManifest(image string) ([]byte, error) {
+	cmd := exec.Command("docker", "buildx", "imagetools", "inspect", "--raw", image)
+	cmd.Env = os.Environ()
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("Failed to inspect manifest of %s: %s", image, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("Failed to inspect manifest of %s: %w", image, err)
+	}
+	return out, nil
+}
+
+// repository returns image without its tag or digest.
+func repository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+// CreateImageIndex creates an image index (also known as a manifest list)
+// from descriptors, and pushes it as tag. The descriptors must reference
+// manifests in the same repository as tag.
+func CreateImageIndex(tag string, descriptors []*Descriptor) error {
+	tmpDir, err := os.MkdirTemp("", "cog-index")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	args, err := imageIndexArgs(tmpDir, tag, descriptors)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("docker", args...)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stderr // redirect stdout to stderr - it's all progress output
+	cmd.Stderr = os.Stderr
+
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	return cmd.Run()
+}
+
+// imageIndexArgs returns the arguments of docker that push an image index
+// of descriptors as tag. Each descriptor is written to a file in tmpDir, so
+// its platform and annotations are kept.
+func imageIndexArgs(tmpDir string, tag string, descriptors []*Descriptor) ([]string, error) {
+	args := []string{"buildx", "imagetools", "create", "--tag", tag}
+	for i, descriptor := range descriptors {
+		contents, err := json.Marshal(descriptor)
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(tmpDir, fmt.Sprintf("descriptor-%d.json", i))
+		if err := os.WriteFile(p, contents, 0o644); err != nil {
+			return nil, err
+		}
+		args = append(args, "--file", p)
+	}
+	return args, nil
+}
@@ -0,0 +1,49 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestDescriptor(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`)
+	descriptor, err := manifestDescriptor("r8.im/user/model", manifest)
+	require.NoError(t, err)
+	require.Equal(t, "application/vnd.docker.distribution.manifest.v2+json", descriptor.MediaType)
+	require.Equal(t, fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)), descriptor.Digest)
+	require.Equal(t, int64(len(manifest)), descriptor.Size)
+
+	_, err = manifestDescriptor("r8.im/user/model", []byte(`{"schemaVersion":2}`))
+	require.ErrorContains(t, err, "has no media type")
+	_, err = manifestDescriptor("r8.im/user/model", []byte(`not json`))
+	require.ErrorContains(t, err, "Failed to parse manifest")
+}
+
+func TestImageIndexArgs(t *testing.T) {
+	descriptors := []*Descriptor{
+		{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: "sha256:aaa", Size: 10, Platform: &Platform{OS: "linux", Architecture: "amd64"}, Annotations: map[string]string{"run.cog.gpu": "true"}},
+		{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: "sha256:bbb", Size: 20, Platform: &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+	}
+	args, err := imageIndexArgs(t.TempDir(), "r8.im/user/model", descriptors)
+	require.NoError(t, err)
+	require.Equal(t, []string{"buildx", "imagetools", "create", "--tag", "r8.im/user/model", "--file", args[6], "--file", args[8]}, args)
+
+	// Each descriptor is written with its platform and annotations
+	for i, descriptor := range descriptors {
+		contents, err := os.ReadFile(args[6+2*i])
+		require.NoError(t, err)
+		written := &Descriptor{}
+		require.NoError(t, json.Unmarshal(contents, written))
+		require.Equal(t, descriptor, written)
+	}
+}
+
+func TestPlatformString(t *testing.T) {
+	require.Equal(t, "linux/amd64", Platform{OS: "linux", Architecture: "amd64"}.String())
+	require.Equal(t, "linux/arm64/v8", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}.String())
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
@@ -17,3 +18,21 @@ func Push(image string) error {
 	console.Debug("$ " + strings.Join(cmd.Args, " "))
 	return cmd.Run()
 }
+
+// PushCompressed pushes image with its layers compressed with compression,
+// like "zstd", at level, or the default level if it's 0. docker push
+// pushes layers as they're stored, so BuildKit recompresses them instead,
+// which needs Docker's containerd image store.
+func PushCompressed(image string, compression string, level int) error {
+	output := fmt.Sprintf("type=image,name=%s,push=true,compression=%s,force-compression=true", image, compression)
+	if level != 0 {
+		output += fmt.Sprintf(",compression-level=%d", level)
+	}
+	cmd := exec.Command("docker", "buildx", "build", "--file", "-", "--output", output, ".")
+	cmd.Stdin = strings.NewReader("FROM " + image)
+	cmd.Stdout = os.Stderr // redirect stdout to stderr - build output is all messaging
+	cmd.Stderr = os.Stderr
+
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	return cmd.Run()
+}
@@ -17,20 +17,47 @@ import (
 )
 
 type Port struct {
+	// HostIP is the address on the host to publish the port on, which can
+	// be IPv4 or IPv6. If it's empty, it's published on all addresses.
+	HostIP        string
 	HostPort      int
 	ContainerPort int
 }
 
+// publishArg returns the argument to --publish for the port.
+func (p Port) publishArg() string {
+	if p.HostIP == "" {
+		return fmt.Sprintf("%d:%d", p.HostPort, p.ContainerPort)
+	}
+	hostPort := ""
+	if p.HostPort != 0 {
+		hostPort = strconv.Itoa(p.HostPort)
+	}
+	return fmt.Sprintf("%s:%d", net.JoinHostPort(p.HostIP, hostPort), p.ContainerPort)
+}
+
 type Volume struct {
 	Source      string
 	Destination string
+	ReadOnly    bool
 }
 
 type RunOptions struct {
-	Args    []string
+	Args []string
+	// CPUs limits how many CPUs the container can use
+	CPUs float64
+	// Devices are passed to --device. They can be paths, or CDI device
+	// names like nvidia.com/gpu=0. CDI GPUs are requested instead of GPUs.
+	Devices []string
 	Env     []string
 	GPUs    string
-	Image   string
+	// GPUVendor is the vendor of the GPUs in GPUs: nvidia, the default, or
+	// amd, whose GPUs are given to the container as their ROCm devices
+	GPUVendor string
+	Image     string
+	// Memory limits the memory the container can use, in bytes. It can't
+	// use swap beyond it.
+	Memory  int64
 	Ports   []Port
 	Volumes []Volume
 	Workdir string
@@ -46,6 +73,8 @@ type internalRunOptions struct {
 
 var ErrMissingDeviceDriver = errors.New("Docker is missing required device driver")
 
+var ErrUnresolvableCDIDevice = errors.New("The container engine couldn't find the CDI device. Generate a CDI specification for your GPUs, e.g. with 'nvidia-ctk cdi generate --output=/etc/cdi/nvidia.yaml'")
+
 func generateDockerArgs(options internalRunOptions) []string {
 	// Use verbose options for clarity
 	dockerArgs := []string{
@@ -55,20 +84,38 @@ func generateDockerArgs(options internalRunOptions) []string {
 		// TODO: relative to pwd and cog.yaml
 	}
 
+	if options.CPUs > 0 {
+		dockerArgs = append(dockerArgs, "--cpus", strconv.FormatFloat(options.CPUs, 'f', -1, 64))
+	}
 	if options.Detach {
 		dockerArgs = append(dockerArgs, "--detach")
 	}
 	for _, env := range options.Env {
 		dockerArgs = append(dockerArgs, "--env", env)
 	}
-	if options.GPUs != "" {
-		dockerArgs = append(dockerArgs, "--gpus", options.GPUs)
+	cdiGPUs := false
+	for _, device := range options.Devices {
+		dockerArgs = append(dockerArgs, "--device", device)
+		if isCDIGPU(device) {
+			cdiGPUs = true
+		}
+	}
+	if options.GPUs != "" && !cdiGPUs {
+		if options.GPUVendor == GPUVendorAMD {
+			dockerArgs = append(dockerArgs, amdGPUArgs()...)
+		} else {
+			dockerArgs = append(dockerArgs, "--gpus", options.GPUs)
+		}
 	}
 	if options.Interactive {
 		dockerArgs = append(dockerArgs, "--interactive")
 	}
+	if options.Memory > 0 {
+		memory := strconv.FormatInt(options.Memory, 10)
+		dockerArgs = append(dockerArgs, "--memory", memory, "--memory-swap", memory)
+	}
 	for _, port := range options.Ports {
-		dockerArgs = append(dockerArgs, "--publish", fmt.Sprintf("%d:%d", port.HostPort, port.ContainerPort))
+		dockerArgs = append(dockerArgs, "--publish", port.publishArg())
 	}
 	if options.TTY {
 		dockerArgs = append(dockerArgs, "--tty")
@@ -76,7 +123,11 @@ func generateDockerArgs(options internalRunOptions) []string {
 	for _, volume := range options.Volumes {
 		// This needs escaping if we want to support commas in filenames
 		// https://github.com/moby/moby/issues/8604
-		dockerArgs = append(dockerArgs, "--mount", "type=bind,source="+volume.Source+",destination="+volume.Destination)
+		mount := "type=bind,source=" + volume.Source + ",destination=" + volume.Destination
+		if volume.ReadOnly {
+			mount += ",readonly"
+		}
+		dockerArgs = append(dockerArgs, "--mount", mount)
 	}
 	if options.Workdir != "" {
 		dockerArgs = append(dockerArgs, "--workdir", options.Workdir)
@@ -91,7 +142,7 @@ func Run(options RunOptions) error {
 }
 
 func RunWithIO(options RunOptions, stdin io.Reader, stdout, stderr io.Writer) error {
-	internalOptions := internalRunOptions{RunOptions: options}
+	internalOptions := internalRunOptions{RunOptions: withEngineDevices(options)}
 	if stdin != nil {
 		internalOptions.Interactive = true
 		if f, ok := stdin.(*os.File); ok {
@@ -114,13 +165,16 @@ func RunWithIO(options RunOptions, stdin io.Reader, stdout, stderr io.Writer) er
 		if strings.Contains(stderrCopy.String(), "could not select device driver") {
 			return ErrMissingDeviceDriver
 		}
+		if strings.Contains(stderrCopy.String(), "unresolvable CDI devices") {
+			return ErrUnresolvableCDIDevice
+		}
 		return err
 	}
 	return nil
 }
 
 func RunDaemon(options RunOptions) (string, error) {
-	internalOptions := internalRunOptions{RunOptions: options}
+	internalOptions := internalRunOptions{RunOptions: withEngineDevices(options)}
 	internalOptions.Detach = true
 
 	dockerArgs := generateDockerArgs(internalOptions)
@@ -138,6 +192,9 @@ func RunDaemon(options RunOptions) (string, error) {
 	return strings.TrimSpace(string(containerID)), nil
 }
 
+// GetPort returns the host port that containerPort is published on. On
+// hosts with IPv6, it is published on both 0.0.0.0 and [::], and on hosts
+// that only have IPv6, only on [::].
 func GetPort(containerID string, containerPort int) (int, error) {
 	cmd := exec.Command("docker", "port", containerID, fmt.Sprintf("%d", containerPort))
 	cmd.Env = os.Environ()
@@ -147,22 +204,18 @@ func GetPort(containerID string, containerPort int) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	return parsePortOutput(output)
+}
 
-	lines := []string{}
+func parsePortOutput(output []byte) (int, error) {
 	scanner := bufio.NewScanner(bytes.NewReader(output))
 	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-	if scanner.Err() != nil {
-		return 0, err
-	}
-
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "0.0.0.0:") {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
 			continue
 		}
 
-		_, portString, err := net.SplitHostPort(strings.TrimSpace(line))
+		_, portString, err := net.SplitHostPort(line)
 		if err != nil {
 			return 0, err
 		}
@@ -174,7 +227,9 @@ func GetPort(containerID string, containerPort int) (int, error) {
 
 		return port, nil
 	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
 
-	return 0, fmt.Errorf("did not find port bound to 0.0.0.0 in `docker port` output")
-
+	return 0, fmt.Errorf("did not find a published port in `docker port` output")
 }
@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishArg(t *testing.T) {
+	require.Equal(t, "0:5000", Port{ContainerPort: 5000}.publishArg())
+	require.Equal(t, "8080:5000", Port{HostPort: 8080, ContainerPort: 5000}.publishArg())
+	require.Equal(t, "127.0.0.1:8080:5000", Port{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 5000}.publishArg())
+	require.Equal(t, "[::]:8080:5000", Port{HostIP: "::", HostPort: 8080, ContainerPort: 5000}.publishArg())
+	require.Equal(t, "[::1]::5000", Port{HostIP: "::1", ContainerPort: 5000}.publishArg())
+}
+
+func TestParsePortOutput(t *testing.T) {
+	port, err := parsePortOutput([]byte("0.0.0.0:49153\n[::]:49153\n"))
+	require.NoError(t, err)
+	require.Equal(t, 49153, port)
+
+	// IPv6-only hosts
+	port, err = parsePortOutput([]byte("[::]:49154\n"))
+	require.NoError(t, err)
+	require.Equal(t, 49154, port)
+
+	_, err = parsePortOutput([]byte(""))
+	require.Error(t, err)
+}
+
+func TestGenerateDockerArgsReadOnlyVolume(t *testing.T) {
+	args := generateDockerArgs(internalRunOptions{RunOptions: RunOptions{
+		Image:   "my-model",
+		Volumes: []Volume{{Source: "/var/lib/cog/weights", Destination: "/src/weights", ReadOnly: true}},
+	}})
+	require.Contains(t, args, "type=bind,source=/var/lib/cog/weights,destination=/src/weights,readonly")
+}
+
+func TestGenerateDockerArgsDevices(t *testing.T) {
+	args := generateDockerArgs(internalRunOptions{RunOptions: RunOptions{
+		Image:   "my-model",
+		GPUs:    "all",
+		Devices: []string{"/dev/fuse"},
+	}})
+	require.Contains(t, strings.Join(args, " "), "--device /dev/fuse --gpus all")
+
+	args = generateDockerArgs(internalRunOptions{RunOptions: RunOptions{
+		Image:   "my-model",
+		GPUs:    "all",
+		Devices: []string{"nvidia.com/gpu=0"},
+	}})
+	require.Contains(t, strings.Join(args, " "), "--device nvidia.com/gpu=0")
+	require.NotContains(t, args, "--gpus")
+
+	args = generateDockerArgs(internalRunOptions{RunOptions: RunOptions{
+		Image:     "my-model",
+		GPUs:      "all",
+		GPUVendor: GPUVendorAMD,
+	}})
+	require.Contains(t, strings.Join(args, " "), "--device /dev/kfd --device /dev/dri --group-add video")
+	require.NotContains(t, args, "--gpus")
+}
+
+func TestCDIDevices(t *testing.T) {
+	require.True(t, IsCDIDevice("nvidia.com/gpu=0"))
+	require.True(t, IsCDIDevice("amd.com/gpu=all"))
+	require.False(t, IsCDIDevice("/dev/fuse"))
+	require.False(t, IsCDIDevice("/dev/sda:/dev/xvda:rwm"))
+	require.False(t, IsCDIDevice("nvidia.com/gpu="))
+	require.True(t, isCDIGPU("nvidia.com/gpu=all"))
+	require.False(t, isCDIGPU("vendor.com/fpga=0"))
+
+	require.Equal(t, []string{"nvidia.com/gpu=all"}, cdiGPUDevices("all"))
+	require.Equal(t, []string{"nvidia.com/gpu=0", "nvidia.com/gpu=1"}, cdiGPUDevices(`"device=0,1"`))
+}
+
+func TestGenerateDockerArgsResources(t *testing.T) {
+	args := generateDockerArgs(internalRunOptions{RunOptions: RunOptions{
+		Image:  "my-model",
+		CPUs:   3.5,
+		Memory: 1 << 30,
+	}})
+	joined := strings.Join(args, " ")
+	require.Contains(t, joined, "--cpus 3.5")
+	require.Contains(t, joined, "--memory 1073741824 --memory-swap 1073741824")
+}
@@ -0,0 +1,30 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// Tag gives the image source the name target.
+func Tag(source string, target string) error {
+	cmd := exec.Command("docker", "image", "tag", source, target)
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to tag %s as %s: %s", source, target, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Untag removes the name image. The image itself is only removed if no
+// other names refer to it.
+func Untag(image string) error {
+	cmd := exec.Command("docker", "image", "rm", "--no-prune", image)
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to remove %s: %s", image, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
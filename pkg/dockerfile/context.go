@@ -0,0 +1,98 @@
+package dockerfile
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+	"github.com/spf13/afero"
+)
+
+// WalkContext calls fn for every regular file in dir that is sent to Docker
+// as part of the build context, which is everything not excluded by
+// .dockerignore. rel is the path of the file relative to dir.
+func WalkContext(dir string, fn func(rel string, info fs.FileInfo) error) error {
+	return walkContext(afero.NewOsFs(), dir, fn)
+}
+
+// walkContext is WalkContext, in fsys.
+func walkContext(fsys afero.Fs, dir string, fn func(rel string, info fs.FileInfo) error) error {
+	return walkContextEntries(fsys, dir, func(rel string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(rel, info)
+	})
+}
+
+// walkContextEntries is like WalkContext, but calls fn for everything that
+// isn't a directory, including symlinks and special files like sockets.
+func walkContextEntries(fsys afero.Fs, dir string, fn func(rel string, d fs.DirEntry) error) error {
+	patterns, err := readDockerignore(fsys, dir)
+	if err != nil {
+		return err
+	}
+	matcher, err := patternmatcher.New(patterns)
+	if err != nil {
+		return fmt.Errorf("Failed to parse .dockerignore: %w", err)
+	}
+
+	return afero.Walk(fsys, dir, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		d := fs.FileInfoToDirEntry(info)
+		ignored, err := matcher.MatchesOrParentMatches(rel)
+		if err != nil {
+			return err
+		}
+		if ignored {
+			// Excluded directories can still have files re-included with !
+			if d.IsDir() && !matcher.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return fn(rel, d)
+	})
+}
+
+func readDockerignore(fsys afero.Fs, dir string) ([]string, error) {
+	f, err := fsys.Open(filepath.Join(dir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
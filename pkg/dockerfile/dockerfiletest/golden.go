@@ -0,0 +1,135 @@
+// Package dockerfiletest tests the Dockerfiles Cog generates against golden
+// files, the Dockerfiles they're expected to be, so changes to what's
+// generated can be reviewed. It's for Cog's tests, and forks and plugins
+// that change what Cog generates.
+//
+// Each project in a directory of golden tests is a directory with a
+// cog.yaml, and the files it needs, like requirements.txt. Its Dockerfile is
+// compared with Dockerfile.golden in it. Run the tests with -update-golden
+// to write the Dockerfiles to the golden files instead:
+//
+//	go test ./pkg/dockerfile -run TestGolden -update-golden
+package dockerfiletest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "Write generated Dockerfiles to their golden files, instead of comparing them")
+
+const (
+	// GOOS and GOARCH are the platform golden Dockerfiles are generated for
+	GOOS   = "linux"
+	GOARCH = "amd64"
+	// GoldenFilename is the name of the golden file in each project
+	GoldenFilename = "Dockerfile.golden"
+	// CogWheelChecksum replaces the SHA256 of Cog's wheel in golden
+	// Dockerfiles, because it changes whenever Cog's Python package does
+	CogWheelChecksum = "<sha256 of Cog's wheel>"
+
+	tmpDirName = "golden"
+)
+
+// Generate generates the Dockerfile for the cog.yaml in dir the same way
+// every time, for GOOS and GOARCH, with the checksum of Cog's wheel replaced
+// by CogWheelChecksum. The text files it copies into the image, like
+// requirements.txt, are appended to it, after their paths in the image. dir is copied to a temporary directory first, so
+// nothing is written to it. If configure isn't nil, it's called with the
+// generator before the Dockerfile is generated, like to set Strict.
+func Generate(t testing.TB, dir string, configure func(*dockerfile.Generator)) string {
+	t.Helper()
+	projectDir := filepath.Join(t.TempDir(), "project")
+	require.NoError(t, files.CopyDir(dir, projectDir))
+	if err := os.Remove(filepath.Join(projectDir, GoldenFilename)); err != nil && !os.IsNotExist(err) {
+		require.NoError(t, err)
+	}
+
+	cfg, _, err := config.GetConfig(projectDir)
+	require.NoError(t, err)
+	generator, err := dockerfile.NewGeneratorWithOptions(cfg, projectDir, false, dockerfile.GeneratorOptions{
+		GOOS:   GOOS,
+		GOARCH: GOARCH,
+		TmpDir: tmpDirName,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, generator.Cleanup())
+	})
+	if configure != nil {
+		configure(generator)
+	}
+
+	actual, err := generator.Generate()
+	require.NoError(t, err)
+	checksums := generator.Checksums()
+	containerPaths := make([]string, 0, len(checksums))
+	for containerPath, checksum := range checksums {
+		if strings.HasPrefix(containerPath, "/tmp/cog-") && strings.HasSuffix(containerPath, ".whl") {
+			actual = strings.ReplaceAll(actual, checksum, CogWheelChecksum)
+		}
+		containerPaths = append(containerPaths, containerPath)
+	}
+
+	// The text files the Dockerfile copies in, like requirements.txt, so
+	// changes to them can be reviewed too
+	sort.Strings(containerPaths)
+	for _, containerPath := range containerPaths {
+		path := filepath.Join(projectDir, ".cog", "tmp", tmpDirName, strings.TrimPrefix(containerPath, "/tmp/"))
+		contents, err := os.ReadFile(path)
+		require.NoError(t, err)
+		if bytes.IndexByte(contents, 0) >= 0 || strings.HasSuffix(containerPath, ".whl") {
+			continue
+		}
+		actual += fmt.Sprintf("\n\n# %s\n%s", containerPath, strings.TrimSuffix(string(contents), "\n"))
+	}
+	return actual
+}
+
+// AssertGolden checks that actual is the contents of the golden file at
+// path, or writes it there with -update-golden.
+func AssertGolden(t testing.TB, path string, actual string) {
+	t.Helper()
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(path, []byte(actual+"\n"), 0o644))
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s doesn't exist. Run the test with -update-golden to write it", path)
+	}
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSuffix(string(expected), "\n"), actual, "The generated Dockerfile doesn't match %s. If the change is expected, run the test with -update-golden to update it", path)
+}
+
+// Run runs a golden test, as a subtest, for each project in dir.
+func Run(t *testing.T, dir string, configure func(*dockerfile.Generator)) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		projectDir := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+		if exists, err := files.Exists(filepath.Join(projectDir, global.ConfigFilename)); err != nil || !exists {
+			continue
+		}
+		t.Run(entry.Name(), func(t *testing.T) {
+			AssertGolden(t, filepath.Join(projectDir, GoldenFilename), Generate(t, projectDir, configure))
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package dockerfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/shell"
+)
+
+// downloadCacheDir is the cache mount files in build.download are kept in
+// between builds, so they're only downloaded again when their URL changes
+const downloadCacheDir = "/weights-cache"
+
+// downloads downloads files in build.download into the image, each in a
+// layer of its own.
+func (g *Generator) downloads(downloads []config.Download) string {
+	lines := []string{}
+	for i, download := range downloads {
+		name := fmt.Sprintf("download %d/%d", i+1, len(downloads))
+		lines = append(lines, g.addStage(name, g.withInstallOptions(g.download(download))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// outsideProject returns the files in downloads that don't go in the project
+// directory. They're the ones that can be downloaded into the image the
+// model runs in from its project directory, which is mounted over /src, so
+// the others are downloaded into the project directory instead.
+func outsideProject(downloads []config.Download) []config.Download {
+	outside := []config.Download{}
+	for _, download := range downloads {
+		if download.ProjectPath() == "" {
+			outside = append(outside, download)
+		}
+	}
+	return outside
+}
+
+// download returns a RUN instruction that downloads a file to the cache
+// mount, named by the hash of its URL, if it isn't there already, and copies
+// it to where it goes. A file that doesn't match its checksum is removed
+// from the cache, so it's downloaded again next time.
+func (g *Generator) download(download config.Download) string {
+	return fmt.Sprintf("RUN --mount=type=cache,target=%s %s", downloadCacheDir, strings.Join(g.downloadSteps(downloadCacheDir, download), " && "))
+}
+
+// downloadSteps returns the shell commands that download a file to cacheDir
+// and copy it to where it goes.
+func (g *Generator) downloadSteps(cacheDir string, download config.Download) []string {
+	sum := sha256.Sum256([]byte(download.URL))
+	cached := path.Join(cacheDir, hex.EncodeToString(sum[:]))
+	dest := download.Dest
+	if !path.IsAbs(dest) {
+		dest = path.Join("/src", dest)
+	}
+
+	steps := []string{
+		// Downloaded to a temporary file first, so a download that fails
+		// part way through isn't cached
+		fmt.Sprintf("if [ ! -f %s ]; then curl -fsSL -o %s.tmp %s && mv %s.tmp %s; fi", cached, cached, shell.Quote(download.URL), cached, cached),
+	}
+	if download.SHA256 != "" {
+		steps = append(steps, fmt.Sprintf(`(echo "%s  %s" | sha256sum -c - || { rm -f %s; exit 1; })`, download.SHA256, cached, cached))
+	}
+	steps = append(steps, fmt.Sprintf("mkdir -p %s && cp %s %s", shell.Quote(path.Dir(dest)), cached, shell.Quote(dest)))
+	if owner := g.sourceOwner(); owner != "" && !path.IsAbs(download.Dest) {
+		steps = append(steps, fmt.Sprintf("chown %s %s", owner, shell.Quote(dest)))
+	}
+	return steps
+}
+
+// prefetchCacheDir is the cache mount files in prefetch are kept in between
+// builds, apart from build.download's
+const prefetchCacheDir = "/prefetch-cache"
+
+// prefetch downloads files in prefetch into the image, all in one layer.
+// They're small, so they're downloaded after the weights, and changing them
+// doesn't rebuild the weights' layers, but before the code, so changing the
+// code doesn't download them again.
+func (g *Generator) prefetch(downloads []config.Download) string {
+	if len(downloads) == 0 {
+		return ""
+	}
+	steps := []string{}
+	for _, download := range downloads {
+		steps = append(steps, g.downloadSteps(prefetchCacheDir, download)...)
+	}
+	run := fmt.Sprintf("RUN --mount=type=cache,target=%s %s", prefetchCacheDir, strings.Join(steps, " && "))
+	return g.addStage("prefetch", g.withInstallOptions(run))
+}
@@ -0,0 +1,201 @@
+package dockerfile
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// Plan is what a build of the model will do, in terms people reviewing it
+// can follow, for cog explain.
+type Plan struct {
+	// BaseImage is the image the model is built on, and BaseImageReason is
+	// why, to follow "because"
+	BaseImage       string
+	BaseImageReason string
+	// PythonVersion is the version of Python, PythonVersionReason is where
+	// it came from, and PythonInstall is how it gets into the image
+	PythonVersion       string
+	PythonVersionReason string
+	PythonInstall       string
+	// CUDA and CuDNN are the versions in the base image, if it's a CUDA
+	// image, and their reasons are where they came from
+	CUDA        string
+	CUDAReason  string
+	CuDNN       string
+	CuDNNReason string
+	// Steps are the names of the steps that install packages, run commands,
+	// and download files
+	Steps []string
+	// Copies are the layers the project directory is copied into
+	Copies []Copy
+	// Network is what the build connects to
+	Network []NetworkAccess
+}
+
+// Copy is a layer the project directory is copied into: some of its files,
+// copied to Dest.
+type Copy struct {
+	Sources []string
+	Dest    string
+}
+
+// NetworkAccess is a host the build connects to, and why.
+type NetworkAccess struct {
+	Host    string
+	Reasons []string
+}
+
+// Explain generates the Dockerfile, and returns what building it will do.
+func (g *Generator) Explain() (*Plan, error) {
+	if _, err := g.Generate(); err != nil {
+		return nil, err
+	}
+	build := g.Config.Build
+	plan := &Plan{
+		PythonVersion:       build.PythonVersion,
+		PythonVersionReason: build.PythonVersionSource(),
+		PythonInstall:       g.explainPythonInstall(),
+		Copies:              g.copies,
+	}
+
+	var err error
+	plan.BaseImage, err = g.fromImage()
+	if err != nil {
+		return nil, err
+	}
+	plan.BaseImageReason = g.explainBaseImage()
+	if build.GPU && !build.IsAMD() && build.BaseImage == "" {
+		plan.CUDA, plan.CUDAReason = build.CUDA, build.CUDASource()
+		plan.CuDNN, plan.CuDNNReason = build.CuDNN, build.CuDNNSource()
+	}
+	for _, stage := range g.stages {
+		plan.Steps = append(plan.Steps, stage.Name)
+	}
+	plan.Network, err = g.explainNetwork(plan.BaseImage)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// explainBaseImage returns why the model is built on its base image, to
+// follow "because".
+func (g *Generator) explainBaseImage() string {
+	build := g.Config.Build
+	switch {
+	case build.BaseImage != "":
+		return "it's set in build.base_image"
+	case build.Distro == config.DistroUBI9:
+		return "build.distro is ubi9"
+	case build.IsAMD():
+		return fmt.Sprintf("build.gpu_vendor is amd, so it's the image for ROCm %s", build.ROCm)
+	case build.GPU:
+		return fmt.Sprintf("build.gpu is true, so it's the image for CUDA %s and cuDNN %s", build.CUDA, build.CuDNN)
+	default:
+		return "the model doesn't use a GPU, so it's the image for its version of Python"
+	}
+}
+
+// explainPythonInstall returns how Python gets into the image.
+func (g *Generator) explainPythonInstall() string {
+	switch {
+	case g.Config.Build.Distro == config.DistroUBI9:
+		return "installed from the UBI repositories"
+	case !g.needsPython():
+		return "the base image has it"
+	case g.PythonTarball != "":
+		return "installed from " + g.PythonTarball
+	case g.Config.Build.PythonInstall == config.PythonInstallStandalone:
+		return fmt.Sprintf("Python %s is downloaded prebuilt from python-build-standalone", g.Config.Build.PythonPatchVersion())
+	default:
+		return fmt.Sprintf("Python %s is compiled with pyenv, which takes a few minutes", g.Config.Build.PythonPatchVersion())
+	}
+}
+
+// explainNetwork returns what the build connects to, in the order it does.
+// It must be called after the Dockerfile is generated.
+func (g *Generator) explainNetwork(fromImage string) ([]NetworkAccess, error) {
+	network := []NetworkAccess{}
+	add := func(host string, reason string) {
+		for i := range network {
+			if network[i].Host == host {
+				for _, r := range network[i].Reasons {
+					if r == reason {
+						return
+					}
+				}
+				network[i].Reasons = append(network[i].Reasons, reason)
+				return
+			}
+		}
+		network = append(network, NetworkAccess{Host: host, Reasons: []string{reason}})
+	}
+	addURL := func(rawURL string, reason string) {
+		if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+			add(u.Host, reason)
+		}
+	}
+
+	build := g.Config.Build
+	add(config.ImageRegistry(fromImage), "to pull the base image")
+	if g.syntax() != "" {
+		add(config.ImageRegistry("docker/dockerfile"), "to pull the Dockerfile frontend")
+	}
+
+	usesApt := len(build.SystemPackages) > 0 || (!g.Offline && build.Distro != config.DistroUBI9) || (g.needsPython() && g.PythonTarball == "")
+	switch {
+	case build.Distro == config.DistroUBI9 || g.PackageManager == PackageManagerDnf:
+		add("the Red Hat package repositories", "to install system packages with dnf")
+	case g.PackageManager == PackageManagerApk:
+		if len(build.SystemPackages) > 0 || !g.Offline {
+			add("the Alpine package repositories", "to install system packages with apk")
+		}
+	case usesApt && build.AptMirror != "":
+		addURL(build.AptMirror, "to install system packages with apt")
+	case usesApt:
+		add("the Debian or Ubuntu archives", "to install system packages with apt")
+	}
+	if !g.Offline {
+		add("github.com", "to download tini")
+	}
+	if g.needsPython() && g.PythonTarball == "" && build.Distro != config.DistroUBI9 && build.PythonInstall == config.PythonInstallStandalone {
+		add("github.com", "to download Python from python-build-standalone")
+	} else if g.needsPython() && g.PythonTarball == "" && build.Distro != config.DistroUBI9 {
+		add("raw.githubusercontent.com", "to install pyenv")
+		add("github.com", "to install pyenv")
+		add("www.python.org", "to download Python's source code")
+	}
+	if build.Installer == config.InstallerUV {
+		add(config.ImageRegistry(uvImage), "to copy uv")
+	}
+
+	if g.wheelhouse() == "" {
+		args := strings.Fields(g.pipIndexArgs())
+		requirements, err := g.Config.PythonRequirementsForArch(g.GOOS, g.GOARCH)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.Fields(requirements)...)
+		for i, arg := range args {
+			if i > 0 && (args[i-1] == "-i" || args[i-1] == "--index-url" || args[i-1] == "--extra-index-url" || args[i-1] == "-f" || args[i-1] == "--find-links") {
+				addURL(arg, "to install Python packages")
+			}
+		}
+	}
+	if build.SSH {
+		add("the git hosts of git+ssh:// requirements", "to install Python packages, with your SSH agent")
+	}
+	for _, download := range build.Download {
+		addURL(download.URL, "to download "+download.Dest)
+	}
+	for _, download := range g.Config.Prefetch {
+		addURL(download.URL, "to prefetch "+download.Dest)
+	}
+	if len(build.Run) > 0 {
+		add("build.run", "Cog can't tell what its commands connect to")
+	}
+	return network, nil
+}
@@ -0,0 +1,83 @@
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestExplain(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  python_packages:
+    - torch==2.3.1
+  system_packages:
+    - ffmpeg
+  layer_groups: 2
+prefetch:
+  - url: https://huggingface.co/openai/clip-vit-large-patch14/resolve/main/tokenizer.json
+    dest: clip/tokenizer.json
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	plan, err := gen.Explain()
+	require.NoError(t, err)
+
+	require.Equal(t, "nvidia/cuda:12.1.1-cudnn8-devel-ubuntu22.04", plan.BaseImage)
+	require.Equal(t, "build.gpu is true, so it's the image for CUDA 12.1.1 and cuDNN 8", plan.BaseImageReason)
+	require.Equal(t, "12.1.1", plan.CUDA)
+	require.Equal(t, "it's the latest CUDA torch==2.3.1 is built for", plan.CUDAReason)
+	require.Equal(t, "it's the latest for CUDA 12.1.1", plan.CuDNNReason)
+	require.Equal(t, "3.8", plan.PythonVersion)
+	require.Equal(t, "it's the default, because build.python_version isn't set", plan.PythonVersionReason)
+	require.Equal(t, "Python 3.8.20 is compiled with pyenv, which takes a few minutes", plan.PythonInstall)
+	require.Equal(t, []string{"apt", "pip", "prefetch"}, plan.Steps)
+	require.Equal(t, []Copy{{Sources: []string{"."}, Dest: "/src"}}, plan.Copies)
+
+	hosts := map[string][]string{}
+	for _, access := range plan.Network {
+		hosts[access.Host] = access.Reasons
+	}
+	require.Equal(t, []string{"to pull the base image", "to pull the Dockerfile frontend"}, hosts["docker.io"])
+	require.Equal(t, []string{"to download tini", "to install pyenv"}, hosts["github.com"])
+	require.Equal(t, []string{"to install Python packages"}, hosts["download.pytorch.org"])
+	require.Equal(t, []string{"to prefetch clip/tokenizer.json"}, hosts["huggingface.co"])
+	require.Contains(t, hosts, "the Debian or Ubuntu archives")
+}
+
+func TestExplainOffline(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  pip_index_url: https://pypi.internal/simple
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	gen.Offline = true
+	tiniFS = testTiniFS()
+	t.Cleanup(func() { tiniFS = embedded })
+	plan, err := gen.Explain()
+	require.NoError(t, err)
+
+	require.Equal(t, "python:3.11", plan.BaseImage)
+	require.Equal(t, "it's set in build.python_version", plan.PythonVersionReason)
+	require.Equal(t, "the base image has it", plan.PythonInstall)
+	require.Empty(t, plan.CUDA)
+	require.Equal(t, []NetworkAccess{
+		{Host: "docker.io", Reasons: []string{"to pull the base image"}},
+		{Host: "pypi.internal", Reasons: []string{"to install Python packages"}},
+	}, plan.Network)
+}
@@ -0,0 +1,78 @@
+package dockerfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// FirstBootPath is where the steps of the build that are run when the model
+// first starts are recorded in the image. They're run by
+// python/cog/first_boot.py.
+const FirstBootPath = "/cog/first_boot.json"
+
+// gpuDevice is the CDI device that gives a RUN instruction every GPU the
+// builder has
+const gpuDevice = "nvidia.com/gpu=all"
+
+// devicesSyntax is the Dockerfile syntax that RUN --device is in
+const devicesSyntax = "# syntax = docker/dockerfile:1.14-labs"
+
+// FirstBoot are the steps of the build that are run when the model first
+// starts, in the format of FirstBootPath.
+type FirstBoot struct {
+	Run []FirstBootRun `json:"run,omitempty"`
+}
+
+// FirstBootRun is a command in build.run that's run when the model first
+// starts.
+type FirstBootRun struct {
+	Command string `json:"command"`
+}
+
+// syntax returns the syntax line of the Dockerfile, which is a newer one if
+// it gives any commands GPUs. Offline, there's no syntax line, because it
+// pulls the frontend image, so the one built into BuildKit is used.
+func (g *Generator) syntax() string {
+	if g.usesDevices {
+		return devicesSyntax
+	}
+	if g.Offline {
+		return ""
+	}
+	return dockerfileSyntax
+}
+
+// gpuRun returns the RUN instruction for a command in build.run that needs
+// a GPU, or "" if the builder doesn't have one and it's run when the model
+// first starts instead.
+func (g *Generator) gpuRun(command string) string {
+	if !g.GPUBuilder {
+		g.firstBoot.Run = append(g.firstBoot.Run, FirstBootRun{Command: command})
+		console.Warnf("'%s' in build.run needs a GPU, but the builder doesn't have one, so it will run when the model first starts instead", command)
+		return ""
+	}
+	g.usesDevices = true
+	return fmt.Sprintf("RUN --device=%s %s", gpuDevice, command)
+}
+
+// copyFirstBoot records the steps that are run when the model first starts
+// in the image.
+func (g *Generator) copyFirstBoot() (string, error) {
+	if len(g.firstBoot.Run) == 0 {
+		return "", nil
+	}
+	contents, err := json.Marshal(g.firstBoot)
+	if err != nil {
+		return "", err
+	}
+	filename := "first_boot.json"
+	if err := afero.WriteFile(g.fs, filepath.Join(g.tmpDir, filename), contents, 0o644); err != nil {
+		return "", fmt.Errorf("Failed to write %s: %w", filename, err)
+	}
+	return copyForm(nil, []string{filepath.ToSlash(filepath.Join(g.relativeTmpDir, filename))}, FirstBootPath)
+}
@@ -1,38 +1,123 @@
 package dockerfile
 
 import (
-	// blank import for embeds
-	_ "embed"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/fs"
-	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/afero"
 
 	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/util"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/shell"
 )
 
-//go:embed embed/cog.whl
-var cogWheelEmbed []byte
+// embedded are the files built into Cog by make: Cog's Python package, and
+// the tini binaries offline builds install
+//
+//go:embed embed
+var embedded embed.FS
+
+var cogWheelEmbed = mustReadEmbedded("embed/cog.whl")
+
+// CogWheelFilename is the name Cog's Python package is installed from. It
+// needs to be the full format, otherwise pip refuses to install it.
+const CogWheelFilename = "cog-0.0.1.dev-py3-none-any.whl"
+
+// CogWheel returns Cog's Python package, which is installed in every image.
+func CogWheel() []byte {
+	return cogWheelEmbed
+}
+
+func mustReadEmbedded(name string) []byte {
+	contents, err := embedded.ReadFile(name)
+	if err != nil {
+		panic(fmt.Sprintf("Cog was built without %s. Build it with make: %s", name, err))
+	}
+	return contents
+}
 
 const (
 	// this will also be the number of extra docker image layers
-	// besides the cog base layers.
+	// besides the cog base layers. They're the defaults for
+	// build.layer_groups and build.large_file_threshold.
 	maxNumFileGroups  = 1
-	fileSizeThresHold = 200 * 1000 * 1000 // 100 MegaBytes
+	fileSizeThresHold = 200 * 1000 * 1000 // 200 MegaBytes
+	// files over this size that share a layer with code are warned about
+	largeSourceFileThreshold = 100 * 1000 * 1000
 )
 
 type Generator struct {
 	Config *config.Config
 	Dir    string
 
-	// these are here to make this type testable
+	// GOOS and GOARCH are the platform the image is built for, which
+	// Python packages are resolved for. They default to the one Docker
+	// builds for, from util.DefaultPlatform.
 	GOOS   string
 	GOARCH string
 
+	// RegistryMirrors maps registry hosts to mirrors that base images are
+	// pulled from instead. See config.UserConfig.
+	RegistryMirrors map[string]string
+	// Lock pins the base image to a digest, if set
+	Lock *config.Lock
+	// PackageManager installs system packages in the base image. Defaults to apt.
+	PackageManager PackageManager
+	// CacheScope, if set, gives cache mounts IDs in their own namespace, so
+	// they aren't shared with builds in other scopes
+	CacheScope string
+	// Strict fails the build on problems that are otherwise warnings
+	Strict bool
+	// PipIndexURL is the Python package index to install packages from,
+	// if it isn't the one in cog.yaml, like when it falls back to
+	// build.pip_fallback_index_url
+	PipIndexURL string
+	// NoCacheFilter are the CacheStages to build without the cache. If it's
+	// set, the Dockerfile is split into stages with those names.
+	NoCacheFilter []string
+	// Target is the one of CacheStages to stop the build at, like docker
+	// build --target. If it's set, the Dockerfile is split into stages too.
+	Target string
+	// GPUBuilder is whether the builder can give RUN instructions GPUs. If
+	// it can't, commands in build.run that need a GPU are run when the model
+	// first starts instead.
+	GPUBuilder bool
+	// Offline generates a Dockerfile that builds without the internet. See
+	// checkOffline for what it can't build.
+	Offline bool
+	// PythonTarball is a python-build-standalone install_only tarball that
+	// Python is installed from, instead of with pyenv, if the base image
+	// doesn't have it
+	PythonTarball string
+	// Wheelhouse is a directory of wheels in the project that Python
+	// packages are installed from, instead of a package index. It overrides
+	// build.wheelhouse.
+	Wheelhouse string
+	// LLB generates a Dockerfile for ConvertToLLB, which is split into
+	// stages too, so each step is named by the stage it's in.
+	LLB bool
+
+	// fs is where the workspace is read from, and temporary files are
+	// written to
+	fs afero.Fs
 	// absolute path to tmpDir, a directory that will be cleaned up
 	tmpDir string
 	// tmpDir relative to Dir
@@ -40,17 +125,71 @@ type Generator struct {
 	// groupFile indicates grouping small files into independent docker
 	// image layer
 	groupFile bool
+	// special caches the symlinks and special files in the workspace
+	special []specialFile
+	// checksums are the SHA256 of the files written by writeTemp
+	checksums map[string]string
+	// stages are the steps that install packages and run commands from
+	// cog.yaml, which are shown by name in the build's output
+	stages []docker.BuildStage
+	// copies are the layers the workspace is copied into
+	copies []Copy
+	// lastCacheStage is the name of the last of the CacheStages started
+	lastCacheStage string
+	// usesDevices is whether any RUN instructions are given GPUs
+	usesDevices bool
+	// firstBoot are the steps of the build that are run when the model first
+	// starts
+	firstBoot FirstBoot
 }
 
 func NewGenerator(config *config.Config, dir string, groupFile bool) (*Generator, error) {
+	return NewGeneratorWithOptions(config, dir, groupFile, GeneratorOptions{})
+}
+
+// GeneratorOptions make a generator generate the same Dockerfile wherever
+// it runs, like for golden tests. See the dockerfiletest package.
+type GeneratorOptions struct {
+	// GOOS and GOARCH are the platform Python packages are resolved for,
+	// instead of the one Docker builds for on the machine Cog runs on
+	GOOS   string
+	GOARCH string
+	// TmpDir is the name of the directory in .cog/tmp that files are
+	// written to and copied into the image from, instead of a new one with
+	// a random name. Generators that share it can't be used at the same
+	// time.
+	TmpDir string
+	// FS is the filesystem the project directory is read from, and
+	// temporary files are written to, instead of the OS's. Use an in-memory
+	// afero.MemMapFs for tests, or an afero.CopyOnWriteFs over a read-only
+	// OS filesystem to generate a Dockerfile without writing to disk.
+	FS afero.Fs
+}
+
+// NewGeneratorWithOptions creates a generator like NewGenerator, with
+// options that would otherwise depend on where it runs.
+func NewGeneratorWithOptions(config *config.Config, dir string, groupFile bool, options GeneratorOptions) (*Generator, error) {
+	fsys := options.FS
+	if fsys == nil {
+		fsys = afero.NewOsFs()
+	}
 	rootTmp := path.Join(dir, ".cog/tmp")
-	if err := os.MkdirAll(rootTmp, 0o755); err != nil {
+	if err := fsys.MkdirAll(rootTmp, 0o755); err != nil {
 		return nil, err
 	}
 	// tmpDir ends up being something like dir/.cog/tmp/build123456789
-	tmpDir, err := os.MkdirTemp(rootTmp, "build")
-	if err != nil {
-		return nil, err
+	var tmpDir string
+	if options.TmpDir != "" {
+		tmpDir = path.Join(rootTmp, options.TmpDir)
+		if err := fsys.MkdirAll(tmpDir, 0o755); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		tmpDir, err = afero.TempDir(fsys, rootTmp, "build")
+		if err != nil {
+			return nil, err
+		}
 	}
 	// tmpDir, but without dir prefix. This is the path used in the Dockerfile.
 	relativeTmpDir, err := filepath.Rel(dir, tmpDir)
@@ -58,30 +197,104 @@ func NewGenerator(config *config.Config, dir string, groupFile bool) (*Generator
 		return nil, err
 	}
 
-	return &Generator{
+	goos, goarch := util.DefaultPlatform(runtime.GOOS, runtime.GOARCH)
+	generator := &Generator{
 		Config:         config,
 		Dir:            dir,
-		GOOS:           runtime.GOOS,
-		GOARCH:         runtime.GOOS,
+		GOOS:           goos,
+		GOARCH:         goarch,
+		fs:             fsys,
 		tmpDir:         tmpDir,
 		relativeTmpDir: relativeTmpDir,
 		groupFile:      groupFile,
-	}, nil
+	}
+	if options.GOOS != "" {
+		generator.GOOS = options.GOOS
+	}
+	if options.GOARCH != "" {
+		generator.GOARCH = options.GOARCH
+	}
+	return generator, nil
 }
 
+const dockerfileSyntax = "# syntax = docker/dockerfile:1.2"
+
+// sourceOwnerStage is the name of the stage that permissions of the
+// workspace are normalized in, when build.source_owner is set.
+const sourceOwnerStage = "source_owner"
+
+// baseCacheStage is the name of the stage that the base image is set up in,
+// before any of the CacheStages.
+const baseCacheStage = "base"
+
+// CacheStages are the stages of the build that can be built without the
+// cache with NoCacheFilter, or built up to with Target, in the order they're
+// built. The stages after one are built on top of it, so they're rebuilt
+// too.
+var CacheStages = []string{"system_packages", "pip", "run", "weights", "source"}
+
 func (g *Generator) GenerateBase() (string, error) {
-	baseImage, err := g.baseImage()
+	base, err := g.baseStage()
+	if err != nil {
+		return "", err
+	}
+	return g.scopeCacheMounts(strings.Join(filterEmpty([]string{
+		g.syntax(),
+		base,
+		g.downloads(outsideProject(g.Config.Build.Download)),
+		g.prefetch(outsideProject(g.Config.Prefetch)),
+		g.user(),
+	}), "\n")), nil
+}
+
+// baseStage returns the stage the model runs in, without the workspace.
+func (g *Generator) baseStage() (string, error) {
+	g.stages = nil
+	g.copies = nil
+	g.lastCacheStage = ""
+	g.usesDevices = false
+	g.firstBoot = FirstBoot{}
+	if g.Offline {
+		if err := g.checkOffline(); err != nil {
+			return "", err
+		}
+	}
+	fromImage, err := g.fromImage()
 	if err != nil {
 		return "", err
 	}
 	installPython := ""
-	if g.Config.Build.GPU {
-		installPython, err = g.installPythonCUDA()
+	if g.Config.Build.Distro == config.DistroUBI9 {
+		installPython = g.installPythonUBI9()
+	} else if g.Config.Build.BaseImage != "" {
+		if !g.Config.Build.BaseImageHas(config.ProvidesPython) {
+			if g.PackageManager == PackageManagerApk || g.PackageManager == PackageManagerDnf {
+				return "", fmt.Errorf("Cog can only install Python on base images that use apt, but %s uses %s. Install Python in it and add 'python' to 'build.base_image_provides' in cog.yaml", g.Config.Build.BaseImage, g.PackageManager)
+			}
+			installPython, err = g.installPython()
+			if err != nil {
+				return "", err
+			}
+		}
+	} else if g.Config.Build.GPU {
+		installPython, err = g.installPython()
 		if err != nil {
 			return "", err
 		}
 	}
-	aptInstalls, err := g.aptInstalls()
+	aptMirror, err := g.aptMirror()
+	if err != nil {
+		return "", err
+	}
+	installTini, err := g.installTini()
+	if err != nil {
+		return "", err
+	}
+	wheelhouse, err := g.copyWheelhouse()
+	if err != nil {
+		return "", err
+	}
+	systemPackageInstalls, err := g.systemPackageInstalls()
 	if err != nil {
 		return "", err
 	}
@@ -99,25 +312,56 @@ func (g *Generator) GenerateBase() (string, error) {
 	}
 
 	return strings.Join(filterEmpty([]string{
-		"# syntax = docker/dockerfile:1.2",
-		"FROM " + baseImage,
+		"FROM " + fromImage + g.startCacheStage(baseCacheStage),
 		g.preamble(),
-		g.installTini(),
+		g.environment(),
+		aptMirror,
+		installTini,
 		installPython,
+		g.installUV(),
+		wheelhouse,
 		installCog,
-		aptInstalls,
+		g.installWeightsDecryption(),
+		g.cacheStage("system_packages"),
+		systemPackageInstalls,
+		g.cacheStage("pip"),
 		pipInstalls,
+		g.cacheStage("run"),
 		run,
+		g.createUser(),
 		`WORKDIR /src`,
-		`EXPOSE 5000`,
-		`CMD ["python", "-m", "cog.server.http"]`,
+		fmt.Sprintf("EXPOSE %d", g.Config.ServingPort()),
+		g.healthcheck(),
+		g.serverCommand(),
 	}), "\n"), nil
 }
 
+// healthcheck checks the model is ready, or busy with a prediction, with
+// the HTTP server's /health-check. It's in Python so it works without curl
+// in the image, and only imports the standard library so it's quick.
+func (g *Generator) healthcheck() string {
+	healthcheck := g.Config.ServingHealthcheck()
+	if healthcheck == nil {
+		return ""
+	}
+	script := fmt.Sprintf("import json, sys, urllib.request; status = json.load(urllib.request.urlopen('http://127.0.0.1:%d/health-check'))['status']; sys.exit(status not in ('READY', 'BUSY'))", g.Config.ServingPort())
+	return fmt.Sprintf("HEALTHCHECK --interval=%s --timeout=%s --start-period=%s --retries=%d CMD [\"python\", \"-c\", %s]",
+		healthcheck.Interval, healthcheck.Timeout, healthcheck.StartPeriod, healthcheck.Retries, strconv.Quote(script))
+}
+
+// serverCommand runs the HTTP server, listening on serving.port.
+func (g *Generator) serverCommand() string {
+	args := []string{}
+	for _, arg := range g.Config.ServerCommand() {
+		args = append(args, strconv.Quote(arg))
+	}
+	return "CMD [" + strings.Join(args, ", ") + "]"
+}
+
 // dirSize returns the size of the given `dir`
-func dirSize(dir string) (int64, error) {
+func dirSize(fsys afero.Fs, dir string) (int64, error) {
 	var size int64
-	if err := filepath.Walk(dir,
+	if err := afero.Walk(fsys, dir,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
@@ -133,9 +377,9 @@ func dirSize(dir string) (int64, error) {
 	return size, nil
 }
 
-// divFilesBySize divides files in workspace into small files
+// divFilesBySize divides files in the workspace dir into small files
 // (size < `threshold`) and large files (size > `threshold`).
-func divFilesBySize(threshold int64, files []fs.FileInfo) (
+func divFilesBySize(fsys afero.Fs, dir string, threshold int64, files []fs.FileInfo) (
 	smalls []string,
 	larges []string,
 	small_folders []string,
@@ -145,7 +389,7 @@ func divFilesBySize(threshold int64, files []fs.FileInfo) (
 	for _, file := range files {
 		size := file.Size()
 		if file.IsDir() {
-			size, err = dirSize(file.Name())
+			size, err = dirSize(fsys, filepath.Join(dir, file.Name()))
 			if err != nil {
 				return nil, nil, nil, nil, err
 			}
@@ -168,9 +412,14 @@ func divFilesBySize(threshold int64, files []fs.FileInfo) (
 	return
 }
 
-// groupFile divide files in the workspace into `numGroups` of groups.
-func groupFiles(numGroups int, fileSizeThresHold int64, files []fs.FileInfo) ([][]string, [][]string, error) {
-	smalls, larges, small_folders, large_folders, err := divFilesBySize(fileSizeThresHold, files)
+// groupFiles divides files in the workspace into groups, each of which is
+// copied into a layer of its own. Large files and folders get groups of
+// their own, and small files are split between `numGroups` groups by a hash
+// of their name. Files stay in the same group as others are added, removed,
+// or edited, so a change to one file only rebuilds the layer it's in, rather
+// than reshuffling every group.
+func groupFiles(fsys afero.Fs, dir string, numGroups int, fileSizeThresHold int64, files []fs.FileInfo) ([][]string, [][]string, error) {
+	smalls, larges, small_folders, large_folders, err := divFilesBySize(fsys, dir, fileSizeThresHold, files)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -183,153 +432,659 @@ func groupFiles(numGroups int, fileSizeThresHold int64, files []fs.FileInfo) ([]
 	}
 	// put all large folders in an independent group.
 	if len(large_folders) > 0 {
-		ret_folder = append(ret, large_folders)
+		ret_folder = append(ret_folder, large_folders)
 	}
 	// put all small folders in an independent group.
 	if len(small_folders) > 0 {
-		ret_folder = append(ret, small_folders)
+		ret_folder = append(ret_folder, small_folders)
 	}
-	// put all small files in an independent group.
-	numSmalls := len(smalls)
-	if numSmalls <= numGroups {
-		// put each file in one group
-		for _, f := range smalls {
-			ret = append(ret, []string{f})
-		}
-		return ret, ret_folder, nil
+	// split small files between the groups, leaving out empty ones
+	if numGroups < 1 {
+		numGroups = 1
 	}
-	// TODO(charleszheng44): The algorithm dividing small files into groups
-	// and assigns each group to a docker image layer can be enhanced.
-	// Two potential issues that may arise:
-	// 1. Large groups of small files can still slow down the deployment
-	//    process, despite being evenly divided.
-	// 2. Users making changes to files in different groups can trigger the
-	//    regeneration of all related layers, leading to a sluggish deployment.
-	filePerGroup, i := numSmalls/numGroups, 0
-	for q := 0; q < numGroups; q++ {
-		curGrp := []string{}
-		for j := 0; j < filePerGroup; j, i = j+1, i+1 {
-			curGrp = append(curGrp, smalls[i])
-		}
-		ret = append(ret, curGrp)
+	smallGroups := make([][]string, numGroups)
+	for _, f := range smalls {
+		q := fileGroup(f, numGroups)
+		smallGroups[q] = append(smallGroups[q], f)
 	}
-	// put the reminders into the last group.
-	if i < numSmalls {
-		ret[numGroups-1] = append(ret[numGroups-1], smalls[i:]...)
+	for _, group := range smallGroups {
+		if len(group) > 0 {
+			ret = append(ret, group)
+		}
 	}
 
 	return ret, ret_folder, nil
 }
 
+// fileGroup returns which of numGroups groups the file with the given name
+// is in.
+func fileGroup(name string, numGroups int) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	return int(hash.Sum32() % uint32(numGroups))
+}
+
+// groupsFiles returns whether the workspace is split into layers, which it
+// is with --groupfile, if how to split it is set in cog.yaml, or if parts of
+// it are copied separately.
+func (g *Generator) groupsFiles() bool {
+	return g.groupFile || g.Config.Build.LayerGroups > 0 || g.Config.Build.LargeFileThreshold != "" || len(g.copiedSeparately()) > 0
+}
+
+// fileGroups returns how many layers small files in the workspace are split
+// into, and the size files over which get a layer of their own.
+func (g *Generator) fileGroups() (numGroups int, threshold int64) {
+	numGroups, threshold = maxNumFileGroups, fileSizeThresHold
+	if g.Config.Build.LayerGroups > 0 {
+		numGroups = g.Config.Build.LayerGroups
+	}
+	if size := g.Config.Build.LargeFileThresholdBytes(); size > 0 {
+		threshold = size
+	}
+	return numGroups, threshold
+}
+
 // copyWorkspace generates the Dockerfile COPY command copying files in the
 // current directory to the /src directory in the docker container.
 func (g *Generator) copyWorkspace() (string, error) {
-	if !g.groupFile {
-		return "COPY . /src", nil
+	if err := g.checkLargeSourceFiles(); err != nil {
+		return "", err
 	}
 
-	ret := ""
-	files, err := ioutil.ReadDir(".")
+	if !g.groupsFiles() {
+		return g.copyToSrc([]string{"."}, "/src")
+	}
+
+	special, err := g.specialFiles()
 	if err != nil {
 		return "", err
 	}
-	groups, folder_groups, err := groupFiles(maxNumFileGroups, fileSizeThresHold, files)
+	topLevelSpecial := map[string]specialFile{}
+	for _, file := range special {
+		if !strings.Contains(file.path, "/") {
+			topLevelSpecial[file.path] = file
+		}
+	}
+
+	separate := g.copiedSeparately()
+	var inContext map[string]bool
+	if len(separate) > 0 {
+		if inContext, err = g.contextPaths(); err != nil {
+			return "", err
+		}
+	}
+
+	entries, err := afero.ReadDir(g.fs, g.Dir)
+	if err != nil {
+		return "", err
+	}
+	files := []fs.FileInfo{}
+	links := []specialFile{}
+	// Directories with separate files or weights.paths in them are copied
+	// without those, which are copied into layers of their own
+	shardedDirLines := []string{}
+	for _, entry := range entries {
+		// Cog's own scratch space, which the Dockerfile copies from directly
+		if entry.Name() == ".cog" {
+			continue
+		}
+		if file, ok := topLevelSpecial[entry.Name()]; ok {
+			if file.isSymlink() && !g.followSymlinks() {
+				links = append(links, file)
+			}
+			continue
+		}
+		if separate[entry.Name()] {
+			continue
+		}
+		if entry.IsDir() && hasShardedFile(entry.Name(), separate) {
+			lines, err := g.copyDirWithoutShards(entry.Name(), inContext)
+			if err != nil {
+				return "", err
+			}
+			shardedDirLines = append(shardedDirLines, lines...)
+			continue
+		}
+		files = append(files, entry)
+	}
+	if len(files) == 0 && len(links) == 0 && len(separate) == 0 {
+		return g.copyToSrc([]string{"."}, "/src")
+	}
+
+	numGroups, threshold := g.fileGroups()
+	groups, folder_groups, err := groupFiles(g.fs, g.Dir, numGroups, threshold, files)
 	if err != nil {
 		return "", err
 	}
 
+	lines := []string{}
 	for _, group := range groups {
-		copyCmd := "COPY "
-		for _, file := range group {
-			copyCmd = copyCmd + file + " "
+		line, err := g.copyToSrc(group, "/src")
+		if err != nil {
+			return "", err
 		}
-		copyCmd = copyCmd + "/src" + "\n"
-		ret = ret + copyCmd
+		lines = append(lines, line)
 	}
 
 	for _, group := range folder_groups {
-		sig_cmd := ""
 		for _, file := range group {
-			sig_cmd = "COPY " + file + " /src/" + file + "\n"
-			ret = ret + sig_cmd
+			line, err := g.copyToSrc([]string{file}, "/src/"+file)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, line)
 		}
 	}
 
-	return ret, nil
+	lines = append(lines, shardedDirLines...)
+
+	linkLines, err := g.linkSymlinks(links)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(filterEmpty(append(lines, linkLines)), "\n"), nil
+}
+
+type largeFile struct {
+	path string
+	size int64
+}
+
+// largeSourceFiles returns the files over largeSourceFileThreshold that are
+// copied into a layer along with smaller files, like code, which change
+// more often. Encrypted weights, sharded weights and weights.paths are
+// declared in cog.yaml, so they aren't included.
+func (g *Generator) largeSourceFiles() ([]largeFile, error) {
+	declared := map[string]bool{}
+	if g.Config.Weights != nil && g.Config.Weights.Encryption != nil {
+		for _, file := range g.Config.Weights.Encryption.Files {
+			declared[filepath.Clean(file)] = true
+		}
+	}
+	for _, file := range g.shardedFiles() {
+		declared[filepath.FromSlash(file)] = true
+	}
+
+	large := []largeFile{}
+	// Top-level directories that have small files in them, which with
+	// --groupfile share their directory's layer with any large files
+	hasSmallFiles := map[string]bool{}
+	err := walkContext(g.fs, g.Dir, func(rel string, info fs.FileInfo) error {
+		top := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		if top == ".cog" {
+			return nil
+		}
+		if info.Size() <= largeSourceFileThreshold {
+			hasSmallFiles[top] = true
+			return nil
+		}
+		if !declared[rel] && !g.isWeightsPath(rel) {
+			large = append(large, largeFile{path: filepath.ToSlash(rel), size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !g.groupsFiles() {
+		return large, nil
+	}
+
+	// With --groupfile, top-level files over the large file threshold, and
+	// each top-level directory, are copied in layers of their own
+	_, threshold := g.fileGroups()
+	shared := []largeFile{}
+	for _, file := range large {
+		top := strings.SplitN(file.path, "/", 2)[0]
+		if top == file.path && file.size > threshold {
+			continue
+		}
+		if top != file.path && !hasSmallFiles[top] {
+			continue
+		}
+		shared = append(shared, file)
+	}
+	return shared, nil
+}
+
+// checkLargeSourceFiles warns about large files that would be uploaded again
+// every time the code changes, or fails if Strict is set.
+func (g *Generator) checkLargeSourceFiles() error {
+	files, err := g.largeSourceFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	lines := []string{}
+	for _, file := range files {
+		lines = append(lines, fmt.Sprintf("  %s (%s)", file.path, units.HumanSize(float64(file.size))))
+	}
+	msg := fmt.Sprintf(`These files are over %s, and are copied into the same layer as smaller files like your code, so they will be pushed again every time the code changes:
+%s
+Move them into a directory of their own and build with --groupfile, or leave them out of the image with .dockerignore.`,
+		units.HumanSize(largeSourceFileThreshold), strings.Join(lines, "\n"))
+	if g.Strict {
+		return fmt.Errorf("%s", msg)
+	}
+	console.Warnf("%s", msg)
+	return nil
+}
+
+// copyToSrc returns a COPY command that copies srcs in the workspace to dest.
+// With build.source_owner set, they are copied from the source stage, where
+// their permissions have been normalized, and owned by that user.
+func (g *Generator) copyToSrc(srcs []string, dest string) (string, error) {
+	g.copies = append(g.copies, Copy{Sources: srcs, Dest: dest})
+	owner := g.sourceOwner()
+	if owner == "" {
+		return copyForm(nil, srcs, dest)
+	}
+	stageSrcs := []string{}
+	for _, src := range srcs {
+		stageSrcs = append(stageSrcs, path.Join("/src", src))
+	}
+	return copyForm([]string{"--from=" + sourceOwnerStage, "--chown=" + owner}, stageSrcs, dest)
+}
+
+// sourceOwner returns the user that owns the workspace in the image, which
+// is build.run_as_user unless build.source_owner is set, so the model can
+// read its own files.
+func (g *Generator) sourceOwner() string {
+	if g.Config.Build.SourceOwner != "" {
+		return g.Config.Build.SourceOwner
+	}
+	return g.Config.Build.RunAsUser
+}
+
+// sourceStageLines returns a stage that copies in the workspace and makes it
+// readable by everyone, preserving executable bits. Doing this in its own
+// stage means the chmod doesn't add a second copy of the workspace to the
+// final image.
+func (g *Generator) sourceStageLines() (string, error) {
+	if g.sourceOwner() == "" {
+		return "", nil
+	}
+	// The base image is pulled anyway, so reuse it rather than pulling another image
+	fromImage, err := g.fromImage()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		fmt.Sprintf("FROM %s AS %s", fromImage, sourceOwnerStage),
+		"COPY . /src",
+		"RUN chmod -R u+rwX,go=rX /src",
+	}, "\n"), nil
+}
+
+// defaultUserName is the name of the user created for build.run_as_user,
+// when it's a UID
+const defaultUserName = "cog"
+
+// createUser creates the user in build.run_as_user, if it doesn't already
+// exist in the base image, and gives it /src.
+func (g *Generator) createUser() string {
+	user := g.Config.Build.RunAsUser
+	if user == "" {
+		return ""
+	}
+	name, uidFlag := user, ""
+	if _, err := strconv.Atoi(user); err == nil {
+		name, uidFlag = defaultUserName, " -u "+user
+	}
+	add := fmt.Sprintf("useradd --create-home%s %s", uidFlag, name)
+	if g.PackageManager == PackageManagerApk {
+		add = fmt.Sprintf("adduser -D%s %s", uidFlag, name)
+	}
+	return fmt.Sprintf("RUN (id %s >/dev/null 2>&1 || %s) && mkdir -p /src && chown %s /src", user, add, user)
+}
+
+// user switches to the user in build.run_as_user. It's the last instruction,
+// so everything before it, like creating symlinks in the workspace, runs as
+// root.
+func (g *Generator) user() string {
+	if g.Config.Build.RunAsUser == "" {
+		return ""
+	}
+	return "USER " + g.Config.Build.RunAsUser
 }
 
 func (g *Generator) Generate() (string, error) {
-	base, err := g.GenerateBase()
+	source, err := g.sourceStageLines()
+	if err != nil {
+		return "", err
+	}
+	shards, err := g.shardStageLines()
 	if err != nil {
 		return "", err
 	}
 
+	base, err := g.baseStage()
+	if err != nil {
+		return "", err
+	}
+
+	// Weights change less often than code, so they're downloaded and
+	// copied first
+	copyShards, err := g.copyShards()
+	if err != nil {
+		return "", err
+	}
 	copyWorkspace, err := g.copyWorkspace()
 	if err != nil {
 		return "", err
 	}
+	copyFollowedSymlinks, err := g.copyFollowedSymlinks()
+	if err != nil {
+		return "", err
+	}
+	copyWeights, err := g.copyWeights()
+	if err != nil {
+		return "", err
+	}
+	copyExampleAssets, err := g.copyExampleAssets()
+	if err != nil {
+		return "", err
+	}
 
-	return strings.Join(filterEmpty(
+	return g.scopeCacheMounts(strings.Join(filterEmpty(
 		[]string{
+			g.syntax(),
+			source,
+			shards,
 			base,
+			g.cacheStage("weights"),
+			g.downloads(g.Config.Build.Download),
+			copyShards,
+			g.prefetch(g.Config.Prefetch),
+			g.cacheStage("source"),
 			copyWorkspace,
-		}), "\n"), nil
+			copyFollowedSymlinks,
+			copyWeights,
+			copyExampleAssets,
+			g.user(),
+			g.labels(),
+		}), "\n")), nil
+}
+
+// splitStages is whether the build is split into CacheStages, for
+// NoCacheFilter, Target, or LLB.
+func (g *Generator) splitStages() bool {
+	return len(g.NoCacheFilter) > 0 || g.Target != "" || g.LLB
+}
+
+// startCacheStage returns the suffix of the FROM line of the first stage of
+// the model to name it, if the build is split into stages.
+func (g *Generator) startCacheStage(name string) string {
+	if !g.splitStages() {
+		return ""
+	}
+	g.lastCacheStage = name
+	return " AS " + name
+}
+
+// cacheStage starts a new stage called name on top of the last one, if the
+// build is split into stages. A stage that's built on the last one has the
+// same layers as if it were the same stage, so it doesn't change what's
+// cached.
+func (g *Generator) cacheStage(name string) string {
+	if !g.splitStages() {
+		return ""
+	}
+	line := fmt.Sprintf("FROM %s AS %s", g.lastCacheStage, name)
+	g.lastCacheStage = name
+	return line
+}
+
+var cacheMountRegexp = regexp.MustCompile(`--mount=type=cache,target=(\S+)`)
+
+// scopeCacheMounts gives every cache mount in dockerfile an ID prefixed with
+// CacheScope. Without an ID, a cache mount is shared by every build that
+// mounts the same target.
+func (g *Generator) scopeCacheMounts(dockerfile string) string {
+	if g.CacheScope == "" {
+		return dockerfile
+	}
+	return cacheMountRegexp.ReplaceAllString(dockerfile, "--mount=type=cache,id="+g.CacheScope+"$1,target=$1")
+}
+
+// copyExampleAssets copies the files used by examples to a fixed path in the
+// image, so they can be used with only the image.
+func (g *Generator) copyExampleAssets() (string, error) {
+	lines := []string{}
+	for _, asset := range g.Config.ExampleAssets() {
+		line, err := g.copyToSrc([]string{asset}, path.Join(config.ExampleAssetsDir, asset))
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
 }
 
 func (g *Generator) Cleanup() error {
-	if err := os.RemoveAll(g.tmpDir); err != nil {
+	if err := g.fs.RemoveAll(g.tmpDir); err != nil {
 		return fmt.Errorf("Failed to clean up %s: %w", g.tmpDir, err)
 	}
 	return nil
 }
 
-func (g *Generator) baseImage() (string, error) {
+// StandardPackageManager returns the package manager of the base image, if
+// it is one Cog picks itself rather than a custom base image.
+func (g *Generator) StandardPackageManager() (pm PackageManager, ok bool, err error) {
+	if g.Config.Build.Distro == config.DistroUBI9 {
+		return PackageManagerDnf, true, nil
+	}
+	baseImage, err := g.BaseImage()
+	if err != nil {
+		return "", false, err
+	}
+	if strings.HasPrefix(baseImage, "python:") || strings.HasPrefix(baseImage, "nvidia/cuda:") || strings.HasPrefix(baseImage, "rocm/") {
+		return PackageManagerApt, true, nil
+	}
+	return "", false, nil
+}
+
+// BaseImage returns the image the model is built on, as a tag.
+func (g *Generator) BaseImage() (string, error) {
+	if g.Config.Build.BaseImage != "" {
+		return g.Config.Build.BaseImage, nil
+	}
+	if g.Config.Build.Distro == config.DistroUBI9 {
+		return "registry.access.redhat.com/ubi9/ubi:latest", nil
+	}
+	if g.Config.Build.IsAMD() {
+		if g.GOARCH == "arm64" {
+			return "", fmt.Errorf("'gpu_vendor: amd' in cog.yaml can only be built for linux/amd64, because ROCm doesn't support arm64")
+		}
+		return config.ROCmBaseImageFor(g.Config.Build.ROCm)
+	}
 	if g.Config.Build.GPU {
 		return g.Config.CUDABaseImageTag()
 	}
 	return "python:" + g.Config.Build.PythonVersion, nil
 }
 
+// fromImage returns the reference to use in the FROM line: the base image
+// pulled through any registry mirror, and pinned to its locked digest.
+func (g *Generator) fromImage() (string, error) {
+	baseImage, err := g.BaseImage()
+	if err != nil {
+		return "", err
+	}
+	image := config.MirrorImage(baseImage, g.RegistryMirrors)
+	if g.Lock != nil {
+		if digest, ok := g.Lock.BaseImages[baseImage]; ok {
+			image += "@" + digest
+		}
+	}
+	return image, nil
+}
+
 func (g *Generator) preamble() string {
+	if g.Config.Build.Distro == config.DistroUBI9 {
+		// Python links against the system OpenSSL, so this puts the
+		// FIPS-validated module in charge of all its cryptography
+		return `ENV PYTHONUNBUFFERED=1
+RUN --mount=type=cache,target=/var/cache/dnf dnf install -y crypto-policies-scripts && update-crypto-policies --set FIPS && dnf clean all`
+	}
+	// Debian and Ubuntu keep libraries in a directory for the architecture
+	systemLibraryPath := "/usr/lib/x86_64-linux-gnu"
+	if g.GOARCH == "arm64" {
+		systemLibraryPath = "/usr/lib/aarch64-linux-gnu"
+	}
+	libraryPath := systemLibraryPath + ":/usr/local/nvidia/lib64:/usr/local/nvidia/bin"
+	if g.Config.Build.IsAMD() {
+		libraryPath = systemLibraryPath + ":/opt/rocm/lib"
+	}
 	return `ENV DEBIAN_FRONTEND=noninteractive
 ENV PYTHONUNBUFFERED=1
-ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/usr/local/nvidia/lib64:/usr/local/nvidia/bin`
+ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:` + libraryPath
 }
 
-func (g *Generator) installTini() string {
+// environment sets the environment variables in cog.yaml, in order of
+// their names, so the Dockerfile is the same every time. Values can refer
+// to other variables, like $HOME.
+func (g *Generator) environment() string {
+	names := []string{}
+	for name := range g.Config.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(g.Config.Environment[name])
+		lines = append(lines, fmt.Sprintf(`ENV %s="%s"`, name, value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// labels sets the labels in cog.yaml, in order of their keys. They're set
+// last, so changing them doesn't rebuild anything else.
+func (g *Generator) labels() string {
+	if len(g.Config.Labels) == 0 {
+		return ""
+	}
+	keys := []string{}
+	for key := range g.Config.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(g.Config.Labels[key])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, value))
+	}
+	return "LABEL " + strings.Join(pairs, " \\\n\t")
+}
+
+func (g *Generator) installTini() (string, error) {
 	// Install tini as the image entrypoint to provide signal handling and process
 	// reaping appropriate for PID 1.
 	//
 	// N.B. If you remove/change this, consider removing/changing the `has_init`
 	// image label applied in image/build.go.
-	lines := []string{
-		`RUN --mount=type=cache,target=/var/cache/apt set -eux; \
+	lines := []string{g.downloadTini()}
+	if g.Offline {
+		var err error
+		lines, err = g.copyEmbeddedTini()
+		if err != nil {
+			return "", err
+		}
+	}
+	lines = append(lines, `ENTRYPOINT ["/sbin/tini", "--"]`)
+	return strings.Join(lines, "\n"), nil
+}
+
+func (g *Generator) downloadTini() string {
+	if g.Config.Build.Distro == config.DistroUBI9 {
+		// Check the download against its published checksum, rather than
+		// trusting whatever comes back
+		return `RUN set -eux; \
+TINI_VERSION=v0.19.0; \
+case "$(uname -m)" in aarch64) TINI_ARCH=arm64 ;; *) TINI_ARCH=amd64 ;; esac; \
+cd /tmp; \
+curl -fsSL -O "https://github.com/krallin/tini/releases/download/${TINI_VERSION}/tini-${TINI_ARCH}"; \
+curl -fsSL -O "https://github.com/krallin/tini/releases/download/${TINI_VERSION}/tini-${TINI_ARCH}.sha256sum"; \
+sha256sum -c "tini-${TINI_ARCH}.sha256sum"; \
+install -m 755 "tini-${TINI_ARCH}" /sbin/tini; \
+rm "tini-${TINI_ARCH}" "tini-${TINI_ARCH}.sha256sum"`
+	}
+	switch g.PackageManager {
+	case PackageManagerApk, PackageManagerDnf:
+		// No dpkg to ask for the architecture, so map it from the kernel's name for it
+		installCurl := "apk add --no-cache curl"
+		if g.PackageManager == PackageManagerDnf {
+			installCurl = "(command -v curl || dnf install -y curl-minimal); dnf clean all"
+		}
+		return `RUN set -eux; \
+` + installCurl + `; \
+TINI_VERSION=v0.19.0; \
+case "$(uname -m)" in aarch64) TINI_ARCH=arm64 ;; *) TINI_ARCH=amd64 ;; esac; \
+curl -sSL -o /sbin/tini "https://github.com/krallin/tini/releases/download/${TINI_VERSION}/tini-${TINI_ARCH}"; \
+chmod +x /sbin/tini`
+	default:
+		return `RUN --mount=type=cache,target=/var/cache/apt set -eux; \
 apt-get update -qq; \
 apt-get install -qqy --no-install-recommends curl; \
 rm -rf /var/lib/apt/lists/*; \
 TINI_VERSION=v0.19.0; \
 TINI_ARCH="$(dpkg --print-architecture)"; \
 curl -sSL -o /sbin/tini "https://github.com/krallin/tini/releases/download/${TINI_VERSION}/tini-${TINI_ARCH}"; \
-chmod +x /sbin/tini`,
-		`ENTRYPOINT ["/sbin/tini", "--"]`,
+chmod +x /sbin/tini`
 	}
-	return strings.Join(lines, "\n")
 }
 
-func (g *Generator) aptInstalls() (string, error) {
+// aptArchiveURLs matches the URLs of the Debian and Ubuntu package archives
+// in apt's sources, but not the sources of other repositories, like CUDA's.
+const aptArchiveURLs = `https\?://\([a-z][a-z]\.\)\?\(archive\|security\|ports\)\.ubuntu\.com\|https\?://\(deb\|security\)\.debian\.org`
+
+// aptMirror points apt at build.apt_mirror, before anything is installed
+// with it. Only the host of the archives is replaced, so the mirror must
+// serve them at the same paths, like /ubuntu and /debian-security. Both the
+// old sources.list format and the deb822 .sources files of newer releases
+// are rewritten.
+func (g *Generator) aptMirror() (string, error) {
+	mirror := strings.TrimSuffix(g.Config.Build.AptMirror, "/")
+	if mirror == "" {
+		return "", nil
+	}
+	if g.PackageManager == PackageManagerApk || g.PackageManager == PackageManagerDnf {
+		return "", fmt.Errorf("'build.apt_mirror' in cog.yaml can't be used with a base image that installs packages with %s", g.PackageManager)
+	}
+	return fmt.Sprintf(`RUN find /etc/apt -name '*.list' -o -name '*.sources' | xargs -r sed -i 's#%s#%s#g'`, aptArchiveURLs, mirror), nil
+}
+
+func (g *Generator) systemPackageInstalls() (string, error) {
 	packages := g.Config.Build.SystemPackages
 	if len(packages) == 0 {
 		return "", nil
 	}
-	return "RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get install -qqy " +
-		strings.Join(packages, " ") +
-		" && rm -rf /var/lib/apt/lists/*", nil
+	name := string(g.PackageManager)
+	if name == "" {
+		name = string(PackageManagerApt)
+	}
+	return g.addStage(name, g.withInstallOptions(g.PackageManager.installCommand(packages))), nil
 }
 
-func (g *Generator) installPythonCUDA() (string, error) {
-	// TODO: check that python version is valid
+// installPython installs the Python in build.python_version, from
+// PythonTarball if it's set, from python-build-standalone with
+// 'python_install: standalone', or else with pyenv.
+func (g *Generator) installPython() (string, error) {
+	if g.PythonTarball != "" {
+		return g.installPythonTarball()
+	}
+	if g.Config.Build.PythonInstall == config.PythonInstallStandalone {
+		return g.installPythonStandalone()
+	}
+	return g.installPythonCUDA()
+}
 
-	py := g.Config.Build.PythonVersion
+func (g *Generator) installPythonCUDA() (string, error) {
+	// It's been checked when the config was validated
+	py := g.Config.Build.PythonPatchVersion()
 
 	return `ENV PATH="/root/.pyenv/shims:/root/.pyenv/bin:$PATH"
 RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get install -qqy --no-install-recommends \
@@ -353,71 +1108,326 @@ RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get insta
 	ca-certificates \
 	&& rm -rf /var/lib/apt/lists/*
 ` + fmt.Sprintf(`RUN curl -s -S -L https://raw.githubusercontent.com/pyenv/pyenv-installer/master/bin/pyenv-installer | bash && \
-	git clone https://github.com/momo-lab/pyenv-install-latest.git "$(pyenv root)"/plugins/pyenv-install-latest && \
-	pyenv install-latest "%s" && \
-	pyenv global $(pyenv install-latest --print "%s") && \
+	pyenv install "%s" && \
+	pyenv global "%s" && \
 	pip install "wheel<1"`, py, py), nil
 }
 
+// installPythonStandalone downloads a prebuilt Python from
+// python-build-standalone's install_only tarball for the image's
+// architecture, and extracts it to pythonTarballDir, like PythonTarball.
+func (g *Generator) installPythonStandalone() (string, error) {
+	release, err := g.Config.Build.PythonStandaloneRelease()
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("%s/%s/cpython-%s%%2B%s-${PYTHON_ARCH}-unknown-linux-gnu-install_only.tar.gz", pythonStandaloneURL, release, g.Config.Build.PythonPatchVersion(), release)
+	return fmt.Sprintf(`RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get install -qqy --no-install-recommends \
+	curl \
+	ca-certificates \
+	&& rm -rf /var/lib/apt/lists/*
+RUN case "$(uname -m)" in aarch64) PYTHON_ARCH=aarch64 ;; *) PYTHON_ARCH=x86_64 ;; esac && \
+	mkdir -p %s && curl -fsSL "%s" | tar -xz -C %s --strip-components=1 && \
+	ln -sf python3 %s/bin/python && \
+	ln -sf pip3 %s/bin/pip
+ENV PATH="%s/bin:$PATH"
+RUN pip install "wheel<1"`, pythonTarballDir, url, pythonTarballDir, pythonTarballDir, pythonTarballDir, pythonTarballDir), nil
+}
+
+// installPythonUBI9 installs Python from the UBI repositories, so it uses
+// the system OpenSSL.
+func (g *Generator) installPythonUBI9() string {
+	py := g.Config.Build.PythonMinorVersion()
+	packages := fmt.Sprintf("python%s python%s-pip", py, py)
+	if py == "3.9" {
+		// 3.9 is the system Python, which isn't packaged by version
+		packages = "python3 python3-pip"
+	}
+	return fmt.Sprintf(`RUN --mount=type=cache,target=/var/cache/dnf dnf install -y %s && dnf clean all && \
+	ln -sf /usr/bin/python%s /usr/local/bin/python && \
+	ln -sf /usr/bin/pip%s /usr/local/bin/pip && \
+	pip install "wheel<1"`, packages, py, py)
+}
+
+// pipIndexArgs returns the arguments to pip install for the package indexes
+// in cog.yaml, or for the wheelhouse, which replaces them.
+func (g *Generator) pipIndexArgs() string {
+	if g.wheelhouse() != "" {
+		return "--no-index --find-links " + wheelhouseDir
+	}
+	indexURL := g.PipIndexURL
+	if indexURL == "" {
+		indexURL = g.Config.Build.PipIndex()
+	}
+	args := []string{"-i", indexURL}
+	for _, url := range g.Config.Build.PipExtraIndexURLs {
+		args = append(args, "--extra-index-url", url)
+	}
+	return strings.Join(args, " ")
+}
+
 func (g *Generator) installCog() (string, error) {
-	// Wheel name needs to be full format otherwise pip refuses to install it
-	cogFilename := "cog-0.0.1.dev-py3-none-any.whl"
-	lines, containerPath, err := g.writeTemp(cogFilename, cogWheelEmbed)
+	lines, containerPath, err := g.writeTemp(CogWheelFilename, cogWheelEmbed)
 	if err != nil {
 		return "", err
 	}
-	lines = append(lines, fmt.Sprintf("RUN --mount=type=cache,target=/root/.cache/pip pip install -i https://pypi.tuna.tsinghua.edu.cn/simple %s", containerPath))
+	lines = append(lines, g.withInstallOptions(g.pipInstall(containerPath, false)))
 	return strings.Join(lines, "\n"), nil
 }
 
+// uvImage is the image uv is copied from, for build.installer: uv
+const uvImage = "ghcr.io/astral-sh/uv:0.4.30"
+
+// installUV installs uv, if it installs Python packages.
+func (g *Generator) installUV() string {
+	if g.Config.Build.Installer != config.InstallerUV {
+		return ""
+	}
+	return fmt.Sprintf("COPY --from=%s /uv /usr/local/bin/uv", uvImage)
+}
+
+// pipInstall returns a RUN instruction that installs the Python packages in
+// args with build.installer, caching what it downloads. With ssh, the
+// builder's SSH agent is forwarded to it.
+func (g *Generator) pipInstall(args string, ssh bool) string {
+	cache, env, install := "/root/.cache/pip", "", "pip install"
+	if g.Config.Build.Installer == config.InstallerUV {
+		// The cache is on a different filesystem, so packages can't be
+		// hard linked from it. uv picks the best match from all the
+		// indexes, like pip, rather than the first index a package is in.
+		cache, env, install = "/root/.cache/uv", "UV_LINK_MODE=copy ", "uv pip install --system --index-strategy unsafe-best-match"
+	}
+	mounts := "--mount=type=cache,target=" + cache
+	if ssh {
+		mounts += " --mount=type=ssh"
+		env = `GIT_SSH_COMMAND="ssh -o StrictHostKeyChecking=accept-new" ` + env
+	}
+	return fmt.Sprintf("RUN %s %s%s %s %s", mounts, env, install, g.pipIndexArgs(), args)
+}
+
+// installWeightsDecryption installs the package cog uses to decrypt
+// encrypted weights at runtime.
+func (g *Generator) installWeightsDecryption() string {
+	if g.Config.Weights == nil || g.Config.Weights.Encryption == nil {
+		return ""
+	}
+	return g.pipInstall("cryptography", false)
+}
+
 func (g *Generator) pipInstalls() (string, error) {
-	requirements, err := g.Config.PythonRequirementsForArch(g.GOOS, g.GOARCH)
+	var lines []string
+	var containerPath, locked string
+	var err error
+	if g.Config.Build.Poetry {
+		lines, containerPath, err = g.poetryExport()
+	} else {
+		var requirements string
+		requirements, err = g.Config.PythonRequirementsForArch(g.GOOS, g.GOARCH)
+		if err != nil {
+			return "", err
+		}
+		if strings.Trim(requirements, "") == "" {
+			return "", nil
+		}
+		var ok bool
+		locked, ok, err = g.lockedRequirements(requirements)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			requirements = locked
+		}
+		lines, containerPath, err = g.writeTemp("requirements.txt", []byte(requirements))
+	}
 	if err != nil {
 		return "", err
 	}
-	if strings.Trim(requirements, "") == "" {
-		return "", nil
+
+	args := "-r " + containerPath
+	if locked != "" {
+		args = "--require-hashes " + args
 	}
+	install := g.pipInstall(args, false)
+	if g.Config.Build.SSH {
+		// Use the SSH agent of whoever's building for git+ssh:// requirements.
+		// There are no known hosts in the image, so trust hosts the first
+		// time they're seen.
+		install = g.pipInstall(args, true)
+	}
+	lines = append(lines, g.addStage("pip", g.withInstallOptions(install)))
+	return strings.Join(lines, "\n"), nil
+}
 
-	lines, containerPath, err := g.writeTemp("requirements.txt", []byte(requirements))
+// lockedRequirements returns the pinned and hashed requirements in
+// config.PythonLockFilename, if it was resolved from requirements. If they've
+// changed since, it isn't used, and the build fails with Strict.
+func (g *Generator) lockedRequirements(requirements string) (string, bool, error) {
+	contents, err := afero.ReadFile(g.fs, filepath.Join(g.Dir, config.PythonLockFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
 	if err != nil {
-		return "", err
+		return "", false, fmt.Errorf("Failed to read %s: %w", config.PythonLockFilename, err)
 	}
+	if g.Lock == nil || g.Lock.PythonRequirements != config.PythonRequirementsHash(requirements) {
+		message := fmt.Sprintf("%s is out of date with the Python packages in cog.yaml, so they're installed without it. Run 'cog lock' to update it", config.PythonLockFilename)
+		if g.Strict {
+			return "", false, errors.New(message)
+		}
+		console.Warn(message)
+		return "", false, nil
+	}
+	return string(contents), true, nil
+}
 
-	lines = append(lines, "RUN --mount=type=cache,target=/root/.cache/pip pip install -i https://pypi.tuna.tsinghua.edu.cn/simple -r "+containerPath)
-	return strings.Join(lines, "\n"), nil
+// poetryExport returns instructions that export the packages in poetry.lock
+// to a requirements file, and its path in the image. Poetry is installed in
+// a virtualenv that's removed in the same instruction, so it isn't in the
+// image.
+func (g *Generator) poetryExport() ([]string, string, error) {
+	lines := []string{}
+	for _, filename := range []string{config.PyprojectFilename, config.PoetryLockFilename} {
+		contents, err := afero.ReadFile(g.fs, filepath.Join(g.Dir, filename))
+		if err != nil {
+			return nil, "", err
+		}
+		copyLines, _, err := g.writeTemp(path.Join("poetry", filename), contents)
+		if err != nil {
+			return nil, "", err
+		}
+		lines = append(lines, copyLines...)
+	}
+	containerPath := "/tmp/requirements.txt"
+	export := fmt.Sprintf("RUN --mount=type=cache,target=/root/.cache/pip python -m venv /tmp/poetry-venv && /tmp/poetry-venv/bin/pip install %s poetry poetry-plugin-export && cd /tmp/poetry && /tmp/poetry-venv/bin/poetry export --without-hashes --format requirements.txt --output %s && rm -rf /tmp/poetry-venv", g.pipIndexArgs(), containerPath)
+	lines = append(lines, g.withInstallOptions(export))
+	return lines, containerPath, nil
 }
 
 func (g *Generator) run() (string, error) {
-	runCommands := g.Config.Build.Run
+	runCommands := append([]config.RunItem{}, g.Config.Build.Run...)
 
 	// For backwards compatibility
-	runCommands = append(runCommands, g.Config.Build.PreInstall...)
+	for _, command := range g.Config.Build.PreInstall {
+		runCommands = append(runCommands, config.RunItem{Command: command})
+	}
 
 	lines := []string{}
-	for _, run := range runCommands {
-		run = strings.TrimSpace(run)
-		if strings.Contains(run, "\n") {
+	for i, run := range runCommands {
+		command := strings.TrimSpace(run.Command)
+		if strings.Contains(command, "\n") {
 			return "", fmt.Errorf(`One of the commands in 'run' contains a new line, which won't work. You need to create a new list item in YAML prefixed with '-' for each command.
 
-This is the offending line: %s`, run)
+This is the offending line: %s`, command)
+		}
+		instruction := "RUN " + command
+		if run.RequiresGPU {
+			if instruction = g.gpuRun(command); instruction == "" {
+				continue
+			}
+		}
+		timeout := g.Config.Build.StepTimeoutDuration()
+		if run.Timeout != "" {
+			timeout = run.TimeoutDuration()
 		}
-		lines = append(lines, "RUN "+run)
+		lines = append(lines, g.addStage(fmt.Sprintf("run %d/%d", i+1, len(runCommands)), withRetries(withTimeout(instruction, timeout), run.Retries)))
 	}
-	return strings.Join(lines, "\n"), nil
+	copyFirstBoot, err := g.copyFirstBoot()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(filterEmpty(append(lines, copyFirstBoot)), "\n"), nil
+}
+
+// withInstallOptions applies build.step_timeout and build.install_retries to
+// a RUN instruction that installs packages.
+func (g *Generator) withInstallOptions(instruction string) string {
+	return withRetries(withTimeout(instruction, g.Config.Build.StepTimeoutDuration()), g.Config.Build.InstallRetries)
+}
+
+// withRetries makes a RUN instruction run its command again if it fails, up
+// to retries times, waiting a little longer each time. It fails with the
+// exit code of the last attempt.
+func withRetries(instruction string, retries int) string {
+	if retries <= 0 {
+		return instruction
+	}
+	prefix, command := splitRun(instruction)
+	return fmt.Sprintf(`%s n=0; until (%s); do s=$?; n=$((n+1)); if [ $n -gt %d ]; then exit $s; fi; echo "Failed with exit code $s, retrying ($n/%d)..."; sleep $((n*5)); done`, prefix, command, retries, retries)
+}
+
+// withTimeout makes a RUN instruction fail if its command runs for longer
+// than timeout, rather than hanging the build.
+func withTimeout(instruction string, timeout time.Duration) string {
+	if timeout <= 0 {
+		return instruction
+	}
+	prefix, command := splitRun(instruction)
+	seconds := int(math.Ceil(timeout.Seconds()))
+	return fmt.Sprintf(`%s timeout %d sh -c %s || { s=$?; if [ $s -eq 124 ]; then echo "Timed out after %s" >&2; fi; exit $s; }`, prefix, seconds, shell.Quote(command), timeout)
+}
+
+// splitRun splits a RUN instruction into "RUN" and its flags, and the
+// command it runs.
+func splitRun(instruction string) (prefix string, command string) {
+	fields := strings.Fields(instruction)
+	flags := []string{fields[0]}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "--") {
+			break
+		}
+		flags = append(flags, field)
+	}
+	command = strings.TrimSpace(instruction)
+	for _, flag := range flags {
+		command = strings.TrimSpace(strings.TrimPrefix(command, flag))
+	}
+	return strings.Join(flags, " "), command
+}
+
+// addStage records instruction as a stage of the build called name, and
+// returns it.
+func (g *Generator) addStage(name string, instruction string) string {
+	g.stages = append(g.stages, docker.BuildStage{Name: name, Instruction: instruction})
+	return instruction
+}
+
+// Stages returns the steps of the last Dockerfile that was generated that
+// install packages or run commands from cog.yaml, so they can be shown by
+// name in the build's output.
+func (g *Generator) Stages() []docker.BuildStage {
+	return g.stages
 }
 
 // writeTemp writes a temporary file that can be used as part of the build process
 // It returns the lines to add to Dockerfile to make it available and the filename it ends up as inside the container
+//
+// The file's SHA256 is recorded in Checksums, and checked after it is copied
+// into the image, so a file that was corrupted on its way into the build
+// fails it.
 func (g *Generator) writeTemp(filename string, contents []byte) ([]string, string, error) {
 	path := filepath.Join(g.tmpDir, filename)
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	if err := g.fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return []string{}, "", fmt.Errorf("Failed to write %s: %w", filename, err)
 	}
-	if err := os.WriteFile(path, contents, 0o644); err != nil {
+	if err := afero.WriteFile(g.fs, path, contents, 0o644); err != nil {
 		return []string{}, "", fmt.Errorf("Failed to write %s: %w", filename, err)
 	}
-	return []string{fmt.Sprintf("COPY %s /tmp/%s", filepath.Join(g.relativeTmpDir, filename), filename)}, "/tmp/" + filename, nil
+	containerPath := "/tmp/" + filename
+	sum := sha256.Sum256(contents)
+	if g.checksums == nil {
+		g.checksums = map[string]string{}
+	}
+	g.checksums[containerPath] = hex.EncodeToString(sum[:])
+	return []string{
+		fmt.Sprintf("COPY %s %s", filepath.Join(g.relativeTmpDir, filename), containerPath),
+		fmt.Sprintf(`RUN echo "%s  %s" | sha256sum -c -`, g.checksums[containerPath], containerPath),
+	}, containerPath, nil
+}
+
+// Checksums returns the SHA256 of each file the generated Dockerfile copies
+// into the image from its temporary directory, by its path in the image.
+func (g *Generator) Checksums() map[string]string {
+	return g.checksums
 }
 
 func filterEmpty(list []string) []string {
@@ -1,14 +1,18 @@
 package dockerfile
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io/fs"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 
 	"github.com/replicate/cog/pkg/config"
@@ -27,9 +31,30 @@ ENTRYPOINT ["/sbin/tini", "--"]
 `
 }
 
+// testTiniFS has fake tini binaries, for offline builds
+func testTiniFS() fstest.MapFS {
+	return fstest.MapFS{
+		"embed/tini-amd64": {Data: []byte("tini for amd64")},
+		"embed/tini-arm64": {Data: []byte("tini for arm64")},
+	}
+}
+
 func testInstallCog(relativeTmpDir string) string {
-	return fmt.Sprintf(`COPY %s/cog-0.0.1.dev-py3-none-any.whl /tmp/cog-0.0.1.dev-py3-none-any.whl
-RUN --mount=type=cache,target=/root/.cache/pip pip install -i https://pypi.tuna.tsinghua.edu.cn/simple /tmp/cog-0.0.1.dev-py3-none-any.whl`, relativeTmpDir)
+	return testCopyTemp(relativeTmpDir, "cog-0.0.1.dev-py3-none-any.whl", cogWheelEmbed) + `
+RUN --mount=type=cache,target=/root/.cache/pip pip install -i https://pypi.tuna.tsinghua.edu.cn/simple /tmp/cog-0.0.1.dev-py3-none-any.whl`
+}
+
+// testCopyTemp returns the lines that copy a file written by writeTemp into
+// the image and check its checksum.
+func testCopyTemp(relativeTmpDir string, filename string, contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return fmt.Sprintf(`COPY %s/%s /tmp/%s
+RUN echo "%x  /tmp/%s" | sha256sum -c -`, relativeTmpDir, filename, filename, sum, filename)
+}
+
+func testHealthcheck(port int) string {
+	return fmt.Sprintf(`HEALTHCHECK --interval=30s --timeout=10s --start-period=10m --retries=3 CMD ["python", "-c", "import json, sys, urllib.request; status = json.load(urllib.request.urlopen('http://127.0.0.1:%d/health-check'))['status']; sys.exit(status not in ('READY', 'BUSY'))"]
+`, port)
 }
 
 func testInstallPython(version string) string {
@@ -55,9 +80,8 @@ RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get insta
 	ca-certificates \
 	&& rm -rf /var/lib/apt/lists/*
 RUN curl -s -S -L https://raw.githubusercontent.com/pyenv/pyenv-installer/master/bin/pyenv-installer | bash && \
-	git clone https://github.com/momo-lab/pyenv-install-latest.git "$(pyenv root)"/plugins/pyenv-install-latest && \
-	pyenv install-latest "%s" && \
-	pyenv global $(pyenv install-latest --print "%s") && \
+	pyenv install "%s" && \
+	pyenv global "%s" && \
 	pip install "wheel<1"
 `, version, version)
 }
@@ -124,8 +148,8 @@ func TestGroupFiles(t *testing.T) {
 				},
 			},
 			[][]string{
-				{"smallFile1"},
-				{"smallFile2", "smallFile3"},
+				{"smallFile2"},
+				{"smallFile1", "smallFile3"},
 			},
 			2,
 			1001,
@@ -187,8 +211,8 @@ func TestGroupFiles(t *testing.T) {
 			},
 			[][]string{
 				{"largeFile1", "largeFile2"},
-				{"smallFile1"},
 				{"smallFile2"},
+				{"smallFile1"},
 			},
 			2,
 			1000,
@@ -201,7 +225,7 @@ func TestGroupFiles(t *testing.T) {
 			strconv.Itoa(i),
 			func(t *testing.T) {
 				t.Parallel()
-				actual, _, err := groupFiles(tc.numGroups, tc.threshold, tc.inputs)
+				actual, _, err := groupFiles(afero.NewMemMapFs(), "", tc.numGroups, tc.threshold, tc.inputs)
 				require.NoError(t, err)
 				require.Equal(t, tc.expect, actual)
 			},
@@ -233,12 +257,64 @@ ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/usr/local/nvidia
 ` + testTini() + testInstallCog(gen.relativeTmpDir) + `
 WORKDIR /src
 EXPOSE 5000
-CMD ["python", "-m", "cog.server.http"]
-COPY . /src`
+` + testHealthcheck(5000) + `CMD ["python", "-m", "cog.server.http"]
+COPY [".","/src"]`
 
 	require.Equal(t, expected, actual)
 }
 
+func TestLayerGroupsFromConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, size := range map[string]int{"a.py": 1, "b.py": 1, "c.py": 1, "d.py": 1, "model.bin": 100} {
+		require.NoError(t, os.WriteFile(path.Join(tmpDir, name), make([]byte, size), 0o644))
+	}
+	conf, err := config.FromYAML([]byte(`
+build:
+  layer_groups: 2
+  large_file_threshold: 50B
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	// Setting them in cog.yaml groups files without --groupfile
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, `COPY ["model.bin","/src"]`)
+	require.Contains(t, actual, `COPY ["b.py","d.py","/src"]`)
+	require.Contains(t, actual, `COPY ["a.py","c.py","/src"]`)
+}
+
+func TestGroupFilesStable(t *testing.T) {
+	files := func(names ...string) []fs.FileInfo {
+		infos := []fs.FileInfo{}
+		for _, name := range names {
+			infos = append(infos, &mockFileInfo{name: name, size: 1, mode: fs.ModeTemporary})
+		}
+		return infos
+	}
+	before, _, err := groupFiles(afero.NewMemMapFs(), "", 4, 1000, files("a.py", "b.py", "c.py", "d.py", "e.py", "f.py"))
+	require.NoError(t, err)
+	after, _, err := groupFiles(afero.NewMemMapFs(), "", 4, 1000, files("a.py", "b.py", "c.py", "d.py", "e.py", "f.py", "new.py"))
+	require.NoError(t, err)
+
+	// Adding a file only changes the group it's added to
+	unchanged := map[string]bool{}
+	for _, group := range before {
+		unchanged[strings.Join(group, ",")] = true
+	}
+	changed := 0
+	for _, group := range after {
+		if !unchanged[strings.Join(group, ",")] {
+			changed++
+			require.Contains(t, group, "new.py")
+		}
+	}
+	require.Equal(t, 1, changed)
+}
+
 func TestGenerateEmptyGPU(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -259,11 +335,11 @@ FROM nvidia/cuda:11.2.0-cudnn8-devel-ubuntu20.04
 ENV DEBIAN_FRONTEND=noninteractive
 ENV PYTHONUNBUFFERED=1
 ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/usr/local/nvidia/lib64:/usr/local/nvidia/bin
-` + testTini() + testInstallPython("3.8") + testInstallCog(gen.relativeTmpDir) + `
+` + testTini() + testInstallPython("3.8.20") + testInstallCog(gen.relativeTmpDir) + `
 WORKDIR /src
 EXPOSE 5000
-CMD ["python", "-m", "cog.server.http"]
-COPY . /src`
+` + testHealthcheck(5000) + `CMD ["python", "-m", "cog.server.http"]
+COPY [".","/src"]`
 
 	require.Equal(t, expected, actual)
 }
@@ -299,13 +375,15 @@ ENV PYTHONUNBUFFERED=1
 ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/usr/local/nvidia/lib64:/usr/local/nvidia/bin
 ` + testTini() + testInstallCog(gen.relativeTmpDir) + `
 RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get install -qqy ffmpeg cowsay && rm -rf /var/lib/apt/lists/*
-COPY ` + gen.relativeTmpDir + `/requirements.txt /tmp/requirements.txt
+` + testCopyTemp(gen.relativeTmpDir, "requirements.txt", []byte(`--find-links https://download.pytorch.org/whl/torch_stable.html
+torch==1.5.1+cpu
+pandas==1.2.0.12`)) + `
 RUN --mount=type=cache,target=/root/.cache/pip pip install -i https://pypi.tuna.tsinghua.edu.cn/simple -r /tmp/requirements.txt
 RUN cowsay moo
 WORKDIR /src
 EXPOSE 5000
-CMD ["python", "-m", "cog.server.http"]
-COPY . /src`
+` + testHealthcheck(5000) + `CMD ["python", "-m", "cog.server.http"]
+COPY [".","/src"]`
 	require.Equal(t, expected, actual)
 
 	requirements, err := os.ReadFile(path.Join(gen.tmpDir, "requirements.txt"))
@@ -346,16 +424,17 @@ ENV DEBIAN_FRONTEND=noninteractive
 ENV PYTHONUNBUFFERED=1
 ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/usr/local/nvidia/lib64:/usr/local/nvidia/bin
 ` + testTini() +
-		testInstallPython("3.8") +
+		testInstallPython("3.8.20") +
 		testInstallCog(gen.relativeTmpDir) + `
 RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get install -qqy ffmpeg cowsay && rm -rf /var/lib/apt/lists/*
-COPY ` + gen.relativeTmpDir + `/requirements.txt /tmp/requirements.txt
+` + testCopyTemp(gen.relativeTmpDir, "requirements.txt", []byte(`torch==1.5.1
+pandas==1.2.0.12`)) + `
 RUN --mount=type=cache,target=/root/.cache/pip pip install -i https://pypi.tuna.tsinghua.edu.cn/simple -r /tmp/requirements.txt
 RUN cowsay moo
 WORKDIR /src
 EXPOSE 5000
-CMD ["python", "-m", "cog.server.http"]
-COPY . /src`
+` + testHealthcheck(5000) + `CMD ["python", "-m", "cog.server.http"]
+COPY [".","/src"]`
 
 	require.Equal(t, expected, actual)
 
@@ -394,8 +473,8 @@ RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get insta
 RUN cowsay moo
 WORKDIR /src
 EXPOSE 5000
-CMD ["python", "-m", "cog.server.http"]
-COPY . /src`
+` + testHealthcheck(5000) + `CMD ["python", "-m", "cog.server.http"]
+COPY [".","/src"]`
 	require.Equal(t, expected, actual)
 
 }
@@ -418,3 +497,1231 @@ build:
 	fmt.Println(actual)
 	require.Contains(t, actual, `pip install -i https://pypi.tuna.tsinghua.edu.cn/simple -r /tmp/requirements.txt`)
 }
+
+func TestPipIndexURL(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  pip_index_url: https://pypi.corp.example.com/simple
+  pip_extra_index_urls:
+    - https://download.pytorch.org/whl/cu118
+  python_packages:
+    - torch==2.0.1
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, "pip install -i https://pypi.corp.example.com/simple --extra-index-url https://download.pytorch.org/whl/cu118 /tmp/cog-0.0.1.dev-py3-none-any.whl")
+	require.Contains(t, actual, "pip install -i https://pypi.corp.example.com/simple --extra-index-url https://download.pytorch.org/whl/cu118 -r /tmp/requirements.txt")
+	require.NotContains(t, actual, config.DefaultPipIndexURL)
+}
+
+func TestAptMirror(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  apt_mirror: https://mirror.example.com/
+  system_packages:
+    - ffmpeg
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+	rewrite := "| xargs -r sed -i 's#" + aptArchiveURLs + "#https://mirror.example.com#g'"
+	require.Contains(t, actual, rewrite)
+	// The sources are rewritten before anything is installed with apt
+	require.Less(t, strings.Index(actual, rewrite), strings.Index(actual, "apt-get"))
+
+	gen.PackageManager = PackageManagerApk
+	_, err = gen.GenerateBase()
+	require.ErrorContains(t, err, "installs packages with apk")
+}
+
+func TestStepTimeouts(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  step_timeout: 30m
+  install_retries: 1
+  python_packages:
+    - torch==2.0.1
+  run:
+    - echo 'hello'
+    - command: make
+      timeout: 2h
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+	require.Contains(t, actual, `RUN timeout 1800 sh -c 'echo '\''hello'\''' || { s=$?; if [ $s -eq 124 ]; then echo "Timed out after 30m0s" >&2; fi; exit $s; }`)
+	require.Contains(t, actual, `RUN timeout 7200 sh -c 'make' ||`)
+	// Each attempt of a retried step has its own timeout
+	require.Contains(t, actual, `until (timeout 1800 sh -c 'pip install -i`)
+}
+
+func TestCustomBaseImage(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  base_image: registry.example.com/hardened/cuda:12.1
+  base_image_provides: [python, cuda]
+  python_version: "3.11"
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	_, ok, err := gen.StandardPackageManager()
+	require.NoError(t, err)
+	require.False(t, ok)
+	gen.PackageManager = PackageManagerApt
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+	require.Contains(t, actual, "\nFROM registry.example.com/hardened/cuda:12.1\n")
+	require.NotContains(t, actual, "pyenv")
+
+	// Python is installed if the image doesn't have it
+	conf.Build.BaseImageProvides = []string{config.ProvidesCUDA}
+	actual, err = gen.GenerateBase()
+	require.NoError(t, err)
+	require.Contains(t, actual, "pyenv install \"3.11.10\"")
+
+	gen.PackageManager = PackageManagerDnf
+	_, err = gen.GenerateBase()
+	require.ErrorContains(t, err, "add 'python' to 'build.base_image_provides'")
+}
+
+func TestRetries(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  install_retries: 2
+  system_packages:
+    - ffmpeg
+  run:
+    - echo hello
+    - command: python download.py
+      retries: 3
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+	require.Contains(t, actual, "RUN --mount=type=cache,target=/var/cache/apt n=0; until (apt-get update -qq && apt-get install -qqy ffmpeg && rm -rf /var/lib/apt/lists/*); do s=$?; n=$((n+1)); if [ $n -gt 2 ]; then exit $s; fi;")
+	require.Contains(t, actual, "\nRUN echo hello\n")
+	require.Contains(t, actual, `RUN n=0; until (python download.py); do s=$?; n=$((n+1)); if [ $n -gt 3 ]; then exit $s; fi; echo "Failed with exit code $s, retrying ($n/3)..."; sleep $((n*5)); done`)
+}
+
+func TestStages(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  system_packages:
+    - ffmpeg
+  python_packages:
+    - torch==2.0.1
+  run:
+    - python -c "import torch"
+    - echo done
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+	names := []string{}
+	for _, stage := range gen.Stages() {
+		names = append(names, stage.Name)
+		require.Contains(t, actual, stage.Instruction)
+	}
+	require.Equal(t, []string{"apt", "pip", "run 1/2", "run 2/2"}, names)
+}
+
+func TestBaseImageMirroredAndPinned(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	gen.RegistryMirrors = map[string]string{"docker.io": "mirror.corp/dockerhub"}
+	gen.Lock = &config.Lock{BaseImages: map[string]string{"python:3.9": "sha256:abc123"}}
+
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+	require.Contains(t, actual, "\nFROM mirror.corp/dockerhub/library/python:3.9@sha256:abc123\n")
+}
+
+func TestGenerateUBI9(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  distro: ubi9
+  python_version: "3.11"
+  system_packages:
+    - ffmpeg
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	gen.PackageManager = PackageManagerDnf
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+	require.Contains(t, actual, "\nFROM registry.access.redhat.com/ubi9/ubi:latest\n")
+	require.Contains(t, actual, "update-crypto-policies --set FIPS")
+	require.Contains(t, actual, "dnf install -y python3.11 python3.11-pip")
+	require.Contains(t, actual, "dnf install -y ffmpeg")
+	require.Contains(t, actual, `sha256sum -c "tini-${TINI_ARCH}.sha256sum"`)
+	require.NotContains(t, actual, "apt-get")
+	require.NotContains(t, actual, "| bash")
+}
+
+func TestGenerateSourceOwner(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  source_owner: "1000:1000"
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(actual, `# syntax = docker/dockerfile:1.2
+FROM python:3.9 AS source_owner
+COPY . /src
+RUN chmod -R u+rwX,go=rX /src
+FROM python:3.9
+`), actual)
+	require.True(t, strings.HasSuffix(actual, `
+COPY --from=source_owner --chown=1000:1000 ["/src","/src"]`), actual)
+
+	instruction, err := gen.copyToSrc([]string{"weights"}, "/src/weights")
+	require.NoError(t, err)
+	require.Equal(t, `COPY --from=source_owner --chown=1000:1000 ["/src/weights","/src/weights"]`, instruction)
+}
+
+func TestGenerateRunAsUser(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  run_as_user: "1000"
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, "\nRUN (id 1000 >/dev/null 2>&1 || useradd --create-home -u 1000 cog) && mkdir -p /src && chown 1000 /src\nWORKDIR /src\n")
+	// The workspace is owned by the user, as with build.source_owner
+	require.True(t, strings.HasSuffix(actual, `
+COPY --from=source_owner --chown=1000 ["/src","/src"]
+USER 1000`), actual)
+
+	conf.Build.RunAsUser = "model"
+	conf.Build.SourceOwner = "model:model"
+	gen.PackageManager = PackageManagerApk
+	actual, err = gen.GenerateBase()
+	require.NoError(t, err)
+	require.Contains(t, actual, "\nRUN (id model >/dev/null 2>&1 || adduser -D model) && mkdir -p /src && chown model /src\n")
+	require.True(t, strings.HasSuffix(actual, "\nUSER model"), actual)
+}
+
+func TestGenerateRunRequiresGPU(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  run:
+    - echo hello
+    - command: pip install flash-attn
+      requires_gpu: true
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	gen.GPUBuilder = true
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(actual, "# syntax = docker/dockerfile:1.14-labs\n"), actual)
+	require.Contains(t, actual, "\nRUN --device=nvidia.com/gpu=all pip install flash-attn\n")
+	require.NotContains(t, actual, FirstBootPath)
+
+	// Without a GPU, it's run when the model first starts
+	gen.GPUBuilder = false
+	actual, err = gen.Generate()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(actual, dockerfileSyntax+"\n"), actual)
+	require.Contains(t, actual, "\nRUN echo hello\n")
+	require.NotContains(t, actual, "pip install flash-attn")
+	require.Contains(t, actual, `COPY ["`+gen.relativeTmpDir+`/first_boot.json","/cog/first_boot.json"]`)
+
+	contents, err := os.ReadFile(path.Join(gen.tmpDir, "first_boot.json"))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"run": [{"command": "pip install flash-attn"}]}`, string(contents))
+}
+
+func TestGeneratePoetry(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "pyproject.toml"), []byte("[tool.poetry]\nname = \"model\"\n"), 0o644))
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "poetry.lock"), []byte("[[package]]\nname = \"numpy\"\nversion = \"1.25.2\"\n"), 0o644))
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.10"
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, "COPY "+gen.relativeTmpDir+"/poetry/pyproject.toml /tmp/poetry/pyproject.toml\n")
+	require.Contains(t, actual, "COPY "+gen.relativeTmpDir+"/poetry/poetry.lock /tmp/poetry/poetry.lock\n")
+	require.Contains(t, actual, "&& cd /tmp/poetry && /tmp/poetry-venv/bin/poetry export --without-hashes --format requirements.txt --output /tmp/requirements.txt && rm -rf /tmp/poetry-venv\n")
+	require.Contains(t, actual, "pip install -i https://pypi.tuna.tsinghua.edu.cn/simple -r /tmp/requirements.txt\n")
+}
+
+func TestGenerateUV(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "requirements.txt"), []byte("numpy==1.25.2"), 0o644))
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.10"
+  python_requirements: requirements.txt
+  installer: uv
+  ssh: true
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, "\nCOPY --from=ghcr.io/astral-sh/uv:0.4.30 /uv /usr/local/bin/uv\n")
+	require.Contains(t, actual, "RUN --mount=type=cache,target=/root/.cache/uv UV_LINK_MODE=copy uv pip install --system --index-strategy unsafe-best-match -i https://pypi.tuna.tsinghua.edu.cn/simple /tmp/cog-0.0.1.dev-py3-none-any.whl\n")
+	require.Contains(t, actual, `RUN --mount=type=cache,target=/root/.cache/uv --mount=type=ssh GIT_SSH_COMMAND="ssh -o StrictHostKeyChecking=accept-new" UV_LINK_MODE=copy uv pip install --system --index-strategy unsafe-best-match -i https://pypi.tuna.tsinghua.edu.cn/simple -r /tmp/requirements.txt`)
+	require.NotContains(t, actual, "/root/.cache/pip")
+}
+
+func TestGenerateDownload(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  run_as_user: cog
+  download:
+    - url: https://example.com/model.safetensors
+      dest: weights/model.safetensors
+      sha256: 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+    - url: https://example.com/vae.bin
+      dest: /models/vae.bin
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	require.Contains(t, actual, "RUN --mount=type=cache,target=/weights-cache if [ ! -f /weights-cache/")
+	require.Contains(t, actual, `curl -fsSL -o /weights-cache/`)
+	require.Contains(t, actual, `'https://example.com/model.safetensors'`)
+	require.Contains(t, actual, `(echo "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae  /weights-cache/`)
+	require.Contains(t, actual, `mkdir -p '/src/weights' && cp /weights-cache/`)
+	require.Contains(t, actual, `'/src/weights/model.safetensors' && chown cog '/src/weights/model.safetensors'`)
+	require.Contains(t, actual, `mkdir -p '/models' && cp /weights-cache/`)
+	require.NotContains(t, actual, `chown cog '/models/vae.bin'`)
+	// Downloaded before the code is copied, so changing the code doesn't
+	// download them again
+	require.Less(t, strings.Index(actual, "/weights-cache"), strings.Index(actual, "COPY --from=source_owner"))
+	names := []string{}
+	for _, stage := range gen.Stages() {
+		names = append(names, stage.Name)
+	}
+	require.Equal(t, []string{"download 1/2", "download 2/2"}, names[len(names)-2:])
+}
+
+func TestGenerateBaseDownload(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  download:
+    - url: https://example.com/model.safetensors
+      dest: weights/model.safetensors
+    - url: https://example.com/vae.bin
+      dest: /models/vae.bin
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+
+	// The project directory is mounted over /src, so only files outside it
+	// are downloaded into the image
+	require.Contains(t, actual, `'https://example.com/vae.bin'`)
+	require.Contains(t, actual, `mkdir -p '/models' && cp /weights-cache/`)
+	require.NotContains(t, actual, `'https://example.com/model.safetensors'`)
+
+	// Files downloaded into the project directory aren't copied into
+	// images built from it
+	excludes, err := gen.ContextExcludes()
+	require.NoError(t, err)
+	require.Equal(t, []string{"weights/model.safetensors"}, excludes)
+}
+
+func TestGeneratePrefetch(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  run_as_user: cog
+  download:
+    - url: https://example.com/model.safetensors
+      dest: weights/model.safetensors
+prefetch:
+  - url: https://example.com/tokenizer.json
+    dest: tokenizer/tokenizer.json
+  - url: https://example.com/config.json
+    dest: tokenizer/config.json
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	// Both files are in one layer, with a cache of their own
+	prefetch := ""
+	for _, line := range strings.Split(actual, "\n") {
+		if strings.HasPrefix(line, "RUN --mount=type=cache,target=/prefetch-cache ") {
+			require.Empty(t, prefetch)
+			prefetch = line
+		}
+	}
+	require.Contains(t, prefetch, `'https://example.com/tokenizer.json'`)
+	require.Contains(t, prefetch, `'https://example.com/config.json'`)
+	require.Contains(t, prefetch, `cp /prefetch-cache/`)
+	require.Contains(t, prefetch, `chown cog '/src/tokenizer/config.json'`)
+	require.NotContains(t, prefetch, "/weights-cache")
+	// After the weights, so changing them doesn't download the weights
+	// again, and before the code
+	require.Less(t, strings.Index(actual, "/weights-cache"), strings.Index(actual, prefetch))
+	require.Less(t, strings.Index(actual, prefetch), strings.Index(actual, "COPY --from=source_owner"))
+	names := []string{}
+	for _, stage := range gen.Stages() {
+		names = append(names, stage.Name)
+	}
+	require.Equal(t, "prefetch", names[len(names)-1])
+}
+
+func TestGenerateBasePrefetch(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+prefetch:
+  - url: https://example.com/tokenizer.json
+    dest: tokenizer/tokenizer.json
+  - url: https://example.com/config.json
+    dest: /models/config.json
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.GenerateBase()
+	require.NoError(t, err)
+
+	// The project directory is mounted over /src, so only files outside it
+	// are downloaded into the image
+	require.Contains(t, actual, "RUN --mount=type=cache,target=/prefetch-cache ")
+	require.Contains(t, actual, `'https://example.com/config.json'`)
+	require.NotContains(t, actual, `'https://example.com/tokenizer.json'`)
+
+	excludes, err := gen.ContextExcludes()
+	require.NoError(t, err)
+	require.Equal(t, []string{"tokenizer/tokenizer.json"}, excludes)
+}
+
+func TestGenerateAMDGPU(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	conf, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  gpu_vendor: amd
+  python_version: "3.11"
+  python_packages:
+    - torch==2.3.1
+    - torchvision==0.18.1
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGenerator(conf, tmpDir, true)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	expected := `# syntax = docker/dockerfile:1.2
+FROM rocm/dev-ubuntu-22.04:6.0
+ENV DEBIAN_FRONTEND=noninteractive
+ENV PYTHONUNBUFFERED=1
+ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/opt/rocm/lib
+` + testTini() +
+		testInstallPython("3.11.10") +
+		testInstallCog(gen.relativeTmpDir)
+	require.True(t, strings.HasPrefix(actual, expected), actual)
+
+	requirements, err := os.ReadFile(path.Join(gen.tmpDir, "requirements.txt"))
+	require.NoError(t, err)
+	require.Equal(t, `--extra-index-url https://download.pytorch.org/whl/rocm6.0
+torch==2.3.1+rocm6.0
+torchvision==0.18.1+rocm6.0`, string(requirements))
+}
+
+func TestGenerateARM64(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	conf, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  python_version: "3.11"
+  python_packages:
+    - torch==2.3.1
+    - torchvision==0.18.1
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGenerator(conf, tmpDir, true)
+	require.NoError(t, err)
+	gen.GOOS = "linux"
+	gen.GOARCH = "arm64"
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	expected := `# syntax = docker/dockerfile:1.2
+FROM nvidia/cuda:12.1.1-cudnn8-devel-ubuntu22.04
+ENV DEBIAN_FRONTEND=noninteractive
+ENV PYTHONUNBUFFERED=1
+ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/aarch64-linux-gnu:/usr/local/nvidia/lib64:/usr/local/nvidia/bin
+` + testTini()
+	require.True(t, strings.HasPrefix(actual, expected), actual)
+
+	// There are only CPU wheels of torch for aarch64, and they don't have
+	// the +cpu suffix
+	requirements, err := os.ReadFile(path.Join(gen.tmpDir, "requirements.txt"))
+	require.NoError(t, err)
+	require.Equal(t, `--extra-index-url https://download.pytorch.org/whl/cpu
+torch==2.3.1
+torchvision==0.18.1`, string(requirements))
+}
+
+func TestGenerateAMDGPUARM64(t *testing.T) {
+	conf, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  gpu_vendor: amd
+  python_version: "3.11"
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGenerator(conf, t.TempDir(), true)
+	require.NoError(t, err)
+	gen.GOOS = "linux"
+	gen.GOARCH = "arm64"
+	_, err = gen.Generate()
+	require.ErrorContains(t, err, "can only be built for linux/amd64")
+}
+
+func TestGenerateEnvironment(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+environment:
+  HF_HOME: /src/.cache/huggingface
+  GREETING: say "hi"
+  MODEL_DIR: $HOME/models
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	expected := `# syntax = docker/dockerfile:1.2
+FROM python:3.11
+ENV DEBIAN_FRONTEND=noninteractive
+ENV PYTHONUNBUFFERED=1
+ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/usr/local/nvidia/lib64:/usr/local/nvidia/bin
+ENV GREETING="say \"hi\""
+ENV HF_HOME="/src/.cache/huggingface"
+ENV MODEL_DIR="$HOME/models"
+` + testTini()
+	require.True(t, strings.HasPrefix(actual, expected), actual)
+}
+
+func TestGenerateLabels(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+labels:
+  org.opencontainers.image.licenses: Apache-2.0
+  com.example.description: costs $5 to "run"
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	// Labels are last, so changing them doesn't rebuild anything
+	require.True(t, strings.HasSuffix(actual, `
+LABEL com.example.description="costs \$5 to \"run\"" \
+	org.opencontainers.image.licenses="Apache-2.0"`), actual)
+}
+
+func TestGenerateServingPort(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+serving:
+  port: 8080
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	require.Contains(t, actual, `WORKDIR /src
+EXPOSE 8080
+`+testHealthcheck(8080)+`CMD ["python", "-m", "cog.server.http", "--port", "8080"]`)
+}
+
+func TestGenerateHealthcheck(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+serving:
+  healthcheck:
+    interval: 10s
+    start_period: 30m
+    retries: 5
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, "HEALTHCHECK --interval=10s --timeout=10s --start-period=30m --retries=5 CMD")
+
+	conf, err = config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+serving:
+  healthcheck:
+    disabled: true
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+	gen, err = NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err = gen.Generate()
+	require.NoError(t, err)
+	require.NotContains(t, actual, "HEALTHCHECK")
+}
+
+func TestGenerateExampleAssets(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "cat.jpg"), []byte("cat"), 0o644))
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+examples:
+  default:
+    input:
+      image: "@cat.jpg"
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(actual, `
+COPY [".","/src"]
+COPY ["cat.jpg","/cog/examples/cat.jpg"]`), actual)
+}
+
+func TestCacheScope(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  system_packages:
+    - ffmpeg
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	gen.CacheScope = "team-a"
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, "RUN --mount=type=cache,id=team-a/var/cache/apt,target=/var/cache/apt apt-get update -qq && apt-get install -qqy ffmpeg")
+	require.Contains(t, actual, "RUN --mount=type=cache,id=team-a/root/.cache/pip,target=/root/.cache/pip pip install")
+	require.NotContains(t, actual, "--mount=type=cache,target=")
+}
+
+func TestNoCacheFilter(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  python_packages:
+    - torch==2.0.1
+  run:
+    - echo hello
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	withoutStages, err := gen.Generate()
+	require.NoError(t, err)
+	require.NotContains(t, withoutStages, " AS ")
+
+	gen.NoCacheFilter = []string{"pip"}
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	lines := []string{}
+	for _, line := range strings.Split(actual, "\n") {
+		if strings.HasPrefix(line, "FROM ") {
+			lines = append(lines, line)
+		}
+	}
+	require.Equal(t, []string{
+		"FROM python:3.9 AS base",
+		"FROM base AS system_packages",
+		"FROM system_packages AS pip",
+		"FROM pip AS run",
+		"FROM run AS weights",
+		"FROM weights AS source",
+	}, lines)
+	require.Less(t, strings.Index(actual, "FROM pip AS run"), strings.Index(actual, "echo hello"))
+	require.Less(t, strings.Index(actual, "FROM system_packages AS pip"), strings.Index(actual, "-r /tmp/requirements.txt"))
+}
+
+func TestTarget(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  python_packages:
+    - torch==2.0.1
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	gen.Target = "pip"
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	// docker build --target needs the stages to be named, without anything
+	// being built without the cache
+	require.Contains(t, actual, "FROM system_packages AS pip")
+	require.Contains(t, actual, "FROM weights AS source")
+}
+
+func TestSSH(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  python_packages:
+    - git+ssh://git@github.com/acme/private.git
+  ssh: true
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, `RUN --mount=type=cache,target=/root/.cache/pip --mount=type=ssh GIT_SSH_COMMAND="ssh -o StrictHostKeyChecking=accept-new" pip install `)
+	// Only installing requirements has the SSH agent
+	require.Equal(t, 1, strings.Count(actual, "--mount=type=ssh"))
+}
+
+func TestWeightsSharding(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"predict.py", "weights/model.bin", "weights/config.json", "weights/tokenizer/vocab.txt"} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0o755))
+		require.NoError(t, os.WriteFile(path.Join(tmpDir, name), []byte("x"), 0o644))
+	}
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+predict: predict.py:Predictor
+weights:
+  sharding:
+    files:
+      - weights/model.bin
+    shards: 3
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	require.Contains(t, actual, `FROM python:3.9 AS shards
+COPY ["weights/model.bin","/shards/0"]
+RUN split -d -a 2 -n 3 /shards/0 /shards/0.part- && rm /shards/0
+`)
+	require.Contains(t, actual, `COPY --from=shards ["/shards/0.part-00","/src/weights/model.bin.shard-00"]
+COPY --from=shards ["/shards/0.part-01","/src/weights/model.bin.shard-01"]
+COPY --from=shards ["/shards/0.part-02","/src/weights/model.bin.shard-02"]
+`)
+	// The rest of the workspace is copied without the sharded file
+	require.Contains(t, actual, `COPY ["predict.py","/src"]`)
+	require.Contains(t, actual, `COPY ["weights/config.json","/src/weights/"]`)
+	require.Contains(t, actual, `COPY ["weights/tokenizer","/src/weights/tokenizer"]`)
+	require.NotContains(t, actual, `COPY ["weights","/src/weights"]`)
+	require.NotContains(t, actual, `COPY [".","/src"]`)
+}
+
+func TestWeightsPaths(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"predict.py", "checkpoints/model.safetensors", "checkpoints/vae.safetensors", "models/lora.safetensors", "models/config.py"} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0o755))
+		require.NoError(t, os.WriteFile(path.Join(tmpDir, name), []byte("x"), 0o644))
+	}
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+predict: predict.py:Predictor
+weights:
+  paths:
+    - checkpoints
+    - models/lora.safetensors
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	// The code is copied without the weights, which each get a layer of
+	// their own after it
+	require.Contains(t, actual, `COPY ["predict.py","/src"]`)
+	require.Contains(t, actual, `COPY ["models/config.py","/src/models/"]`)
+	require.NotContains(t, actual, `COPY [".","/src"]`)
+	require.Contains(t, actual, `COPY ["checkpoints","/src/checkpoints"]
+COPY ["models/lora.safetensors","/src/models/lora.safetensors"]`)
+	require.Less(t, strings.Index(actual, `COPY ["predict.py","/src"]`), strings.Index(actual, `COPY ["checkpoints","/src/checkpoints"]`))
+	require.Equal(t, 1, strings.Count(actual, `"checkpoints`))
+}
+
+func TestLargeSourceFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeSparse := func(name string, size int64) {
+		p := path.Join(tmpDir, name)
+		require.NoError(t, os.MkdirAll(path.Dir(p), 0o755))
+		f, err := os.Create(p)
+		require.NoError(t, err)
+		require.NoError(t, f.Truncate(size))
+		require.NoError(t, f.Close())
+	}
+	writeSparse("predict.py", 100)
+	writeSparse("model.bin", 150*1000*1000)
+	writeSparse("huge.bin", 300*1000*1000)
+	writeSparse("weights/a.bin", 150*1000*1000)
+	writeSparse("src/data.bin", 150*1000*1000)
+	writeSparse("src/util.py", 100)
+	writeSparse("ignored.bin", 150*1000*1000)
+	writeSparse("secret.bin.enc", 150*1000*1000)
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, ".dockerignore"), []byte("ignored.bin\n"), 0o644))
+
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+weights:
+  encryption:
+    files:
+      - secret.bin.enc
+`))
+	require.NoError(t, err)
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	files, err := gen.largeSourceFiles()
+	require.NoError(t, err)
+	require.Equal(t, []largeFile{
+		{path: "huge.bin", size: 300 * 1000 * 1000},
+		{path: "model.bin", size: 150 * 1000 * 1000},
+		{path: "src/data.bin", size: 150 * 1000 * 1000},
+		{path: "weights/a.bin", size: 150 * 1000 * 1000},
+	}, files)
+
+	// With --groupfile, huge.bin and weights/ get layers of their own
+	gen, err = NewGenerator(conf, tmpDir, true)
+	require.NoError(t, err)
+	files, err = gen.largeSourceFiles()
+	require.NoError(t, err)
+	require.Equal(t, []largeFile{
+		{path: "model.bin", size: 150 * 1000 * 1000},
+		{path: "src/data.bin", size: 150 * 1000 * 1000},
+	}, files)
+
+	gen.Strict = true
+	_, err = gen.Generate()
+	require.ErrorContains(t, err, "  model.bin (150MB)\n  src/data.bin (150MB)\n")
+}
+
+func TestChecksums(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_packages:
+    - torch==1.5.1
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	_, err = gen.Generate()
+	require.NoError(t, err)
+
+	requirements, err := os.ReadFile(path.Join(gen.tmpDir, "requirements.txt"))
+	require.NoError(t, err)
+	checksums := gen.Checksums()
+	require.Len(t, checksums, 2)
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(requirements)), checksums["/tmp/requirements.txt"])
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(cogWheelEmbed)), checksums["/tmp/cog-0.0.1.dev-py3-none-any.whl"])
+}
+
+func TestGenerateOffline(t *testing.T) {
+	tiniFS = testTiniFS()
+	t.Cleanup(func() { tiniFS = embedded })
+
+	tmpDir := t.TempDir()
+	require.NoError(t, os.Mkdir(path.Join(tmpDir, "wheels"), 0o755))
+	tarball := path.Join(t.TempDir(), "cpython-3.11.9+20240726-x86_64-unknown-linux-gnu-install_only.tar.gz")
+	require.NoError(t, os.WriteFile(tarball, []byte("python"), 0o644))
+	conf, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  cuda: "12.1"
+  python_version: "3.11"
+  python_packages:
+    - torch==2.3.1
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	gen.Offline = true
+	gen.PythonTarball = tarball
+	gen.Wheelhouse = "wheels"
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	// Nothing is fetched from the internet, including the syntax's frontend
+	require.NotContains(t, actual, "# syntax")
+	require.NotContains(t, actual, "curl")
+	require.NotContains(t, actual, "pyenv")
+	require.Contains(t, actual, testCopyTemp(gen.relativeTmpDir, "tini-amd64", []byte("tini for amd64")))
+	require.Contains(t, actual, testCopyTemp(gen.relativeTmpDir, "tini-arm64", []byte("tini for arm64")))
+	require.Contains(t, actual, `install -m 755 "/tmp/tini-${TINI_ARCH}" /sbin/tini`)
+	require.Contains(t, actual, `RUN mkdir -p /opt/python && tar -xf /tmp/cpython-3.11.9+20240726-x86_64-unknown-linux-gnu-install_only.tar.gz -C /opt/python --strip-components=1`)
+	require.Contains(t, actual, `ENV PATH="/opt/python/bin:$PATH"`)
+	require.Contains(t, actual, "COPY wheels /tmp/wheels")
+	require.Contains(t, actual, "pip install --no-index --find-links /tmp/wheels /tmp/cog-0.0.1.dev-py3-none-any.whl")
+	require.Contains(t, actual, "pip install --no-index --find-links /tmp/wheels -r /tmp/requirements.txt")
+	require.NotContains(t, actual, config.DefaultPipIndexURL)
+	// The wheels are copied before anything is installed from them
+	require.Less(t, strings.Index(actual, "COPY wheels"), strings.Index(actual, "pip install"))
+}
+
+func TestGeneratePythonStandalone(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  cuda: "12.1"
+  python_version: "3.11"
+  python_install: standalone
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	require.NotContains(t, actual, "pyenv")
+	require.NotContains(t, actual, "build-essential")
+	require.Contains(t, actual, `curl -fsSL "https://github.com/indygreg/python-build-standalone/releases/download/20241016/cpython-3.11.10%2B20241016-${PYTHON_ARCH}-unknown-linux-gnu-install_only.tar.gz" | tar -xz -C /opt/python --strip-components=1`)
+	require.Contains(t, actual, `ENV PATH="/opt/python/bin:$PATH"`)
+
+	for version, message := range map[string]string{
+		"3.8":    "python-build-standalone doesn't have Python 3.8",
+		"3.11.9": "has Python 3.11.10, not 3.11.9",
+	} {
+		conf, err := config.FromYAML([]byte(fmt.Sprintf(`
+build:
+  gpu: true
+  cuda: "11.8"
+  python_version: %q
+  python_install: standalone
+predict: predict.py:Predictor
+`, version)))
+		require.NoError(t, err)
+		require.NoError(t, conf.ValidateAndComplete(tmpDir))
+		gen, err := NewGenerator(conf, tmpDir, false)
+		require.NoError(t, err)
+		_, err = gen.Generate()
+		require.ErrorContains(t, err, message)
+	}
+}
+
+func TestGenerateWheelhouse(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(tmpDir, "vendor/wheels"), 0o755))
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  python_packages:
+    - torch==2.3.1
+  wheelhouse: vendor/wheels
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+
+	require.Contains(t, actual, "COPY vendor/wheels /tmp/wheels\n"+testCopyTemp(gen.relativeTmpDir, "cog-0.0.1.dev-py3-none-any.whl", cogWheelEmbed))
+	require.Contains(t, actual, "pip install --no-index --find-links /tmp/wheels /tmp/cog-0.0.1.dev-py3-none-any.whl")
+	require.Contains(t, actual, "pip install --no-index --find-links /tmp/wheels -r /tmp/requirements.txt")
+	require.NotContains(t, actual, config.DefaultPipIndexURL)
+
+	require.NoError(t, os.RemoveAll(path.Join(tmpDir, "vendor")))
+	_, err = gen.Generate()
+	require.ErrorContains(t, err, "Failed to read the wheelhouse")
+}
+
+func TestGeneratePythonLock(t *testing.T) {
+	tmpDir := t.TempDir()
+	locked := "torch==2.3.1 \\\n    --hash=sha256:abc123\n"
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, config.PythonLockFilename), []byte(locked), 0o644))
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  python_packages:
+    - torch
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+	gen, err := NewGenerator(conf, tmpDir, false)
+	require.NoError(t, err)
+	requirements, err := conf.PythonRequirementsForArch(gen.GOOS, gen.GOARCH)
+	require.NoError(t, err)
+	gen.Lock = &config.Lock{PythonRequirements: config.PythonRequirementsHash(requirements)}
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, testCopyTemp(gen.relativeTmpDir, "requirements.txt", []byte(locked)))
+	require.Contains(t, actual, "--require-hashes -r /tmp/requirements.txt")
+
+	// When the Python packages have changed, the lockfile isn't used
+	gen.Lock.PythonRequirements = config.PythonRequirementsHash("torch==2.0.0")
+	actual, err = gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, testCopyTemp(gen.relativeTmpDir, "requirements.txt", []byte(requirements)))
+	require.NotContains(t, actual, "--require-hashes")
+
+	gen.Strict = true
+	_, err = gen.Generate()
+	require.ErrorContains(t, err, "requirements.lock is out of date")
+}
+
+func TestGenerateInMemory(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fsys, "/project/predict.py", []byte("class Predictor: pass\n"), 0o644))
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  python_packages:
+    - pillow==10.4.0
+predict: predict.py:Predictor
+`))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+
+	gen, err := NewGeneratorWithOptions(conf, "/project", true, GeneratorOptions{FS: fsys, TmpDir: "test"})
+	require.NoError(t, err)
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.Contains(t, actual, testCopyTemp(".cog/tmp/test", "requirements.txt", []byte("pillow==10.4.0")))
+	require.Contains(t, actual, `COPY ["predict.py","/src"]`)
+
+	// The temporary files are written to it, and nothing to disk
+	requirements, err := afero.ReadFile(fsys, "/project/.cog/tmp/test/requirements.txt")
+	require.NoError(t, err)
+	require.Equal(t, "pillow==10.4.0", string(requirements))
+	_, err = os.Stat("/project")
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, gen.Cleanup())
+	exists, err := afero.Exists(fsys, "/project/.cog/tmp/test")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestGenerateOfflineErrors(t *testing.T) {
+	tiniFS = fstest.MapFS{}
+	t.Cleanup(func() { tiniFS = embedded })
+
+	for _, tt := range []struct {
+		name       string
+		yaml       string
+		wheelhouse bool
+		err        string
+	}{
+		{
+			name: "pypi",
+			yaml: `python_version: "3.11"`,
+			err:  "Set 'build.wheelhouse'",
+		},
+		{
+			name:       "pyenv",
+			yaml:       "gpu: true\n  python_version: \"3.11\"",
+			wheelhouse: true,
+			err:        "Build with --python-tarball",
+		},
+		{
+			name:       "system packages",
+			yaml:       "python_version: \"3.11\"\n  system_packages: [ffmpeg]",
+			wheelhouse: true,
+			err:        "Set 'build.apt_mirror'",
+		},
+		{
+			name:       "uv",
+			yaml:       "python_version: \"3.11\"\n  installer: uv",
+			wheelhouse: true,
+			err:        "'build.installer: uv' in cog.yaml can't be built offline",
+		},
+		{
+			name:       "tini",
+			yaml:       "python_version: \"3.11\"\n  pip_index_url: http://pypi.internal/simple",
+			wheelhouse: false,
+			err:        "This build of Cog doesn't include tini",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			require.NoError(t, os.Mkdir(path.Join(tmpDir, "wheels"), 0o755))
+			conf, err := config.FromYAML([]byte("build:\n  " + tt.yaml + "\npredict: predict.py:Predictor\n"))
+			require.NoError(t, err)
+			require.NoError(t, conf.ValidateAndComplete(tmpDir))
+
+			gen, err := NewGenerator(conf, tmpDir, false)
+			require.NoError(t, err)
+			gen.Offline = true
+			if tt.wheelhouse {
+				gen.Wheelhouse = "wheels"
+			}
+			_, err = gen.Generate()
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
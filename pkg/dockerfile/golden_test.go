@@ -0,0 +1,11 @@
+package dockerfile_test
+
+import (
+	"testing"
+
+	"github.com/replicate/cog/pkg/dockerfile/dockerfiletest"
+)
+
+func TestGolden(t *testing.T) {
+	dockerfiletest.Run(t, "testdata/golden", nil)
+}
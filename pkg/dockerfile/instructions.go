@@ -0,0 +1,81 @@
+package dockerfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// execForm returns a Dockerfile instruction with its arguments in JSON
+// array form, so they don't need quoting.
+func execForm(instruction string, args ...string) (string, error) {
+	b, err := jsonArray(args)
+	if err != nil {
+		return "", err
+	}
+	return instruction + " " + b, nil
+}
+
+// copyForm returns a COPY instruction with flags, copying srcs to dest.
+// Unlike RUN, the arguments of COPY still have variables, quotes and
+// wildcards expanded in JSON array form, so paths are escaped to stop
+// file names like "it's [final].txt" from being interpreted.
+func copyForm(flags []string, srcs []string, dest string) (string, error) {
+	args := []string{}
+	for _, src := range srcs {
+		if !utf8.ValidString(src) {
+			return "", fmt.Errorf("The name of %q isn't valid UTF-8, so it can't be copied into the image. Rename it, or add it to .dockerignore", src)
+		}
+		args = append(args, escapeWord(escapePattern(src)))
+	}
+	args = append(args, escapeWord(dest))
+	b, err := jsonArray(args)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append(append([]string{"COPY"}, flags...), b), " "), nil
+}
+
+// escapePattern escapes the characters in path that are wildcards in COPY
+// sources, by putting each in a character class of its own.
+func escapePattern(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[':
+			b.WriteString("[" + string(c) + "]")
+		case '\\':
+			b.WriteString(`[\\]`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// escapeWord escapes the characters in word that Dockerfile variable
+// expansion treats specially.
+func escapeWord(word string) string {
+	var b strings.Builder
+	for _, c := range word {
+		if strings.ContainsRune(`\$'"`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// jsonArray encodes args as a JSON array. HTML characters are left as they
+// are, which json.Marshal would escape, to keep the Dockerfile readable.
+func jsonArray(args []string) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(args); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,85 @@
+package dockerfile
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestCopyForm(t *testing.T) {
+	for _, tt := range []struct {
+		src      string
+		expected string
+	}{
+		{"predict.py", `COPY ["predict.py","/src"]`},
+		{"my model.py", `COPY ["my model.py","/src"]`},
+		{`it's "final".txt`, `COPY ["it\\'s \\\"final\\\".txt","/src"]`},
+		{"$HOME.txt", `COPY ["\\$HOME.txt","/src"]`},
+		{"${PATH}", `COPY ["\\${PATH}","/src"]`},
+		{"*.txt", `COPY ["[*].txt","/src"]`},
+		{"what?.txt", `COPY ["what[?].txt","/src"]`},
+		{"arr[0].txt", `COPY ["arr[[]0].txt","/src"]`},
+		{`back\slash.txt`, `COPY ["back[\\\\\\\\]slash.txt","/src"]`},
+		{"--from=weights", `COPY ["--from=weights","/src"]`},
+		{"#comment.txt", `COPY ["#comment.txt","/src"]`},
+		{"new\nline.txt", `COPY ["new\nline.txt","/src"]`},
+		{"日本語のモデル.py", `COPY ["日本語のモデル.py","/src"]`},
+		{"<&>.txt", `COPY ["<&>.txt","/src"]`},
+	} {
+		t.Run(tt.src, func(t *testing.T) {
+			actual, err := copyForm(nil, []string{tt.src}, "/src")
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, actual)
+			require.False(t, strings.Contains(actual, "\n"))
+
+			// The arguments are valid JSON, which is what Docker parses
+			var args []string
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(actual, "COPY ")), &args))
+			require.Equal(t, []string{escapeWord(escapePattern(tt.src)), "/src"}, args)
+		})
+	}
+}
+
+func TestCopyFormFlagsAndDest(t *testing.T) {
+	actual, err := copyForm([]string{"--from=source", "--chown=1000:1000"}, []string{"/src/a b", "/src/c"}, "/src/it's here/")
+	require.NoError(t, err)
+	require.Equal(t, `COPY --from=source --chown=1000:1000 ["/src/a b","/src/c","/src/it\\'s here/"]`, actual)
+}
+
+func TestCopyFormInvalidUTF8(t *testing.T) {
+	_, err := copyForm(nil, []string{"model\xff.bin"}, "/src")
+	require.ErrorContains(t, err, "isn't valid UTF-8")
+}
+
+func TestCopyWorkspaceSpecialCharacters(t *testing.T) {
+	tmpDir := t.TempDir()
+	names := []string{"my model.py", `it's "final".txt`, "$HOME", "[weights]", "--from=source", "日本語"}
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(path.Join(tmpDir, name), []byte("x"), 0o644))
+	}
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+`))
+	require.NoError(t, err)
+
+	gen, err := NewGenerator(conf, tmpDir, true)
+	require.NoError(t, err)
+	actual, err := gen.copyWorkspace()
+	require.NoError(t, err)
+	for _, name := range names {
+		expected, err := jsonArray([]string{escapeWord(escapePattern(name))})
+		require.NoError(t, err)
+		require.Contains(t, actual, strings.Trim(expected, "[]"))
+	}
+	for _, line := range strings.Split(actual, "\n") {
+		require.True(t, strings.HasPrefix(line, `COPY [`), line)
+		require.True(t, strings.HasSuffix(line, `"/src"]`), line)
+	}
+}
@@ -0,0 +1,590 @@
+package dockerfile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/replicate/cog/pkg/docker"
+)
+
+// defaultPath is the PATH of images that don't set one, like Docker's
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Image is the config of an image that's built with LLB, in the format of
+// Docker's image config, which BuildKit's exporters take.
+type Image struct {
+	ocispecs.Image
+	Config ImageConfig `json:"config,omitempty"`
+}
+
+// ImageConfig is the config of the container an image runs in, with what
+// Docker has on top of the OCI spec.
+type ImageConfig struct {
+	ocispecs.ImageConfig
+	Healthcheck *Healthcheck `json:",omitempty"`
+}
+
+// Healthcheck is an image's HEALTHCHECK, in the format of Docker's image
+// config.
+type Healthcheck struct {
+	Test        []string      `json:",omitempty"`
+	Interval    time.Duration `json:",omitempty"`
+	Timeout     time.Duration `json:",omitempty"`
+	StartPeriod time.Duration `json:",omitempty"`
+	Retries     int           `json:",omitempty"`
+}
+
+// llbStage is a stage of the Dockerfile as it's converted to LLB.
+type llbStage struct {
+	name   string
+	state  llb.State
+	image  Image
+	cmdSet bool
+	// ignoreCache is whether the stage's steps are run without the cache
+	ignoreCache bool
+}
+
+// llbConverter converts the Dockerfile the generator made to LLB, one stage
+// at a time.
+type llbConverter struct {
+	g      *Generator
+	build  docker.LLBBuild
+	lex    *shell.Lex
+	stages []*llbStage
+	// images are the configs of images that have been resolved, by
+	// reference
+	images map[string]resolvedImage
+}
+
+type resolvedImage struct {
+	ref    string
+	config []byte
+}
+
+// ConvertToLLB converts dockerfile, which the generator generated with LLB
+// set, to LLB, and returns it with the config of the image it builds.
+//
+// Each of CacheStages is a stage of the Dockerfile then, so the steps of
+// the build are named by the stage they're in, and only the ones in
+// NoCacheFilter and after are run without the cache. It only converts what
+// the generator generates, not every Dockerfile.
+func (g *Generator) ConvertToLLB(ctx context.Context, dockerfile string, build docker.LLBBuild) (*llb.Definition, *Image, error) {
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse Dockerfile: %w", err)
+	}
+	c := &llbConverter{
+		g:      g,
+		build:  build,
+		lex:    shell.NewLex(rune(parser.DefaultEscapeToken)),
+		images: map[string]resolvedImage{},
+	}
+	for _, node := range result.AST.Children {
+		if err := c.instruction(ctx, node); err != nil {
+			return nil, nil, fmt.Errorf("Failed to convert line %d of the Dockerfile to LLB: %w", node.StartLine, err)
+		}
+	}
+	if len(c.stages) == 0 {
+		return nil, nil, fmt.Errorf("The Dockerfile doesn't have any stages")
+	}
+
+	target := c.stages[len(c.stages)-1]
+	if g.Target != "" {
+		if target = c.stage(g.Target); target == nil {
+			return nil, nil, fmt.Errorf("The Dockerfile doesn't have a stage called %s", g.Target)
+		}
+	}
+	constraints := []llb.ConstraintsOpt{llb.Platform(build.Platform)}
+	if build.Caps != nil {
+		constraints = append(constraints, llb.WithCaps(*build.Caps))
+	}
+	def, err := target.state.Marshal(ctx, constraints...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return def, &target.image, nil
+}
+
+// instruction adds an instruction of the Dockerfile to the stage it's in.
+func (c *llbConverter) instruction(ctx context.Context, node *parser.Node) error {
+	instruction := strings.ToUpper(node.Value)
+	if instruction == "FROM" {
+		return c.from(ctx, node)
+	}
+	if len(c.stages) == 0 {
+		return fmt.Errorf("%s is before FROM", instruction)
+	}
+	s := c.stages[len(c.stages)-1]
+	args := nodeArgs(node)
+
+	switch instruction {
+	case "RUN":
+		return c.run(s, node, args)
+	case "COPY":
+		return c.copy(ctx, s, node, args)
+	case "ENV", "LABEL":
+		if len(args)%2 != 0 {
+			return fmt.Errorf("%s must have a value for each name", instruction)
+		}
+		for i := 0; i < len(args); i += 2 {
+			value, err := c.expand(s, args[i+1])
+			if err != nil {
+				return err
+			}
+			if instruction == "ENV" {
+				s.state = s.state.AddEnv(args[i], value)
+				s.image.Config.Env = setEnv(s.image.Config.Env, args[i], value)
+			} else {
+				if s.image.Config.Labels == nil {
+					s.image.Config.Labels = map[string]string{}
+				}
+				s.image.Config.Labels[args[i]] = value
+			}
+		}
+		return nil
+	case "WORKDIR":
+		dir, err := c.oneArg(s, instruction, args)
+		if err != nil {
+			return err
+		}
+		if !path.IsAbs(dir) {
+			dir = path.Join("/", s.image.Config.WorkingDir, dir)
+		}
+		s.state = s.state.Dir(dir)
+		s.image.Config.WorkingDir = dir
+		s.state = s.state.File(llb.Mkdir(dir, 0o755, llb.WithParents(true)), c.stepOptions(s, node)...)
+		return nil
+	case "USER":
+		user, err := c.oneArg(s, instruction, args)
+		if err != nil {
+			return err
+		}
+		s.state = s.state.User(user)
+		s.image.Config.User = user
+		return nil
+	case "EXPOSE":
+		if s.image.Config.ExposedPorts == nil {
+			s.image.Config.ExposedPorts = map[string]struct{}{}
+		}
+		for _, arg := range args {
+			port, err := c.expand(s, arg)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			s.image.Config.ExposedPorts[port] = struct{}{}
+		}
+		return nil
+	case "ENTRYPOINT":
+		s.image.Config.Entrypoint = command(node, args)
+		// Like Docker, the base image's CMD doesn't go with a new ENTRYPOINT
+		if !s.cmdSet {
+			s.image.Config.Cmd = nil
+		}
+		return nil
+	case "CMD":
+		s.image.Config.Cmd = command(node, args)
+		s.cmdSet = true
+		return nil
+	case "HEALTHCHECK":
+		return c.healthcheck(s, node)
+	}
+	return fmt.Errorf("%s isn't supported", instruction)
+}
+
+// from starts a new stage, on an image or an earlier stage.
+func (c *llbConverter) from(ctx context.Context, node *parser.Node) error {
+	args := nodeArgs(node)
+	s := &llbStage{}
+	switch {
+	case len(args) == 3 && strings.EqualFold(args[1], "AS"):
+		s.name = strings.ToLower(args[2])
+	case len(args) != 1:
+		return fmt.Errorf("FROM must have an image, and optionally AS and a name")
+	}
+	s.ignoreCache = c.ignoresCache(s.name)
+
+	if base := c.stage(args[0]); base != nil {
+		s.state = base.state
+		s.image = copyImage(base.image)
+		s.cmdSet = base.cmdSet
+	} else if strings.EqualFold(args[0], "scratch") {
+		s.state = llb.Scratch().Platform(c.build.Platform)
+		s.image = Image{Image: ocispecs.Image{OS: c.build.Platform.OS, Architecture: c.build.Platform.Architecture}}
+	} else {
+		image, err := c.resolve(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(image.config, &s.image); err != nil {
+			return fmt.Errorf("Failed to read the config of %s: %w", args[0], err)
+		}
+		s.image.RootFS = ocispecs.RootFS{}
+		s.image.History = nil
+		s.image.Created = nil
+		s.state = llb.Image(image.ref, llb.Platform(c.build.Platform), c.stepName(s, node))
+		if s.state, err = s.state.WithImageConfig(image.config); err != nil {
+			return err
+		}
+		if s.image.Config.User != "" {
+			s.state = s.state.User(s.image.Config.User)
+		}
+	}
+	if s.image.OS == "" {
+		s.image.OS = c.build.Platform.OS
+		s.image.Architecture = c.build.Platform.Architecture
+	}
+	if _, ok := getEnv(s.image.Config.Env, "PATH"); !ok {
+		s.state = s.state.AddEnv("PATH", defaultPath)
+		s.image.Config.Env = setEnv(s.image.Config.Env, "PATH", defaultPath)
+	}
+	c.stages = append(c.stages, s)
+	return nil
+}
+
+// resolve returns the config of an image, and a reference to it by its
+// digest, so every stage on it is built on the same image.
+func (c *llbConverter) resolve(ctx context.Context, ref string) (resolvedImage, error) {
+	if image, ok := c.images[ref]; ok {
+		return image, nil
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return resolvedImage{}, fmt.Errorf("Invalid image %s: %w", ref, err)
+	}
+	named = reference.TagNameOnly(named)
+	dgst, config, err := c.build.Resolver.ResolveImageConfig(ctx, named.String(), llb.ResolveImageConfigOpt{
+		Platform:    &c.build.Platform,
+		ResolveMode: llb.ResolveModeDefault.String(),
+		LogName:     "[internal] load metadata for " + named.String(),
+	})
+	if err != nil {
+		return resolvedImage{}, err
+	}
+	image := resolvedImage{ref: named.String(), config: config}
+	if _, ok := named.(reference.Canonical); !ok && dgst != "" {
+		if canonical, err := reference.WithDigest(named, dgst); err == nil {
+			image.ref = canonical.String()
+		}
+	}
+	c.images[ref] = image
+	return image, nil
+}
+
+// run adds a RUN instruction. The only mounts generated Dockerfiles have
+// are caches and the SSH agent.
+func (c *llbConverter) run(s *llbStage, node *parser.Node, args []string) error {
+	opts := []llb.RunOption{llb.Args(command(node, args))}
+	for _, flag := range node.Flags {
+		name, value, _ := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+		if name != "mount" {
+			return fmt.Errorf("RUN --%s isn't supported", name)
+		}
+		opt, err := mountOption(value)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, opt)
+	}
+	for _, opt := range c.stepOptions(s, node) {
+		opts = append(opts, opt)
+	}
+	s.state = s.state.Run(opts...).Root()
+	return nil
+}
+
+// mountOption returns the option for a RUN --mount, in the form
+// type=cache,target=/root/.cache/pip.
+func mountOption(mount string) (llb.RunOption, error) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(mount, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		fields[strings.ToLower(key)] = value
+	}
+	target := fields["target"]
+	switch fields["type"] {
+	case "cache":
+		if target == "" {
+			return nil, fmt.Errorf("Cache mounts must have a target")
+		}
+		id := fields["id"]
+		if id == "" {
+			id = target
+		}
+		sharing := llb.CacheMountShared
+		switch fields["sharing"] {
+		case "", "shared":
+		case "locked":
+			sharing = llb.CacheMountLocked
+		case "private":
+			sharing = llb.CacheMountPrivate
+		default:
+			return nil, fmt.Errorf("Unknown sharing of cache mount: %s", fields["sharing"])
+		}
+		return llb.AddMount(target, llb.Scratch(), llb.AsPersistentCacheDir(id, sharing)), nil
+	case "ssh":
+		id := fields["id"]
+		if id == "" {
+			id = "default"
+		}
+		opts := []llb.SSHOption{llb.SSHID(id)}
+		if target != "" {
+			opts = append(opts, llb.SSHSocketTarget(target))
+		}
+		return llb.AddSSHSocket(opts...), nil
+	}
+	return nil, fmt.Errorf("RUN --mount=type=%s isn't supported", fields["type"])
+}
+
+// copy adds a COPY instruction, from the project directory, an earlier
+// stage, or an image.
+func (c *llbConverter) copy(ctx context.Context, s *llbStage, node *parser.Node, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("COPY must have a source and a destination")
+	}
+	from := c.build.Context
+	info := &llb.CopyInfo{
+		FollowSymlinks:      true,
+		CopyDirContentsOnly: true,
+		CreateDestPath:      true,
+		AllowWildcard:       true,
+		AllowEmptyWildcard:  true,
+	}
+	for _, flag := range node.Flags {
+		name, value, _ := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+		switch name {
+		case "from":
+			if stage := c.stage(value); stage != nil {
+				from = stage.state
+			} else {
+				image, err := c.resolve(ctx, value)
+				if err != nil {
+					return err
+				}
+				from = llb.Image(image.ref, llb.Platform(c.build.Platform))
+			}
+		case "chown":
+			chown, ok := llb.WithUser(value).(llb.ChownOpt)
+			if !ok {
+				return fmt.Errorf("Invalid --chown: %s", value)
+			}
+			info.ChownOpt = &chown
+		default:
+			return fmt.Errorf("COPY --%s isn't supported", name)
+		}
+	}
+
+	paths := make([]string, len(args))
+	for i, arg := range args {
+		var err error
+		if paths[i], err = c.expand(s, arg); err != nil {
+			return err
+		}
+	}
+	srcs, dest := paths[:len(paths)-1], paths[len(paths)-1]
+	isDir := strings.HasSuffix(dest, "/") || dest == "." || len(srcs) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", s.image.Config.WorkingDir, dest)
+	}
+	if isDir && !strings.HasSuffix(dest, "/") {
+		dest += "/"
+	}
+
+	var action *llb.FileAction
+	for _, src := range srcs {
+		src = path.Join("/", src)
+		if action == nil {
+			action = llb.Copy(from, src, dest, info)
+		} else {
+			action = action.Copy(from, src, dest, info)
+		}
+	}
+	s.state = s.state.File(action, c.stepOptions(s, node)...)
+	return nil
+}
+
+// healthcheck sets the image's HEALTHCHECK.
+func (c *llbConverter) healthcheck(s *llbStage, node *parser.Node) error {
+	args := nodeArgs(node)
+	if len(args) == 0 {
+		return fmt.Errorf("HEALTHCHECK must have NONE or CMD")
+	}
+	if strings.EqualFold(args[0], "NONE") {
+		s.image.Config.Healthcheck = &Healthcheck{Test: []string{"NONE"}}
+		return nil
+	}
+	if !strings.EqualFold(args[0], "CMD") || node.Next == nil {
+		return fmt.Errorf("HEALTHCHECK must have NONE or CMD")
+	}
+	healthcheck := &Healthcheck{}
+	if node.Attributes["json"] {
+		healthcheck.Test = append([]string{"CMD"}, args[1:]...)
+	} else {
+		healthcheck.Test = []string{"CMD-SHELL", strings.Join(args[1:], " ")}
+	}
+	for _, flag := range node.Flags {
+		name, value, _ := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+		var err error
+		switch name {
+		case "interval":
+			healthcheck.Interval, err = time.ParseDuration(value)
+		case "timeout":
+			healthcheck.Timeout, err = time.ParseDuration(value)
+		case "start-period":
+			healthcheck.StartPeriod, err = time.ParseDuration(value)
+		case "retries":
+			healthcheck.Retries, err = strconv.Atoi(value)
+		default:
+			return fmt.Errorf("HEALTHCHECK --%s isn't supported", name)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid HEALTHCHECK --%s: %w", name, err)
+		}
+	}
+	s.image.Config.Healthcheck = healthcheck
+	return nil
+}
+
+// stepOptions returns the options for a step of stage s: its name, and
+// whether it's run without the cache.
+func (c *llbConverter) stepOptions(s *llbStage, node *parser.Node) []llb.ConstraintsOpt {
+	opts := []llb.ConstraintsOpt{c.stepName(s, node)}
+	if s.ignoreCache {
+		opts = append(opts, llb.IgnoreCache)
+	}
+	return opts
+}
+
+// stepName names a step by the stage it's in, like "[pip] RUN pip install
+// ...", which is how it's shown in the build's progress.
+func (c *llbConverter) stepName(s *llbStage, node *parser.Node) llb.ConstraintsOpt {
+	name := s.name
+	if name == "" {
+		name = fmt.Sprintf("stage-%d", len(c.stages))
+	}
+	return llb.WithCustomName(fmt.Sprintf("[%s] %s", name, node.Original))
+}
+
+// ignoresCache returns whether the steps of the stage called name are run
+// without the cache: all of them with NoCache, or the ones in NoCacheFilter
+// and the CacheStages after them.
+func (c *llbConverter) ignoresCache(name string) bool {
+	if c.build.NoCache {
+		return true
+	}
+	i := cacheStageIndex(name)
+	if i < 0 {
+		return false
+	}
+	for _, filtered := range c.g.NoCacheFilter {
+		if j := cacheStageIndex(filtered); j >= 0 && j <= i {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheStageIndex returns where name is in CacheStages, or -1 if it isn't
+// one of them.
+func cacheStageIndex(name string) int {
+	for i, stage := range CacheStages {
+		if stage == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// stage returns the stage called name, or nil if there isn't one.
+func (c *llbConverter) stage(name string) *llbStage {
+	for _, s := range c.stages {
+		if s.name != "" && strings.EqualFold(s.name, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// expand expands the environment variables in word, like Docker does in
+// the arguments of instructions other than RUN.
+func (c *llbConverter) expand(s *llbStage, word string) (string, error) {
+	return c.lex.ProcessWord(word, s.image.Config.Env)
+}
+
+func (c *llbConverter) oneArg(s *llbStage, instruction string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s must have one argument", instruction)
+	}
+	return c.expand(s, args[0])
+}
+
+// nodeArgs returns the arguments of an instruction.
+func nodeArgs(node *parser.Node) []string {
+	args := []string{}
+	for n := node.Next; n != nil; n = n.Next {
+		args = append(args, n.Value)
+	}
+	return args
+}
+
+// command returns the command of a RUN, CMD, or ENTRYPOINT, which is run
+// with the shell unless it's in JSON form.
+func command(node *parser.Node, args []string) []string {
+	if node.Attributes["json"] {
+		return args
+	}
+	return []string{"/bin/sh", "-c", strings.Join(args, " ")}
+}
+
+func getEnv(env []string, key string) (string, bool) {
+	for _, kv := range env {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func setEnv(env []string, key string, value string) []string {
+	result := []string{}
+	for _, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k != key {
+			result = append(result, kv)
+		}
+	}
+	return append(result, key+"="+value)
+}
+
+// copyImage copies an image's config, so stages on an earlier stage don't
+// change it.
+func copyImage(image Image) Image {
+	image.Config.Env = append([]string{}, image.Config.Env...)
+	if image.Config.Labels != nil {
+		labels := map[string]string{}
+		for k, v := range image.Config.Labels {
+			labels[k] = v
+		}
+		image.Config.Labels = labels
+	}
+	if image.Config.ExposedPorts != nil {
+		ports := map[string]struct{}{}
+		for k := range image.Config.ExposedPorts {
+			ports[k] = struct{}{}
+		}
+		image.Config.ExposedPorts = ports
+	}
+	return image
+}
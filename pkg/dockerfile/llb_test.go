@@ -0,0 +1,187 @@
+package dockerfile
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+)
+
+func TestConvertToLLB(t *testing.T) {
+	gen := llbTestGenerator(t, `
+build:
+  python_version: "3.11"
+  python_packages:
+    - pillow==10.4.0
+  run:
+    - echo hello
+  run_as_user: cog
+predict: predict.py:Predictor
+`)
+	gen.NoCacheFilter = []string{"run"}
+	def, img := convertToLLBForTest(t, gen)
+
+	require.Equal(t, []string{"/sbin/tini", "--"}, img.Config.Entrypoint)
+	require.Equal(t, []string{"python", "-m", "cog.server.http"}, img.Config.Cmd)
+	require.Equal(t, "/src", img.Config.WorkingDir)
+	require.Equal(t, "cog", img.Config.User)
+	require.Equal(t, map[string]struct{}{"5000/tcp": {}}, img.Config.ExposedPorts)
+	require.Contains(t, img.Config.Env, "PYTHONUNBUFFERED=1")
+	require.Contains(t, img.Config.Env, "PATH=/usr/local/bin:/usr/bin:/bin")
+	require.Equal(t, "CMD", img.Config.Healthcheck.Test[0])
+	require.Equal(t, 30*time.Second, img.Config.Healthcheck.Interval)
+	require.Equal(t, 3, img.Config.Healthcheck.Retries)
+	require.Equal(t, "linux", img.OS)
+
+	// Each step is named by the stage it's in, and only the ones in
+	// NoCacheFilter and after are run without the cache
+	steps := llbSteps(t, def)
+	requireStep(t, steps, "[pip] RUN --mount=type=cache,target=/root/.cache/pip pip install", false)
+	requireStep(t, steps, "[run] RUN echo hello", true)
+	requireStep(t, steps, "[source] COPY --from=source_owner --chown=cog", true)
+
+	require.Contains(t, llbCacheMounts(t, def), "/root/.cache/pip")
+}
+
+func TestConvertToLLBTarget(t *testing.T) {
+	gen := llbTestGenerator(t, `
+build:
+  python_version: "3.11"
+  run:
+    - echo hello
+predict: predict.py:Predictor
+`)
+	gen.Target = "pip"
+	def, img := convertToLLBForTest(t, gen)
+
+	require.Equal(t, []string{"/sbin/tini", "--"}, img.Config.Entrypoint)
+	require.Empty(t, img.Config.Cmd)
+	for name := range llbSteps(t, def) {
+		require.False(t, strings.HasPrefix(name, "[run]"), name)
+	}
+}
+
+func TestConvertToLLBNoCache(t *testing.T) {
+	gen := llbTestGenerator(t, `
+build:
+  python_version: "3.11"
+predict: predict.py:Predictor
+`)
+	def, _, err := gen.ConvertToLLB(context.Background(), "FROM python:3.11 AS base\nRUN echo hello\n", llbTestBuild(true))
+	require.NoError(t, err)
+	requireStep(t, llbSteps(t, def), "[base] RUN echo hello", true)
+}
+
+func TestConvertToLLBUnsupported(t *testing.T) {
+	gen := llbTestGenerator(t, `
+build:
+  python_version: "3.11"
+predict: predict.py:Predictor
+`)
+	for dockerfile, expected := range map[string]string{
+		"FROM python:3.11\nRUN --device=nvidia.com/gpu=all nvidia-smi\n": "RUN --device isn't supported",
+		"FROM python:3.11\nADD model.bin /src/\n":                        "ADD isn't supported",
+		"FROM python:3.11\nRUN --mount=type=bind,target=/x true\n":       "RUN --mount=type=bind isn't supported",
+		"RUN true\n": "RUN is before FROM",
+	} {
+		_, _, err := gen.ConvertToLLB(context.Background(), dockerfile, llbTestBuild(false))
+		require.ErrorContains(t, err, expected)
+	}
+
+	gen.Target = "nope"
+	_, _, err := gen.ConvertToLLB(context.Background(), "FROM python:3.11 AS base\n", llbTestBuild(false))
+	require.ErrorContains(t, err, "doesn't have a stage called nope")
+}
+
+func llbTestGenerator(t *testing.T, yaml string) *Generator {
+	t.Helper()
+	conf, err := config.FromYAML([]byte(yaml))
+	require.NoError(t, err)
+	require.NoError(t, conf.ValidateAndComplete(""))
+	gen, err := NewGenerator(conf, t.TempDir(), false)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, gen.Cleanup())
+	})
+	gen.LLB = true
+	return gen
+}
+
+func convertToLLBForTest(t *testing.T, gen *Generator) (*llb.Definition, *Image) {
+	t.Helper()
+	dockerfile, err := gen.Generate()
+	require.NoError(t, err)
+	def, img, err := gen.ConvertToLLB(context.Background(), dockerfile, llbTestBuild(false))
+	require.NoError(t, err)
+	return def, img
+}
+
+func llbTestBuild(noCache bool) docker.LLBBuild {
+	return docker.LLBBuild{
+		Platform: ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+		Resolver: testImageResolver{},
+		Context:  llb.Local("context"),
+		NoCache:  noCache,
+	}
+}
+
+// llbSteps returns whether each step of def is run without the cache, by
+// its name
+func llbSteps(t *testing.T, def *llb.Definition) map[string]bool {
+	t.Helper()
+	steps := map[string]bool{}
+	for _, md := range def.Metadata {
+		if name := md.Description["llb.customname"]; name != "" {
+			steps[name] = md.IgnoreCache
+		}
+	}
+	return steps
+}
+
+// requireStep checks that a step whose name starts with prefix is in steps,
+// and whether it's run without the cache
+func requireStep(t *testing.T, steps map[string]bool, prefix string, ignoreCache bool) {
+	t.Helper()
+	for name, ignored := range steps {
+		if strings.HasPrefix(name, prefix) {
+			require.Equal(t, ignoreCache, ignored, name)
+			return
+		}
+	}
+	t.Fatalf("No step starts with %q in %v", prefix, steps)
+}
+
+// llbCacheMounts returns the IDs of the cache mounts in def
+func llbCacheMounts(t *testing.T, def *llb.Definition) []string {
+	t.Helper()
+	var ids []string
+	for _, dt := range def.Def {
+		var op pb.Op
+		require.NoError(t, op.Unmarshal(dt))
+		if exec := op.GetExec(); exec != nil {
+			for _, mount := range exec.Mounts {
+				if mount.CacheOpt != nil {
+					ids = append(ids, mount.CacheOpt.ID)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// testImageResolver resolves images without a registry, to an image that
+// only has a PATH
+type testImageResolver struct{}
+
+func (testImageResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	return digest.FromString(ref), []byte(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/usr/local/bin:/usr/bin:/bin"]}}`), nil
+}
@@ -0,0 +1,167 @@
+package dockerfile
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// tiniArchitectures are the architectures of the tini binaries built into
+// Cog by make, for offline builds
+var tiniArchitectures = []string{"amd64", "arm64"}
+
+// tiniFS has the tini binaries, in embed/. It's a variable so it can be
+// replaced in tests.
+var tiniFS fs.FS = embedded
+
+// wheelhouseDir is where Wheelhouse is copied to in the image
+const wheelhouseDir = "/tmp/wheels"
+
+// pythonTarballDir is where PythonTarball, or Python from
+// python-build-standalone, is extracted to in the image
+const pythonTarballDir = "/opt/python"
+
+// pythonStandaloneURL is where python-build-standalone's releases are
+// downloaded from
+const pythonStandaloneURL = "https://github.com/indygreg/python-build-standalone/releases/download"
+
+// checkOffline returns an error if the model needs something from the
+// internet to build, other than its base image, which must be pulled
+// already, and packages from build.apt_mirror or build.pip_index_url, which
+// must be on the local network.
+func (g *Generator) checkOffline() error {
+	build := g.Config.Build
+	if build.Distro == config.DistroUBI9 {
+		return fmt.Errorf("'build.distro: ubi9' in cog.yaml can't be built offline, because Python is installed from the UBI repositories")
+	}
+	if build.Installer == config.InstallerUV {
+		return fmt.Errorf("'build.installer: uv' in cog.yaml can't be built offline, because uv is copied from %s. Remove it to install packages with pip", uvImage)
+	}
+	if len(build.SystemPackages) > 0 {
+		if g.PackageManager == PackageManagerApk || g.PackageManager == PackageManagerDnf {
+			return fmt.Errorf("'build.system_packages' in cog.yaml can't be installed offline with %s. Install them in the base image instead", g.PackageManager)
+		}
+		if build.AptMirror == "" {
+			return fmt.Errorf("'build.system_packages' in cog.yaml can only be installed offline from a mirror on your network. Set 'build.apt_mirror' to it")
+		}
+	}
+	if len(build.Download) > 0 {
+		return fmt.Errorf("'build.download' in cog.yaml can't be downloaded offline. Put the files in the project directory instead")
+	}
+	if len(g.Config.Prefetch) > 0 {
+		return fmt.Errorf("'prefetch' in cog.yaml can't be downloaded offline. Put the files in the project directory instead")
+	}
+	if g.needsPython() && g.PythonTarball == "" && build.PythonInstall == config.PythonInstallStandalone {
+		return fmt.Errorf("Python is downloaded from python-build-standalone, which needs the internet. Build with --python-tarball and its install_only tarball for Python %s, or use a base image that has Python", build.PythonVersion)
+	}
+	if g.needsPython() && g.PythonTarball == "" {
+		return fmt.Errorf("Python is installed with pyenv, which needs the internet. Build with --python-tarball and a python-build-standalone install_only tarball for Python %s, or use a base image that has Python", build.PythonVersion)
+	}
+	if g.wheelhouse() == "" {
+		index := g.PipIndexURL
+		if index == "" {
+			index = build.PipIndex()
+		}
+		if index == config.DefaultPipIndexURL {
+			return fmt.Errorf("Python packages are installed from %s, which needs the internet. Set 'build.wheelhouse' to a directory of wheels, or set 'build.pip_index_url' in cog.yaml to an index on your network", index)
+		}
+	}
+	return nil
+}
+
+// needsPython is whether Python is installed in the base image, rather than
+// it having Python already.
+func (g *Generator) needsPython() bool {
+	if g.Config.Build.BaseImage != "" {
+		return !g.Config.Build.BaseImageHas(config.ProvidesPython)
+	}
+	return g.Config.Build.GPU
+}
+
+// copyEmbeddedTini returns instructions that install tini from the binaries
+// built into Cog, instead of downloading it. Both architectures are copied,
+// so it's right whatever platform the image is built for.
+func (g *Generator) copyEmbeddedTini() ([]string, error) {
+	lines := []string{}
+	for _, arch := range tiniArchitectures {
+		contents, err := fs.ReadFile(tiniFS, "embed/tini-"+arch)
+		if err != nil {
+			return nil, fmt.Errorf("This build of Cog doesn't include tini, so it can't build offline. Build Cog with make, which downloads it")
+		}
+		copyLines, _, err := g.writeTemp("tini-"+arch, contents)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, copyLines...)
+	}
+	lines = append(lines, `RUN case "$(uname -m)" in aarch64) TINI_ARCH=arm64 ;; *) TINI_ARCH=amd64 ;; esac && \
+	install -m 755 "/tmp/tini-${TINI_ARCH}" /sbin/tini && \
+	rm /tmp/tini-*`)
+	return lines, nil
+}
+
+// installPythonTarball installs Python from PythonTarball, which is
+// extracted to pythonTarballDir. It has python3 and pip3, but not python and
+// pip, so they're linked to them.
+func (g *Generator) installPythonTarball() (string, error) {
+	filename := filepath.Base(g.PythonTarball)
+	// python-build-standalone's tarballs are named for their version, like
+	// cpython-3.11.9+20240726-x86_64-unknown-linux-gnu-install_only.tar.gz
+	if strings.HasPrefix(filename, "cpython-") && !strings.HasPrefix(filename, "cpython-"+g.Config.Build.PythonMinorVersion()+".") {
+		return "", fmt.Errorf("%s isn't Python %s, which is 'build.python_version' in cog.yaml", filename, g.Config.Build.PythonMinorVersion())
+	}
+	contents, err := afero.ReadFile(g.fs, g.PythonTarball)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the Python tarball: %w", err)
+	}
+	lines, containerPath, err := g.writeTemp(filename, contents)
+	if err != nil {
+		return "", err
+	}
+	lines = append(lines,
+		fmt.Sprintf(`RUN mkdir -p %s && tar -xf %s -C %s --strip-components=1 && rm %s && \
+	ln -sf python3 %s/bin/python && \
+	ln -sf pip3 %s/bin/pip`, pythonTarballDir, containerPath, pythonTarballDir, containerPath, pythonTarballDir, pythonTarballDir),
+		fmt.Sprintf(`ENV PATH="%s/bin:$PATH"`, pythonTarballDir),
+	)
+	return strings.Join(lines, "\n"), nil
+}
+
+// wheelhouse returns the directory of wheels Python packages are installed
+// from, or "" if they're installed from a package index.
+func (g *Generator) wheelhouse() string {
+	if g.Wheelhouse != "" {
+		return g.Wheelhouse
+	}
+	return g.Config.Build.Wheelhouse
+}
+
+// copyWheelhouse copies the wheelhouse into the image, before anything is
+// installed from it, so every install can find packages in it.
+func (g *Generator) copyWheelhouse() (string, error) {
+	wheelhouse := g.wheelhouse()
+	if wheelhouse == "" {
+		return "", nil
+	}
+	dir := wheelhouse
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(g.Dir, dir)
+	}
+	relative, err := filepath.Rel(g.Dir, dir)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("The wheelhouse %s must be in the project directory, so it can be copied into the image", wheelhouse)
+	}
+	info, err := g.fs.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the wheelhouse: %w", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("The wheelhouse %s must be a directory of wheels", wheelhouse)
+	}
+	return fmt.Sprintf("COPY %s %s", filepath.ToSlash(relative), wheelhouseDir), nil
+}
@@ -0,0 +1,54 @@
+package dockerfile
+
+import (
+	"bufio"
+	"strings"
+)
+
+// PackageManager is the system package manager of a base image, used to
+// install system_packages.
+type PackageManager string
+
+const (
+	PackageManagerApt PackageManager = "apt"
+	PackageManagerApk PackageManager = "apk"
+	PackageManagerDnf PackageManager = "dnf"
+)
+
+// PackageManagerFromOSRelease picks the package manager for a distribution
+// from the contents of its /etc/os-release. Anything that isn't recognized
+// is assumed to be Debian-based.
+func PackageManagerFromOSRelease(osRelease string) PackageManager {
+	ids := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(osRelease))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || (key != "ID" && key != "ID_LIKE") {
+			continue
+		}
+		ids = append(ids, strings.Fields(strings.Trim(value, `"'`))...)
+	}
+	for _, id := range ids {
+		switch id {
+		case "alpine":
+			return PackageManagerApk
+		case "rhel", "fedora", "centos", "rocky", "almalinux":
+			return PackageManagerDnf
+		}
+	}
+	return PackageManagerApt
+}
+
+// installCommand returns a RUN command that installs packages.
+func (pm PackageManager) installCommand(packages []string) string {
+	switch pm {
+	case PackageManagerApk:
+		return "RUN --mount=type=cache,target=/var/cache/apk apk add " + strings.Join(packages, " ")
+	case PackageManagerDnf:
+		return "RUN --mount=type=cache,target=/var/cache/dnf dnf install -y " + strings.Join(packages, " ") + " && dnf clean all"
+	default:
+		return "RUN --mount=type=cache,target=/var/cache/apt apt-get update -qq && apt-get install -qqy " +
+			strings.Join(packages, " ") +
+			" && rm -rf /var/lib/apt/lists/*"
+	}
+}
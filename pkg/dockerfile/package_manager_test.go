@@ -0,0 +1,46 @@
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestPackageManagerFromOSRelease(t *testing.T) {
+	for _, tc := range []struct {
+		osRelease string
+		expected  PackageManager
+	}{
+		{"NAME=\"Alpine Linux\"\nID=alpine\nVERSION_ID=3.17.0\n", PackageManagerApk},
+		{"NAME=\"Red Hat Enterprise Linux\"\nID=\"rhel\"\nID_LIKE=\"fedora\"\n", PackageManagerDnf},
+		{"NAME=\"Rocky Linux\"\nID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"\n", PackageManagerDnf},
+		{"NAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n", PackageManagerApt},
+		{"", PackageManagerApt},
+	} {
+		require.Equal(t, tc.expected, PackageManagerFromOSRelease(tc.osRelease), tc.osRelease)
+	}
+}
+
+func TestSystemPackageInstalls(t *testing.T) {
+	conf, err := config.FromYAML([]byte(`
+build:
+  system_packages:
+    - ffmpeg
+    - libsndfile
+`))
+	require.NoError(t, err)
+	gen, err := NewGenerator(conf, t.TempDir(), false)
+	require.NoError(t, err)
+
+	gen.PackageManager = PackageManagerApk
+	actual, err := gen.systemPackageInstalls()
+	require.NoError(t, err)
+	require.Equal(t, "RUN --mount=type=cache,target=/var/cache/apk apk add ffmpeg libsndfile", actual)
+
+	gen.PackageManager = PackageManagerDnf
+	actual, err = gen.systemPackageInstalls()
+	require.NoError(t, err)
+	require.Equal(t, "RUN --mount=type=cache,target=/var/cache/dnf dnf install -y ffmpeg libsndfile && dnf clean all", actual)
+}
@@ -0,0 +1,225 @@
+package dockerfile
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// Followed symlinks can point at directories with symlinks in them, which
+// can form a loop
+const maxFollowDepth = 40
+
+// specialFile is something in the workspace that isn't a regular file or a
+// directory: a symlink, socket, named pipe or device.
+type specialFile struct {
+	// path relative to the workspace, with forward slashes
+	path string
+	mode fs.FileMode
+	// target is where a symlink points
+	target string
+}
+
+func (f specialFile) isSymlink() bool {
+	return f.mode&fs.ModeSymlink != 0
+}
+
+// specialFiles returns the special files in the build context.
+func (g *Generator) specialFiles() ([]specialFile, error) {
+	if g.special != nil {
+		return g.special, nil
+	}
+	special := []specialFile{}
+	err := walkContextEntries(g.fs, g.Dir, func(rel string, d fs.DirEntry) error {
+		if d.Type().IsRegular() {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.SplitN(rel, "/", 2)[0] == ".cog" {
+			return nil
+		}
+		file := specialFile{path: rel, mode: d.Type()}
+		if file.isSymlink() {
+			reader, ok := g.fs.(afero.LinkReader)
+			if !ok {
+				return fmt.Errorf("Failed to read the symlink %s, because the filesystem doesn't support symlinks", rel)
+			}
+			target, err := reader.ReadlinkIfPossible(filepath.Join(g.Dir, rel))
+			if err != nil {
+				return err
+			}
+			file.target = target
+		}
+		special = append(special, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	g.special = special
+	return special, nil
+}
+
+// ContextExcludes returns paths in the workspace to leave out of the build
+// context, as well as what is in .dockerignore. Sockets, named pipes and
+// devices are always left out, because Docker can't send them and they only
+// mean something on this machine. With build.symlinks set to follow,
+// symlinks are left out too, and the files they point to are copied in
+// their place.
+func (g *Generator) ContextExcludes() ([]string, error) {
+	special, err := g.specialFiles()
+	if err != nil {
+		return nil, err
+	}
+	excludes := []string{}
+	for _, file := range special {
+		if file.isSymlink() && !g.followSymlinks() {
+			continue
+		}
+		excludes = append(excludes, file.path)
+	}
+	// Files in build.download and prefetch that go in the project directory
+	// are downloaded into the image, so copies that were downloaded to run
+	// the model from its project directory aren't copied in on top of them
+	for _, download := range g.Config.Downloads() {
+		if p := download.ProjectPath(); p != "" {
+			excludes = append(excludes, p)
+		}
+	}
+	// What Cog keeps in .cog, like the prediction history, is left out, so
+	// it isn't copied into images. The scratch space in .cog/tmp that the
+	// Dockerfile copies from stays.
+	cogEntries, err := afero.ReadDir(g.fs, filepath.Join(g.Dir, ".cog"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range cogEntries {
+		if entry.Name() != "tmp" {
+			excludes = append(excludes, path.Join(".cog", entry.Name()))
+		}
+	}
+	return excludes, nil
+}
+
+func (g *Generator) followSymlinks() bool {
+	return g.Config.Build.Symlinks == config.SymlinksFollow
+}
+
+// copyFollowedSymlinks copies what symlinks in the workspace point to into
+// the temporary directory, at the paths of the links, and returns a COPY
+// command that puts them where the links would have been in the image.
+func (g *Generator) copyFollowedSymlinks() (string, error) {
+	if !g.followSymlinks() {
+		return "", nil
+	}
+	special, err := g.specialFiles()
+	if err != nil {
+		return "", err
+	}
+	stageDir := filepath.Join(g.tmpDir, "symlinks")
+	staged := false
+	for _, file := range special {
+		if !file.isSymlink() {
+			continue
+		}
+		link := filepath.Join(g.Dir, filepath.FromSlash(file.path))
+		if _, err := g.fs.Stat(link); err != nil {
+			return "", fmt.Errorf("%s is a symlink to %s, which doesn't exist. Remove it, or add it to .dockerignore", file.path, file.target)
+		}
+		if err := g.copyFollowing(link, filepath.Join(stageDir, filepath.FromSlash(file.path)), 0); err != nil {
+			return "", fmt.Errorf("Failed to copy %s, which %s links to: %w", file.target, file.path, err)
+		}
+		staged = true
+	}
+	if !staged {
+		return "", nil
+	}
+	return g.copyToSrc([]string{path.Join(filepath.ToSlash(g.relativeTmpDir), "symlinks")}, "/src")
+}
+
+// linkSymlinks returns instructions that recreate the top-level symlinks in
+// the workspace in the image. COPY follows symlinks that are named as its
+// source, so with --groupfile they can't be copied like other files.
+func (g *Generator) linkSymlinks(links []specialFile) (string, error) {
+	lines := []string{}
+	for _, link := range links {
+		dest := path.Join("/src", link.path)
+		instruction, err := execForm("RUN", "ln", "-s", link.target, dest)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, instruction)
+		if owner := g.sourceOwner(); owner != "" {
+			instruction, err := execForm("RUN", "chown", "-h", owner, dest)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, instruction)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// copyFollowing copies src to dst, following symlinks. Files are hard
+// linked where possible, because they are often large weights. Permissions
+// are kept, so executable files stay executable.
+func (g *Generator) copyFollowing(src string, dst string, depth int) error {
+	if depth > maxFollowDepth {
+		return fmt.Errorf("%s is nested too deeply, which might be because of a symlink loop", src)
+	}
+	info, err := g.fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := g.fs.MkdirAll(dst, info.Mode().Perm()|0o700); err != nil {
+			return err
+		}
+		entries, err := afero.ReadDir(g.fs, src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := g.copyFollowing(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	if err := g.fs.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	// Hard links are only possible on the OS's filesystem, and link to
+	// symlinks rather than what they point to
+	if _, ok := g.fs.(*afero.OsFs); ok {
+		if resolved, err := filepath.EvalSymlinks(src); err == nil && os.Link(resolved, dst) == nil {
+			return nil
+		}
+	}
+	in, err := g.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := g.fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
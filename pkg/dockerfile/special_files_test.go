@@ -0,0 +1,123 @@
+package dockerfile
+
+import (
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func symlinksTestConfig(t *testing.T, symlinks string) *config.Config {
+	conf, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.9"
+  symlinks: ` + symlinks + `
+`))
+	require.NoError(t, err)
+	return conf
+}
+
+func TestSymlinksPreserve(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "predict.py"), []byte("x"), 0o644))
+	require.NoError(t, os.Mkdir(path.Join(tmpDir, "lib"), 0o755))
+	require.NoError(t, os.Symlink("../predict.py", path.Join(tmpDir, "lib", "predict.py")))
+	require.NoError(t, os.Symlink("/nonexistent/weights", path.Join(tmpDir, "weights")))
+	listener, err := net.Listen("unix", path.Join(tmpDir, "server.sock"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	gen, err := NewGenerator(symlinksTestConfig(t, "preserve"), tmpDir, true)
+	require.NoError(t, err)
+
+	excludes, err := gen.ContextExcludes()
+	require.NoError(t, err)
+	require.Equal(t, []string{"server.sock"}, excludes)
+
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(actual, `
+COPY ["predict.py","/src"]
+COPY ["lib","/src/lib"]
+RUN ["ln","-s","/nonexistent/weights","/src/weights"]`), actual)
+}
+
+func TestContextExcludesCogDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "predict.py"), []byte("x"), 0o644))
+	require.NoError(t, os.MkdirAll(path.Join(tmpDir, ".cog", "history", "3f2a9c1d"), 0o755))
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, ".cog", "history", "3f2a9c1d", "inputs.json"), []byte("{}"), 0o644))
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, ".cog", "history.jsonl"), []byte("{}\n"), 0o644))
+	require.NoError(t, os.MkdirAll(path.Join(tmpDir, ".cog", "crash-20240101T000000Z"), 0o755))
+
+	for _, groupFile := range []bool{false, true} {
+		gen, err := NewGenerator(symlinksTestConfig(t, "preserve"), tmpDir, groupFile)
+		require.NoError(t, err)
+
+		excludes, err := gen.ContextExcludes()
+		require.NoError(t, err)
+		require.Equal(t, []string{".cog/crash-20240101T000000Z", ".cog/history", ".cog/history.jsonl"}, excludes)
+		// The scratch space the Dockerfile copies from is still sent
+		require.True(t, strings.HasPrefix(gen.relativeTmpDir, ".cog/tmp/"), gen.relativeTmpDir)
+		require.NoError(t, gen.Cleanup())
+	}
+}
+
+func TestSymlinksFollow(t *testing.T) {
+	tmpDir := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(outside, "run.sh"), []byte("#!/bin/sh"), 0o755))
+	require.NoError(t, os.Mkdir(path.Join(outside, "weights"), 0o755))
+	require.NoError(t, os.WriteFile(path.Join(outside, "weights", "model.bin"), []byte("weights"), 0o644))
+
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "predict.py"), []byte("x"), 0o644))
+	require.NoError(t, os.Symlink(path.Join(outside, "run.sh"), path.Join(tmpDir, "run.sh")))
+	require.NoError(t, os.Symlink(path.Join(outside, "weights"), path.Join(tmpDir, "weights")))
+
+	gen, err := NewGenerator(symlinksTestConfig(t, "follow"), tmpDir, false)
+	require.NoError(t, err)
+
+	excludes, err := gen.ContextExcludes()
+	require.NoError(t, err)
+	require.Equal(t, []string{"run.sh", "weights"}, excludes)
+
+	actual, err := gen.Generate()
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(actual, `
+COPY [".","/src"]
+COPY ["`+gen.relativeTmpDir+`/symlinks","/src"]`), actual)
+
+	info, err := os.Stat(filepath.Join(gen.tmpDir, "symlinks", "run.sh"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	contents, err := os.ReadFile(filepath.Join(gen.tmpDir, "symlinks", "weights", "model.bin"))
+	require.NoError(t, err)
+	require.Equal(t, "weights", string(contents))
+}
+
+func TestSymlinksFollowBroken(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.Symlink("missing.bin", path.Join(tmpDir, "model.bin")))
+
+	gen, err := NewGenerator(symlinksTestConfig(t, "follow"), tmpDir, false)
+	require.NoError(t, err)
+	_, err = gen.Generate()
+	require.ErrorContains(t, err, "model.bin is a symlink to missing.bin, which doesn't exist")
+}
+
+func TestSymlinksFollowLoop(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.Mkdir(path.Join(tmpDir, "dir"), 0o755))
+	require.NoError(t, os.Symlink("..", path.Join(tmpDir, "dir", "parent")))
+
+	gen, err := NewGenerator(symlinksTestConfig(t, "follow"), tmpDir, false)
+	require.NoError(t, err)
+	_, err = gen.Generate()
+	require.ErrorContains(t, err, "symlink loop")
+}
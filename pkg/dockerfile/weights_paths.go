@@ -0,0 +1,62 @@
+package dockerfile
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// weightsPaths returns the files and directories in weights.paths, as paths
+// relative to the workspace.
+func (g *Generator) weightsPaths() []string {
+	if g.Config.Weights == nil {
+		return nil
+	}
+	paths := []string{}
+	for _, p := range g.Config.Weights.Paths {
+		paths = append(paths, path.Clean(filepath.ToSlash(p)))
+	}
+	return paths
+}
+
+// copiedSeparately returns the paths in the workspace that aren't copied
+// with the rest of it, as they're copied into layers of their own: the
+// sharded files and weights.paths.
+func (g *Generator) copiedSeparately() map[string]bool {
+	paths := map[string]bool{}
+	for _, file := range g.shardedFiles() {
+		paths[file] = true
+	}
+	for _, p := range g.weightsPaths() {
+		paths[p] = true
+	}
+	return paths
+}
+
+// copyWeights copies each of weights.paths into a layer of its own. They're
+// copied after the code, so they aren't copied again when only the weights
+// change, and the weights layers are the same whatever code they're built
+// with, so they aren't pushed again when only the code changes.
+func (g *Generator) copyWeights() (string, error) {
+	lines := []string{}
+	for _, p := range g.weightsPaths() {
+		line, err := g.copyToSrc([]string{p}, path.Join("/src", p))
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// isWeightsPath returns whether rel is in weights.paths, or in a directory
+// in it.
+func (g *Generator) isWeightsPath(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, p := range g.weightsPaths() {
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	return false
+}
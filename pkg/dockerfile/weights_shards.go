@@ -0,0 +1,161 @@
+package dockerfile
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// shardStage is the name of the stage that the files in weights.sharding
+// are split into shards in
+const shardStage = "shards"
+
+// ShardPath returns the path of shard i of a file in weights.sharding. The
+// shards are joined back into file when the model starts, by
+// python/cog/weights.py.
+func ShardPath(file string, i int) string {
+	return fmt.Sprintf("%s.shard-%02d", file, i)
+}
+
+// shardedFiles returns the files in weights.sharding, as paths relative to
+// the workspace.
+func (g *Generator) shardedFiles() []string {
+	if g.Config.Weights == nil || g.Config.Weights.Sharding == nil {
+		return nil
+	}
+	files := []string{}
+	for _, file := range g.Config.Weights.Sharding.Files {
+		files = append(files, path.Clean(filepath.ToSlash(file)))
+	}
+	return files
+}
+
+// shardStageLines returns a stage that splits each of the files in
+// weights.sharding into shards. The whole file is never in the final image,
+// only its shards, which are each copied into a layer of their own.
+func (g *Generator) shardStageLines() (string, error) {
+	files := g.shardedFiles()
+	if len(files) == 0 {
+		return "", nil
+	}
+	// The base image is pulled anyway, so reuse it rather than pulling another image
+	fromImage, err := g.fromImage()
+	if err != nil {
+		return "", err
+	}
+	lines := []string{fmt.Sprintf("FROM %s AS %s", fromImage, shardStage)}
+	for i, file := range files {
+		line, err := copyForm(nil, []string{file}, fmt.Sprintf("/shards/%d", i))
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line, fmt.Sprintf("RUN split -d -a 2 -n %d /shards/%d /shards/%d.part- && rm /shards/%d", g.Config.Weights.Sharding.Shards, i, i, i))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// copyShards copies each shard from the shard stage into a layer of its own,
+// next to where the file it's part of would be.
+func (g *Generator) copyShards() (string, error) {
+	flags := []string{"--from=" + shardStage}
+	if owner := g.sourceOwner(); owner != "" {
+		flags = append(flags, "--chown="+owner)
+	}
+	lines := []string{}
+	for i, file := range g.shardedFiles() {
+		for j := 0; j < g.Config.Weights.Sharding.Shards; j++ {
+			line, err := copyForm(flags, []string{fmt.Sprintf("/shards/%d.part-%02d", i, j)}, path.Join("/src", ShardPath(file, j)))
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// copyDirWithoutShards copies the directory rel in the workspace, which has
+// sharded files or weights.paths in it, to /src without those. Its files are
+// copied together, and each of its directories separately, so the only
+// directories that are split up are the ones those are in.
+func (g *Generator) copyDirWithoutShards(rel string, inContext map[string]bool) ([]string, error) {
+	entries, err := afero.ReadDir(g.fs, filepath.Join(g.Dir, rel))
+	if err != nil {
+		return nil, err
+	}
+	separate := g.copiedSeparately()
+
+	files := []string{}
+	lines := []string{}
+	for _, entry := range entries {
+		p := path.Join(rel, entry.Name())
+		if separate[p] || !inContext[p] {
+			continue
+		}
+		if !entry.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		if hasShardedFile(p, separate) {
+			dirLines, err := g.copyDirWithoutShards(p, inContext)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, dirLines...)
+			continue
+		}
+		line, err := g.copyToSrc([]string{p}, path.Join("/src", p))
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	if len(files) > 0 {
+		line, err := g.copyToSrc(files, path.Join("/src", rel)+"/")
+		if err != nil {
+			return nil, err
+		}
+		lines = append([]string{line}, lines...)
+	}
+	return lines, nil
+}
+
+// contextPaths returns the paths in the workspace that are sent to Docker,
+// with the directories they're in, so paths left out by .dockerignore aren't
+// copied by name. Special files are left out, as they're copied separately.
+func (g *Generator) contextPaths() (map[string]bool, error) {
+	special, err := g.specialFiles()
+	if err != nil {
+		return nil, err
+	}
+	isSpecial := map[string]bool{}
+	for _, file := range special {
+		isSpecial[file.path] = true
+	}
+	paths := map[string]bool{}
+	err = walkContextEntries(g.fs, g.Dir, func(rel string, d fs.DirEntry) error {
+		if isSpecial[filepath.ToSlash(rel)] {
+			return nil
+		}
+		for p := filepath.ToSlash(rel); p != "."; p = path.Dir(p) {
+			paths[p] = true
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// hasShardedFile returns whether the directory dir has any of the sharded
+// files, or other paths that are copied separately, in it.
+func hasShardedFile(dir string, sharded map[string]bool) bool {
+	for file := range sharded {
+		if strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
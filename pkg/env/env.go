@@ -0,0 +1,222 @@
+// Package env compares a local Python environment with the one a model's
+// image would have.
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// Environment is the Python version and packages in an environment
+type Environment struct {
+	PythonVersion string `json:"python_version"`
+	// CUDA is the CUDA version torch was built with, if it is installed
+	// with CUDA support
+	CUDA     string            `json:"cuda"`
+	Packages map[string]string `json:"packages"`
+}
+
+// Lists the installed distributions, and the CUDA version torch was built
+// with. Importing torch is slow, so its version is read from its metadata
+// and it is only imported to find the CUDA version if it's installed.
+const localEnvironmentScript = `
+import json, platform, sys
+try:
+    from importlib import metadata
+    dists = {d.metadata["Name"]: d.version for d in metadata.distributions() if d.metadata["Name"]}
+except ImportError:
+    import pkg_resources
+    dists = {d.project_name: d.version for d in pkg_resources.working_set}
+cuda = ""
+if any(name.lower() == "torch" for name in dists):
+    try:
+        import torch
+        cuda = torch.version.cuda or ""
+    except Exception:
+        pass
+json.dump({"python_version": platform.python_version(), "cuda": cuda, "packages": dists}, sys.stdout)
+`
+
+// Local returns the environment of the Python interpreter python.
+func Local(python string) (*Environment, error) {
+	cmd := exec.Command(python, "-c", localEnvironmentScript)
+	console.Debug("$ " + python + " -c <script>")
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("Failed to list the packages installed for %s: %s", python, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("Failed to run %s: %w", python, err)
+	}
+	env := &Environment{}
+	if err := json.Unmarshal(out, env); err != nil {
+		return nil, fmt.Errorf("Failed to parse the packages installed for %s: %w", python, err)
+	}
+	packages := map[string]string{}
+	for name, version := range env.Packages {
+		packages[normalizeName(name)] = version
+	}
+	env.Packages = packages
+	return env, nil
+}
+
+// Image returns the environment the image built from cfg would have. It
+// only knows the versions of packages that are pinned in cog.yaml, so
+// other packages have an empty version.
+func Image(cfg *config.Config) (*Environment, error) {
+	env := &Environment{
+		PythonVersion: cfg.Build.PythonVersion,
+		Packages:      map[string]string{},
+	}
+	if cfg.Build.GPU {
+		env.CUDA = cfg.Build.CUDA
+	}
+	requirements, err := cfg.PythonRequirementsForArch("linux", "amd64")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(requirements, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "-") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, version := splitRequirement(line)
+		if name != "" {
+			env.Packages[normalizeName(name)] = version
+		}
+	}
+	return env, nil
+}
+
+// Difference is something that is different between the local environment
+// and the image.
+type Difference struct {
+	// Name is the package, or "python" or "cuda"
+	Name  string
+	Local string
+	Image string
+	// Reason is why it's a problem, if it's not a different version
+	Reason string
+}
+
+func (d Difference) String() string {
+	s := fmt.Sprintf("%s: %s locally, %s in the image", d.Name, orNone(d.Local), orNone(d.Image))
+	if d.Reason != "" {
+		s += ". " + d.Reason
+	}
+	return s
+}
+
+// Diff returns the differences between the local environment and the
+// image, for the Python version, CUDA, and the packages in cog.yaml.
+// Packages that are installed locally but not in cog.yaml aren't included,
+// because most of them are dependencies of what is.
+func Diff(local *Environment, image *Environment) []Difference {
+	diffs := []Difference{}
+
+	if !sameVersion(minorVersion(local.PythonVersion), minorVersion(image.PythonVersion)) {
+		diffs = append(diffs, Difference{Name: "python", Local: local.PythonVersion, Image: image.PythonVersion})
+	}
+	if image.CUDA != "" && local.CUDA != "" && minorVersion(local.CUDA) != minorVersion(image.CUDA) {
+		diffs = append(diffs, Difference{Name: "cuda", Local: local.CUDA, Image: image.CUDA, Reason: "torch is built for a different version of CUDA"})
+	}
+
+	names := []string{}
+	for name := range image.Packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		imageVersion := image.Packages[name]
+		localVersion, ok := local.Packages[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Name: name, Image: orUnpinned(imageVersion), Reason: "The model hasn't been run locally with it"})
+		case imageVersion == "":
+			diffs = append(diffs, Difference{Name: name, Local: localVersion, Image: "the latest version", Reason: "Pin it in cog.yaml to " + name + "==" + publicVersion(localVersion) + " to get the same version"})
+		case !sameVersion(publicVersion(localVersion), publicVersion(imageVersion)):
+			diffs = append(diffs, Difference{Name: name, Local: localVersion, Image: imageVersion})
+		}
+	}
+	return diffs
+}
+
+var requirementNameRe = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)`)
+
+// splitRequirement returns the name of the package in a requirements.txt
+// line, and its version if it is pinned with ==.
+func splitRequirement(line string) (name string, version string) {
+	line = strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+	name = requirementNameRe.FindString(line)
+	rest := strings.TrimSpace(line[len(name):])
+	// Extras, like package[extra]==1.0
+	if strings.HasPrefix(rest, "[") {
+		if end := strings.Index(rest, "]"); end != -1 {
+			rest = strings.TrimSpace(rest[end+1:])
+		}
+	}
+	if strings.HasPrefix(rest, "==") && !strings.Contains(rest, ",") {
+		version = strings.TrimSpace(strings.TrimPrefix(rest, "=="))
+		if strings.Contains(version, "*") {
+			version = ""
+		}
+	}
+	return name, version
+}
+
+var nameSeparatorRe = regexp.MustCompile(`[-_.]+`)
+
+// normalizeName normalizes the name of a Python package, so the different
+// ways of writing it are the same.
+func normalizeName(name string) string {
+	return nameSeparatorRe.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// publicVersion strips the local part of a version, like +cu118 in torch
+// versions.
+func publicVersion(version string) string {
+	return strings.SplitN(version, "+", 2)[0]
+}
+
+func minorVersion(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// sameVersion compares versions, treating missing trailing zeros as equal,
+// so 1.0 and 1.0.0 are the same.
+func sameVersion(a string, b string) bool {
+	return trimZeros(a) == trimZeros(b)
+}
+
+func trimZeros(version string) string {
+	parts := strings.Split(version, ".")
+	for len(parts) > 1 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+func orNone(version string) string {
+	if version == "" {
+		return "not installed"
+	}
+	return version
+}
+
+func orUnpinned(version string) string {
+	if version == "" {
+		return "the latest version"
+	}
+	return version
+}
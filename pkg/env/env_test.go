@@ -0,0 +1,103 @@
+package env
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestSplitRequirement(t *testing.T) {
+	for _, tt := range []struct {
+		line    string
+		name    string
+		version string
+	}{
+		{"torch==2.0.1", "torch", "2.0.1"},
+		{"torch==2.0.1+cu118", "torch", "2.0.1+cu118"},
+		{"Pillow", "Pillow", ""},
+		{"numpy>=1.20", "numpy", ""},
+		{"numpy>=1.20,<2", "numpy", ""},
+		{"numpy==1.*", "numpy", ""},
+		{"uvicorn[standard]==0.22.0", "uvicorn", "0.22.0"},
+		{`pywin32==306; sys_platform == "win32"`, "pywin32", "306"},
+	} {
+		name, version := splitRequirement(tt.line)
+		require.Equal(t, tt.name, name, tt.line)
+		require.Equal(t, tt.version, version, tt.line)
+	}
+}
+
+func TestImage(t *testing.T) {
+	cfg, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  python_version: "3.10"
+  python_packages:
+    - "torch==1.12.1"
+    - "Pillow"
+    - "typing_extensions==4.5.0"
+`))
+	require.NoError(t, err)
+	require.NoError(t, cfg.ValidateAndComplete(""))
+
+	image, err := Image(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "3.10", image.PythonVersion)
+	require.Equal(t, cfg.Build.CUDA, image.CUDA)
+	require.Equal(t, "", image.Packages["pillow"])
+	require.Equal(t, "4.5.0", image.Packages["typing-extensions"])
+	require.Equal(t, "1.12.1+cu116", image.Packages["torch"])
+}
+
+func TestDiff(t *testing.T) {
+	local := &Environment{
+		PythonVersion: "3.11.4",
+		CUDA:          "12.1",
+		Packages: map[string]string{
+			"torch":             "2.0.1+cu121",
+			"numpy":             "1.24.0",
+			"pillow":            "9.5.0",
+			"typing-extensions": "4.5",
+		},
+	}
+	image := &Environment{
+		PythonVersion: "3.10",
+		CUDA:          "11.8",
+		Packages: map[string]string{
+			"torch":             "2.0.1+cu118",
+			"numpy":             "1.23.5",
+			"pillow":            "",
+			"typing-extensions": "4.5.0",
+			"transformers":      "4.30.0",
+		},
+	}
+	require.Equal(t, []Difference{
+		{Name: "python", Local: "3.11.4", Image: "3.10"},
+		{Name: "cuda", Local: "12.1", Image: "11.8", Reason: "torch is built for a different version of CUDA"},
+		{Name: "numpy", Local: "1.24.0", Image: "1.23.5"},
+		{Name: "pillow", Local: "9.5.0", Image: "the latest version", Reason: "Pin it in cog.yaml to pillow==9.5.0 to get the same version"},
+		{Name: "transformers", Image: "4.30.0", Reason: "The model hasn't been run locally with it"},
+	}, Diff(local, image))
+}
+
+func TestDiffSame(t *testing.T) {
+	local := &Environment{PythonVersion: "3.10.12", Packages: map[string]string{"torch": "2.0.1"}}
+	image := &Environment{PythonVersion: "3.10", CUDA: "11.8", Packages: map[string]string{"torch": "2.0.1+cpu"}}
+	require.Empty(t, Diff(local, image))
+}
+
+func TestLocal(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 isn't installed")
+	}
+	env, err := Local(python)
+	require.NoError(t, err)
+	require.NotEmpty(t, env.PythonVersion)
+	for name := range env.Packages {
+		require.Equal(t, normalizeName(name), name)
+	}
+}
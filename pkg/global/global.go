@@ -15,4 +15,9 @@ var (
 	ReplicateRegistryHost = "r8.im"
 	ReplicateWebsiteHost  = "replicate.com"
 	LabelNamespace        = "run.cog."
+	// ReleaseURL is the default release channel, and ReleasePublicKey
+	// verifies its releases. They're set at build time, from
+	// COG_RELEASE_URL and COG_RELEASE_PUBLIC_KEY.
+	ReleaseURL       = ""
+	ReleasePublicKey = ""
 )
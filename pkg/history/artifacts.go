@@ -0,0 +1,218 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vincent-petithory/dataurl"
+
+	"github.com/replicate/cog/pkg/util/mime"
+)
+
+// ArtifactsDir is where what's needed to reproduce each prediction is kept,
+// in a directory named by its ID, relative to the project directory
+const ArtifactsDir = ".cog/history"
+
+// MaxArtifacts is how many predictions' artifacts are kept. The oldest are
+// removed when there are more, and their entries in the history stay.
+const MaxArtifacts = 100
+
+// Artifacts are what's kept of a prediction, so it can be reproduced.
+type Artifacts struct {
+	// Config is the content of the cog.yaml the image was built from
+	Config []byte
+	// Inputs are the prediction's inputs, with files as data URLs
+	Inputs map[string]string
+	// Output is the prediction's output, decoded from JSON. Files in it are
+	// data URIs, or keys of OutputFiles.
+	Output interface{}
+	// OutputFiles are the output files that were sent apart from the JSON,
+	// by what they're referred to as in Output
+	OutputFiles map[string]OutputFile
+}
+
+// OutputFile is an output file that was written to a temporary file.
+type OutputFile struct {
+	Path        string
+	ContentType string
+}
+
+// PruneArtifacts removes the artifacts of the oldest predictions in dir,
+// so only the newest keep are kept.
+func PruneArtifacts(dir string, keep int) error {
+	entries, err := os.ReadDir(filepath.Join(dir, ArtifactsDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	type saved struct {
+		id      string
+		modTime time.Time
+	}
+	predictions := []saved{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		predictions = append(predictions, saved{id: entry.Name(), modTime: info.ModTime()})
+	}
+	if len(predictions) <= keep {
+		return nil
+	}
+	sort.Slice(predictions, func(i, j int) bool {
+		return predictions[i].modTime.Before(predictions[j].modTime)
+	})
+	for _, prediction := range predictions[:len(predictions)-keep] {
+		if err := os.RemoveAll(artifactsPath(dir, prediction.id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func artifactsPath(dir string, id string) string {
+	return filepath.Join(dir, ArtifactsDir, id)
+}
+
+// SaveArtifacts keeps the artifacts of prediction id in dir. Input and
+// output files are written as files of their own, and inputs.json and
+// output.json refer to them by their paths, relative to the prediction's
+// directory.
+func SaveArtifacts(dir string, id string, artifacts Artifacts) error {
+	root := artifactsPath(dir, id)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
+	}
+	if artifacts.Config != nil {
+		if err := os.WriteFile(filepath.Join(root, "cog.yaml"), artifacts.Config, 0o644); err != nil {
+			return err
+		}
+	}
+
+	inputs := map[string]string{}
+	for key, value := range artifacts.Inputs {
+		if !strings.HasPrefix(value, "data:") {
+			inputs[key] = value
+			continue
+		}
+		name, err := writeDataURL(root, "inputs", key, value)
+		if err != nil {
+			return fmt.Errorf("Failed to save input %s: %w", key, err)
+		}
+		// Like -i, files are prefixed with @
+		inputs[key] = "@" + name
+	}
+	if err := writeJSON(filepath.Join(root, "inputs.json"), inputs); err != nil {
+		return err
+	}
+
+	files := 0
+	output, err := saveOutput(root, artifacts.Output, artifacts.OutputFiles, &files)
+	if err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(root, "output.json"), output)
+}
+
+// saveOutput writes the files in output to the output directory, and
+// returns output with them replaced by their paths.
+func saveOutput(root string, output interface{}, outputFiles map[string]OutputFile, files *int) (interface{}, error) {
+	switch v := output.(type) {
+	case string:
+		if file, ok := outputFiles[v]; ok {
+			name := filepath.Join("output", fmt.Sprintf("%d%s", *files, mime.ExtensionByType(file.ContentType)))
+			*files++
+			if err := copyFile(file.Path, filepath.Join(root, name)); err != nil {
+				return nil, fmt.Errorf("Failed to save output: %w", err)
+			}
+			return name, nil
+		}
+		if strings.HasPrefix(v, "data:") {
+			name, err := writeDataURL(root, "output", fmt.Sprint(*files), v)
+			*files++
+			if err != nil {
+				return nil, fmt.Errorf("Failed to save output: %w", err)
+			}
+			return name, nil
+		}
+		return v, nil
+	case []interface{}:
+		saved := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if saved[i], err = saveOutput(root, item, outputFiles, files); err != nil {
+				return nil, err
+			}
+		}
+		return saved, nil
+	case map[string]interface{}:
+		// In order, so files are numbered the same every time
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		saved := map[string]interface{}{}
+		for _, key := range keys {
+			var err error
+			if saved[key], err = saveOutput(root, v[key], outputFiles, files); err != nil {
+				return nil, err
+			}
+		}
+		return saved, nil
+	}
+	return output, nil
+}
+
+// writeDataURL writes the content of a data URL to dir/name, with the
+// extension of its content type, and returns its path relative to root.
+func writeDataURL(root string, dir string, name string, value string) (string, error) {
+	decoded, err := dataurl.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	relativePath := filepath.Join(dir, name+mime.ExtensionByType(decoded.ContentType()))
+	if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+		return "", err
+	}
+	return relativePath, os.WriteFile(filepath.Join(root, relativePath), decoded.Data, 0o644)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+func copyFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
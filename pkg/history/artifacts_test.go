@@ -0,0 +1,33 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"c", "a", "b"} {
+		require.NoError(t, SaveArtifacts(dir, id, Artifacts{Inputs: map[string]string{"text": "hello"}}))
+		modTime := start.Add(time.Duration(i) * time.Hour)
+		require.NoError(t, os.Chtimes(artifactsPath(dir, id), modTime, modTime))
+	}
+
+	require.NoError(t, PruneArtifacts(dir, 3))
+	require.DirExists(t, artifactsPath(dir, "c"))
+
+	require.NoError(t, PruneArtifacts(dir, 2))
+	require.NoDirExists(t, artifactsPath(dir, "c"))
+	require.DirExists(t, artifactsPath(dir, "a"))
+	require.DirExists(t, artifactsPath(dir, "b"))
+}
+
+func TestPruneArtifactsWithoutHistory(t *testing.T) {
+	require.NoError(t, PruneArtifacts(t.TempDir(), MaxArtifacts))
+	require.NoError(t, PruneArtifacts(filepath.Join(t.TempDir(), "missing"), MaxArtifacts))
+}
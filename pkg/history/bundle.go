@@ -0,0 +1,112 @@
+package history
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/shell"
+)
+
+// WriteBundle writes a gzipped tarball of what's needed to reproduce the
+// prediction in entry: the artifacts kept in dir, the entry itself as
+// prediction.json, and a reproduce.sh script that runs it again with
+// cog predict, on the same image.
+func WriteBundle(dir string, entry Entry, w io.Writer) error {
+	root := artifactsPath(dir, entry.ID)
+	inputsJSON, err := os.ReadFile(filepath.Join(root, "inputs.json"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("The inputs of prediction %s weren't kept, so it can't be bundled", entry.ID)
+	} else if err != nil {
+		return err
+	}
+	inputs := map[string]string{}
+	if err := json.Unmarshal(inputsJSON, &inputs); err != nil {
+		return fmt.Errorf("Failed to read the inputs of prediction %s: %w", entry.ID, err)
+	}
+	entryJSON, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	prefix := "cog-prediction-" + entry.ID
+	if err := writeTarFile(tw, prefix+"/prediction.json", append(entryJSON, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, prefix+"/reproduce.sh", []byte(reproduceScript(entry, inputs)), 0o755); err != nil {
+		return err
+	}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return writeTarFile(tw, prefix+"/"+filepath.ToSlash(rel), data, 0o644)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// reproduceScript returns a script that runs the prediction again, from the
+// directory it's in.
+func reproduceScript(entry Entry, inputs map[string]string) string {
+	image := entry.Image
+	if entry.RepoDigest != "" {
+		image = entry.RepoDigest
+	}
+	args := []string{"cog", "predict", shell.Quote(image)}
+	if entry.Model != "" {
+		args = append(args, "--model", shell.Quote(entry.Model))
+	}
+	keys := []string{}
+	for key := range inputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "-i", shell.Quote(key+"="+inputs[key]))
+	}
+
+	lines := []string{
+		"#!/bin/sh",
+		fmt.Sprintf("# Runs prediction %s again. It ran on %s (%s) at %s.", entry.ID, entry.Image, entry.ImageDigest, entry.Time.Format("2006-01-02 15:04:05 MST")),
+		"# Its output is in output.json and output/.",
+	}
+	if entry.RepoDigest == "" {
+		lines = append(lines, fmt.Sprintf("# %s wasn't pushed, so it needs to be built from cog.yaml, or copied with 'docker save'.", entry.Image))
+	}
+	lines = append(lines,
+		"set -e",
+		`cd "$(dirname "$0")"`,
+		strings.Join(args, " "),
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
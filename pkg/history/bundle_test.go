@@ -0,0 +1,74 @@
+package history
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBundle(t *testing.T) {
+	dir := t.TempDir()
+	largeOutput := filepath.Join(t.TempDir(), "cog-output-123")
+	require.NoError(t, os.WriteFile(largeOutput, []byte("large"), 0o644))
+
+	require.NoError(t, SaveArtifacts(dir, "abc123", Artifacts{
+		Config: []byte("build:\n  python_version: \"3.11\"\n"),
+		Inputs: map[string]string{
+			"prompt": "it's a cat",
+			"image":  "data:image/png;base64,aGk=",
+		},
+		Output: []interface{}{"data:text/plain;base64,aGVsbG8=", "cid:1"},
+		OutputFiles: map[string]OutputFile{
+			"cid:1": {Path: largeOutput, ContentType: "image/png"},
+		},
+	}))
+
+	entry := Entry{
+		ID:          "abc123",
+		Time:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Image:       "r8.im/user/model",
+		ImageDigest: "sha256:aaa",
+		RepoDigest:  "r8.im/user/model@sha256:bbb",
+		Status:      "succeeded",
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteBundle(dir, entry, &buf))
+
+	files := map[string]string{}
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(content)
+	}
+
+	prefix := "cog-prediction-abc123/"
+	require.Equal(t, "build:\n  python_version: \"3.11\"\n", files[prefix+"cog.yaml"])
+	require.Equal(t, "hi", files[prefix+"inputs/image.png"])
+	require.Equal(t, "hello", files[prefix+"output/0.txt"])
+	require.Equal(t, "large", files[prefix+"output/1.png"])
+	require.JSONEq(t, `{"image": "@inputs/image.png", "prompt": "it's a cat"}`, files[prefix+"inputs.json"])
+	require.JSONEq(t, `["output/0.txt", "output/1.png"]`, files[prefix+"output.json"])
+	require.Contains(t, files[prefix+"prediction.json"], `"image_digest": "sha256:aaa"`)
+	require.Contains(t, files[prefix+"reproduce.sh"], `cog predict 'r8.im/user/model@sha256:bbb' -i 'image=@inputs/image.png' -i 'prompt=it'\''s a cat'`)
+}
+
+func TestWriteBundleWithoutArtifacts(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteBundle(t.TempDir(), Entry{ID: "abc123"}, &buf)
+	require.ErrorContains(t, err, "weren't kept")
+}
@@ -0,0 +1,164 @@
+// Package history records the predictions run locally with cog predict and
+// cog train, so experiments can be audited later with cog history.
+//
+// Entries are appended, one JSON object per line, to .cog/history.jsonl in
+// the project directory, so the history survives rebuilds and can be read
+// with other tools too.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Filename is where the history is kept, relative to the project directory
+const Filename = ".cog/history.jsonl"
+
+// StatusError is the status of predictions that didn't get a response,
+// like when the container crashed or the inputs were invalid
+const StatusError = "error"
+
+// Entry is a prediction in the history.
+type Entry struct {
+	// ID identifies the prediction in the history. Its artifacts are kept
+	// in a directory of ArtifactsDir named by it.
+	ID   string    `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+	// Image is the name of the image the prediction ran on, and
+	// ImageDigest its ID, so it's known which build it ran on even if the
+	// name has since been given to another one
+	Image       string `json:"image"`
+	ImageDigest string `json:"image_digest,omitempty"`
+	// RepoDigest is a reference to the image by its digest in a registry,
+	// like r8.im/user/model@sha256:..., if it was pushed or pulled
+	RepoDigest string `json:"repo_digest,omitempty"`
+	// Model is the variant from cog.yaml, if one was chosen
+	Model string `json:"model,omitempty"`
+	// InputsHash is the SHA256 of the inputs, including the content of
+	// input files, so predictions with the same inputs can be found
+	InputsHash string `json:"inputs_hash,omitempty"`
+	// Duration is how long the prediction took, in seconds
+	Duration float64 `json:"duration"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	// Output is where the output was written, if it was passed with -o
+	Output string `json:"output,omitempty"`
+}
+
+// Append adds entry to the history in dir.
+func Append(dir string, entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, Filename)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// A single write of a line is atomic with O_APPEND, so concurrent
+	// predictions don't interleave their entries
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns the history in dir, oldest first. It's empty if nothing has
+// been recorded yet.
+func Read(dir string) ([]Entry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, Filename))
+	if os.IsNotExist(err) {
+		return []Entry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		entry := Entry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("Failed to read line %d of %s: %w", lineNumber, Filename, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Find returns the entry with the ID, or the only one whose ID starts with
+// it.
+func Find(entries []Entry, id string) (Entry, error) {
+	matched := []Entry{}
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+		if id != "" && strings.HasPrefix(entry.ID, id) {
+			matched = append(matched, entry)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return Entry{}, fmt.Errorf("There is no prediction %s in the history", id)
+	case 1:
+		return matched[0], nil
+	}
+	return Entry{}, fmt.Errorf("More than one prediction in the history has an ID starting with %s", id)
+}
+
+// Filter picks entries from the history. Fields that aren't set match
+// every entry.
+type Filter struct {
+	Status string
+	// Image matches entries whose image name contains it, or whose digest
+	// starts with it
+	Image string
+	Model string
+	// InputsHash matches entries whose inputs hash starts with it
+	InputsHash string
+	Since      time.Time
+	// Limit keeps only the most recent entries, if it's more than 0
+	Limit int
+}
+
+// Apply returns the entries that match the filter, oldest first.
+func (f Filter) Apply(entries []Entry) []Entry {
+	matched := []Entry{}
+	for _, entry := range entries {
+		if f.Status != "" && entry.Status != f.Status {
+			continue
+		}
+		if f.Image != "" && !strings.Contains(entry.Image, f.Image) && !strings.HasPrefix(entry.ImageDigest, f.Image) {
+			continue
+		}
+		if f.Model != "" && entry.Model != f.Model {
+			continue
+		}
+		if f.InputsHash != "" && !strings.HasPrefix(entry.InputsHash, f.InputsHash) {
+			continue
+		}
+		if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	if f.Limit > 0 && len(matched) > f.Limit {
+		matched = matched[len(matched)-f.Limit:]
+	}
+	return matched
+}
@@ -0,0 +1,69 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendAndRead(t *testing.T) {
+	dir := t.TempDir()
+
+	entries, err := Read(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	first := Entry{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Image: "cog-resnet", ImageDigest: "sha256:abc", InputsHash: "123", Duration: 1.5, Status: "succeeded", Output: "out.png"}
+	second := Entry{Time: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), Image: "cog-resnet", Duration: 0.2, Status: StatusError, Error: "Failed to POST"}
+	require.NoError(t, Append(dir, first))
+	require.NoError(t, Append(dir, second))
+
+	entries, err = Read(dir)
+	require.NoError(t, err)
+	require.Equal(t, []Entry{first, second}, entries)
+}
+
+func TestReadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".cog"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, Filename), []byte("{\"status\": \"succeeded\"}\nnot json\n"), 0o644))
+	_, err := Read(dir)
+	require.ErrorContains(t, err, "line 2")
+}
+
+func TestFilter(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	entries := []Entry{
+		{Time: day(1), Image: "cog-resnet", ImageDigest: "sha256:aaa", InputsHash: "111", Status: "succeeded"},
+		{Time: day(2), Image: "cog-resnet", ImageDigest: "sha256:bbb", InputsHash: "222", Status: "failed"},
+		{Time: day(3), Image: "r8.im/user/sdxl", ImageDigest: "sha256:ccc", InputsHash: "111", Status: "succeeded", Model: "turbo"},
+	}
+
+	require.Equal(t, entries, Filter{}.Apply(entries))
+	require.Equal(t, []Entry{entries[0], entries[2]}, Filter{Status: "succeeded"}.Apply(entries))
+	require.Equal(t, []Entry{entries[0], entries[1]}, Filter{Image: "resnet"}.Apply(entries))
+	require.Equal(t, []Entry{entries[1]}, Filter{Image: "sha256:bb"}.Apply(entries))
+	require.Equal(t, []Entry{entries[2]}, Filter{Model: "turbo"}.Apply(entries))
+	require.Equal(t, []Entry{entries[0], entries[2]}, Filter{InputsHash: "11"}.Apply(entries))
+	require.Equal(t, []Entry{entries[1], entries[2]}, Filter{Since: day(2)}.Apply(entries))
+	require.Equal(t, []Entry{entries[2]}, Filter{Limit: 1}.Apply(entries))
+}
+
+func TestFind(t *testing.T) {
+	entries := []Entry{{ID: "abc123"}, {ID: "abd456"}, {Status: "succeeded"}}
+
+	entry, err := Find(entries, "abc123")
+	require.NoError(t, err)
+	require.Equal(t, "abc123", entry.ID)
+	entry, err = Find(entries, "abd")
+	require.NoError(t, err)
+	require.Equal(t, "abd456", entry.ID)
+
+	_, err = Find(entries, "ab")
+	require.ErrorContains(t, err, "More than one")
+	_, err = Find(entries, "xyz")
+	require.ErrorContains(t, err, "There is no prediction xyz")
+}
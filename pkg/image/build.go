@@ -2,41 +2,99 @@ package image
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/moby/buildkit/client/llb"
 
 	"github.com/replicate/cog/pkg/config"
 	"github.com/replicate/cog/pkg/docker"
 	"github.com/replicate/cog/pkg/dockerfile"
 	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/util"
 	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/weights"
 )
 
 // Build a Cog model from a config
 //
 // This is separated out from docker.Build(), so that can be as close as possible to the behavior of 'docker build'.
-func Build(cfg *config.Config, dir, imageName string, progressOutput string, groupFile bool) error {
+func Build(cfg *config.Config, dir, imageName string, progressOutput string, groupFile bool, buildOptions docker.BuildOptions) error {
 	console.Infof("Building Docker image from environment in cog.yaml as %s...", imageName)
 
-	generator, err := dockerfile.NewGenerator(cfg, dir, groupFile)
+	if cfg.Weights != nil && len(cfg.Weights.Validate) > 0 {
+		console.Info("Checking weights...")
+		if err := weights.ValidateConfig(cfg, dir); err != nil {
+			return err
+		}
+	}
+
+	generator, err := NewGenerator(cfg, dir, groupFile)
 	if err != nil {
 		return fmt.Errorf("Error creating Dockerfile generator: %w", err)
 	}
+	generator.CacheScope = buildOptions.CacheScope
+	generator.Strict = buildOptions.Strict
+	generator.NoCacheFilter = buildOptions.NoCacheFilter
+	generator.Target = buildOptions.Target
+	generator.LLB = buildOptions.Backend == "llb"
+	generator.GPUBuilder = cfg.Build.RunRequiresGPU() && docker.BuilderHasGPU(buildOptions.Builder)
+	if generator.GPUBuilder && generator.LLB {
+		// LLB can't give RUN instructions devices in the version of
+		// BuildKit Cog builds it with
+		console.Warn("The builder has GPUs, but --backend llb can't use them, so the commands in build.run that need a GPU will run when the model first starts. Use --backend dockerfile to run them during the build.")
+		generator.GPUBuilder = false
+	}
+	setOffline(generator, buildOptions)
+	if cfg.Build.SSH && buildOptions.SSH == "" {
+		buildOptions.SSH = "default"
+	}
 	defer func() {
 		if err := generator.Cleanup(); err != nil {
 			console.Warnf("Error cleaning up Dockerfile generator: %s", err)
 		}
 	}()
+	if err := SetPlatform(generator, buildOptions.Platform); err != nil {
+		return err
+	}
+	if err := checkBuildPolicy(cfg, generator); err != nil {
+		return err
+	}
+	if !buildOptions.Offline {
+		pinBaseImage(generator, dir)
+	}
 
 	dockerfileContents, err := generator.Generate()
 	if err != nil {
 		return fmt.Errorf("Failed to generate Dockerfile: %w", err)
 	}
 
-	if err := docker.Build(dir, dockerfileContents, imageName, progressOutput); err != nil {
+	warnIfLarge(generator, dir)
+
+	buildOptions.Stages = generator.Stages()
+	if buildOptions.Exclude, err = generator.ContextExcludes(); err != nil {
+		return err
+	}
+	if generator.LLB {
+		err = docker.BuildLLB(dir, llbConverter(generator, dockerfileContents), imageName, progressOutput, buildOptions)
+	} else {
+		err = docker.Build(dir, dockerfileContents, imageName, progressOutput, buildOptions)
+	}
+	if err != nil {
 		return fmt.Errorf("Failed to build Docker image: %w", err)
 	}
 
+	// The labels are worked out by running the model, which a partial image
+	// may not have
+	if buildOptions.Target != "" {
+		return nil
+	}
+
 	console.Info("Adding labels to image...")
 	schema, err := GenerateOpenAPISchema(imageName, cfg.Build.GPU)
 	if err != nil {
@@ -61,6 +119,36 @@ func Build(cfg *config.Config, dir, imageName string, progressOutput string, gro
 		"org.cogmodel.config":      string(bytes.TrimSpace(configJSON)),
 	}
 
+	// So images built from the same cog.yaml, and the commit they were
+	// built from, can be found
+	labels[global.LabelNamespace+"config_hash"] = fmt.Sprintf("%x", sha256.Sum256(bytes.TrimSpace(configJSON)))
+	if revision, ok := gitRevision(dir); ok {
+		labels["org.opencontainers.image.revision"] = revision
+	}
+
+	// What was injected into the build from outside the project, so it can
+	// be audited
+	checksumsJSON, err := json.Marshal(generator.Checksums())
+	if err != nil {
+		return fmt.Errorf("Failed to convert checksums to JSON: %w", err)
+	}
+	labels[global.LabelNamespace+"build_checksums"] = string(checksumsJSON)
+	// Which index packages were installed from can depend on whether it
+	// could be reached, so it's recorded for reviewing how the image was
+	// built
+	labels[global.LabelNamespace+"pip_index_url"] = generator.PipIndexURL
+
+	// So the host's driver can be checked before running the model, rather
+	// than CUDA failing to initialize in it
+	if cfg.Build.GPU && cfg.Build.CUDA != "" {
+		driver, err := config.MinimumDriverVersion(cfg.Build.CUDA)
+		if err != nil {
+			console.Warnf("%s", err)
+		} else {
+			labels[global.LabelNamespace+"min_nvidia_driver"] = driver
+		}
+	}
+
 	// OpenAPI schema is not set if there is no predictor.
 	if len((*schema).(map[string]interface{})) != 0 {
 		schemaJSON, err := json.Marshal(schema)
@@ -71,33 +159,195 @@ func Build(cfg *config.Config, dir, imageName string, progressOutput string, gro
 		labels["org.cogmodel.openapi_schema"] = string(schemaJSON)
 	}
 
-	if err := docker.BuildAddLabelsToImage(imageName, labels); err != nil {
+	if err := docker.BuildAddLabelsToImage(imageName, labels, buildOptions.Platform); err != nil {
 		return fmt.Errorf("Failed to add labels to image: %w", err)
 	}
 	return nil
 }
 
-func BuildBase(cfg *config.Config, dir string, progressOutput string, groupFile bool) (string, error) {
+func BuildBase(cfg *config.Config, dir string, progressOutput string, groupFile bool, buildOptions docker.BuildOptions) (string, error) {
 	// TODO: better image management so we don't eat up disk space
 	// https://github.com/replicate/cog/issues/80
 	imageName := config.BaseDockerImageName(dir)
 
 	console.Info("Building Docker image from environment in cog.yaml...")
-	generator, err := dockerfile.NewGenerator(cfg, dir, groupFile)
+	generator, err := NewGenerator(cfg, dir, groupFile)
 	if err != nil {
 		return "", fmt.Errorf("Error creating Dockerfile generator: %w", err)
 	}
+	generator.CacheScope = buildOptions.CacheScope
+	generator.NoCacheFilter = buildOptions.NoCacheFilter
+	generator.GPUBuilder = cfg.Build.RunRequiresGPU() && docker.BuilderHasGPU(buildOptions.Builder)
+	setOffline(generator, buildOptions)
+	if cfg.Build.SSH && buildOptions.SSH == "" {
+		buildOptions.SSH = "default"
+	}
 	defer func() {
 		if err := generator.Cleanup(); err != nil {
 			console.Warnf("Error cleaning up Dockerfile generator: %s", err)
 		}
 	}()
+	if err := SetPlatform(generator, buildOptions.Platform); err != nil {
+		return "", err
+	}
 	dockerfileContents, err := generator.GenerateBase()
 	if err != nil {
 		return "", fmt.Errorf("Failed to generate Dockerfile: %w", err)
 	}
-	if err := docker.Build(dir, dockerfileContents, imageName, progressOutput); err != nil {
+	if err := DownloadToProject(cfg.Downloads(), dir); err != nil {
+		return "", err
+	}
+	buildOptions.Stages = generator.Stages()
+	if buildOptions.Exclude, err = generator.ContextExcludes(); err != nil {
+		return "", err
+	}
+	if err := docker.Build(dir, dockerfileContents, imageName, progressOutput, buildOptions); err != nil {
 		return "", fmt.Errorf("Failed to build Docker image: %w", err)
 	}
 	return imageName, nil
 }
+
+// setOffline sets up generator to build offline, if buildOptions say to.
+// Offline, build.pip_index_url is used without checking it can be reached,
+// because build.pip_fallback_index_url is usually on the internet.
+// llbConverter returns the converter docker.BuildLLB builds dockerfile
+// with, which the generator generated.
+func llbConverter(generator *dockerfile.Generator, dockerfileContents string) docker.LLBConverter {
+	return func(ctx context.Context, build docker.LLBBuild) (*llb.Definition, []byte, error) {
+		def, img, err := generator.ConvertToLLB(ctx, dockerfileContents, build)
+		if err != nil {
+			return nil, nil, err
+		}
+		config, err := json.Marshal(img)
+		if err != nil {
+			return nil, nil, err
+		}
+		return def, config, nil
+	}
+}
+
+func setOffline(generator *dockerfile.Generator, buildOptions docker.BuildOptions) {
+	generator.Offline = buildOptions.Offline
+	generator.PythonTarball = buildOptions.PythonTarball
+	generator.Wheelhouse = buildOptions.Wheelhouse
+	if buildOptions.Offline {
+		generator.PipIndexURL = generator.Config.Build.PipIndex()
+	} else {
+		generator.PipIndexURL = choosePipIndex(generator.Config.Build)
+	}
+}
+
+// SetPlatform makes the generator generate the image for platform, like
+// linux/arm64, if it's set, rather than the one Docker builds for by
+// default.
+func SetPlatform(generator *dockerfile.Generator, platform string) error {
+	if platform == "" {
+		return nil
+	}
+	goos, goarch, err := util.ParsePlatform(platform)
+	if err != nil {
+		return err
+	}
+	generator.GOOS = goos
+	generator.GOARCH = goarch
+	return nil
+}
+
+// lockFileMu serializes updates to cog.lock, because matrix builds build
+// images in parallel.
+var lockFileMu sync.Mutex
+
+// NewGenerator creates a Dockerfile generator for cfg, with the user's
+// settings applied and the base image pinned by cog.lock, if it's there.
+// cog.lock is only read, so it doesn't reach the registry.
+func NewGenerator(cfg *config.Config, dir string, groupFile bool) (*dockerfile.Generator, error) {
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	lockFileMu.Lock()
+	lock, err := config.LoadLock(dir)
+	lockFileMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	generator, err := dockerfile.NewGenerator(cfg, dir, groupFile)
+	if err != nil {
+		return nil, err
+	}
+	generator.RegistryMirrors = userConfig.RegistryMirrors
+	generator.Lock = lock
+
+	packageManager, err := detectPackageManager(generator)
+	if err != nil {
+		return nil, err
+	}
+	generator.PackageManager = packageManager
+	return generator, nil
+}
+
+// pinBaseImage pins the generator's base image in cog.lock in dir, if it
+// isn't already, when an image is built from it. cog.lock is loaded again,
+// so what other builds pinned in the meantime is kept.
+func pinBaseImage(generator *dockerfile.Generator, dir string) {
+	lockFileMu.Lock()
+	defer lockFileMu.Unlock()
+
+	lock, err := config.LoadLock(dir)
+	if err != nil {
+		console.Warnf("Not pinning base image: %s", err)
+		return
+	}
+	changed, err := LockBaseImage(generator, lock, false)
+	if err != nil {
+		console.Warnf("Not pinning base image: %s", err)
+		return
+	}
+	if changed {
+		if err := lock.Save(dir); err != nil {
+			console.Warnf("%s", err)
+		}
+	}
+	generator.Lock = lock
+}
+
+// detectPackageManager probes a custom base image's /etc/os-release to work
+// out how to install system packages in it. Cog already knows about its own
+// base images, so they aren't probed.
+func detectPackageManager(generator *dockerfile.Generator) (dockerfile.PackageManager, error) {
+	packageManager, ok, err := generator.StandardPackageManager()
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return packageManager, nil
+	}
+	baseImage, err := generator.BaseImage()
+	if err != nil {
+		return "", err
+	}
+	osRelease, err := docker.ReadImageFile(config.MirrorImage(baseImage, generator.RegistryMirrors), "/etc/os-release")
+	if err != nil {
+		return "", err
+	}
+	packageManager = dockerfile.PackageManagerFromOSRelease(string(osRelease))
+	console.Debugf("Using %s to install system packages in %s", packageManager, baseImage)
+	return packageManager, nil
+}
+
+// gitRevision returns the commit checked out in dir, with -dirty on the end
+// if there are uncommitted changes, so it's clear the image may not match
+// the commit. ok is false if dir isn't in a git repository.
+func gitRevision(dir string) (revision string, ok bool) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", false
+	}
+	revision = strings.TrimSpace(string(out))
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err == nil && len(bytes.TrimSpace(status)) > 0 {
+		revision += "-dirty"
+	}
+	return revision, true
+}
@@ -0,0 +1,189 @@
+package image
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/docker/go-units"
+
+	"github.com/replicate/cog/pkg/docker"
+)
+
+// similarLayerSizeRatio is how close the sizes of layers in different images
+// have to be for them to probably be the same step of the build, run on top
+// of different layers
+const similarLayerSizeRatio = 0.01
+
+// minSuggestedLayerSize is the size below which layers aren't worth
+// restructuring a build for
+const minSuggestedLayerSize = 100 * 1000 * 1000
+
+// largeUniqueLayerSize is the size over which layers that are only in one
+// image are pointed out, as they're often weights that other models use too
+const largeUniqueLayerSize = 1000 * 1000 * 1000
+
+// ImageLayers are the layers of an image in a registry, from the base image
+// up.
+type ImageLayers struct {
+	Image  string
+	Layers []docker.Descriptor
+}
+
+// ImageStorage is how much of an image's storage in the registry is shared
+// with the other images in a DedupeReport.
+type ImageStorage struct {
+	Image string
+	// Size is the size of all the image's layers
+	Size int64
+	// SharedSize is the size of its layers that are in other images too
+	SharedSize int64
+	// UniqueSize is the size of its layers that are only in this image
+	UniqueSize int64
+}
+
+// DedupeReport is how much storage a family of images uses in a registry,
+// which stores each layer once however many images it's in, and how to
+// restructure the images so they share more layers.
+type DedupeReport struct {
+	Images []ImageStorage
+	// TotalSize is the size of every image added up, as if they shared
+	// nothing
+	TotalSize int64
+	// StoredSize is the size of the layers the registry stores, with each
+	// layer counted once
+	StoredSize  int64
+	Suggestions []string
+}
+
+// NewDedupeReport works out which of the layers of images are shared, and
+// suggests how to share more of them.
+func NewDedupeReport(images []ImageLayers) *DedupeReport {
+	report := &DedupeReport{}
+
+	// How many images each layer is in, and its size
+	imageCount := map[string]int{}
+	sizes := map[string]int64{}
+	for _, image := range images {
+		for digest := range layerSet(image.Layers) {
+			imageCount[digest]++
+		}
+		for _, layer := range image.Layers {
+			sizes[layer.Digest] = layer.Size
+		}
+	}
+	for _, size := range sizes {
+		report.StoredSize += size
+	}
+
+	for _, image := range images {
+		storage := ImageStorage{Image: image.Image}
+		for digest := range layerSet(image.Layers) {
+			storage.Size += sizes[digest]
+			if imageCount[digest] > 1 {
+				storage.SharedSize += sizes[digest]
+			} else {
+				storage.UniqueSize += sizes[digest]
+			}
+		}
+		report.TotalSize += storage.Size
+		report.Images = append(report.Images, storage)
+	}
+
+	report.Suggestions = append(report.Suggestions, suggestSharedBase(images)...)
+	report.Suggestions = append(report.Suggestions, suggestLayerOrder(images)...)
+	report.Suggestions = append(report.Suggestions, suggestWeightLayers(images, imageCount)...)
+	return report
+}
+
+// suggestSharedBase suggests building the images on the same base image, if
+// their first layers are different.
+func suggestSharedBase(images []ImageLayers) []string {
+	bases := map[string]bool{}
+	for _, image := range images {
+		if len(image.Layers) > 0 {
+			bases[image.Layers[0].Digest] = true
+		}
+	}
+	if len(bases) < 2 {
+		return nil
+	}
+	return []string{fmt.Sprintf("The images are built on %d different base images. If they're built on the same one, with the same python_version, cuda, and base_image in cog.yaml, the registry only stores it once.", len(bases))}
+}
+
+// suggestLayerOrder suggests moving what's different between two images
+// after what they have in common, if after they stop sharing layers they
+// have layers of about the same size. Those are usually the same step, like
+// installing Python packages, run on top of different layers, such as
+// different weights, so they aren't shared.
+func suggestLayerOrder(images []ImageLayers) []string {
+	suggestions := []string{}
+	for i := 0; i < len(images); i++ {
+		for j := i + 1; j < len(images); j++ {
+			a, b := images[i], images[j]
+			common := commonPrefix(a.Layers, b.Layers)
+			if common == 0 {
+				// They're on different base images, which is suggested
+				// separately
+				continue
+			}
+			var bestA, bestB int
+			var bestSize int64
+			for x := common; x < len(a.Layers); x++ {
+				for y := common; y < len(b.Layers); y++ {
+					la, lb := a.Layers[x], b.Layers[y]
+					if la.Digest == lb.Digest || la.Size < minSuggestedLayerSize || !similarSize(la.Size, lb.Size) {
+						continue
+					}
+					if la.Size > bestSize {
+						bestA, bestB, bestSize = x, y, la.Size
+					}
+				}
+			}
+			if bestSize == 0 {
+				continue
+			}
+			suggestions = append(suggestions, fmt.Sprintf("%s and %s stop sharing layers after layer %d, but both have a %s layer after that (layers %d and %d), which is probably the same step run on top of different layers. Move what's different between them, like weights, after the steps they have in common, so those layers are shared.", a.Image, b.Image, common, units.HumanSize(float64(bestSize)), bestA+1, bestB+1))
+		}
+	}
+	return suggestions
+}
+
+// suggestWeightLayers points out large layers that are only in one image,
+// which are often weights that other models use too.
+func suggestWeightLayers(images []ImageLayers, imageCount map[string]int) []string {
+	if len(images) < 2 {
+		return nil
+	}
+	suggestions := []string{}
+	for _, image := range images {
+		for i, layer := range image.Layers {
+			if layer.Size < largeUniqueLayerSize || imageCount[layer.Digest] > 1 {
+				continue
+			}
+			suggestions = append(suggestions, fmt.Sprintf("Layer %d of %s is %s and isn't in any of the other images. If it has weights that other models use too, give those files a layer of their own with build.large_file_threshold in cog.yaml, so the layer is the same in each image.", i+1, image.Image, units.HumanSize(float64(layer.Size))))
+		}
+	}
+	return suggestions
+}
+
+// layerSet returns the digests of layers, each once.
+func layerSet(layers []docker.Descriptor) map[string]bool {
+	set := map[string]bool{}
+	for _, layer := range layers {
+		set[layer.Digest] = true
+	}
+	return set
+}
+
+// commonPrefix returns how many layers a and b start with that are the same.
+func commonPrefix(a, b []docker.Descriptor) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n].Digest == b[n].Digest {
+		n++
+	}
+	return n
+}
+
+func similarSize(a, b int64) bool {
+	return math.Abs(float64(a-b)) <= similarLayerSizeRatio*math.Max(float64(a), float64(b))
+}
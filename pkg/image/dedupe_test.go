@@ -0,0 +1,42 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/docker"
+)
+
+func layer(digest string, size int64) docker.Descriptor {
+	return docker.Descriptor{Digest: digest, Size: size}
+}
+
+func TestDedupeReport(t *testing.T) {
+	report := NewDedupeReport([]ImageLayers{
+		{Image: "a", Layers: []docker.Descriptor{layer("base", 100), layer("weights-a", 2e9), layer("pip-a", 5e8)}},
+		{Image: "b", Layers: []docker.Descriptor{layer("base", 100), layer("weights-b", 3e8), layer("pip-b", 501e6)}},
+	})
+
+	require.Equal(t, []ImageStorage{
+		{Image: "a", Size: 2.5e9 + 100, SharedSize: 100, UniqueSize: 2.5e9},
+		{Image: "b", Size: 801e6 + 100, SharedSize: 100, UniqueSize: 801e6},
+	}, report.Images)
+	require.Equal(t, int64(3301e6+200), report.TotalSize)
+	require.Equal(t, int64(3301e6+100), report.StoredSize)
+
+	require.Len(t, report.Suggestions, 2)
+	// pip was installed on top of the weights, so it isn't shared
+	require.Contains(t, report.Suggestions[0], "a and b stop sharing layers after layer 1, but both have a 500MB layer after that (layers 3 and 3)")
+	require.Contains(t, report.Suggestions[1], "Layer 2 of a is 2GB")
+}
+
+func TestDedupeReportDifferentBases(t *testing.T) {
+	report := NewDedupeReport([]ImageLayers{
+		{Image: "a", Layers: []docker.Descriptor{layer("ubuntu", 100), layer("weights", 5e8)}},
+		{Image: "b", Layers: []docker.Descriptor{layer("debian", 100), layer("weights", 5e8)}},
+	})
+	require.Equal(t, int64(5e8+200), report.StoredSize)
+	require.Equal(t, int64(5e8), report.Images[0].SharedSize)
+	require.Equal(t, []string{"The images are built on 2 different base images. If they're built on the same one, with the same python_version, cuda, and base_image in cog.yaml, the registry only stores it once."}, report.Suggestions)
+}
@@ -0,0 +1,98 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// DownloadToProject downloads the files in downloads that go in the project
+// directory into dir, for running the model from it. The image it runs in
+// can't have them, because dir is mounted over /src. Files that are there
+// already aren't downloaded again, unless they don't match their checksum.
+func DownloadToProject(downloads []config.Download, dir string) error {
+	for _, download := range downloads {
+		p := download.ProjectPath()
+		if p == "" {
+			continue
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(p))
+		ok, err := downloaded(dest, download.SHA256)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		console.Infof("Downloading %s to %s...", download.URL, p)
+		if err := downloadFile(download, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloaded returns whether the file at dest has been downloaded, and
+// matches sha256sum if it's set.
+func downloaded(dest string, sha256sum string) (bool, error) {
+	f, err := os.Open(dest)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if sha256sum == "" {
+		return true, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == sha256sum, nil
+}
+
+// downloadFile downloads a file to dest. It's downloaded to a temporary file
+// next to it first, so a download that fails part way through isn't left
+// there.
+func downloadFile(download config.Download, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	resp, err := http.Get(download.URL)
+	if err != nil {
+		return fmt.Errorf("Failed to download %s: %w", download.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to download %s: status %d", download.URL, resp.StatusCode)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		return fmt.Errorf("Failed to download %s: %w", download.URL, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); download.SHA256 != "" && sum != download.SHA256 {
+		return fmt.Errorf("The checksum of %s is %s, but cog.yaml says it should be %s", download.URL, sum, download.SHA256)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
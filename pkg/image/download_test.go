@@ -0,0 +1,50 @@
+package image
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestDownloadToProject(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("foo"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	downloads := []config.Download{
+		{URL: server.URL + "/model.safetensors", Dest: "weights/model.safetensors", SHA256: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+		{URL: server.URL + "/tokenizer.json", Dest: "/src/tokenizer/tokenizer.json"},
+		// Not in the project directory, so it's downloaded into the image
+		{URL: server.URL + "/vae.bin", Dest: "/models/vae.bin"},
+	}
+
+	require.NoError(t, DownloadToProject(downloads, dir))
+	contents, err := os.ReadFile(filepath.Join(dir, "weights", "model.safetensors"))
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(contents))
+	require.FileExists(t, filepath.Join(dir, "tokenizer", "tokenizer.json"))
+	require.Equal(t, 2, requests)
+
+	// They're only downloaded again if they don't match their checksums
+	require.NoError(t, DownloadToProject(downloads, dir))
+	require.Equal(t, 2, requests)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "weights", "model.safetensors"), []byte("bar"), 0o644))
+	require.NoError(t, DownloadToProject(downloads, dir))
+	require.Equal(t, 3, requests)
+
+	downloads[0].SHA256 = "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+	require.NoError(t, os.Remove(filepath.Join(dir, "weights", "model.safetensors")))
+	require.ErrorContains(t, DownloadToProject(downloads, dir), "checksum")
+	entries, err := os.ReadDir(filepath.Join(dir, "weights"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,35 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// Explain returns what building the model with buildOptions will do,
+// without building it. Unlike Build, it doesn't check build.pip_index_url
+// can be reached.
+func Explain(cfg *config.Config, dir string, groupFile bool, buildOptions docker.BuildOptions) (*dockerfile.Plan, error) {
+	generator, err := NewGenerator(cfg, dir, groupFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Dockerfile generator: %w", err)
+	}
+	defer func() {
+		if err := generator.Cleanup(); err != nil {
+			console.Warnf("Error cleaning up Dockerfile generator: %s", err)
+		}
+	}()
+	generator.Strict = buildOptions.Strict
+	generator.GPUBuilder = cfg.Build.RunRequiresGPU() && docker.BuilderHasGPU(buildOptions.Builder)
+	generator.Offline = buildOptions.Offline
+	generator.PythonTarball = buildOptions.PythonTarball
+	generator.Wheelhouse = buildOptions.Wheelhouse
+	generator.PipIndexURL = cfg.Build.PipIndex()
+	if err := SetPlatform(generator, buildOptions.Platform); err != nil {
+		return nil, err
+	}
+	return generator.Explain()
+}
@@ -0,0 +1,140 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/files"
+	"github.com/replicate/cog/pkg/util/slices"
+)
+
+// exportedRequirementsHeader is at the top of the requirements exported by
+// ExportPythonRequirements
+const exportedRequirementsHeader = `# Every Python package the model installs, pinned with their hashes, and the
+# indexes they're installed from. It's exported by 'cog export requirements'.
+# Install them with: pip install --require-hashes -r <this file>
+`
+
+// ExportPythonRequirements returns a requirements file with the model's
+// Python packages, and every package they depend on, pinned to the versions
+// the image installs with their hashes, and the package indexes they're
+// installed from. It's config.PythonLockFilename if it's up to date, or
+// they're resolved the same way as with 'cog lock' otherwise.
+func ExportPythonRequirements(generator *dockerfile.Generator, lock *config.Lock, dir string) ([]byte, error) {
+	cfg := generator.Config
+	if cfg.Build.Poetry {
+		return nil, fmt.Errorf("Python packages are installed from %s. Export them with 'poetry export' instead", config.PoetryLockFilename)
+	}
+	requirements, err := cfg.PythonRequirementsForArch(generator.GOOS, generator.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(requirements) == "" {
+		return nil, fmt.Errorf("cog.yaml doesn't have any Python packages to export")
+	}
+
+	var resolved []byte
+	lockPath := filepath.Join(dir, config.PythonLockFilename)
+	exists, err := files.Exists(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists && lock.PythonRequirements == config.PythonRequirementsHash(requirements) {
+		contents, err := os.ReadFile(lockPath)
+		if err != nil {
+			return nil, err
+		}
+		resolved = []byte(strings.TrimPrefix(string(contents), pythonLockHeader))
+	} else {
+		if resolved, err = resolvePythonRequirements(generator, dir, requirements); err != nil {
+			return nil, err
+		}
+	}
+
+	lines := append([]string{strings.TrimSuffix(exportedRequirementsHeader, "\n")}, pipIndexLines(cfg.Build, requirements)...)
+	return []byte(strings.Join(lines, "\n") + "\n" + string(resolved)), nil
+}
+
+// pipIndexLines returns the options for a requirements file that install
+// packages from the same indexes as the model: the ones in cog.yaml, the
+// ones in requirements, and the wheelhouse, which replaces them.
+func pipIndexLines(build *config.Build, requirements string) []string {
+	if build.Wheelhouse != "" {
+		return []string{"--no-index", "--find-links " + build.Wheelhouse}
+	}
+	lines := []string{"--index-url " + build.PipIndex()}
+	for _, url := range build.PipExtraIndexURLs {
+		lines = append(lines, "--extra-index-url "+url)
+	}
+	for _, line := range strings.Split(requirements, "\n") {
+		line = strings.TrimSpace(line)
+		for _, option := range []string{"--extra-index-url", "--find-links", "-f ", "--trusted-host"} {
+			if strings.HasPrefix(line, option) && !slices.ContainsString(lines, line) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+// ExportWheelhouse downloads wheels of everything the model's Python
+// packages are installed from, and Cog's own dependencies, to output, so
+// it can be used as build.wheelhouse, or to install them without the
+// internet somewhere else. Packages without wheels are built, in the
+// Python image for the model's version of Python, so they're for Linux on
+// the architecture Docker runs.
+func ExportWheelhouse(generator *dockerfile.Generator, lock *config.Lock, dir string, output string) error {
+	cfg := generator.Config
+	if cfg.Build.Wheelhouse != "" {
+		return fmt.Errorf("Python packages are already installed from the wheelhouse in %s", cfg.Build.Wheelhouse)
+	}
+	requirements, err := ExportPythonRequirements(generator, lock, dir)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := projectTempDir(dir, "wheelhouse")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	cogRequirements := strings.Join(append(pipIndexLines(cfg.Build, ""), "/export/"+dockerfile.CogWheelFilename), "\n") + "\n"
+	for name, contents := range map[string][]byte{
+		"requirements.txt":          requirements,
+		"cog.txt":                   []byte(cogRequirements),
+		dockerfile.CogWheelFilename: dockerfile.CogWheel(),
+	} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), contents, 0o644); err != nil {
+			return err
+		}
+	}
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(output, 0o755); err != nil {
+		return err
+	}
+
+	console.Infof("Downloading Python packages for Python %s...", cfg.Build.PythonVersion)
+	err = docker.RunWithIO(docker.RunOptions{
+		Image: config.MirrorImage("python:"+cfg.Build.PythonVersion, generator.RegistryMirrors),
+		// Cog's dependencies are separate, because they aren't pinned
+		// with hashes
+		Args: []string{"sh", "-c", "pip wheel --quiet --require-hashes --wheel-dir /wheels -r /export/requirements.txt && pip wheel --quiet --wheel-dir /wheels -r /export/cog.txt"},
+		Volumes: []docker.Volume{
+			{Source: tmpDir, Destination: "/export", ReadOnly: true},
+			{Source: output, Destination: "/wheels"},
+		},
+	}, nil, os.Stderr, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("Failed to download Python packages: %w", err)
+	}
+	return nil
+}
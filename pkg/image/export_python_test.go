@@ -0,0 +1,53 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/dockerfile"
+)
+
+func TestPipIndexLines(t *testing.T) {
+	build := &config.Build{PipIndexURL: "https://pypi.example.com/simple", PipExtraIndexURLs: []string{"https://extra.example.com/simple"}}
+	require.Equal(t, []string{
+		"--index-url https://pypi.example.com/simple",
+		"--extra-index-url https://extra.example.com/simple",
+		"--extra-index-url https://download.pytorch.org/whl/cu121",
+	}, pipIndexLines(build, "--extra-index-url https://extra.example.com/simple\n--extra-index-url https://download.pytorch.org/whl/cu121\ntorch==2.3.1\n"))
+
+	build = &config.Build{Wheelhouse: "vendor/wheels"}
+	require.Equal(t, []string{"--no-index", "--find-links vendor/wheels"}, pipIndexLines(build, "torch==2.3.1\n"))
+}
+
+func TestExportPythonRequirementsFromLock(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+  python_packages:
+    - requests==2.32.3
+`))
+	require.NoError(t, err)
+	require.NoError(t, cfg.ValidateAndComplete(dir))
+	generator, err := dockerfile.NewGenerator(cfg, dir, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, generator.Cleanup()) })
+
+	requirements, err := cfg.PythonRequirementsForArch(generator.GOOS, generator.GOARCH)
+	require.NoError(t, err)
+	lock, err := config.LoadLock(dir)
+	require.NoError(t, err)
+	lock.PythonRequirements = config.PythonRequirementsHash(requirements)
+	resolved := "requests==2.32.3 \\\n    --hash=sha256:abc123\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, config.PythonLockFilename), []byte(pythonLockHeader+resolved), 0o644))
+
+	// The lock file is up to date, so it's exported without resolving the
+	// packages again
+	exported, err := ExportPythonRequirements(generator, lock, dir)
+	require.NoError(t, err)
+	require.Equal(t, exportedRequirementsHeader+"--index-url "+config.DefaultPipIndexURL+"\n"+resolved, string(exported))
+}
@@ -0,0 +1,126 @@
+package image
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// GitTokenEnv is the environment variable with a token for cloning private
+// repositories over HTTPS, like a GitHub personal access token
+const GitTokenEnv = "COG_GIT_TOKEN"
+
+// GitSource is a git repository a model is built from, like
+// https://github.com/org/model.git#v1.2:models/sd, which is the models/sd
+// directory of the v1.2 tag or branch.
+type GitSource struct {
+	URL string
+	// Ref is a branch, tag, or commit, or "" for the default branch
+	Ref string
+	// Dir is the directory in the repository the model is in, or "" for
+	// its root
+	Dir string
+}
+
+// IsGitSource is whether a build's argument is a git repository, rather
+// than something else, like an image name.
+func IsGitSource(arg string) bool {
+	for _, prefix := range []string{"https://", "http://", "ssh://", "git://", "git@", "file://"} {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseGitSource parses a git repository in the same format as `docker
+// build`'s git contexts: a URL, optionally followed by #ref, or #ref:dir.
+func ParseGitSource(arg string) (*GitSource, error) {
+	if !IsGitSource(arg) {
+		return nil, fmt.Errorf("%s isn't a git repository. It must be an https://, ssh://, or git@ URL, like https://github.com/org/model.git#main", arg)
+	}
+	source := &GitSource{URL: arg}
+	if i := strings.Index(arg, "#"); i >= 0 {
+		source.URL = arg[:i]
+		source.Ref, source.Dir, _ = strings.Cut(arg[i+1:], ":")
+	}
+	source.Dir = strings.Trim(source.Dir, "/")
+	if source.Dir != "" && (path.IsAbs(source.Dir) || strings.HasPrefix(path.Clean(source.Dir), "..")) {
+		return nil, fmt.Errorf("The directory in %s must be in the repository", arg)
+	}
+	return source, nil
+}
+
+// Name returns the name of the repository, like model for
+// https://github.com/org/model.git, or the directory in it the model is in.
+func (s *GitSource) Name() string {
+	if s.Dir != "" {
+		return path.Base(s.Dir)
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(s.URL, "/"), ".git")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// Clone makes a shallow clone of the repository at Ref in a directory in
+// parentDir, and returns the directory the model is in. Private
+// repositories are cloned with git's credential helpers or SSH agent, or
+// over HTTPS with the token in COG_GIT_TOKEN.
+func (s *GitSource) Clone(parentDir string) (string, error) {
+	dir := filepath.Join(parentDir, s.Name())
+	ref := s.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	console.Infof("Cloning %s at %s...", s.URL, ref)
+
+	// Fetching the ref, rather than cloning a branch, means it can be a
+	// commit too
+	for _, args := range [][]string{
+		{"init", "--quiet", dir},
+		{"-C", dir, "remote", "add", "origin", s.URL},
+		{"-C", dir, "fetch", "--quiet", "--depth", "1", "origin", ref},
+		{"-C", dir, "checkout", "--quiet", "FETCH_HEAD"},
+		{"-C", dir, "submodule", "update", "--quiet", "--init", "--recursive", "--depth", "1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), s.gitEnv()...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("Failed to clone %s at %s: %s", s.URL, ref, strings.TrimSpace(string(out)))
+		}
+	}
+
+	modelDir := filepath.Join(dir, filepath.FromSlash(s.Dir))
+	if info, err := os.Stat(modelDir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s isn't a directory in %s at %s", s.Dir, s.URL, ref)
+	}
+	return modelDir, nil
+}
+
+// gitEnv returns the environment git is run with. Prompts for credentials
+// are turned off, so a build that can't clone fails instead of waiting for
+// input. The token is passed with git's GIT_CONFIG_* variables, so it isn't
+// in the command line, where other users can see it.
+func (s *GitSource) gitEnv() []string {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	token := os.Getenv(GitTokenEnv)
+	u, err := url.Parse(s.URL)
+	if token == "" || err != nil || u.Scheme != "https" {
+		return env
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+	return append(env,
+		"GIT_CONFIG_COUNT=1",
+		fmt.Sprintf("GIT_CONFIG_KEY_0=http.%s://%s/.extraHeader", u.Scheme, u.Host),
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+	)
+}
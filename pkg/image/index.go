@@ -0,0 +1,92 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/global"
+)
+
+// IndexEntry is a pushed image to include in an image index.
+type IndexEntry struct {
+	Image  string
+	Config *config.Config
+}
+
+// PushImageIndex pushes an image index as imageName that references every
+// entry. Each entry is annotated with the hardware and software it was built
+// for, so clients can pick the right one. Clients pull by platform, so the
+// entries must be for different platforms.
+func PushImageIndex(imageName string, entries []IndexEntry) error {
+	descriptors, err := indexDescriptors(entries, describeImage)
+	if err != nil {
+		return err
+	}
+	if err := docker.CreateImageIndex(imageName, descriptors); err != nil {
+		return fmt.Errorf("Failed to push image index %s: %w", imageName, err)
+	}
+	return nil
+}
+
+// indexDescriptors returns the descriptors of entries in an image index,
+// with the descriptor of each image from describe.
+func indexDescriptors(entries []IndexEntry, describe func(image string) (*docker.Descriptor, error)) ([]*docker.Descriptor, error) {
+	descriptors := []*docker.Descriptor{}
+	platforms := map[docker.Platform]string{}
+	for _, entry := range entries {
+		descriptor, err := describe(entry.Image)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := platforms[*descriptor.Platform]; ok {
+			return nil, fmt.Errorf("%s and %s are both built for %s, so they can't be in the same image index", other, entry.Image, descriptor.Platform)
+		}
+		platforms[*descriptor.Platform] = entry.Image
+		descriptor.Annotations = IndexAnnotations(entry.Config)
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors, nil
+}
+
+// describeImage returns the descriptor of the manifest of image, which must
+// already be pushed, with the platform it's built for.
+func describeImage(image string) (*docker.Descriptor, error) {
+	descriptor, err := docker.ManifestDescriptor(image)
+	if err != nil {
+		return nil, err
+	}
+	inspect, err := docker.ImageInspect(image)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to inspect %s: %w", image, err)
+	}
+	descriptor.Platform = &docker.Platform{
+		OS:           inspect.Os,
+		Architecture: inspect.Architecture,
+		Variant:      inspect.Variant,
+	}
+	return descriptor, nil
+}
+
+// IndexAnnotations returns the annotations describing an image built from
+// cfg in an image index, with the labels in cog.yaml.
+func IndexAnnotations(cfg *config.Config) map[string]string {
+	annotations := map[string]string{}
+	// Registry policies can check annotations without pulling each image's
+	// config for its labels
+	for key, value := range cfg.Labels {
+		annotations[key] = value
+	}
+	annotations[global.LabelNamespace+"python_version"] = cfg.Build.PythonVersion
+	if cfg.Build.IsAMD() {
+		annotations[global.LabelNamespace+"gpu"] = "true"
+		annotations[global.LabelNamespace+"rocm"] = cfg.Build.ROCm
+	} else if cfg.Build.GPU {
+		annotations[global.LabelNamespace+"gpu"] = "true"
+		annotations[global.LabelNamespace+"cuda"] = cfg.Build.CUDA
+		annotations[global.LabelNamespace+"cudnn"] = cfg.Build.CuDNN
+	} else {
+		annotations[global.LabelNamespace+"gpu"] = "false"
+	}
+	return annotations
+}
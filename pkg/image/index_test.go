@@ -0,0 +1,67 @@
+package image
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+)
+
+func TestIndexAnnotations(t *testing.T) {
+	cpu := &config.Config{Build: &config.Build{PythonVersion: "3.11"}, Labels: map[string]string{"org.example.team": "vision"}}
+	require.Equal(t, map[string]string{
+		"org.example.team":       "vision",
+		"run.cog.python_version": "3.11",
+		"run.cog.gpu":            "false",
+	}, IndexAnnotations(cpu))
+
+	gpu := &config.Config{Build: &config.Build{PythonVersion: "3.10", GPU: true, CUDA: "11.8", CuDNN: "8"}}
+	require.Equal(t, map[string]string{
+		"run.cog.python_version": "3.10",
+		"run.cog.gpu":            "true",
+		"run.cog.cuda":           "11.8",
+		"run.cog.cudnn":          "8",
+	}, IndexAnnotations(gpu))
+}
+
+func TestIndexDescriptors(t *testing.T) {
+	cfg := &config.Config{Build: &config.Build{PythonVersion: "3.11"}}
+	platforms := map[string]docker.Platform{
+		"r8.im/user/model:linux-amd64": {OS: "linux", Architecture: "amd64"},
+		"r8.im/user/model:linux-arm64": {OS: "linux", Architecture: "arm64", Variant: "v8"},
+		"r8.im/user/model:cpu":         {OS: "linux", Architecture: "amd64"},
+	}
+	describe := func(image string) (*docker.Descriptor, error) {
+		platform, ok := platforms[image]
+		if !ok {
+			return nil, fmt.Errorf("%s isn't pushed", image)
+		}
+		return &docker.Descriptor{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: "sha256:" + image, Platform: &platform}, nil
+	}
+
+	descriptors, err := indexDescriptors([]IndexEntry{
+		{Image: "r8.im/user/model:linux-amd64", Config: cfg},
+		{Image: "r8.im/user/model:linux-arm64", Config: cfg},
+	}, describe)
+	require.NoError(t, err)
+	require.Len(t, descriptors, 2)
+	require.Equal(t, "sha256:r8.im/user/model:linux-amd64", descriptors[0].Digest)
+	require.Equal(t, "arm64", descriptors[1].Platform.Architecture)
+	for _, descriptor := range descriptors {
+		require.Equal(t, IndexAnnotations(cfg), descriptor.Annotations)
+	}
+
+	// Clients pull by platform, so images for the same one can't share an
+	// index
+	_, err = indexDescriptors([]IndexEntry{
+		{Image: "r8.im/user/model:linux-amd64", Config: cfg},
+		{Image: "r8.im/user/model:cpu", Config: cfg},
+	}, describe)
+	require.ErrorContains(t, err, "r8.im/user/model:linux-amd64 and r8.im/user/model:cpu are both built for linux/amd64")
+
+	_, err = indexDescriptors([]IndexEntry{{Image: "r8.im/user/model:gpu", Config: cfg}}, describe)
+	require.ErrorContains(t, err, "isn't pushed")
+}
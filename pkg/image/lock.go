@@ -0,0 +1,143 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+// LockBaseImage records the digest of the generator's base image in lock if
+// it isn't already there, or always if update is set. It returns whether
+// lock was changed.
+func LockBaseImage(generator *dockerfile.Generator, lock *config.Lock, update bool) (bool, error) {
+	baseImage, err := generator.BaseImage()
+	if err != nil {
+		return false, err
+	}
+	current, locked := lock.BaseImages[baseImage]
+	if locked && !update {
+		return false, nil
+	}
+
+	digest, err := docker.ImageDigest(config.MirrorImage(baseImage, generator.RegistryMirrors))
+	if err != nil {
+		return false, err
+	}
+	if digest == current {
+		return false, nil
+	}
+	if locked {
+		console.Infof("Updated base image %s from %s to %s in %s", baseImage, current, digest, config.LockFilename)
+	} else {
+		console.Infof("Pinned base image %s to %s in %s", baseImage, digest, config.LockFilename)
+	}
+	lock.BaseImages[baseImage] = digest
+	return true, nil
+}
+
+// pythonLockHeader is at the top of config.PythonLockFilename
+const pythonLockHeader = `# Every Python package the model installs, pinned with their hashes. It's
+# generated by 'cog lock' from the Python packages in cog.yaml, so edit
+# those and run 'cog lock' again rather than editing this.
+`
+
+// LockPythonRequirements resolves the model's Python requirements, and every
+// package they depend on, to pinned versions with hashes, and writes them
+// to config.PythonLockFilename in dir. It's resolved with pip-tools, in the
+// Python image for the model's version of Python, so it's right for Linux.
+// Nothing is resolved if the lock file was resolved from the same
+// requirements, unless update is set. It returns whether lock was changed.
+func LockPythonRequirements(generator *dockerfile.Generator, lock *config.Lock, dir string, update bool) (bool, error) {
+	cfg := generator.Config
+	requirements, err := cfg.PythonRequirementsForArch(generator.GOOS, generator.GOARCH)
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(requirements) == "" {
+		return false, nil
+	}
+	hash := config.PythonRequirementsHash(requirements)
+	lockPath := filepath.Join(dir, config.PythonLockFilename)
+	exists, err := files.Exists(lockPath)
+	if err != nil {
+		return false, err
+	}
+	if exists && lock.PythonRequirements == hash && !update {
+		return false, nil
+	}
+
+	resolved, err := resolvePythonRequirements(generator, dir, requirements)
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(lockPath, append([]byte(pythonLockHeader), resolved...), 0o644); err != nil {
+		return false, fmt.Errorf("Failed to write %s: %w", lockPath, err)
+	}
+	console.Infof("Pinned Python packages in %s", config.PythonLockFilename)
+	lock.PythonRequirements = hash
+	return true, nil
+}
+
+// resolvePythonRequirements resolves requirements, and every package they
+// depend on, to pinned versions with hashes with pip-tools, in the Python
+// image for the model's version of Python, so it's right for Linux.
+func resolvePythonRequirements(generator *dockerfile.Generator, dir string, requirements string) ([]byte, error) {
+	cfg := generator.Config
+	console.Infof("Resolving Python packages for Python %s...", cfg.Build.PythonVersion)
+	tmpDir, err := projectTempDir(dir, "lock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.WriteFile(filepath.Join(tmpDir, "requirements.in"), []byte(requirements), 0o644); err != nil {
+		return nil, err
+	}
+
+	volumes := []docker.Volume{{Source: tmpDir, Destination: "/lock"}}
+	if wheelhouse := cfg.Build.Wheelhouse; wheelhouse != "" {
+		volumes = append(volumes, docker.Volume{Source: filepath.Join(dir, wheelhouse), Destination: "/wheels", ReadOnly: true})
+	}
+	err = docker.RunWithIO(docker.RunOptions{
+		Image:   config.MirrorImage("python:"+cfg.Build.PythonVersion, generator.RegistryMirrors),
+		Args:    []string{"sh", "-c", pipCompileCommand(cfg.Build)},
+		Volumes: volumes,
+	}, nil, os.Stderr, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve Python packages: %w", err)
+	}
+	return os.ReadFile(filepath.Join(tmpDir, config.PythonLockFilename))
+}
+
+// projectTempDir makes a temporary directory in the project directory dir,
+// so Docker can mount it wherever it runs.
+func projectTempDir(dir string, pattern string) (string, error) {
+	rootTmp := filepath.Join(dir, ".cog", "tmp")
+	if err := os.MkdirAll(rootTmp, 0o755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(rootTmp, pattern)
+}
+
+// pipCompileCommand returns the command that resolves /lock/requirements.in
+// to /lock/requirements.lock, from the same package index, or wheelhouse,
+// the model is built from. The index isn't written to the lock file, because
+// the build passes its own. Packages like setuptools are pinned too, because
+// --require-hashes needs everything to be.
+func pipCompileCommand(build *config.Build) string {
+	args := []string{"-i", build.PipIndex()}
+	for _, url := range build.PipExtraIndexURLs {
+		args = append(args, "--extra-index-url", url)
+	}
+	if build.Wheelhouse != "" {
+		args = []string{"--no-index", "--find-links", "/wheels"}
+	}
+	index := strings.Join(args, " ")
+	return fmt.Sprintf("pip install --quiet %s pip-tools && pip-compile --quiet --generate-hashes --allow-unsafe --strip-extras --no-header --no-emit-index-url --no-emit-find-links %s --output-file /lock/%s /lock/requirements.in", index, index, config.PythonLockFilename)
+}
@@ -0,0 +1,40 @@
+package image
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+func TestPipCompileCommand(t *testing.T) {
+	build := &config.Build{PipExtraIndexURLs: []string{"https://download.pytorch.org/whl/cu118"}}
+	require.Equal(t, "pip install --quiet -i "+config.DefaultPipIndexURL+" --extra-index-url https://download.pytorch.org/whl/cu118 pip-tools && pip-compile --quiet --generate-hashes --allow-unsafe --strip-extras --no-header --no-emit-index-url --no-emit-find-links -i "+config.DefaultPipIndexURL+" --extra-index-url https://download.pytorch.org/whl/cu118 --output-file /lock/requirements.lock /lock/requirements.in", pipCompileCommand(build))
+
+	// Packages only come from the wheelhouse, if there is one
+	build = &config.Build{Wheelhouse: "wheels"}
+	require.Equal(t, "pip install --quiet --no-index --find-links /wheels pip-tools && pip-compile --quiet --generate-hashes --allow-unsafe --strip-extras --no-header --no-emit-index-url --no-emit-find-links --no-index --find-links /wheels --output-file /lock/requirements.lock /lock/requirements.in", pipCompileCommand(build))
+}
+
+func TestNewGeneratorOnlyReadsLock(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", t.TempDir())
+	cfg, err := config.FromYAML([]byte(`
+build:
+  python_version: "3.11"
+`))
+	require.NoError(t, err)
+	require.NoError(t, cfg.ValidateAndComplete(dir))
+
+	// Commands that don't build, like cog explain, don't pin the base image
+	generator, err := NewGenerator(cfg, dir, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, generator.Cleanup()) })
+	require.Empty(t, generator.Lock.BaseImages)
+	exists, err := files.Exists(filepath.Join(dir, config.LockFilename))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
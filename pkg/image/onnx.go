@@ -0,0 +1,88 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/util/files"
+)
+
+// ONNXMetadata describes an exported ONNX model. It is written by
+// python/cog/command/export_onnx.py after the model has been validated.
+type ONNXMetadata struct {
+	IRVersion          int            `json:"ir_version"`
+	Opsets             map[string]int `json:"opsets"`
+	ProducerName       string         `json:"producer_name"`
+	ProducerVersion    string         `json:"producer_version"`
+	ONNXVersion        string         `json:"onnx_version"`
+	ONNXRuntimeVersion string         `json:"onnxruntime_version"`
+}
+
+// ExportONNX runs the predictor's export_onnx() hook inside imageName and
+// writes the resulting model to outputPath, returning its metadata.
+//
+// The image is expected to be a base image, so projectDir is mounted at /src.
+func ExportONNX(imageName string, projectDir string, enableGPU bool, env []string, outputPath string) (*ONNXMetadata, error) {
+	exportDir, err := os.MkdirTemp("", "cog-export-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(exportDir)
+
+	gpus := ""
+	if enableGPU {
+		gpus = "all"
+	}
+	err = docker.RunWithIO(docker.RunOptions{
+		Image: imageName,
+		Args:  []string{"python", "-m", "cog.command.export_onnx", "/export/model.onnx"},
+		Env:   env,
+		GPUs:  gpus,
+		Volumes: []docker.Volume{
+			{Source: projectDir, Destination: "/src"},
+			{Source: exportDir, Destination: "/export"},
+		},
+		Workdir: "/src",
+	}, nil, os.Stderr, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to export model to ONNX: %w", err)
+	}
+
+	return readONNXExport(exportDir, outputPath)
+}
+
+// readONNXExport reads the model export_onnx.py exported to exportDir, with
+// its metadata, and moves them to outputPath.
+func readONNXExport(exportDir string, outputPath string) (*ONNXMetadata, error) {
+	metadataJSON, err := os.ReadFile(filepath.Join(exportDir, "model.onnx.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read ONNX metadata: %w", err)
+	}
+	metadata := new(ONNXMetadata)
+	if err := json.Unmarshal(metadataJSON, metadata); err != nil {
+		return nil, fmt.Errorf("Failed to parse ONNX metadata: %w", err)
+	}
+
+	if err := moveFile(filepath.Join(exportDir, "model.onnx"), outputPath); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(outputPath+".json", metadataJSON, 0o644); err != nil {
+		return nil, fmt.Errorf("Failed to write ONNX metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// moveFile renames src to dest, falling back to copying when they are on
+// different filesystems (the export directory is usually in /tmp).
+func moveFile(src string, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	if err := files.CopyFile(src, dest); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,58 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadONNXExport(t *testing.T) {
+	exportDir := t.TempDir()
+	metadataJSON := `{
+  "ir_version": 8,
+  "opsets": {"ai.onnx": 17, "com.microsoft": 1},
+  "producer_name": "pytorch",
+  "producer_version": "2.3.1",
+  "onnx_version": "1.16.0",
+  "onnxruntime_version": "1.18.0"
+}`
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, "model.onnx"), []byte("model"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, "model.onnx.json"), []byte(metadataJSON), 0o644))
+	outputPath := filepath.Join(t.TempDir(), "resnet.onnx")
+
+	metadata, err := readONNXExport(exportDir, outputPath)
+	require.NoError(t, err)
+	require.Equal(t, &ONNXMetadata{
+		IRVersion:          8,
+		Opsets:             map[string]int{"ai.onnx": 17, "com.microsoft": 1},
+		ProducerName:       "pytorch",
+		ProducerVersion:    "2.3.1",
+		ONNXVersion:        "1.16.0",
+		ONNXRuntimeVersion: "1.18.0",
+	}, metadata)
+
+	// The model is moved next to its metadata
+	model, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	require.Equal(t, "model", string(model))
+	written, err := os.ReadFile(outputPath + ".json")
+	require.NoError(t, err)
+	require.JSONEq(t, metadataJSON, string(written))
+	require.NoFileExists(t, filepath.Join(exportDir, "model.onnx"))
+}
+
+func TestReadONNXExportFailure(t *testing.T) {
+	// The export failed before the metadata was written
+	exportDir := t.TempDir()
+	outputPath := filepath.Join(t.TempDir(), "resnet.onnx")
+	_, err := readONNXExport(exportDir, outputPath)
+	require.ErrorContains(t, err, "Failed to read ONNX metadata")
+	require.NoFileExists(t, outputPath)
+
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, "model.onnx.json"), []byte("{"), 0o644))
+	_, err = readONNXExport(exportDir, outputPath)
+	require.ErrorContains(t, err, "Failed to parse ONNX metadata")
+	require.NoFileExists(t, outputPath)
+}
@@ -0,0 +1,54 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// pipIndexTimeout is how long build.pip_index_url has to respond before
+// build.pip_fallback_index_url is used instead
+const pipIndexTimeout = 5 * time.Second
+
+// choosePipIndex returns the Python package index to build with. That's
+// build.pip_index_url, unless it can't be reached and there's a
+// build.pip_fallback_index_url, like when a caching proxy on an internal
+// network is used from outside it. The choice is printed, and recorded in
+// the image's labels by Build.
+func choosePipIndex(build *config.Build) string {
+	index := build.PipIndex()
+	if build.PipFallbackIndexURL == "" {
+		return index
+	}
+	if err := checkPipIndex(index); err != nil {
+		console.Warnf("Can't reach the Python package index %s, so installing packages from %s instead: %s", index, build.PipFallbackIndexURL, err)
+		return build.PipFallbackIndexURL
+	}
+	console.Infof("Installing Python packages from %s", index)
+	return index
+}
+
+// checkPipIndex returns an error if the index at url doesn't respond. Any
+// response that isn't a server error means it's up, because proxies don't
+// all support HEAD requests to an index's root.
+func checkPipIndex(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pipIndexTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package image
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestChoosePipIndex(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	build := &config.Build{PipIndexURL: proxy.URL + "/simple", PipFallbackIndexURL: "https://pypi.org/simple"}
+	require.Equal(t, proxy.URL+"/simple", choosePipIndex(build))
+
+	// Without a fallback, the index isn't checked
+	require.Equal(t, config.DefaultPipIndexURL, choosePipIndex(&config.Build{}))
+
+	proxy.Close()
+	require.Equal(t, "https://pypi.org/simple", choosePipIndex(build))
+}
+
+func TestCheckPipIndexServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	require.ErrorContains(t, checkPipIndex(server.URL), "status 502")
+}
@@ -0,0 +1,32 @@
+package image
+
+import (
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/policy"
+)
+
+// checkBuildPolicy checks a build of cfg against the policy, if there is
+// one, before anything is built.
+func checkBuildPolicy(cfg *config.Config, generator *dockerfile.Generator) error {
+	p, err := policy.Load()
+	if err != nil || p == nil {
+		return err
+	}
+	baseImage, err := generator.BaseImage()
+	if err != nil {
+		return err
+	}
+	return p.CheckBuild(cfg, baseImage)
+}
+
+// CheckPushPolicy checks that imageName can be pushed from here by the
+// policy, if there is one. It's checked before building, so a push that
+// isn't allowed fails before spending time on the build.
+func CheckPushPolicy(imageName string) error {
+	p, err := policy.Load()
+	if err != nil || p == nil {
+		return err
+	}
+	return p.CheckPush(imageName, policy.PushingFrom())
+}
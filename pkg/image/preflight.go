@@ -0,0 +1,66 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/docker/go-units"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// CheckPushSize checks imageName against the size limits of the registry it
+// is about to be pushed to, so a push that is going to be rejected fails
+// before uploading anything. Registries don't advertise their limits, so
+// they come from registry_limits in the user config.
+func CheckPushSize(imageName string) error {
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	registry := config.ImageRegistry(imageName)
+	limit, ok := userConfig.RegistryLimits[registry]
+	if !ok {
+		return nil
+	}
+
+	layerSizes, err := docker.LayerSizes(imageName)
+	if err != nil {
+		console.Warnf("Not checking image size against the limits of %s: %s", registry, err)
+		return nil
+	}
+	return checkSizeLimit(registry, limit, layerSizes)
+}
+
+func checkSizeLimit(registry string, limit config.RegistryLimit, layerSizes []int64) error {
+	const guidance = "To make the image smaller, leave large files such as weights out of it with .dockerignore, and download them from a URL in setup() instead."
+
+	var total, largest int64
+	for _, size := range layerSizes {
+		total += size
+		if size > largest {
+			largest = size
+		}
+	}
+
+	if limit.MaxImageSize != "" {
+		max, err := units.FromHumanSize(limit.MaxImageSize)
+		if err != nil {
+			return fmt.Errorf("Invalid max_image_size %q for %s in the user config: %w", limit.MaxImageSize, registry, err)
+		}
+		if total > max {
+			return fmt.Errorf("The image is %s, which is over the %s limit of %s. %s", units.HumanSize(float64(total)), limit.MaxImageSize, registry, guidance)
+		}
+	}
+	if limit.MaxLayerSize != "" {
+		max, err := units.FromHumanSize(limit.MaxLayerSize)
+		if err != nil {
+			return fmt.Errorf("Invalid max_layer_size %q for %s in the user config: %w", limit.MaxLayerSize, registry, err)
+		}
+		if largest > max {
+			return fmt.Errorf("The image has a %s layer, which is over the %s layer limit of %s. %s You can also split large files into their own layers with 'cog build --groupfile'.", units.HumanSize(float64(largest)), limit.MaxLayerSize, registry, guidance)
+		}
+	}
+	return nil
+}
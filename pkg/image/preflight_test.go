@@ -0,0 +1,25 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestCheckSizeLimit(t *testing.T) {
+	layers := []int64{100e6, 0, 3e9, 500e6}
+
+	require.NoError(t, checkSizeLimit("r8.im", config.RegistryLimit{}, layers))
+	require.NoError(t, checkSizeLimit("r8.im", config.RegistryLimit{MaxImageSize: "5GB", MaxLayerSize: "4GB"}, layers))
+
+	err := checkSizeLimit("r8.im", config.RegistryLimit{MaxImageSize: "2GB"}, layers)
+	require.ErrorContains(t, err, "over the 2GB limit of r8.im")
+
+	err = checkSizeLimit("r8.im", config.RegistryLimit{MaxLayerSize: "1GB"}, layers)
+	require.ErrorContains(t, err, "3GB layer")
+
+	err = checkSizeLimit("r8.im", config.RegistryLimit{MaxLayerSize: "lots"}, layers)
+	require.ErrorContains(t, err, "Invalid max_layer_size")
+}
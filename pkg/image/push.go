@@ -0,0 +1,43 @@
+package image
+
+import (
+	"github.com/replicate/cog/pkg/auth"
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// Push pushes imageName with its layers compressed as build.compression in
+// cog.yaml says. If it can't be pushed like that, because the registry
+// doesn't support zstd or Docker can't recompress layers, it's pushed with
+// Docker's default compression instead.
+func Push(cfg *config.Config, imageName string) error {
+	if err := refreshLogin(imageName); err != nil {
+		return err
+	}
+	if cfg.Build.Compression == "" {
+		return docker.Push(imageName)
+	}
+	err := docker.PushCompressed(imageName, cfg.Build.Compression, cfg.Build.CompressionLevel)
+	if err == nil {
+		return nil
+	}
+	console.Warnf("Failed to push %s with %s compression: %s. The registry may not support it, or Docker may need the containerd image store to recompress layers. Pushing it with Docker's default compression instead...", imageName, cfg.Build.Compression, err)
+	return docker.Push(imageName)
+}
+
+// refreshLogin refreshes the login to the registry imageName is pushed to,
+// if it was logged in to with OpenID Connect and the token has expired.
+func refreshLogin(imageName string) error {
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	registry := config.ImageRegistry(imageName)
+	provider, ok := userConfig.OIDC[registry]
+	if !ok {
+		return nil
+	}
+	_, err = auth.AccessToken(registry, provider)
+	return err
+}
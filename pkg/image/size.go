@@ -0,0 +1,188 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/dockerfile"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// DefaultImageSizeWarning is the estimated image size above which Cog warns
+// before building, unless image_size_warning is set in the user config.
+const DefaultImageSizeWarning = "10GB"
+
+// Wheels are zip files, so installed packages take up more space than the
+// wheel. This is a rough average for the kind of packages models use.
+const wheelInstallRatio = 2
+
+// How long to spend looking up package sizes before giving up, so an
+// estimate never holds up a build for long
+const packageSizeTimeout = 10 * time.Second
+
+// SizeEstimate is an estimate of the size of an image, before it is built.
+type SizeEstimate struct {
+	BaseImage      int64
+	Workspace      int64
+	PythonPackages int64
+	// Unknown lists what couldn't be estimated, and isn't included
+	Unknown []string
+}
+
+func (e *SizeEstimate) Total() int64 {
+	return e.BaseImage + e.Workspace + e.PythonPackages
+}
+
+// EstimateSize estimates the size of the image generator will build, from
+// the size of the base image, the files that will be copied from dir, and
+// the wheels of the pinned Python requirements.
+func EstimateSize(generator *dockerfile.Generator, dir string) (*SizeEstimate, error) {
+	estimate := &SizeEstimate{}
+
+	baseImage, err := generator.BaseImage()
+	if err != nil {
+		return nil, err
+	}
+	if inspect, err := docker.ImageInspect(baseImage); err == nil {
+		estimate.BaseImage = inspect.Size
+	} else {
+		estimate.Unknown = append(estimate.Unknown, "base image "+baseImage+" (not pulled yet)")
+	}
+
+	estimate.Workspace, err = workspaceSize(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	requirements, err := generator.Config.PythonRequirementsForArch(generator.GOOS, generator.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), packageSizeTimeout)
+	defer cancel()
+	for _, line := range strings.Split(requirements, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "-") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		size, err := wheelSize(ctx, line)
+		if err != nil {
+			console.Debugf("Failed to get size of %s: %s", line, err)
+			estimate.Unknown = append(estimate.Unknown, line)
+			continue
+		}
+		estimate.PythonPackages += size * wheelInstallRatio
+	}
+	return estimate, nil
+}
+
+// warnIfLarge prints the estimated size of the image, and warns if it is
+// over the threshold in the user config.
+func warnIfLarge(generator *dockerfile.Generator, dir string) {
+	estimate, err := EstimateSize(generator, dir)
+	if err != nil {
+		console.Debugf("Failed to estimate image size: %s", err)
+		return
+	}
+	console.Infof("Estimated image size: %s (base image %s, files %s, Python packages %s)",
+		units.HumanSize(float64(estimate.Total())),
+		units.HumanSize(float64(estimate.BaseImage)),
+		units.HumanSize(float64(estimate.Workspace)),
+		units.HumanSize(float64(estimate.PythonPackages)))
+	if len(estimate.Unknown) > 0 {
+		console.Debugf("Not included in the estimate: %s", strings.Join(estimate.Unknown, ", "))
+	}
+
+	threshold := DefaultImageSizeWarning
+	userConfig, err := config.LoadUserConfig()
+	if err == nil && userConfig.ImageSizeWarning != "" {
+		threshold = userConfig.ImageSizeWarning
+	}
+	thresholdBytes, err := units.FromHumanSize(threshold)
+	if err != nil {
+		console.Warnf("Invalid image_size_warning %q in the user config: %s", threshold, err)
+		return
+	}
+	if estimate.Total() > thresholdBytes {
+		console.Warnf("This image will be about %s, which is over %s. Large images are slow to push and pull, and may be over your registry's size limit. Consider leaving weights out of the image with .dockerignore and downloading them at runtime.",
+			units.HumanSize(float64(estimate.Total())), threshold)
+	}
+}
+
+// workspaceSize returns the total size of the files in dir that are sent to
+// Docker, excluding anything matched by .dockerignore.
+func workspaceSize(dir string) (int64, error) {
+	var size int64
+	err := dockerfile.WalkContext(dir, func(rel string, info fs.FileInfo) error {
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+type pypiRelease struct {
+	URLs []struct {
+		Filename    string `json:"filename"`
+		PackageType string `json:"packagetype"`
+		Size        int64  `json:"size"`
+	} `json:"urls"`
+}
+
+// wheelSize returns the size of the Linux wheel for a pinned requirement
+// (name==version), according to PyPI.
+func wheelSize(ctx context.Context, requirement string) (int64, error) {
+	name, version, ok := strings.Cut(requirement, "==")
+	if !ok {
+		return 0, fmt.Errorf("not pinned to a version")
+	}
+	// PyPI doesn't have local versions, like torch's +cpu
+	version, _, _ = strings.Cut(version, "+")
+
+	url := fmt.Sprintf("https://pypi.org/pypi/%s/%s/json", strings.TrimSpace(name), strings.TrimSpace(version))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	release := &pypiRelease{}
+	if err := json.NewDecoder(resp.Body).Decode(release); err != nil {
+		return 0, err
+	}
+
+	// Prefer the largest Linux or pure Python wheel, because it is the one
+	// most likely to be installed
+	var size, fallback int64
+	for _, u := range release.URLs {
+		if u.Size > fallback {
+			fallback = u.Size
+		}
+		if u.PackageType != "bdist_wheel" {
+			continue
+		}
+		if (strings.Contains(u.Filename, "linux") && strings.Contains(u.Filename, "x86_64")) || strings.HasSuffix(u.Filename, "-none-any.whl") {
+			if u.Size > size {
+				size = u.Size
+			}
+		}
+	}
+	if size == 0 {
+		size = fallback
+	}
+	return size, nil
+}
@@ -0,0 +1,28 @@
+package image
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkspaceSize(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "weights"), 0o755))
+	require.NoError(t, os.WriteFile(path.Join(dir, "predict.py"), make([]byte, 100), 0o644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "weights", "a.bin"), make([]byte, 1000), 0o644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "weights", "b.bin"), make([]byte, 10000), 0o644))
+
+	size, err := workspaceSize(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(11100), size)
+
+	dockerignore := []byte("# weights are downloaded\nweights\n!weights/a.bin\n")
+	require.NoError(t, os.WriteFile(path.Join(dir, ".dockerignore"), dockerignore, 0o644))
+	size, err = workspaceSize(dir)
+	require.NoError(t, err)
+	// .dockerignore itself is sent too
+	require.Equal(t, int64(1100+len(dockerignore)), size)
+}
@@ -0,0 +1,258 @@
+// Package kubernetes generates Kubernetes manifests for deploying models.
+package kubernetes
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// Options are what a model's manifests are generated from
+type Options struct {
+	// Name of the Deployment and Service. It's made a valid Kubernetes name.
+	Name     string
+	Image    string
+	Replicas int
+	Config   *config.Config
+}
+
+type metadata struct {
+	Name   string            `yaml:"name,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type deployment struct {
+	APIVersion string         `yaml:"apiVersion"`
+	Kind       string         `yaml:"kind"`
+	Metadata   metadata       `yaml:"metadata"`
+	Spec       deploymentSpec `yaml:"spec"`
+}
+
+type deploymentSpec struct {
+	Replicas int             `yaml:"replicas"`
+	Selector labelSelector   `yaml:"selector"`
+	Template podTemplateSpec `yaml:"template"`
+}
+
+type labelSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels"`
+}
+
+type podTemplateSpec struct {
+	Metadata metadata `yaml:"metadata"`
+	Spec     podSpec  `yaml:"spec"`
+}
+
+type podSpec struct {
+	InitContainers []container `yaml:"initContainers,omitempty"`
+	Containers     []container `yaml:"containers"`
+	Volumes        []volume    `yaml:"volumes,omitempty"`
+}
+
+type container struct {
+	Name           string        `yaml:"name"`
+	Image          string        `yaml:"image"`
+	Command        []string      `yaml:"command,omitempty"`
+	Ports          []port        `yaml:"ports,omitempty"`
+	ReadinessProbe *probe        `yaml:"readinessProbe,omitempty"`
+	Resources      *resources    `yaml:"resources,omitempty"`
+	VolumeMounts   []volumeMount `yaml:"volumeMounts,omitempty"`
+}
+
+type port struct {
+	Name          string `yaml:"name,omitempty"`
+	ContainerPort int    `yaml:"containerPort,omitempty"`
+	Port          int    `yaml:"port,omitempty"`
+	TargetPort    string `yaml:"targetPort,omitempty"`
+}
+
+type probe struct {
+	Exec          execAction `yaml:"exec"`
+	PeriodSeconds int        `yaml:"periodSeconds"`
+}
+
+type execAction struct {
+	Command []string `yaml:"command"`
+}
+
+type resources struct {
+	Limits map[string]string `yaml:"limits"`
+}
+
+type volumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+type volume struct {
+	Name     string         `yaml:"name"`
+	HostPath hostPathSource `yaml:"hostPath"`
+}
+
+type hostPathSource struct {
+	Path string `yaml:"path"`
+	Type string `yaml:"type"`
+}
+
+type service struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   metadata    `yaml:"metadata"`
+	Spec       serviceSpec `yaml:"spec"`
+}
+
+type serviceSpec struct {
+	Selector map[string]string `yaml:"selector"`
+	Ports    []port            `yaml:"ports"`
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Name returns a valid Kubernetes name for an image, from the last part of
+// its repository.
+func Name(image string) string {
+	name := path.Base(strings.SplitN(image, "@", 2)[0])
+	name = strings.SplitN(name, ":", 2)[0]
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	if name == "" {
+		return "cog-model"
+	}
+	return name
+}
+
+func copySharedWeightsScript(shared *config.SharedWeights) string {
+	dest := path.Join("/cog-shared", path.Base(shared.HostPath))
+	tmp := path.Join("/cog-shared", "."+path.Base(shared.HostPath)+"-XXXXXX")
+	return strings.Join([]string{
+		"set -e",
+		"if [ ! -d " + dest + " ]; then",
+		"  tmp=$(mktemp -d " + tmp + ")",
+		"  cp -a " + path.Join("/src", shared.Path) + "/. \"$tmp\"",
+		"  chmod 755 \"$tmp\"",
+		"  mv -T \"$tmp\" " + dest + " || rm -rf \"$tmp\"",
+		"fi",
+	}, "\n")
+}
+
+// Manifest returns a Deployment and a Service for a model, as YAML.
+func Manifest(options Options) ([]byte, error) {
+	name := Name(options.Name)
+	labels := map[string]string{"app.kubernetes.io/name": name}
+
+	c := container{
+		Name:  "model",
+		Image: options.Image,
+		Ports: []port{{Name: "http", ContainerPort: options.Config.ServingPort()}},
+		// The server creates this file once setup has finished, when it's
+		// running in Kubernetes
+		ReadinessProbe: &probe{
+			Exec:          execAction{Command: []string{"test", "-f", "/var/run/cog/ready"}},
+			PeriodSeconds: 5,
+		},
+	}
+	pod := podSpec{}
+	limits := map[string]string{}
+	if r := options.Config.Resources; r != nil {
+		if r.CPUs > 0 {
+			limits["cpu"] = strconv.FormatFloat(r.CPUs, 'f', -1, 64)
+		}
+		if r.Memory != "" {
+			limits["memory"] = strconv.FormatInt(r.MemoryBytes(), 10)
+		}
+	}
+	if options.Config.Build.IsAMD() {
+		// From the AMD GPU device plugin
+		limits["amd.com/gpu"] = "1"
+	} else if options.Config.Build.GPU {
+		limits["nvidia.com/gpu"] = "1"
+		if options.Config.Build.CUDA != "" {
+			minimum, err := config.MinimumDriverVersion(options.Config.Build.CUDA)
+			if err != nil {
+				return nil, err
+			}
+			// Check the node's driver before starting, so an old one is
+			// reported clearly rather than as CUDA failing to initialize
+			pod.InitContainers = append(pod.InitContainers, container{
+				Name:      "check-nvidia-driver",
+				Image:     options.Image,
+				Command:   []string{"python", "-m", "cog.command.check_nvidia_driver", minimum, options.Config.Build.CUDA},
+				Resources: &resources{Limits: map[string]string{"nvidia.com/gpu": "1"}},
+			})
+		}
+	}
+	if len(limits) > 0 {
+		c.Resources = &resources{Limits: limits}
+	}
+	if options.Config.Weights != nil && options.Config.Weights.Shared != nil {
+		shared := options.Config.Weights.Shared
+		c.VolumeMounts = append(c.VolumeMounts, volumeMount{
+			Name:      "shared-weights",
+			MountPath: path.Join("/src", shared.Path),
+			ReadOnly:  true,
+		})
+		pod.Volumes = append(pod.Volumes,
+			volume{Name: "shared-weights", HostPath: hostPathSource{Path: shared.HostPath, Type: "Directory"}},
+			volume{Name: "shared-weights-parent", HostPath: hostPathSource{Path: path.Dir(shared.HostPath), Type: "DirectoryOrCreate"}},
+		)
+		// The first pod on each node copies the weights from its image to
+		// the node. They're copied to a temporary directory and moved into
+		// place, so pods starting at the same time never see a partial copy.
+		pod.InitContainers = append(pod.InitContainers, container{
+			Name:         "copy-shared-weights",
+			Image:        options.Image,
+			Command:      []string{"sh", "-c", copySharedWeightsScript(shared)},
+			VolumeMounts: []volumeMount{{Name: "shared-weights-parent", MountPath: "/cog-shared"}},
+		})
+	}
+	pod.Containers = []container{c}
+
+	replicas := options.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+	documents := []interface{}{
+		deployment{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Metadata:   metadata{Name: name, Labels: labels},
+			Spec: deploymentSpec{
+				Replicas: replicas,
+				Selector: labelSelector{MatchLabels: labels},
+				Template: podTemplateSpec{Metadata: metadata{Labels: labels}, Spec: pod},
+			},
+		},
+		service{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Metadata:   metadata{Name: name, Labels: labels},
+			Spec: serviceSpec{
+				Selector: labels,
+				Ports:    []port{{Name: "http", Port: 80, TargetPort: "http"}},
+			},
+		},
+	}
+
+	var out bytes.Buffer
+	for i, document := range documents {
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+		b, err := yaml.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(b)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,51 @@
+package kubernetes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestName(t *testing.T) {
+	require.Equal(t, "sdxl", Name("r8.im/stability-ai/sdxl:v1"))
+	require.Equal(t, "my-model", Name("localhost:5000/My_Model@sha256:abc"))
+	require.Equal(t, "cog-model", Name("___"))
+}
+
+func TestManifest(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Build.GPU = true
+	cfg.Build.CUDA = "11.8"
+	cfg.Resources = &config.Resources{CPUs: 4, Memory: "16GiB"}
+	manifest, err := Manifest(Options{Name: "sdxl", Image: "r8.im/stability-ai/sdxl:v1", Replicas: 2, Config: cfg})
+	require.NoError(t, err)
+
+	documents := strings.Split(string(manifest), "---\n")
+	require.Len(t, documents, 2)
+	deployment := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(documents[0]), &deployment))
+	require.Equal(t, "Deployment", deployment["kind"])
+	require.Contains(t, documents[0], "replicas: 2")
+	require.Contains(t, documents[0], "nvidia.com/gpu: \"1\"")
+	require.Contains(t, documents[0], "cpu: \"4\"\n            memory: \"17179869184\"")
+	require.NotContains(t, documents[0], "volumes")
+	require.Contains(t, documents[0], "- cog.command.check_nvidia_driver\n        - 450.80.02\n        - \"11.8\"")
+	require.Contains(t, documents[1], "kind: Service")
+}
+
+func TestManifestSharedWeights(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Weights = &config.Weights{Shared: &config.SharedWeights{Path: "weights", HostPath: "/var/lib/cog/weights/sdxl"}}
+	manifest, err := Manifest(Options{Name: "sdxl", Image: "sdxl", Config: cfg})
+	require.NoError(t, err)
+
+	deployment := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(strings.Split(string(manifest), "---\n")[0]), &deployment))
+	require.Contains(t, string(manifest), "mountPath: /src/weights\n          readOnly: true")
+	require.Contains(t, string(manifest), "path: /var/lib/cog/weights/sdxl\n          type: Directory")
+	require.Contains(t, string(manifest), "cp -a /src/weights/. \"$tmp\"")
+}
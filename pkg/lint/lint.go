@@ -0,0 +1,327 @@
+// Package lint checks a predictor for common problems without running it.
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	// SeverityOff turns a rule off, in ApplyRules
+	SeverityOff Severity = "off"
+)
+
+// Rules are the names of the rules Lint checks.
+var Rules = []string{
+	"bare-dict-output",
+	"missing-input-type",
+	"missing-output-type",
+	"missing-predict",
+	"missing-predictor",
+	"missing-setup",
+	"print",
+	"unsupported-input-type",
+	"write-outside-tmp",
+}
+
+// Finding is a problem found in a predictor.
+type Finding struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s (%s)", f.File, f.Line, f.Severity, f.Message, f.Rule)
+}
+
+// The input types that cog.predictor supports
+var allowedInputTypes = []string{"str", "int", "float", "bool", "File", "Path"}
+
+// Lint checks the class predictorClass in the Python source of file for
+// common problems.
+func Lint(file string, source []byte, predictorClass string) []Finding {
+	l := &linter{file: file, findings: []Finding{}}
+	lines := tokenize(string(source))
+
+	l.checkCalls(lines)
+
+	classIndex := -1
+	for i, line := range lines {
+		if len(line.tokens) >= 2 && line.tokens[0].value == "class" && line.tokens[1].value == predictorClass {
+			classIndex = i
+			break
+		}
+	}
+	if classIndex == -1 {
+		l.add(1, "missing-predictor", SeverityError, "There is no class called %s", predictorClass)
+		return l.findings
+	}
+
+	methods := classMethods(lines, classIndex)
+	if _, ok := methods["setup"]; !ok {
+		l.add(lines[classIndex].line, "missing-setup", SeverityWarning, "%s has no setup() method, so anything expensive like loading weights happens on every prediction", predictorClass)
+	}
+	predict, ok := methods["predict"]
+	if !ok {
+		l.add(lines[classIndex].line, "missing-predict", SeverityError, "%s has no predict() method", predictorClass)
+		return l.findings
+	}
+	l.checkPredictSignature(predict)
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		return l.findings[i].Line < l.findings[j].Line
+	})
+	return l.findings
+}
+
+// ApplyRules changes the severity of findings to the severity of their rule
+// in rules, leaving out findings for rules that are off.
+func ApplyRules(findings []Finding, rules map[string]Severity) []Finding {
+	applied := []Finding{}
+	for _, finding := range findings {
+		if severity, ok := rules[finding.Rule]; ok {
+			if severity == SeverityOff {
+				continue
+			}
+			finding.Severity = severity
+		}
+		applied = append(applied, finding)
+	}
+	return applied
+}
+
+type linter struct {
+	file     string
+	findings []Finding
+}
+
+func (l *linter) add(line int, rule string, severity Severity, format string, args ...interface{}) {
+	l.findings = append(l.findings, Finding{
+		File:     l.file,
+		Line:     line,
+		Rule:     rule,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// classMethods returns the def lines in the body of the class at
+// classIndex, by method name.
+func classMethods(lines []logicalLine, classIndex int) map[string]logicalLine {
+	methods := map[string]logicalLine{}
+	classIndent := lines[classIndex].indent
+	for _, line := range lines[classIndex+1:] {
+		if line.indent <= classIndent {
+			break
+		}
+		tokens := line.tokens
+		if tokens[0].value == "async" {
+			tokens = tokens[1:]
+		}
+		if len(tokens) >= 2 && tokens[0].value == "def" {
+			if _, ok := methods[tokens[1].value]; !ok {
+				methods[tokens[1].value] = logicalLine{indent: line.indent, line: line.line, tokens: tokens}
+			}
+		}
+	}
+	return methods
+}
+
+func (l *linter) checkPredictSignature(def logicalLine) {
+	tokens := def.tokens
+	// def predict ( ... ) -> Type :
+	if len(tokens) < 4 || tokens[2].value != "(" {
+		return
+	}
+	end := matchingBracket(tokens, 2)
+	if end == -1 {
+		return
+	}
+
+	for _, param := range splitTopLevel(tokens[3:end], ",") {
+		l.checkInput(param)
+	}
+
+	rest := tokens[end+1:]
+	if len(rest) == 0 || rest[0].value != "->" {
+		l.add(def.line, "missing-output-type", SeverityError, "predict() has no return type annotation, so Cog can't work out the type of its output")
+		return
+	}
+	annotation := rest[1:]
+	if colon := indexTopLevel(annotation, ":"); colon != -1 {
+		annotation = annotation[:colon]
+	}
+	if isBareDict(annotation) {
+		l.add(annotation[0].line, "bare-dict-output", SeverityError, "The output of predict() is typed as %s, which has no schema. Return a subclass of cog.BaseModel called Output instead", joinTokens(annotation))
+	}
+}
+
+func (l *linter) checkInput(param []token) {
+	if len(param) == 0 || param[0].kind != tokenName {
+		// *, *args or **kwargs
+		return
+	}
+	name := param[0].value
+	if name == "self" {
+		return
+	}
+	if len(param) < 2 || param[1].value != ":" {
+		l.add(param[0].line, "missing-input-type", SeverityError, "The input %s has no type annotation", name)
+		return
+	}
+	annotation := param[2:]
+	if eq := indexTopLevel(annotation, "="); eq != -1 {
+		annotation = annotation[:eq]
+	}
+	typ := joinTokens(annotation)
+	for _, allowed := range allowedInputTypes {
+		if strings.TrimPrefix(typ, "cog.") == allowed {
+			return
+		}
+	}
+	l.add(param[0].line, "unsupported-input-type", SeverityError, "The input %s has the type %s, which isn't supported. Supported types are: %s", name, typ, strings.Join(allowedInputTypes, ", "))
+}
+
+// checkCalls looks for calls to print(), and to open() for writing outside
+// /tmp, anywhere in the file.
+func (l *linter) checkCalls(lines []logicalLine) {
+	for _, line := range lines {
+		tokens := line.tokens
+		for i := 0; i+1 < len(tokens); i++ {
+			if tokens[i].kind != tokenName || tokens[i+1].value != "(" {
+				continue
+			}
+			if i > 0 && (tokens[i-1].value == "." || tokens[i-1].value == "def") {
+				continue
+			}
+			switch tokens[i].value {
+			case "print":
+				l.add(tokens[i].line, "print", SeverityWarning, "print() output has no log level or timestamp. Use the logging module instead")
+			case "open":
+				end := matchingBracket(tokens, i+1)
+				if end == -1 {
+					continue
+				}
+				l.checkOpen(splitTopLevel(tokens[i+2:end], ","))
+			}
+		}
+	}
+}
+
+func (l *linter) checkOpen(args [][]token) {
+	if len(args) < 2 || len(args[0]) != 1 || args[0][0].kind != tokenString {
+		return
+	}
+	path, ok := stringValue(args[0][0].value)
+	if !ok {
+		return
+	}
+	mode := ""
+	for i, arg := range args[1:] {
+		if i == 0 && len(arg) == 1 && arg[0].kind == tokenString {
+			mode, _ = stringValue(arg[0].value)
+		} else if len(arg) == 3 && arg[0].value == "mode" && arg[1].value == "=" && arg[2].kind == tokenString {
+			mode, _ = stringValue(arg[2].value)
+		}
+	}
+	if !strings.ContainsAny(mode, "wax+") {
+		return
+	}
+	if path == "/tmp" || strings.HasPrefix(path, "/tmp/") {
+		return
+	}
+	l.add(args[0][0].line, "write-outside-tmp", SeverityWarning, "%s is written to outside /tmp. The rest of the filesystem may be read-only or shared between predictions, so write files to a temporary directory", path)
+}
+
+// isBareDict returns whether a type annotation is dict, or a list or
+// iterator of dicts.
+func isBareDict(annotation []token) bool {
+	typ := joinTokens(annotation)
+	for _, wrapper := range []string{"Iterator[", "List[", "list[", "ConcatenateIterator["} {
+		if strings.HasPrefix(typ, wrapper) && strings.HasSuffix(typ, "]") {
+			typ = typ[len(wrapper) : len(typ)-1]
+			break
+		}
+	}
+	typ = strings.TrimPrefix(typ, "typing.")
+	return typ == "dict" || typ == "Dict" || strings.HasPrefix(typ, "dict[") || strings.HasPrefix(typ, "Dict[")
+}
+
+// matchingBracket returns the index of the bracket that closes the one at
+// tokens[open], or -1.
+func matchingBracket(tokens []token, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits tokens at separators that aren't inside brackets.
+func splitTopLevel(tokens []token, sep string) [][]token {
+	parts := [][]token{}
+	depth := 0
+	start := 0
+	for i, t := range tokens {
+		switch t.value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, tokens[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(tokens) {
+		parts = append(parts, tokens[start:])
+	}
+	return parts
+}
+
+func indexTopLevel(tokens []token, value string) int {
+	depth := 0
+	for i, t := range tokens {
+		switch t.value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		case value:
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func joinTokens(tokens []token) string {
+	s := ""
+	for _, t := range tokens {
+		if t.value == "," {
+			s += ", "
+		} else {
+			s += t.value
+		}
+	}
+	return s
+}
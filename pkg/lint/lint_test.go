@@ -0,0 +1,117 @@
+package lint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func rules(findings []Finding) []string {
+	rules := []string{}
+	for _, f := range findings {
+		rules = append(rules, f.Rule)
+	}
+	return rules
+}
+
+func TestLintClean(t *testing.T) {
+	source := `import logging
+from cog import BasePredictor, Input, Path
+
+
+class Predictor(BasePredictor):
+    def setup(self):
+        """Load the model"""
+        self.model = load("weights.pth")
+
+    def predict(
+        self,
+        image: Path = Input(description="Input image, (with brackets)"),
+        scale: float = Input(description="Factor", ge=0, le=10, default=1.5),
+    ) -> Path:
+        logging.info("predicting")
+        with open("/tmp/out.png", "wb") as f:
+            f.write(run(image, scale))
+        with open("weights.pth") as f:
+            pass
+        return Path("/tmp/out.png")
+`
+	require.Empty(t, Lint("predict.py", []byte(source), "Predictor"))
+}
+
+func TestLintProblems(t *testing.T) {
+	source := `from typing import Dict, Iterator
+from cog import BasePredictor, Input
+
+
+class Predictor(BasePredictor):
+    def predict(self, prompt: str, count, options: dict = Input(default={})) -> Iterator[Dict[str, str]]:
+        print("predicting")
+        with open("output.json", mode="w") as f:
+            f.write("{}")
+        yield {"prompt": prompt}
+`
+	findings := Lint("predict.py", []byte(source), "Predictor")
+	require.Equal(t, []string{"missing-setup", "missing-input-type", "unsupported-input-type", "bare-dict-output", "print", "write-outside-tmp"}, rules(findings))
+	require.Equal(t, 5, findings[0].Line)
+	require.Equal(t, SeverityWarning, findings[0].Severity)
+	require.Equal(t, "predict.py:6: error: The input options has the type dict, which isn't supported. Supported types are: str, int, float, bool, File, Path (unsupported-input-type)", findings[2].String())
+	require.Equal(t, 8, findings[5].Line)
+}
+
+func TestApplyRules(t *testing.T) {
+	findings := []Finding{
+		{Rule: "print", Severity: SeverityWarning},
+		{Rule: "missing-setup", Severity: SeverityWarning},
+		{Rule: "write-outside-tmp", Severity: SeverityError},
+	}
+	applied := ApplyRules(findings, map[string]Severity{"print": SeverityError, "missing-setup": SeverityOff})
+	require.Equal(t, []string{"print", "write-outside-tmp"}, rules(applied))
+	require.Equal(t, SeverityError, applied[0].Severity)
+	require.Equal(t, SeverityWarning, findings[0].Severity)
+}
+
+func TestLintMissing(t *testing.T) {
+	require.Equal(t, []string{"missing-predictor"}, rules(Lint("predict.py", []byte("class Model:\n    pass\n"), "Predictor")))
+
+	source := `class Predictor:
+    def setup(self):
+        pass
+
+    def run(self):
+        pass
+
+def predict(x: str) -> str:
+    return x
+`
+	require.Equal(t, []string{"missing-predict"}, rules(Lint("predict.py", []byte(source), "Predictor")))
+
+	source = `class Predictor:
+    def setup(self):
+        pass
+
+    async def predict(self, x: str):
+        return x
+`
+	require.Equal(t, []string{"missing-output-type"}, rules(Lint("predict.py", []byte(source), "Predictor")))
+}
+
+func TestTokenizeStrings(t *testing.T) {
+	lines := tokenize(`x = """multi
+line # not a comment
+"""  # a comment
+y = f"{x}" + r'\'' + (1,
+  2)
+`)
+	require.Len(t, lines, 2)
+	require.Equal(t, 1, lines[0].line)
+	require.Equal(t, 4, lines[1].line)
+	require.Len(t, lines[0].tokens, 3)
+	require.Equal(t, `f"{x}"`, lines[1].tokens[2].value)
+
+	value, ok := stringValue(`"""abc"""`)
+	require.True(t, ok)
+	require.Equal(t, "abc", value)
+	_, ok = stringValue(`f"{x}"`)
+	require.False(t, ok)
+}
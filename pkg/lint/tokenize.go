@@ -0,0 +1,192 @@
+package lint
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenName tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	line  int
+}
+
+// logicalLine is a Python statement, which can span several physical lines
+// if it has brackets or backslash continuations in it.
+type logicalLine struct {
+	indent int
+	line   int
+	tokens []token
+}
+
+// tokenize splits Python source into logical lines of tokens. Comments are
+// dropped. It is only as thorough as the lint rules need: it understands
+// strings, brackets and indentation, not the full grammar.
+func tokenize(source string) []logicalLine {
+	lines := []logicalLine{}
+	current := logicalLine{}
+	depth := 0
+	lineNum := 1
+	atLineStart := true
+	indent := 0
+
+	endLine := func() {
+		if len(current.tokens) > 0 {
+			lines = append(lines, current)
+		}
+		current = logicalLine{}
+	}
+	addToken := func(kind tokenKind, value string, line int) {
+		if len(current.tokens) == 0 {
+			current.indent = indent
+			current.line = line
+		}
+		current.tokens = append(current.tokens, token{kind: kind, value: value, line: line})
+	}
+
+	i := 0
+	for i < len(source) {
+		c := source[i]
+
+		if atLineStart {
+			atLineStart = false
+			if depth == 0 && len(current.tokens) == 0 {
+				indent = 0
+				for i < len(source) && (source[i] == ' ' || source[i] == '\t') {
+					indent++
+					i++
+				}
+				continue
+			}
+		}
+
+		switch {
+		case c == '\n':
+			lineNum++
+			atLineStart = true
+			if depth == 0 {
+				endLine()
+			}
+			i++
+		case c == '\\' && i+1 < len(source) && source[i+1] == '\n':
+			// Line continuation
+			lineNum++
+			i += 2
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f':
+			i++
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case isStringStart(source[i:]):
+			start := i
+			startLine := lineNum
+			i = skipString(source, i)
+			lineNum += strings.Count(source[start:i], "\n")
+			addToken(tokenString, source[start:i], startLine)
+		case isNameChar(c) && !isDigit(c):
+			start := i
+			for i < len(source) && isNameChar(source[i]) {
+				i++
+			}
+			addToken(tokenName, source[start:i], lineNum)
+		case isDigit(c):
+			start := i
+			for i < len(source) && (isNameChar(source[i]) || source[i] == '.') {
+				i++
+			}
+			addToken(tokenNumber, source[start:i], lineNum)
+		default:
+			op := string(c)
+			for _, multi := range []string{"->", "**", "//", "==", "!=", "<=", ">=", ":="} {
+				if strings.HasPrefix(source[i:], multi) {
+					op = multi
+					break
+				}
+			}
+			switch op {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				if depth > 0 {
+					depth--
+				}
+			}
+			addToken(tokenOp, op, lineNum)
+			i += len(op)
+		}
+	}
+	endLine()
+	return lines
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || isDigit(c) || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isStringStart returns whether s starts with a string literal, including
+// any prefix like r or f.
+func isStringStart(s string) bool {
+	i := 0
+	for i < len(s) && i < 2 && strings.ContainsRune("rRbBuUfF", rune(s[i])) {
+		i++
+	}
+	return i < len(s) && (s[i] == '\'' || s[i] == '"')
+}
+
+// skipString returns the index after the string literal starting at i.
+func skipString(source string, i int) int {
+	for source[i] != '\'' && source[i] != '"' {
+		i++
+	}
+	quote := source[i : i+1]
+	if strings.HasPrefix(source[i:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	i += len(quote)
+	for i < len(source) {
+		if source[i] == '\\' {
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(source[i:], quote) {
+			return i + len(quote)
+		}
+		if source[i] == '\n' && len(quote) == 1 {
+			// Unterminated string
+			return i
+		}
+		i++
+	}
+	return len(source)
+}
+
+// stringValue returns the contents of a string literal token, and whether
+// it is a plain string whose value is known without running the code.
+func stringValue(literal string) (string, bool) {
+	prefix := strings.ToLower(literal[:strings.IndexAny(literal, `'"`)])
+	if strings.Contains(prefix, "f") {
+		return "", false
+	}
+	body := literal[len(prefix):]
+	quote := body[:1]
+	if strings.HasPrefix(body, strings.Repeat(quote, 3)) && len(body) >= 6 {
+		quote = strings.Repeat(quote, 3)
+	}
+	if len(body) < 2*len(quote) {
+		return "", false
+	}
+	return body[len(quote) : len(body)-len(quote)], true
+}
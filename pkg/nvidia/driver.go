@@ -0,0 +1,62 @@
+// Package nvidia checks the NVIDIA driver on the machine Cog is running on.
+package nvidia
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/version"
+)
+
+// ErrNoDriver is returned when there is no NVIDIA driver to check
+var ErrNoDriver = errors.New("No NVIDIA driver found")
+
+// DriverVersion returns the version of the NVIDIA driver, which nvidia-smi
+// reads with NVML.
+func DriverVersion() (string, error) {
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return "", ErrNoDriver
+	}
+	cmd := exec.Command("nvidia-smi", "--query-gpu=driver_version", "--format=csv,noheader")
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the NVIDIA driver version: %w", err)
+	}
+	// There's a line for each GPU, but they all have the same driver
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if lines[0] == "" {
+		return "", ErrNoDriver
+	}
+	return strings.TrimSpace(lines[0]), nil
+}
+
+// CheckDriver returns an error if the NVIDIA driver is older than minimum,
+// the oldest that can run the CUDA version cuda. If there is no driver to
+// check, like when Docker is running on another machine, it does nothing.
+func CheckDriver(minimum string, cuda string) error {
+	driver, err := DriverVersion()
+	if err == ErrNoDriver {
+		console.Debugf("Not checking the NVIDIA driver: %s", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isOlder(driver, minimum) {
+		return fmt.Errorf("This model uses CUDA %s, which needs NVIDIA driver %s or later, but the driver on this machine is %s. Upgrade the driver to run it", cuda, minimum, driver)
+	}
+	return nil
+}
+
+func isOlder(driver string, minimum string) bool {
+	d, err := version.NewVersion(driver)
+	if err != nil {
+		console.Debugf("Not checking the NVIDIA driver: %s", err)
+		return false
+	}
+	return version.MustVersion(minimum).Greater(d)
+}
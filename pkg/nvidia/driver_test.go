@@ -0,0 +1,15 @@
+package nvidia
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsOlder(t *testing.T) {
+	require.True(t, isOlder("418.67", "450.80.02"))
+	require.True(t, isOlder("450.80.01", "450.80.02"))
+	require.False(t, isOlder("450.80.02", "450.80.02"))
+	require.False(t, isOlder("535.104.05", "525.60.13"))
+	require.False(t, isOlder("not a version", "525.60.13"))
+}
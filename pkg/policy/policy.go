@@ -0,0 +1,197 @@
+// Package policy checks builds and pushes against rules set by an
+// organization, like only building on approved base images, or only pushing
+// to the production registry from CI.
+//
+// The policy is a YAML file, found with the COG_POLICY environment variable
+// or policy in the user config, so it can be set for everyone in an
+// organization without changing each model's cog.yaml.
+package policy
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v2"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+const (
+	// FromCI is where pushes come from when the CI environment variable is
+	// set, as it is by GitHub Actions, GitLab CI, CircleCI, and others
+	FromCI = "ci"
+	// FromLocal is where every other push comes from, like a laptop
+	FromLocal = "local"
+)
+
+// Policy is the rules builds and pushes must follow.
+type Policy struct {
+	// Path is the file the policy was loaded from
+	Path string `yaml:"-"`
+	// PinnedDependencies requires every Python package to be pinned to a
+	// version with ==
+	PinnedDependencies bool `yaml:"pinned_dependencies"`
+	// BaseImages are patterns of the base images models can be built on. Any
+	// base image is allowed if it's empty.
+	BaseImages []string `yaml:"base_images"`
+	// GPUMemory requires models that use a GPU to set resources.gpu_memory
+	GPUMemory bool `yaml:"gpu_memory"`
+	// Push are where images can be pushed to, and from where. Images can be
+	// pushed anywhere if it's empty.
+	Push []PushRule `yaml:"push"`
+}
+
+// PushRule allows pushing images whose names match Image, from where's in
+// From: FromCI, FromLocal, or both if it's empty.
+type PushRule struct {
+	Image string   `yaml:"image"`
+	From  []string `yaml:"from"`
+}
+
+// Path returns the path of the policy file, or "" if there isn't one.
+func Path() (string, error) {
+	if p := os.Getenv("COG_POLICY"); p != "" {
+		return homedir.Expand(p)
+	}
+	userConfig, err := config.LoadUserConfig()
+	if err != nil {
+		return "", err
+	}
+	if userConfig.Policy == "" {
+		return "", nil
+	}
+	return homedir.Expand(userConfig.Policy)
+}
+
+// Load loads the policy, or returns nil if there isn't one.
+func Load() (*Policy, error) {
+	p, err := Path()
+	if err != nil || p == "" {
+		return nil, err
+	}
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the policy: %w", err)
+	}
+	return Parse(p, contents)
+}
+
+// Parse parses the policy in contents, loaded from path. Unknown rules are
+// an error, rather than being ignored, so a typo doesn't turn a rule off.
+func Parse(path string, contents []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(contents, policy); err != nil {
+		return nil, fmt.Errorf("Failed to parse the policy in %s: %w", path, err)
+	}
+	policy.Path = path
+	for _, rule := range policy.Push {
+		if rule.Image == "" {
+			return nil, fmt.Errorf("Every rule in 'push' in the policy in %s must have an 'image'", path)
+		}
+		for _, from := range rule.From {
+			if from != FromCI && from != FromLocal {
+				return nil, fmt.Errorf("'from' in 'push' in the policy in %s can only have %s and %s, not '%s'", path, FromCI, FromLocal, from)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// CheckBuild returns an error listing the rules a build of cfg on baseImage
+// breaks, or nil if it follows them all.
+func (p *Policy) CheckBuild(cfg *config.Config, baseImage string) error {
+	violations := []string{}
+	if p.PinnedDependencies {
+		for _, pkg := range unpinnedRequirements(cfg.Build.PythonRequirementLines()) {
+			violations = append(violations, fmt.Sprintf("Python packages must be pinned to a version with ==, but %s isn't", pkg))
+		}
+	}
+	if len(p.BaseImages) > 0 && !matchAny(p.BaseImages, baseImage) {
+		violations = append(violations, fmt.Sprintf("Models must be built on %s, not %s", strings.Join(p.BaseImages, ", "), baseImage))
+	}
+	if p.GPUMemory && cfg.Build.GPU && (cfg.Resources == nil || cfg.Resources.GPUMemory == "") {
+		violations = append(violations, "Models that use a GPU must set 'resources.gpu_memory' in cog.yaml")
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("The build breaks the policy in %s:\n  - %s", p.Path, strings.Join(violations, "\n  - "))
+}
+
+// CheckPush returns an error if imageName can't be pushed from where, which
+// is FromCI or FromLocal.
+func (p *Policy) CheckPush(imageName string, from string) error {
+	if len(p.Push) == 0 {
+		return nil
+	}
+	allowedFrom := []string{}
+	for _, rule := range p.Push {
+		if !match(rule.Image, imageName) {
+			continue
+		}
+		if len(rule.From) == 0 {
+			return nil
+		}
+		for _, f := range rule.From {
+			if f == from {
+				return nil
+			}
+		}
+		allowedFrom = append(allowedFrom, rule.From...)
+	}
+	if len(allowedFrom) > 0 {
+		return fmt.Errorf("%s can only be pushed from %s, by the policy in %s", imageName, strings.Join(allowedFrom, ", "), p.Path)
+	}
+	images := []string{}
+	for _, rule := range p.Push {
+		images = append(images, rule.Image)
+	}
+	return fmt.Errorf("Pushing %s breaks the policy in %s. Images can only be pushed to %s", imageName, p.Path, strings.Join(images, ", "))
+}
+
+// PushingFrom returns where a push is coming from: FromCI if the CI
+// environment variable is set, and FromLocal otherwise.
+func PushingFrom() string {
+	if ci := os.Getenv("CI"); ci != "" && ci != "false" && ci != "0" {
+		return FromCI
+	}
+	return FromLocal
+}
+
+// unpinnedRequirements returns the lines of requirements that aren't pinned
+// to a version with ==. Blank lines, comments and pip options are skipped.
+func unpinnedRequirements(requirements []string) []string {
+	unpinned := []string{}
+	for _, line := range requirements {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if !strings.Contains(line, "==") {
+			unpinned = append(unpinned, line)
+		}
+	}
+	return unpinned
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns whether s matches pattern, where * matches anything,
+// including /, so r8.im/acme/* matches every image under r8.im/acme.
+func match(pattern string, s string) bool {
+	re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	return regexp.MustCompile(re).MatchString(s)
+}
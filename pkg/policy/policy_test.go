@@ -0,0 +1,95 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+func TestParse(t *testing.T) {
+	policy, err := Parse("policy.yaml", []byte(`
+pinned_dependencies: true
+base_images: ["python:*", "nvidia/cuda:*"]
+push:
+  - image: registry.acme.com/prod/*
+    from: [ci]
+`))
+	require.NoError(t, err)
+	require.Equal(t, &Policy{
+		Path:               "policy.yaml",
+		PinnedDependencies: true,
+		BaseImages:         []string{"python:*", "nvidia/cuda:*"},
+		Push:               []PushRule{{Image: "registry.acme.com/prod/*", From: []string{"ci"}}},
+	}, policy)
+
+	_, err = Parse("policy.yaml", []byte("pinned_dependency: true\n"))
+	require.ErrorContains(t, err, "field pinned_dependency not found")
+	_, err = Parse("policy.yaml", []byte("push:\n  - image: r8.im/*\n    from: [laptop]\n"))
+	require.ErrorContains(t, err, "not 'laptop'")
+	_, err = Parse("policy.yaml", []byte("push:\n  - from: [ci]\n"))
+	require.ErrorContains(t, err, "must have an 'image'")
+}
+
+func TestCheckBuild(t *testing.T) {
+	cfg, err := config.FromYAML([]byte(`
+build:
+  gpu: true
+  python_version: "3.11"
+  python_packages:
+    - "torch==2.1.0"
+    - "numpy"
+`))
+	require.NoError(t, err)
+	require.NoError(t, cfg.ValidateAndComplete(""))
+
+	require.NoError(t, (&Policy{}).CheckBuild(cfg, "nvidia/cuda:12.1.1-cudnn8-devel-ubuntu22.04"))
+
+	policy := &Policy{
+		Path:               "policy.yaml",
+		PinnedDependencies: true,
+		BaseImages:         []string{"python:*", "r8.im/acme/*"},
+		GPUMemory:          true,
+	}
+	err = policy.CheckBuild(cfg, "nvidia/cuda:12.1.1-cudnn8-devel-ubuntu22.04")
+	require.EqualError(t, err, `The build breaks the policy in policy.yaml:
+  - Python packages must be pinned to a version with ==, but numpy isn't
+  - Models must be built on python:*, r8.im/acme/*, not nvidia/cuda:12.1.1-cudnn8-devel-ubuntu22.04
+  - Models that use a GPU must set 'resources.gpu_memory' in cog.yaml`)
+
+	cfg, err = config.FromYAML([]byte(`
+build:
+  gpu: true
+  python_version: "3.11"
+  python_packages:
+    - "torch==2.1.0  # the version we test with"
+resources:
+  gpu_memory: 24GB
+`))
+	require.NoError(t, err)
+	require.NoError(t, cfg.ValidateAndComplete(""))
+	require.NoError(t, policy.CheckBuild(cfg, "r8.im/acme/base/cuda:12"))
+}
+
+func TestCheckPush(t *testing.T) {
+	policy := &Policy{
+		Path: "policy.yaml",
+		Push: []PushRule{
+			{Image: "registry.acme.com/prod/*", From: []string{FromCI}},
+			{Image: "registry.acme.com/dev/*"},
+		},
+	}
+	require.NoError(t, policy.CheckPush("registry.acme.com/prod/sdxl:v2", FromCI))
+	require.NoError(t, policy.CheckPush("registry.acme.com/dev/sdxl", FromLocal))
+	require.EqualError(t, policy.CheckPush("registry.acme.com/prod/sdxl:v2", FromLocal), "registry.acme.com/prod/sdxl:v2 can only be pushed from ci, by the policy in policy.yaml")
+	require.EqualError(t, policy.CheckPush("r8.im/someone/sdxl", FromCI), "Pushing r8.im/someone/sdxl breaks the policy in policy.yaml. Images can only be pushed to registry.acme.com/prod/*, registry.acme.com/dev/*")
+	require.NoError(t, (&Policy{}).CheckPush("r8.im/someone/sdxl", FromLocal))
+}
+
+func TestPushingFrom(t *testing.T) {
+	t.Setenv("CI", "true")
+	require.Equal(t, FromCI, PushingFrom())
+	t.Setenv("CI", "")
+	require.Equal(t, FromLocal, PushingFrom())
+}
@@ -0,0 +1,215 @@
+package predict
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// crashLogSize is how much of the end of the container's logs is kept for
+// crash bundles
+const crashLogSize = 1024 * 1024
+
+// maxCrashBundles is how many crash bundles are kept in a project. The
+// oldest are removed when a new one is written.
+const maxCrashBundles = 10
+
+// maxInputLength is the length strings in the request of a crash bundle are
+// cut to
+const maxInputLength = 1024
+
+// secretInputName matches the names of inputs whose values are left out of
+// crash bundles, so they can be attached to bug reports
+var secretInputName = regexp.MustCompile(`(?i)(token|secret|password|passwd|api_?key|credential)`)
+
+// crashState is what's kept while the container runs in case it crashes.
+// It's shared by copies of a Predictor.
+type crashState struct {
+	mu       sync.Mutex
+	logs     []byte
+	logsDone chan struct{}
+	input    map[string]string
+}
+
+func newCrashState() *crashState {
+	return &crashState{logsDone: make(chan struct{})}
+}
+
+// Write keeps the last crashLogSize bytes of the container's logs.
+func (s *crashState) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs = append(s.logs, p...)
+	if len(s.logs) > crashLogSize {
+		s.logs = s.logs[len(s.logs)-crashLogSize:]
+	}
+	return len(p), nil
+}
+
+func (s *crashState) setInput(input map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.input = input
+}
+
+// Crashed returns whether the container has stopped. Containers are removed
+// when they stop, so it can't be inspected afterwards.
+func (p *Predictor) Crashed() bool {
+	if p.containerID == "" {
+		return true
+	}
+	cont, err := docker.ContainerInspect(p.containerID)
+	if err != nil {
+		return true
+	}
+	return cont.State == nil || !cont.State.Running
+}
+
+// WriteCrashBundle writes what's needed to debug a crash of setup or a
+// prediction to a new directory, .cog/crash-<timestamp> in dir, and returns
+// its path. The bundle has the error, the container's logs, any OOM kills
+// in the kernel log, the state of the GPUs, the request with its files and
+// secrets left out, and the versions of Cog and Docker. Like the rest of
+// .cog, it isn't copied into images, and only the newest maxCrashBundles
+// are kept.
+func (p *Predictor) WriteCrashBundle(dir string, cause error) (string, error) {
+	bundle := filepath.Join(dir, ".cog", "crash-"+time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(bundle, 0o755); err != nil {
+		return "", fmt.Errorf("Failed to create %s: %w", bundle, err)
+	}
+
+	// The rest of the logs are written as the container stops
+	if p.Crashed() {
+		select {
+		case <-p.crash.logsDone:
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	p.crash.mu.Lock()
+	logs := append([]byte{}, p.crash.logs...)
+	input := p.crash.input
+	p.crash.mu.Unlock()
+
+	files := map[string][]byte{
+		"error.txt": []byte(cause.Error() + "\n"),
+		"logs.txt":  logs,
+		"oom.txt":   []byte(oomKills()),
+	}
+	if p.runOptions.GPUVendor == docker.GPUVendorAMD {
+		files["gpu.txt"] = []byte(commandOutput("rocm-smi"))
+	} else if p.runOptions.GPUs != "" || len(p.runOptions.Devices) > 0 {
+		files["gpu.txt"] = []byte(commandOutput("nvidia-smi"))
+	}
+	if input != nil {
+		request, err := json.MarshalIndent(map[string]interface{}{"input": redactInput(input)}, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		files["request.json"] = request
+	}
+	versions, err := json.MarshalIndent(map[string]string{
+		"cog":        global.Version,
+		"cog_commit": global.Commit,
+		"docker":     strings.TrimSpace(commandOutput("docker", "version", "--format", "{{.Server.Version}}")),
+		"image":      p.runOptions.Image,
+		"platform":   runtime.GOOS + "/" + runtime.GOARCH,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files["versions.json"] = versions
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(bundle, name), content, 0o644); err != nil {
+			return "", fmt.Errorf("Failed to write %s: %w", name, err)
+		}
+	}
+	if err := pruneCrashBundles(dir, maxCrashBundles); err != nil {
+		console.Warnf("Failed to remove old crash bundles: %s", err)
+	}
+	return bundle, nil
+}
+
+// pruneCrashBundles removes the oldest crash bundles in dir, so only the
+// newest keep are kept. Their names sort in the order they were written.
+func pruneCrashBundles(dir string, keep int) error {
+	bundles, err := filepath.Glob(filepath.Join(dir, ".cog", "crash-*"))
+	if err != nil {
+		return err
+	}
+	if len(bundles) <= keep {
+		return nil
+	}
+	sort.Strings(bundles)
+	for _, bundle := range bundles[:len(bundles)-keep] {
+		if err := os.RemoveAll(bundle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactInput returns a copy of a prediction's input that's safe to attach
+// to a bug report. Files are replaced with their type and size, inputs that
+// look like secrets are left out, and long strings are shortened.
+func redactInput(input map[string]string) map[string]string {
+	redacted := map[string]string{}
+	for name, value := range input {
+		switch {
+		case secretInputName.MatchString(name):
+			redacted[name] = "<redacted>"
+		case strings.HasPrefix(value, "data:"):
+			mediaType := strings.SplitN(strings.TrimPrefix(value, "data:"), ";", 2)[0]
+			redacted[name] = fmt.Sprintf("<%s file, %d bytes encoded>", mediaType, len(value))
+		case len(value) > maxInputLength:
+			redacted[name] = value[:maxInputLength] + fmt.Sprintf("... (%d bytes)", len(value))
+		default:
+			redacted[name] = value
+		}
+	}
+	return redacted
+}
+
+// oomKills returns the lines about the OOM killer in the kernel log. Reading
+// it can need root, so the error is returned in its place if it fails.
+func oomKills() string {
+	out, err := exec.Command("dmesg").CombinedOutput()
+	if err != nil {
+		return fmt.Sprintf("Failed to read the kernel log: %s\n%s", err, out)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "oom") || strings.Contains(lower, "out of memory") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return "There are no OOM kills in the kernel log\n"
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// commandOutput returns the output of a command, or why it couldn't be run.
+func commandOutput(name string, args ...string) string {
+	cmd := exec.Command(name, args...)
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Sprintf("Failed to run %s: %s\n%s", name, err, out)
+	}
+	return string(out)
+}
@@ -0,0 +1,53 @@
+package predict
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactInput(t *testing.T) {
+	long := strings.Repeat("a", maxInputLength+10)
+	redacted := redactInput(map[string]string{
+		"prompt":    "a photo of a cat",
+		"image":     "data:image/png;base64,aGk=",
+		"hf_token":  "hf_abc",
+		"API_KEY":   "sk-123",
+		"long_text": long,
+	})
+	require.Equal(t, "a photo of a cat", redacted["prompt"])
+	require.Equal(t, "<image/png file, 26 bytes encoded>", redacted["image"])
+	require.Equal(t, "<redacted>", redacted["hf_token"])
+	require.Equal(t, "<redacted>", redacted["API_KEY"])
+	require.Equal(t, long[:maxInputLength]+"... (1034 bytes)", redacted["long_text"])
+}
+
+func TestCrashStateKeepsEndOfLogs(t *testing.T) {
+	state := newCrashState()
+	_, err := state.Write([]byte(strings.Repeat("a\n", crashLogSize/2)))
+	require.NoError(t, err)
+	_, err = state.Write([]byte("setup failed\n"))
+	require.NoError(t, err)
+	require.Len(t, state.logs, crashLogSize)
+	require.True(t, strings.HasSuffix(string(state.logs), "a\nsetup failed\n"))
+}
+
+func TestPruneCrashBundles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"crash-20240102T000000Z", "crash-20240101T000000Z", "crash-20240103T000000Z"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, ".cog", name), 0o755))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".cog", "history"), 0o755))
+
+	require.NoError(t, pruneCrashBundles(dir, 3))
+	require.DirExists(t, filepath.Join(dir, ".cog", "crash-20240101T000000Z"))
+
+	require.NoError(t, pruneCrashBundles(dir, 2))
+	require.NoDirExists(t, filepath.Join(dir, ".cog", "crash-20240101T000000Z"))
+	require.DirExists(t, filepath.Join(dir, ".cog", "crash-20240102T000000Z"))
+	require.DirExists(t, filepath.Join(dir, ".cog", "crash-20240103T000000Z"))
+	require.DirExists(t, filepath.Join(dir, ".cog", "history"))
+}
@@ -0,0 +1,142 @@
+package predict
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Detached is a prediction started by `cog predict --detach`, which carries
+// on in a container that's left running after Cog exits. It's recorded in
+// the project's .cog directory, so it can be found again by its ID.
+type Detached struct {
+	ID          string `json:"id"`
+	ContainerID string `json:"container_id"`
+	Host        string `json:"host,omitempty"`
+	Port        int    `json:"port"`
+}
+
+// ErrUnknownPrediction is returned when a detached prediction isn't
+// recorded, or the container running it doesn't know of it.
+var ErrUnknownPrediction = errors.New("There's no detached prediction with that ID")
+
+// Done returns whether the prediction has finished, whether or not it
+// succeeded.
+func (r *Response) Done() bool {
+	switch r.Status {
+	case "succeeded", "failed", "canceled", "preempted":
+		return true
+	}
+	return false
+}
+
+func detachedPath(dir string, id string) string {
+	return filepath.Join(dir, ".cog", "predictions", id+".json")
+}
+
+// PredictAsync starts a prediction with an ID, without waiting for it to
+// finish, so its progress can be fetched with GetPrediction.
+func (p *Predictor) PredictAsync(inputs Inputs, model string, id string) (*Response, error) {
+	inputMap, err := inputs.toMap()
+	if err != nil {
+		return nil, err
+	}
+	requestBody, err := json.Marshal(Request{Input: inputMap, Model: model, ID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	u := p.url("/predictions")
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create HTTP request to %s: %w", u, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async")
+	req.Close = true
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to POST HTTP request to %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		errorResponse := &ValidationErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(errorResponse); err != nil {
+			return nil, fmt.Errorf("/predictions call returned status 422, and the response body failed to decode: %w", err)
+		}
+		return nil, buildInputValidationErrorMessage(errorResponse)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("/predictions call returned status %d", resp.StatusCode)
+	}
+	return decodeResponse(resp.Header.Get("Content-Type"), resp.Body)
+}
+
+// GetPrediction returns the status of a prediction started with
+// PredictAsync, and its output once it has any.
+func (p *Predictor) GetPrediction(id string) (*Response, error) {
+	u := p.url("/predictions/" + url.PathEscape(id))
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get prediction %s. The container running it might have stopped: %w", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUnknownPrediction
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %d", u, resp.StatusCode)
+	}
+	return decodeResponse(resp.Header.Get("Content-Type"), resp.Body)
+}
+
+// Detach records the prediction id, running in the predictor's container,
+// in dir, so it can be found after Cog exits.
+func (p *Predictor) Detach(dir string, id string) error {
+	detached := Detached{ID: id, ContainerID: p.containerID, Host: p.host, Port: p.port}
+	data, err := json.MarshalIndent(detached, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := detachedPath(dir, id)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
+
+// LoadDetached returns the prediction id that was detached in dir.
+func LoadDetached(dir string, id string) (*Detached, error) {
+	data, err := os.ReadFile(detachedPath(dir, id))
+	if os.IsNotExist(err) {
+		return nil, ErrUnknownPrediction
+	} else if err != nil {
+		return nil, err
+	}
+	detached := &Detached{}
+	if err := json.Unmarshal(data, detached); err != nil {
+		return nil, fmt.Errorf("Failed to read detached prediction %s: %w", id, err)
+	}
+	return detached, nil
+}
+
+// Remove forgets the detached prediction.
+func (d *Detached) Remove(dir string) error {
+	if err := os.Remove(detachedPath(dir, d.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Predictor returns a predictor for the container the prediction is
+// running in.
+func (d *Detached) Predictor() Predictor {
+	return Predictor{containerID: d.ContainerID, host: d.Host, port: d.Port, crash: newCrashState()}
+}
@@ -0,0 +1,33 @@
+package predict
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetach(t *testing.T) {
+	dir := t.TempDir()
+	predictor := Predictor{containerID: "abc123", host: "127.0.0.1", port: 5001, crash: newCrashState()}
+	require.NoError(t, predictor.Detach(dir, "3f2a9c1d"))
+
+	detached, err := LoadDetached(dir, "3f2a9c1d")
+	require.NoError(t, err)
+	require.Equal(t, Detached{ID: "3f2a9c1d", ContainerID: "abc123", Host: "127.0.0.1", Port: 5001}, *detached)
+
+	p := detached.Predictor()
+	require.Equal(t, "abc123", p.containerID)
+	require.Equal(t, 5001, p.port)
+
+	require.NoError(t, detached.Remove(dir))
+	_, err = LoadDetached(dir, "3f2a9c1d")
+	require.True(t, errors.Is(err, ErrUnknownPrediction))
+}
+
+func TestResponseDone(t *testing.T) {
+	require.False(t, (&Response{Status: "starting"}).Done())
+	require.False(t, (&Response{Status: "processing"}).Done())
+	require.True(t, (&Response{Status: "succeeded"}).Done())
+	require.True(t, (&Response{Status: "preempted"}).Done())
+}
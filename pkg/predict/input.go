@@ -1,11 +1,14 @@
 package predict
 
 import (
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/mitchellh/go-homedir"
+	"github.com/replicate/cog/pkg/storage"
 	"github.com/replicate/cog/pkg/util/console"
 	"github.com/replicate/cog/pkg/util/mime"
 	"github.com/vincent-petithory/dataurl"
@@ -14,6 +17,9 @@ import (
 type Input struct {
 	String *string
 	File   *string
+	// URI is a file on cloud storage or an HTTP server, which is downloaded
+	// on the host
+	URI *string
 }
 
 type Inputs map[string]Input
@@ -22,7 +28,10 @@ func NewInputs(keyVals map[string]string) Inputs {
 	input := Inputs{}
 	for key, val := range keyVals {
 		val := val
-		if strings.HasPrefix(val, "@") {
+		if strings.HasPrefix(val, "@") && storage.IsURI(val[1:]) {
+			val = val[1:]
+			input[key] = Input{URI: &val}
+		} else if strings.HasPrefix(val, "@") {
 			val = val[1:]
 			expandedVal, err := homedir.Expand(val)
 			if err != nil {
@@ -60,13 +69,45 @@ func (inputs *Inputs) toMap() (map[string]string, error) {
 		if input.String != nil {
 			keyVals[key] = *input.String
 		} else if input.File != nil {
-			content, err := os.ReadFile(*input.File)
+			dataURL, err := readInput(*input.File)
 			if err != nil {
 				return keyVals, err
 			}
-			mimeType := mime.TypeByExtension(filepath.Ext(*input.File))
-			keyVals[key] = dataurl.New(content, mimeType).String()
+			keyVals[key] = dataURL
+		} else if input.URI != nil {
+			dataURL, err := downloadInput(*input.URI)
+			if err != nil {
+				return keyVals, err
+			}
+			keyVals[key] = dataURL
 		}
 	}
 	return keyVals, nil
 }
+
+// readInput returns the file at path as a data URL.
+func readInput(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return dataurl.New(content, mime.TypeByExtension(filepath.Ext(path))).String(), nil
+}
+
+// downloadInput returns the file at uri as a data URL.
+func downloadInput(uri string) (string, error) {
+	tempPath, err := storage.DownloadTemp(uri)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempPath)
+	content, err := os.ReadFile(tempPath)
+	if err != nil {
+		return "", err
+	}
+	ext := ""
+	if u, err := url.Parse(uri); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	return dataurl.New(content, mime.TypeByExtension(ext)).String(), nil
+}
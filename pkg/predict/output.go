@@ -0,0 +1,123 @@
+package predict
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// OutputFile is an output file that was sent as a part of a multipart
+// response, and has been written to a temporary file
+type OutputFile struct {
+	Path        string
+	ContentType string
+	// Filename is the name of the file in the container, if it has one
+	Filename string
+}
+
+// cidPrefix is the prefix of outputs that refer to a part of a multipart
+// response, rather than being a data URI
+const cidPrefix = "cid:"
+
+// File returns the file an output refers to, if it was sent as a part of a
+// multipart response.
+func (r *Response) File(output string) (*OutputFile, bool) {
+	if !strings.HasPrefix(output, cidPrefix) {
+		return nil, false
+	}
+	file, ok := r.Files[strings.TrimPrefix(output, cidPrefix)]
+	return file, ok
+}
+
+// Cleanup removes the temporary files of outputs that haven't been moved
+// somewhere else.
+func (r *Response) Cleanup() {
+	for _, file := range r.Files {
+		if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+			console.Warnf("Failed to remove %s: %s", file.Path, err)
+		}
+	}
+}
+
+// decodeResponse decodes the body of a prediction response, which is either
+// JSON, or a multipart response of the JSON followed by the large output
+// files.
+func decodeResponse(contentType string, body io.Reader) (*Response, error) {
+	prediction := &Response{}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/mixed" {
+		if err := json.NewDecoder(body).Decode(prediction); err != nil {
+			return nil, fmt.Errorf("Failed to decode prediction response: %w", err)
+		}
+		return prediction, nil
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read prediction response: %w", err)
+	}
+	if err := json.NewDecoder(part).Decode(prediction); err != nil {
+		return nil, fmt.Errorf("Failed to decode prediction response: %w", err)
+	}
+
+	prediction.Files = map[string]*OutputFile{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			prediction.Cleanup()
+			return nil, fmt.Errorf("Failed to read output file: %w", err)
+		}
+		file, err := readOutputFile(part)
+		if err != nil {
+			prediction.Cleanup()
+			return nil, err
+		}
+		prediction.Files[strings.Trim(part.Header.Get("Content-ID"), "<>")] = file
+	}
+	return prediction, nil
+}
+
+// readOutputFile writes a part of a multipart response to a temporary file,
+// showing the progress as it goes.
+func readOutputFile(part *multipart.Part) (*OutputFile, error) {
+	file := &OutputFile{
+		ContentType: part.Header.Get("Content-Type"),
+		Filename:    part.FileName(),
+	}
+	f, err := os.CreateTemp("", "cog-output-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a temporary file for output: %w", err)
+	}
+	file.Path = f.Name()
+
+	size, err := strconv.ParseInt(part.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	label := file.Filename
+	if label == "" {
+		label = "output"
+	}
+	progress := console.NewProgress("Downloading "+label, size)
+	_, err = io.Copy(io.MultiWriter(f, progress), part)
+	progress.Finish()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Path)
+		return nil, fmt.Errorf("Failed to write output to %s: %w", file.Path, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,60 @@
+package predict
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeResponseJSON(t *testing.T) {
+	prediction, err := decodeResponse("application/json", strings.NewReader(`{"status": "succeeded", "output": "data:text/plain;base64,aGk="}`))
+	require.NoError(t, err)
+	require.Equal(t, status("succeeded"), prediction.Status)
+	require.Empty(t, prediction.Files)
+}
+
+func TestDecodeResponseMultipart(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	require.NoError(t, err)
+	_, err = part.Write([]byte(`{"status": "succeeded", "output": "cid:output-0"}`))
+	require.NoError(t, err)
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"image/png"},
+		"Content-Id":          {"<output-0>"},
+		"Content-Length":      {"5"},
+		"Content-Disposition": {"attachment; filename*=UTF-8''out.png"},
+	})
+	require.NoError(t, err)
+	_, err = part.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	prediction, err := decodeResponse("multipart/mixed; boundary="+writer.Boundary(), body)
+	require.NoError(t, err)
+	defer prediction.Cleanup()
+
+	file, ok := prediction.File((*prediction.Output).(string))
+	require.True(t, ok)
+	require.Equal(t, "image/png", file.ContentType)
+	require.Equal(t, "out.png", file.Filename)
+	content, err := os.ReadFile(file.Path)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+
+	prediction.Cleanup()
+	_, err = os.Stat(file.Path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestResponseFileNotCID(t *testing.T) {
+	prediction := &Response{}
+	_, ok := prediction.File("data:text/plain;base64,aGk=")
+	require.False(t, ok)
+}
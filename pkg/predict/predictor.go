@@ -2,14 +2,20 @@ package predict
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/replicate/cog/pkg/config"
 	"github.com/replicate/cog/pkg/docker"
 	"github.com/replicate/cog/pkg/global"
 	"github.com/replicate/cog/pkg/util/console"
@@ -24,12 +30,24 @@ type HealthcheckResponse struct {
 type Request struct {
 	// TODO: could this be Inputs?
 	Input map[string]string `json:"input"`
+	// Model is the variant from cog.yaml to run the prediction with
+	Model string `json:"model,omitempty"`
+	// ID identifies a prediction that's started without waiting for it
+	ID string `json:"id,omitempty"`
 }
 
 type Response struct {
 	Status status       `json:"status"`
 	Output *interface{} `json:"output"`
 	Error  string       `json:"error"`
+
+	// Files are the output files sent after the JSON in a multipart
+	// response, by content ID
+	Files map[string]*OutputFile `json:"-"`
+	// Inputs are the prediction's inputs, with files as data URLs, and
+	// InputsHash is their SHA256
+	Inputs     map[string]string `json:"-"`
+	InputsHash string            `json:"-"`
 }
 
 type ValidationErrorResponse struct {
@@ -45,7 +63,10 @@ type Predictor struct {
 
 	// Running state
 	containerID string
+	host        string
 	port        int
+
+	crash *crashState
 }
 
 func NewPredictor(runOptions docker.RunOptions) Predictor {
@@ -54,14 +75,41 @@ func NewPredictor(runOptions docker.RunOptions) Predictor {
 	} else {
 		runOptions.Env = append(runOptions.Env, "COG_LOG_LEVEL=warning")
 	}
-	return Predictor{runOptions: runOptions}
+	return Predictor{runOptions: runOptions, crash: newCrashState()}
+}
+
+// ContainerPort returns the port the HTTP server listens on in image: the
+// one it exposes, which is serving.port in cog.yaml, or 5000 if it doesn't
+// expose one.
+func ContainerPort(image string) int {
+	inspect, err := docker.ImageInspect(image)
+	if err != nil || inspect.Config == nil || len(inspect.Config.ExposedPorts) != 1 {
+		return config.DefaultServingPort
+	}
+	for port := range inspect.Config.ExposedPorts {
+		if port.Proto() == "tcp" {
+			return port.Int()
+		}
+	}
+	return config.DefaultServingPort
 }
 
 func (p *Predictor) Start(logsWriter io.Writer) error {
 	var err error
-	containerPort := 5000
 
-	p.runOptions.Ports = append(p.runOptions.Ports, docker.Port{HostPort: 0, ContainerPort: containerPort})
+	containerPort := ContainerPort(p.runOptions.Image)
+
+	// The port can be published by the caller, on a particular address
+	published := false
+	for _, port := range p.runOptions.Ports {
+		if port.ContainerPort == containerPort {
+			p.host = port.HostIP
+			published = true
+		}
+	}
+	if !published {
+		p.runOptions.Ports = append(p.runOptions.Ports, docker.Port{HostPort: 0, ContainerPort: containerPort})
+	}
 
 	p.containerID, err = docker.RunDaemon(p.runOptions)
 	if err != nil {
@@ -74,7 +122,8 @@ func (p *Predictor) Start(logsWriter io.Writer) error {
 	}
 
 	go func() {
-		if err := docker.ContainerLogsFollow(p.containerID, logsWriter); err != nil {
+		defer close(p.crash.logsDone)
+		if err := docker.ContainerLogsFollow(p.containerID, io.MultiWriter(logsWriter, p.crash)); err != nil {
 			// if user hits ctrl-c we expect an error signal
 			if !strings.Contains(err.Error(), "signal: interrupt") {
 				console.Warnf("Error getting container logs: %s", err)
@@ -86,7 +135,7 @@ func (p *Predictor) Start(logsWriter io.Writer) error {
 }
 
 func (p *Predictor) waitForContainerReady() error {
-	url := fmt.Sprintf("http://localhost:%d/health-check", p.port)
+	url := p.url("/health-check")
 
 	start := time.Now()
 	for {
@@ -102,6 +151,9 @@ func (p *Predictor) waitForContainerReady() error {
 			return fmt.Errorf("Failed to get container status: %w", err)
 		}
 		if cont.State != nil && (cont.State.Status == "exited" || cont.State.Status == "dead") {
+			if cont.State.OOMKilled {
+				return p.outOfMemoryError("setup")
+			}
 			return fmt.Errorf("Container exited unexpectedly")
 		}
 
@@ -130,32 +182,51 @@ func (p *Predictor) waitForContainerReady() error {
 	}
 }
 
+// Image returns the name of the image the predictor runs.
+func (p *Predictor) Image() string {
+	return p.runOptions.Image
+}
+
 func (p *Predictor) Stop() error {
 	return docker.Stop(p.containerID)
 }
 
-func (p *Predictor) Predict(inputs Inputs) (*Response, error) {
+// Predict runs a prediction. model is the variant from cog.yaml to run it
+// with, or empty for the default.
+func (p *Predictor) Predict(inputs Inputs, model string) (*Response, error) {
 	inputMap, err := inputs.toMap()
 	if err != nil {
 		return nil, err
 	}
-	request := Request{Input: inputMap}
+	p.crash.setInput(inputMap)
+	request := Request{Input: inputMap, Model: model}
 	requestBody, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
+	inputsHash, err := hashInputs(inputMap)
+	if err != nil {
+		return nil, err
+	}
 
-	url := fmt.Sprintf("http://localhost:%d/predictions", p.port)
+	url := p.url("/predictions")
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create HTTP request to %s: %w", url, err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	// Output files are decoded from data URIs, even if the model is
+	// configured to return them as binary. Large files are streamed after
+	// the JSON in a multipart response, so they aren't held in memory.
+	req.Header.Set("Accept", "multipart/mixed, application/json")
 	req.Close = true
 
 	httpClient := &http.Client{}
 	resp, err := httpClient.Do(req)
 	if err != nil {
+		if p.oomKilled() {
+			return nil, p.outOfMemoryError("inference")
+		}
 		return nil, fmt.Errorf("Failed to POST HTTP request to %s: %w", url, err)
 	}
 	defer resp.Body.Close()
@@ -173,15 +244,64 @@ func (p *Predictor) Predict(inputs Inputs) (*Response, error) {
 		return nil, fmt.Errorf("/predictions call returned status %d", resp.StatusCode)
 	}
 
-	prediction := &Response{}
-	if err = json.NewDecoder(resp.Body).Decode(prediction); err != nil {
-		return nil, fmt.Errorf("Failed to decode prediction response: %w", err)
+	prediction, err := decodeResponse(resp.Header.Get("Content-Type"), resp.Body)
+	if err != nil {
+		return nil, err
 	}
+	prediction.Inputs = inputMap
+	prediction.InputsHash = inputsHash
 	return prediction, nil
 }
 
+// hashInputs returns the SHA256 of inputs, which is the same whatever order
+// they were passed in.
+func hashInputs(inputs map[string]string) (string, error) {
+	// Maps are encoded with their keys sorted
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// PredictJSON runs a prediction with inputs that are already JSON values,
+// like the inputs of requests captured from a queue, and returns the status
+// code of the response along with the prediction. Output files are returned
+// as data URIs. The prediction is nil if the response wasn't a prediction,
+// like a validation error.
+func (p *Predictor) PredictJSON(input map[string]interface{}) (int, *Response, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	url := p.url("/predictions")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to create HTTP request to %s: %w", url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Close = true
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to POST HTTP request to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil, nil
+	}
+	prediction := &Response{}
+	if err := json.NewDecoder(resp.Body).Decode(prediction); err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("Failed to decode prediction response: %w", err)
+	}
+	return resp.StatusCode, prediction, nil
+}
+
 func (p *Predictor) GetSchema() (*openapi3.T, error) {
-	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/openapi.json", p.port))
+	resp, err := http.Get(p.url("/openapi.json"))
 	if err != nil {
 		return nil, err
 	}
@@ -196,6 +316,45 @@ func (p *Predictor) GetSchema() (*openapi3.T, error) {
 	return openapi3.NewLoader().LoadFromData(body)
 }
 
+// oomKilled returns whether the container was killed for running out of
+// memory. It can only tell if the container hasn't been removed yet.
+func (p *Predictor) oomKilled() bool {
+	cont, err := docker.ContainerInspect(p.containerID)
+	if err != nil {
+		return false
+	}
+	return cont.State != nil && cont.State.OOMKilled
+}
+
+// outOfMemoryError explains that the container ran out of memory during
+// phase, rather than just that it exited with status 137.
+func (p *Predictor) outOfMemoryError(phase string) error {
+	if p.runOptions.Memory > 0 {
+		return fmt.Errorf("The container exceeded its %s memory limit during %s. Raise resources.memory in cog.yaml to give it more", units.BytesSize(float64(p.runOptions.Memory)), phase)
+	}
+	return fmt.Errorf("The container ran out of memory during %s", phase)
+}
+
+// url returns the URL of path on the container's HTTP server.
+func (p *Predictor) url(path string) string {
+	return "http://" + net.JoinHostPort(dialHost(p.host), strconv.Itoa(p.port)) + path
+}
+
+// dialHost returns the host to connect to a port published on host. A port
+// published on an unspecified address is connected to over loopback, of the
+// same IP version so it works on hosts that only have IPv6.
+func dialHost(host string) string {
+	switch host {
+	case "":
+		return "localhost"
+	case "0.0.0.0":
+		return "127.0.0.1"
+	case "::":
+		return "::1"
+	}
+	return host
+}
+
 func buildInputValidationErrorMessage(errorResponse *ValidationErrorResponse) error {
 	errorMessages := []string{}
 
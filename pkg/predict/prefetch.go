@@ -0,0 +1,70 @@
+package predict
+
+// Prefetch reads the files and downloads the URIs of inputs in the
+// background, so it can overlap with building or pulling an image and
+// starting its container.
+type Prefetch struct {
+	// By file path or URI
+	results map[string]*prefetchResult
+}
+
+type prefetchResult struct {
+	done    chan struct{}
+	dataURL string
+	err     error
+}
+
+// PrefetchInputs starts loading each file and URI in inputs in its own
+// goroutine.
+func PrefetchInputs(inputs Inputs) *Prefetch {
+	p := &Prefetch{results: map[string]*prefetchResult{}}
+	for _, input := range inputs {
+		var source string
+		var load func(string) (string, error)
+		switch {
+		case input.File != nil:
+			source, load = *input.File, readInput
+		case input.URI != nil:
+			source, load = *input.URI, downloadInput
+		default:
+			continue
+		}
+		if _, ok := p.results[source]; ok {
+			continue
+		}
+		result := &prefetchResult{done: make(chan struct{})}
+		p.results[source] = result
+		go func() {
+			defer close(result.done)
+			result.dataURL, result.err = load(source)
+		}()
+	}
+	return p
+}
+
+// Resolve returns inputs with the files and URIs that were prefetched
+// replaced by their contents as data URLs, waiting for any that are still
+// loading. Inputs that weren't prefetched are left as they are.
+func (p *Prefetch) Resolve(inputs Inputs) (Inputs, error) {
+	resolved := Inputs{}
+	for key, input := range inputs {
+		source := ""
+		if input.File != nil {
+			source = *input.File
+		} else if input.URI != nil {
+			source = *input.URI
+		}
+		result, ok := p.results[source]
+		if source == "" || !ok {
+			resolved[key] = input
+			continue
+		}
+		<-result.done
+		if result.err != nil {
+			return nil, result.err
+		}
+		dataURL := result.dataURL
+		resolved[key] = Input{String: &dataURL}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,32 @@
+package predict
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello"), 0o644))
+
+	prefetch := PrefetchInputs(NewInputs(map[string]string{"0": "@" + path}))
+	inputs, err := prefetch.Resolve(NewInputs(map[string]string{"text": "@" + path, "n": "3"}))
+	require.NoError(t, err)
+	require.Equal(t, "data:text/plain;base64,aGVsbG8=", *inputs["text"].String)
+	require.Equal(t, "3", *inputs["n"].String)
+
+	// Inputs that weren't prefetched are loaded as usual
+	inputs, err = prefetch.Resolve(NewInputs(map[string]string{"other": "@other.txt"}))
+	require.NoError(t, err)
+	require.Equal(t, "other.txt", *inputs["other"].File)
+}
+
+func TestPrefetchMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.txt")
+	prefetch := PrefetchInputs(NewInputs(map[string]string{"0": "@" + path}))
+	_, err := prefetch.Resolve(NewInputs(map[string]string{"text": "@" + path}))
+	require.Error(t, err)
+}
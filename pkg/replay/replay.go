@@ -0,0 +1,224 @@
+// Package replay compares how a local build of a model responds to requests
+// captured in production with how production responded.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+// Lines can contain data URIs, so they can be much longer than bufio's
+// default limit
+const maxLineSize = 256 * 1024 * 1024
+
+// Request is a captured request. It's in the format of messages on the
+// prediction queue, with what production responded with, if it was captured.
+type Request struct {
+	ID    string                 `json:"id"`
+	Input map[string]interface{} `json:"input"`
+	// StatusCode is the status code of production's response
+	StatusCode int `json:"status_code"`
+	// Response is the completed prediction, as it was sent to the webhook
+	Response *Prediction `json:"response"`
+
+	// Line is the line of the file it was read from
+	Line int `json:"-"`
+}
+
+// Prediction is the outcome of a prediction
+type Prediction struct {
+	Status string      `json:"status"`
+	Output interface{} `json:"output"`
+	Error  string      `json:"error"`
+}
+
+// Name returns the ID of the request, or its line if it doesn't have one.
+func (r *Request) Name() string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return fmt.Sprintf("line %d", r.Line)
+}
+
+// ReadRequests reads requests from newline-delimited JSON.
+func ReadRequests(r io.Reader) ([]*Request, error) {
+	requests := []*Request{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		request := &Request{Line: line}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		// Keep numbers as they were written, so they aren't compared
+		// with float rounding
+		decoder.UseNumber()
+		if err := decoder.Decode(request); err != nil {
+			return nil, fmt.Errorf("Failed to parse line %d: %w", line, err)
+		}
+		if request.Input == nil {
+			return nil, fmt.Errorf("The request on line %d doesn't have an input", line)
+		}
+		requests = append(requests, request)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// Compare returns the differences between production's response to request
+// and the local build's. prediction is nil if the local build didn't respond
+// with a prediction. Numbers in outputs are the same if they're within
+// tolerance of each other.
+func Compare(request *Request, statusCode int, prediction *Prediction, tolerance float64) []string {
+	diffs := []string{}
+	if request.StatusCode != 0 && !sameStatusCode(request.StatusCode, statusCode) {
+		diffs = append(diffs, fmt.Sprintf("status code: %d in production, %d locally", request.StatusCode, statusCode))
+	}
+	if request.Response == nil {
+		return diffs
+	}
+	if prediction == nil {
+		return append(diffs, fmt.Sprintf("status: %s in production, but the local build responded with status code %d", request.Response.Status, statusCode))
+	}
+	if request.Response.Status != prediction.Status {
+		diff := fmt.Sprintf("status: %s in production, %s locally", request.Response.Status, prediction.Status)
+		if prediction.Error != "" {
+			diff += ": " + prediction.Error
+		}
+		return append(diffs, diff)
+	}
+	if prediction.Status == "succeeded" {
+		diffs = append(diffs, compareValues("output", request.Response.Output, prediction.Output, tolerance)...)
+	}
+	return diffs
+}
+
+// sameStatusCode compares status codes, treating the 202 of an asynchronous
+// prediction as the same as the 200 of a synchronous one.
+func sameStatusCode(production int, local int) bool {
+	if production == 202 {
+		production = 200
+	}
+	return production == local
+}
+
+func compareValues(path string, production interface{}, local interface{}, tolerance float64) []string {
+	switch p := production.(type) {
+	case map[string]interface{}:
+		l, ok := local.(map[string]interface{})
+		if !ok {
+			return []string{differs(path, production, local)}
+		}
+		keys := map[string]bool{}
+		for k := range p {
+			keys[k] = true
+		}
+		for k := range l {
+			keys[k] = true
+		}
+		names := []string{}
+		for k := range keys {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		diffs := []string{}
+		for _, k := range names {
+			diffs = append(diffs, compareValues(path+"."+k, p[k], l[k], tolerance)...)
+		}
+		return diffs
+	case []interface{}:
+		l, ok := local.([]interface{})
+		if !ok || len(l) != len(p) {
+			return []string{differs(path, production, local)}
+		}
+		diffs := []string{}
+		for i := range p {
+			diffs = append(diffs, compareValues(fmt.Sprintf("%s[%d]", path, i), p[i], l[i], tolerance)...)
+		}
+		return diffs
+	case json.Number:
+		a, err := p.Float64()
+		b, ok := toFloat(local)
+		if err != nil || !ok || math.Abs(a-b) > tolerance {
+			return []string{differs(path, production, local)}
+		}
+		return nil
+	case string:
+		l, ok := local.(string)
+		if ok && isFile(p) && isFile(l) {
+			// Production's files are usually uploaded, so they can only be
+			// compared if both are data URIs
+			if same, comparable := sameFile(p, l); comparable && !same {
+				return []string{fmt.Sprintf("%s: the files are different", path)}
+			}
+			return nil
+		}
+	}
+	if !reflect.DeepEqual(production, local) {
+		return []string{differs(path, production, local)}
+	}
+	return nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func isFile(s string) bool {
+	return strings.HasPrefix(s, "data:") || strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func sameFile(production string, local string) (same bool, comparable bool) {
+	a, err := dataurl.DecodeString(production)
+	if err != nil {
+		return false, false
+	}
+	b, err := dataurl.DecodeString(local)
+	if err != nil {
+		return false, false
+	}
+	return bytes.Equal(a.Data, b.Data), true
+}
+
+func differs(path string, production interface{}, local interface{}) string {
+	return fmt.Sprintf("%s: %s in production, %s locally", path, summarize(production), summarize(local))
+}
+
+// summarize returns a value as JSON, shortened so long outputs don't fill
+// the terminal.
+func summarize(v interface{}) string {
+	if v == nil {
+		return "nothing"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	s := string(b)
+	if len(s) > 60 {
+		s = s[:57] + "..."
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package replay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRequests(t *testing.T) {
+	requests, err := ReadRequests(strings.NewReader(`{"id": "a", "input": {"n": 3}, "status_code": 202, "response": {"status": "succeeded", "output": 9}}
+
+{"input": {"text": "hello"}, "webhook": "https://example.com/webhook"}
+`))
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	require.Equal(t, "a", requests[0].Name())
+	require.Equal(t, 202, requests[0].StatusCode)
+	require.Equal(t, "succeeded", requests[0].Response.Status)
+	require.Equal(t, "line 3", requests[1].Name())
+	require.Nil(t, requests[1].Response)
+}
+
+func TestReadRequestsInvalid(t *testing.T) {
+	_, err := ReadRequests(strings.NewReader("{\"input\": {}}\nnot json\n"))
+	require.ErrorContains(t, err, "line 2")
+
+	_, err = ReadRequests(strings.NewReader(`{"id": "a"}`))
+	require.ErrorContains(t, err, "doesn't have an input")
+}
+
+func readRequest(t *testing.T, line string) *Request {
+	requests, err := ReadRequests(strings.NewReader(line))
+	require.NoError(t, err)
+	return requests[0]
+}
+
+func TestCompareSame(t *testing.T) {
+	request := readRequest(t, `{"input": {}, "status_code": 202, "response": {"status": "succeeded", "output": {"score": 0.5, "labels": ["cat"]}}}`)
+	local := &Prediction{Status: "succeeded", Output: map[string]interface{}{"score": 0.5, "labels": []interface{}{"cat"}}}
+	require.Empty(t, Compare(request, 200, local, 0))
+}
+
+func TestCompareStatusCode(t *testing.T) {
+	request := readRequest(t, `{"input": {}, "status_code": 200}`)
+	require.Equal(t, []string{"status code: 200 in production, 422 locally"}, Compare(request, 422, nil, 0))
+}
+
+func TestCompareStatus(t *testing.T) {
+	request := readRequest(t, `{"input": {}, "response": {"status": "succeeded", "output": 1}}`)
+	local := &Prediction{Status: "failed", Error: "CUDA out of memory"}
+	require.Equal(t, []string{"status: succeeded in production, failed locally: CUDA out of memory"}, Compare(request, 200, local, 0))
+}
+
+func TestCompareOutput(t *testing.T) {
+	request := readRequest(t, `{"input": {}, "response": {"status": "succeeded", "output": {"score": 0.5, "label": "cat"}}}`)
+	local := &Prediction{Status: "succeeded", Output: map[string]interface{}{"score": 0.5001, "label": "dog"}}
+	require.Equal(t, []string{
+		`output.label: "cat" in production, "dog" locally`,
+		`output.score: 0.5 in production, 0.5001 locally`,
+	}, Compare(request, 200, local, 0))
+
+	// Within the tolerance, only the label is different
+	require.Len(t, Compare(request, 200, local, 0.001), 1)
+}
+
+func TestCompareFiles(t *testing.T) {
+	// Uploaded files can't be compared
+	request := readRequest(t, `{"input": {}, "response": {"status": "succeeded", "output": "https://example.com/output.png"}}`)
+	require.Empty(t, Compare(request, 200, &Prediction{Status: "succeeded", Output: "data:image/png;base64,aGk="}, 0))
+
+	request = readRequest(t, `{"input": {}, "response": {"status": "succeeded", "output": "data:image/png;base64,aGk="}}`)
+	require.Empty(t, Compare(request, 200, &Prediction{Status: "succeeded", Output: "data:image/png;base64,aGk="}, 0))
+	require.Equal(t, []string{"output: the files are different"}, Compare(request, 200, &Prediction{Status: "succeeded", Output: "data:image/png;base64,aGV5"}, 0))
+}
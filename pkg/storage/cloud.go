@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// S3 is Amazon S3, with s3://bucket/key URIs
+type S3 struct{}
+
+const installAWS = "Install the AWS CLI to use s3:// URIs: https://aws.amazon.com/cli/"
+
+func (s *S3) Download(uri string, path string) error {
+	return runCLI(installAWS, "aws", "s3", "cp", "--only-show-errors", uri, path)
+}
+
+func (s *S3) Upload(path string, uri string) error {
+	return runCLI(installAWS, "aws", "s3", "cp", "--only-show-errors", path, uri)
+}
+
+// GCS is Google Cloud Storage, with gs://bucket/object URIs
+type GCS struct{}
+
+const installGCloud = "Install the Google Cloud CLI to use gs:// URIs: https://cloud.google.com/sdk/docs/install"
+
+func (s *GCS) Download(uri string, path string) error {
+	return runCLI(installGCloud, "gcloud", "storage", "cp", uri, path)
+}
+
+func (s *GCS) Upload(path string, uri string) error {
+	return runCLI(installGCloud, "gcloud", "storage", "cp", path, uri)
+}
+
+// Azure is Azure Blob Storage, with az://account/container/blob URIs
+type Azure struct{}
+
+const installAzure = "Install the Azure CLI to use az:// URIs: https://learn.microsoft.com/cli/azure/install-azure-cli"
+
+func (s *Azure) Download(uri string, path string) error {
+	account, container, blob, err := parseAzureURI(uri)
+	if err != nil {
+		return err
+	}
+	return runCLI(installAzure, "az", "storage", "blob", "download", "--only-show-errors", "--account-name", account, "--container-name", container, "--name", blob, "--file", path, "--overwrite")
+}
+
+func (s *Azure) Upload(path string, uri string) error {
+	account, container, blob, err := parseAzureURI(uri)
+	if err != nil {
+		return err
+	}
+	return runCLI(installAzure, "az", "storage", "blob", "upload", "--only-show-errors", "--account-name", account, "--container-name", container, "--name", blob, "--file", path, "--overwrite")
+}
+
+func parseAzureURI(uri string) (account string, container string, blob string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri[len("az://"):], "/"), "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("%s isn't a valid Azure URI. It should be in the form az://account/container/blob", uri)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
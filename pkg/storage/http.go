@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// HTTP downloads files with GET and uploads them with PUT. Credentials can
+// be put in the URL, like a presigned URL.
+type HTTP struct{}
+
+func (s *HTTP) Download(uri string, path string) error {
+	resp, err := http.Get(uri)
+	if err != nil {
+		return fmt.Errorf("Failed to download %s: %w", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to download %s: status %d", uri, resp.StatusCode)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to download %s: %w", uri, err)
+	}
+	return f.Close()
+}
+
+func (s *HTTP) Upload(path string, uri string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, uri, f)
+	if err != nil {
+		return fmt.Errorf("Failed to create HTTP request to %s: %w", uri, err)
+	}
+	req.ContentLength = info.Size()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to upload to %s: %w", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Failed to upload to %s: status %d", uri, resp.StatusCode)
+	}
+	return nil
+}
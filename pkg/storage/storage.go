@@ -0,0 +1,107 @@
+// Package storage reads and writes the files that inputs and outputs of
+// predictions refer to by URI, on cloud storage or HTTP servers.
+//
+// Cloud storage is accessed with each provider's CLI, so credentials come
+// from the provider's usual chain: environment variables, config files,
+// instance metadata, and so on.
+package storage
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/console"
+)
+
+// Storage downloads and uploads files at URIs
+type Storage interface {
+	// Download writes the file at uri to path
+	Download(uri string, path string) error
+	// Upload writes the file at path to uri
+	Upload(path string, uri string) error
+}
+
+var schemes = map[string]Storage{
+	"s3":    &S3{},
+	"gs":    &GCS{},
+	"az":    &Azure{},
+	"http":  &HTTP{},
+	"https": &HTTP{},
+}
+
+// scheme returns the scheme of uri, like "s3", or "" if it doesn't have one.
+func scheme(uri string) string {
+	i := strings.Index(uri, "://")
+	if i <= 0 {
+		return ""
+	}
+	return strings.ToLower(uri[:i])
+}
+
+// IsURI returns whether s is a URI that can be read or written.
+func IsURI(s string) bool {
+	_, ok := schemes[scheme(s)]
+	return ok
+}
+
+// ForURI returns the Storage for uri's scheme.
+func ForURI(uri string) (Storage, error) {
+	storage, ok := schemes[scheme(uri)]
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a URI Cog can read or write. Use an s3://, gs://, az://, http://, or https:// URI", uri)
+	}
+	return storage, nil
+}
+
+// Download writes the file at uri to path.
+func Download(uri string, path string) error {
+	storage, err := ForURI(uri)
+	if err != nil {
+		return err
+	}
+	console.Infof("Downloading %s...", uri)
+	return storage.Download(uri, path)
+}
+
+// DownloadTemp writes the file at uri to a temporary file and returns its
+// path. The caller removes it.
+func DownloadTemp(uri string) (string, error) {
+	f, err := os.CreateTemp("", "cog-input-")
+	if err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := Download(uri, f.Name()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Upload writes the file at path to uri.
+func Upload(path string, uri string) error {
+	storage, err := ForURI(uri)
+	if err != nil {
+		return err
+	}
+	console.Infof("Uploading to %s...", uri)
+	return storage.Upload(path, uri)
+}
+
+// runCLI runs a storage provider's CLI, with its errors in the returned
+// error.
+func runCLI(install string, name string, args ...string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s isn't installed. %s", name, install)
+	}
+	cmd := exec.Command(name, args...)
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s", strings.Join(cmd.Args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsURI(t *testing.T) {
+	require.True(t, IsURI("s3://bucket/key.png"))
+	require.True(t, IsURI("gs://bucket/object"))
+	require.True(t, IsURI("az://account/container/blob"))
+	require.True(t, IsURI("https://example.com/image.jpg"))
+	require.True(t, IsURI("HTTP://example.com/image.jpg"))
+	require.False(t, IsURI("image.jpg"))
+	require.False(t, IsURI("/tmp/s3://image.jpg"))
+	require.False(t, IsURI("ftp://example.com/image.jpg"))
+}
+
+func TestForURI(t *testing.T) {
+	storage, err := ForURI("s3://bucket/key")
+	require.NoError(t, err)
+	require.IsType(t, &S3{}, storage)
+
+	_, err = ForURI("ftp://example.com/image.jpg")
+	require.Error(t, err)
+}
+
+func TestParseAzureURI(t *testing.T) {
+	account, container, blob, err := parseAzureURI("az://myaccount/models/weights/model.bin")
+	require.NoError(t, err)
+	require.Equal(t, "myaccount", account)
+	require.Equal(t, "models", container)
+	require.Equal(t, "weights/model.bin", blob)
+
+	_, _, _, err = parseAzureURI("az://myaccount/models")
+	require.Error(t, err)
+}
+
+func TestHTTP(t *testing.T) {
+	uploaded := []byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != "/input.txt" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte("hello"))
+		case http.MethodPut:
+			uploaded, _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	require.NoError(t, Download(server.URL+"/input.txt", path))
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+
+	require.Error(t, Download(server.URL+"/missing.txt", path))
+
+	require.NoError(t, Upload(path, server.URL+"/output.txt"))
+	require.Equal(t, "hello", string(uploaded))
+}
@@ -0,0 +1,181 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/replicate/cog/pkg/docker"
+	"github.com/replicate/cog/pkg/global"
+	"github.com/replicate/cog/pkg/util/console"
+	"github.com/replicate/cog/pkg/util/version"
+)
+
+// MinimumVersionLabel is the label on a base image with the oldest version
+// of Cog that can build models on it.
+var MinimumVersionLabel = global.LabelNamespace + "min_cog_version"
+
+// Release is the latest version of Cog on a release channel. The channel
+// serves it as JSON, with an ed25519 signature of that JSON at the same URL
+// plus ".sig", so the binaries can be trusted as long as the channel's
+// public key is.
+type Release struct {
+	Version string `json:"version"`
+	// Assets maps <os>-<arch> to the binary for that platform
+	Assets map[string]Asset `json:"assets"`
+}
+
+type Asset struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// LatestRelease fetches the release on the channel at url and verifies its
+// signature with publicKey, a base64-encoded ed25519 public key.
+func LatestRelease(ctx context.Context, url string, publicKey string) (*Release, error) {
+	if publicKey == "" {
+		return nil, fmt.Errorf("There is no public key to verify releases from %s with. Set release_channel.public_key in your user config", url)
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("The release channel's public key must be a base64-encoded ed25519 public key")
+	}
+
+	body, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := get(ctx, url+".sig")
+	if err != nil {
+		return nil, err
+	}
+	signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode the signature of %s: %w", url, err)
+	}
+	if !ed25519.Verify(key, body, signature) {
+		return nil, fmt.Errorf("The signature of %s doesn't match the release channel's public key", url)
+	}
+
+	release := &Release{}
+	if err := json.Unmarshal(body, release); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %w", url, err)
+	}
+	return release, nil
+}
+
+// Upgrade downloads the release's binary for this platform, checks it against
+// the checksum in the release, and replaces the running binary with it.
+func Upgrade(ctx context.Context, release *Release) error {
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	asset, ok := release.Assets[platform]
+	if !ok {
+		return fmt.Errorf("Cog %s isn't available for %s", release.Version, platform)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+
+	// Download next to the binary, so it can be renamed into place
+	// atomically
+	tmp, err := os.CreateTemp(filepath.Dir(executable), ".cog-upgrade-*")
+	if err != nil {
+		return fmt.Errorf("Failed to write to %s: %w", filepath.Dir(executable), err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	console.Infof("Downloading Cog %s...", release.Version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, asset.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to download %s: status %d", asset.URL, resp.StatusCode)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		return fmt.Errorf("Failed to download %s: %w", asset.URL, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != asset.SHA256 {
+		return fmt.Errorf("The checksum of %s is %s, but the release says it should be %s", asset.URL, sum, asset.SHA256)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), executable)
+}
+
+// IsOlder returns whether Cog version current is older than minimum.
+// Development builds, which don't have a version number, are never older.
+func IsOlder(current string, minimum string) bool {
+	c, err := version.NewVersion(strings.TrimPrefix(current, "v"))
+	if err != nil {
+		return false
+	}
+	m, err := version.NewVersion(strings.TrimPrefix(minimum, "v"))
+	if err != nil {
+		return false
+	}
+	return m.Greater(c)
+}
+
+// MinimumVersion returns the oldest version of Cog that can build on image,
+// from its MinimumVersionLabel, pulling it if it isn't present. It returns
+// an empty string if the image doesn't require a version.
+func MinimumVersion(image string) (string, error) {
+	inspect, err := docker.ImageInspect(image)
+	if err == docker.ErrNoSuchImage {
+		if err := docker.Pull(image); err != nil {
+			return "", fmt.Errorf("Failed to pull %s: %w", image, err)
+		}
+		inspect, err = docker.ImageInspect(image)
+	}
+	if err != nil {
+		return "", err
+	}
+	if inspect.Config == nil {
+		return "", nil
+	}
+	return inspect.Config.Labels[MinimumVersionLabel], nil
+}
+
+func get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,59 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func releaseServer(t *testing.T, body string, signature []byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable.json":
+			_, _ = w.Write([]byte(body))
+		case "/stable.json.sig":
+			_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(signature)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLatestRelease(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key := base64.StdEncoding.EncodeToString(publicKey)
+	body := `{"version": "0.9.0", "assets": {"linux-amd64": {"url": "https://example.com/cog", "sha256": "abc"}}}`
+
+	server := releaseServer(t, body, ed25519.Sign(privateKey, []byte(body)))
+	release, err := LatestRelease(context.Background(), server.URL+"/stable.json", key)
+	require.NoError(t, err)
+	require.Equal(t, "0.9.0", release.Version)
+	require.Equal(t, "abc", release.Assets["linux-amd64"].SHA256)
+
+	// Signed by someone else
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	server = releaseServer(t, body, ed25519.Sign(otherKey, []byte(body)))
+	_, err = LatestRelease(context.Background(), server.URL+"/stable.json", key)
+	require.ErrorContains(t, err, "doesn't match the release channel's public key")
+
+	_, err = LatestRelease(context.Background(), server.URL+"/stable.json", "")
+	require.ErrorContains(t, err, "no public key")
+}
+
+func TestIsOlder(t *testing.T) {
+	require.True(t, IsOlder("0.8.1", "0.9.0"))
+	require.True(t, IsOlder("v0.8.1+dev", "0.8.2"))
+	require.False(t, IsOlder("0.9.0", "0.9.0"))
+	require.False(t, IsOlder("0.10.0", "v0.9.0"))
+	require.False(t, IsOlder("dev", "0.9.0"))
+}
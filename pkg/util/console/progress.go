@@ -0,0 +1,66 @@
+package console
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+const progressInterval = 100 * time.Millisecond
+
+// Progress is an io.Writer that counts the bytes written to it and shows
+// how many have been written on stderr, if it's a terminal.
+type Progress struct {
+	label   string
+	total   int64
+	written int64
+	out     io.Writer
+	drawn   time.Time
+}
+
+// NewProgress returns a Progress for label. total is the number of bytes
+// that will be written, or -1 if it isn't known.
+func NewProgress(label string, total int64) *Progress {
+	p := &Progress{label: label, total: total}
+	if IsTTY(os.Stderr) && ConsoleInstance.Level <= InfoLevel {
+		p.out = os.Stderr
+	}
+	return p
+}
+
+func (p *Progress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.drawn) >= progressInterval {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+// Finish shows the final count and ends the line.
+func (p *Progress) Finish() {
+	if p.out == nil {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(p.out)
+}
+
+// String returns how much has been written, like "1.5MB / 3MB (50%)".
+func (p *Progress) String() string {
+	if p.total <= 0 {
+		return units.HumanSize(float64(p.written))
+	}
+	return fmt.Sprintf("%s / %s (%d%%)", units.HumanSize(float64(p.written)), units.HumanSize(float64(p.total)), p.written*100/p.total)
+}
+
+func (p *Progress) draw() {
+	p.drawn = time.Now()
+	if p.out == nil {
+		return
+	}
+	// \033[K clears the rest of the line, in case it was longer before
+	fmt.Fprintf(p.out, "\r%s %s\033[K", p.label, p.String())
+}
@@ -1,7 +1,10 @@
 package console
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/moby/term"
 )
@@ -25,3 +28,26 @@ func GetWidth() (uint16, error) {
 	}
 	return 0, nil
 }
+
+// ReadPassword asks for a password on stderr, and reads it from stdin
+// without echoing it
+func ReadPassword(prompt string) (string, error) {
+	fd := os.Stdin.Fd()
+	state, err := term.SaveState(fd)
+	if err != nil {
+		return "", err
+	}
+	if err := term.DisableEcho(fd, state); err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = term.RestoreTerminal(fd, state)
+		fmt.Fprintln(os.Stderr)
+	}()
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
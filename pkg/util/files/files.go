@@ -3,7 +3,9 @@ package files
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 
 	"golang.org/x/sys/unix"
 )
@@ -49,3 +51,21 @@ func CopyFile(src string, dest string) error {
 	}
 	return out.Close()
 }
+
+// CopyDir copies the directory src, and everything in it, to dest.
+func CopyDir(src string, dest string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		return CopyFile(path, target)
+	})
+}
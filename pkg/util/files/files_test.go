@@ -18,3 +18,15 @@ func TestIsExecutable(t *testing.T) {
 	require.NoError(t, os.Chmod(path, 0o744))
 	require.True(t, IsExecutable(path))
 }
+
+func TestCopyDir(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "unet"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "unet", "model.safetensors"), []byte("weights"), 0o644))
+
+	dest := filepath.Join(t.TempDir(), "copy")
+	require.NoError(t, CopyDir(src, dest))
+	content, err := os.ReadFile(filepath.Join(dest, "unet", "model.safetensors"))
+	require.NoError(t, err)
+	require.Equal(t, "weights", string(content))
+}
@@ -1,5 +1,31 @@
 package util
 
+import (
+	"fmt"
+	"strings"
+)
+
 func IsM1Mac(goos string, goarch string) bool {
 	return goos == "darwin" && goarch == "arm64"
 }
+
+// DefaultPlatform returns the OS and architecture images are built for
+// when a platform isn't given, on a machine running goos and goarch: Linux,
+// on the same architecture, except on Apple Silicon Macs, which build for
+// amd64, like the machines most models are deployed on.
+func DefaultPlatform(goos string, goarch string) (string, string) {
+	if IsM1Mac(goos, goarch) {
+		return "linux", "amd64"
+	}
+	return "linux", goarch
+}
+
+// ParsePlatform splits a platform like linux/arm64 into its OS and
+// architecture.
+func ParsePlatform(platform string) (goos string, goarch string, err error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%s is not a platform. Platforms look like linux/amd64", platform)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultPlatform(t *testing.T) {
+	for _, tt := range []struct {
+		goos       string
+		goarch     string
+		wantGOOS   string
+		wantGOARCH string
+	}{
+		{"linux", "amd64", "linux", "amd64"},
+		{"linux", "arm64", "linux", "arm64"},
+		{"darwin", "amd64", "linux", "amd64"},
+		{"darwin", "arm64", "linux", "amd64"},
+	} {
+		goos, goarch := DefaultPlatform(tt.goos, tt.goarch)
+		require.Equal(t, tt.wantGOOS, goos, "%s/%s", tt.goos, tt.goarch)
+		require.Equal(t, tt.wantGOARCH, goarch, "%s/%s", tt.goos, tt.goarch)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	goos, goarch, err := ParsePlatform("linux/arm64")
+	require.NoError(t, err)
+	require.Equal(t, "linux", goos)
+	require.Equal(t, "arm64", goarch)
+
+	for _, platform := range []string{"", "linux", "linux/", "/arm64", "linux/arm64/v8"} {
+		_, _, err := ParsePlatform(platform)
+		require.Error(t, err, platform)
+	}
+}
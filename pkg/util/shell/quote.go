@@ -0,0 +1,8 @@
+package shell
+
+import "strings"
+
+// Quote quotes s as a single argument to sh.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
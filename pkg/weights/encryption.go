@@ -0,0 +1,186 @@
+// Package weights handles model weights that are stored in the image.
+package weights
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted weights are split into chunks so that multi-gigabyte files can be
+// decrypted without holding them in memory. The format is:
+//
+//	header: magic (8 bytes) | chunk size (uint32) | nonce prefix (8 bytes)
+//	chunks: AES-256-GCM(chunk) with nonce = nonce prefix | chunk index (uint32)
+//
+// Each chunk is authenticated with the header and a flag marking the final
+// chunk, so reordered or truncated files fail to decrypt. The same format is
+// read by python/cog/weights.py.
+
+const (
+	EncryptedSuffix = ".enc"
+	KeySize         = 32
+	chunkSize       = 4 * 1024 * 1024
+	nonceSize       = 12
+)
+
+var magic = []byte("COGENC1\n")
+
+var ErrInvalidEncryptedFile = errors.New("Not a Cog encrypted weights file")
+
+// GenerateKey returns a new random key, base64-encoded.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseKey decodes a base64-encoded key.
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("Weights key must be base64 encoded: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Weights key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// EncryptFile encrypts src with key and writes the result to dest.
+func EncryptFile(src string, dest string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := Encrypt(in, out, key); err != nil {
+		return fmt.Errorf("Failed to encrypt %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// Encrypt reads plaintext from r and writes encrypted weights to w.
+func Encrypt(r io.Reader, w io.Writer, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, len(magic)+4+8)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[len(magic):], chunkSize)
+	if _, err := rand.Read(header[len(magic)+4:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(r, chunkSize)
+	buf := make([]byte, chunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := n < chunkSize
+		if !final {
+			if _, err := reader.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		sealed := aead.Seal(nil, chunkNonce(header, index), buf[:n], chunkAAD(header, final))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Decrypt reads encrypted weights from r and writes plaintext to w.
+func Decrypt(r io.Reader, w io.Writer, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, len(magic)+4+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ErrInvalidEncryptedFile
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return ErrInvalidEncryptedFile
+	}
+	size := int(binary.BigEndian.Uint32(header[len(magic):])) + aead.Overhead()
+
+	reader := bufio.NewReaderSize(r, size)
+	buf := make([]byte, size)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := n < size
+		if !final {
+			if _, err := reader.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		plaintext, err := aead.Open(nil, chunkNonce(header, index), buf[:n], chunkAAD(header, final))
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt weights, the key may be wrong or the file corrupted: %w", err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Weights key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(header []byte, index uint32) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, header[len(magic)+4:])
+	binary.BigEndian.PutUint32(nonce[8:], index)
+	return nonce
+}
+
+func chunkAAD(header []byte, final bool) []byte {
+	aad := append([]byte{}, header...)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
@@ -0,0 +1,66 @@
+package weights
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	encodedKey, err := GenerateKey()
+	require.NoError(t, err)
+	key, err := ParseKey(encodedKey)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, chunkSize, 2*chunkSize + 3} {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		require.NoError(t, err)
+
+		encrypted := new(bytes.Buffer)
+		require.NoError(t, Encrypt(bytes.NewReader(plaintext), encrypted, key))
+
+		decrypted := new(bytes.Buffer)
+		require.NoError(t, Decrypt(encrypted, decrypted, key))
+		require.True(t, bytes.Equal(plaintext, decrypted.Bytes()))
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	otherKey := bytes.Repeat([]byte{2}, KeySize)
+
+	encrypted := new(bytes.Buffer)
+	require.NoError(t, Encrypt(bytes.NewReader([]byte("weights")), encrypted, key))
+
+	err := Decrypt(encrypted, new(bytes.Buffer), otherKey)
+	require.Error(t, err)
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	plaintext := make([]byte, 2*chunkSize)
+
+	encrypted := new(bytes.Buffer)
+	require.NoError(t, Encrypt(bytes.NewReader(plaintext), encrypted, key))
+
+	// Dropping the final chunk leaves a file whose last chunk isn't marked final
+	truncated := encrypted.Bytes()[:encrypted.Len()-17]
+	err := Decrypt(bytes.NewReader(truncated), new(bytes.Buffer), key)
+	require.Error(t, err)
+}
+
+func TestDecryptNotEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	err := Decrypt(bytes.NewReader([]byte("definitely not encrypted weights")), new(bytes.Buffer), key)
+	require.ErrorIs(t, err, ErrInvalidEncryptedFile)
+}
+
+func TestParseKey(t *testing.T) {
+	_, err := ParseKey("not base64!")
+	require.Error(t, err)
+	_, err = ParseKey("c2hvcnQ=")
+	require.ErrorContains(t, err, "must be 32 bytes")
+}
@@ -0,0 +1,240 @@
+package weights
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// maxSafetensorsHeaderSize is the largest header the safetensors library
+// reads
+const maxSafetensorsHeaderSize = 100 * 1000 * 1000
+
+// safetensorsDTypeSizes are the sizes in bytes of each of the dtypes in the
+// safetensors format
+var safetensorsDTypeSizes = map[string]int64{
+	"BOOL": 1, "U8": 1, "I8": 1, "F8_E5M2": 1, "F8_E4M3": 1,
+	"I16": 2, "U16": 2, "F16": 2, "BF16": 2,
+	"I32": 4, "U32": 4, "F32": 4,
+	"I64": 8, "U64": 8, "F64": 8,
+}
+
+// Tensor is a tensor in the header of a safetensors file.
+type Tensor struct {
+	DType string  `json:"dtype"`
+	Shape []int64 `json:"shape"`
+	// DataOffsets are where the tensor starts and ends in the data after
+	// the header
+	DataOffsets [2]int64 `json:"data_offsets"`
+}
+
+// Manifest is what a weights file should have, to catch weights for a
+// different architecture. Every field is optional.
+type Manifest struct {
+	TensorCount int `json:"tensor_count,omitempty"`
+	// DTypes are the dtypes tensors can be, like F16
+	DTypes []string `json:"dtypes,omitempty"`
+	// Keys are the names of tensors the file must have
+	Keys []string `json:"keys,omitempty"`
+}
+
+// LoadManifest reads a Manifest from a JSON file.
+func LoadManifest(path string) (*Manifest, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the weights manifest %s: %w", path, err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(contents, manifest); err != nil {
+		return nil, fmt.Errorf("Failed to parse the weights manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// ValidateConfig checks the weights in weights.validate in cfg, which are
+// relative to projectDir.
+func ValidateConfig(cfg *config.Config, projectDir string) error {
+	if cfg.Weights == nil {
+		return nil
+	}
+	for _, check := range cfg.Weights.Validate {
+		var manifest *Manifest
+		if check.Manifest != "" {
+			var err error
+			if manifest, err = LoadManifest(filepath.Join(projectDir, check.Manifest)); err != nil {
+				return err
+			}
+		}
+		if err := ValidateFile(filepath.Join(projectDir, check.Path), manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateFile checks that the weights file at path is complete, and has
+// what manifest says it should, if it isn't nil. Safetensors files are
+// checked from their header, and PyTorch checkpoints only that they're
+// complete, as their tensors can't be read without unpickling them.
+func ValidateFile(path string, manifest *Manifest) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".safetensors":
+		tensors, err := ReadSafetensorsHeader(path)
+		if err != nil {
+			return err
+		}
+		if manifest != nil {
+			return checkManifest(path, tensors, manifest)
+		}
+		return nil
+	case ".ckpt", ".pt", ".pth", ".bin":
+		if manifest != nil {
+			return fmt.Errorf("%s can't be checked against a manifest. Only safetensors files can", path)
+		}
+		return validateTorchCheckpoint(path)
+	default:
+		return fmt.Errorf("%s can't be checked. Only safetensors files and PyTorch checkpoints (.ckpt, .pt, .pth, .bin) can", path)
+	}
+}
+
+// ReadSafetensorsHeader returns the tensors in the header of the safetensors
+// file at path, and checks that their data is all in the file.
+func ReadSafetensorsHeader(path string) (map[string]Tensor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	invalid := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%s isn't a valid safetensors file: %s", path, fmt.Sprintf(format, a...))
+	}
+
+	var headerSize uint64
+	if err := binary.Read(f, binary.LittleEndian, &headerSize); err != nil {
+		return nil, invalid("it's too short")
+	}
+	if headerSize > maxSafetensorsHeaderSize || int64(headerSize) > info.Size()-8 {
+		return nil, invalid("the header is %d bytes, which is more than the file has", headerSize)
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	entries := map[string]json.RawMessage{}
+	if err := json.Unmarshal(header, &entries); err != nil {
+		return nil, invalid("failed to parse the header: %s", err)
+	}
+
+	dataSize := info.Size() - 8 - int64(headerSize)
+	var end int64
+	tensors := map[string]Tensor{}
+	for name, entry := range entries {
+		if name == "__metadata__" {
+			continue
+		}
+		tensor := Tensor{}
+		if err := json.Unmarshal(entry, &tensor); err != nil {
+			return nil, invalid("failed to parse tensor %s: %s", name, err)
+		}
+		size, ok := safetensorsDTypeSizes[tensor.DType]
+		if !ok {
+			return nil, invalid("tensor %s has an unknown dtype %q", name, tensor.DType)
+		}
+		for _, dim := range tensor.Shape {
+			size *= dim
+		}
+		begin, tensorEnd := tensor.DataOffsets[0], tensor.DataOffsets[1]
+		if begin < 0 || tensorEnd-begin != size {
+			return nil, invalid("tensor %s is %d bytes, but its shape needs %d", name, tensorEnd-begin, size)
+		}
+		if tensorEnd > dataSize {
+			return nil, invalid("tensor %s ends %d bytes past the end of the file. It may have been cut off while downloading", name, tensorEnd-dataSize)
+		}
+		if tensorEnd > end {
+			end = tensorEnd
+		}
+		tensors[name] = tensor
+	}
+	if end != dataSize {
+		return nil, invalid("it has %d bytes after the last tensor", dataSize-end)
+	}
+	return tensors, nil
+}
+
+// checkManifest checks the tensors of the safetensors file at path against
+// manifest.
+func checkManifest(path string, tensors map[string]Tensor, manifest *Manifest) error {
+	if manifest.TensorCount != 0 && len(tensors) != manifest.TensorCount {
+		return fmt.Errorf("%s has %d tensors, but its manifest says it should have %d. The weights may be for a different architecture", path, len(tensors), manifest.TensorCount)
+	}
+	if len(manifest.DTypes) > 0 {
+		allowed := map[string]bool{}
+		for _, dtype := range manifest.DTypes {
+			allowed[dtype] = true
+		}
+		names := make([]string, 0, len(tensors))
+		for name := range tensors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !allowed[tensors[name].DType] {
+				return fmt.Errorf("Tensor %s in %s is %s, but its manifest says tensors should be %s", name, path, tensors[name].DType, strings.Join(manifest.DTypes, " or "))
+			}
+		}
+	}
+	missing := []string{}
+	for _, key := range manifest.Keys {
+		if _, ok := tensors[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		examples := missing
+		if len(examples) > 3 {
+			examples = examples[:3]
+		}
+		return fmt.Errorf("%s doesn't have %d of the tensors in its manifest, like %s. The weights may be for a different architecture", path, len(missing), strings.Join(examples, ", "))
+	}
+	return nil
+}
+
+// validateTorchCheckpoint checks that a PyTorch checkpoint is complete. The
+// zip files torch.save() writes have their index at the end, so a file
+// that's cut off can't be opened. Older checkpoints are a bare pickle.
+func validateTorchCheckpoint(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		f, openErr := os.Open(path)
+		if openErr != nil {
+			return openErr
+		}
+		defer f.Close()
+		start := make([]byte, 2)
+		// Pickles start with the PROTO opcode
+		if _, readErr := io.ReadFull(f, start); readErr == nil && start[0] == 0x80 {
+			return nil
+		}
+		return fmt.Errorf("%s isn't a valid PyTorch checkpoint. It may have been cut off while downloading: %w", path, err)
+	}
+	defer r.Close()
+	for _, file := range r.File {
+		if strings.HasSuffix(file.Name, "/data.pkl") || file.Name == "data.pkl" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't a valid PyTorch checkpoint: it doesn't have data.pkl", path)
+}
@@ -0,0 +1,81 @@
+package weights
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSafetensors writes a safetensors file with a tensor of 2 F16 values
+// for each of names, and returns its path.
+func writeSafetensors(t *testing.T, names []string, dtype string) string {
+	header := map[string]interface{}{"__metadata__": map[string]string{"format": "pt"}}
+	for i, name := range names {
+		header[name] = map[string]interface{}{"dtype": dtype, "shape": []int{2}, "data_offsets": []int{i * 4, (i + 1) * 4}}
+	}
+	headerJSON, err := json.Marshal(header)
+	require.NoError(t, err)
+
+	contents := binary.LittleEndian.AppendUint64(nil, uint64(len(headerJSON)))
+	contents = append(contents, headerJSON...)
+	contents = append(contents, make([]byte, len(names)*4)...)
+	path := filepath.Join(t.TempDir(), "model.safetensors")
+	require.NoError(t, os.WriteFile(path, contents, 0o644))
+	return path
+}
+
+func TestValidateSafetensors(t *testing.T) {
+	path := writeSafetensors(t, []string{"a.weight", "b.weight"}, "F16")
+	require.NoError(t, ValidateFile(path, nil))
+	require.NoError(t, ValidateFile(path, &Manifest{TensorCount: 2, DTypes: []string{"F16", "BF16"}, Keys: []string{"a.weight"}}))
+
+	err := ValidateFile(path, &Manifest{TensorCount: 3})
+	require.ErrorContains(t, err, "has 2 tensors, but its manifest says it should have 3")
+
+	err = ValidateFile(path, &Manifest{DTypes: []string{"F32"}})
+	require.ErrorContains(t, err, "Tensor a.weight in "+path+" is F16, but its manifest says tensors should be F32")
+
+	err = ValidateFile(path, &Manifest{Keys: []string{"a.weight", "c.weight"}})
+	require.ErrorContains(t, err, "doesn't have 1 of the tensors in its manifest, like c.weight")
+}
+
+func TestValidateSafetensorsTruncated(t *testing.T) {
+	path := writeSafetensors(t, []string{"a.weight", "b.weight"}, "F16")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	err = ValidateFile(path, nil)
+	require.ErrorContains(t, err, "ends 3 bytes past the end of the file")
+
+	require.NoError(t, os.Truncate(path, 4))
+	err = ValidateFile(path, nil)
+	require.ErrorContains(t, err, "it's too short")
+}
+
+func TestValidateSafetensorsUnknownDType(t *testing.T) {
+	path := writeSafetensors(t, []string{"a.weight"}, "F17")
+	err := ValidateFile(path, nil)
+	require.ErrorContains(t, err, `tensor a.weight has an unknown dtype "F17"`)
+}
+
+func TestValidateCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "model.ckpt")
+	require.NoError(t, os.WriteFile(path, []byte("PK\x03\x04 cut off"), 0o644))
+	err := ValidateFile(path, nil)
+	require.ErrorContains(t, err, "isn't a valid PyTorch checkpoint")
+
+	require.NoError(t, os.WriteFile(path, []byte{0x80, 0x02, '}', '.'}, 0o644))
+	require.NoError(t, ValidateFile(path, nil))
+
+	err = ValidateFile(path, &Manifest{TensorCount: 1})
+	require.ErrorContains(t, err, "Only safetensors files can")
+
+	err = ValidateFile(filepath.Join(dir, "model.gguf"), nil)
+	require.ErrorContains(t, err, "can't be checked")
+}
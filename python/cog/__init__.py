@@ -1,7 +1,9 @@
 from pydantic import BaseModel
 
 from .predictor import BasePredictor
+from .preemption import Preempted
 from .types import File, Input, Path, ConcatenateIterator
+from .weights import mmap_weights
 
 try:
     from ._version import __version__
@@ -17,4 +19,6 @@ __all__ = [
     "File",
     "Input",
     "Path",
+    "Preempted",
+    "mmap_weights",
 ]
@@ -0,0 +1,52 @@
+"""
+python -m cog.command.check_nvidia_driver <minimum version> <CUDA version>
+
+This reads the version of the NVIDIA driver on the host with NVML, and exits
+with an error if it's older than the minimum version, so an old driver is
+reported clearly rather than as CUDA failing to initialize. If NVML isn't
+available, there is no driver to check, and it exits successfully.
+"""
+import ctypes
+import sys
+from typing import Optional, Tuple
+
+
+def driver_version() -> Optional[str]:
+    try:
+        nvml = ctypes.CDLL("libnvidia-ml.so.1")
+    except OSError:
+        return None
+    if nvml.nvmlInit_v2() != 0:
+        return None
+    try:
+        buf = ctypes.create_string_buffer(80)
+        if nvml.nvmlSystemGetDriverVersion(buf, ctypes.c_uint(80)) != 0:
+            return None
+        return buf.value.decode()
+    finally:
+        nvml.nvmlShutdown()
+
+
+def parse_version(version: str) -> Tuple[int, ...]:
+    return tuple(int(part) for part in version.split("."))
+
+
+if __name__ == "__main__":
+    if len(sys.argv) != 3:
+        print(
+            "usage: python -m cog.command.check_nvidia_driver <minimum version> <CUDA version>",
+            file=sys.stderr,
+        )
+        sys.exit(1)
+    minimum, cuda = sys.argv[1], sys.argv[2]
+    driver = driver_version()
+    if driver is None:
+        print("No NVIDIA driver found, so not checking it", file=sys.stderr)
+        sys.exit(0)
+    if parse_version(driver) < parse_version(minimum):
+        print(
+            f"This model uses CUDA {cuda}, which needs NVIDIA driver {minimum} or later, but the driver on this host is {driver}. Upgrade the driver to run it.",
+            file=sys.stderr,
+        )
+        sys.exit(1)
+    print(f"NVIDIA driver {driver} can run CUDA {cuda}", file=sys.stderr)
@@ -0,0 +1,88 @@
+"""
+python -m cog.command.export_onnx <output path>
+
+This sets up the predictor, calls its export_onnx() hook to write an ONNX
+model to the output path, validates the result with onnx and onnxruntime, and
+writes a JSON object describing the exported model to <output path>.json.
+"""
+import importlib.util
+import json
+import sys
+from typing import Any
+
+from ..predictor import get_predictor_ref, load_config, load_predictor_from_ref, run_setup
+
+# The packages the exported model is validated with
+REQUIRED_PACKAGES = ["onnx", "onnxruntime"]
+
+
+class MissingPackagesError(Exception):
+    pass
+
+
+def check_packages() -> None:
+    """
+    Check that the packages the model is validated with are installed, before
+    the predictor is set up, which can take a long time.
+    """
+    missing = [
+        name for name in REQUIRED_PACKAGES if importlib.util.find_spec(name) is None
+    ]
+    if missing:
+        names = " and ".join(missing)
+        raise MissingPackagesError(
+            f"Exporting to ONNX needs {names}, which {'is' if len(missing) == 1 else 'are'} not installed. Add {names} to build.python_packages in cog.yaml"
+        )
+
+
+def export(output_path: str) -> dict:
+    check_packages()
+    config = load_config()
+    predictor = load_predictor_from_ref(get_predictor_ref(config))
+    if not hasattr(predictor, "export_onnx"):
+        raise AttributeError(
+            "Your Predictor needs an export_onnx(self, path) method to be exported to ONNX"
+        )
+    run_setup(predictor)
+    predictor.export_onnx(output_path)  # type: ignore
+
+    import onnx
+    import onnxruntime
+
+    model = onnx.load(output_path)
+    onnx.checker.check_model(model)
+    # Loading the model into a session catches operators that the checker
+    # accepts but the runtime can't execute.
+    onnxruntime.InferenceSession(output_path, providers=["CPUExecutionProvider"])
+
+    return metadata(model, onnx.__version__, onnxruntime.__version__)
+
+
+def metadata(model: Any, onnx_version: str, onnxruntime_version: str) -> dict:
+    """
+    Describe an ONNX model, in the format pkg/image.ONNXMetadata reads.
+    """
+    return {
+        "ir_version": model.ir_version,
+        "opsets": {
+            (opset.domain or "ai.onnx"): opset.version for opset in model.opset_import
+        },
+        "producer_name": model.producer_name,
+        "producer_version": model.producer_version,
+        "onnx_version": onnx_version,
+        "onnxruntime_version": onnxruntime_version,
+    }
+
+
+if __name__ == "__main__":
+    if len(sys.argv) != 2:
+        print("usage: python -m cog.command.export_onnx <output path>", file=sys.stderr)
+        sys.exit(1)
+    output_path = sys.argv[1]
+    try:
+        result = export(output_path)
+    except MissingPackagesError as e:
+        print(e, file=sys.stderr)
+        sys.exit(1)
+    with open(output_path + ".json", "w") as fh:
+        json.dump(result, fh, indent=2)
@@ -0,0 +1,46 @@
+"""
+The COG_* environment variables a predictor can read, so it can adapt to
+where it's running without parsing flags of its own. `cog predict`, `cog
+serve`, `cog run`, and `cog train` set them, and --env overrides them.
+set_defaults() fills in the ones that aren't set, like when the image is run
+with docker run.
+"""
+import os
+import subprocess
+from typing import Any, Dict
+
+MODEL_NAME = "COG_MODEL_NAME"
+IMAGE_DIGEST = "COG_IMAGE_DIGEST"
+GPU_COUNT = "COG_GPU_COUNT"
+CACHE_DIR = "COG_CACHE_DIR"
+
+DEFAULT_CACHE_DIR = "/var/cache/cog"
+
+
+def set_defaults(config: Dict[str, Any]) -> None:
+    """
+    Sets the COG_* environment variables that aren't set already. The image
+    digest can't be known from inside the image, so it's left unset.
+    """
+    if config.get("image"):
+        os.environ.setdefault(MODEL_NAME, config["image"])
+    os.environ.setdefault(CACHE_DIR, DEFAULT_CACHE_DIR)
+    if GPU_COUNT not in os.environ:
+        os.environ[GPU_COUNT] = str(gpu_count())
+
+
+def gpu_count() -> int:
+    """
+    Returns how many GPUs the container can use: the ones in
+    CUDA_VISIBLE_DEVICES if it's set, or else the ones nvidia-smi lists.
+    """
+    visible = os.environ.get("CUDA_VISIBLE_DEVICES")
+    if visible is not None:
+        return len([d for d in visible.split(",") if d.strip() and d.strip() != "-1"])
+    try:
+        out = subprocess.run(
+            ["nvidia-smi", "-L"], stdout=subprocess.PIPE, check=True
+        ).stdout.decode()
+    except (OSError, subprocess.CalledProcessError):
+        return 0
+    return len([line for line in out.splitlines() if line.startswith("GPU ")])
@@ -0,0 +1,155 @@
+"""
+Running the work that's done once per container, when the model first
+starts, before setup(): the steps in first_boot in cog.yaml, and the steps
+of the build that are deferred until then, like commands in build.run that
+need a GPU when the builder doesn't have one. Those are recorded in the
+image at FIRST_BOOT_PATH by pkg/dockerfile/first_boot.go.
+"""
+import hashlib
+import json
+import os
+import shutil
+import subprocess
+import tempfile
+import threading
+import urllib.request
+from typing import Any, Dict, List, Optional
+
+import structlog
+
+from .env import CACHE_DIR, DEFAULT_CACHE_DIR
+
+log = structlog.get_logger("cog.first_boot")
+
+FIRST_BOOT_PATH = "/cog/first_boot.json"
+
+
+class FirstBootError(Exception):
+    """Raised when a step that's run when the model first starts fails."""
+
+
+class FirstBoot:
+    """
+    The steps that are run when the model first starts, and how far through
+    them it is, which the server reports from /health-check.
+    """
+
+    def __init__(
+        self, config: Optional[Dict[str, Any]] = None, path: str = FIRST_BOOT_PATH
+    ):
+        first_boot = (config or {}).get("first_boot") or {}
+        self.cache_dir = (
+            first_boot.get("cache_dir")
+            or os.environ.get(CACHE_DIR)
+            or DEFAULT_CACHE_DIR
+        )
+        self.steps: List[Dict[str, Any]] = []
+        if os.path.exists(path):
+            with open(path, encoding="utf-8") as f:
+                for run in json.load(f).get("run") or []:
+                    self.steps.append({"run": run["command"], "build": True})
+        self.steps.extend(first_boot.get("steps") or [])
+
+        self._lock = threading.Lock()
+        self._completed = 0
+        self._current: Optional[str] = None
+        self._status = "pending"
+
+    def progress(self) -> Optional[Dict[str, Any]]:
+        """
+        Returns how far through the steps it is, or None if there aren't
+        any.
+        """
+        if not self.steps:
+            return None
+        with self._lock:
+            return {
+                "status": self._status,
+                "steps": len(self.steps),
+                "completed": self._completed,
+                "current": self._current,
+            }
+
+    def run(self) -> None:
+        """
+        Runs the steps, once per container. A marker is left in the temporary
+        directory when they've all succeeded, so they aren't run again if the
+        model is set up again in the same container.
+        """
+        if not self.steps:
+            return
+        done_path = os.path.join(tempfile.gettempdir(), "cog-first-boot-done")
+        if os.path.exists(done_path):
+            with self._lock:
+                self._status = "succeeded"
+                self._completed = len(self.steps)
+            return
+
+        with self._lock:
+            self._status = "running"
+        try:
+            for step in self.steps:
+                with self._lock:
+                    self._current = step.get("run") or step.get("download")
+                if step.get("run"):
+                    self._run(step["run"], from_build=step.get("build", False))
+                else:
+                    self._download(step["download"], step["dest"])
+                with self._lock:
+                    self._completed += 1
+        except Exception:
+            with self._lock:
+                self._status = "failed"
+            raise
+
+        with open(done_path, "w", encoding="utf-8"):
+            pass
+        with self._lock:
+            self._status = "succeeded"
+            self._current = None
+
+    def _run(self, command: str, from_build: bool) -> None:
+        log.info("running first boot step", command=command)
+        os.makedirs(self.cache_dir, exist_ok=True)
+        env = dict(os.environ, COG_FIRST_BOOT_CACHE=self.cache_dir)
+        result = subprocess.run(command, shell=True, env=env, check=False)
+        if result.returncode != 0:
+            section = "build.run" if from_build else "first_boot"
+            raise FirstBootError(
+                f"'{command}' in {section} failed with exit code {result.returncode} when the model first started"
+            )
+
+    def _download(self, url: str, dest: str) -> None:
+        """
+        Downloads url to the cache directory, unless it's already there from
+        an earlier container, and links dest to it.
+        """
+        if os.path.exists(dest):
+            return
+        cached = os.path.join(
+            self.cache_dir, hashlib.sha256(url.encode("utf-8")).hexdigest()
+        )
+        if not os.path.exists(cached):
+            log.info("downloading", url=url)
+            os.makedirs(self.cache_dir, exist_ok=True)
+            # Download next to where it goes, so a container that's stopped
+            # part way through never leaves a partial file in the cache
+            fd, tmp_path = tempfile.mkstemp(dir=self.cache_dir, prefix=".download-")
+            try:
+                with os.fdopen(fd, "wb") as f, urllib.request.urlopen(url) as r:
+                    shutil.copyfileobj(r, f)
+                os.rename(tmp_path, cached)
+            except Exception as e:
+                os.unlink(tmp_path)
+                raise FirstBootError(f"Failed to download {url}: {e}") from e
+        if os.path.dirname(dest):
+            os.makedirs(os.path.dirname(dest), exist_ok=True)
+        os.symlink(cached, dest)
+
+
+def run_first_boot(config: Optional[Dict[str, Any]] = None) -> None:
+    """
+    Runs the steps that are run when the model first starts, if they
+    haven't been run in this container yet.
+    """
+    FirstBoot(config).run()
@@ -9,12 +9,14 @@ from pathlib import Path
 from pydantic import create_model, BaseModel, Field
 from pydantic.fields import FieldInfo
 from typing import Any, Callable, Dict, List, Optional, Type, Union
+from urllib.parse import urlparse
 
 # Added in Python 3.8. Can be from typing if we drop support for <3.8.
 from typing_extensions import get_origin, get_args, Annotated
 import yaml
 
 from .errors import ConfigDoesNotExist, PredictorNotSet
+from .first_boot import run_first_boot
 from .types import (
     Input,
     Path as CogPath,
@@ -23,6 +25,7 @@ from .types import (
     URLPath,
     get_filename,
 )
+from .weights import decrypt_weights, join_weight_shards
 
 
 ALLOWED_INPUT_TYPES = [str, int, float, bool, CogFile, CogPath]
@@ -41,11 +44,35 @@ class BasePredictor(ABC):
         """
 
 
-def run_setup(predictor: BasePredictor) -> None:
+def run_setup(predictor: BasePredictor, model_weights: Optional[str] = None) -> None:
+    """
+    Run the predictor's setup(). model_weights is the path or URL of the
+    weights of a model variant from cog.yaml, which are used instead of
+    COG_WEIGHTS or the weights in the image.
+    """
+    try:
+        config = load_config()
+    except ConfigDoesNotExist:
+        config = None
+
+    # The server runs these before setting up the predictor, so it can
+    # report on them, so this only runs them outside the server. They come
+    # first, as the model can depend on what they install or download.
+    run_first_boot(config)
+
+    if config is not None:
+        # Encrypted weights can be sharded, so they're joined first
+        join_weight_shards(config)
+        decrypt_weights(config)
+
     weights_type = get_weights_type(predictor.setup)
 
     # No weights need to be passed, so just run setup() without any arguments.
     if weights_type is None:
+        if model_weights is not None:
+            raise ValueError(
+                "cog.yaml has model variants, but Predictor.setup() doesn't have an argument 'weights' to load them with"
+            )
         predictor.setup()
         return
 
@@ -53,6 +80,14 @@ def run_setup(predictor: BasePredictor) -> None:
 
     weights_url = os.environ.get("COG_WEIGHTS")
     weights_path = "weights"
+    if model_weights is not None:
+        if urlparse(model_weights).scheme:
+            weights_url = model_weights
+        else:
+            weights_url = None
+            weights_path = model_weights
+            if not os.path.exists(weights_path):
+                raise FileNotFoundError(f"The model's weights {weights_path} don't exist")
 
     # TODO: Cog{File,Path}.validate(...) methods accept either "real"
     # paths/files or URLs to those things. In future we can probably tidy this
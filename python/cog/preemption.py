@@ -0,0 +1,45 @@
+"""
+Preemption of long-running predictions, like on a spot instance that's about
+to be reclaimed. The server is told shortly before it's stopped, either with
+SIGTERM when serving.preemption_grace is set in cog.yaml, or with a request
+to /predictions/<id>/preempt. It raises Preempted in predict(), which has
+until the deadline to save a checkpoint and return what it has so far. The
+prediction's status is then "preempted", rather than "succeeded".
+
+    from cog import BasePredictor, Preempted
+
+    class Predictor(BasePredictor):
+        def predict(self, steps: int) -> str:
+            try:
+                for step in range(steps):
+                    train(step)
+            except Preempted:
+                save_checkpoint()
+            return "checkpoint.pt"
+
+If predict() doesn't catch it, the prediction's output is whatever it had
+yielded before it was preempted.
+"""
+import time
+from typing import Optional
+
+
+class Preempted(Exception):
+    """
+    Raised in predict() when the prediction is preempted. deadline is the
+    time, from time.time(), by which predict() must return, or None if the
+    server wasn't told.
+    """
+
+    def __init__(self, deadline: Optional[float] = None):
+        self.deadline = deadline
+        super().__init__("The prediction was preempted")
+
+    def time_left(self) -> Optional[float]:
+        """
+        Returns how many seconds predict() has left to return, or None if
+        there's no deadline.
+        """
+        if self.deadline is None:
+            return None
+        return max(0.0, self.deadline - time.time())
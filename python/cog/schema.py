@@ -11,10 +11,18 @@ class Status(str, Enum):
     SUCCEEDED = "succeeded"
     CANCELED = "canceled"
     FAILED = "failed"
+    # Stopped early, like on a spot instance that's being reclaimed, with
+    # whatever output the predictor had when it was stopped
+    PREEMPTED = "preempted"
 
     @staticmethod
     def is_terminal(status: t.Optional["Status"]) -> bool:
-        return status in {Status.SUCCEEDED, Status.CANCELED, Status.FAILED}
+        return status in {
+            Status.SUCCEEDED,
+            Status.CANCELED,
+            Status.FAILED,
+            Status.PREEMPTED,
+        }
 
 
 class WebhookEvent(str, Enum):
@@ -39,6 +47,9 @@ class PredictionRequest(PredictionBaseModel):
     # TODO: deprecate this
     output_file_prefix: t.Optional[str]
 
+    # The model variant from cog.yaml to run the prediction with
+    model: t.Optional[str]
+
     webhook: t.Optional[pydantic.AnyHttpUrl]
     webhook_events_filter: t.Optional[
         t.Set[WebhookEvent]
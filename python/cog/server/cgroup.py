@@ -0,0 +1,69 @@
+"""
+Memory usage and limits of the container, from cgroup v2, to explain why a
+prediction was killed when the container runs out of memory.
+"""
+import os
+from typing import Optional
+
+CGROUP_DIR = "/sys/fs/cgroup"
+
+
+def _read(name: str, cgroup_dir: str) -> Optional[str]:
+    try:
+        with open(os.path.join(cgroup_dir, name)) as f:
+            return f.read().strip()
+    except OSError:
+        return None
+
+
+def oom_kills(cgroup_dir: str = CGROUP_DIR) -> Optional[int]:
+    """
+    The number of processes in the container that have been killed for
+    running out of memory, or None if it's not known.
+    """
+    events = _read("memory.events", cgroup_dir)
+    if events is None:
+        return None
+    for line in events.splitlines():
+        name, _, value = line.partition(" ")
+        if name == "oom_kill":
+            return int(value)
+    return None
+
+
+def memory_limit(cgroup_dir: str = CGROUP_DIR) -> Optional[int]:
+    value = _read("memory.max", cgroup_dir)
+    if value is None or value == "max":
+        return None
+    return int(value)
+
+
+def memory_peak(cgroup_dir: str = CGROUP_DIR) -> Optional[int]:
+    # memory.peak is only in Linux 5.19 and later
+    value = _read("memory.peak", cgroup_dir)
+    if value is None:
+        return None
+    return int(value)
+
+
+def format_bytes(n: int) -> str:
+    size = float(n)
+    for unit in ["B", "KiB", "MiB", "GiB"]:
+        if size < 1024:
+            return f"{size:.4g} {unit}"
+        size /= 1024
+    return f"{size:.4g} TiB"
+
+
+def out_of_memory_message(phase: str, cgroup_dir: str = CGROUP_DIR) -> str:
+    limit = memory_limit(cgroup_dir)
+    if limit is None:
+        message = f"The container ran out of memory during {phase}"
+    else:
+        message = (
+            f"The container exceeded its {format_bytes(limit)} memory limit during {phase}"
+        )
+    peak = memory_peak(cgroup_dir)
+    if peak is not None:
+        message += f", with a peak usage of {format_bytes(peak)}"
+    return message
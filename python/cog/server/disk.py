@@ -0,0 +1,101 @@
+"""
+Keeping a long-running model from filling its disk. Before each prediction,
+the free space on the container's writable layer is checked against
+serving.min_free_disk. If it's low, files in serving.evict_dirs are removed,
+least recently used first, and if that doesn't free enough, the prediction
+is refused with a clear error, rather than failing part way through with
+"No space left on device".
+"""
+import os
+import shutil
+import threading
+from typing import Any, Dict, List, Optional, Tuple
+
+import structlog
+
+from .tmpdir import parse_size
+
+log = structlog.get_logger("cog.server.disk")
+
+
+class DiskFullError(Exception):
+    """Raised when there isn't enough free disk space to run a prediction."""
+
+
+class DiskGuard:
+    def __init__(
+        self, min_free: int, evict_dirs: Optional[List[str]] = None, path: str = "/"
+    ):
+        self.min_free = min_free
+        self.evict_dirs = evict_dirs or []
+        # A path on the filesystem that's checked
+        self.path = path
+        self._lock = threading.Lock()
+
+    @classmethod
+    def from_config(cls, config: Dict[str, Any]) -> Optional["DiskGuard"]:
+        serving = config.get("serving") or {}
+        min_free = serving.get("min_free_disk")
+        if not min_free:
+            return None
+        return cls(
+            min_free=parse_size(min_free),
+            evict_dirs=serving.get("evict_dirs"),
+        )
+
+    def free(self) -> int:
+        return shutil.disk_usage(self.path).free
+
+    def status(self) -> Dict[str, Any]:
+        """
+        Returns how much disk space is free, for the health check.
+        """
+        free = self.free()
+        return {"free": free, "min_free": self.min_free, "low": free < self.min_free}
+
+    def check(self) -> None:
+        """
+        Makes sure there's at least min_free bytes free, evicting files if
+        there isn't, and raises DiskFullError if that isn't enough.
+        """
+        with self._lock:
+            free = self.free()
+            if free >= self.min_free:
+                return
+            log.warn(
+                "disk space is low, evicting files", free=free, min_free=self.min_free
+            )
+            free = self._evict()
+            if free < self.min_free:
+                raise DiskFullError(
+                    f"There isn't enough free disk space to run a prediction: {free} bytes are free, "
+                    f"but serving.min_free_disk is {self.min_free} bytes"
+                )
+
+    def _evict(self) -> int:
+        """
+        Removes files in evict_dirs, least recently used first, until there's
+        enough free, and returns how much is free.
+        """
+        files: List[Tuple[float, str]] = []
+        for evict_dir in self.evict_dirs:
+            for dirpath, _, filenames in os.walk(evict_dir):
+                for name in filenames:
+                    p = os.path.join(dirpath, name)
+                    try:
+                        st = os.lstat(p)
+                    except OSError:
+                        continue
+                    files.append((max(st.st_atime, st.st_mtime), p))
+        files.sort()
+
+        free = self.free()
+        for _, p in files:
+            if free >= self.min_free:
+                break
+            try:
+                os.unlink(p)
+            except OSError:
+                continue
+            free = self.free()
+        return free
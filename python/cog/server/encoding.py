@@ -0,0 +1,289 @@
+import gzip
+import io
+import mimetypes
+import os
+from typing import Any, Callable, Dict, Iterator, List, Optional, Sequence, Tuple, Union
+from urllib.parse import quote
+
+import structlog
+
+try:
+    import zstandard  # type: ignore
+
+    has_zstandard = True
+except ImportError:
+    has_zstandard = False
+
+log = structlog.get_logger("cog.server.encoding")
+
+# The ways predict() output files can be encoded in responses
+OUTPUT_ENCODINGS = ("data_uri", "url", "binary")
+
+COMPRESSION_ENCODINGS = ("gzip", "zstd")
+
+# Responses smaller than this aren't worth compressing
+MINIMUM_COMPRESSION_SIZE = 1024
+
+# Output files at least this big are sent as parts of a multipart response,
+# if the client accepts it, rather than as data URIs
+MULTIPART_THRESHOLD = 1024 * 1024
+
+MULTIPART_CHUNK_SIZE = 64 * 1024
+
+
+def parse_prefer(header: Optional[str]) -> Dict[str, str]:
+    """
+    Parse a Prefer header (RFC 7240) into a dict of preferences. Preferences
+    without a value, like respond-async, have an empty value.
+    """
+    prefs: Dict[str, str] = {}
+    if not header:
+        return prefs
+    for pref in header.split(","):
+        # Parameters of preferences, after ";", aren't used by anything
+        token = pref.split(";")[0].strip()
+        if not token:
+            continue
+        name, _, value = token.partition("=")
+        prefs[name.strip().lower()] = value.strip().strip('"')
+    return prefs
+
+
+def parse_quality_list(header: Optional[str]) -> Dict[str, float]:
+    """
+    Parse a header like Accept or Accept-Encoding into a dict of values and
+    their quality, from 0 to 1.
+    """
+    values: Dict[str, float] = {}
+    if not header:
+        return values
+    for item in header.split(","):
+        parts = item.split(";")
+        value = parts[0].strip().lower()
+        if not value:
+            continue
+        quality = 1.0
+        for param in parts[1:]:
+            name, _, q = param.partition("=")
+            if name.strip() == "q":
+                try:
+                    quality = float(q)
+                except ValueError:
+                    quality = 0.0
+        values[value] = quality
+    return values
+
+
+def accepts_json(accept: Optional[str]) -> bool:
+    """
+    Whether a client with this Accept header accepts a JSON response.
+    """
+    if accept is None:
+        return True
+    accepted = parse_quality_list(accept)
+    return any(
+        accepted.get(media_type, 0) > 0
+        for media_type in ("application/json", "application/*", "*/*")
+    )
+
+
+def accepts_multipart(accept: Optional[str]) -> bool:
+    """
+    Whether a client with this Accept header accepts a multipart/mixed
+    response.
+    """
+    return parse_quality_list(accept).get("multipart/mixed", 0) > 0
+
+
+def choose_compression(
+    accept_encoding: Optional[str], enabled: Sequence[str]
+) -> Optional[str]:
+    """
+    Return the first of the enabled compression encodings that the client
+    accepts, or None to not compress the response.
+    """
+    accepted = parse_quality_list(accept_encoding)
+    for encoding in enabled:
+        quality = accepted.get(encoding, accepted.get("*", 0))
+        if quality > 0:
+            return encoding
+    return None
+
+
+def compress(encoding: str, body: bytes) -> bytes:
+    if encoding == "gzip":
+        return gzip.compress(body)
+    if encoding == "zstd":
+        return zstandard.ZstdCompressor().compress(body)
+    raise ValueError(f"unknown compression encoding: {encoding}")
+
+
+def available_compression(encodings: Sequence[str]) -> List[str]:
+    """
+    Return the encodings from serving.compression in cog.yaml that can be
+    used. zstd needs the zstandard package, which isn't installed with Cog.
+    """
+    available = []
+    for encoding in encodings:
+        if encoding not in COMPRESSION_ENCODINGS:
+            raise ValueError(
+                f"serving.compression must be one of {', '.join(COMPRESSION_ENCODINGS)}, not {encoding}"
+            )
+        if encoding == "zstd" and not has_zstandard:
+            log.warn(
+                "zstd compression is enabled in cog.yaml, but the zstandard package isn't installed. Add it to python_packages to use it."
+            )
+            continue
+        available.append(encoding)
+    return available
+
+
+class MultipartOutput:
+    """
+    Encodes output files for a multipart/mixed response. Files smaller than
+    MULTIPART_THRESHOLD are encoded with inline, and bigger ones are replaced
+    with a cid: URL of a part that follows the JSON response. Files on disk
+    are only read when the response is streamed.
+    """
+
+    def __init__(self, inline: Callable[[io.IOBase], str]) -> None:
+        self.inline = inline
+        # Content ID, filename, size, and the path or content of each file
+        self.parts: List[Tuple[str, str, int, Union[str, bytes]]] = []
+
+    def encode_file(self, fh: io.IOBase) -> str:
+        fh.seek(0, os.SEEK_END)
+        size = fh.tell()
+        fh.seek(0)
+        if size < MULTIPART_THRESHOLD:
+            return self.inline(fh)
+
+        path = getattr(fh, "name", None)
+        source: Union[str, bytes]
+        if isinstance(path, str) and os.path.isfile(path):
+            source = path
+        else:
+            content = fh.read()
+            if isinstance(content, str):
+                content = content.encode("utf-8")
+            source = content
+            size = len(content)
+        content_id = f"output-{len(self.parts)}"
+        name = os.path.basename(path) if isinstance(path, str) else ""
+        self.parts.append((content_id, name, size, source))
+        return "cid:" + content_id
+
+    def stream(self, response: bytes, boundary: str) -> Iterator[bytes]:
+        """
+        Yield the body of the multipart response: the JSON response, then
+        each of the files.
+        """
+        yield _part_headers(
+            boundary,
+            [
+                ("Content-Type", "application/json"),
+                ("Content-Length", str(len(response))),
+            ],
+        )
+        yield response
+        for content_id, name, size, source in self.parts:
+            headers = [
+                (
+                    "Content-Type",
+                    mimetypes.guess_type(name)[0] or "application/octet-stream",
+                ),
+                ("Content-ID", f"<{content_id}>"),
+                ("Content-Length", str(size)),
+            ]
+            if name:
+                headers.append(
+                    (
+                        "Content-Disposition",
+                        f"attachment; filename*=UTF-8''{quote(name)}",
+                    )
+                )
+            yield b"\r\n" + _part_headers(boundary, headers)
+            if isinstance(source, bytes):
+                yield source
+                continue
+            with open(source, "rb") as f:
+                while True:
+                    chunk = f.read(MULTIPART_CHUNK_SIZE)
+                    if not chunk:
+                        break
+                    yield chunk
+        yield f"\r\n--{boundary}--\r\n".encode()
+
+
+def _part_headers(boundary: str, headers: List[Tuple[str, str]]) -> bytes:
+    lines = [f"--{boundary}"] + [f"{k}: {v}" for k, v in headers]
+    return ("\r\n".join(lines) + "\r\n\r\n").encode("utf-8")
+
+
+class CompressionMiddleware:
+    """
+    ASGI middleware that compresses responses with one of encodings, if the
+    client accepts it. Responses are buffered, which is fine for the JSON
+    responses the server sends. Multipart responses, which can contain large
+    files, are streamed as they are.
+    """
+
+    def __init__(self, app: Callable, encodings: Sequence[str]) -> None:
+        self.app = app
+        self.encodings = list(encodings)
+
+    async def __call__(self, scope: Dict[str, Any], receive: Callable, send: Callable) -> None:
+        if scope["type"] != "http" or not self.encodings:
+            await self.app(scope, receive, send)
+            return
+
+        headers = {
+            k.decode("latin-1").lower(): v.decode("latin-1")
+            for k, v in scope.get("headers", [])
+        }
+        encoding = choose_compression(headers.get("accept-encoding"), self.encodings)
+        if encoding is None:
+            await self.app(scope, receive, send)
+            return
+
+        start: Dict[str, Any] = {}
+        body = bytearray()
+        passthrough = False
+
+        async def send_compressed(message: Dict[str, Any]) -> None:
+            nonlocal start, passthrough
+            if message["type"] == "http.response.start":
+                content_type = dict(message.get("headers", [])).get(b"content-type", b"")
+                if content_type.lower().startswith(b"multipart/"):
+                    passthrough = True
+                    await send(message)
+                    return
+                start = message
+                return
+            if passthrough or message["type"] != "http.response.body":
+                await send(message)
+                return
+
+            body.extend(message.get("body", b""))
+            if message.get("more_body", False):
+                return
+
+            response_headers = [
+                (k, v)
+                for k, v in start.get("headers", [])
+                if k.lower() != b"content-length"
+            ]
+            already_encoded = any(
+                k.lower() == b"content-encoding" for k, _ in response_headers
+            )
+            content = bytes(body)
+            if not already_encoded and len(content) >= MINIMUM_COMPRESSION_SIZE:
+                content = compress(encoding, content)  # type: ignore
+                response_headers.append((b"content-encoding", encoding.encode()))  # type: ignore
+                response_headers.append((b"vary", b"Accept-Encoding"))
+            response_headers.append((b"content-length", str(len(content)).encode()))
+
+            await send({**start, "headers": response_headers})
+            await send({"type": "http.response.body", "body": content})
+
+        await self.app(scope, receive, send_compressed)
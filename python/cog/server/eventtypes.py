@@ -1,4 +1,4 @@
-from typing import Any, Dict
+from typing import Any, Dict, Optional
 
 from attrs import define, field, validators
 
@@ -8,6 +8,10 @@ from attrs import define, field, validators
 @define
 class PredictionInput:
     payload: Dict[str, Any]
+    # The model variant from cog.yaml to run the prediction with
+    model: Optional[str] = None
+    # The prediction's own temporary directory
+    tmp_dir: Optional[str] = None
 
 
 @define
@@ -36,6 +40,7 @@ class PredictionOutputType:
 @define
 class Done:
     canceled: bool = False
+    preempted: bool = False
     error: bool = False
     error_detail: str = ""
 
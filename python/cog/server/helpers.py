@@ -1,6 +1,8 @@
 import io
 import os
 import selectors
+import socket
+import stat
 import threading
 import uuid
 from typing import Callable, Optional, Sequence, TextIO
@@ -149,3 +151,63 @@ class StreamRedirector(threading.Thread):
                     if drain_tokens_seen >= drain_tokens_needed:
                         self.drain_event.set()
                         drain_tokens_seen = 0
+
+
+def bind_socket(host: str, port: int) -> socket.socket:
+    """
+    Create a socket for the HTTP server listening on host and port.
+
+    If host is empty, it listens on all addresses. Where the kernel supports
+    IPv6, that is a single dual-stack socket that accepts both IPv4 and IPv6
+    connections, so the server can be reached on IPv6-only networks. Where it
+    doesn't, for example in containers with IPv6 disabled, it falls back to
+    IPv4.
+    """
+    if not host:
+        try:
+            return _bind(socket.AF_INET6, ("::", port), dual_stack=True)
+        except OSError:
+            return _bind(socket.AF_INET, ("0.0.0.0", port))
+
+    host = host.strip("[]")
+    family, _, _, _, address = socket.getaddrinfo(
+        host, port, type=socket.SOCK_STREAM
+    )[0]
+    return _bind(family, address)
+
+
+def bind_unix_socket(path: str) -> socket.socket:
+    """
+    Create a socket for the HTTP server listening on the Unix domain socket
+    at path, replacing a socket left behind by a previous server.
+
+    Anyone who can reach the socket can connect to it, so who can use the
+    server is controlled by the permissions of the directory it is in.
+    """
+    try:
+        if stat.S_ISSOCK(os.stat(path).st_mode):
+            os.unlink(path)
+    except FileNotFoundError:
+        pass
+
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    try:
+        sock.bind(path)
+        os.chmod(path, 0o666)
+    except OSError:
+        sock.close()
+        raise
+    return sock
+
+
+def _bind(family: int, address: tuple, dual_stack: bool = False) -> socket.socket:
+    sock = socket.socket(family, socket.SOCK_STREAM)
+    try:
+        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+        if dual_stack:
+            sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 0)
+        sock.bind(address)
+    except OSError:
+        sock.close()
+        raise
+    return sock
@@ -1,11 +1,19 @@
 import argparse
+import io
+import json
 import logging
+import mimetypes
 import os
+import pathlib
 import signal
+import socket
 import textwrap
 import threading
+import uuid
+from collections import OrderedDict
 from datetime import datetime, timezone
-from typing import Any, Callable, Dict, Optional, Union
+from typing import Any, Callable, Dict, List, Optional, Union
+from urllib.parse import quote
 
 import structlog
 import uvicorn
@@ -15,11 +23,14 @@ from enum import Enum, auto, unique
 from fastapi import Body, FastAPI, Header, HTTPException, Path, Response
 from fastapi.encoders import jsonable_encoder
 from fastapi.exceptions import RequestValidationError
-from fastapi.responses import JSONResponse
+from fastapi.responses import JSONResponse, PlainTextResponse, StreamingResponse
 from pydantic import ValidationError
 from pydantic.error_wrappers import ErrorWrapper
+from starlette.background import BackgroundTask
 
 from .. import schema
+from ..first_boot import FirstBoot
+from ..env import set_defaults
 from ..files import upload_file
 from ..json import upload_files
 from ..logging import setup_logging
@@ -30,7 +41,25 @@ from ..predictor import (
     load_config,
     load_predictor_from_ref,
 )
+from .disk import DiskFullError, DiskGuard
+from .encoding import (
+    OUTPUT_ENCODINGS,
+    CompressionMiddleware,
+    MultipartOutput,
+    accepts_json,
+    accepts_multipart,
+    available_compression,
+    parse_prefer,
+)
+from .helpers import bind_socket, bind_unix_socket
+from .load_shedding import PredictionQueue, RequestShedError
 from .runner import PredictionRunner, RunnerBusyError, UnknownPredictionError
+from .tmpdir import PredictionTmpDirs
+from .worker import Models
+
+# How many asynchronous predictions are kept, most recent first, so they can
+# be fetched with GET /predictions/<id>
+MAX_RECENT_PREDICTIONS = 16
 
 log = structlog.get_logger("cog.server.http")
 
@@ -62,11 +91,6 @@ def create_app(
 
     predictor_ref = get_predictor_ref(config, mode)
 
-    runner = PredictionRunner(
-        predictor_ref=predictor_ref,
-        shutdown_event=shutdown_event,
-        upload_url=upload_url,
-    )
     # TODO: avoid loading predictor code in this process
     predictor = load_predictor_from_ref(predictor_ref)
 
@@ -78,10 +102,83 @@ def create_app(
         input_type=InputType, output_type=OutputType
     )
 
+    # Validate warmup inputs now, so a mistake in cog.yaml fails loudly
+    warmup_inputs = []
+    if mode == "predict":
+        for warmup in config.get("warmup") or []:
+            warmup_inputs.append(
+                PredictionRequest(input=warmup.get("input") or {}).dict()["input"]
+            )
+
+    serving = config.get("serving") or {}
+    default_output_encoding = serving.get("output_encoding") or "data_uri"
+    if default_output_encoding not in OUTPUT_ENCODINGS:
+        raise ValueError(
+            f"serving.output_encoding must be one of {', '.join(OUTPUT_ENCODINGS)}, not {default_output_encoding}"
+        )
+    if default_output_encoding == "url" and upload_url is None:
+        log.warn(
+            "serving.output_encoding is url, but the server wasn't started with --upload-url, so output files will be returned as data URIs"
+        )
+        default_output_encoding = "data_uri"
+
+    queue = PredictionQueue(
+        max_size=serving.get("max_queue_size") or 0,
+        timeout=serving.get("queue_timeout"),
+        priorities=serving.get("priorities"),
+        default_priority=serving.get("default_priority"),
+    )
+
+    compression = available_compression(serving.get("compression") or [])
+    if compression:
+        app.add_middleware(CompressionMiddleware, encodings=compression)
+
+    models = Models.from_config(config) if mode == "predict" else None
+    first_boot = FirstBoot(config)
+    tmp_dirs = PredictionTmpDirs.from_config(config)
+    disk_guard = DiskGuard.from_config(config)
+
+    runner = PredictionRunner(
+        predictor_ref=predictor_ref,
+        shutdown_event=shutdown_event,
+        upload_url=upload_url,
+        warmup_inputs=warmup_inputs,
+        models=models,
+        first_boot=first_boot,
+        tmp_dirs=tmp_dirs,
+        preemption_grace=serving.get("preemption_grace"),
+    )
+    app.state.runner = runner
+
+    # Asynchronous predictions with an ID, by ID, oldest first, and whether
+    # their output files are kept until they're forgotten. Requests are
+    # handled in a thread pool, so they're only used with recent_lock held.
+    recent_predictions: "OrderedDict[str, Any]" = OrderedDict()
+    kept_files: Dict[str, bool] = {}
+    recent_lock = threading.Lock()
+
+    def remember(prediction_id: str, response: Any, keep_files: bool) -> None:
+        with recent_lock:
+            previous = recent_predictions.pop(prediction_id, None)
+            previous_kept = kept_files.pop(prediction_id, False)
+            if previous is response:
+                # Remembered again by a retry, which doesn't own the files
+                keep_files = keep_files or previous_kept
+            elif previous_kept:
+                runner.release(previous)
+            recent_predictions[prediction_id] = response
+            kept_files[prediction_id] = keep_files
+            while len(recent_predictions) > MAX_RECENT_PREDICTIONS:
+                forgotten_id, forgotten = recent_predictions.popitem(last=False)
+                if kept_files.pop(forgotten_id, False):
+                    runner.release(forgotten)
+
     @app.on_event("startup")
     def startup() -> None:
         # https://github.com/tiangolo/fastapi/issues/4221
-        RunVar("_default_thread_limiter").set(CapacityLimiter(threads))  # type: ignore
+        # Predictions waiting in the queue each hold a thread, so they mustn't
+        # stop other requests, like health checks, from getting one
+        RunVar("_default_thread_limiter").set(CapacityLimiter(threads + queue.max_size))  # type: ignore
 
         app.state.setup_result = runner.setup()
 
@@ -104,11 +201,21 @@ def create_app(
             health = Health.BUSY if runner.is_busy() else Health.READY
         else:
             health = app.state.health
-        return jsonable_encoder(
-            {
-                "status": health.name,
-                "setup": app.state.setup_result_payload,
-            }
+        response = {
+            "status": health.name,
+            "setup": app.state.setup_result_payload,
+        }
+        first_boot_progress = first_boot.progress()
+        if first_boot_progress is not None:
+            response["first_boot"] = first_boot_progress
+        if disk_guard is not None:
+            response["disk"] = disk_guard.status()
+        return jsonable_encoder(response)
+
+    @app.get("/metrics")
+    def metrics() -> Any:
+        return PlainTextResponse(
+            queue.metrics(), media_type="text/plain; version=0.0.4"
         )
 
     @app.post(
@@ -116,19 +223,13 @@ def create_app(
         response_model=PredictionResponse,
         response_model_exclude_unset=True,
     )
-    def predict(request: PredictionRequest = Body(default=None), prefer: Union[str, None] = Header(default=None)) -> Any:  # type: ignore
+    def predict(request: PredictionRequest = Body(default=None), prefer: Union[str, None] = Header(default=None), accept: Union[str, None] = Header(default=None), x_cog_priority: Union[str, None] = Header(default=None)) -> Any:  # type: ignore
         """
         Run a single prediction on the model
         """
-        if runner.is_busy():
-            return JSONResponse(
-                {"detail": "Already running a prediction"}, status_code=409
-            )
-
-        # TODO: spec-compliant parsing of Prefer header.
-        respond_async = prefer == "respond-async"
-
-        return _predict(request=request, respond_async=respond_async)
+        return _queued_predict(
+            request=request, prefer=prefer, accept=accept, priority=x_cog_priority
+        )
 
     @app.put(
         "/predictions/{prediction_id}",
@@ -139,6 +240,8 @@ def create_app(
         prediction_id: str = Path(..., title="Prediction ID"),
         request: PredictionRequest = Body(..., title="Prediction Request"),
         prefer: Union[str, None] = Header(default=None),
+        accept: Union[str, None] = Header(default=None),
+        x_cog_priority: Union[str, None] = Header(default=None),
     ) -> Any:
         """
         Run a single prediction on the model (idempotent creation).
@@ -159,14 +262,105 @@ def create_app(
         # set on the prediction object
         request.id = prediction_id
 
-        # TODO: spec-compliant parsing of Prefer header.
-        respond_async = prefer == "respond-async"
+        # A retry of the running prediction gets it, rather than waiting for
+        # it to finish and running it again
+        if runner.is_running(prediction_id):
+            return _predict(request=request, prefer=prefer, accept=accept)
+        return _queued_predict(
+            request=request, prefer=prefer, accept=accept, priority=x_cog_priority
+        )
 
-        return _predict(request=request, respond_async=respond_async)
+    def _queued_predict(
+        *,
+        request: PredictionRequest,
+        prefer: Optional[str],
+        accept: Optional[str],
+        priority: Optional[str],
+    ) -> Response:
+        """
+        Wait for a turn in the queue, in the lane for the X-Cog-Priority
+        header, and run the prediction.
+        """
+        try:
+            lane = queue.priority(priority)
+        except ValueError as e:
+            return JSONResponse({"detail": str(e)}, status_code=400)
+        try:
+            if queue.max_size == 0 and runner.is_busy():
+                raise queue.shed("busy", "Already running a prediction")
+            release_turn = queue.acquire(lane)
+        except RequestShedError as e:
+            # Busy is 409 Conflict, as it always has been. Requests that
+            # couldn't be queued can be retried, maybe on another instance.
+            status_code = 409 if e.reason == "busy" else 429
+            return JSONResponse({"detail": e.detail}, status_code=status_code)
+
+        response: Optional[Response] = None
+        try:
+            response = _predict(
+                request=request, prefer=prefer, accept=accept, on_done=release_turn
+            )
+            return response
+        finally:
+            # An asynchronous prediction holds the turn until it finishes,
+            # rather than until it's responded to, so the next request waits
+            # for it instead of finding the runner busy
+            if response is None or response.status_code != 202:
+                release_turn()
+
+    def _output_encoding(
+        prefs: Dict[str, str], accept: Optional[str]
+    ) -> Union[str, JSONResponse]:
+        """
+        Choose how to encode output files, from the output-encoding
+        preference, the Accept header, and then serving.output_encoding.
+        """
+        encoding = prefs.get("output-encoding")
+        if encoding is not None:
+            if encoding not in OUTPUT_ENCODINGS:
+                return JSONResponse(
+                    {
+                        "detail": f"output-encoding must be one of {', '.join(OUTPUT_ENCODINGS)}"
+                    },
+                    status_code=400,
+                )
+            if encoding == "url" and upload_url is None:
+                return JSONResponse(
+                    {
+                        "detail": "output-encoding=url can't be used because the server wasn't started with --upload-url"
+                    },
+                    status_code=400,
+                )
+            return encoding
+        if not accepts_json(accept):
+            return "binary"
+        if default_output_encoding == "binary" and accept is not None:
+            # The client asked for JSON, like cog predict does
+            return "data_uri"
+        return default_output_encoding
 
     def _predict(
-        *, request: PredictionRequest, respond_async: bool = False
+        *,
+        request: PredictionRequest,
+        prefer: Optional[str] = None,
+        accept: Optional[str] = None,
+        on_done: Optional[Callable[[], None]] = None,
     ) -> Response:
+        """
+        Run a prediction. If it's asynchronous, and is started, on_done is
+        called when it finishes, after it's responded to with 202.
+        """
+        prefs = parse_prefer(prefer)
+        respond_async = "respond-async" in prefs
+        output_encoding = _output_encoding(prefs, accept)
+        if isinstance(output_encoding, JSONResponse):
+            return output_encoding
+        if respond_async and output_encoding == "binary":
+            return JSONResponse(
+                {"detail": "Asynchronous predictions can't return binary output"},
+                status_code=406,
+            )
+
         # [compat] If no body is supplied, assume that this model can be run
         # with empty input. This will throw a ValidationError if that's not
         # possible.
@@ -177,36 +371,132 @@ def create_app(
         if request.input is None:
             request.input = {}
 
+        if request.model is not None and (
+            models is None or request.model not in models.weights
+        ):
+            names = ", ".join(sorted(models.weights)) if models else "none"
+            return JSONResponse(
+                {
+                    "detail": f"There is no model called {request.model}. Models are: {names}"
+                },
+                status_code=422,
+            )
+
+        if disk_guard is not None:
+            try:
+                disk_guard.check()
+            except DiskFullError as e:
+                # 507 Insufficient Storage, so the prediction can be retried
+                # on another instance
+                return JSONResponse({"detail": str(e)}, status_code=507)
+
+        # The output files of an asynchronous prediction that can't be
+        # uploaded are kept, so they can be fetched with GET /predictions/<id>
+        keep_files = respond_async and upload_url is None and request.id is not None
+        # A retry of the running prediction gets its response, but the
+        # request that started it owns its output files, and releases them
+        running = (
+            runner.running_prediction(request.id) if request.id is not None else None
+        )
         try:
             # For now, we only ask PredictionRunner to handle file uploads for
             # async predictions. This is unfortunate but required to ensure
             # backwards-compatible behaviour for synchronous predictions.
             initial_response, async_result = runner.predict(
-                request, upload=respond_async
+                request,
+                upload=(respond_async and not keep_files)
+                or (output_encoding == "url" and request.output_file_prefix is None),
+                on_done=on_done if respond_async else None,
             )
         except RunnerBusyError:
             return JSONResponse(
                 {"detail": "Already running a prediction"}, status_code=409
             )
+        owns_prediction = initial_response is not running
 
         if respond_async:
+            if request.id is not None:
+                remember(request.id, initial_response, keep_files and owns_prediction)
             return JSONResponse(jsonable_encoder(initial_response), status_code=202)
 
+        # The output files are in the prediction's temporary directory, which
+        # is removed once they've been encoded, or streamed
+        streaming = False
         try:
-            response = PredictionResponse(**async_result.get().dict())
-        except ValidationError as e:
-            _log_invalid_output(e)
-            raise HTTPException(status_code=500)
+            try:
+                response = PredictionResponse(**async_result.get().dict())
+            except ValidationError as e:
+                _log_invalid_output(e)
+                raise HTTPException(status_code=500)
+
+            response_object = response.dict()
+            if output_encoding == "binary":
+                output = response_object.get("output")
+                if response.status == schema.Status.SUCCEEDED and isinstance(
+                    output, (pathlib.Path, io.IOBase)
+                ):
+                    return _binary_response(output, response_object)
+                if response.status == schema.Status.SUCCEEDED and (
+                    "output-encoding" in prefs or not accepts_json(accept)
+                ):
+                    return JSONResponse(
+                        {
+                            "detail": "The output isn't a single file, so it can't be returned as binary"
+                        },
+                        status_code=406,
+                    )
+
+            def encode_file(fh: io.IOBase) -> str:
+                return upload_file(fh, request.output_file_prefix)  # type: ignore
+
+            multipart = None
+            if (
+                output_encoding == "data_uri"
+                and request.output_file_prefix is None
+                and accepts_multipart(accept)
+            ):
+                # Large files are streamed after the JSON, rather than as
+                # enormous data URIs
+                multipart = MultipartOutput(inline=encode_file)
+
+            response_object["output"] = upload_files(
+                response_object["output"],
+                upload_file=multipart.encode_file if multipart else encode_file,
+            )
 
+            encoded_response = jsonable_encoder(response_object)
+            if multipart is not None and multipart.parts:
+                boundary = uuid.uuid4().hex
+                streaming = True
+                return StreamingResponse(
+                    multipart.stream(json.dumps(encoded_response).encode(), boundary),
+                    media_type=f"multipart/mixed; boundary={boundary}",
+                    background=(
+                        BackgroundTask(runner.release, initial_response)
+                        if owns_prediction
+                        else None
+                    ),
+                )
+            return JSONResponse(content=encoded_response)
+        finally:
+            if owns_prediction and not streaming:
+                runner.release(initial_response)
+
+    @app.get("/predictions/{prediction_id}")
+    def get_prediction(prediction_id: str = Path(..., title="Prediction ID")) -> Any:
+        """
+        Get the status and output of a recent asynchronous prediction
+        """
+        with recent_lock:
+            response = recent_predictions.get(prediction_id)
+        if response is None:
+            return JSONResponse({}, status_code=404)
         response_object = response.dict()
         response_object["output"] = upload_files(
             response_object["output"],
-            upload_file=lambda fh: upload_file(fh, request.output_file_prefix),  # type: ignore
+            upload_file=lambda fh: upload_file(fh, None),  # type: ignore
         )
-
-        # FIXME: clean up output files
-        encoded_response = jsonable_encoder(response_object)
-        return JSONResponse(content=encoded_response)
+        return JSONResponse(jsonable_encoder(response_object))
 
     @app.post("/predictions/{prediction_id}/cancel")
     def cancel(prediction_id: str = Path(..., title="Prediction ID")) -> Any:
@@ -222,6 +512,20 @@ def create_app(
         else:
             return JSONResponse({}, status_code=200)
 
+    @app.post("/predictions/{prediction_id}/preempt")
+    def preempt(prediction_id: str = Path(..., title="Prediction ID")) -> Any:
+        """
+        Preempt a running prediction, so it returns what it has so far
+        """
+        if not runner.is_busy():
+            return JSONResponse({}, status_code=404)
+        try:
+            runner.preempt(prediction_id)
+        except UnknownPredictionError:
+            return JSONResponse({}, status_code=404)
+        else:
+            return JSONResponse({}, status_code=200)
+
     @app.post("/shutdown")
     def start_shutdown() -> Any:
         log.info("shutdown requested via http")
@@ -250,6 +554,32 @@ def create_app(
     return app
 
 
+def _binary_response(
+    output: Union[pathlib.Path, io.IOBase], response_object: Dict[str, Any]
+) -> Response:
+    """
+    Return an output file as the body of the response, rather than encoded in
+    JSON. Only successful predictions are returned like this, and the
+    prediction's ID is in a header instead.
+    """
+    if isinstance(output, pathlib.Path):
+        name = output.name
+        content = output.read_bytes()
+    else:
+        name = os.path.basename(getattr(output, "name", "") or "")
+        output.seek(0)
+        content = output.read()
+        if isinstance(content, str):
+            content = content.encode("utf-8")
+    media_type = mimetypes.guess_type(name)[0] or "application/octet-stream"
+    headers = {}
+    if response_object.get("id"):
+        headers["X-Cog-Prediction-Id"] = response_object["id"]
+    if name:
+        headers["Content-Disposition"] = f"inline; filename*=UTF-8''{quote(name)}"
+    return Response(content=content, media_type=media_type, headers=headers)
+
+
 def _log_invalid_output(error: Any) -> None:
     log.error(
         textwrap.dedent(
@@ -268,8 +598,8 @@ def _log_invalid_output(error: Any) -> None:
 
 
 class Server(uvicorn.Server):
-    def start(self) -> None:
-        self._thread = threading.Thread(target=self.run)
+    def start(self, sockets: Optional[List[socket.socket]] = None) -> None:
+        self._thread = threading.Thread(target=self.run, kwargs={"sockets": sockets})
         self._thread.start()
 
     def stop(self) -> None:
@@ -301,6 +631,26 @@ def signal_set_event(event: threading.Event) -> Callable:
     return _signal_set_event
 
 
+def signal_preempt(
+    runner: PredictionRunner, event: threading.Event, grace: float
+) -> Callable:
+    """
+    Preempts the running prediction, and sets event once it's finished, or
+    grace seconds have passed.
+    """
+
+    def _wait() -> None:
+        runner.wait(timeout=grace)
+        event.set()
+
+    def _signal_preempt(signum: Any, frame: Any) -> None:
+        log.info("Got a signal to exit, preempting the running prediction", grace=grace)
+        runner.preempt()
+        threading.Thread(target=_wait, daemon=True).start()
+
+    return _signal_preempt
+
+
 if __name__ == "__main__":
     parser = argparse.ArgumentParser(description="Cog HTTP server")
     parser.add_argument(
@@ -310,6 +660,27 @@ if __name__ == "__main__":
         default=None,
         help="Number of worker processes. Defaults to number of CPUs, or 1 if using a GPU.",
     )
+    parser.add_argument(
+        "--host",
+        dest="host",
+        type=str,
+        default="",
+        help="Address to listen on. Defaults to all IPv4 and IPv6 addresses",
+    )
+    parser.add_argument(
+        "--port",
+        dest="port",
+        type=int,
+        default=None,
+        help="Port to listen on. Defaults to the PORT environment variable, or 5000",
+    )
+    parser.add_argument(
+        "--unix-socket",
+        dest="unix_socket",
+        type=str,
+        default=None,
+        help="Listen on this Unix domain socket instead of a TCP port",
+    )
     parser.add_argument(
         "--upload-url",
         dest="upload_url",
@@ -342,6 +713,8 @@ if __name__ == "__main__":
     setup_logging(log_level=log_level)
 
     config = load_config()
+    # Before the predictor is started, so it sees them
+    set_defaults(config)
 
     threads = args.threads
     if threads is None:
@@ -359,23 +732,35 @@ if __name__ == "__main__":
         mode=args.mode,
     )
 
-    port = int(os.getenv("PORT", 5000))
+    if args.unix_socket:
+        sock = bind_unix_socket(args.unix_socket)
+        address: Dict[str, Any] = {"uds": args.unix_socket}
+    else:
+        port = args.port if args.port is not None else int(os.getenv("PORT", 5000))
+        sock = bind_socket(args.host, port)
+        host, port = sock.getsockname()[:2]
+        address = {"host": host, "port": port}
     server_config = uvicorn.Config(
         app,
-        host="0.0.0.0",
-        port=port,
+        **address,
         log_config=None,
         # This is the default, but to be explicit: only run a single worker
         workers=1,
     )
 
+    preemption_grace = (config.get("serving") or {}).get("preemption_grace")
     if args.await_explicit_shutdown:
         signal.signal(signal.SIGTERM, signal_ignore)
+    elif preemption_grace:
+        signal.signal(
+            signal.SIGTERM,
+            signal_preempt(app.state.runner, shutdown_event, preemption_grace),
+        )
     else:
         signal.signal(signal.SIGTERM, signal_set_event(shutdown_event))
 
     s = Server(config=server_config)
-    s.start()
+    s.start(sockets=[sock])
 
     try:
         shutdown_event.wait()
@@ -383,3 +768,9 @@ if __name__ == "__main__":
         pass
 
     s.stop()
+
+    if args.unix_socket:
+        try:
+            os.unlink(args.unix_socket)
+        except FileNotFoundError:
+            pass
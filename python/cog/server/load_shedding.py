@@ -0,0 +1,191 @@
+import threading
+import time
+from collections import deque
+from contextlib import contextmanager
+from typing import Callable, Deque, Dict, Iterator, List, Optional
+
+SHED_REASONS = ("busy", "queue_full", "queue_timeout")
+
+
+class RequestShedError(Exception):
+    def __init__(self, reason: str, detail: str) -> None:
+        super().__init__(detail)
+        self.reason = reason
+        self.detail = detail
+
+
+class PredictionQueue:
+    """
+    Limits how many synchronous predictions can wait for the one that is
+    running. Requests over the limit, or that wait for longer than timeout,
+    are shed straight away, so an overloaded container rejects them promptly
+    rather than letting them time out.
+
+    With a max_size of 0, predictions don't wait at all, and a prediction
+    made while another is running is rejected as busy.
+
+    Waiting predictions are in lanes, named by priorities from highest to
+    lowest. When the running prediction finishes, the next one is the first
+    to arrive in the highest lane with any waiting, so batch traffic in a low
+    lane can't hold up interactive traffic in a high one.
+    """
+
+    def __init__(
+        self,
+        max_size: int = 0,
+        timeout: Optional[float] = None,
+        priorities: Optional[List[str]] = None,
+        default_priority: Optional[str] = None,
+    ) -> None:
+        if max_size < 0:
+            raise ValueError("serving.max_queue_size can't be negative")
+        if timeout is not None and timeout <= 0:
+            raise ValueError("serving.queue_timeout must be more than 0")
+        if not priorities:
+            priorities = ["default"]
+        if len(set(priorities)) != len(priorities):
+            raise ValueError("serving.priorities can't have duplicates")
+        if default_priority is None:
+            default_priority = priorities[0]
+        if default_priority not in priorities:
+            raise ValueError(
+                f"serving.default_priority must be one of {', '.join(priorities)}, not {default_priority}"
+            )
+        self.max_size = max_size
+        self.timeout = timeout
+        self.priorities = priorities
+        self.default_priority = default_priority
+
+        self._lock = threading.Lock()
+        # Notified when the turn is released, or a request leaves a lane
+        self._changed = threading.Condition(self._lock)
+        # Whether a request holds the turn and is running its prediction
+        self._running = False
+        self._lanes: Dict[str, Deque[object]] = {p: deque() for p in priorities}
+        self._shed: Dict[str, int] = {reason: 0 for reason in SHED_REASONS}
+
+    @property
+    def length(self) -> int:
+        """The number of predictions waiting for the running one."""
+        with self._lock:
+            return self._waiting()
+
+    def lane_lengths(self) -> Dict[str, int]:
+        with self._lock:
+            return {p: len(lane) for p, lane in self._lanes.items()}
+
+    def shed_counts(self) -> Dict[str, int]:
+        with self._lock:
+            return dict(self._shed)
+
+    def shed(self, reason: str, detail: str) -> RequestShedError:
+        """Count a shed request, and return the error to raise for it."""
+        with self._lock:
+            self._shed[reason] += 1
+        return RequestShedError(reason, detail)
+
+    def priority(self, header: Optional[str]) -> str:
+        """
+        The priority of a request with the X-Cog-Priority header, which
+        raises ValueError if it isn't one of the priorities.
+        """
+        if header is None:
+            return self.default_priority
+        priority = header.strip()
+        if priority not in self._lanes:
+            raise ValueError(
+                f"X-Cog-Priority must be one of {', '.join(self.priorities)}"
+            )
+        return priority
+
+    @contextmanager
+    def turn(self, priority: Optional[str] = None) -> Iterator[None]:
+        """
+        Wait for the predictions ahead in the queue, and hold the turn while
+        running the prediction.
+        """
+        release = self.acquire(priority)
+        try:
+            yield
+        finally:
+            release()
+
+    def acquire(self, priority: Optional[str] = None) -> Callable[[], None]:
+        """
+        Wait for the predictions ahead in the queue, and take the turn. It
+        returns a function that releases it, for predictions that finish
+        after the request that started them, which does nothing if it's
+        called again.
+        """
+        lane = self._lanes[priority or self.default_priority]
+        ticket = object()
+        with self._lock:
+            if self._running and self._waiting() >= self.max_size:
+                if self.max_size:
+                    reason, detail = "queue_full", "Too many predictions are waiting"
+                else:
+                    reason, detail = "busy", "Already running a prediction"
+                self._shed[reason] += 1
+                raise RequestShedError(reason, detail)
+
+            lane.append(ticket)
+            deadline = None if self.timeout is None else time.monotonic() + self.timeout
+            while self._running or self._next() is not ticket:
+                remaining = None if deadline is None else deadline - time.monotonic()
+                if remaining is not None and remaining <= 0:
+                    lane.remove(ticket)
+                    self._changed.notify_all()
+                    self._shed["queue_timeout"] += 1
+                    raise RequestShedError(
+                        "queue_timeout",
+                        "Timed out waiting for other predictions to finish",
+                    )
+                self._changed.wait(remaining)
+            lane.popleft()
+            self._running = True
+
+        released = False
+
+        def release() -> None:
+            nonlocal released
+            with self._lock:
+                if released:
+                    return
+                released = True
+                self._running = False
+                self._changed.notify_all()
+
+        return release
+
+    def _waiting(self) -> int:
+        return sum(len(lane) for lane in self._lanes.values())
+
+    def _next(self) -> Optional[object]:
+        for priority in self.priorities:
+            if self._lanes[priority]:
+                return self._lanes[priority][0]
+        return None
+
+    def metrics(self) -> str:
+        """The queue's metrics, in the Prometheus text format."""
+        lines = [
+            "# HELP cog_queue_length Predictions waiting for the running prediction to finish.",
+            "# TYPE cog_queue_length gauge",
+            f"cog_queue_length {self.length}",
+        ]
+        if len(self.priorities) > 1:
+            lines += [
+                "# HELP cog_queue_priority_length Predictions waiting for the running prediction to finish, by priority.",
+                "# TYPE cog_queue_priority_length gauge",
+            ]
+            for priority, length in self.lane_lengths().items():
+                lines.append(
+                    f'cog_queue_priority_length{{priority="{priority}"}} {length}'
+                )
+        lines += [
+            "# HELP cog_requests_shed_total Predictions rejected because the model was overloaded.",
+            "# TYPE cog_requests_shed_total counter",
+        ]
+        for reason, count in self.shed_counts().items():
+            lines.append(f'cog_requests_shed_total{{reason="{reason}"}} {count}')
+        return "\n".join(lines) + "\n"
@@ -1,9 +1,10 @@
 import io
 import threading
+import time
 import traceback
 from datetime import datetime, timezone
 from multiprocessing.pool import AsyncResult, ThreadPool
-from typing import Any, Callable, Optional, Tuple
+from typing import Any, Callable, Dict, List, Optional, Tuple
 
 import requests
 import structlog
@@ -13,15 +14,21 @@ from requests.packages.urllib3.util.retry import Retry  # type: ignore
 
 from .. import schema
 from .. import types
+from ..first_boot import FirstBoot
 from ..files import put_file_to_signed_endpoint
 from ..json import upload_files
 from .eventtypes import Done, Heartbeat, Log, PredictionOutput, PredictionOutputType
 from .probes import ProbeHelper
+from .tmpdir import PredictionTmpDirs
 from .webhook import webhook_caller_filtered
-from .worker import Worker
+from .worker import Models, Worker
 
 log = structlog.get_logger("cog.server.runner")
 
+# How often, in seconds, a prediction's temporary directory is checked
+# against serving.tmp_dir_quota
+TMP_DIR_CHECK_INTERVAL = 1.0
+
 
 class FileUploadError(Exception):
     pass
@@ -42,18 +49,40 @@ class PredictionRunner:
         predictor_ref: str,
         shutdown_event: threading.Event,
         upload_url: Optional[str] = None,
+        warmup_inputs: Optional[List[Dict[str, Any]]] = None,
+        models: Optional[Models] = None,
+        first_boot: Optional[FirstBoot] = None,
+        tmp_dirs: Optional[PredictionTmpDirs] = None,
+        preemption_grace: Optional[float] = None,
     ):
         self._thread = None
         self._threadpool = ThreadPool(processes=1)
 
         self._response: Optional[schema.PredictionResponse] = None
         self._result: Optional[AsyncResult] = None
-
-        self._worker = Worker(predictor_ref=predictor_ref)
+        # Set when the running prediction has finished, which is before
+        # self._result is ready, because callbacks run first
+        self._finished: Optional[threading.Event] = None
+
+        self._worker = Worker(
+            predictor_ref=predictor_ref,
+            models=models,
+            preemption_grace=preemption_grace,
+        )
         self._should_cancel = threading.Event()
+        self._should_preempt = threading.Event()
 
         self._shutdown_event = shutdown_event
         self._upload_url = upload_url
+        self._warmup_inputs = warmup_inputs or []
+        self._first_boot = first_boot
+
+        self._tmp_dirs = tmp_dirs
+        # Temporary directories of predictions whose output files weren't
+        # uploaded, by the response they're in, until the caller releases them
+        self._unreleased_tmp_dirs: Dict[int, str] = {}
+        if self._tmp_dirs is not None:
+            self._tmp_dirs.remove_all()
 
     def setup(self) -> AsyncResult:
         if self.is_busy():
@@ -71,16 +100,29 @@ class PredictionRunner:
 
         self._result = self._threadpool.apply_async(
             func=setup,
-            kwds={"worker": self._worker},
+            kwds={
+                "worker": self._worker,
+                "warmup_inputs": self._warmup_inputs,
+                "first_boot": self._first_boot,
+                "tmp_dirs": self._tmp_dirs,
+            },
             error_callback=handle_error,
         )
+        self._finished = None
         return self._result
 
     # TODO: Make the return type AsyncResult[schema.PredictionResponse] when we
     # no longer have to support Python 3.8
     def predict(
-        self, prediction: schema.PredictionRequest, upload: bool = True
+        self,
+        prediction: schema.PredictionRequest,
+        upload: bool = True,
+        on_done: Optional[Callable[[], None]] = None,
     ) -> Tuple[schema.PredictionResponse, AsyncResult]:
+        """
+        Start running a prediction. on_done is called when it finishes,
+        whether or not it succeeded, and the runner isn't busy by then.
+        """
         # It's the caller's responsibility to not call us if we're busy.
         if self.is_busy():
             # If self._result is set, but self._response is not, we're still
@@ -98,12 +140,27 @@ class PredictionRunner:
         structlog.contextvars.bind_contextvars(prediction_id=prediction.id)
 
         self._should_cancel.clear()
+        self._should_preempt.clear()
         upload_url = self._upload_url if upload else None
         event_handler = create_event_handler(prediction, upload_url=upload_url)
+        tmp_dir = self._tmp_dirs.create() if self._tmp_dirs is not None else None
+        finished = threading.Event()
+
+        def done() -> None:
+            finished.set()
+            if on_done is not None:
+                on_done()
 
         def cleanup(_: Optional[Any] = None) -> None:
-            if hasattr(prediction.input, "cleanup"):
-                prediction.input.cleanup()
+            try:
+                if hasattr(prediction.input, "cleanup"):
+                    prediction.input.cleanup()
+                # Output files that weren't uploaded are returned as they
+                # are, so they're only removed once the caller releases them
+                if tmp_dir is not None and upload:
+                    self._tmp_dirs.remove(tmp_dir)  # type: ignore
+            finally:
+                done()
 
         def handle_error(error: BaseException) -> None:
             # Re-raise the exception in order to more easily capture exc_info,
@@ -114,8 +171,10 @@ class PredictionRunner:
             except Exception:
                 log.error("caught exception while running prediction", exc_info=True)
                 self._shutdown_event.set()
+            done()
 
         self._response = event_handler.response
+        self._finished = finished
         self._result = self._threadpool.apply_async(
             func=predict,
             kwds={
@@ -123,28 +182,68 @@ class PredictionRunner:
                 "request": prediction,
                 "event_handler": event_handler,
                 "should_cancel": self._should_cancel,
+                "should_preempt": self._should_preempt,
+                "tmp_dir": tmp_dir,
+                "tmp_dirs": self._tmp_dirs,
             },
             callback=cleanup,
             error_callback=handle_error,
         )
+        if tmp_dir is not None and not upload:
+            self._unreleased_tmp_dirs[id(self._response)] = tmp_dir
 
         return (self._response, self._result)
 
+    def release(self, response: schema.PredictionResponse) -> None:
+        """
+        Removes the temporary directory of a prediction that was run with
+        upload=False, once the caller is done with its output files.
+        """
+        tmp_dir = self._unreleased_tmp_dirs.pop(id(response), None)
+        if tmp_dir is not None and self._tmp_dirs is not None:
+            self._tmp_dirs.remove(tmp_dir)
+
     def is_busy(self) -> bool:
         if self._result is None:
             return False
 
-        if not self._result.ready():
+        if not self._result.ready() and not (
+            self._finished is not None and self._finished.is_set()
+        ):
             return True
 
         self._response = None
         self._result = None
+        self._finished = None
         return False
 
+    def is_running(self, prediction_id: str) -> bool:
+        """
+        Whether the prediction called prediction_id is running.
+        """
+        return self.running_prediction(prediction_id) is not None
+
+    def running_prediction(
+        self, prediction_id: str
+    ) -> Optional[schema.PredictionResponse]:
+        """
+        The response of the prediction called prediction_id, if it's running.
+        predict() returns the same response to a retry of it.
+        """
+        if (
+            self.is_busy()
+            and self._response is not None
+            and self._response.id == prediction_id
+        ):
+            return self._response
+        return None
+
     def shutdown(self) -> None:
         self._worker.terminate()
         self._threadpool.terminate()
         self._threadpool.join()
+        if self._tmp_dirs is not None:
+            self._tmp_dirs.remove_all()
 
     def cancel(self, prediction_id: Optional[str] = None) -> None:
         if not self.is_busy():
@@ -154,6 +253,26 @@ class PredictionRunner:
             raise UnknownPredictionError()
         self._should_cancel.set()
 
+    def preempt(self, prediction_id: Optional[str] = None) -> None:
+        """
+        Tells the running prediction it's being preempted, so it can save a
+        checkpoint and return what it has so far.
+        """
+        if not self.is_busy():
+            return
+        assert self._response is not None
+        if prediction_id is not None and prediction_id != self._response.id:
+            raise UnknownPredictionError()
+        self._should_preempt.set()
+
+    def wait(self, timeout: Optional[float] = None) -> None:
+        """
+        Waits for the running prediction, if there is one, to finish.
+        """
+        result = self._result
+        if result is not None:
+            result.wait(timeout)
+
 
 def create_event_handler(
     prediction: schema.PredictionRequest, upload_url: Optional[str] = None
@@ -260,6 +379,17 @@ class PredictionEventHandler:
         self._set_completed_at()
         self._send_webhook(schema.WebhookEvent.COMPLETED)
 
+    def preempted(self) -> None:
+        log.info("prediction preempted")
+        self.p.status = schema.Status.PREEMPTED
+        self._set_completed_at()
+        assert self.p.completed_at is not None
+        assert self.p.started_at is not None
+        self.p.metrics = {
+            "predict_time": (self.p.completed_at - self.p.started_at).total_seconds()
+        }
+        self._send_webhook(schema.WebhookEvent.COMPLETED)
+
     def _set_completed_at(self) -> None:
         self.p.completed_at = datetime.now(tz=timezone.utc)
 
@@ -273,7 +403,6 @@ class PredictionEventHandler:
             return output
 
         try:
-            # TODO: clean up output files
             return self._file_uploader(output)
         except Exception as error:
             # If something goes wrong uploading a file, it's irrecoverable.
@@ -282,12 +411,22 @@ class PredictionEventHandler:
             raise FileUploadError("Got error trying to upload output files") from error
 
 
-def setup(*, worker: Worker):
+def setup(
+    *,
+    worker: Worker,
+    warmup_inputs: Optional[List[Dict[str, Any]]] = None,
+    first_boot: Optional[FirstBoot] = None,
+    tmp_dirs: Optional[PredictionTmpDirs] = None,
+):
     logs = []
     status = None
     started_at = datetime.now(tz=timezone.utc)
 
     try:
+        # The model can depend on what these install or download, so they're
+        # run before it's set up
+        if first_boot is not None:
+            first_boot.run()
         for event in worker.setup():
             if isinstance(event, Log):
                 logs.append(event.message)
@@ -303,6 +442,14 @@ def setup(*, worker: Worker):
         logs.append("Error: did not receive 'done' event from setup!")
         status = schema.Status.FAILED
 
+    # Warmup is part of setup, so the model doesn't report itself as ready
+    # until it has run
+    if status == schema.Status.SUCCEEDED:
+        for input_dict in warmup_inputs or []:
+            logs.extend(
+                warmup(worker=worker, input_dict=input_dict, tmp_dirs=tmp_dirs)
+            )
+
     completed_at = datetime.now(tz=timezone.utc)
 
     # Only if setup succeeded, mark the container as "ready".
@@ -318,12 +465,50 @@ def setup(*, worker: Worker):
     }
 
 
+def warmup(
+    *,
+    worker: Worker,
+    input_dict: Dict[str, Any],
+    tmp_dirs: Optional[PredictionTmpDirs] = None,
+) -> List[str]:
+    """
+    Run a prediction and throw away its output, so things like JIT
+    compilation and CUDA initialization happen before real predictions. A
+    failed warmup is logged, but doesn't fail setup.
+    """
+    log.info("running warmup prediction")
+    logs = []
+    input_dict = dict(input_dict)
+    tmp_dir = tmp_dirs.create() if tmp_dirs is not None else None
+    try:
+        for k, v in input_dict.items():
+            if isinstance(v, types.URLPath):
+                input_dict[k] = v.convert()
+
+        for event in worker.predict(input_dict, poll=0.1, tmp_dir=tmp_dir):
+            if isinstance(event, Log):
+                logs.append(event.message)
+            elif isinstance(event, Done) and event.error:
+                logs.append(f"Warmup prediction failed: {event.error_detail}\n")
+                log.warn("warmup prediction failed", error=event.error_detail)
+    except Exception:
+        logs.append(traceback.format_exc())
+        log.warn("warmup prediction failed", exc_info=True)
+    finally:
+        if tmp_dir is not None:
+            tmp_dirs.remove(tmp_dir)  # type: ignore
+    return logs
+
+
 def predict(
     *,
     worker: Worker,
     request: schema.PredictionRequest,
     event_handler: PredictionEventHandler,
     should_cancel: threading.Event,
+    should_preempt: Optional[threading.Event] = None,
+    tmp_dir: Optional[str] = None,
+    tmp_dirs: Optional[PredictionTmpDirs] = None,
 ) -> schema.PredictionResponse:
 
     # Set up logger context within prediction thread.
@@ -336,6 +521,9 @@ def predict(
             request=request,
             event_handler=event_handler,
             should_cancel=should_cancel,
+            should_preempt=should_preempt,
+            tmp_dir=tmp_dir,
+            tmp_dirs=tmp_dirs,
         )
     except Exception as e:
         tb = traceback.format_exc()
@@ -350,6 +538,9 @@ def _predict(
     request: schema.PredictionRequest,
     event_handler: PredictionEventHandler,
     should_cancel: threading.Event,
+    should_preempt: Optional[threading.Event] = None,
+    tmp_dir: Optional[str] = None,
+    tmp_dirs: Optional[PredictionTmpDirs] = None,
 ) -> schema.PredictionResponse:
     initial_prediction = request.dict()
 
@@ -367,11 +558,32 @@ def _predict(
                 log.warn("failed to download url path from input", exc_info=True)
                 return event_handler.response
 
-    for event in worker.predict(input_dict, poll=0.1):
+    # The prediction is canceled if it puts more than the quota in its
+    # temporary directory, and fails rather than being reported as canceled
+    check_quota = tmp_dir is not None and tmp_dirs is not None and tmp_dirs.quota
+    over_quota = False
+    next_quota_check = time.monotonic() + TMP_DIR_CHECK_INTERVAL
+
+    for event in worker.predict(
+        input_dict, poll=0.1, model=request.model, tmp_dir=tmp_dir
+    ):
         if should_cancel.is_set():
             worker.cancel()
             should_cancel.clear()
 
+        if should_preempt is not None and should_preempt.is_set():
+            worker.preempt()
+            should_preempt.clear()
+
+        if check_quota and not over_quota and (
+            isinstance(event, Done) or time.monotonic() >= next_quota_check
+        ):
+            next_quota_check = time.monotonic() + TMP_DIR_CHECK_INTERVAL
+            if tmp_dirs.over_quota(tmp_dir):  # type: ignore
+                over_quota = True
+                if not isinstance(event, Done):
+                    worker.cancel()
+
         if isinstance(event, Heartbeat):
             # Heartbeat events exist solely to ensure that we have a
             # regular opportunity to check for cancelation and
@@ -402,10 +614,16 @@ def _predict(
                 event_handler.set_output(event.payload)
 
         elif isinstance(event, Done):
-            if event.canceled:
+            if over_quota:
+                event_handler.failed(
+                    error=f"The prediction wrote more than serving.tmp_dir_quota ({tmp_dirs.quota} bytes) of temporary files"  # type: ignore
+                )
+            elif event.canceled:
                 event_handler.canceled()
             elif event.error:
                 event_handler.failed(error=str(event.error_detail))
+            elif event.preempted:
+                event_handler.preempted()
             else:
                 event_handler.succeeded()
 
@@ -0,0 +1,100 @@
+"""
+Temporary directories for predictions. Each prediction gets a directory of
+its own, which tempfile uses while it runs, so files the predictor writes,
+like its output files, are removed once the prediction's done with, rather
+than filling up the disk of a long-running container.
+"""
+import contextlib
+import os
+import re
+import shutil
+import tempfile
+from typing import Any, Dict, Iterator, Optional
+
+# Set to the prediction's temporary directory while it runs
+TMP_DIR_ENV = "COG_PREDICTION_TMP_DIR"
+
+# Decimal, like the sizes cog.yaml is validated with
+_SIZE_UNITS = {"": 1, "k": 10**3, "m": 10**6, "g": 10**9, "t": 10**12, "p": 10**15}
+
+
+def parse_size(size: str) -> int:
+    """
+    Returns a size like 10GB in bytes.
+    """
+    match = re.fullmatch(r"(\d+(?:\.\d+)?) ?([kmgtp]?)i?b?", size.strip(), re.I)
+    if not match:
+        raise ValueError(f"{size} isn't a size, like 10GB")
+    return int(float(match.group(1)) * _SIZE_UNITS[match.group(2).lower()])
+
+
+class PredictionTmpDirs:
+    """
+    Creates and removes the temporary directories of predictions, and checks
+    how much is in them against serving.tmp_dir_quota.
+    """
+
+    def __init__(self, quota: Optional[int] = None, root: Optional[str] = None):
+        self.quota = quota
+        self.root = root or os.path.join(tempfile.gettempdir(), "cog-predictions")
+
+    @classmethod
+    def from_config(cls, config: Dict[str, Any]) -> "PredictionTmpDirs":
+        quota = (config.get("serving") or {}).get("tmp_dir_quota")
+        return cls(quota=parse_size(quota) if quota else None)
+
+    def create(self) -> str:
+        os.makedirs(self.root, exist_ok=True)
+        return tempfile.mkdtemp(prefix="prediction-", dir=self.root)
+
+    def remove(self, path: str) -> None:
+        shutil.rmtree(path, ignore_errors=True)
+
+    def remove_all(self) -> None:
+        """
+        Removes the directories of every prediction, including ones left
+        behind by a server that didn't shut down cleanly.
+        """
+        shutil.rmtree(self.root, ignore_errors=True)
+
+    def usage(self, path: str) -> int:
+        """
+        Returns how many bytes the files in path take up.
+        """
+        total = 0
+        for dirpath, _, filenames in os.walk(path):
+            for name in filenames:
+                try:
+                    total += os.lstat(os.path.join(dirpath, name)).st_size
+                except OSError:
+                    # Removed while it was being walked
+                    pass
+        return total
+
+    def over_quota(self, path: str) -> bool:
+        return self.quota is not None and self.usage(path) > self.quota
+
+
+@contextlib.contextmanager
+def use_tmp_dir(path: Optional[str]) -> Iterator[None]:
+    """
+    Makes tempfile, and anything else that respects TMPDIR, put its files in
+    path while the prediction runs, and tells the predictor where it is.
+    """
+    if path is None:
+        yield
+        return
+    previous = tempfile.tempdir
+    previous_env = {name: os.environ.get(name) for name in ("TMPDIR", TMP_DIR_ENV)}
+    tempfile.tempdir = path
+    os.environ["TMPDIR"] = path
+    os.environ[TMP_DIR_ENV] = path
+    try:
+        yield
+    finally:
+        tempfile.tempdir = previous
+        for name, value in previous_env.items():
+            if value is None:
+                os.environ.pop(name, None)
+            else:
+                os.environ[name] = value
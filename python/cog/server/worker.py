@@ -1,15 +1,20 @@
+import gc
 import multiprocessing
 import os
 import signal
 import sys
+import time
 import traceback
 import types
+from collections import OrderedDict
 from enum import Enum, auto, unique
 from multiprocessing.connection import Connection
 from typing import Any, Dict, Iterable, Optional, TextIO, Union
 
 from ..json import make_encodeable
 from ..predictor import BasePredictor, load_predictor_from_ref, get_predict, run_setup
+from ..preemption import Preempted
+from . import cgroup
 from .eventtypes import (
     Done,
     Heartbeat,
@@ -25,6 +30,7 @@ from .exceptions import (
     InvalidStateException,
 )
 from .helpers import StreamRedirector, WrappedStream
+from .tmpdir import use_tmp_dir
 
 _spawn = multiprocessing.get_context("spawn")
 
@@ -40,14 +46,59 @@ class WorkerState(Enum):
     DEFUNCT = auto()
 
 
+class Models:
+    """
+    Model variants from cog.yaml, which share the predictor's code but are set
+    up with different weights.
+    """
+
+    def __init__(
+        self,
+        weights: Dict[str, str],
+        default: Optional[str] = None,
+        max_loaded: int = 0,
+    ) -> None:
+        if default is not None and default not in weights:
+            raise ValueError(
+                f"default_model must be one of the models in cog.yaml, not {default}"
+            )
+        if max_loaded < 0:
+            raise ValueError("serving.max_loaded_models can't be negative")
+        # Weights of each variant, by name
+        self.weights = weights
+        self.default = default
+        # How many variants can be loaded at once, or 0 for no limit
+        self.max_loaded = max_loaded
+
+    @classmethod
+    def from_config(cls, config: Dict[str, Any]) -> Optional["Models"]:
+        models = config.get("models")
+        if not models:
+            return None
+        return cls(
+            weights={name: m["weights"] for name, m in models.items()},
+            default=config.get("default_model"),
+            max_loaded=(config.get("serving") or {}).get("max_loaded_models") or 0,
+        )
+
+
 class Worker:
-    def __init__(self, predictor_ref: str, tee_output: bool = True):
+    def __init__(
+        self,
+        predictor_ref: str,
+        tee_output: bool = True,
+        models: Optional[Models] = None,
+        preemption_grace: Optional[float] = None,
+    ):
         self._state = WorkerState.NEW
         self._allow_cancel = False
+        self._allow_preempt = False
 
         # A pipe with which to communicate with the child worker.
         self._events, child_events = _spawn.Pipe()
-        self._child = _ChildWorker(predictor_ref, child_events, tee_output)
+        self._child = _ChildWorker(
+            predictor_ref, child_events, tee_output, models, preemption_grace
+        )
         self._terminating = False
 
     def setup(self) -> Iterable[_PublicEventType]:
@@ -58,12 +109,17 @@ class Worker:
         return self._wait(raise_on_error="Predictor errored during setup")
 
     def predict(
-        self, payload: Dict[str, Any], poll: Optional[float] = None
+        self,
+        payload: Dict[str, Any],
+        poll: Optional[float] = None,
+        model: Optional[str] = None,
+        tmp_dir: Optional[str] = None,
     ) -> Iterable[_PublicEventType]:
         self._assert_state(WorkerState.READY)
         self._state = WorkerState.PROCESSING
         self._allow_cancel = True
-        self._events.send(PredictionInput(payload=payload))
+        self._allow_preempt = True
+        self._events.send(PredictionInput(payload=payload, model=model, tmp_dir=tmp_dir))
 
         return self._wait(poll=poll)
 
@@ -92,6 +148,15 @@ class Worker:
             os.kill(self._child.pid, signal.SIGUSR1)
             self._allow_cancel = False
 
+    def preempt(self) -> None:
+        """
+        Tells the running prediction it's being preempted, so it can save a
+        checkpoint and return early.
+        """
+        if self._allow_preempt and self._child.is_alive():
+            os.kill(self._child.pid, signal.SIGUSR2)
+            self._allow_preempt = False
+
     def _assert_state(self, state: WorkerState) -> None:
         if self._state != state:
             raise InvalidStateException(
@@ -102,6 +167,8 @@ class Worker:
         self, poll: Optional[float] = None, raise_on_error: Optional[str] = None
     ) -> Iterable[_PublicEventType]:
         done = None
+        # To tell whether the child is killed for running out of memory
+        oom_kills = cgroup.oom_kills()
 
         if poll:
             send_heartbeats = True
@@ -127,11 +194,15 @@ class Worker:
             else:
                 self._state = WorkerState.READY
                 self._allow_cancel = False
+                self._allow_preempt = False
 
         # If we dropped off the end off the end of the loop, check if it's
         # because the child process died.
         if not self._child.is_alive() and not self._terminating:
             exitcode = self._child.exitcode
+            if oom_kills is not None and (cgroup.oom_kills() or 0) > oom_kills:
+                phase = "setup" if raise_on_error else "inference"
+                raise FatalWorkerException(cgroup.out_of_memory_message(phase))
             raise FatalWorkerException(
                 f"Prediction failed for an unknown reason. It might have run out of memory? (exitcode {exitcode})"
             )
@@ -143,12 +214,20 @@ class _ChildWorker(_spawn.Process):  # type: ignore
         predictor_ref: str,
         events: Connection,
         tee_output: bool = True,
+        models: Optional[Models] = None,
+        preemption_grace: Optional[float] = None,
     ):
         self._predictor_ref = predictor_ref
-        self._predictor: Optional[BasePredictor] = None
+        self._models = models
+        # Set-up predictors, by model variant, least recently used first. The
+        # predictor set up with the image's own weights is None.
+        self._predictors: "OrderedDict[Optional[str], BasePredictor]" = OrderedDict()
         self._events = events
         self._tee_output = tee_output
         self._cancelable = False
+        # How long predict() has to return once it's preempted, in seconds
+        self._preemption_grace = preemption_grace
+        self._preempted = False
 
         super().__init__()
 
@@ -160,6 +239,8 @@ class _ChildWorker(_spawn.Process):  # type: ignore
 
         # We use SIGUSR1 to signal an interrupt for cancelation.
         signal.signal(signal.SIGUSR1, self._signal_handler)
+        # And SIGUSR2 for preemption.
+        signal.signal(signal.SIGUSR2, self._signal_handler)
 
         ws_stdout = WrappedStream("stdout", sys.stdout)
         ws_stderr = WrappedStream("stderr", sys.stderr)
@@ -179,10 +260,7 @@ class _ChildWorker(_spawn.Process):  # type: ignore
     def _setup(self) -> None:
         done = Done()
         try:
-            self._predictor = load_predictor_from_ref(self._predictor_ref)
-            # Could be a function or a class
-            if hasattr(self._predictor, "setup"):
-                run_setup(self._predictor)
+            self._load(self._models.default if self._models else None)
         except Exception as e:
             traceback.print_exc()
             done.error = True
@@ -204,16 +282,48 @@ class _ChildWorker(_spawn.Process):  # type: ignore
             if isinstance(ev, Shutdown):
                 break
             elif isinstance(ev, PredictionInput):
-                self._predict(ev.payload)
+                with use_tmp_dir(ev.tmp_dir):
+                    self._predict(ev.payload, ev.model)
             else:
                 print(f"Got unexpected event: {ev}", file=sys.stderr)
 
-    def _predict(self, payload: Dict[str, Any]) -> None:
-        assert self._predictor
+    def _load(self, model: Optional[str]) -> BasePredictor:
+        """
+        Return the predictor for a model variant, setting it up first if it
+        isn't loaded. If that makes too many loaded, the least recently used
+        is unloaded.
+        """
+        if model in self._predictors:
+            self._predictors.move_to_end(model)
+            return self._predictors[model]
+
+        if self._models and self._models.max_loaded:
+            while len(self._predictors) >= self._models.max_loaded:
+                unloaded, _ = self._predictors.popitem(last=False)
+                print(f"Unloading model {unloaded or 'default'}", file=sys.stderr)
+            # Free the memory of the unloaded predictor before setting up
+            # the next one
+            gc.collect()
+
+        if model is not None:
+            print(f"Loading model {model}", file=sys.stderr)
+        predictor = load_predictor_from_ref(self._predictor_ref)
+        # Could be a function or a class
+        if hasattr(predictor, "setup"):
+            run_setup(predictor, None if model is None else self._models.weights[model])  # type: ignore
+        elif model is not None:
+            raise ValueError("cog.yaml has model variants, but the predictor doesn't have a setup() method to load them")
+        self._predictors[model] = predictor
+        return predictor
+
+    def _predict(self, payload: Dict[str, Any], model: Optional[str] = None) -> None:
         done = Done()
         self._cancelable = True
+        self._preempted = False
         try:
-            predict = get_predict(self._predictor)
+            if model is None and self._models:
+                model = self._models.default
+            predict = get_predict(self._load(model))
             result = predict(**payload)
 
             if result:
@@ -226,18 +336,29 @@ class _ChildWorker(_spawn.Process):  # type: ignore
                     self._events.send(PredictionOutput(payload=make_encodeable(result)))
         except CancelationException:
             done.canceled = True
+        except Preempted:
+            # The predictor didn't catch it, so its output is whatever it
+            # yielded before it was preempted
+            pass
         except Exception as e:
             traceback.print_exc()
             done.error = True
             done.error_detail = str(e)
         finally:
             self._cancelable = False
+        done.preempted = self._preempted and not done.canceled
         self._stream_redirector.drain()
         self._events.send(done)
 
     def _signal_handler(self, signum: int, frame: Optional[types.FrameType]) -> None:
         if signum == signal.SIGUSR1 and self._cancelable:
             raise CancelationException()
+        if signum == signal.SIGUSR2 and self._cancelable and not self._preempted:
+            self._preempted = True
+            deadline = None
+            if self._preemption_grace is not None:
+                deadline = time.time() + self._preemption_grace
+            raise Preempted(deadline)
 
     def _stream_write_hook(
         self, stream_name: str, original_stream: TextIO, data: str
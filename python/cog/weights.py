@@ -0,0 +1,144 @@
+"""
+Loading model weights: joining weights sharded across layers of the image,
+decryption of weights stored encrypted in the image, and memory-mapping
+weights shared between replicas.
+
+Files are encrypted with `cog weights encrypt`. See pkg/weights/encryption.go
+for a description of the format.
+"""
+import base64
+import glob
+import mmap
+import os
+import shutil
+import struct
+import subprocess
+from pathlib import Path
+from typing import Any, BinaryIO, Dict, Union
+
+import structlog
+
+log = structlog.get_logger("cog.weights")
+
+MAGIC = b"COGENC1\n"
+HEADER_SIZE = len(MAGIC) + 4 + 8
+TAG_SIZE = 16
+KEY_SIZE = 32
+
+
+class WeightsDecryptionError(Exception):
+    """Raised when encrypted weights can't be decrypted."""
+
+
+def join_weight_shards(config: Dict[str, Any]) -> None:
+    """
+    Joins the shards of the files listed in weights.sharding in cog.yaml,
+    which are each in a layer of their own in the image, back into the file.
+    The shards are named <file>.shard-NN, by ShardPath in
+    pkg/dockerfile/weights_shards.go.
+    """
+    sharding = (config.get("weights") or {}).get("sharding")
+    if not sharding:
+        return
+
+    for path in sharding.get("files", []):
+        if os.path.exists(path):
+            continue
+        shards = sorted(glob.glob(glob.escape(path) + ".shard-[0-9][0-9]"))
+        if not shards:
+            raise FileNotFoundError(f"There are no shards of the weights file {path}")
+        log.info("joining weight shards", path=path, shards=len(shards))
+        tmp_path = path + ".tmp"
+        with open(tmp_path, "wb") as dest:
+            for shard in shards:
+                with open(shard, "rb") as src:
+                    shutil.copyfileobj(src, dest, 16 * 1024 * 1024)
+        os.rename(tmp_path, path)
+
+
+def decrypt_weights(config: Dict[str, Any]) -> None:
+    """
+    Decrypts the files listed in weights.encryption in cog.yaml, writing each
+    one next to the encrypted file without the .enc suffix.
+    """
+    encryption = (config.get("weights") or {}).get("encryption")
+    if not encryption:
+        return
+
+    key = _load_key(encryption)
+    for encrypted_path in encryption.get("files", []):
+        path = encrypted_path[: -len(".enc")]
+        if os.path.exists(path):
+            continue
+        log.info("decrypting weights", path=path)
+        tmp_path = path + ".tmp"
+        with open(encrypted_path, "rb") as src, open(tmp_path, "wb") as dest:
+            _decrypt(src, dest, key)
+        os.rename(tmp_path, path)
+
+
+def _load_key(encryption: Dict[str, Any]) -> bytes:
+    key_env = encryption.get("key_env") or "COG_WEIGHTS_KEY"
+    encoded = os.environ.get(key_env)
+    if not encoded and encryption.get("key_command"):
+        encoded = subprocess.run(
+            encryption["key_command"],
+            shell=True,
+            check=True,
+            stdout=subprocess.PIPE,
+        ).stdout.decode()
+    if not encoded:
+        raise WeightsDecryptionError(
+            f"The weights of this model are encrypted. Set the {key_env} environment variable to the key to decrypt them."
+        )
+    key = base64.b64decode(encoded.strip())
+    if len(key) != KEY_SIZE:
+        raise WeightsDecryptionError(
+            f"Weights key must be {KEY_SIZE} bytes, got {len(key)}"
+        )
+    return key
+
+
+def _decrypt(src: BinaryIO, dest: BinaryIO, key: bytes) -> None:
+    from cryptography.exceptions import InvalidTag
+    from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+
+    header = src.read(HEADER_SIZE)
+    if len(header) != HEADER_SIZE or not header.startswith(MAGIC):
+        raise WeightsDecryptionError("Not a Cog encrypted weights file")
+    (chunk_size,) = struct.unpack(">I", header[len(MAGIC) : len(MAGIC) + 4])
+    nonce_prefix = header[len(MAGIC) + 4 :]
+    size = chunk_size + TAG_SIZE
+
+    aesgcm = AESGCM(key)
+    index = 0
+    chunk = src.read(size)
+    while True:
+        next_chunk = src.read(size) if len(chunk) == size else b""
+        final = next_chunk == b""
+        nonce = nonce_prefix + struct.pack(">I", index)
+        aad = header + (b"\x01" if final else b"\x00")
+        try:
+            dest.write(aesgcm.decrypt(nonce, chunk, aad))
+        except InvalidTag:
+            raise WeightsDecryptionError(
+                "Failed to decrypt weights, the key may be wrong or the file corrupted"
+            )
+        if final:
+            return
+        chunk = next_chunk
+        index += 1
+
+
+def mmap_weights(path: Union[str, Path]) -> mmap.mmap:
+    """
+    Map a weights file into memory, read-only. The pages are shared with
+    every other process that maps the same file, so replicas on one host that
+    load weights from a shared volume (weights.shared in cog.yaml) keep one
+    copy in the page cache between them, rather than one each.
+
+    The result supports the buffer protocol, so it can be passed to things
+    like numpy.frombuffer() or torch.frombuffer() without copying.
+    """
+    with open(path, "rb") as fh:
+        return mmap.mmap(fh.fileno(), 0, access=mmap.ACCESS_READ)
@@ -39,11 +39,22 @@ def uses_predictor_with_client_options(name, **options):
     )
 
 
-def make_client(fixture_name: str, upload_url: Optional[str] = None):
+def make_client(
+    fixture_name: str,
+    upload_url: Optional[str] = None,
+    serving: Optional[Dict[str, Any]] = None,
+    models: Optional[Dict[str, Any]] = None,
+    default_model: Optional[str] = None,
+):
     """
     Creates a fastapi test client for an app that uses the requested Predictor.
     """
-    config = {"predict": _fixture_path(fixture_name)}
+    config = {
+        "predict": _fixture_path(fixture_name),
+        "serving": serving,
+        "models": models,
+        "default_model": default_model,
+    }
     app = create_app(
         config=config,
         shutdown_event=threading.Event(),
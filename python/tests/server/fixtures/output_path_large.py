@@ -0,0 +1,13 @@
+import os
+import tempfile
+
+from cog import BasePredictor, Path
+
+
+class Predictor(BasePredictor):
+    def predict(self) -> Path:
+        temp_dir = tempfile.mkdtemp()
+        temp_path = os.path.join(temp_dir, "large.bin")
+        with open(temp_path, "wb") as fh:
+            fh.write(b"x" * (2 * 1024 * 1024))
+        return Path(temp_path)
@@ -0,0 +1,14 @@
+import time
+
+from cog import BasePredictor, Preempted
+
+
+class Predictor(BasePredictor):
+    def predict(self, steps: int = 100) -> str:
+        step = 0
+        try:
+            for step in range(steps):
+                time.sleep(0.05)
+        except Preempted as e:
+            return f"checkpointed at step {step}, deadline {e.deadline is not None}"
+        return "finished"
@@ -0,0 +1,15 @@
+import os
+import tempfile
+import time
+
+from cog import BasePredictor, Path
+
+
+class Predictor(BasePredictor):
+    def predict(self, sleep: float = 0) -> Path:
+        time.sleep(sleep)
+        temp_dir = tempfile.mkdtemp()
+        temp_path = os.path.join(temp_dir, "file.txt")
+        with open(temp_path, "w") as fh:
+            fh.write("hello")
+        return Path(temp_path)
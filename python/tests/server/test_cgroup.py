@@ -0,0 +1,28 @@
+from cog.server import cgroup
+
+
+def write(tmp_path, name, contents):
+    (tmp_path / name).write_text(contents)
+
+
+def test_oom_kills(tmp_path):
+    assert cgroup.oom_kills(str(tmp_path)) is None
+    write(tmp_path, "memory.events", "low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n")
+    assert cgroup.oom_kills(str(tmp_path)) == 1
+
+
+def test_out_of_memory_message(tmp_path):
+    assert (
+        cgroup.out_of_memory_message("inference", str(tmp_path))
+        == "The container ran out of memory during inference"
+    )
+
+    write(tmp_path, "memory.max", "17179869184\n")
+    write(tmp_path, "memory.peak", "17179860992\n")
+    assert (
+        cgroup.out_of_memory_message("inference", str(tmp_path))
+        == "The container exceeded its 16 GiB memory limit during inference, with a peak usage of 16 GiB"
+    )
+
+    write(tmp_path, "memory.max", "max\n")
+    assert cgroup.memory_limit(str(tmp_path)) is None
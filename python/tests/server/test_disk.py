@@ -0,0 +1,59 @@
+import os
+
+import pytest
+
+from cog.server.disk import DiskFullError, DiskGuard
+
+
+def write(path, size, mtime):
+    path.write_bytes(b"x" * size)
+    os.utime(path, (mtime, mtime))
+
+
+def fake_free(evict_dir, total):
+    def free():
+        return total - sum(
+            os.path.getsize(os.path.join(evict_dir, name))
+            for name in os.listdir(evict_dir)
+        )
+
+    return free
+
+
+def test_check_enough_free(tmp_path):
+    guard = DiskGuard(min_free=10, evict_dirs=[str(tmp_path)])
+    guard.free = lambda: 100
+    write(tmp_path / "cached.bin", 4, 1000)
+    guard.check()
+    assert (tmp_path / "cached.bin").exists()
+    assert guard.status() == {"free": 100, "min_free": 10, "low": False}
+
+
+def test_check_evicts_least_recently_used(tmp_path):
+    write(tmp_path / "old.bin", 4, 1000)
+    write(tmp_path / "new.bin", 4, 2000)
+    guard = DiskGuard(min_free=95, evict_dirs=[str(tmp_path)])
+    guard.free = fake_free(tmp_path, 100)
+
+    guard.check()
+    assert not (tmp_path / "old.bin").exists()
+    assert (tmp_path / "new.bin").exists()
+
+
+def test_check_not_enough_after_evicting(tmp_path):
+    write(tmp_path / "cached.bin", 4, 1000)
+    guard = DiskGuard(min_free=99, evict_dirs=[str(tmp_path)])
+    guard.free = fake_free(tmp_path, 90)
+
+    with pytest.raises(DiskFullError, match="serving.min_free_disk"):
+        guard.check()
+    assert not (tmp_path / "cached.bin").exists()
+
+
+def test_from_config():
+    assert DiskGuard.from_config({}) is None
+    guard = DiskGuard.from_config(
+        {"serving": {"min_free_disk": "5GB", "evict_dirs": ["/cache"]}}
+    )
+    assert guard.min_free == 5 * 1000**3
+    assert guard.evict_dirs == ["/cache"]
@@ -1,10 +1,16 @@
 import os
+import socket
 import tempfile
 import uuid
 
 import pytest
 
-from cog.server.helpers import StreamRedirector, WrappedStream
+from cog.server.helpers import (
+    StreamRedirector,
+    WrappedStream,
+    bind_socket,
+    bind_unix_socket,
+)
 
 
 @pytest.fixture
@@ -183,3 +189,71 @@ def test_stream_redirector_with_no_streams_raises():
 
     with pytest.raises(ValueError):
         StreamRedirector([], _write_hook)
+
+
+def test_bind_socket_dual_stack():
+    """
+    With no host, bind_socket listens on both IPv4 and IPv6 if the kernel
+    supports IPv6.
+    """
+    sock = bind_socket("", 0)
+    sock.listen()
+    port = sock.getsockname()[1]
+    try:
+        addresses = ["127.0.0.1"]
+        if sock.family == socket.AF_INET6:
+            addresses.append("::1")
+        for address in addresses:
+            with socket.create_connection((address, port), timeout=1):
+                pass
+    finally:
+        sock.close()
+
+
+def test_bind_socket_host():
+    sock = bind_socket("127.0.0.1", 0)
+    try:
+        assert sock.family == socket.AF_INET
+        assert sock.getsockname()[0] == "127.0.0.1"
+    finally:
+        sock.close()
+
+
+@pytest.mark.skipif(not socket.has_ipv6, reason="IPv6 is not supported")
+def test_bind_socket_ipv6_host():
+    try:
+        sock = bind_socket("[::1]", 0)
+    except OSError:
+        pytest.skip("IPv6 loopback is not available")
+    try:
+        assert sock.family == socket.AF_INET6
+        assert sock.getsockname()[0] == "::1"
+    finally:
+        sock.close()
+
+
+def test_bind_unix_socket(tmpdir):
+    path = os.path.join(tmpdir, "cog.sock")
+
+    # A socket left behind by a server that didn't exit cleanly
+    stale = bind_unix_socket(path)
+    stale.close()
+
+    sock = bind_unix_socket(path)
+    sock.listen()
+    try:
+        with socket.socket(socket.AF_UNIX, socket.SOCK_STREAM) as client:
+            client.connect(path)
+    finally:
+        sock.close()
+
+
+def test_bind_unix_socket_does_not_replace_files(tmpdir):
+    path = os.path.join(tmpdir, "predict.py")
+    with open(path, "w") as f:
+        f.write("important")
+
+    with pytest.raises(OSError):
+        bind_unix_socket(path)
+    with open(path) as f:
+        assert f.read() == "important"
@@ -470,6 +470,52 @@ def test_asynchronous_prediction_endpoint(client, match):
     assert webhook.call_count == 1
 
 
+@uses_predictor("output_path_text")
+def test_get_prediction(client):
+    resp = client.get("/predictions/123")
+    assert resp.status_code == 404
+
+    resp = client.post(
+        "/predictions",
+        json={"id": "123", "input": {}},
+        headers={"Prefer": "respond-async"},
+    )
+    assert resp.status_code == 202
+
+    n = 0
+    while n < 50:
+        resp = client.get("/predictions/123")
+        assert resp.status_code == 200
+        if resp.json()["status"] == "succeeded":
+            break
+        time.sleep(0.1)
+        n += 1
+
+    # The output file is kept, and returned as a data URI
+    assert resp.json()["output"] == "data:text/plain;base64,aGVsbG8="
+
+
+@uses_predictor("sleep_output_path_text")
+def test_prediction_idempotent_retry_keeps_files(client):
+    resp = client.put(
+        "/predictions/123",
+        json={"input": {"sleep": 0.5}},
+        headers={"Prefer": "respond-async"},
+    )
+    assert resp.status_code == 202
+
+    # A synchronous retry gets the running prediction's output, but the
+    # files belong to the first request, so they're still there after it
+    resp = client.put("/predictions/123", json={"input": {"sleep": 0.5}})
+    assert resp.status_code == 200
+    assert resp.json()["output"] == "data:text/plain;base64,aGVsbG8="
+
+    resp = client.get("/predictions/123")
+    assert resp.status_code == 200
+    assert resp.json()["status"] == "succeeded"
+    assert resp.json()["output"] == "data:text/plain;base64,aGVsbG8="
+
+
 @uses_predictor("sleep")
 def test_prediction_cancel(client):
     resp = client.post("/predictions/123/cancel")
@@ -497,3 +543,33 @@ def test_weights_are_read_from_environment_variables(client, match):
     resp = client.post("/predictions")
     assert resp.status_code == 200
     assert resp.json() == match({"status": "succeeded", "output": "hello"})
+
+
+@uses_predictor_with_client_options(
+    "setup_weights",
+    models={
+        "hello": {"weights": "data:text/plain; charset=utf-8;base64,aGVsbG8="},
+        "goodbye": {"weights": "data:text/plain; charset=utf-8;base64,Z29vZGJ5ZQ=="},
+    },
+    default_model="hello",
+    serving={"max_loaded_models": 1},
+)
+def test_model_variants(client, match):
+    resp = client.post("/predictions")
+    assert resp.status_code == 200
+    assert resp.json() == match({"status": "succeeded", "output": "hello"})
+
+    resp = client.post("/predictions", json={"model": "goodbye"})
+    assert resp.status_code == 200
+    assert resp.json() == match(
+        {"status": "succeeded", "output": "goodbye", "model": "goodbye"}
+    )
+    assert "Loading model goodbye" in resp.json()["logs"]
+
+    # hello was unloaded to make room for goodbye, so it's loaded again
+    resp = client.post("/predictions", json={"model": "hello"})
+    assert resp.json() == match({"status": "succeeded", "output": "hello"})
+    assert "Unloading model goodbye" in resp.json()["logs"]
+
+    resp = client.post("/predictions", json={"model": "farewell"})
+    assert resp.status_code == 422
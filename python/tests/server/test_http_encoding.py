@@ -0,0 +1,214 @@
+import email
+import io
+import json
+
+import pytest
+
+from cog.server.encoding import (
+    MultipartOutput,
+    accepts_json,
+    accepts_multipart,
+    choose_compression,
+    parse_prefer,
+    parse_quality_list,
+)
+
+from .conftest import uses_predictor, uses_predictor_with_client_options
+
+
+def test_parse_prefer():
+    assert parse_prefer(None) == {}
+    assert parse_prefer("respond-async") == {"respond-async": ""}
+    assert parse_prefer("respond-async, output-encoding=binary") == {
+        "respond-async": "",
+        "output-encoding": "binary",
+    }
+    assert parse_prefer('output-encoding="url"; foo=bar') == {"output-encoding": "url"}
+
+
+def test_parse_quality_list():
+    assert parse_quality_list("gzip, zstd;q=0.5, br;q=0") == {
+        "gzip": 1.0,
+        "zstd": 0.5,
+        "br": 0.0,
+    }
+
+
+def test_accepts_json():
+    assert accepts_json(None)
+    assert accepts_json("application/json")
+    assert accepts_json("*/*")
+    assert accepts_json("image/png, application/*;q=0.1")
+    assert not accepts_json("image/png")
+    assert not accepts_json("application/octet-stream")
+    assert not accepts_json("application/json;q=0")
+
+
+def test_accepts_multipart():
+    assert not accepts_multipart(None)
+    assert not accepts_multipart("application/json")
+    assert accepts_multipart("multipart/mixed, application/json")
+    assert not accepts_multipart("multipart/mixed;q=0")
+
+
+def test_multipart_output():
+    multipart = MultipartOutput(inline=lambda fh: "data:inline")
+    assert multipart.encode_file(io.BytesIO(b"small")) == "data:inline"
+    large = io.BytesIO(b"x" * (1024 * 1024))
+    assert multipart.encode_file(large) == "cid:output-0"
+
+    body = b"".join(multipart.stream(b'{"output": "cid:output-0"}', "b"))
+    message = email.message_from_bytes(
+        b"Content-Type: multipart/mixed; boundary=b\r\n\r\n" + body
+    )
+    parts = message.get_payload()
+    assert parts[0].get_payload() == '{"output": "cid:output-0"}'
+    assert parts[1]["Content-ID"] == "<output-0>"
+    assert parts[1].get_payload(decode=True) == b"x" * (1024 * 1024)
+
+
+def test_choose_compression():
+    assert choose_compression(None, ["gzip"]) is None
+    assert choose_compression("gzip, deflate", ["gzip"]) == "gzip"
+    assert choose_compression("gzip, zstd", ["zstd", "gzip"]) == "zstd"
+    assert choose_compression("zstd", ["gzip"]) is None
+    assert choose_compression("gzip;q=0", ["gzip"]) is None
+    assert choose_compression("*", ["gzip"]) == "gzip"
+
+
+@uses_predictor("output_path_image")
+def test_output_binary_with_prefer(client):
+    res = client.post("/predictions", headers={"Prefer": "output-encoding=binary"})
+    assert res.status_code == 200
+    assert res.headers["content-type"] == "image/bmp"
+    assert res.content[:2] == b"BM"
+
+
+@uses_predictor("output_path_image")
+def test_output_binary_with_accept(client):
+    res = client.post("/predictions", headers={"Accept": "image/bmp"})
+    assert res.status_code == 200
+    assert res.headers["content-type"] == "image/bmp"
+
+
+@uses_predictor("output_path_image")
+def test_output_data_uri_by_default(client):
+    res = client.post("/predictions", headers={"Accept": "application/json"})
+    assert res.status_code == 200
+    assert res.json()["output"].startswith("data:image/bmp;base64,")
+
+
+@uses_predictor_with_client_options(
+    "output_path_image", serving={"output_encoding": "binary"}
+)
+def test_output_binary_from_config(client):
+    res = client.post("/predictions")
+    assert res.status_code == 200
+    assert res.headers["content-type"] == "image/bmp"
+
+    # Clients that ask for JSON, like cog predict, still get it
+    res = client.post("/predictions", headers={"Accept": "application/json"})
+    assert res.json()["output"].startswith("data:image/bmp;base64,")
+
+
+@uses_predictor("hello_world")
+def test_output_binary_not_a_file(client):
+    res = client.post(
+        "/predictions",
+        json={"input": {"name": "world"}},
+        headers={"Prefer": "output-encoding=binary"},
+    )
+    assert res.status_code == 406
+
+
+@uses_predictor("output_path_image")
+def test_output_binary_async(client):
+    res = client.post(
+        "/predictions", headers={"Prefer": "respond-async, output-encoding=binary"}
+    )
+    assert res.status_code == 406
+
+
+@uses_predictor("output_path_image")
+def test_output_url_without_upload_url(client):
+    res = client.post("/predictions", headers={"Prefer": "output-encoding=url"})
+    assert res.status_code == 400
+
+
+@uses_predictor("output_path_image")
+def test_output_invalid_encoding(client):
+    res = client.post("/predictions", headers={"Prefer": "output-encoding=base32"})
+    assert res.status_code == 400
+
+
+@uses_predictor_with_client_options(
+    "output_path_image", serving={"compression": ["gzip"]}
+)
+def test_compression(client):
+    res = client.post(
+        "/predictions",
+        headers={"Accept-Encoding": "gzip", "Accept": "application/json"},
+    )
+    assert res.status_code == 200
+    assert res.headers["content-encoding"] == "gzip"
+    # The test client decompresses it
+    assert res.json()["output"].startswith("data:image/bmp;base64,")
+
+
+@uses_predictor_with_client_options(
+    "output_path_image", serving={"compression": ["gzip"]}
+)
+def test_compression_not_accepted(client):
+    res = client.post("/predictions", headers={"Accept-Encoding": "identity"})
+    assert res.status_code == 200
+    assert "content-encoding" not in res.headers
+
+
+def test_invalid_compression():
+    from .conftest import make_client
+
+    with pytest.raises(ValueError):
+        make_client("output_path_image", serving={"compression": ["brotli"]})
+
+
+@uses_predictor("output_path_large")
+def test_output_multipart(client):
+    res = client.post(
+        "/predictions", headers={"Accept": "multipart/mixed, application/json"}
+    )
+    assert res.status_code == 200
+    assert res.headers["content-type"].startswith("multipart/mixed; boundary=")
+
+    content_type = res.headers["content-type"].encode()
+    message = email.message_from_bytes(
+        b"Content-Type: " + content_type + b"\r\n\r\n" + res.content
+    )
+    response, output = message.get_payload()
+    assert json.loads(response.get_payload())["output"] == "cid:output-0"
+    assert output["Content-ID"] == "<output-0>"
+    assert output.get_filename() == "large.bin"
+    assert output.get_payload(decode=True) == b"x" * (2 * 1024 * 1024)
+
+
+@uses_predictor("output_path_image")
+def test_output_multipart_small_files_are_inline(client):
+    res = client.post(
+        "/predictions", headers={"Accept": "multipart/mixed, application/json"}
+    )
+    assert res.status_code == 200
+    assert res.json()["output"].startswith("data:image/bmp;base64,")
+
+
+@uses_predictor_with_client_options(
+    "output_path_large", serving={"compression": ["gzip"]}
+)
+def test_output_multipart_not_compressed(client):
+    res = client.post(
+        "/predictions",
+        headers={
+            "Accept": "multipart/mixed, application/json",
+            "Accept-Encoding": "gzip",
+        },
+    )
+    assert res.status_code == 200
+    assert "content-encoding" not in res.headers
@@ -0,0 +1,234 @@
+import threading
+
+import pytest
+
+from cog.server.load_shedding import PredictionQueue, RequestShedError
+
+from .conftest import uses_predictor, uses_predictor_with_client_options
+
+
+def test_queue_without_waiting():
+    queue = PredictionQueue()
+    with queue.turn():
+        with pytest.raises(RequestShedError) as e:
+            with queue.turn():
+                pass
+    assert e.value.reason == "busy"
+    assert queue.shed_counts()["busy"] == 1
+
+    # The turn is free again
+    with queue.turn():
+        pass
+
+
+def test_queue_full():
+    queue = PredictionQueue(max_size=1)
+    running = threading.Event()
+    finish = threading.Event()
+
+    def hold_turn():
+        with queue.turn():
+            running.set()
+            finish.wait()
+
+    holder = threading.Thread(target=hold_turn)
+    holder.start()
+    running.wait()
+
+    def wait_for_turn():
+        with queue.turn():
+            pass
+
+    waiter = threading.Thread(target=wait_for_turn)
+    waiter.start()
+    # Wait for the second request to be queued
+    while queue.length < 1:
+        pass
+
+    with pytest.raises(RequestShedError) as e:
+        with queue.turn():
+            pass
+    assert e.value.reason == "queue_full"
+
+    finish.set()
+    holder.join()
+    waiter.join()
+
+
+def test_queue_timeout():
+    queue = PredictionQueue(max_size=1, timeout=0.01)
+    with queue.turn():
+        with pytest.raises(RequestShedError) as e:
+            with queue.turn():
+                pass
+    assert e.value.reason == "queue_timeout"
+    assert queue.length == 0
+
+
+def test_queue_invalid_config():
+    with pytest.raises(ValueError):
+        PredictionQueue(max_size=-1)
+    with pytest.raises(ValueError):
+        PredictionQueue(max_size=1, timeout=0)
+
+
+def test_queue_metrics():
+    queue = PredictionQueue()
+    queue.shed("busy", "Already running a prediction")
+    metrics = queue.metrics()
+    assert "cog_queue_length 0\n" in metrics
+    assert 'cog_requests_shed_total{reason="busy"} 1\n' in metrics
+    assert 'cog_requests_shed_total{reason="queue_full"} 0\n' in metrics
+
+
+@uses_predictor("sleep")
+def test_metrics_endpoint(client):
+    client.post(
+        "/predictions",
+        json={"input": {"sleep": 1}},
+        headers={"Prefer": "respond-async"},
+    )
+    resp = client.post("/predictions", json={"input": {"sleep": 0}})
+    assert resp.status_code == 409
+
+    resp = client.get("/metrics")
+    assert resp.status_code == 200
+    assert 'cog_requests_shed_total{reason="busy"} 1' in resp.text
+
+
+@uses_predictor_with_client_options("sleep", serving={"max_queue_size": 1})
+def test_async_predictions_wait_for_turn(client):
+    # The first prediction holds the turn until it finishes, not until it's
+    # responded to, so the second waits for it instead of finding the runner
+    # busy
+    for _ in range(2):
+        resp = client.post(
+            "/predictions",
+            json={"input": {"sleep": 0.5}},
+            headers={"Prefer": "respond-async"},
+        )
+        assert resp.status_code == 202
+
+    resp = client.get("/metrics")
+    assert 'cog_requests_shed_total{reason="busy"} 0' in resp.text
+
+
+def test_queue_release_once():
+    queue = PredictionQueue()
+    release = queue.acquire()
+    release()
+    # Releasing again doesn't free a turn someone else has taken
+    release_next = queue.acquire()
+    release()
+    with pytest.raises(RequestShedError):
+        queue.acquire()
+    release_next()
+
+
+def test_queue_priorities():
+    queue = PredictionQueue(max_size=4, priorities=["interactive", "batch"])
+    order = []
+    running = threading.Event()
+    finish = threading.Event()
+
+    def hold_turn():
+        with queue.turn("batch"):
+            running.set()
+            finish.wait()
+
+    holder = threading.Thread(target=hold_turn)
+    holder.start()
+    running.wait()
+
+    def wait_for_turn(name, priority):
+        with queue.turn(priority):
+            order.append(name)
+
+    waiters = []
+    for name, priority in [("b1", "batch"), ("b2", "batch"), ("i1", "interactive")]:
+        waiter = threading.Thread(target=wait_for_turn, args=(name, priority))
+        waiter.start()
+        waiters.append(waiter)
+        while queue.length < len(waiters):
+            pass
+    assert queue.lane_lengths() == {"interactive": 1, "batch": 2}
+
+    finish.set()
+    holder.join()
+    for waiter in waiters:
+        waiter.join()
+    # Interactive jumps ahead of the batch predictions that were waiting
+    assert order == ["i1", "b1", "b2"]
+
+
+def test_queue_priority_header():
+    queue = PredictionQueue(priorities=["interactive", "batch"])
+    assert queue.priority(None) == "interactive"
+    assert queue.priority("batch") == "batch"
+    with pytest.raises(ValueError):
+        queue.priority("urgent")
+
+    queue = PredictionQueue(priorities=["interactive", "batch"], default_priority="batch")
+    assert queue.priority(None) == "batch"
+
+    with pytest.raises(ValueError):
+        PredictionQueue(priorities=["interactive", "batch"], default_priority="urgent")
+    with pytest.raises(ValueError):
+        PredictionQueue(priorities=["batch", "batch"])
+
+
+@uses_predictor_with_client_options(
+    "sleep", serving={"max_queue_size": 1, "priorities": ["interactive", "batch"]}
+)
+def test_priority_header(client):
+    resp = client.post(
+        "/predictions",
+        json={"input": {"sleep": 0}},
+        headers={"X-Cog-Priority": "batch"},
+    )
+    assert resp.status_code == 200
+
+    resp = client.post(
+        "/predictions",
+        json={"input": {"sleep": 0}},
+        headers={"X-Cog-Priority": "urgent"},
+    )
+    assert resp.status_code == 400
+
+    resp = client.get("/metrics")
+    assert 'cog_queue_priority_length{priority="batch"} 0' in resp.text
+
+
+@uses_predictor_with_client_options(
+    "sleep", serving={"max_queue_size": 1, "priorities": ["interactive", "batch"]}
+)
+def test_priority_header_idempotent(client):
+    resp = client.put(
+        "/predictions/abcd1234",
+        json={"input": {"sleep": 0}},
+        headers={"X-Cog-Priority": "batch"},
+    )
+    assert resp.status_code == 200
+
+    resp = client.put(
+        "/predictions/5678efgh",
+        json={"input": {"sleep": 0}},
+        headers={"X-Cog-Priority": "urgent"},
+    )
+    assert resp.status_code == 400
+
+
+@uses_predictor("sleep")
+def test_idempotent_prediction_shed(client):
+    resp = client.put(
+        "/predictions/abcd1234",
+        json={"input": {"sleep": 1}},
+        headers={"Prefer": "respond-async"},
+    )
+    assert resp.status_code == 202
+    resp = client.put("/predictions/5678efgh", json={"input": {"sleep": 0}})
+    assert resp.status_code == 409
+
+    # It's counted as shed, like predictions made with POST
+    resp = client.get("/metrics")
+    assert 'cog_requests_shed_total{reason="busy"} 1' in resp.text
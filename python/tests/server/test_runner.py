@@ -20,6 +20,7 @@ from cog.server.runner import (
     UnknownPredictionError,
     predict,
 )
+from cog.server.tmpdir import PredictionTmpDirs
 
 
 def _fixture_path(name):
@@ -54,6 +55,22 @@ def test_prediction_runner_setup():
         runner.shutdown()
 
 
+def test_prediction_runner_setup_with_warmup():
+    runner = PredictionRunner(
+        predictor_ref=_fixture_path("logging"),
+        shutdown_event=threading.Event(),
+        warmup_inputs=[{}],
+    )
+    try:
+        result = runner.setup().get(5)
+
+        assert result["status"] == Status.SUCCEEDED
+        # The predictor's logs from the warmup prediction end up in setup logs
+        assert "writing with print" in result["logs"]
+    finally:
+        runner.shutdown()
+
+
 def test_prediction_runner(runner):
     request = PredictionRequest(input={"sleep": 0.1})
     _, async_result = runner.predict(request)
@@ -61,6 +78,20 @@ def test_prediction_runner(runner):
     assert response.output == "done in 0.1 seconds"
     assert response.status == "succeeded"
     assert response.error is None
+
+
+def test_prediction_runner_on_done(runner):
+    done = threading.Event()
+    busy_when_done = []
+
+    def on_done():
+        busy_when_done.append(runner.is_busy())
+        done.set()
+
+    runner.predict(PredictionRequest(input={"sleep": 0.1}), on_done=on_done)
+    assert done.wait(timeout=1)
+    # Another prediction can be started as soon as it's called
+    assert busy_when_done == [False]
     assert response.logs == ""
     assert isinstance(response.started_at, datetime)
     assert isinstance(response.completed_at, datetime)
@@ -144,6 +175,50 @@ def test_prediction_runner_cancel_by_mismatched_id(runner):
     assert response.status == "succeeded"
 
 
+def test_prediction_runner_running_prediction(runner):
+    request = PredictionRequest(id="abcd1234", input={"sleep": 0.5})
+    initial_response, async_result = runner.predict(request)
+
+    # A retry gets the same response
+    assert runner.running_prediction("abcd1234") is initial_response
+    assert runner.running_prediction("5678efgh") is None
+    retry_response, _ = runner.predict(request)
+    assert retry_response is initial_response
+
+    async_result.get(timeout=1)
+    assert runner.running_prediction("abcd1234") is None
+
+
+def test_prediction_runner_tmp_dir(tmp_path):
+    tmp_dirs = PredictionTmpDirs(quota=1000, root=str(tmp_path))
+    runner = PredictionRunner(
+        predictor_ref=_fixture_path("write_tmp"),
+        shutdown_event=threading.Event(),
+        tmp_dirs=tmp_dirs,
+    )
+    try:
+        runner.setup().get(5)
+
+        # Output files are kept until the caller releases them
+        initial_response, async_result = runner.predict(
+            PredictionRequest(input={"size": 10}), upload=False
+        )
+        response = async_result.get(timeout=5)
+        assert response.status == "succeeded"
+        assert str(response.output).startswith(str(tmp_path))
+        assert os.path.exists(response.output)
+        runner.release(initial_response)
+        assert not os.path.exists(response.output)
+
+        _, async_result = runner.predict(PredictionRequest(input={"size": 2000}))
+        response = async_result.get(timeout=5)
+        assert response.status == "failed"
+        assert "serving.tmp_dir_quota" in response.error
+        assert os.listdir(tmp_path) == []
+    finally:
+        runner.shutdown()
+
+
 # list of (events, calls)
 PREDICT_TESTS = [
     ([Heartbeat()], []),
@@ -184,7 +259,7 @@ PREDICT_TESTS = [
 
 def fake_worker(events):
     class FakeWorker:
-        def predict(self, input_, poll=None):
+        def predict(self, input_, poll=None, model=None, tmp_dir=None):
             for e in events:
                 yield e
 
@@ -0,0 +1,55 @@
+import os
+import tempfile
+
+import pytest
+
+from cog.server.tmpdir import TMP_DIR_ENV, PredictionTmpDirs, parse_size, use_tmp_dir
+
+
+def test_parse_size():
+    assert parse_size("512") == 512
+    assert parse_size("10GB") == 10 * 1000**3
+    assert parse_size("1.5 mb") == 1500 * 1000
+    assert parse_size("2G") == 2 * 1000**3
+    with pytest.raises(ValueError):
+        parse_size("lots")
+
+
+def test_create_and_remove(tmp_path):
+    tmp_dirs = PredictionTmpDirs(quota=10, root=str(tmp_path / "predictions"))
+    path = tmp_dirs.create()
+    assert os.path.dirname(path) == tmp_dirs.root
+
+    with open(os.path.join(path, "output.png"), "wb") as f:
+        f.write(b"x" * 8)
+    assert tmp_dirs.usage(path) == 8
+    assert not tmp_dirs.over_quota(path)
+    os.makedirs(os.path.join(path, "frames"))
+    with open(os.path.join(path, "frames", "0.png"), "wb") as f:
+        f.write(b"x" * 8)
+    assert tmp_dirs.over_quota(path)
+
+    tmp_dirs.remove(path)
+    assert not os.path.exists(path)
+
+    # Directories left behind by an earlier server
+    orphan = tmp_dirs.create()
+    tmp_dirs.remove_all()
+    assert not os.path.exists(orphan)
+
+
+def test_no_quota(tmp_path):
+    tmp_dirs = PredictionTmpDirs.from_config({})
+    assert tmp_dirs.quota is None
+    assert not tmp_dirs.over_quota(str(tmp_path))
+    assert PredictionTmpDirs.from_config({"serving": {"tmp_dir_quota": "1GB"}}).quota == 1000**3
+
+
+def test_use_tmp_dir(tmp_path, monkeypatch):
+    monkeypatch.delenv(TMP_DIR_ENV, raising=False)
+    with use_tmp_dir(str(tmp_path)):
+        assert os.environ[TMP_DIR_ENV] == str(tmp_path)
+        with tempfile.NamedTemporaryFile() as f:
+            assert os.path.dirname(f.name) == str(tmp_path)
+    assert TMP_DIR_ENV not in os.environ
+    assert tempfile.gettempdir() != str(tmp_path)
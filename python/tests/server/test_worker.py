@@ -24,7 +24,7 @@ from cog.server.eventtypes import (
     PredictionOutputType,
 )
 from cog.server.exceptions import FatalWorkerException, InvalidStateException
-from cog.server.worker import Worker
+from cog.server.worker import Models, Worker
 
 # Set a longer deadline on CI as the instances are a bit slower.
 settings.register_profile("ci", max_examples=100, deadline=1000)
@@ -367,6 +367,43 @@ def test_cancel_multiple_predictions():
         w.terminate()
 
 
+def test_preempt():
+    """
+    A preempted prediction can catch Preempted and return early, and is
+    reported as preempted rather than succeeded.
+    """
+    w = Worker(
+        predictor_ref=_fixture_path("preempt"), tee_output=False, preemption_grace=10
+    )
+
+    try:
+        _process(w.setup())
+
+        preempted = False
+        output = None
+        done = None
+        for event in w.predict({"steps": 100}, poll=0.01):
+            if not preempted:
+                time.sleep(0.2)
+                w.preempt()
+                preempted = True
+            if isinstance(event, PredictionOutput):
+                output = event.payload
+            if isinstance(event, Done):
+                done = event
+
+        assert done == Done(preempted=True)
+        assert output.startswith("checkpointed at step")
+        assert output.endswith("deadline True")
+
+        # The next prediction isn't preempted
+        result = _process(w.predict({"steps": 2}))
+        assert result.done == Done()
+        assert result.output == "finished"
+    finally:
+        w.terminate()
+
+
 def test_heartbeats():
     """
     Passing the `poll` keyword argument to predict should result in regular
@@ -556,3 +593,21 @@ class WorkerState(RuleBasedStateMachine):
 
 
 TestWorkerState = WorkerState.TestCase
+
+
+def test_models_from_config():
+    assert Models.from_config({}) is None
+
+    models = Models.from_config(
+        {
+            "models": {"a": {"weights": "weights/a"}, "b": {"weights": "weights/b"}},
+            "default_model": "b",
+            "serving": {"max_loaded_models": 1},
+        }
+    )
+    assert models.weights == {"a": "weights/a", "b": "weights/b"}
+    assert models.default == "b"
+    assert models.max_loaded == 1
+
+    with pytest.raises(ValueError):
+        Models(weights={"a": "weights/a"}, default="c")
@@ -0,0 +1,48 @@
+import importlib.util
+from types import SimpleNamespace
+
+import pytest
+
+from cog.command.export_onnx import MissingPackagesError, check_packages, metadata
+
+
+def test_metadata():
+    model = SimpleNamespace(
+        ir_version=8,
+        opset_import=[
+            SimpleNamespace(domain="", version=17),
+            SimpleNamespace(domain="com.microsoft", version=1),
+        ],
+        producer_name="pytorch",
+        producer_version="2.3.1",
+    )
+    assert metadata(model, "1.16.0", "1.18.0") == {
+        "ir_version": 8,
+        "opsets": {"ai.onnx": 17, "com.microsoft": 1},
+        "producer_name": "pytorch",
+        "producer_version": "2.3.1",
+        "onnx_version": "1.16.0",
+        "onnxruntime_version": "1.18.0",
+    }
+
+
+def test_check_packages_installed(monkeypatch):
+    monkeypatch.setattr(importlib.util, "find_spec", lambda name: object())
+    check_packages()
+
+
+@pytest.mark.parametrize(
+    "installed,message",
+    [
+        ({"onnx"}, "needs onnxruntime, which is not installed"),
+        (set(), "needs onnx and onnxruntime, which are not installed"),
+    ],
+)
+def test_check_packages_missing(monkeypatch, installed, message):
+    monkeypatch.setattr(
+        importlib.util,
+        "find_spec",
+        lambda name: object() if name in installed else None,
+    )
+    with pytest.raises(MissingPackagesError, match=message):
+        check_packages()
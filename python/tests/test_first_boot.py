@@ -0,0 +1,54 @@
+import json
+
+import pytest
+
+from cog.first_boot import FirstBoot, FirstBootError
+
+
+@pytest.fixture(autouse=True)
+def tmpdir_marker(tmp_path, monkeypatch):
+    # Each test gets its own marker of having run
+    monkeypatch.setattr("tempfile.tempdir", str(tmp_path))
+
+
+def test_first_boot_runs_build_and_config_steps_once(tmp_path, monkeypatch):
+    record = tmp_path / "first_boot.json"
+    record.write_text(json.dumps({"run": [{"command": "echo build >> out.txt"}]}))
+    monkeypatch.chdir(tmp_path)
+    config = {
+        "first_boot": {
+            "cache_dir": str(tmp_path / "cache"),
+            "steps": [{"run": "echo $COG_FIRST_BOOT_CACHE >> out.txt"}],
+        }
+    }
+
+    first_boot = FirstBoot(config, path=str(record))
+    assert first_boot.progress() == {
+        "status": "pending",
+        "steps": 2,
+        "completed": 0,
+        "current": None,
+    }
+    first_boot.run()
+    assert first_boot.progress()["status"] == "succeeded"
+    assert (tmp_path / "out.txt").read_text() == f"build\n{tmp_path / 'cache'}\n"
+
+    # It's only run once per container
+    FirstBoot(config, path=str(record)).run()
+    assert (tmp_path / "out.txt").read_text() == f"build\n{tmp_path / 'cache'}\n"
+
+
+def test_first_boot_failure(tmp_path):
+    first_boot = FirstBoot(
+        {"first_boot": {"steps": [{"run": "exit 3"}]}},
+        path=str(tmp_path / "missing.json"),
+    )
+    with pytest.raises(FirstBootError, match="failed with exit code 3"):
+        first_boot.run()
+    assert first_boot.progress()["status"] == "failed"
+
+
+def test_first_boot_without_steps(tmp_path):
+    first_boot = FirstBoot({}, path=str(tmp_path / "missing.json"))
+    assert first_boot.progress() is None
+    first_boot.run()